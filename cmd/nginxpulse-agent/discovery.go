@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/likaia/nginxpulse/internal/ingest/envelope"
+	"github.com/sirupsen/logrus"
+)
+
+// inputConfig 一组日志文件及其目标站点。paths 支持 glob，按 discoverInterval 周期性重新匹配；
+// websiteID / sourceID 可以引用 match 正则的捕获组（$1、${name}），从文件路径推导站点
+type inputConfig struct {
+	Paths     []string `json:"paths"`
+	Match     string   `json:"match"`
+	WebsiteID string   `json:"websiteID"`
+	SourceID  string   `json:"sourceID"`
+	// Websites：可选，把展开后的 websiteID（例如文件名中的域名）映射为实际站点 ID；配置后未列出的文件会被忽略。
+	Websites map[string]string `json:"websites"`
+	// Format：可选，docker / cri 解开容器运行时的 JSON、CRI 封装（两种格式按行自动识别），journald 读取 journal export 文件的 MESSAGE。
+	Format string `json:"format"`
+	// Stream：docker / cri 只推送的输出流：stdout（默认）/ stderr / all。
+	Stream string `json:"stream"`
+	// Containers、Labels：docker / cri 按容器名（支持通配符）与标签过滤文件；journald 按 CONTAINER_NAME 过滤条目。
+	Containers []string          `json:"containers"`
+	Labels     map[string]string `json:"labels"`
+	// Units：journald 按 _SYSTEMD_UNIT 或 SYSLOG_IDENTIFIER 过滤条目，支持通配符。
+	Units []string `json:"units"`
+}
+
+type compiledInput struct {
+	inputConfig
+	match  *regexp.Regexp
+	format *envelope.Options // nil 表示原样读取
+}
+
+// routeTarget 推送目标，每个目标独立读取、推送与退避
+type routeTarget struct {
+	websiteID string
+	sourceID  string
+}
+
+func (t routeTarget) key() string {
+	return t.websiteID + "/" + t.sourceID
+}
+
+// compileInputs 顶层 paths/websiteID/sourceID 视为第一组输入，之后依次是 inputs
+func compileInputs(cfg *agentConfig) ([]compiledInput, error) {
+	inputs := make([]inputConfig, 0, len(cfg.Inputs)+1)
+	if len(cfg.Paths) > 0 {
+		inputs = append(inputs, inputConfig{
+			Paths:     cfg.Paths,
+			WebsiteID: cfg.WebsiteID,
+			SourceID:  cfg.SourceID,
+		})
+	}
+	inputs = append(inputs, cfg.Inputs...)
+
+	compiled := make([]compiledInput, 0, len(inputs))
+	for i, input := range inputs {
+		if len(input.Paths) == 0 {
+			return nil, fmt.Errorf("inputs[%d].paths 不能为空", i)
+		}
+		if strings.TrimSpace(input.WebsiteID) == "" {
+			return nil, fmt.Errorf("inputs[%d].websiteID 不能为空", i)
+		}
+		item := compiledInput{inputConfig: input}
+		if pattern := strings.TrimSpace(input.Match); pattern != "" {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("inputs[%d].match 无效: %w", i, err)
+			}
+			item.match = re
+		}
+		for _, pattern := range input.Paths {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("inputs[%d].paths 无效: %s", i, pattern)
+			}
+		}
+		if strings.TrimSpace(input.Format) != "" {
+			opts := envelope.Options{
+				Format:     envelope.NormalizeFormat(input.Format),
+				Stream:     input.Stream,
+				Units:      input.Units,
+				Containers: input.Containers,
+			}
+			if err := opts.Validate(); err != nil {
+				return nil, fmt.Errorf("inputs[%d]: %w", i, err)
+			}
+			item.format = &opts
+		}
+		compiled = append(compiled, item)
+	}
+	return compiled, nil
+}
+
+// resolve 计算文件所属站点；match 不匹配或站点不在 websites 中时返回 false
+func (in *compiledInput) resolve(path string) (routeTarget, bool) {
+	websiteID, sourceID := in.WebsiteID, in.SourceID
+	if in.match != nil {
+		submatches := in.match.FindStringSubmatchIndex(path)
+		if submatches == nil {
+			return routeTarget{}, false
+		}
+		websiteID = string(in.match.ExpandString(nil, websiteID, path, submatches))
+		sourceID = string(in.match.ExpandString(nil, sourceID, path, submatches))
+	}
+	websiteID = strings.TrimSpace(websiteID)
+	if len(in.Websites) > 0 {
+		mapped, ok := in.Websites[websiteID]
+		if !ok {
+			return routeTarget{}, false
+		}
+		websiteID = mapped
+	}
+	if websiteID == "" {
+		return routeTarget{}, false
+	}
+	sourceID = strings.TrimSpace(sourceID)
+	if sourceID == "" {
+		sourceID = "agent"
+	}
+	return routeTarget{websiteID: websiteID, sourceID: sourceID}, true
+}
+
+// containerFilter 是否需要按容器名或标签筛选文件
+func (in *compiledInput) containerFilter() bool {
+	if in.format == nil || in.format.Format == envelope.FormatJournald {
+		return false
+	}
+	return len(in.Containers) > 0 || len(in.Labels) > 0
+}
+
+// discoverFiles 展开所有 glob 并按站点分组。同一文件只归属于第一个匹配的输入；
+// formats 记录需要解开封装的文件及其解码选项
+func discoverFiles(inputs []compiledInput) (map[routeTarget][]string, map[string]*envelope.Options) {
+	assignment := make(map[routeTarget][]string)
+	formats := make(map[string]*envelope.Options)
+	claimed := make(map[string]bool)
+	for i := range inputs {
+		input := &inputs[i]
+		for _, pattern := range input.Paths {
+			for _, path := range expandPattern(pattern) {
+				if claimed[path] || strings.HasSuffix(strings.ToLower(path), ".gz") {
+					continue
+				}
+				target, ok := input.resolve(path)
+				if !ok {
+					continue
+				}
+				if input.containerFilter() && !envelope.MatchContainer(path, input.Containers, input.Labels) {
+					continue
+				}
+				claimed[path] = true
+				assignment[target] = append(assignment[target], path)
+				if input.format != nil {
+					formats[path] = input.format
+				}
+			}
+		}
+	}
+	return assignment, formats
+}
+
+// expandPattern 普通路径原样返回（文件暂不存在时由读取处报错）；glob 只返回已存在的普通文件
+func expandPattern(pattern string) []string {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		logrus.WithError(err).Warnf("匹配日志路径失败: %s", pattern)
+		return nil
+	}
+	files := matches[:0]
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, path)
+	}
+	return files
+}
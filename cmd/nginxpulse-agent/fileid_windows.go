@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// fileIdentity Windows 下不提供 inode，只能依赖文件大小判断截断
+func fileIdentity(info os.FileInfo) fileID {
+	return fileID{}
+}
+
+func syncDir(dir string) error {
+	return nil
+}
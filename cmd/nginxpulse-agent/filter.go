@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultFilterLogRegex 从 nginx combined 格式中提取过滤所需的字段
+const defaultFilterLogRegex = `^\S+ \S+ \S+ \[[^\]]+\] "\S+ (?P<url>[^"\s]+)[^"]*" (?P<status>\d{3}) \S+ "[^"]*" "(?P<ua>[^"]*)"`
+
+// filterConfig 推送前的本地过滤：先按 drop 规则丢弃，再按 sample 规则确定性采样（保留 1/rate）。
+// 采样保留的行会带上采样倍数一起推送，服务端统计时按倍数还原
+type filterConfig struct {
+	// LogRegex 提取 url、status、ua 的命名分组正则，留空时使用 nginx combined 格式；JSON 行按常见字段名提取
+	LogRegex string       `json:"logRegex"`
+	Drop     []filterRule `json:"drop"`
+	Sample   []filterRule `json:"sample"`
+}
+
+// filterRule 规则中设置的条件需全部满足才算匹配
+type filterRule struct {
+	Line       string   `json:"line"`       // 整行正则
+	PathPrefix []string `json:"pathPrefix"` // 请求路径前缀，任一匹配即可
+	Status     []string `json:"status"`     // 状态码，支持 "404"、"4xx"
+	UserAgent  string   `json:"userAgent"`  // User-Agent 正则
+	Rate       int      `json:"rate"`       // sample 规则：每 rate 行保留 1 行
+}
+
+type compiledRule struct {
+	line       *regexp.Regexp
+	pathPrefix []string
+	status     []string
+	userAgent  *regexp.Regexp
+	rate       int
+}
+
+// lineFilter 编译后的过滤规则；nil 表示不过滤
+type lineFilter struct {
+	logRegex   *regexp.Regexp
+	urlIndex   int
+	statusIdx  int
+	uaIndex    int
+	drop       []compiledRule
+	sample     []compiledRule
+	needFields bool
+}
+
+// lineFields 过滤规则使用的请求字段
+type lineFields struct {
+	path   string
+	status string
+	ua     string
+}
+
+// filterStats 过滤与采样计数
+type filterStats struct {
+	dropped    int64
+	sampledOut int64
+}
+
+func compileFilter(cfg *filterConfig) (*lineFilter, error) {
+	if cfg == nil || (len(cfg.Drop) == 0 && len(cfg.Sample) == 0) {
+		return nil, nil
+	}
+	pattern := strings.TrimSpace(cfg.LogRegex)
+	if pattern == "" {
+		pattern = defaultFilterLogRegex
+	}
+	logRegex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("filters.logRegex 无效: %w", err)
+	}
+	f := &lineFilter{
+		logRegex:  logRegex,
+		urlIndex:  logRegex.SubexpIndex("url"),
+		statusIdx: logRegex.SubexpIndex("status"),
+		uaIndex:   logRegex.SubexpIndex("ua"),
+	}
+	for i, rule := range cfg.Drop {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("filters.drop[%d]: %w", i, err)
+		}
+		f.drop = append(f.drop, compiled)
+	}
+	for i, rule := range cfg.Sample {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("filters.sample[%d]: %w", i, err)
+		}
+		if compiled.rate < 1 {
+			return nil, fmt.Errorf("filters.sample[%d]: rate 必须大于 0", i)
+		}
+		f.sample = append(f.sample, compiled)
+	}
+	for _, rules := range [][]compiledRule{f.drop, f.sample} {
+		for _, rule := range rules {
+			if rule.usesFields() {
+				f.needFields = true
+			}
+		}
+	}
+	return f, nil
+}
+
+func compileRule(rule filterRule) (compiledRule, error) {
+	compiled := compiledRule{rate: rule.Rate}
+	if strings.TrimSpace(rule.Line) != "" {
+		re, err := regexp.Compile(rule.Line)
+		if err != nil {
+			return compiled, fmt.Errorf("line 正则无效: %w", err)
+		}
+		compiled.line = re
+	}
+	if strings.TrimSpace(rule.UserAgent) != "" {
+		re, err := regexp.Compile(rule.UserAgent)
+		if err != nil {
+			return compiled, fmt.Errorf("userAgent 正则无效: %w", err)
+		}
+		compiled.userAgent = re
+	}
+	for _, prefix := range rule.PathPrefix {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			compiled.pathPrefix = append(compiled.pathPrefix, prefix)
+		}
+	}
+	for _, status := range rule.Status {
+		status = strings.ToLower(strings.TrimSpace(status))
+		if status == "" {
+			continue
+		}
+		if len(status) != 3 || !strings.ContainsAny(status[:1], "12345") ||
+			strings.Trim(status[1:], "0123456789x") != "" {
+			return compiled, fmt.Errorf("status 格式不正确: %s", status)
+		}
+		compiled.status = append(compiled.status, status)
+	}
+	if compiled.line == nil && compiled.userAgent == nil && len(compiled.pathPrefix) == 0 && len(compiled.status) == 0 {
+		return compiled, errors.New("规则至少需要一个条件")
+	}
+	return compiled, nil
+}
+
+// apply 返回该行的采样倍数：0 表示丢弃，1 表示原样推送，N 表示该行代表 N 行
+func (f *lineFilter) apply(line string, stats *filterStats) int {
+	if f == nil {
+		return 1
+	}
+	var fields *lineFields
+	if f.needFields {
+		fields = f.extract(line)
+	}
+	for _, rule := range f.drop {
+		if rule.match(line, fields) {
+			stats.dropped++
+			return 0
+		}
+	}
+	for _, rule := range f.sample {
+		if !rule.match(line, fields) {
+			continue
+		}
+		if rule.rate <= 1 {
+			return 1
+		}
+		// 按行内容哈希取模：同一行无论重放或重启都得到相同结果
+		h := fnv.New32a()
+		h.Write([]byte(line))
+		if h.Sum32()%uint32(rule.rate) != 0 {
+			stats.sampledOut++
+			return 0
+		}
+		return rule.rate
+	}
+	return 1
+}
+
+func (r compiledRule) match(line string, fields *lineFields) bool {
+	if r.line != nil && !r.line.MatchString(line) {
+		return false
+	}
+	if !r.usesFields() {
+		return true
+	}
+	if fields == nil {
+		// 无法提取字段的行不匹配字段条件
+		return false
+	}
+	if len(r.pathPrefix) > 0 {
+		matched := false
+		for _, prefix := range r.pathPrefix {
+			if strings.HasPrefix(fields.path, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.status) > 0 {
+		matched := false
+		for _, status := range r.status {
+			if statusMatches(status, fields.status) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.userAgent != nil && !r.userAgent.MatchString(fields.ua) {
+		return false
+	}
+	return true
+}
+
+func (r compiledRule) usesFields() bool {
+	return len(r.pathPrefix) > 0 || len(r.status) > 0 || r.userAgent != nil
+}
+
+func statusMatches(pattern, status string) bool {
+	if len(status) != len(pattern) {
+		return false
+	}
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != 'x' && pattern[i] != status[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// extract 提取请求路径、状态码与 User-Agent；JSON 行按常见字段名查找
+func (f *lineFilter) extract(line string) *lineFields {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "{") {
+		return extractJSONFields(trimmed)
+	}
+	match := f.logRegex.FindStringSubmatch(line)
+	if match == nil {
+		return nil
+	}
+	fields := &lineFields{}
+	if f.urlIndex > 0 {
+		fields.path = match[f.urlIndex]
+	}
+	if f.statusIdx > 0 {
+		fields.status = match[f.statusIdx]
+	}
+	if f.uaIndex > 0 {
+		fields.ua = match[f.uaIndex]
+	}
+	return fields
+}
+
+func extractJSONFields(line string) *lineFields {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &data); err != nil {
+		return nil
+	}
+	fields := &lineFields{
+		path:   firstString(data, "request_uri", "uri", "path", "url"),
+		status: jsonStatus(data["status"]),
+		ua:     firstString(data, "http_user_agent", "user_agent", "ua"),
+	}
+	if fields.path == "" {
+		// nginx $request："GET /path HTTP/1.1"
+		if parts := strings.Fields(firstString(data, "request")); len(parts) >= 2 {
+			fields.path = parts[1]
+		}
+	}
+	// caddy：{"request": {"uri": "...", "headers": {"User-Agent": ["..."]}}}
+	if request, ok := data["request"].(map[string]interface{}); ok {
+		if fields.path == "" {
+			fields.path = firstString(request, "uri")
+		}
+		if headers, ok := request["headers"].(map[string]interface{}); ok && fields.ua == "" {
+			if values, ok := headers["User-Agent"].([]interface{}); ok && len(values) > 0 {
+				fields.ua, _ = values[0].(string)
+			}
+		}
+	}
+	return fields
+}
+
+func firstString(data map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := data[key].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func jsonStatus(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.Itoa(int(v))
+	case string:
+		return strings.TrimSpace(v)
+	}
+	return ""
+}
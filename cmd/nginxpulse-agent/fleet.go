@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/version"
+	"github.com/sirupsen/logrus"
+)
+
+const heartbeatTimeout = 30 * time.Second
+
+// routeStatus 单个站点的推送状态，随心跳上报
+type routeStatus struct {
+	WebsiteID    string `json:"website_id"`
+	SourceID     string `json:"source_id"`
+	Files        int    `json:"files"`
+	LagBytes     int64  `json:"lag_bytes"`
+	PendingLines int    `json:"pending_lines"`
+	SpoolBytes   int64  `json:"spool_bytes"`
+	Failures     int    `json:"failures"`
+	Dropped      int64  `json:"dropped_lines,omitempty"`
+	SampledOut   int64  `json:"sampled_out_lines,omitempty"`
+	LastPushAt   int64  `json:"last_push_at,omitempty"`
+	LastError    string `json:"last_error,omitempty"`
+	paths        []string
+}
+
+type heartbeatRequest struct {
+	AgentID           string        `json:"agent_id"`
+	Hostname          string        `json:"hostname"`
+	Version           string        `json:"version"`
+	HeartbeatInterval int64         `json:"heartbeat_interval"`
+	Paths             []string      `json:"paths"`
+	Routes            []routeStatus `json:"routes"`
+	ConfigVersion     int64         `json:"config_version"`
+}
+
+type heartbeatResponse struct {
+	Config        json.RawMessage `json:"config"`
+	ConfigVersion int64           `json:"config_version"`
+}
+
+// remoteConfig 允许服务端下发的配置项，未出现的字段保持本地配置
+type remoteConfig struct {
+	WebsiteID         *string        `json:"websiteID"`
+	SourceID          *string        `json:"sourceID"`
+	Paths             *[]string      `json:"paths"`
+	Inputs            *[]inputConfig `json:"inputs"`
+	PollInterval      *string        `json:"pollInterval"`
+	BatchSize         *int           `json:"batchSize"`
+	FlushInterval     *string        `json:"flushInterval"`
+	RequestTimeout    *string        `json:"requestTimeout"`
+	MaxPendingLines   *int           `json:"maxPendingLines"`
+	MaxLineBytes      *int           `json:"maxLineBytes"`
+	RetryBackoffMin   *string        `json:"retryBackoffMin"`
+	RetryBackoffMax   *string        `json:"retryBackoffMax"`
+	DiscoverInterval  *string        `json:"discoverInterval"`
+	HeartbeatInterval *string        `json:"heartbeatInterval"`
+	Filters           *filterConfig  `json:"filters"`
+}
+
+func (r *remoteConfig) applyTo(cfg *agentConfig) {
+	setString := func(dst *string, src *string) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	setInt := func(dst *int, src *int) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	setString(&cfg.WebsiteID, r.WebsiteID)
+	setString(&cfg.SourceID, r.SourceID)
+	if r.Paths != nil {
+		cfg.Paths = *r.Paths
+	}
+	if r.Inputs != nil {
+		cfg.Inputs = *r.Inputs
+	}
+	setString(&cfg.PollInterval, r.PollInterval)
+	setInt(&cfg.BatchSize, r.BatchSize)
+	setString(&cfg.FlushInterval, r.FlushInterval)
+	setString(&cfg.RequestTimeout, r.RequestTimeout)
+	setInt(&cfg.MaxPendingLines, r.MaxPendingLines)
+	setInt(&cfg.MaxLineBytes, r.MaxLineBytes)
+	setString(&cfg.RetryBackoffMin, r.RetryBackoffMin)
+	setString(&cfg.RetryBackoffMax, r.RetryBackoffMax)
+	setString(&cfg.DiscoverInterval, r.DiscoverInterval)
+	setString(&cfg.HeartbeatInterval, r.HeartbeatInterval)
+	if r.Filters != nil {
+		cfg.Filters = r.Filters
+	}
+}
+
+// heartbeat 向服务端注册并上报各站点状态；响应中的远程配置版本变化时合并生效
+func (rt *agentRuntime) heartbeat() {
+	resp, err := rt.sendHeartbeat()
+	if err != nil {
+		// 旧版服务端没有该接口，避免刷屏：最多每 10 分钟打印一次
+		if time.Since(rt.lastHeartbeatFailed) > 10*time.Minute {
+			rt.lastHeartbeatFailed = time.Now()
+			logrus.WithError(err).Warn("agent 心跳上报失败")
+		}
+		return
+	}
+	if resp.ConfigVersion == rt.configVersion || resp.ConfigVersion == rt.rejectedVersion {
+		return
+	}
+	if err := rt.applyRemoteConfig(resp.Config); err != nil {
+		rt.rejectedVersion = resp.ConfigVersion
+		logrus.WithError(err).WithField("config_version", resp.ConfigVersion).Warn("远程配置无效，继续使用当前配置")
+		return
+	}
+	rt.configVersion = resp.ConfigVersion
+	rt.rejectedVersion = 0
+	logrus.WithField("config_version", resp.ConfigVersion).Info("remote config applied")
+	rt.logConfig()
+}
+
+func (rt *agentRuntime) sendHeartbeat() (heartbeatResponse, error) {
+	var result heartbeatResponse
+	req := heartbeatRequest{
+		AgentID:           rt.agentID,
+		Hostname:          rt.hostname,
+		Version:           version.Version,
+		HeartbeatInterval: int64(rt.heartbeatInterval / time.Second),
+		Paths:             make([]string, 0),
+		Routes:            make([]routeStatus, 0, len(rt.routes)),
+		ConfigVersion:     rt.configVersion,
+	}
+	for _, r := range rt.routes {
+		status := r.snapshot()
+		if status.WebsiteID == "" {
+			status.WebsiteID, status.SourceID = r.target.websiteID, r.target.sourceID
+		}
+		req.Paths = append(req.Paths, status.paths...)
+		req.Routes = append(req.Routes, status)
+	}
+	sort.Strings(req.Paths)
+	sort.Slice(req.Routes, func(i, j int) bool {
+		return req.Routes[i].WebsiteID+"/"+req.Routes[i].SourceID < req.Routes[j].WebsiteID+"/"+req.Routes[j].SourceID
+	})
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return result, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, strings.TrimRight(rt.cfg.Server, "/")+"/api/agents/heartbeat", bytes.NewReader(payload))
+	if err != nil {
+		return result, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if key := strings.TrimSpace(rt.cfg.AccessKey); key != "" {
+		httpReq.Header.Set("X-NginxPulse-Key", key)
+	}
+	client := &http.Client{Timeout: heartbeatTimeout}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return result, fmt.Errorf("heartbeat http status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
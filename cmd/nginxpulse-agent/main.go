@@ -43,18 +43,48 @@ type agentConfig struct {
 	// ExitOnMaxBackoff：当退避已达到 RetryBackoffMax 且再次推送仍失败时，是否直接退出进程（让 k8s 重启容器）。
 	// 默认：false。
 	ExitOnMaxBackoff bool `json:"exitOnMaxBackoff"`
+	// StateFile：本地偏移量状态文件路径，推送成功后写入，重启后从该位置继续读取。
+	// 默认：var/nginxpulse_agent_state.json。
+	StateFile string `json:"stateFile"`
+	// SpoolDir：磁盘缓冲目录。推送失败时把待发送日志写入该目录，服务端恢复后按顺序重放；留空表示不启用。
+	SpoolDir string `json:"spoolDir"`
+	// SpoolMaxBytes：磁盘缓冲总大小上限（byte）。默认：512MiB。
+	SpoolMaxBytes int64 `json:"spoolMaxBytes"`
+	// SpoolMaxAge：缓冲数据的最长保留时间（例如 "72h"），超过后丢弃；留空表示不限制。
+	SpoolMaxAge string `json:"spoolMaxAge"`
+	// SpoolFullPolicy：缓冲写满后的策略。drop_oldest（默认）丢弃最旧的分段；block 停止写入缓冲，pending 满后暂停读取。
+	SpoolFullPolicy string `json:"spoolFullPolicy"`
+	// Protocol：推送协议。v2（默认）为压缩批次 + 序号确认，重试只入库一次；v1 为旧版未压缩 JSON，用于兼容旧服务端。
+	Protocol string `json:"protocol"`
+	// Compression：v2 请求体压缩方式：gzip（默认）、zstd 或 none。
+	Compression string `json:"compression"`
+	// AgentID：agent 唯一标识，实际上报为 agentID/sourceID，服务端按它与 websiteID 记录已确认的批次序号。默认：主机名。
+	AgentID string `json:"agentID"`
+	// Inputs：多站点输入。每组包含 paths（支持 glob）、目标 websiteID/sourceID，可用 match 正则从文件路径中提取站点。
+	// 顶层 paths/websiteID/sourceID 等价于第一组输入。
+	Inputs []inputConfig `json:"inputs"`
+	// DiscoverInterval：重新匹配 glob、发现新日志文件的间隔（例如 "30s"）。默认：30s。
+	DiscoverInterval string `json:"discoverInterval"`
+	// HeartbeatInterval：向服务端注册、上报状态并拉取远程配置的间隔（例如 "30s"）。默认：30s；设为 "0" 关闭。
+	HeartbeatInterval string `json:"heartbeatInterval"`
+	// Filters：推送前的本地过滤与采样。drop 规则匹配的行直接丢弃；sample 规则按 rate 确定性保留 1/rate，
+	// 保留的行带上采样倍数推送，服务端统计 PV、流量与状态码时按倍数还原。
+	Filters *filterConfig `json:"filters"`
 }
 
 type ingestRequest struct {
-	WebsiteID string   `json:"website_id"`
-	SourceID  string   `json:"source_id"`
-	Lines     []string `json:"lines"`
+	WebsiteID   string   `json:"website_id"`
+	SourceID    string   `json:"source_id"`
+	Lines       []string `json:"lines"`
+	SampleRates []int    `json:"sample_rates,omitempty"`
 }
 
 type fileState struct {
 	offset   int64
 	lastSize int64
 	partial  string
+	id       fileID
+	file     *os.File
 }
 
 type readStats struct {
@@ -67,6 +97,9 @@ type readStats struct {
 	hasPartial bool
 	skippedLines int
 	maxLineBytes int
+	// 轮转后读完并关闭的旧文件及其最终位置
+	retiredID     fileID
+	retiredOffset int64
 }
 
 func main() {
@@ -80,222 +113,46 @@ func main() {
 	}
 	applyEnvOverrides(cfg)
 
-	pollInterval := parseDuration(cfg.PollInterval, time.Second)
-	flushInterval := parseDuration(cfg.FlushInterval, 2*time.Second)
-	requestTimeout := parseDuration(cfg.RequestTimeout, 90*time.Second)
-	backoffMin := parseDuration(cfg.RetryBackoffMin, time.Second)
-	backoffMax := parseDuration(cfg.RetryBackoffMax, 30*time.Second)
-	batchSize := cfg.BatchSize
-	if batchSize <= 0 {
-		batchSize = 200
-	}
-	maxPending := cfg.MaxPendingLines
-	if maxPending <= 0 {
-		maxPending = 5000
-	}
-	maxLineBytes := cfg.MaxLineBytes
-	if maxLineBytes <= 0 {
-		maxLineBytes = 256 * 1024
+	rt, err := newAgentRuntime(cfg)
+	if err != nil {
+		logrus.WithError(err).Error("加载 agent 配置失败")
+		os.Exit(1)
 	}
-	sourceID := strings.TrimSpace(cfg.SourceID)
-	if sourceID == "" {
-		sourceID = "agent"
-	}
-
-	endpoint := strings.TrimRight(cfg.Server, "/") + "/api/ingest/logs"
-	states := make(map[string]*fileState)
-	pending := make([]string, 0, batchSize)
-	var (
-		nextPushAt    time.Time
-		failures      int
-		reachedMax    bool
-		lastErrLogged time.Time
-		lastMemLogged time.Time
-		lastReadLogged time.Time
-		lastPushLogged time.Time
-		lastBackpressureLogged time.Time
-	)
-	// 用于比较的“有效最大退避时间”（computeBackoff 在 max<=0 时会使用默认值）。
-	effectiveBackoffMax := backoffMax
-	if effectiveBackoffMax <= 0 {
-		effectiveBackoffMax = 30 * time.Second
+	rt.logConfig()
+
+	// 先注册并拉取远程配置；服务端不可用时按本地配置启动，之后随心跳重试
+	if rt.heartbeatInterval > 0 {
+		rt.heartbeat()
+	}
+	rt.discover()
+	if len(rt.routes) == 0 {
+		logrus.Warn("no log files matched yet; waiting for discovery")
+	}
+
+	discoverTicker := time.NewTicker(rt.discoverInterval)
+	memTicker := time.NewTicker(30 * time.Second)
+	defer discoverTicker.Stop()
+	defer memTicker.Stop()
+	var heartbeatC <-chan time.Time
+	if rt.heartbeatInterval > 0 {
+		heartbeatTicker := time.NewTicker(rt.heartbeatInterval)
+		defer heartbeatTicker.Stop()
+		heartbeatC = heartbeatTicker.C
+		rt.onIntervalsChanged = func() {
+			discoverTicker.Reset(rt.discoverInterval)
+			heartbeatTicker.Reset(rt.heartbeatInterval)
+		}
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"endpoint":              endpoint,
-		"poll_interval":         pollInterval.String(),
-		"flush_interval":        flushInterval.String(),
-		"batch_size":            batchSize,
-		"max_pending_lines":     maxPending,
-		"max_line_bytes":        maxLineBytes,
-		"request_timeout":       requestTimeout.String(),
-		"retry_backoff_min":     backoffMin.String(),
-		"retry_backoff_max":     effectiveBackoffMax.String(),
-		"exit_on_max_backoff":   cfg.ExitOnMaxBackoff,
-		"paths":                 cfg.Paths,
-		"website_id":            cfg.WebsiteID,
-		"source_id":             sourceID,
-	}).Info("nginxpulse-agent: config loaded")
-
-	pollTicker := time.NewTicker(pollInterval)
-	flushTicker := time.NewTicker(flushInterval)
-	defer pollTicker.Stop()
-	defer flushTicker.Stop()
-
 	for {
 		select {
-		case <-pollTicker.C:
-			// 背压：如果 pending 积压过大，则暂停读取，直到成功推送一部分数据。
-			if len(pending) >= maxPending {
-				if time.Since(lastBackpressureLogged) > 10*time.Second {
-					lastBackpressureLogged = time.Now()
-					logrus.WithFields(logrus.Fields{
-						"pending_lines":      len(pending),
-						"max_pending_lines":  maxPending,
-						"failures":           failures,
-						"next_push_in":       durationUntil(nextPushAt).Truncate(time.Millisecond).String(),
-					}).Warn("pending buffer is full; pausing reads")
-				}
-				continue
-			}
-			for _, path := range cfg.Paths {
-				if len(pending) >= maxPending {
-					break
-				}
-				if strings.HasSuffix(strings.ToLower(path), ".gz") {
-					continue
-				}
-				state := states[path]
-				if state == nil {
-					state = &fileState{}
-					states[path] = state
-				}
-				lines, st, err := readNewLines(path, state, maxLineBytes)
-				if err != nil {
-					logrus.WithError(err).Warnf("读取日志失败: %s", path)
-					continue
-				}
-				if st.lines == 0 {
-					continue
-				}
-				// 大读取/周期性摘要日志：用于辅助定位 OOM 与积压问题。
-				if st.lines >= batchSize || st.bytes >= 4*1024*1024 || time.Since(lastReadLogged) > 30*time.Second {
-					lastReadLogged = time.Now()
-					logrus.WithFields(logrus.Fields{
-						"path":          st.path,
-						"lines":         st.lines,
-						"skipped_lines": st.skippedLines,
-						"max_line_bytes": st.maxLineBytes,
-						"bytes":         formatBytes(st.bytes),
-						"file_size":     formatBytes(st.fileSize),
-						"offset_from":   st.from,
-						"offset_to":     st.to,
-						"offset_delta":  st.to - st.from,
-						"has_partial":   st.hasPartial,
-						"pending_lines": len(pending),
-					}).Info("read new lines")
-				}
-				pending = append(pending, lines...)
-				if len(pending) >= batchSize {
-					// 遵守退避窗口：在 backoff 时间内不进行推送尝试。
-					if !nextPushAt.IsZero() && time.Now().Before(nextPushAt) {
-						continue
-					}
-					if err := pushLines(requestTimeout, endpoint, cfg.AccessKey, cfg.WebsiteID, sourceID, pending); err != nil {
-						failures++
-						delay := computeBackoff(failures, backoffMin, backoffMax)
-						// 如果此前已达到最大退避，并且等待后依然失败，则按配置可选择直接退出进程。
-						if cfg.ExitOnMaxBackoff && reachedMax && delay >= effectiveBackoffMax {
-							logrus.WithError(err).Errorf("日志推送连续失败且退避已达上限 %s，终止 agent 进程", effectiveBackoffMax)
-							os.Exit(1)
-						}
-						nextPushAt = time.Now().Add(delay)
-						reachedMax = delay >= effectiveBackoffMax
-						// 避免刷屏：最多每 5 秒打印一次 warning。
-						if time.Since(lastErrLogged) > 5*time.Second {
-							lastErrLogged = time.Now()
-							logrus.WithError(err).Warnf("日志推送失败，将在 %s 后重试", time.Until(nextPushAt).Truncate(time.Millisecond))
-							logrus.WithFields(logrus.Fields{
-								"pending_lines":      len(pending),
-								"batch_size":         batchSize,
-								"failures":           failures,
-								"backoff_next":       delay.String(),
-								"backoff_max":        effectiveBackoffMax.String(),
-								"reached_max_backoff": reachedMax,
-							}).Warn("push failed (debug)")
-						}
-						continue
-					}
-					// 成功后：周期性打印推送摘要，方便观测吞吐与 pending 容量变化。
-					if time.Since(lastPushLogged) > 30*time.Second || failures > 0 {
-						lastPushLogged = time.Now()
-						logrus.WithFields(logrus.Fields{
-							"pushed_lines":     len(pending),
-							"pending_lines":    len(pending),
-							"pending_cap":      cap(pending),
-							"failures_reset":   failures,
-						}).Info("push succeeded")
-					}
-					pending = resetPending(pending, batchSize, maxPending)
-					failures = 0
-					reachedMax = false
-					nextPushAt = time.Time{}
-				}
-			}
+		case <-discoverTicker.C:
+			rt.discover()
+		case <-heartbeatC:
+			rt.heartbeat()
+		case <-memTicker.C:
 			// 周期性内存统计：用于与 OOMKilled 时间点对齐分析。
-			if time.Since(lastMemLogged) > 30*time.Second {
-				lastMemLogged = time.Now()
-				logMemStats("mem")
-				logrus.WithFields(logrus.Fields{
-					"pending_lines":     len(pending),
-					"batch_size":        batchSize,
-					"max_pending_lines": maxPending,
-					"failures":          failures,
-					"next_push_in":      durationUntil(nextPushAt).Truncate(time.Millisecond).String(),
-				}).Info("agent status")
-			}
-		case <-flushTicker.C:
-			if len(pending) == 0 {
-				continue
-			}
-			if !nextPushAt.IsZero() && time.Now().Before(nextPushAt) {
-				continue
-			}
-			if err := pushLines(requestTimeout, endpoint, cfg.AccessKey, cfg.WebsiteID, sourceID, pending); err != nil {
-				failures++
-				delay := computeBackoff(failures, backoffMin, backoffMax)
-				if cfg.ExitOnMaxBackoff && reachedMax && delay >= effectiveBackoffMax {
-					logrus.WithError(err).Errorf("日志推送连续失败且退避已达上限 %s，终止 agent 进程", effectiveBackoffMax)
-					os.Exit(1)
-				}
-				nextPushAt = time.Now().Add(delay)
-				reachedMax = delay >= effectiveBackoffMax
-				if time.Since(lastErrLogged) > 5*time.Second {
-					lastErrLogged = time.Now()
-					logrus.WithError(err).Warnf("日志推送失败，将在 %s 后重试", time.Until(nextPushAt).Truncate(time.Millisecond))
-					logrus.WithFields(logrus.Fields{
-						"pending_lines":      len(pending),
-						"batch_size":         batchSize,
-						"failures":           failures,
-						"backoff_next":       delay.String(),
-						"backoff_max":        effectiveBackoffMax.String(),
-						"reached_max_backoff": reachedMax,
-					}).Warn("push failed on flush tick (debug)")
-				}
-				continue
-			}
-			if time.Since(lastPushLogged) > 30*time.Second || failures > 0 {
-				lastPushLogged = time.Now()
-				logrus.WithFields(logrus.Fields{
-					"pushed_lines":   len(pending),
-					"pending_cap":    cap(pending),
-					"trigger":        "flush_interval",
-				}).Info("push succeeded")
-			}
-			pending = resetPending(pending, batchSize, maxPending)
-			failures = 0
-			reachedMax = false
-			nextPushAt = time.Time{}
+			logMemStats("mem")
 		}
 	}
 }
@@ -315,28 +172,67 @@ func loadConfig(path string) (*agentConfig, error) {
 	if err := json.Unmarshal(data, cfg); err != nil {
 		return nil, err
 	}
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validateConfig 校验并规范化配置，本地配置与合并远程配置后都会调用
+func validateConfig(cfg *agentConfig) error {
 	if strings.TrimSpace(cfg.Server) == "" {
-		return nil, errors.New("server 不能为空")
+		return errors.New("server 不能为空")
 	}
-	if strings.TrimSpace(cfg.WebsiteID) == "" {
-		return nil, errors.New("websiteID 不能为空")
+	if len(cfg.Paths) == 0 && len(cfg.Inputs) == 0 {
+		return errors.New("paths 与 inputs 不能同时为空")
 	}
-	if len(cfg.Paths) == 0 {
-		return nil, errors.New("paths 不能为空")
+	if len(cfg.Paths) > 0 && strings.TrimSpace(cfg.WebsiteID) == "" {
+		return errors.New("websiteID 不能为空")
 	}
-	return cfg, nil
+	switch cfg.Protocol = strings.ToLower(strings.TrimSpace(cfg.Protocol)); cfg.Protocol {
+	case "":
+		cfg.Protocol = protocolV2
+	case protocolV1, protocolV2:
+	default:
+		return fmt.Errorf("protocol 无效: %s", cfg.Protocol)
+	}
+	switch cfg.Compression = strings.ToLower(strings.TrimSpace(cfg.Compression)); cfg.Compression {
+	case "":
+		cfg.Compression = compressionGzip
+	case compressionGzip, compressionZstd, compressionNone:
+	default:
+		return fmt.Errorf("compression 无效: %s", cfg.Compression)
+	}
+	switch strings.TrimSpace(cfg.SpoolFullPolicy) {
+	case "", spoolPolicyDropOldest, spoolPolicyBlock:
+	default:
+		return fmt.Errorf("spoolFullPolicy 无效: %s", cfg.SpoolFullPolicy)
+	}
+	if _, err := compileFilter(cfg.Filters); err != nil {
+		return err
+	}
+	return nil
 }
 
-func readNewLines(path string, state *fileState, maxLineBytes int) ([]string, readStats, error) {
+// readNewLines 读取新增的完整行；raw 时保留行尾 \r 与空行，供封装解码器按原始字节解析
+func readNewLines(path string, state *fileState, maxLineBytes int, raw bool) ([]string, readStats, error) {
 	stats := readStats{path: path}
 	stats.maxLineBytes = maxLineBytes
-	info, err := os.Stat(path)
+	// 通过已打开的句柄读取：文件被改名后仍能读完剩余内容
+	file := state.file
+	info, err := file.Stat()
 	if err != nil {
 		return nil, stats, err
 	}
 	size := info.Size()
 	stats.fileSize = size
 	if size < state.offset {
+		// copytruncate：文件被截断后从头读取
+		logrus.WithFields(logrus.Fields{
+			"path":     path,
+			"offset":   state.offset,
+			"new_size": size,
+		}).Info("file truncated; restarting from beginning")
 		state.offset = 0
 		state.partial = ""
 	}
@@ -344,12 +240,6 @@ func readNewLines(path string, state *fileState, maxLineBytes int) ([]string, re
 		return nil, stats, nil
 	}
 
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, stats, err
-	}
-	defer file.Close()
-
 	stats.from = state.offset
 	if _, err := file.Seek(state.offset, io.SeekStart); err != nil {
 		return nil, stats, err
@@ -379,7 +269,7 @@ func readNewLines(path string, state *fileState, maxLineBytes int) ([]string, re
 	}
 
 	for {
-		line, overlong, bytesRead, hasNewline, eof, err, actualLineBytes := readOneLineLimited(reader, maxLineBytes, seed)
+		line, overlong, bytesRead, hasNewline, eof, err, actualLineBytes := readOneLineLimited(reader, maxLineBytes, seed, raw)
 		seed = ""
 		if bytesRead > 0 {
 			state.offset += bytesRead
@@ -409,7 +299,7 @@ func readNewLines(path string, state *fileState, maxLineBytes int) ([]string, re
 			}
 			break
 		}
-		if line != "" {
+		if line != "" || raw {
 			lines = append(lines, line)
 			stats.lines++
 		}
@@ -423,7 +313,8 @@ func readNewLines(path string, state *fileState, maxLineBytes int) ([]string, re
 // It consumes the full line from reader. If the actual line length exceeds maxLineBytes, overlong=true and line content is discarded.
 // bytesRead counts the bytes consumed from reader for this line (including '\n' if present).
 // actualLineBytes reports the total bytes of the line content excluding trailing '\n' and '\r' (includes seed bytes).
-func readOneLineLimited(reader *bufio.Reader, maxLineBytes int, seed string) (line string, overlong bool, bytesRead int64, hasNewline bool, eof bool, err error, actualLineBytes int64) {
+// With raw=true a '\r' before the newline is kept as line content.
+func readOneLineLimited(reader *bufio.Reader, maxLineBytes int, seed string, raw bool) (line string, overlong bool, bytesRead int64, hasNewline bool, eof bool, err error, actualLineBytes int64) {
 	if maxLineBytes <= 0 {
 		maxLineBytes = 256 * 1024
 	}
@@ -450,7 +341,7 @@ func readOneLineLimited(reader *bufio.Reader, maxLineBytes int, seed string) (li
 			if frag[len(frag)-1] == '\n' {
 				contentLen--
 				hasNewline = true
-				if contentLen > 0 && frag[contentLen-1] == '\r' {
+				if !raw && contentLen > 0 && frag[contentLen-1] == '\r' {
 					contentLen--
 				}
 			}
@@ -492,11 +383,14 @@ func readOneLineLimited(reader *bufio.Reader, maxLineBytes int, seed string) (li
 	return buf.String(), false, bytesRead, hasNewline, eof, nil, actualLineBytes
 }
 
-func pushLines(timeout time.Duration, endpoint, accessKey, websiteID, sourceID string, lines []string) error {
+func pushLines(
+	timeout time.Duration, endpoint, accessKey, websiteID, sourceID string, lines []string, sampleRates []int,
+) error {
 	payload := ingestRequest{
-		WebsiteID: websiteID,
-		SourceID:  sourceID,
-		Lines:     lines,
+		WebsiteID:   websiteID,
+		SourceID:    sourceID,
+		Lines:       lines,
+		SampleRates: sampleRates,
 	}
 	body, err := json.Marshal(payload)
 	if err != nil {
@@ -572,6 +466,38 @@ func applyEnvOverrides(cfg *agentConfig) {
 	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_RETRY_BACKOFF_MAX"); ok && strings.TrimSpace(v) != "" {
 		cfg.RetryBackoffMax = v
 	}
+	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_STATE_FILE"); ok && strings.TrimSpace(v) != "" {
+		cfg.StateFile = strings.TrimSpace(v)
+	}
+	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_SPOOL_DIR"); ok && strings.TrimSpace(v) != "" {
+		cfg.SpoolDir = strings.TrimSpace(v)
+	}
+	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_SPOOL_MAX_BYTES"); ok && strings.TrimSpace(v) != "" {
+		if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			cfg.SpoolMaxBytes = n
+		}
+	}
+	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_SPOOL_MAX_AGE"); ok && strings.TrimSpace(v) != "" {
+		cfg.SpoolMaxAge = v
+	}
+	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_SPOOL_FULL_POLICY"); ok && strings.TrimSpace(v) != "" {
+		cfg.SpoolFullPolicy = strings.TrimSpace(v)
+	}
+	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_PROTOCOL"); ok && strings.TrimSpace(v) != "" {
+		cfg.Protocol = strings.ToLower(strings.TrimSpace(v))
+	}
+	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_COMPRESSION"); ok && strings.TrimSpace(v) != "" {
+		cfg.Compression = strings.ToLower(strings.TrimSpace(v))
+	}
+	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_ID"); ok && strings.TrimSpace(v) != "" {
+		cfg.AgentID = strings.TrimSpace(v)
+	}
+	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_DISCOVER_INTERVAL"); ok && strings.TrimSpace(v) != "" {
+		cfg.DiscoverInterval = v
+	}
+	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_HEARTBEAT_INTERVAL"); ok && strings.TrimSpace(v) != "" {
+		cfg.HeartbeatInterval = v
+	}
 	if v, ok := os.LookupEnv("NGINXPULSE_AGENT_EXIT_ON_MAX_BACKOFF"); ok && strings.TrimSpace(v) != "" {
 		if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
 			cfg.ExitOnMaxBackoff = b
@@ -648,12 +574,3 @@ func formatBytes(v int64) string {
 		return fmt.Sprintf("%dB", v)
 	}
 }
-
-// resetPending 用于释放 pending slice 持有的引用。
-// 这里采用“始终换新 slice”的策略：每次推送成功后都丢弃旧的底层数组，
-// 让 GC 更容易回收历史积压/异常输入导致的内存占用，从而抑制 heap_sys 长期走高。
-func resetPending(pending []string, batchSize, maxPending int) []string {
-	_ = pending
-	_ = maxPending
-	return make([]string, 0, batchSize)
-}
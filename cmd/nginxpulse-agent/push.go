@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	protocolV1 = "v1"
+	protocolV2 = "v2"
+
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+// pushBatch 一次推送的批次。序号与内容在封装后固定，重试或从磁盘缓冲重放时原样发送，
+// 服务端按序号判断是否已入库
+type pushBatch struct {
+	Seq         int64        `json:"seq"`
+	Files       []fileOffset `json:"files,omitempty"`
+	Lines       []string     `json:"lines"`
+	SampleRates []int        `json:"sample_rates,omitempty"`
+}
+
+// pendingLines 已读取、待封装为批次的日志行。rates 与 lines 一一对应，为采样保留的行代表的行数，
+// 只有出现采样行时才分配
+type pendingLines struct {
+	lines []string
+	rates []int
+}
+
+func (p *pendingLines) len() int {
+	return len(p.lines)
+}
+
+func (p *pendingLines) add(line string, rate int) {
+	if rate > 1 && p.rates == nil {
+		p.rates = make([]int, len(p.lines), cap(p.lines))
+		for i := range p.rates {
+			p.rates[i] = 1
+		}
+	}
+	p.lines = append(p.lines, line)
+	if p.rates != nil {
+		p.rates = append(p.rates, max(rate, 1))
+	}
+}
+
+// clear 交出底层数组（已封装进批次）
+func (p *pendingLines) clear() {
+	p.lines = nil
+	p.rates = nil
+}
+
+// reset 用于释放 pending slice 持有的引用。
+// 这里采用“始终换新 slice”的策略：每次推送成功后都丢弃旧的底层数组，
+// 让 GC 更容易回收历史积压/异常输入导致的内存占用，从而抑制 heap_sys 长期走高。
+func (p *pendingLines) reset(batchSize int) {
+	p.lines = make([]string, 0, batchSize)
+	p.rates = nil
+}
+
+// fileOffset 批次封装时各文件可安全恢复的读取位置
+type fileOffset struct {
+	Path   string `json:"path"`
+	Dev    uint64 `json:"dev,omitempty"`
+	Ino    uint64 `json:"ino,omitempty"`
+	Offset int64  `json:"offset"`
+}
+
+type ingestV2Request struct {
+	AgentID   string       `json:"agent_id"`
+	WebsiteID string       `json:"website_id"`
+	SourceID  string       `json:"source_id"`
+	Seq       int64        `json:"seq"`
+	Files     []fileOffset `json:"files,omitempty"`
+	Lines     []string     `json:"lines"`
+	// SampleRates 与 lines 一一对应，未采样时省略
+	SampleRates []int `json:"sample_rates,omitempty"`
+}
+
+type ingestAck struct {
+	Seq   int64        `json:"seq"`
+	Files []fileOffset `json:"files"`
+}
+
+// shipper 负责批次封装、推送、磁盘缓冲与偏移量提交
+type shipper struct {
+	server      string
+	protocol    string
+	compression string
+	accessKey   string
+	websiteID   string
+	sourceID    string
+	agentID     string
+	timeout     time.Duration
+	store       *stateStore
+	route       string // 状态文件中的站点键
+	states      map[string]*fileState
+	spool       *spool
+	lastSeq     int64
+	synced      bool
+	committed   bool // 启动后是否已提交过批次
+	inflight    *pushBatch
+}
+
+// idle 没有待发送、在途或缓冲中的数据
+func (s *shipper) idle(pending *pendingLines) bool {
+	return pending.len() == 0 && s.inflight == nil && (s.spool == nil || s.spool.empty())
+}
+
+// seal 把 pending 封装为新批次，同时记录此刻各文件的读取位置
+func (s *shipper) seal(pending *pendingLines) *pushBatch {
+	s.lastSeq++
+	return &pushBatch{
+		Seq:         s.lastSeq,
+		Files:       snapshotOffsets(s.states),
+		Lines:       pending.lines,
+		SampleRates: pending.rates,
+	}
+}
+
+// commit 批次已被服务端确认或已落盘缓冲，持久化其读取位置
+func (s *shipper) commit(batch *pushBatch) {
+	s.committed = true
+	if err := s.store.commit(s.route, batch.Seq, batch.Files); err != nil {
+		logrus.WithError(err).Warnf("保存偏移量状态文件失败: %s", s.store.path)
+	}
+}
+
+// deliver 推送所有待发送数据：先重放磁盘缓冲，再发送在途批次，最后封装并发送 pending。
+// 成功返回时 pending 已清空
+func (s *shipper) deliver(pending *pendingLines) error {
+	if err := s.ensureSynced(pending); err != nil {
+		return err
+	}
+	if s.spool != nil && !s.spool.empty() {
+		// 保持顺序：缓冲非空时新数据先落盘，再按写入顺序重放
+		if err := s.spill(pending); err != nil && !errors.Is(err, errSpoolFull) {
+			return err
+		}
+		if err := s.spool.replay(s.push); err != nil {
+			return err
+		}
+	}
+	for {
+		if s.inflight == nil {
+			if pending.len() == 0 {
+				return nil
+			}
+			s.inflight = s.seal(pending)
+			pending.clear()
+		}
+		if err := s.push(s.inflight); err != nil {
+			if s.spool != nil {
+				if spillErr := s.spill(pending); spillErr != nil && !errors.Is(spillErr, errSpoolFull) {
+					logrus.WithError(spillErr).Warn("写入磁盘缓冲失败")
+				}
+			}
+			return err
+		}
+		s.commit(s.inflight)
+		s.inflight = nil
+	}
+}
+
+// spill 把在途批次与 pending 写入磁盘缓冲；落盘后即可提交偏移量并继续读取新日志。
+// block 策略下缓冲写满时数据保留在内存中
+func (s *shipper) spill(pending *pendingLines) error {
+	if s.spool == nil {
+		return nil
+	}
+	if s.inflight != nil {
+		if err := s.spool.append(s.inflight); err != nil {
+			return err
+		}
+		s.commit(s.inflight)
+		s.inflight = nil
+	}
+	if pending.len() == 0 {
+		return nil
+	}
+	s.inflight = s.seal(pending)
+	pending.clear()
+	if err := s.spool.append(s.inflight); err != nil {
+		return err
+	}
+	s.commit(s.inflight)
+	s.inflight = nil
+	return nil
+}
+
+// spillDuringBackoff 退避期间把已满一批的数据转存到磁盘，避免 pending 积压导致暂停读取
+func (s *shipper) spillDuringBackoff(pending *pendingLines, batchSize int) {
+	if s.spool == nil || pending.len() < batchSize || !s.canSeal() {
+		return
+	}
+	if err := s.spill(pending); err != nil && !errors.Is(err, errSpoolFull) {
+		logrus.WithError(err).Warn("写入磁盘缓冲失败")
+	}
+}
+
+func (s *shipper) push(batch *pushBatch) error {
+	if s.protocol == protocolV1 {
+		return pushLines(s.timeout, strings.TrimRight(s.server, "/")+"/api/ingest/logs",
+			s.accessKey, s.websiteID, s.sourceID, batch.Lines, batch.SampleRates)
+	}
+	return s.pushV2(batch)
+}
+
+// pushV2 以压缩 JSON 推送带序号的批次；服务端返回 duplicate 说明该批次此前已入库，同样视为成功
+func (s *shipper) pushV2(batch *pushBatch) error {
+	payload, err := json.Marshal(ingestV2Request{
+		AgentID:     s.agentID,
+		WebsiteID:   s.websiteID,
+		SourceID:    s.sourceID,
+		Seq:         batch.Seq,
+		Files:       batch.Files,
+		Lines:       batch.Lines,
+		SampleRates: batch.SampleRates,
+	})
+	if err != nil {
+		return err
+	}
+	body, encoding, err := compressPayload(payload, s.compression)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(s.server, "/")+"/api/ingest/v2/logs", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	s.setAuth(req)
+
+	client := &http.Client{Timeout: s.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	var result struct {
+		AckedSeq  int64 `json:"acked_seq"`
+		Duplicate bool  `json:"duplicate"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return err
+	}
+	if result.AckedSeq != batch.Seq {
+		return fmt.Errorf("ack seq mismatch: want %d, got %d", batch.Seq, result.AckedSeq)
+	}
+	if result.Duplicate {
+		logrus.WithFields(logrus.Fields{
+			"website_id": s.websiteID,
+			"seq":        batch.Seq,
+		}).Info("batch already acknowledged by server")
+	}
+	return nil
+}
+
+// canSeal 没有本地序号时必须先与服务端对齐，才能为新批次分配序号
+func (s *shipper) canSeal() bool {
+	return s.synced || s.protocol != protocolV2 || s.lastSeq > 0
+}
+
+// ensureSynced v2 协议下首次推送前与服务端对齐确认序号。本地已有状态时查询失败不阻塞推送
+func (s *shipper) ensureSynced(pending *pendingLines) error {
+	if s.synced || s.protocol != protocolV2 {
+		return nil
+	}
+	ack, err := s.queryAck()
+	if err != nil {
+		if s.lastSeq > 0 {
+			s.synced = true
+			logrus.WithError(err).WithField("website_id", s.websiteID).Warn("查询服务端确认序号失败，按本地状态继续")
+			return nil
+		}
+		return err
+	}
+	return s.sync(ack, pending)
+}
+
+// queryAck 查询服务端已确认的序号与文件位置
+func (s *shipper) queryAck() (*ingestAck, error) {
+	query := url.Values{}
+	query.Set("agent_id", s.agentID)
+	query.Set("website_id", s.websiteID)
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(s.server, "/")+"/api/ingest/v2/ack?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.setAuth(req)
+	client := &http.Client{Timeout: s.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("ack query http status %d", resp.StatusCode)
+	}
+	var ack ingestAck
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 8<<20)).Decode(&ack); err != nil {
+		return nil, err
+	}
+	return &ack, nil
+}
+
+// sync 按服务端确认序号对齐本地状态。若服务端领先本地（本地状态丢失或上次确认后未来得及保存），
+// 丢弃已读取未推送的数据，按服务端记录的文件位置重新读取，否则新批次的序号会被服务端误判为重复
+func (s *shipper) sync(ack *ingestAck, pending *pendingLines) error {
+	if ack.Seq <= s.lastSeq {
+		s.synced = true
+		return nil
+	}
+	if s.committed {
+		return s.reseal(ack.Seq)
+	}
+	s.synced = true
+
+	logrus.WithFields(logrus.Fields{
+		"website_id": s.websiteID,
+		"local_seq":  s.lastSeq,
+		"server_seq": ack.Seq,
+	}).Warn("server is ahead of local state; resuming from server-acknowledged offsets")
+	s.lastSeq = ack.Seq
+	s.inflight = nil
+	pending.clear()
+	serverFiles := make(map[string]fileOffset, len(ack.Files))
+	for _, file := range ack.Files {
+		serverFiles[file.Path] = file
+	}
+	for path, state := range s.states {
+		if state.file != nil {
+			state.file.Close()
+		}
+		if file, ok := serverFiles[path]; ok {
+			*state = fileState{offset: file.Offset, id: fileID{dev: file.Dev, ino: file.Ino}}
+		} else {
+			// 本次启动后尚未提交过，状态文件中的位置即启动时恢复的位置
+			restored, _ := s.store.restore(path)
+			*state = fileState{offset: restored.offset, id: restored.id}
+		}
+	}
+	for path, file := range serverFiles {
+		if _, ok := s.states[path]; !ok {
+			s.states[path] = &fileState{offset: file.Offset, id: fileID{dev: file.Dev, ino: file.Ino}}
+		}
+	}
+	s.commit(&pushBatch{Seq: ack.Seq, Files: snapshotOffsets(s.states)})
+	return nil
+}
+
+// reseal 本次启动后已有批次封装（落盘缓冲或在途），不能回退读取位置。这些批次都还没发送过，
+// 把它们按原顺序重新编号到服务端序号之后，否则会被服务端当作重复批次丢弃
+func (s *shipper) reseal(serverSeq int64) error {
+	seq := serverSeq
+	if s.spool != nil {
+		last, err := s.spool.renumber(serverSeq + 1)
+		if err != nil {
+			// 未对齐前不推送，下次 deliver 重试
+			return fmt.Errorf("renumber spooled batches: %w", err)
+		}
+		seq = last
+	}
+	if s.inflight != nil {
+		seq++
+		s.inflight.Seq = seq
+	}
+	logrus.WithFields(logrus.Fields{
+		"website_id": s.websiteID,
+		"local_seq":  s.lastSeq,
+		"server_seq": serverSeq,
+		"resealed":   seq - serverSeq,
+	}).Warn("server is ahead of local state; renumbered unsent batches after server seq")
+	s.lastSeq = seq
+	s.synced = true
+	if err := s.store.commit(s.route, seq, nil); err != nil {
+		logrus.WithError(err).Warnf("保存偏移量状态文件失败: %s", s.store.path)
+	}
+	return nil
+}
+
+func (s *shipper) setAuth(req *http.Request) {
+	if key := strings.TrimSpace(s.accessKey); key != "" {
+		req.Header.Set("X-NginxPulse-Key", key)
+	}
+}
+
+// compressPayload 按配置压缩请求体，返回对应的 Content-Encoding
+func compressPayload(payload []byte, compression string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch compression {
+	case compressionNone:
+		return payload, "", nil
+	case compressionZstd:
+		encoder, err := zstd.NewWriter(&buf, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := encoder.Write(payload); err != nil {
+			encoder.Close()
+			return nil, "", err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "zstd", nil
+	default:
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(payload); err != nil {
+			gz.Close()
+			return nil, "", err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "gzip", nil
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIngestServer 模拟 v2 接口：ack 查询返回固定序号，推送时拒绝不大于已确认序号的批次（视为重复）
+type fakeIngestServer struct {
+	mu     sync.Mutex
+	acked  int64
+	pushed []ingestV2Request
+}
+
+func (f *fakeIngestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/api/ingest/v2/ack":
+		json.NewEncoder(w).Encode(ingestAck{Seq: f.acked})
+	case "/api/ingest/v2/logs":
+		var req ingestV2Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		duplicate := req.Seq <= f.acked
+		if !duplicate {
+			f.acked = req.Seq
+			f.pushed = append(f.pushed, req)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"acked_seq": req.Seq, "duplicate": duplicate})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestShipper(t *testing.T, server string, lastSeq int64) *shipper {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := loadStateStore(filepath.Join(dir, "state.json"), "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := openSpool(filepath.Join(dir, "spool"), 0, 0, spoolPolicyDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sp.closeActive)
+	return &shipper{
+		server:      server,
+		protocol:    protocolV2,
+		compression: compressionNone,
+		websiteID:   "site",
+		agentID:     "agent",
+		timeout:     5 * time.Second,
+		store:       store,
+		route:       "site",
+		states:      map[string]*fileState{},
+		spool:       sp,
+		lastSeq:     lastSeq,
+	}
+}
+
+func TestShipperResealsSpooledBatchesWhenServerAhead(t *testing.T) {
+	fake := &fakeIngestServer{acked: 10}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	ship := newTestShipper(t, server.URL, 3)
+	// 服务端不可达期间落盘的两批，序号沿用本地状态
+	for _, line := range []string{"a", "b"} {
+		ship.spillDuringBackoff(&pendingLines{lines: []string{line}}, 1)
+	}
+	if ship.lastSeq != 5 || !ship.committed {
+		t.Fatalf("after spill lastSeq = %d, committed = %t; want 5, true", ship.lastSeq, ship.committed)
+	}
+
+	pending := &pendingLines{lines: []string{"c"}}
+	if err := ship.deliver(pending); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+
+	var seqs []int64
+	var lines []string
+	for _, req := range fake.pushed {
+		seqs = append(seqs, req.Seq)
+		lines = append(lines, req.Lines...)
+	}
+	if want := []int64{11, 12, 13}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("pushed seqs = %v, want %v", seqs, want)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("pushed lines = %v, want %v", lines, want)
+	}
+	if ship.lastSeq != 13 || ship.store.seq("site") != 13 {
+		t.Errorf("lastSeq = %d, stored seq = %d; want 13", ship.lastSeq, ship.store.seq("site"))
+	}
+	if !ship.spool.empty() {
+		t.Error("spool not empty after deliver")
+	}
+}
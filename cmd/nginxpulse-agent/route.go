@@ -0,0 +1,497 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/ingest/envelope"
+	"github.com/sirupsen/logrus"
+)
+
+// maxRetiredFiles 记录已读完的轮转文件数量上限
+const maxRetiredFiles = 256
+
+// routeSettings 各站点共用的读取与推送参数
+type routeSettings struct {
+	pollInterval        time.Duration
+	flushInterval       time.Duration
+	requestTimeout      time.Duration
+	backoffMin          time.Duration
+	backoffMax          time.Duration
+	effectiveBackoffMax time.Duration
+	batchSize           int
+	maxPending          int
+	maxLineBytes        int
+	exitOnMaxBackoff    bool
+	filter              *lineFilter // 只读，各站点共用
+}
+
+// route 同一站点（websiteID + sourceID）的日志文件共用一个推送通道。
+// 每个站点在独立的 goroutine 中读取、推送与退避，某个站点推送失败不会阻塞其它站点
+type route struct {
+	target   routeTarget
+	settings routeSettings
+	ship     *shipper
+	store    *stateStore
+	states   map[string]*fileState
+	paths    []string
+	formats  map[string]*envelope.Options // 需要解开封装的文件，只读
+	decoders map[string]envelope.Decoder  // 各文件的解码器，保存跨批次的分片行
+	assignCh chan routeFiles
+	updateCh chan routeSettings
+	pending  pendingLines
+	// retired 已读完并关闭的轮转文件（inode → 最终位置）。glob 同时匹配到轮转后的文件名时从该位置继续，避免重复读取
+	retired map[fileID]retiredFile
+	seen    map[string]bool // 已从状态文件恢复过的路径
+
+	nextPushAt             time.Time
+	failures               int
+	reachedMax             bool
+	lastErrLogged          time.Time
+	lastStatusLogged       time.Time
+	lastReadLogged         time.Time
+	lastPushLogged         time.Time
+	lastBackpressureLogged time.Time
+	lastPushAt             time.Time
+	lastPushErr            string
+	lag                    map[string]int64 // 各文件未读取的字节数
+	filtered               filterStats
+
+	statusMu sync.Mutex
+	status   routeStatus // 供心跳上报的状态快照，由站点 goroutine 更新
+}
+
+// routeFiles 下发给站点的文件列表
+type routeFiles struct {
+	paths   []string
+	formats map[string]*envelope.Options
+}
+
+type retiredFile struct {
+	offset    int64
+	retiredAt time.Time
+}
+
+func newRoute(target routeTarget, settings routeSettings, ship *shipper, store *stateStore) *route {
+	return &route{
+		target:   target,
+		settings: settings,
+		ship:     ship,
+		store:    store,
+		states:   ship.states,
+		decoders: make(map[string]envelope.Decoder),
+		assignCh: make(chan routeFiles, 1),
+		updateCh: make(chan routeSettings, 1),
+		pending:  pendingLines{lines: make([]string, 0, settings.batchSize)},
+		retired:  make(map[fileID]retiredFile),
+		seen:     make(map[string]bool),
+		lag:      make(map[string]int64),
+	}
+}
+
+// assign 下发最新匹配到的文件列表，只保留最近一次，由站点 goroutine 在下次轮询前应用
+func (r *route) assign(paths []string, formats map[string]*envelope.Options) {
+	select {
+	case <-r.assignCh:
+	default:
+	}
+	r.assignCh <- routeFiles{paths: paths, formats: formats}
+}
+
+// update 下发远程配置调整后的参数，只保留最近一次
+func (r *route) update(settings routeSettings) {
+	select {
+	case <-r.updateCh:
+	default:
+	}
+	r.updateCh <- settings
+}
+
+func (r *route) run() {
+	pollTicker := time.NewTicker(r.settings.pollInterval)
+	flushTicker := time.NewTicker(r.settings.flushInterval)
+	defer pollTicker.Stop()
+	defer flushTicker.Stop()
+
+	for {
+		select {
+		case files := <-r.assignCh:
+			r.applyPaths(files)
+		case settings := <-r.updateCh:
+			if settings.pollInterval != r.settings.pollInterval {
+				pollTicker.Reset(settings.pollInterval)
+			}
+			if settings.flushInterval != r.settings.flushInterval {
+				flushTicker.Reset(settings.flushInterval)
+			}
+			r.settings = settings
+			r.ship.timeout = settings.requestTimeout
+		case <-pollTicker.C:
+			r.poll()
+		case <-flushTicker.C:
+			if r.ship.idle(&r.pending) {
+				continue
+			}
+			r.push("flush_interval")
+			r.publishStatus()
+		}
+	}
+}
+
+func (r *route) logger() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"website_id": r.target.websiteID,
+		"source_id":  r.target.sourceID,
+	})
+}
+
+// applyPaths 更新跟踪的文件。不再匹配的文件若仍有打开的句柄，继续读完后再移除
+func (r *route) applyPaths(files routeFiles) {
+	paths := files.paths
+	assigned := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		assigned[path] = true
+		// 解码方式变化（例如远程配置调整）时重建解码器；仍在读取的旧文件沿用原来的解码方式
+		if r.formats[path] != files.formats[path] {
+			delete(r.decoders, path)
+		}
+	}
+	for path, state := range r.states {
+		if !assigned[path] && state.file == nil {
+			delete(r.states, path)
+		}
+	}
+	for path := range r.lag {
+		if _, ok := r.states[path]; !ok && !assigned[path] {
+			delete(r.lag, path)
+		}
+	}
+	for path := range r.decoders {
+		if _, ok := r.states[path]; !ok && !assigned[path] {
+			delete(r.decoders, path)
+		}
+	}
+	formats := make(map[string]*envelope.Options, len(files.formats))
+	for path, format := range r.formats {
+		if state, ok := r.states[path]; ok && state.file != nil && !assigned[path] {
+			formats[path] = format
+		}
+	}
+	for _, path := range paths {
+		if format := files.formats[path]; format != nil {
+			formats[path] = format
+		}
+	}
+	r.paths = paths
+	r.formats = formats
+	r.publishStatus()
+}
+
+func (r *route) poll() {
+	// 背压：如果 pending 积压过大，则暂停读取，直到成功推送一部分数据。
+	if r.pending.len() >= r.settings.maxPending {
+		if time.Since(r.lastBackpressureLogged) > 10*time.Second {
+			r.lastBackpressureLogged = time.Now()
+			r.logger().WithFields(logrus.Fields{
+				"pending_lines":     r.pending.len(),
+				"max_pending_lines": r.settings.maxPending,
+				"failures":          r.failures,
+				"next_push_in":      durationUntil(r.nextPushAt).Truncate(time.Millisecond).String(),
+			}).Warn("pending buffer is full; pausing reads")
+		}
+		return
+	}
+
+	// 先恢复状态文件中记录的位置，再为新文件建立状态，保证按 inode 去重时能看到所有已知文件。
+	// 只在首次匹配到路径时恢复：进程内已读完并移除的路径再次出现时，状态文件中的记录已过期
+	for _, path := range r.paths {
+		if _, ok := r.states[path]; ok || r.seen[path] {
+			continue
+		}
+		r.seen[path] = true
+		if saved, ok := r.store.restore(path); ok {
+			r.states[path] = &fileState{offset: saved.offset, id: saved.id}
+		}
+	}
+	assigned := make(map[string]bool, len(r.paths))
+	for _, path := range r.paths {
+		assigned[path] = true
+		if r.pending.len() >= r.settings.maxPending {
+			break
+		}
+		state := r.states[path]
+		if state == nil {
+			state = &fileState{}
+			r.states[path] = state
+		}
+		if state.file == nil && !r.claim(path, state) {
+			continue
+		}
+		r.read(path, state)
+	}
+	// 已不再匹配、但句柄仍打开的文件（例如被轮转改名）：读完剩余内容后关闭
+	for path, state := range r.states {
+		if assigned[path] || state.file == nil || r.pending.len() >= r.settings.maxPending {
+			continue
+		}
+		if st := r.read(path, state); st.bytes == 0 && state.file != nil {
+			if state.partial != "" {
+				r.enqueue(r.decode(path, []string{state.partial}))
+				state.partial = ""
+			}
+			state.file.Close()
+			state.file = nil
+			r.retire(state.id, state.offset)
+		}
+		if state.file == nil {
+			delete(r.states, path)
+			delete(r.lag, path)
+			delete(r.decoders, path)
+		}
+	}
+	r.publishStatus()
+
+	// 周期性状态日志：用于观察各站点的积压与退避情况。
+	if time.Since(r.lastStatusLogged) > 30*time.Second {
+		r.lastStatusLogged = time.Now()
+		statusFields := logrus.Fields{
+			"files":             len(r.states),
+			"pending_lines":     r.pending.len(),
+			"batch_size":        r.settings.batchSize,
+			"max_pending_lines": r.settings.maxPending,
+			"failures":          r.failures,
+			"next_push_in":      durationUntil(r.nextPushAt).Truncate(time.Millisecond).String(),
+			"last_seq":          r.ship.lastSeq,
+		}
+		if r.settings.filter != nil {
+			statusFields["dropped_lines"] = r.filtered.dropped
+			statusFields["sampled_out_lines"] = r.filtered.sampledOut
+		}
+		if r.ship.spool != nil {
+			for key, value := range r.ship.spool.logFields() {
+				statusFields[key] = value
+			}
+		}
+		r.logger().WithFields(statusFields).Info("agent status")
+	}
+}
+
+// claim 打开文件前按 inode 去重：glob 同时匹配 access.log 与轮转后的 access.log.1 时，
+// 同一个文件只由一个状态读取；已读完的轮转文件从记录的位置继续
+func (r *route) claim(path string, state *fileState) bool {
+	current := fileID{}
+	if info, err := os.Stat(path); err == nil {
+		current = fileIdentity(info)
+	}
+	if state.id.known() && r.tracking(path, state.id) {
+		if !current.known() || current == state.id {
+			return false
+		}
+		// 记录的旧文件已由其它路径读取（例如重启期间被轮转为 access.log.1），当前路径从新文件开头读取
+		*state = fileState{id: current}
+	}
+	id := state.id
+	if !id.known() {
+		id = current
+	}
+	if !id.known() {
+		// 交给 tailFile 报告读取错误
+		return true
+	}
+	if r.tracking(path, id) {
+		return false
+	}
+	if retired, ok := r.retired[id]; ok {
+		delete(r.retired, id)
+		if !state.id.known() || retired.offset > state.offset {
+			state.id = id
+			state.offset = retired.offset
+			state.partial = ""
+		}
+	}
+	return true
+}
+
+// tracking 是否有其它路径正通过打开的句柄读取该文件
+func (r *route) tracking(path string, id fileID) bool {
+	for other, state := range r.states {
+		if other != path && state.file != nil && state.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// retire 记录读完的轮转文件，超过上限时丢弃最早的记录
+func (r *route) retire(id fileID, offset int64) {
+	if !id.known() {
+		return
+	}
+	r.retired[id] = retiredFile{offset: offset, retiredAt: time.Now()}
+	for len(r.retired) > maxRetiredFiles {
+		var oldestID fileID
+		var oldest time.Time
+		for candidate, file := range r.retired {
+			if oldest.IsZero() || file.retiredAt.Before(oldest) {
+				oldestID, oldest = candidate, file.retiredAt
+			}
+		}
+		delete(r.retired, oldestID)
+	}
+}
+
+// read 读取单个文件的新增行并追加到 pending，满一批时尝试推送
+func (r *route) read(path string, state *fileState) readStats {
+	lines, st, err := tailFile(path, state, r.settings.maxLineBytes, r.formats[path] != nil)
+	if err != nil {
+		r.logger().WithError(err).Warnf("读取日志失败: %s", path)
+		return st
+	}
+	r.retire(st.retiredID, st.retiredOffset)
+	if state.file != nil && st.fileSize >= state.offset {
+		r.lag[path] = st.fileSize - state.offset
+	} else {
+		r.lag[path] = 0
+	}
+	if st.lines == 0 {
+		return st
+	}
+	// 大读取/周期性摘要日志：用于辅助定位 OOM 与积压问题。
+	if st.lines >= r.settings.batchSize || st.bytes >= 4*1024*1024 || time.Since(r.lastReadLogged) > 30*time.Second {
+		r.lastReadLogged = time.Now()
+		r.logger().WithFields(logrus.Fields{
+			"path":           st.path,
+			"lines":          st.lines,
+			"skipped_lines":  st.skippedLines,
+			"max_line_bytes": st.maxLineBytes,
+			"bytes":          formatBytes(st.bytes),
+			"file_size":      formatBytes(st.fileSize),
+			"offset_from":    st.from,
+			"offset_to":      st.to,
+			"offset_delta":   st.to - st.from,
+			"has_partial":    st.hasPartial,
+			"pending_lines":  r.pending.len(),
+		}).Info("read new lines")
+	}
+	r.enqueue(r.decode(path, lines))
+	if r.pending.len() >= r.settings.batchSize {
+		r.push("batch_size")
+	}
+	return st
+}
+
+// decode 解开容器运行时或 journald 的封装；未配置 format 的文件原样返回
+func (r *route) decode(path string, lines []string) []string {
+	format := r.formats[path]
+	if format == nil {
+		return lines
+	}
+	decoder := r.decoders[path]
+	if decoder == nil {
+		decoder = envelope.NewDecoder(*format)
+		r.decoders[path] = decoder
+	}
+	decoded := lines[:0]
+	for _, line := range lines {
+		if text, ok := decoder.Decode(line); ok {
+			decoded = append(decoded, text)
+		}
+	}
+	return decoded
+}
+
+// enqueue 按过滤规则丢弃或采样后追加到 pending
+func (r *route) enqueue(lines []string) {
+	for _, line := range lines {
+		if rate := r.settings.filter.apply(line, &r.filtered); rate > 0 {
+			r.pending.add(line, rate)
+		}
+	}
+}
+
+// push 推送 pending；失败时按指数退避，退避窗口内只把满批数据转存到磁盘缓冲
+func (r *route) push(trigger string) {
+	// 遵守退避窗口：在 backoff 时间内不进行推送尝试。
+	if !r.nextPushAt.IsZero() && time.Now().Before(r.nextPushAt) {
+		r.ship.spillDuringBackoff(&r.pending, r.settings.batchSize)
+		return
+	}
+	pushed := r.pending.len()
+	if err := r.ship.deliver(&r.pending); err != nil {
+		r.failures++
+		delay := computeBackoff(r.failures, r.settings.backoffMin, r.settings.backoffMax)
+		// 如果此前已达到最大退避，并且等待后依然失败，则按配置可选择直接退出进程。
+		if r.settings.exitOnMaxBackoff && r.reachedMax && delay >= r.settings.effectiveBackoffMax {
+			r.logger().WithError(err).Errorf("日志推送连续失败且退避已达上限 %s，终止 agent 进程", r.settings.effectiveBackoffMax)
+			os.Exit(1)
+		}
+		r.nextPushAt = time.Now().Add(delay)
+		r.reachedMax = delay >= r.settings.effectiveBackoffMax
+		r.lastPushErr = err.Error()
+		// 避免刷屏：最多每 5 秒打印一次 warning。
+		if time.Since(r.lastErrLogged) > 5*time.Second {
+			r.lastErrLogged = time.Now()
+			r.logger().WithError(err).Warnf("日志推送失败，将在 %s 后重试", time.Until(r.nextPushAt).Truncate(time.Millisecond))
+			r.logger().WithFields(logrus.Fields{
+				"pending_lines":       r.pending.len(),
+				"batch_size":          r.settings.batchSize,
+				"failures":            r.failures,
+				"backoff_next":        delay.String(),
+				"backoff_max":         r.settings.effectiveBackoffMax.String(),
+				"reached_max_backoff": r.reachedMax,
+				"trigger":             trigger,
+			}).Warn("push failed (debug)")
+		}
+		return
+	}
+	// 成功后：周期性打印推送摘要，方便观测吞吐与 pending 容量变化。
+	if time.Since(r.lastPushLogged) > 30*time.Second || r.failures > 0 {
+		r.lastPushLogged = time.Now()
+		r.logger().WithFields(logrus.Fields{
+			"pushed_lines":   pushed,
+			"pending_cap":    cap(r.pending.lines),
+			"failures_reset": r.failures,
+			"trigger":        trigger,
+		}).Info("push succeeded")
+	}
+	r.pending.reset(r.settings.batchSize)
+	r.lastPushAt = time.Now()
+	r.lastPushErr = ""
+	r.failures = 0
+	r.reachedMax = false
+	r.nextPushAt = time.Time{}
+}
+
+// publishStatus 更新供心跳读取的状态快照
+func (r *route) publishStatus() {
+	status := routeStatus{
+		WebsiteID:    r.target.websiteID,
+		SourceID:     r.target.sourceID,
+		Files:        len(r.states),
+		PendingLines: r.pending.len(),
+		Failures:     r.failures,
+		LastError:    r.lastPushErr,
+		Dropped:      r.filtered.dropped,
+		SampledOut:   r.filtered.sampledOut,
+		paths:        append([]string(nil), r.paths...),
+	}
+	for _, lag := range r.lag {
+		status.LagBytes += lag
+	}
+	if r.ship.spool != nil {
+		status.SpoolBytes = r.ship.spool.totalBytes
+	}
+	if !r.lastPushAt.IsZero() {
+		status.LastPushAt = r.lastPushAt.Unix()
+	}
+	r.statusMu.Lock()
+	r.status = status
+	r.statusMu.Unlock()
+}
+
+func (r *route) snapshot() routeStatus {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return r.status
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// agentRuntime 进程内的站点路由，以及可随远程配置调整的运行参数。只在主 goroutine 中使用
+type agentRuntime struct {
+	local    *agentConfig // 本地配置文件（含环境变量覆盖）
+	cfg      *agentConfig // 合并远程配置后的生效配置
+	settings routeSettings
+	inputs   []compiledInput
+	routes   map[routeTarget]*route
+	store    *stateStore
+	agentID  string
+	hostname string
+	spoolDir string
+
+	discoverInterval  time.Duration
+	heartbeatInterval time.Duration
+	// onIntervalsChanged 远程配置修改了发现或心跳间隔后重置主循环的定时器
+	onIntervalsChanged func()
+
+	configVersion       int64 // 已应用的远程配置版本
+	rejectedVersion     int64 // 校验失败的远程配置版本，避免重复告警
+	lastHeartbeatFailed time.Time
+}
+
+func newAgentRuntime(cfg *agentConfig) (*agentRuntime, error) {
+	inputs, err := compileInputs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	agentID := strings.TrimSpace(cfg.AgentID)
+	if agentID == "" {
+		agentID = hostname
+	}
+
+	stateFile := strings.TrimSpace(cfg.StateFile)
+	if stateFile == "" {
+		stateFile = defaultStateFile
+	}
+	legacySourceID := strings.TrimSpace(cfg.SourceID)
+	if legacySourceID == "" {
+		legacySourceID = "agent"
+	}
+	legacyRoute := routeTarget{websiteID: strings.TrimSpace(cfg.WebsiteID), sourceID: legacySourceID}
+	store, err := loadStateStore(stateFile, legacyRoute.key())
+	if err != nil {
+		logrus.WithError(err).Warnf("读取偏移量状态文件失败，将从头读取: %s", stateFile)
+	}
+
+	rt := &agentRuntime{
+		local:    cfg,
+		cfg:      cfg,
+		settings: newRouteSettings(cfg),
+		inputs:   inputs,
+		routes:   make(map[routeTarget]*route),
+		store:    store,
+		agentID:  agentID,
+		hostname: hostname,
+		spoolDir: strings.TrimSpace(cfg.SpoolDir),
+	}
+	rt.discoverInterval, rt.heartbeatInterval = runtimeIntervals(cfg, cfg)
+	return rt, nil
+}
+
+// newRouteSettings 解析读取与推送参数并补齐默认值
+func newRouteSettings(cfg *agentConfig) routeSettings {
+	settings := routeSettings{
+		pollInterval:     parseDuration(cfg.PollInterval, time.Second),
+		flushInterval:    parseDuration(cfg.FlushInterval, 2*time.Second),
+		requestTimeout:   parseDuration(cfg.RequestTimeout, 90*time.Second),
+		backoffMin:       parseDuration(cfg.RetryBackoffMin, time.Second),
+		backoffMax:       parseDuration(cfg.RetryBackoffMax, 30*time.Second),
+		batchSize:        cfg.BatchSize,
+		maxPending:       cfg.MaxPendingLines,
+		maxLineBytes:     cfg.MaxLineBytes,
+		exitOnMaxBackoff: cfg.ExitOnMaxBackoff,
+	}
+	// 规则已在 validateConfig 中校验
+	settings.filter, _ = compileFilter(cfg.Filters)
+	if settings.pollInterval <= 0 {
+		settings.pollInterval = time.Second
+	}
+	if settings.flushInterval <= 0 {
+		settings.flushInterval = 2 * time.Second
+	}
+	if settings.batchSize <= 0 {
+		settings.batchSize = 200
+	}
+	if settings.maxPending <= 0 {
+		settings.maxPending = 5000
+	}
+	if settings.maxLineBytes <= 0 {
+		settings.maxLineBytes = 256 * 1024
+	}
+	// 用于比较的“有效最大退避时间”（computeBackoff 在 max<=0 时会使用默认值）。
+	settings.effectiveBackoffMax = settings.backoffMax
+	if settings.effectiveBackoffMax <= 0 {
+		settings.effectiveBackoffMax = 30 * time.Second
+	}
+	return settings
+}
+
+// runtimeIntervals 发现与心跳间隔。远程配置不能关闭心跳，否则之后无法再下发配置
+func runtimeIntervals(cfg, local *agentConfig) (time.Duration, time.Duration) {
+	discoverInterval := parseDuration(cfg.DiscoverInterval, 30*time.Second)
+	if discoverInterval <= 0 {
+		discoverInterval = 30 * time.Second
+	}
+	localHeartbeat := parseDuration(local.HeartbeatInterval, 30*time.Second)
+	if localHeartbeat <= 0 {
+		return discoverInterval, 0
+	}
+	heartbeatInterval := parseDuration(cfg.HeartbeatInterval, localHeartbeat)
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = localHeartbeat
+	}
+	return discoverInterval, heartbeatInterval
+}
+
+func (rt *agentRuntime) logConfig() {
+	cfg := rt.cfg
+	logrus.WithFields(logrus.Fields{
+		"server":              cfg.Server,
+		"protocol":            cfg.Protocol,
+		"compression":         cfg.Compression,
+		"agent_id":            rt.agentID,
+		"poll_interval":       rt.settings.pollInterval.String(),
+		"flush_interval":      rt.settings.flushInterval.String(),
+		"discover_interval":   rt.discoverInterval.String(),
+		"heartbeat_interval":  rt.heartbeatInterval.String(),
+		"batch_size":          rt.settings.batchSize,
+		"max_pending_lines":   rt.settings.maxPending,
+		"max_line_bytes":      rt.settings.maxLineBytes,
+		"request_timeout":     rt.settings.requestTimeout.String(),
+		"retry_backoff_min":   rt.settings.backoffMin.String(),
+		"retry_backoff_max":   rt.settings.effectiveBackoffMax.String(),
+		"exit_on_max_backoff": cfg.ExitOnMaxBackoff,
+		"paths":               cfg.Paths,
+		"inputs":              len(cfg.Inputs),
+		"website_id":          cfg.WebsiteID,
+		"source_id":           cfg.SourceID,
+		"state_file":          rt.store.path,
+		"restored_files":      len(rt.store.data.Files),
+		"spool_dir":           rt.spoolDir,
+		"config_version":      rt.configVersion,
+		"filters":             rt.settings.filter != nil,
+	}).Info("nginxpulse-agent: config loaded")
+}
+
+func (rt *agentRuntime) newShipper(target routeTarget) *shipper {
+	cfg := rt.cfg
+	ship := &shipper{
+		server:      cfg.Server,
+		protocol:    cfg.Protocol,
+		compression: cfg.Compression,
+		accessKey:   cfg.AccessKey,
+		websiteID:   target.websiteID,
+		sourceID:    target.sourceID,
+		agentID:     rt.agentID + "/" + target.sourceID,
+		timeout:     rt.settings.requestTimeout,
+		store:       rt.store,
+		route:       target.key(),
+		states:      make(map[string]*fileState),
+		lastSeq:     rt.store.seq(target.key()),
+	}
+	if rt.spoolDir != "" {
+		dir := filepath.Join(rt.spoolDir, spoolDirName(target))
+		spool, err := openSpool(dir, cfg.SpoolMaxBytes, parseDuration(cfg.SpoolMaxAge, 0), cfg.SpoolFullPolicy)
+		if err != nil {
+			logrus.WithError(err).Errorf("打开磁盘缓冲目录失败: %s", dir)
+			os.Exit(1)
+		}
+		ship.spool = spool
+	}
+	return ship
+}
+
+// discover 重新匹配文件并下发给各站点。每个站点一个 route，首次匹配到文件时创建；
+// 之后站点不再匹配任何文件时保留 route，以便继续推送积压与磁盘缓冲中的数据
+func (rt *agentRuntime) discover() {
+	assignment, formats := discoverFiles(rt.inputs)
+	for target, paths := range assignment {
+		r := rt.routes[target]
+		if r == nil {
+			r = newRoute(target, rt.settings, rt.newShipper(target), rt.store)
+			rt.routes[target] = r
+			logrus.WithFields(logrus.Fields{
+				"website_id": target.websiteID,
+				"source_id":  target.sourceID,
+				"paths":      paths,
+			}).Info("route started")
+			r.assign(paths, formats)
+			go r.run()
+			continue
+		}
+		r.assign(paths, formats)
+	}
+	for target, r := range rt.routes {
+		if _, ok := assignment[target]; !ok {
+			r.assign(nil, nil)
+		}
+	}
+	rt.store.prune()
+}
+
+// applyRemoteConfig 把远程配置合并到本地配置之上并生效；raw 为空表示恢复本地配置
+func (rt *agentRuntime) applyRemoteConfig(raw json.RawMessage) error {
+	cfg, err := mergeRemoteConfig(rt.local, raw)
+	if err != nil {
+		return err
+	}
+	inputs, err := compileInputs(cfg)
+	if err != nil {
+		return err
+	}
+	rt.cfg = cfg
+	rt.inputs = inputs
+	rt.settings = newRouteSettings(cfg)
+	for _, r := range rt.routes {
+		r.update(rt.settings)
+	}
+	discoverInterval, heartbeatInterval := runtimeIntervals(cfg, rt.local)
+	if discoverInterval != rt.discoverInterval || heartbeatInterval != rt.heartbeatInterval {
+		rt.discoverInterval, rt.heartbeatInterval = discoverInterval, heartbeatInterval
+		if rt.onIntervalsChanged != nil {
+			rt.onIntervalsChanged()
+		}
+	}
+	rt.discover()
+	return nil
+}
+
+// mergeRemoteConfig 远程配置只覆盖其中出现的字段，server、accessKey 等部署相关配置始终以本地为准
+func mergeRemoteConfig(local *agentConfig, raw json.RawMessage) (*agentConfig, error) {
+	merged := *local
+	// 切片先复制，避免 json.Unmarshal 复用本地配置的底层数组
+	merged.Paths = append([]string(nil), local.Paths...)
+	merged.Inputs = append([]inputConfig(nil), local.Inputs...)
+	if len(raw) > 0 && string(raw) != "null" {
+		var remote remoteConfig
+		if err := json.Unmarshal(raw, &remote); err != nil {
+			return nil, err
+		}
+		remote.applyTo(&merged)
+	}
+	if err := validateConfig(&merged); err != nil {
+		return nil, err
+	}
+	return &merged, nil
+}
+
+// spoolDirName 各站点的磁盘缓冲子目录
+func spoolDirName(target routeTarget) string {
+	replacer := strings.NewReplacer("/", "_", "\\", "_", ":", "_")
+	return replacer.Replace(target.websiteID) + "__" + replacer.Replace(target.sourceID)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	spoolPolicyDropOldest = "drop_oldest"
+	spoolPolicyBlock      = "block"
+
+	spoolSegmentExt       = ".seg"
+	spoolCursorFile       = "cursor.json"
+	spoolRecordHeaderSize = 8 // 4 字节长度 + 4 字节 CRC32
+	spoolSegmentBytes     = 8 * 1024 * 1024
+	defaultSpoolMaxBytes  = 512 * 1024 * 1024
+)
+
+// errSpoolFull block 策略下磁盘缓冲已满
+var errSpoolFull = errors.New("spool is full")
+
+// spool 推送失败时的磁盘缓冲。数据按批写入分段文件，每条记录带长度与校验和，
+// 恢复后按写入顺序重放，重放成功的分段随即删除；首个分段的重放位置持久化在 cursor.json 中
+type spool struct {
+	dir        string
+	maxBytes   int64
+	maxAge     time.Duration
+	policy     string
+	segments   []spoolSegment // 按写入顺序排列，最后一个可能是正在写入的分段
+	active     *os.File
+	activeSize int64
+	totalBytes int64
+	readCursor int64 // 首个分段中已重放的字节位置
+	stats      spoolStats
+}
+
+// spoolCursor 首个分段已重放的位置，重启后从这里继续，避免重发已送达的批次
+type spoolCursor struct {
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+type spoolSegment struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+type spoolStats struct {
+	spooledBatches  int64
+	spooledLines    int64
+	replayedBatches int64
+	replayedLines   int64
+	droppedSegments int64
+	droppedBytes    int64
+	corruptRecords  int64
+}
+
+// openSpool 打开（或创建）缓冲目录并载入已有分段
+func openSpool(dir string, maxBytes int64, maxAge time.Duration, policy string) (*spool, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultSpoolMaxBytes
+	}
+	if policy != spoolPolicyBlock {
+		policy = spoolPolicyDropOldest
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge, policy: policy}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spoolSegmentExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, spoolSegment{
+			path:    filepath.Join(dir, entry.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		s.totalBytes += info.Size()
+	}
+	// 分段文件名为写入时的纳秒时间戳（定长），按名称排序即写入顺序
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].path < s.segments[j].path
+	})
+	s.loadCursor()
+	return s, nil
+}
+
+// loadCursor 恢复重放位置；记录的分段已不是首个分段（已重放完删除）时从头开始
+func (s *spool) loadCursor() {
+	if len(s.segments) == 0 {
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logrus.WithError(err).Warn("读取缓冲重放位置失败，从头重放")
+		}
+		return
+	}
+	var cursor spoolCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		logrus.WithError(err).Warn("缓冲重放位置文件损坏，从头重放")
+		return
+	}
+	head := s.segments[0]
+	if cursor.Segment == filepath.Base(head.path) && cursor.Offset > 0 && cursor.Offset <= head.size {
+		s.readCursor = cursor.Offset
+	}
+}
+
+// saveCursor 持久化重放位置；写入失败时重启后会重发首个分段中已送达的批次
+func (s *spool) saveCursor() {
+	if len(s.segments) == 0 {
+		return
+	}
+	data, err := json.Marshal(spoolCursor{Segment: filepath.Base(s.segments[0].path), Offset: s.readCursor})
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(s.dir, spoolCursorFile), data)
+	}
+	if err != nil {
+		logrus.WithError(err).Warn("保存缓冲重放位置失败")
+	}
+}
+
+func (s *spool) empty() bool {
+	return len(s.segments) == 0
+}
+
+// append 把一个批次写入缓冲并 fsync，返回后即可认为这批数据已持久化
+func (s *spool) append(batch *pushBatch) error {
+	if batch == nil || len(batch.Lines) == 0 {
+		return nil
+	}
+	record, err := encodeSpoolRecord(batch)
+	if err != nil {
+		return err
+	}
+	recordSize := int64(len(record))
+
+	s.dropExpired()
+	if s.totalBytes+recordSize > s.maxBytes {
+		if s.policy == spoolPolicyBlock {
+			return errSpoolFull
+		}
+		for len(s.segments) > 0 && s.totalBytes+recordSize > s.maxBytes {
+			s.dropSegment(0, "spool is full; dropping oldest segment")
+		}
+	}
+
+	if s.active == nil || s.activeSize >= spoolSegmentBytes {
+		if err := s.rollSegment(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.active.Write(record); err != nil {
+		return err
+	}
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+
+	s.activeSize += recordSize
+	s.totalBytes += recordSize
+	last := &s.segments[len(s.segments)-1]
+	last.size = s.activeSize
+	last.modTime = time.Now()
+	s.stats.spooledBatches++
+	s.stats.spooledLines += int64(len(batch.Lines))
+	return nil
+}
+
+// replay 按写入顺序逐批推送缓冲数据，遇到推送失败立即返回，下次从同一批继续
+func (s *spool) replay(push func(*pushBatch) error) error {
+	s.dropExpired()
+	for len(s.segments) > 0 {
+		head := s.segments[0]
+		if s.active != nil && s.active.Name() == head.path {
+			// 正在写入的分段也要重放，先封存，新数据写入下一个分段
+			s.closeActive()
+		}
+		done, err := s.replaySegment(head.path, push)
+		if err != nil {
+			return err
+		}
+		if done {
+			s.removeHead()
+		}
+	}
+	return nil
+}
+
+func (s *spool) replaySegment(path string, push func(*pushBatch) error) (bool, error) {
+	err := s.readRecords(path, s.readCursor, func(batch *pushBatch, size int64) error {
+		if err := push(batch); err != nil {
+			return err
+		}
+		s.readCursor += size
+		s.saveCursor()
+		s.stats.replayedBatches++
+		s.stats.replayedLines += int64(len(batch.Lines))
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
+
+// renumber 为尚未重放的批次从 first 起重新分配序号，逐个分段写临时文件后 rename 原地替换，
+// 返回最后分配的序号（没有批次时为 first-1）。首个分段已重放的部分原样保留，持久化的重放位置仍然有效
+func (s *spool) renumber(first int64) (int64, error) {
+	s.closeActive()
+	seq := first - 1
+	for i := range s.segments {
+		segment := &s.segments[i]
+		offset := int64(0)
+		if i == 0 {
+			offset = s.readCursor
+		}
+		tmp, err := os.CreateTemp(s.dir, filepath.Base(segment.path)+".tmp-*")
+		if err != nil {
+			return seq, err
+		}
+		tmpName := tmp.Name()
+		cleanup := func() {
+			tmp.Close()
+			os.Remove(tmpName)
+		}
+		size, err := copyPrefix(tmp, segment.path, offset)
+		if err == nil {
+			err = s.readRecords(segment.path, offset, func(batch *pushBatch, _ int64) error {
+				seq++
+				batch.Seq = seq
+				record, err := encodeSpoolRecord(batch)
+				if err != nil {
+					return err
+				}
+				if _, err := tmp.Write(record); err != nil {
+					return err
+				}
+				size += int64(len(record))
+				return nil
+			})
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			cleanup()
+			continue
+		}
+		if err != nil {
+			cleanup()
+			return seq, err
+		}
+		if err := tmp.Sync(); err != nil {
+			cleanup()
+			return seq, err
+		}
+		if err := tmp.Close(); err != nil {
+			os.Remove(tmpName)
+			return seq, err
+		}
+		// 保留原分段的修改时间，过期清理仍按最初写入时间计算
+		os.Chtimes(tmpName, segment.modTime, segment.modTime)
+		if err := os.Rename(tmpName, segment.path); err != nil {
+			os.Remove(tmpName)
+			return seq, err
+		}
+		s.totalBytes += size - segment.size
+		segment.size = size
+	}
+	if err := syncDir(s.dir); err != nil {
+		logrus.WithError(err).Warn("同步缓冲目录失败")
+	}
+	return seq, nil
+}
+
+// copyPrefix 把分段开头 n 字节原样写入 dst
+func copyPrefix(dst io.Writer, path string, n int64) (int64, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return io.CopyN(dst, file, n)
+}
+
+// readRecords 从 offset 起依次解析分段中的记录交给 fn（size 为记录占用的字节数）。
+// 遇到残缺或校验失败的记录时丢弃分段剩余部分，视为已读完
+func (s *spool) readRecords(path string, offset int64, fn func(batch *pushBatch, size int64) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := make([]byte, spoolRecordHeaderSize)
+	for {
+		if _, err := io.ReadFull(file, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			// 写入过程中被强制终止留下的残缺尾部
+			s.stats.corruptRecords++
+			logrus.WithField("segment", path).Warn("spool segment has a truncated record; discarding the rest")
+			return nil
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if int64(size) > s.maxBytes {
+			s.stats.corruptRecords++
+			logrus.WithField("segment", path).Warn("spool segment has an invalid record length; discarding the rest")
+			return nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(file, payload); err != nil {
+			s.stats.corruptRecords++
+			logrus.WithField("segment", path).Warn("spool segment has a truncated record; discarding the rest")
+			return nil
+		}
+		batch, ok := decodeSpoolRecord(payload, checksum)
+		if !ok {
+			s.stats.corruptRecords++
+			logrus.WithField("segment", path).Warn("spool record checksum mismatch; discarding the rest")
+			return nil
+		}
+		if err := fn(batch, int64(spoolRecordHeaderSize)+int64(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// encodeSpoolRecord 编码一条记录：4 字节长度 + 4 字节 CRC32 + JSON
+func encodeSpoolRecord(batch *pushBatch) ([]byte, error) {
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, spoolRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[spoolRecordHeaderSize:], payload)
+	return record, nil
+}
+
+// decodeSpoolRecord 校验并解析一条记录
+func decodeSpoolRecord(payload []byte, checksum uint32) (*pushBatch, bool) {
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, false
+	}
+	batch := &pushBatch{}
+	if err := json.Unmarshal(payload, batch); err != nil {
+		return nil, false
+	}
+	return batch, true
+}
+
+// dropExpired 丢弃超过最长保留时间的分段
+func (s *spool) dropExpired() {
+	if s.maxAge <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-s.maxAge)
+	for len(s.segments) > 0 && s.segments[0].modTime.Before(cutoff) {
+		s.dropSegment(0, "spool segment expired; dropping")
+	}
+}
+
+func (s *spool) dropSegment(index int, reason string) {
+	segment := s.segments[index]
+	logrus.WithFields(logrus.Fields{
+		"segment": segment.path,
+		"bytes":   formatBytes(segment.size),
+	}).Warn(reason)
+	s.stats.droppedSegments++
+	s.stats.droppedBytes += segment.size
+	if index == 0 {
+		s.removeHead()
+		return
+	}
+	if s.active != nil && s.active.Name() == segment.path {
+		s.closeActive()
+	}
+	os.Remove(segment.path)
+	s.totalBytes -= segment.size
+	s.segments = append(s.segments[:index], s.segments[index+1:]...)
+}
+
+func (s *spool) removeHead() {
+	head := s.segments[0]
+	if s.active != nil && s.active.Name() == head.path {
+		s.closeActive()
+	}
+	if err := os.Remove(head.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.WithError(err).Warnf("删除缓冲分段失败: %s", head.path)
+	}
+	s.totalBytes -= head.size
+	if s.totalBytes < 0 {
+		s.totalBytes = 0
+	}
+	s.segments = s.segments[1:]
+	s.readCursor = 0
+}
+
+func (s *spool) rollSegment() error {
+	s.closeActive()
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), spoolSegmentExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		logrus.WithError(err).Warn("同步缓冲目录失败")
+	}
+	s.active = file
+	s.activeSize = 0
+	s.segments = append(s.segments, spoolSegment{path: path, modTime: time.Now()})
+	return nil
+}
+
+func (s *spool) closeActive() {
+	if s.active == nil {
+		return
+	}
+	s.active.Close()
+	s.active = nil
+	s.activeSize = 0
+}
+
+// logFields 缓冲指标，附加在 agent 周期性状态日志中
+func (s *spool) logFields() logrus.Fields {
+	return logrus.Fields{
+		"spool_segments":         len(s.segments),
+		"spool_bytes":            formatBytes(s.totalBytes),
+		"spool_max_bytes":        formatBytes(s.maxBytes),
+		"spool_policy":           s.policy,
+		"spool_spooled_batches":  s.stats.spooledBatches,
+		"spool_spooled_lines":    s.stats.spooledLines,
+		"spool_replayed_batches": s.stats.replayedBatches,
+		"spool_replayed_lines":   s.stats.replayedLines,
+		"spool_dropped_segments": s.stats.droppedSegments,
+		"spool_dropped_bytes":    formatBytes(s.stats.droppedBytes),
+		"spool_corrupt_records":  s.stats.corruptRecords,
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func openTestSpool(t *testing.T, dir string) *spool {
+	t.Helper()
+	sp, err := openSpool(dir, 0, 0, spoolPolicyDropOldest)
+	if err != nil {
+		t.Fatalf("openSpool: %v", err)
+	}
+	t.Cleanup(sp.closeActive)
+	return sp
+}
+
+// replayUntil 重放缓冲，推送 limit 批后模拟推送失败；返回已推送批次的序号
+func replayUntil(t *testing.T, sp *spool, limit int) []int64 {
+	t.Helper()
+	errStop := errors.New("stop")
+	var seqs []int64
+	err := sp.replay(func(batch *pushBatch) error {
+		if len(seqs) == limit {
+			return errStop
+		}
+		seqs = append(seqs, batch.Seq)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		t.Fatalf("replay: %v", err)
+	}
+	return seqs
+}
+
+func appendTestBatches(t *testing.T, sp *spool, seqs ...int64) {
+	t.Helper()
+	for _, seq := range seqs {
+		if err := sp.append(&pushBatch{Seq: seq, Lines: []string{"line"}}); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+}
+
+func TestSpoolCursorSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	sp := openTestSpool(t, dir)
+	appendTestBatches(t, sp, 1, 2, 3)
+	if got := replayUntil(t, sp, 1); !reflect.DeepEqual(got, []int64{1}) {
+		t.Fatalf("first replay = %v, want [1]", got)
+	}
+	sp.closeActive()
+
+	// 重启后从持久化的位置继续，不重发已送达的第一批
+	reopened := openTestSpool(t, dir)
+	if got := replayUntil(t, reopened, -1); !reflect.DeepEqual(got, []int64{2, 3}) {
+		t.Fatalf("replay after restart = %v, want [2 3]", got)
+	}
+	if !reopened.empty() {
+		t.Fatal("spool not empty after full replay")
+	}
+
+	// 旧的重放位置不影响之后新建的分段
+	appendTestBatches(t, reopened, 4)
+	reopened.closeActive()
+	if got := replayUntil(t, openTestSpool(t, dir), -1); !reflect.DeepEqual(got, []int64{4}) {
+		t.Fatalf("replay of new segment = %v, want [4]", got)
+	}
+}
+
+func TestSpoolRenumberKeepsCursor(t *testing.T) {
+	dir := t.TempDir()
+	sp := openTestSpool(t, dir)
+	appendTestBatches(t, sp, 1, 2, 3)
+	replayUntil(t, sp, 1)
+
+	last, err := sp.renumber(11)
+	if err != nil {
+		t.Fatalf("renumber: %v", err)
+	}
+	if last != 12 {
+		t.Fatalf("renumber last = %d, want 12", last)
+	}
+	sp.closeActive()
+
+	if got := replayUntil(t, openTestSpool(t, dir), -1); !reflect.DeepEqual(got, []int64{11, 12}) {
+		t.Fatalf("replay after renumber = %v, want [11 12]", got)
+	}
+}
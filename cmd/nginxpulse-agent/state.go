@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStateFile  = "var/nginxpulse_agent_state.json"
+	stateFileVersion  = 2
+	stateFileTempMode = 0o644
+)
+
+// offsetState 持久化到本地状态文件中的单个文件进度
+type offsetState struct {
+	Dev       uint64 `json:"dev,omitempty"`
+	Ino       uint64 `json:"ino,omitempty"`
+	Offset    int64  `json:"offset"`
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+type stateFileData struct {
+	Version int                    `json:"version"`
+	Seq     int64                  `json:"seq,omitempty"` // 版本 1 只有一个站点，序号记在这里
+	Routes  map[string]int64       `json:"routes"`        // 各站点（websiteID/sourceID）已确认（或已落盘缓冲）的最大批次序号
+	Files   map[string]offsetState `json:"files"`
+}
+
+// stateStore 各站点共用的状态文件，站点提交批次时合并自己的序号与文件位置后整体写入
+type stateStore struct {
+	mu   sync.Mutex
+	path string
+	data stateFileData
+}
+
+// loadStateStore 读取状态文件；文件不存在时返回空状态。版本 1 的序号归入 legacyRoute
+func loadStateStore(path, legacyRoute string) (*stateStore, error) {
+	store := &stateStore{
+		path: path,
+		data: stateFileData{
+			Version: stateFileVersion,
+			Routes:  make(map[string]int64),
+			Files:   make(map[string]offsetState),
+		},
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return store, nil
+		}
+		return store, err
+	}
+	var saved stateFileData
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return store, err
+	}
+	for key, seq := range saved.Routes {
+		store.data.Routes[key] = seq
+	}
+	for path, entry := range saved.Files {
+		store.data.Files[path] = entry
+	}
+	if saved.Seq > 0 && store.data.Routes[legacyRoute] == 0 {
+		store.data.Routes[legacyRoute] = saved.Seq
+	}
+	return store, nil
+}
+
+// seq 站点已提交的最大批次序号
+func (s *stateStore) seq(route string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.Routes[route]
+}
+
+// restore 返回文件上次提交的读取位置
+func (s *stateStore) restore(path string) (fileState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.data.Files[path]
+	if !ok {
+		return fileState{}, false
+	}
+	return fileState{offset: entry.Offset, id: fileID{dev: entry.Dev, ino: entry.Ino}}, true
+}
+
+// commit 记录站点已推送成功的序号与文件进度并写入状态文件
+func (s *stateStore) commit(route string, seq int64, files []fileOffset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Routes[route] = seq
+	now := time.Now().Unix()
+	for _, file := range files {
+		s.data.Files[file.Path] = offsetState{
+			Dev:       file.Dev,
+			Ino:       file.Ino,
+			Offset:    file.Offset,
+			UpdatedAt: now,
+		}
+	}
+	return writeStateFile(s.path, s.data)
+}
+
+// prune 移除已不存在的文件，避免 glob 匹配过的历史文件在状态文件中无限累积
+func (s *stateStore) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path := range s.data.Files {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			delete(s.data.Files, path)
+		}
+	}
+}
+
+// snapshotOffsets 记录当前各文件可安全恢复的位置，随批次一起提交
+func snapshotOffsets(states map[string]*fileState) []fileOffset {
+	files := make([]fileOffset, 0, len(states))
+	for p, state := range states {
+		files = append(files, fileOffset{
+			Path:   p,
+			Dev:    state.id.dev,
+			Ino:    state.id.ino,
+			Offset: state.committedOffset(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// writeStateFile 写入状态文件
+func writeStateFile(path string, snapshot stateFileData) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic 先写临时文件并 fsync，再原子 rename 覆盖
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmpName)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		cleanup()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		cleanup()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, stateFileTempMode); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// committedOffset 返回可安全恢复的位置：未读完整的行不计入，重启后会重新读取
+func (s *fileState) committedOffset() int64 {
+	offset := s.offset - int64(len(s.partial))
+	if offset < 0 {
+		return 0
+	}
+	return offset
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileID 以设备号+inode 标识一个文件，路径被轮转替换后仍能识别旧文件
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func (id fileID) known() bool {
+	return id.ino != 0
+}
+
+// tailFile 读取 path 的新增行，处理两种轮转方式：
+//   - rename + create：继续通过旧句柄读完被改名的文件，读不到新内容后再切换到新文件；
+//   - copytruncate：文件变小时从头开始读取。
+//
+// raw 见 readNewLines。
+func tailFile(path string, state *fileState, maxLineBytes int, raw bool) ([]string, readStats, error) {
+	info, statErr := os.Stat(path)
+	if state.file == nil {
+		if statErr != nil {
+			return nil, readStats{path: path}, statErr
+		}
+		if err := openTracked(path, state); err != nil {
+			return nil, readStats{path: path}, err
+		}
+	}
+
+	current := fileID{}
+	if statErr == nil {
+		current = fileIdentity(info)
+	}
+	// 路径暂时不存在（轮转进行中）或已指向新文件时，旧文件视为已轮转
+	rotated := statErr != nil || (state.id.known() && current.known() && current != state.id)
+
+	lines, stats, err := readNewLines(path, state, maxLineBytes, raw)
+	if err != nil {
+		return lines, stats, err
+	}
+	if !rotated || stats.bytes > 0 || statErr != nil {
+		return lines, stats, nil
+	}
+
+	// 旧文件已读完：残留的半行不会再有后续内容，按完整行发送
+	if state.partial != "" {
+		lines = append(lines, state.partial)
+		stats.lines++
+		state.partial = ""
+	}
+	logrus.WithFields(logrus.Fields{
+		"path":       path,
+		"old_offset": state.offset,
+		"old_inode":  state.id.ino,
+		"new_inode":  current.ino,
+		"read_lines": stats.lines,
+	}).Info("rotated file drained; switching to new file")
+	stats.retiredID = state.id
+	stats.retiredOffset = state.offset
+	state.file.Close()
+	state.file = nil
+	state.id = current
+	state.offset = 0
+	state.lastSize = 0
+	return lines, stats, nil
+}
+
+// openTracked 打开需要跟踪的文件。若状态中记录的 inode 与当前路径不同，
+// 说明重启期间发生过轮转，先在同目录下找回旧文件把剩余内容读完
+func openTracked(path string, state *fileState) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	id := fileIdentity(info)
+
+	if state.id.known() && id.known() && id != state.id {
+		if rotatedPath := findRotatedFile(path, state.id); rotatedPath != "" {
+			if old, err := os.Open(rotatedPath); err == nil {
+				file.Close()
+				logrus.WithFields(logrus.Fields{
+					"path":         path,
+					"rotated_path": rotatedPath,
+					"offset":       state.offset,
+				}).Info("resuming rotated file from saved offset")
+				state.file = old
+				return nil
+			}
+		}
+		state.offset = 0
+		state.partial = ""
+	}
+	state.file = file
+	state.id = id
+	return nil
+}
+
+// findRotatedFile 在同目录下查找 inode 匹配且以原文件名开头的文件（如 access.log.1）
+func findRotatedFile(path string, id fileID) string {
+	dir := filepath.Dir(path)
+	base := filepath.Base(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == base || !strings.HasPrefix(name, base) || entry.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(strings.ToLower(name), ".gz") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if fileIdentity(info) == id {
+			return filepath.Join(dir, name)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestReadNewLinesRaw 封装格式的文件按原始字节读取：保留 \r 与空行，未结束的半行留到下次
+func TestReadNewLinesRaw(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.export")
+	content := "MESSAGE=a\r\n\nMESSAGE=b\n\nMESSA"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		raw  bool
+		want []string
+	}{
+		{raw: false, want: []string{"MESSAGE=a", "MESSAGE=b"}},
+		{raw: true, want: []string{"MESSAGE=a\r", "", "MESSAGE=b", ""}},
+	}
+	for _, tt := range tests {
+		state := &fileState{}
+		lines, _, err := tailFile(path, state, 1024, tt.raw)
+		if state.file != nil {
+			defer state.file.Close()
+		}
+		if err != nil {
+			t.Fatalf("tailFile(raw=%t): %v", tt.raw, err)
+		}
+		if !reflect.DeepEqual(lines, tt.want) {
+			t.Errorf("tailFile(raw=%t) = %q, want %q", tt.raw, lines, tt.want)
+		}
+		if state.partial != "MESSA" || state.offset != int64(len(content)) {
+			t.Errorf("raw=%t: partial = %q, offset = %d", tt.raw, state.partial, state.offset)
+		}
+	}
+}
@@ -17,7 +17,11 @@ CREATE TABLE IF NOT EXISTS "{{website_id}}_dim_url" (
 
 CREATE TABLE IF NOT EXISTS "{{website_id}}_dim_referer" (
   id BIGSERIAL PRIMARY KEY,
-  referer TEXT NOT NULL UNIQUE
+  referer TEXT NOT NULL UNIQUE,
+  host TEXT NOT NULL DEFAULT '',
+  channel TEXT NOT NULL DEFAULT '',
+  source TEXT NOT NULL DEFAULT '',
+  keyword TEXT NOT NULL DEFAULT ''
 );
 
 CREATE TABLE IF NOT EXISTS "{{website_id}}_dim_ua" (
@@ -67,6 +71,7 @@ CREATE TABLE IF NOT EXISTS "{{website_id}}_nginx_logs" (
   referer_id BIGINT NOT NULL,
   ua_id BIGINT NOT NULL,
   location_id BIGINT NOT NULL,
+  raw_url TEXT,
   PRIMARY KEY (id, timestamp)
 ) PARTITION BY RANGE (timestamp);
 
@@ -158,6 +163,18 @@ CREATE TABLE IF NOT EXISTS "{{website_id}}_agg_entry_daily" (
   PRIMARY KEY (day, entry_url_id)
 );
 
+CREATE TABLE IF NOT EXISTS "{{website_id}}_anomalies" (
+  id BIGSERIAL PRIMARY KEY,
+  bucket BIGINT NOT NULL,
+  metric TEXT NOT NULL,
+  value DOUBLE PRECISION NOT NULL,
+  baseline DOUBLE PRECISION NOT NULL,
+  score DOUBLE PRECISION NOT NULL,
+  direction TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  UNIQUE (bucket, metric)
+);
+
 -- Indexes (create on the partitioned parent; partitions inherit)
 CREATE INDEX IF NOT EXISTS "idx_{{website_id}}_timestamp"
   ON "{{website_id}}_nginx_logs"(timestamp);
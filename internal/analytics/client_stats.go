@@ -3,11 +3,7 @@ package analytics
 import (
 	"fmt"
 	"math"
-	"net/url"
-	"strings"
 
-	"github.com/likaia/nginxpulse/internal/config"
-	"github.com/likaia/nginxpulse/internal/sqlutil"
 	"github.com/likaia/nginxpulse/internal/store"
 	"github.com/likaia/nginxpulse/internal/timeutil"
 )
@@ -18,6 +14,21 @@ type ClientStats struct {
 	UV        []int    `json:"uv"`         // 独立访客数
 	PVPercent []int    `json:"pv_percent"` // PV 百分比
 	UVPercent []int    `json:"uv_percent"` // UV 百分比
+
+	Compare *ClientStatsCompare `json:"compare,omitempty"` // 对比区间数据（与 Key 一一对应）
+
+	UVRelativeError *float64 `json:"uv_relative_error,omitempty"` // UV 来自维度聚合草图时的相对标准误差
+}
+
+// ClientStatsCompare 对比区间的 PV/UV 以及相对当前区间的变化
+type ClientStatsCompare struct {
+	CompareRange
+	PV              []int      `json:"pv"`
+	UV              []int      `json:"uv"`
+	PVChange        []int      `json:"pv_change"`         // 当前 - 对比
+	UVChange        []int      `json:"uv_change"`         // 当前 - 对比
+	PVChangePercent []*float64 `json:"pv_change_percent"` // 对比值为 0 时为 null
+	UVChangePercent []*float64 `json:"uv_change_percent"`
 }
 
 func (s ClientStats) GetType() string {
@@ -25,50 +36,84 @@ func (s ClientStats) GetType() string {
 }
 
 type ClientStatsManager struct {
-	repo      *store.Repository
+	stats     store.StatsQuerier
 	statsType string
 }
 
-func NewURLStatsManager(userRepoPtr *store.Repository) *ClientStatsManager {
+// NewClientStatsManagerWithStats 使用指定的查询层创建维度排行管理器，statsType 取值与各 New*StatsManager 一致
+func NewClientStatsManagerWithStats(stats store.StatsQuerier, statsType string) *ClientStatsManager {
 	return &ClientStatsManager{
-		repo:      userRepoPtr,
-		statsType: "url",
+		stats:     stats,
+		statsType: statsType,
 	}
 }
 
+func NewURLStatsManager(userRepoPtr *store.Repository) *ClientStatsManager {
+	return NewClientStatsManagerWithStats(userRepoPtr.Stats(), "url")
+}
+
 func NewrefererStatsManager(userRepoPtr *store.Repository) *ClientStatsManager {
-	return &ClientStatsManager{
-		repo:      userRepoPtr,
-		statsType: "referer",
-	}
+	return NewClientStatsManagerWithStats(userRepoPtr.Stats(), "referer")
+}
+
+// NewChannelStatsManager 按来源渠道（search/social/email/ai-assistant/direct/internal/other）统计
+func NewChannelStatsManager(userRepoPtr *store.Repository) *ClientStatsManager {
+	return NewClientStatsManagerWithStats(userRepoPtr.Stats(), "channel")
 }
 
 func NewBrowserStatsManager(userRepoPtr *store.Repository) *ClientStatsManager {
-	return &ClientStatsManager{
-		repo:      userRepoPtr,
-		statsType: "user_browser",
-	}
+	return NewClientStatsManagerWithStats(userRepoPtr.Stats(), "user_browser")
 }
 
 func NewOsStatsManager(userRepoPtr *store.Repository) *ClientStatsManager {
-	return &ClientStatsManager{
-		repo:      userRepoPtr,
-		statsType: "user_os",
-	}
+	return NewClientStatsManagerWithStats(userRepoPtr.Stats(), "user_os")
 }
 
 func NewDeviceStatsManager(userRepoPtr *store.Repository) *ClientStatsManager {
-	return &ClientStatsManager{
-		repo:      userRepoPtr,
-		statsType: "user_device",
-	}
+	return NewClientStatsManagerWithStats(userRepoPtr.Stats(), "user_device")
 }
 
 func NewLocationStatsManager(userRepoPtr *store.Repository) *ClientStatsManager {
-	return &ClientStatsManager{
-		repo:      userRepoPtr,
-		statsType: "location",
+	return NewClientStatsManagerWithStats(userRepoPtr.Stats(), "location")
+}
+
+// dimensionFor 把统计类型（以及来源分组方式、地域类型）映射为查询维度
+func (s *ClientStatsManager) dimensionFor(query StatsQuery) (store.Dimension, bool, error) {
+	switch s.statsType {
+	case "url":
+		return store.DimensionURL, false, nil
+	case "referer":
+		groupBy, _ := query.ExtraParam["groupBy"].(string)
+		switch groupBy {
+		case "keyword":
+			return store.DimensionRefererKeyword, false, nil
+		case "source":
+			return store.DimensionRefererSource, false, nil
+		case "host":
+			return store.DimensionRefererHost, false, nil
+		}
+		return store.DimensionReferer, false, nil
+	case "channel":
+		return store.DimensionChannel, false, nil
+	case "user_browser":
+		return store.DimensionBrowser, false, nil
+	case "user_os":
+		return store.DimensionOS, false, nil
+	case "user_device":
+		return store.DimensionDevice, false, nil
+	case "location":
+		locationType, _ := query.ExtraParam["locationType"].(string)
+		switch locationType {
+		case "domestic":
+			return store.DimensionProvince, true, nil
+		case "city":
+			return store.DimensionCity, true, nil
+		case "global":
+			return store.DimensionCountry, false, nil
+		}
+		return "", false, fmt.Errorf("不支持的地域统计类型: %s", locationType)
 	}
+	return "", false, fmt.Errorf("不支持的统计类型: %s", s.statsType)
 }
 
 // 实现 StatsManager 接口
@@ -81,180 +126,93 @@ func (s *ClientStatsManager) Query(query StatsQuery) (StatsResult, error) {
 		UVPercent: make([]int, 0),
 	}
 
-	statsType := s.statsType
-	locationType := ""
-	joinClause := ""
-	if s.statsType == "location" {
-		locationType = query.ExtraParam["locationType"].(string)
-		switch locationType {
-		case "domestic", "city":
-			statsType = "domestic"
-		case "global":
-			statsType = "global"
-		default:
-			statsType = locationType
-		}
-	}
-	selectExpr := statsType
-	groupExpr := statsType
-	if s.statsType == "location" && locationType == "domestic" {
-		selectExpr = fmt.Sprintf(
-			"CASE WHEN position('·' in loc.%[1]s) > 0 THEN substring(loc.%[1]s from 1 for position('·' in loc.%[1]s) - 1) ELSE loc.%[1]s END",
-			statsType,
-		)
-		groupExpr = selectExpr
-	}
-	if s.statsType == "location" && locationType == "city" {
-		selectExpr = fmt.Sprintf(
-			"CASE WHEN position('·' in loc.%[1]s) > 0 THEN substring(loc.%[1]s from position('·' in loc.%[1]s) + 1) ELSE loc.%[1]s END",
-			statsType,
-		)
-		groupExpr = selectExpr
-	}
-	if s.statsType == "referer" {
-		internalCond := ""
-		if website, ok := config.GetWebsiteByID(query.WebsiteID); ok {
-			internalCond = buildInternalRefererCondition(website.Domains, "r.referer")
-		}
-		if internalCond != "" {
-			selectExpr = fmt.Sprintf(
-				"CASE WHEN r.referer = '-' OR r.referer = '' THEN '直接输入网址访问' WHEN %s THEN '站内访问' ELSE r.referer END",
-				internalCond,
-			)
-		} else {
-			selectExpr = "CASE WHEN r.referer = '-' OR r.referer = '' THEN '直接输入网址访问' ELSE r.referer END"
-		}
-		groupExpr = selectExpr
+	dimension, domesticOnly, err := s.dimensionFor(query)
+	if err != nil {
+		return result, err
 	}
 	limit, _ := query.ExtraParam["limit"].(int)
 	timeRange := query.ExtraParam["timeRange"].(string)
-	startTime, endTime, err := timeutil.TimePeriod(timeRange)
+	startTime, endTime, err := timeutil.TimePeriodIn(timeRange, queryLocation(query))
 	if err != nil {
 		return result, err
 	}
 
-	extraCondition := ""
-	switch s.statsType {
-	case "url":
-		joinClause = fmt.Sprintf(`JOIN "%s_dim_url" u ON u.id = l.url_id`, query.WebsiteID)
-		selectExpr = "u.url"
-		groupExpr = "u.url"
-	case "referer":
-		joinClause = fmt.Sprintf(`JOIN "%s_dim_referer" r ON r.id = l.referer_id`, query.WebsiteID)
-	case "user_browser":
-		joinClause = fmt.Sprintf(`JOIN "%s_dim_ua" ua ON ua.id = l.ua_id`, query.WebsiteID)
-		selectExpr = "ua.browser"
-		groupExpr = "ua.browser"
-	case "user_os":
-		joinClause = fmt.Sprintf(`JOIN "%s_dim_ua" ua ON ua.id = l.ua_id`, query.WebsiteID)
-		selectExpr = "ua.os"
-		groupExpr = "ua.os"
-	case "user_device":
-		joinClause = fmt.Sprintf(`JOIN "%s_dim_ua" ua ON ua.id = l.ua_id`, query.WebsiteID)
-		selectExpr = "ua.device"
-		groupExpr = "ua.device"
-	case "location":
-		joinClause = fmt.Sprintf(`JOIN "%s_dim_location" loc ON loc.id = l.location_id`, query.WebsiteID)
-		if locationType == "global" {
-			selectExpr = "loc.global"
-			groupExpr = "loc.global"
-		} else if locationType != "domestic" && locationType != "city" {
-			selectExpr = "loc." + statsType
-			groupExpr = selectExpr
-		}
+	cmp := compareRangeFromQuery(query, timeRange, startTime, endTime)
+	compareSort, _ := query.ExtraParam["compareSort"].(string)
+	dimQuery := store.DimensionQuery{
+		Dimension:    dimension,
+		Start:        startTime,
+		End:          endTime,
+		CompareSort:  compareSort,
+		DomesticOnly: domesticOnly,
+		Limit:        limit,
 	}
-	if s.statsType == "location" && (locationType == "domestic" || locationType == "city") {
-		extraCondition = " AND loc.global = '中国'"
+	if cmp != nil {
+		dimQuery.Compare = &store.TimeRange{Start: cmp.Start, End: cmp.End}
 	}
 
-	// 构建、执行查询
-	dbQueryStr := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT 
-            %[1]s AS url, 
-            COUNT(*) AS pv,
-            COUNT(DISTINCT l.ip_id) AS uv
-        FROM "%[2]s_nginx_logs" l
-        %[4]s
-        WHERE l.pageview_flag = 1 AND l.timestamp >= ? AND l.timestamp < ?%[5]s
-        GROUP BY %[3]s
-        ORDER BY uv DESC
-        LIMIT ?`,
-		selectExpr, query.WebsiteID, groupExpr, joinClause, extraCondition))
-
-	rows, err := s.repo.GetDB().Query(dbQueryStr, startTime.Unix(), endTime.Unix(), limit)
+	dimResult, err := s.stats.TopDimension(query.WebsiteID, dimQuery)
 	if err != nil {
-		return result, fmt.Errorf("查询URL统计失败: %v", err)
+		return clientStatsFromRows(nil, cmp), err
 	}
-	defer rows.Close()
-
-	totalPV := 0
-	totalUV := 0
+	result = clientStatsFromRows(dimResult.Rows, cmp)
+	result.UVRelativeError = dimResult.UVRelativeError
+	return result, nil
+}
 
-	for rows.Next() {
-		var url string
-		var pv, uv int
-		if err := rows.Scan(&url, &pv, &uv); err != nil {
-			return result, fmt.Errorf("解析URL统计结果失败: %v", err)
+// clientStatsFromRows 把已排序、截断的分组行转换为接口结果
+func clientStatsFromRows(rows []store.DimensionRow, cmp *CompareRange) ClientStats {
+	result := ClientStats{
+		Key:       make([]string, 0, len(rows)),
+		PV:        make([]int, 0, len(rows)),
+		UV:        make([]int, 0, len(rows)),
+		PVPercent: make([]int, 0, len(rows)),
+		UVPercent: make([]int, 0, len(rows)),
+	}
+	if cmp != nil {
+		result.Compare = &ClientStatsCompare{
+			CompareRange:    *cmp,
+			PV:              make([]int, 0, len(rows)),
+			UV:              make([]int, 0, len(rows)),
+			PVChange:        make([]int, 0, len(rows)),
+			UVChange:        make([]int, 0, len(rows)),
+			PVChangePercent: make([]*float64, 0, len(rows)),
+			UVChangePercent: make([]*float64, 0, len(rows)),
 		}
-		result.Key = append(result.Key, url)
-		result.PV = append(result.PV, pv)
-		result.UV = append(result.UV, uv)
-		totalPV += pv
-		totalUV += uv
 	}
-
-	if err := rows.Err(); err != nil {
-		return result, fmt.Errorf("遍历URL统计结果失败: %v", err)
-	}
-
-	if totalPV > 0 && totalUV > 0 {
-		for i := range result.PV {
-			result.PVPercent = append(
-				result.PVPercent, int(
-					math.Round(float64(result.PV[i])/float64(totalPV)*100)))
-			result.UVPercent = append(
-				result.UVPercent, int(
-					math.Round(float64(result.UV[i])/float64(totalUV)*100)))
+	totalPV := 0
+	totalUV := 0
+	for _, row := range rows {
+		result.Key = append(result.Key, row.Key)
+		result.PV = append(result.PV, row.CurPV)
+		result.UV = append(result.UV, row.CurUV)
+		if result.Compare != nil {
+			result.Compare.PV = append(result.Compare.PV, row.PrevPV)
+			result.Compare.UV = append(result.Compare.UV, row.PrevUV)
+			result.Compare.PVChange = append(result.Compare.PVChange, row.CurPV-row.PrevPV)
+			result.Compare.UVChange = append(result.Compare.UVChange, row.CurUV-row.PrevUV)
+			result.Compare.PVChangePercent = append(result.Compare.PVChangePercent, changePercent(row.CurPV, row.PrevPV))
+			result.Compare.UVChangePercent = append(result.Compare.UVChangePercent, changePercent(row.CurUV, row.PrevUV))
 		}
+		totalPV += row.CurPV
+		totalUV += row.CurUV
 	}
 
-	return result, nil
-
-}
+	fillClientPercents(&result, totalPV, totalUV)
 
-func buildInternalRefererCondition(domains []string, refererColumn string) string {
-	conditions := make([]string, 0, len(domains))
-	for _, raw := range domains {
-		domain := normalizeDomain(raw)
-		if domain == "" {
-			continue
-		}
-		domain = strings.ReplaceAll(domain, "'", "''")
-		conditions = append(conditions,
-			fmt.Sprintf(
-				"%[1]s LIKE 'http%%://%[2]s/%%' OR %[1]s LIKE 'http%%://%[2]s' OR %[1]s LIKE 'http%%://%[2]s:%%'",
-				refererColumn, domain,
-			),
-		)
-	}
-	if len(conditions) == 0 {
-		return ""
-	}
-	return fmt.Sprintf("(%s)", strings.Join(conditions, " OR "))
+	return result
 }
 
-func normalizeDomain(raw string) string {
-	raw = strings.TrimSpace(raw)
-	if raw == "" {
-		return ""
+func fillClientPercents(result *ClientStats, totalPV, totalUV int) {
+	if totalPV <= 0 || totalUV <= 0 {
+		return
 	}
-	if strings.Contains(raw, "://") {
-		parsed, err := url.Parse(raw)
-		if err == nil && parsed.Host != "" {
-			return strings.TrimSuffix(parsed.Host, "/")
-		}
+	for i := range result.PV {
+		result.PVPercent = append(
+			result.PVPercent, int(
+				math.Round(float64(result.PV[i])/float64(totalPV)*100)))
+		result.UVPercent = append(
+			result.UVPercent, int(
+				math.Round(float64(result.UV[i])/float64(totalUV)*100)))
 	}
-	raw = strings.TrimPrefix(raw, "//")
-	raw = strings.TrimSuffix(raw, "/")
-	return raw
 }
@@ -0,0 +1,66 @@
+package analytics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClientStatsManagerURL(t *testing.T) {
+	manager := NewClientStatsManagerWithStats(newTestStats(), "url")
+	raw, err := manager.Query(testQuery(map[string]interface{}{
+		"timeRange": "2025-03-10",
+		"limit":     10,
+	}))
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	got := raw.(ClientStats)
+
+	want := ClientStats{
+		Key:       []string{"/a", "/b", "/c"},
+		PV:        []int{2, 1, 1},
+		UV:        []int{2, 1, 1},
+		PVPercent: []int{50, 25, 25},
+		UVPercent: []int{50, 25, 25},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Query = %+v, want %+v", got, want)
+	}
+}
+
+func TestClientStatsManagerLimitAndDimensions(t *testing.T) {
+	tests := []struct {
+		statsType string
+		extra     map[string]interface{}
+		wantKeys  []string
+	}{
+		{statsType: "url", extra: map[string]interface{}{"limit": 1}, wantKeys: []string{"/a"}},
+		{statsType: "user_browser", wantKeys: []string{"Chrome"}},
+		{statsType: "user_device", wantKeys: []string{"Desktop"}},
+	}
+	for _, tt := range tests {
+		extra := map[string]interface{}{"timeRange": "2025-03-10", "limit": 10}
+		for key, value := range tt.extra {
+			extra[key] = value
+		}
+		raw, err := NewClientStatsManagerWithStats(newTestStats(), tt.statsType).Query(testQuery(extra))
+		if err != nil {
+			t.Fatalf("%s: Query: %v", tt.statsType, err)
+		}
+		if got := raw.(ClientStats).Key; !reflect.DeepEqual(got, tt.wantKeys) {
+			t.Errorf("%s: Key = %v, want %v", tt.statsType, got, tt.wantKeys)
+		}
+	}
+}
+
+func TestClientStatsManagerUnknownLocationType(t *testing.T) {
+	manager := NewClientStatsManagerWithStats(newTestStats(), "location")
+	_, err := manager.Query(testQuery(map[string]interface{}{
+		"timeRange":    "2025-03-10",
+		"limit":        10,
+		"locationType": "planet",
+	}))
+	if err == nil {
+		t.Fatal("Query with unknown locationType succeeded, want error")
+	}
+}
@@ -0,0 +1,139 @@
+package analytics
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// 对比模式
+const (
+	compareModePrevious = "previous" // 上一周期
+	compareModeLastYear = "lastYear" // 去年同期
+	compareModeCustom   = "custom"   // 自定义区间
+)
+
+// compareSupportedTypes 支持 compare 参数的统计类型
+var compareSupportedTypes = map[string]bool{
+	"url":        true,
+	"referer":    true,
+	"channel":    true,
+	"browser":    true,
+	"os":         true,
+	"device":     true,
+	"location":   true,
+	"timeseries": true,
+}
+
+// CompareRange 对比区间的描述，随结果返回给前端
+type CompareRange struct {
+	Mode  string `json:"mode"`
+	Start int64  `json:"start"`
+	End   int64  `json:"end"`
+}
+
+// parseCompareParams 解析 compare 相关的可选参数并写入 ExtraParam
+func parseCompareParams(params map[string]string, extra map[string]interface{}) error {
+	mode, ok := params["compare"]
+	if !ok || mode == "" {
+		return nil
+	}
+	switch mode {
+	case compareModePrevious, compareModeLastYear:
+	case compareModeCustom:
+		startRaw, err := getRequiredString(params, "compareStart")
+		if err != nil {
+			return err
+		}
+		endRaw, err := getRequiredString(params, "compareEnd")
+		if err != nil {
+			return err
+		}
+		start, err := time.ParseInLocation("2006-01-02", startRaw, time.Local)
+		if err != nil {
+			return fmt.Errorf("compareStart 参数格式错误")
+		}
+		end, err := time.ParseInLocation("2006-01-02", endRaw, time.Local)
+		if err != nil {
+			return fmt.Errorf("compareEnd 参数格式错误")
+		}
+		if end.Before(start) {
+			return fmt.Errorf("compareEnd 不能早于 compareStart")
+		}
+		extra["compareStart"] = startRaw
+		extra["compareEnd"] = endRaw
+	default:
+		return fmt.Errorf("compare 参数无效，必须为以下值之一: [previous lastYear custom]")
+	}
+	extra["compare"] = mode
+
+	if sortRaw, ok := params["compareSort"]; ok && sortRaw != "" {
+		switch sortRaw {
+		case "current", "decline", "growth":
+			extra["compareSort"] = sortRaw
+		default:
+			return fmt.Errorf("compareSort 参数无效")
+		}
+	}
+	return nil
+}
+
+// compareRangeFromQuery 根据查询参数计算对比区间，未指定 compare 时返回 nil
+func compareRangeFromQuery(query StatsQuery, timeRange string, startTime, endTime time.Time) *CompareRange {
+	mode, _ := query.ExtraParam["compare"].(string)
+	var cmpStart, cmpEnd time.Time
+	switch mode {
+	case compareModePrevious:
+		cmpStart, cmpEnd = previousTimeRange(timeRange, startTime.Location())
+	case compareModeLastYear:
+		cmpStart, cmpEnd = startTime.AddDate(-1, 0, 0), endTime.AddDate(-1, 0, 0)
+	case compareModeCustom:
+		startRaw, _ := query.ExtraParam["compareStart"].(string)
+		endRaw, _ := query.ExtraParam["compareEnd"].(string)
+		start, err := time.ParseInLocation("2006-01-02", startRaw, startTime.Location())
+		if err != nil {
+			return nil
+		}
+		end, err := time.ParseInLocation("2006-01-02", endRaw, startTime.Location())
+		if err != nil {
+			return nil
+		}
+		cmpStart = start
+		cmpEnd = time.Date(end.Year(), end.Month(), end.Day(), 23, 59, 59, 0, end.Location())
+	default:
+		return nil
+	}
+	if cmpStart.IsZero() || cmpEnd.IsZero() {
+		return nil
+	}
+	return &CompareRange{Mode: mode, Start: cmpStart.Unix(), End: cmpEnd.Unix()}
+}
+
+// shiftComparePoints 把当前区间的时间点平移到对比区间，保持小时/日期对齐
+func shiftComparePoints(timePoints []time.Time, startTime time.Time, cmp *CompareRange) []time.Time {
+	shifted := make([]time.Time, len(timePoints))
+	cmpStart := time.Unix(cmp.Start, 0).In(startTime.Location())
+	if cmp.Mode == compareModeLastYear {
+		for i, point := range timePoints {
+			shifted[i] = point.AddDate(-1, 0, 0)
+		}
+		return shifted
+	}
+	curDay := time.Date(startTime.Year(), startTime.Month(), startTime.Day(), 0, 0, 0, 0, startTime.Location())
+	cmpDay := time.Date(cmpStart.Year(), cmpStart.Month(), cmpStart.Day(), 0, 0, 0, 0, cmpStart.Location())
+	// 按日历天数平移而非固定时长，跨夏令时也能对齐到同一小时
+	dayOffset := int(math.Round(curDay.Sub(cmpDay).Hours() / 24))
+	for i, point := range timePoints {
+		shifted[i] = point.AddDate(0, 0, -dayOffset)
+	}
+	return shifted
+}
+
+// changePercent 计算变化百分比（保留一位小数），对比值为 0 时无意义返回 nil
+func changePercent(current, previous int) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	value := math.Round(float64(current-previous)/float64(previous)*1000) / 10
+	return &value
+}
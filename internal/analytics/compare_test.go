@@ -0,0 +1,93 @@
+package analytics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+func TestClientStatsManagerCompare(t *testing.T) {
+	previous := map[string]interface{}{"compare": compareModePrevious}
+	custom := map[string]interface{}{
+		"compare":      compareModeCustom,
+		"compareStart": "2025-03-09",
+		"compareEnd":   "2025-03-09",
+	}
+
+	for _, params := range []map[string]interface{}{previous, custom} {
+		extra := map[string]interface{}{"timeRange": "2025-03-10", "limit": 10}
+		for key, value := range params {
+			extra[key] = value
+		}
+		raw, err := NewClientStatsManagerWithStats(newTestStats(), "url").Query(testQuery(extra))
+		if err != nil {
+			t.Fatalf("%v: Query: %v", params["compare"], err)
+		}
+		got := raw.(ClientStats)
+		if want := []string{"/a", "/b", "/c"}; !reflect.DeepEqual(got.Key, want) {
+			t.Errorf("%v: Key = %v, want %v", params["compare"], got.Key, want)
+		}
+		cmp := got.Compare
+		if cmp == nil {
+			t.Fatalf("%v: Compare = nil", params["compare"])
+		}
+		if cmp.Start != testTime(9, 0, 0).Unix() || cmp.End != testTime(9, 23, 59).Unix()+59 {
+			t.Errorf("%v: compare range = %d~%d, want 2025-03-09", params["compare"], cmp.Start, cmp.End)
+		}
+		if want := []int{1, 1, 0}; !reflect.DeepEqual(cmp.UV, want) {
+			t.Errorf("%v: Compare.UV = %v, want %v", params["compare"], cmp.UV, want)
+		}
+		if want := []int{1, 0, 1}; !reflect.DeepEqual(cmp.UVChange, want) {
+			t.Errorf("%v: Compare.UVChange = %v, want %v", params["compare"], cmp.UVChange, want)
+		}
+		if want := []*float64{floatPtr(100), floatPtr(0), nil}; !reflect.DeepEqual(cmp.UVChangePercent, want) {
+			t.Errorf("%v: Compare.UVChangePercent = %v, want [100 0 nil]", params["compare"], cmp.UVChangePercent)
+		}
+	}
+}
+
+func TestClientStatsManagerCompareSort(t *testing.T) {
+	tests := []struct {
+		sort string
+		want []string
+	}{
+		{sort: "", want: []string{"/a", "/b", "/c"}},
+		{sort: "decline", want: []string{"/b", "/a", "/c"}},
+		{sort: "growth", want: []string{"/a", "/c", "/b"}},
+	}
+	for _, tt := range tests {
+		extra := map[string]interface{}{
+			"timeRange": "2025-03-10",
+			"limit":     10,
+			"compare":   compareModePrevious,
+		}
+		if tt.sort != "" {
+			extra["compareSort"] = tt.sort
+		}
+		raw, err := NewClientStatsManagerWithStats(newTestStats(), "url").Query(testQuery(extra))
+		if err != nil {
+			t.Fatalf("%q: Query: %v", tt.sort, err)
+		}
+		if got := raw.(ClientStats).Key; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("compareSort %q: Key = %v, want %v", tt.sort, got, tt.want)
+		}
+	}
+}
+
+func TestCompareRangeFromQueryLastYear(t *testing.T) {
+	start, end := testTime(10, 0, 0), testTime(10, 23, 59)
+	query := testQuery(map[string]interface{}{"compare": compareModeLastYear})
+	got := compareRangeFromQuery(query, "2025-03-10", start, end)
+	if got == nil {
+		t.Fatal("compareRangeFromQuery = nil")
+	}
+	if got.Start != start.AddDate(-1, 0, 0).Unix() || got.End != end.AddDate(-1, 0, 0).Unix() {
+		t.Errorf("lastYear range = %+v, want shifted by one year", got)
+	}
+	if compareRangeFromQuery(testQuery(map[string]interface{}{}), "2025-03-10", start, end) != nil {
+		t.Error("compareRangeFromQuery without compare param should be nil")
+	}
+}
@@ -1,13 +1,11 @@
 package analytics
 
 import (
-	"database/sql"
 	"fmt"
 	"math"
 	"sort"
 	"time"
 
-	"github.com/likaia/nginxpulse/internal/sqlutil"
 	"github.com/likaia/nginxpulse/internal/store"
 	"github.com/likaia/nginxpulse/internal/timeutil"
 	"github.com/sirupsen/logrus"
@@ -27,6 +25,7 @@ type OverallStats struct {
 	Compare                   OverallCompare `json:"compare"`                   // 对比数据
 	StatusCodeHits            StatusCodeHits `json:"statusCodeHits"`            // HTTP 状态码命中次数
 	StatusCodeHitsPrevious    StatusCodeHits `json:"statusCodeHitsPrevious"`    // 上一期状态码命中次数
+	UVRelativeError           *float64       `json:"uvRelativeError,omitempty"` // UV 近似计数时的相对标准误差，精确计数时不返回
 }
 
 type OverallSnapshot struct {
@@ -55,13 +54,18 @@ func (s OverallStats) GetType() string {
 }
 
 type OverallStatsManager struct {
-	repo *store.Repository
+	stats store.StatsQuerier
 }
 
 // NewOverallStatsManager 创建一个新的 OverallStatsManager 实例
 func NewOverallStatsManager(userRepoPtr *store.Repository) *OverallStatsManager {
+	return NewOverallStatsManagerWithStats(userRepoPtr.Stats())
+}
+
+// NewOverallStatsManagerWithStats 使用指定的查询层创建 OverallStatsManager
+func NewOverallStatsManagerWithStats(stats store.StatsQuerier) *OverallStatsManager {
 	return &OverallStatsManager{
-		repo: userRepoPtr,
+		stats: stats,
 	}
 }
 
@@ -92,14 +96,16 @@ func (s *OverallStatsManager) Query(query StatsQuery) (StatsResult, error) {
 		},
 		StatusCodeHits:         StatusCodeHits{},
 		StatusCodeHitsPrevious: StatusCodeHits{},
+		UVRelativeError:        uvRelativeError(query.WebsiteID),
 	}
 
 	timeRange := query.ExtraParam["timeRange"].(string)
-	startTime, endTime, err := timeutil.TimePeriod(timeRange)
+	loc := queryLocation(query)
+	startTime, endTime, err := timeutil.TimePeriodIn(timeRange, loc)
 	if err != nil {
 		return result, err
 	}
-	prevStart, prevEnd := previousTimeRange(timeRange)
+	prevStart, prevEnd := previousTimeRange(timeRange, loc)
 	entryLimit := 10
 	if rawLimit, ok := query.ExtraParam["entryLimit"]; ok {
 		if limit, ok := rawLimit.(int); ok && limit > 0 {
@@ -107,28 +113,25 @@ func (s *OverallStatsManager) Query(query StatsQuery) (StatsResult, error) {
 		}
 	}
 
-	err = s.statsByTimeRangeForWebsite(query.WebsiteID, startTime, endTime, &result)
+	totals, err := s.stats.Totals(query.WebsiteID, startTime, endTime)
 	if err != nil {
 		return result, fmt.Errorf("获取总体统计失败: %v", err)
 	}
-
-	statusHits, err := s.statusCodeHitsByTimeRangeForWebsite(query.WebsiteID, startTime, endTime)
-	if err != nil {
-		logrus.WithError(err).Warn("获取状态码统计失败")
-	} else {
-		result.StatusCodeHits = statusHits
-	}
+	result.PV = totals.PV
+	result.UV = totals.UV
+	result.Traffic = totals.Traffic
+	result.StatusCodeHits = statusCodeHitsFromTotals(totals)
 
 	if !prevStart.IsZero() && !prevEnd.IsZero() {
-		prevStatusHits, err := s.statusCodeHitsByTimeRangeForWebsite(query.WebsiteID, prevStart, prevEnd)
+		prevTotals, err := s.stats.Totals(query.WebsiteID, prevStart, prevEnd)
 		if err != nil {
 			logrus.WithError(err).Warn("获取上一期状态码统计失败")
 		} else {
-			result.StatusCodeHitsPrevious = prevStatusHits
+			result.StatusCodeHitsPrevious = statusCodeHitsFromTotals(prevTotals)
 		}
 	}
 
-	metrics, err := collectSessionMetrics(s.repo, query.WebsiteID, startTime, endTime)
+	metrics, err := s.stats.SessionMetrics(query.WebsiteID, startTime, endTime)
 	if err != nil {
 		logrus.WithError(err).Warn("获取会话统计失败")
 	} else {
@@ -136,14 +139,18 @@ func (s *OverallStatsManager) Query(query StatsQuery) (StatsResult, error) {
 		result.EntryPages = buildEntryStats(metrics.EntryCounts, entryLimit)
 	}
 
-	activeCount, err := s.activeVisitorCount(query.WebsiteID)
+	now := time.Now()
+	activeCount, err := s.stats.ActiveVisitors(query.WebsiteID, store.TimeRange{
+		Start: now.Add(-15 * time.Minute).Unix(),
+		End:   now.Unix(),
+	})
 	if err != nil {
 		logrus.WithError(err).Warn("获取活跃访客失败")
 	} else {
 		result.ActiveVisitorCount = activeCount
 	}
 
-	newCount, returningCount, err := s.newReturningCounts(query.WebsiteID, startTime, endTime)
+	newCount, returningCount, err := s.stats.VisitorSplit(query.WebsiteID, startTime, endTime)
 	if err != nil {
 		logrus.WithError(err).Warn("获取新老访客失败")
 	} else {
@@ -152,7 +159,7 @@ func (s *OverallStatsManager) Query(query StatsQuery) (StatsResult, error) {
 	}
 
 	if !prevStart.IsZero() && !prevEnd.IsZero() {
-		prevNew, prevReturning, err := s.newReturningCounts(query.WebsiteID, prevStart, prevEnd)
+		prevNew, prevReturning, err := s.stats.VisitorSplit(query.WebsiteID, prevStart, prevEnd)
 		if err != nil {
 			logrus.WithError(err).Warn("获取上期新老访客失败")
 		} else {
@@ -174,306 +181,15 @@ func (s *OverallStatsManager) Query(query StatsQuery) (StatsResult, error) {
 	return result, nil
 }
 
-// StatsByTimePoints 直接使用 db.Query() 方法查询数据库获取指定时间点的统计数据
-func (s *OverallStatsManager) statsByTimeRangeForWebsite(
-	websiteID string, startTime, endTime time.Time, overall *OverallStats) error {
-
-	// 初始化结果
-	overall.PV = 0
-	overall.UV = 0
-	overall.Traffic = 0
-
-	startDay := dayBucket(startTime)
-	endDay := dayBucket(endTime)
-
-	aggQuery := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT 
-            COALESCE(SUM(pv), 0) as pv,
-            COALESCE(SUM(traffic), 0) as traffic
-        FROM "%s_agg_daily"
-        WHERE day >= ? AND day <= ?`,
-		websiteID))
-
-	var pv int64
-	var traffic int64
-	row := s.repo.GetDB().QueryRow(aggQuery, startDay, endDay)
-	if err := row.Scan(&pv, &traffic); err != nil {
-		return fmt.Errorf("查询总体统计数据失败: %v", err)
-	}
-	overall.PV = int(pv)
-	overall.Traffic = traffic
-
-	uvQuery := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT COUNT(DISTINCT ip_id) as uv
-        FROM "%s_agg_daily_ip"
-        WHERE day >= ? AND day <= ?`,
-		websiteID))
-
-	var uv int64
-	row = s.repo.GetDB().QueryRow(uvQuery, startDay, endDay)
-	if err := row.Scan(&uv); err != nil {
-		return fmt.Errorf("查询总体统计UV失败: %v", err)
-	}
-	overall.UV = int(uv)
-
-	return nil
-}
-
-func (s *OverallStatsManager) statusCodeHitsByTimeRangeForWebsite(
-	websiteID string, startTime, endTime time.Time) (StatusCodeHits, error) {
-
-	result := StatusCodeHits{}
-	startDay := dayBucket(startTime)
-	endDay := dayBucket(endTime)
-
-	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT
-            COALESCE(SUM(s2xx), 0) AS s2xx,
-            COALESCE(SUM(s3xx), 0) AS s3xx,
-            COALESCE(SUM(s4xx), 0) AS s4xx,
-            COALESCE(SUM(s5xx), 0) AS s5xx,
-            COALESCE(SUM(other), 0) AS other
-        FROM "%s_agg_daily"
-        WHERE day >= ? AND day <= ?`,
-		websiteID))
-
-	row := s.repo.GetDB().QueryRow(query, startDay, endDay)
-	if err := row.Scan(&result.S2xx, &result.S3xx, &result.S4xx, &result.S5xx, &result.Other); err != nil {
-		return result, fmt.Errorf("查询状态码统计失败: %v", err)
-	}
-
-	return result, nil
-}
-
-type sessionMetrics struct {
-	SessionCount int
-	EntryCounts  map[string]int
-}
-
-const sessionGapSeconds = int64(1800)
-
-func collectSessionMetrics(
-	repo *store.Repository,
-	websiteID string,
-	startTime, endTime time.Time,
-) (sessionMetrics, error) {
-	sessionAggTable := fmt.Sprintf("%s_agg_session_daily", websiteID)
-	entryAggTable := fmt.Sprintf("%s_agg_entry_daily", websiteID)
-	hasSessionAgg, err := tableExists(repo.GetDB(), sessionAggTable)
-	if err != nil {
-		return sessionMetrics{EntryCounts: make(map[string]int)}, err
-	}
-	hasEntryAgg, err := tableExists(repo.GetDB(), entryAggTable)
-	if err != nil {
-		return sessionMetrics{EntryCounts: make(map[string]int)}, err
-	}
-	if hasSessionAgg && hasEntryAgg {
-		return collectSessionMetricsFromAggregates(repo.GetDB(), websiteID, startTime, endTime)
-	}
-
-	sessionTable := fmt.Sprintf("%s_sessions", websiteID)
-	exists, err := tableExists(repo.GetDB(), sessionTable)
-	if err != nil {
-		return sessionMetrics{EntryCounts: make(map[string]int)}, err
-	}
-	if !exists {
-		return collectSessionMetricsFromLogs(repo, websiteID, startTime, endTime)
-	}
-	return collectSessionMetricsFromSessions(repo.GetDB(), websiteID, startTime, endTime)
-}
-
-func collectSessionMetricsFromAggregates(
-	db *sql.DB,
-	websiteID string,
-	startTime, endTime time.Time,
-) (sessionMetrics, error) {
-	metrics := sessionMetrics{
-		EntryCounts: make(map[string]int),
-	}
-
-	startDay := dayBucket(startTime)
-	endDay := dayBucket(endTime)
-
-	sessionTable := fmt.Sprintf("%s_agg_session_daily", websiteID)
-	entryTable := fmt.Sprintf("%s_agg_entry_daily", websiteID)
-	urlTable := fmt.Sprintf("%s_dim_url", websiteID)
-
-	row := db.QueryRow(
-		sqlutil.ReplacePlaceholders(fmt.Sprintf(
-			`SELECT COALESCE(SUM(sessions), 0) FROM "%s" WHERE day >= ? AND day <= ?`, sessionTable,
-		)),
-		startDay, endDay,
-	)
-	if err := row.Scan(&metrics.SessionCount); err != nil {
-		return metrics, err
-	}
-
-	rows, err := db.Query(
-		sqlutil.ReplacePlaceholders(fmt.Sprintf(
-			`SELECT u.url, SUM(e.count)
-         FROM "%s" e
-         JOIN "%s" u ON u.id = e.entry_url_id
-         WHERE e.day >= ? AND e.day <= ?
-         GROUP BY e.entry_url_id, u.url`,
-			entryTable, urlTable,
-		)),
-		startDay, endDay,
-	)
-	if err != nil {
-		return metrics, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var (
-			url   string
-			count int
-		)
-		if err := rows.Scan(&url, &count); err != nil {
-			return metrics, err
-		}
-		metrics.EntryCounts[url] = count
-	}
-
-	if err := rows.Err(); err != nil {
-		return metrics, err
-	}
-
-	return metrics, nil
-}
-
-func collectSessionMetricsFromSessions(
-	db *sql.DB,
-	websiteID string,
-	startTime, endTime time.Time,
-) (sessionMetrics, error) {
-	metrics := sessionMetrics{
-		EntryCounts: make(map[string]int),
-	}
-
-	sessionTable := fmt.Sprintf("%s_sessions", websiteID)
-	urlTable := fmt.Sprintf("%s_dim_url", websiteID)
-
-	row := db.QueryRow(
-		sqlutil.ReplacePlaceholders(fmt.Sprintf(
-			`SELECT COUNT(*) FROM "%s" WHERE start_ts >= ? AND start_ts < ?`, sessionTable,
-		)),
-		startTime.Unix(), endTime.Unix(),
-	)
-	if err := row.Scan(&metrics.SessionCount); err != nil {
-		return metrics, err
-	}
-
-	rows, err := db.Query(
-		sqlutil.ReplacePlaceholders(fmt.Sprintf(
-			`SELECT u.url, COUNT(*)
-         FROM "%s" s
-         JOIN "%s" u ON u.id = s.entry_url_id
-         WHERE s.start_ts >= ? AND s.start_ts < ?
-         GROUP BY s.entry_url_id, u.url`,
-			sessionTable, urlTable,
-		)),
-		startTime.Unix(), endTime.Unix(),
-	)
-	if err != nil {
-		return metrics, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var (
-			url   string
-			count int
-		)
-		if err := rows.Scan(&url, &count); err != nil {
-			return metrics, err
-		}
-		metrics.EntryCounts[url] = count
-	}
-
-	if err := rows.Err(); err != nil {
-		return metrics, err
-	}
-
-	return metrics, nil
-}
-
-func collectSessionMetricsFromLogs(
-	repo *store.Repository,
-	websiteID string,
-	startTime, endTime time.Time,
-) (sessionMetrics, error) {
-	metrics := sessionMetrics{
-		EntryCounts: make(map[string]int),
+// statusCodeHitsFromTotals 从区间汇总中取出状态码命中次数
+func statusCodeHitsFromTotals(totals store.StatsTotals) StatusCodeHits {
+	return StatusCodeHits{
+		S2xx:  totals.S2xx,
+		S3xx:  totals.S3xx,
+		S4xx:  totals.S4xx,
+		S5xx:  totals.S5xx,
+		Other: totals.Other,
 	}
-
-	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT l.timestamp, l.ip_id, l.ua_id, u.url
-        FROM "%s_nginx_logs" l
-        JOIN "%s_dim_url" u ON u.id = l.url_id
-        WHERE l.pageview_flag = 1 AND l.timestamp >= ? AND l.timestamp < ?
-        ORDER BY l.ip_id, l.ua_id, l.timestamp`,
-		websiteID, websiteID))
-
-	rows, err := repo.GetDB().Query(query, startTime.Unix(), endTime.Unix())
-	if err != nil {
-		return metrics, err
-	}
-	defer rows.Close()
-
-	var (
-		currentKey    string
-		lastTimestamp int64
-		initialized   bool
-	)
-
-	for rows.Next() {
-		var (
-			timestamp int64
-			url       string
-			ipID      int64
-			uaID      int64
-		)
-		if err := rows.Scan(&timestamp, &ipID, &uaID, &url); err != nil {
-			return metrics, err
-		}
-
-		key := fmt.Sprintf("%d|%d", ipID, uaID)
-
-		if !initialized || key != currentKey || timestamp-lastTimestamp > sessionGapSeconds {
-			currentKey = key
-			metrics.SessionCount++
-			metrics.EntryCounts[url]++
-			initialized = true
-		}
-
-		lastTimestamp = timestamp
-	}
-
-	if err := rows.Err(); err != nil {
-		return metrics, err
-	}
-
-	return metrics, nil
-}
-
-func tableExists(db *sql.DB, tableName string) (bool, error) {
-	row := db.QueryRow(sqlutil.ReplacePlaceholders(
-		`SELECT 1
-         FROM pg_class c
-         JOIN pg_namespace n ON n.oid = c.relnamespace
-         WHERE n.nspname = 'public'
-           AND c.relkind IN ('r', 'p')
-           AND c.relname = ?`,
-	), tableName)
-	var exists int
-	if err := row.Scan(&exists); err != nil {
-		if err == sql.ErrNoRows {
-			return false, nil
-		}
-		return false, err
-	}
-	return true, nil
 }
 
 func buildEntryStats(counts map[string]int, limit int) ClientStats {
@@ -524,60 +240,17 @@ func buildEntryStats(counts map[string]int, limit int) ClientStats {
 	return result
 }
 
-func (s *OverallStatsManager) activeVisitorCount(websiteID string) (int, error) {
-	now := time.Now()
-	start := now.Add(-15 * time.Minute)
-
-	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT COUNT(DISTINCT ip_id)
-        FROM "%s_nginx_logs"
-        WHERE pageview_flag = 1 AND timestamp >= ? AND timestamp < ?`,
-		websiteID))
-
-	row := s.repo.GetDB().QueryRow(query, start.Unix(), now.Unix())
-	var count int
-	if err := row.Scan(&count); err != nil {
-		return 0, err
+func previousTimeRange(timeRange string, loc *time.Location) (time.Time, time.Time) {
+	if loc == nil {
+		loc = time.Local
 	}
-	return count, nil
-}
-
-func (s *OverallStatsManager) newReturningCounts(
-	websiteID string, startTime, endTime time.Time,
-) (int, int, error) {
-	startDay := dayBucket(startTime)
-	endDay := dayBucket(endTime)
-
-	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        WITH active_ips AS (
-            SELECT DISTINCT ip_id
-            FROM "%s_agg_daily_ip"
-            WHERE day >= ? AND day <= ?
-        )
-        SELECT
-            COALESCE(SUM(CASE WHEN fs.first_ts >= ? AND fs.first_ts < ? THEN 1 ELSE 0 END), 0) AS new_uv,
-            COALESCE(SUM(CASE WHEN fs.first_ts < ? THEN 1 ELSE 0 END), 0) AS returning_uv
-        FROM active_ips a
-        LEFT JOIN "%s_first_seen" fs ON fs.ip_id = a.ip_id`,
-		websiteID, websiteID))
-
-	row := s.repo.GetDB().QueryRow(
-		query,
-		startDay, endDay,
-		startTime.Unix(), endTime.Unix(),
-		startTime.Unix(),
-	)
-
-	var newCount, returningCount int
-	if err := row.Scan(&newCount, &returningCount); err != nil {
-		return 0, 0, err
+	now := time.Now().In(loc)
+	if start, end, ok, err := timeutil.ParseCustomRange(timeRange, loc); ok {
+		if err != nil {
+			return time.Time{}, time.Time{}
+		}
+		return previousCustomRange(start, end)
 	}
-
-	return newCount, returningCount, nil
-}
-
-func previousTimeRange(timeRange string) (time.Time, time.Time) {
-	now := time.Now()
 	if len(timeRange) == 10 {
 		if date, err := time.ParseInLocation("2006-01-02", timeRange, now.Location()); err == nil {
 			prev := date.AddDate(0, 0, -1)
@@ -606,13 +279,19 @@ func previousTimeRange(timeRange string) (time.Time, time.Time) {
 		start := time.Date(now.Year(), now.Month(), now.Day()-59, 0, 0, 0, 0, now.Location())
 		return start, end
 	case "week":
-		start, end, _ := timeutil.TimePeriod("week")
+		start, end, _ := timeutil.TimePeriodIn("week", loc)
 		return start.AddDate(0, 0, -7), end.AddDate(0, 0, -7)
 	case "month":
-		start, _, _ := timeutil.TimePeriod("month")
+		start, _, _ := timeutil.TimePeriodIn("month", loc)
 		prevEnd := start.Add(-time.Second)
 		prevStart := time.Date(prevEnd.Year(), prevEnd.Month(), 1, 0, 0, 0, 0, prevEnd.Location())
 		return prevStart, prevEnd
+	case "quarter", "lastQuarter":
+		start, _, _ := timeutil.TimePeriodIn(timeRange, loc)
+		return start.AddDate(0, -3, 0), start.Add(-time.Second)
+	case "year", "lastYear":
+		start, _, _ := timeutil.TimePeriodIn(timeRange, loc)
+		return start.AddDate(-1, 0, 0), start.Add(-time.Second)
 	default:
 		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
 		start := day.AddDate(0, 0, -1)
@@ -621,6 +300,19 @@ func previousTimeRange(timeRange string) (time.Time, time.Time) {
 	}
 }
 
+// previousCustomRange 紧邻自定义区间之前、长度相同的区间；整日区间按日历天平移以适配夏令时
+func previousCustomRange(start, end time.Time) (time.Time, time.Time) {
+	prevEnd := start.Add(-time.Second)
+	if start.Hour() == 0 && start.Minute() == 0 && start.Second() == 0 &&
+		end.Hour() == 23 && end.Minute() == 59 && end.Second() == 59 {
+		startDay := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+		endDay := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC)
+		days := int(endDay.Sub(startDay).Hours()/24) + 1
+		return start.AddDate(0, 0, -days), prevEnd
+	}
+	return start.Add(-end.Sub(start) - time.Second), prevEnd
+}
+
 func snapshotFromOverall(overall OverallStats) OverallSnapshot {
 	return OverallSnapshot{
 		PV:           overall.PV,
@@ -635,7 +327,7 @@ func (s *OverallStatsManager) buildCompareSnapshots(
 	startTime, endTime time.Time,
 	current OverallSnapshot,
 ) (OverallSnapshot, OverallSnapshot, OverallSnapshot) {
-	prevStart, prevEnd := previousTimeRange(timeRange)
+	prevStart, prevEnd := previousTimeRange(timeRange, startTime.Location())
 	if prevStart.IsZero() || prevEnd.IsZero() {
 		return OverallSnapshot{}, current, current
 	}
@@ -704,19 +396,19 @@ func scaleSnapshot(current OverallSnapshot, progress float64) OverallSnapshot {
 func (s *OverallStatsManager) snapshotForRange(
 	websiteID string, startTime, endTime time.Time,
 ) (OverallSnapshot, error) {
-	overall := OverallStats{}
-	if err := s.statsByTimeRangeForWebsite(websiteID, startTime, endTime, &overall); err != nil {
+	totals, err := s.stats.Totals(websiteID, startTime, endTime)
+	if err != nil {
 		return OverallSnapshot{}, err
 	}
 
-	metrics, err := collectSessionMetrics(s.repo, websiteID, startTime, endTime)
+	metrics, err := s.stats.SessionMetrics(websiteID, startTime, endTime)
 	if err != nil {
 		return OverallSnapshot{}, err
 	}
 
 	snapshot := OverallSnapshot{
-		PV:           overall.PV,
-		UV:           overall.UV,
+		PV:           totals.PV,
+		UV:           totals.UV,
 		SessionCount: metrics.SessionCount,
 	}
 
@@ -0,0 +1,120 @@
+package analytics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/store"
+)
+
+const testWebsiteID = "test_site"
+
+// testTime 按服务器本地时区构造时间，与聚合表的小时桶口径一致
+func testTime(day, hour, minute int) time.Time {
+	return time.Date(2025, time.March, day, hour, minute, 0, 0, time.Local)
+}
+
+func testPageview(ip, url string, ts time.Time) store.NginxLogRecord {
+	return store.NginxLogRecord{
+		IP:           ip,
+		Timestamp:    ts,
+		Method:       "GET",
+		Url:          url,
+		Status:       200,
+		BytesSent:    1000,
+		Referer:      "-",
+		UserBrowser:  "Chrome",
+		UserOs:       "Windows",
+		UserDevice:   "Desktop",
+		PageviewFlag: 1,
+	}
+}
+
+// newTestStats 构造固定的样本：
+// 3 月 1 日 A 首次访问；3 月 9 日 A、B 各浏览一次；
+// 3 月 10 日 A 连续浏览两页（一个会话），C 间隔 4 小时浏览两页（两个会话），D 请求一个 404 静态资源
+func newTestStats() *store.MemoryStats {
+	stats := store.NewMemoryStats()
+	missing := testPageview("10.0.0.4", "/static/app.js", testTime(10, 11, 0))
+	missing.Status = 404
+	missing.BytesSent = 300
+	missing.PageviewFlag = 0
+	stats.AddLogs(testWebsiteID,
+		testPageview("10.0.0.1", "/a", testTime(1, 10, 0)),
+		testPageview("10.0.0.1", "/a", testTime(9, 9, 0)),
+		testPageview("10.0.0.2", "/b", testTime(9, 9, 10)),
+		testPageview("10.0.0.1", "/a", testTime(10, 9, 0)),
+		testPageview("10.0.0.1", "/b", testTime(10, 9, 5)),
+		testPageview("10.0.0.3", "/a", testTime(10, 10, 0)),
+		testPageview("10.0.0.3", "/c", testTime(10, 14, 0)),
+		missing,
+	)
+	return stats
+}
+
+func testQuery(extra map[string]interface{}) StatsQuery {
+	return StatsQuery{WebsiteID: testWebsiteID, ExtraParam: extra}
+}
+
+func TestOverallStatsManagerQuery(t *testing.T) {
+	manager := NewOverallStatsManagerWithStats(newTestStats())
+	raw, err := manager.Query(testQuery(map[string]interface{}{"timeRange": "2025-03-10"}))
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	got := raw.(OverallStats)
+
+	if got.PV != 4 || got.UV != 2 || got.Traffic != 4000 {
+		t.Errorf("PV/UV/Traffic = %d/%d/%d, want 4/2/4000", got.PV, got.UV, got.Traffic)
+	}
+	if want := (StatusCodeHits{S2xx: 4, S4xx: 1}); got.StatusCodeHits != want {
+		t.Errorf("StatusCodeHits = %+v, want %+v", got.StatusCodeHits, want)
+	}
+	if want := (StatusCodeHits{S2xx: 2}); got.StatusCodeHitsPrevious != want {
+		t.Errorf("StatusCodeHitsPrevious = %+v, want %+v", got.StatusCodeHitsPrevious, want)
+	}
+	if got.SessionCount != 3 {
+		t.Errorf("SessionCount = %d, want 3", got.SessionCount)
+	}
+	if !reflect.DeepEqual(got.EntryPages.Key, []string{"/a", "/c"}) ||
+		!reflect.DeepEqual(got.EntryPages.UV, []int{2, 1}) ||
+		!reflect.DeepEqual(got.EntryPages.UVPercent, []int{67, 33}) {
+		t.Errorf("EntryPages = %+v, want /a=2 (67%%), /c=1 (33%%)", got.EntryPages)
+	}
+	if got.NewVisitorCount != 1 || got.ReturningVisitorCount != 1 {
+		t.Errorf("new/returning = %d/%d, want 1/1", got.NewVisitorCount, got.ReturningVisitorCount)
+	}
+	if got.PrevNewVisitorCount != 1 || got.PrevReturningVisitorCount != 1 {
+		t.Errorf("prev new/returning = %d/%d, want 1/1", got.PrevNewVisitorCount, got.PrevReturningVisitorCount)
+	}
+	if got.ActiveVisitorCount != 0 {
+		t.Errorf("ActiveVisitorCount = %d, want 0", got.ActiveVisitorCount)
+	}
+	if got.UVRelativeError != nil {
+		t.Errorf("UVRelativeError = %v, want nil for exact UV", *got.UVRelativeError)
+	}
+
+	// 区间已结束：同期等于上一期，预测等于当前值
+	previous := OverallSnapshot{PV: 2, UV: 2, SessionCount: 2}
+	want := OverallCompare{
+		Previous: previous,
+		SameTime: previous,
+		Forecast: OverallSnapshot{PV: 4, UV: 2, SessionCount: 3},
+	}
+	if got.Compare != want {
+		t.Errorf("Compare = %+v, want %+v", got.Compare, want)
+	}
+}
+
+func TestOverallStatsManagerEmptyRange(t *testing.T) {
+	manager := NewOverallStatsManagerWithStats(newTestStats())
+	raw, err := manager.Query(testQuery(map[string]interface{}{"timeRange": "2025-02-01~2025-02-07"}))
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	got := raw.(OverallStats)
+	if got.PV != 0 || got.UV != 0 || got.SessionCount != 0 || len(got.EntryPages.Key) != 0 {
+		t.Errorf("empty range returned %+v", got)
+	}
+}
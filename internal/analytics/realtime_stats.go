@@ -1,13 +1,10 @@
 package analytics
 
 import (
-	"fmt"
 	"sort"
 	"strings"
 	"time"
 
-	"github.com/likaia/nginxpulse/internal/config"
-	"github.com/likaia/nginxpulse/internal/sqlutil"
 	"github.com/likaia/nginxpulse/internal/store"
 )
 
@@ -34,12 +31,17 @@ func (s RealtimeStats) GetType() string {
 }
 
 type RealtimeStatsManager struct {
-	repo *store.Repository
+	stats store.StatsQuerier
 }
 
 func NewRealtimeStatsManager(userRepoPtr *store.Repository) *RealtimeStatsManager {
+	return NewRealtimeStatsManagerWithStats(userRepoPtr.Stats())
+}
+
+// NewRealtimeStatsManagerWithStats 使用指定的查询层创建 RealtimeStatsManager
+func NewRealtimeStatsManagerWithStats(stats store.StatsQuerier) *RealtimeStatsManager {
 	return &RealtimeStatsManager{
-		repo: userRepoPtr,
+		stats: stats,
 	}
 }
 
@@ -59,99 +61,47 @@ func (m *RealtimeStatsManager) Query(query StatsQuery) (StatsResult, error) {
 
 	endTime := time.Now()
 	startTime := endTime.Add(-time.Duration(window) * time.Minute)
+	timeRange := store.TimeRange{Start: startTime.Unix(), End: endTime.Unix()}
 
-	tableName := fmt.Sprintf("%s_nginx_logs", query.WebsiteID)
-
-	activeCount, err := m.activeVisitorCount(tableName, startTime, endTime)
+	activeCount, err := m.stats.ActiveVisitors(query.WebsiteID, timeRange)
 	if err != nil {
 		return result, err
 	}
 	result.ActiveCount = activeCount
 
-	series, err := m.activeSeries(tableName, startTime, endTime, window)
+	series, err := m.activeSeries(query.WebsiteID, timeRange, window)
 	if err != nil {
 		return result, err
 	}
 	result.ActiveSeries = series
 
-	result.DeviceBreakdown = m.deviceBreakdown(tableName, startTime, endTime)
+	result.DeviceBreakdown = m.deviceBreakdown(query.WebsiteID, startTime, endTime)
 
-	refererExpr := buildRealtimeRefererExpr(query.WebsiteID, "r.referer")
-	refererJoin := fmt.Sprintf(`JOIN "%s_dim_referer" r ON r.id = l.referer_id`, query.WebsiteID)
-	referers, _ := m.queryTopItems(tableName, refererJoin, refererExpr, refererExpr, startTime, endTime, 10, true)
+	referers, _ := m.queryTopItems(query.WebsiteID, store.DimensionReferer, startTime, endTime, 10, true)
 	result.Referers = referers
 
-	urlJoin := fmt.Sprintf(`JOIN "%s_dim_url" u ON u.id = l.url_id`, query.WebsiteID)
-	pages, _ := m.queryTopItems(tableName, urlJoin, "u.url", "u.url", startTime, endTime, 10, false)
+	pages, _ := m.queryTopItems(query.WebsiteID, store.DimensionURL, startTime, endTime, 10, false)
 	result.Pages = pages
 
-	entryCounts, _ := m.entryPages(tableName, startTime, endTime)
+	entryCounts, _ := m.entryPages(query.WebsiteID, startTime, endTime)
 	result.EntryPages = entryCounts
 
-	uaJoin := fmt.Sprintf(`JOIN "%s_dim_ua" ua ON ua.id = l.ua_id`, query.WebsiteID)
-	browsers, _ := m.queryTopItems(tableName, uaJoin, "ua.browser", "ua.browser", startTime, endTime, 10, true)
+	browsers, _ := m.queryTopItems(query.WebsiteID, store.DimensionBrowser, startTime, endTime, 10, true)
 	result.Browsers = browsers
 
-	locationExpr := "CASE WHEN position('·' in loc.domestic) > 0 THEN substring(loc.domestic from position('·' in loc.domestic) + 1) ELSE loc.domestic END"
-	locationJoin := fmt.Sprintf(`JOIN "%s_dim_location" loc ON loc.id = l.location_id`, query.WebsiteID)
-	locations, _ := m.queryTopItems(
-		tableName,
-		locationJoin,
-		locationExpr,
-		locationExpr,
-		startTime,
-		endTime,
-		10,
-		true,
-	)
+	locations, _ := m.queryTopItems(query.WebsiteID, store.DimensionCity, startTime, endTime, 10, true)
 	result.Locations = locations
 
 	return result, nil
 }
 
-func (m *RealtimeStatsManager) activeVisitorCount(tableName string, startTime, endTime time.Time) (int, error) {
-	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT COUNT(DISTINCT ip_id)
-        FROM "%s"
-        WHERE pageview_flag = 1 AND timestamp >= ? AND timestamp < ?`,
-		tableName))
-
-	row := m.repo.GetDB().QueryRow(query, startTime.Unix(), endTime.Unix())
-	var count int
-	if err := row.Scan(&count); err != nil {
-		return 0, err
-	}
-	return count, nil
-}
-
-func (m *RealtimeStatsManager) activeSeries(tableName string, startTime, endTime time.Time, window int) ([]int, error) {
-	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT (timestamp / 60) as bucket, COUNT(DISTINCT ip_id) as uv
-        FROM "%s"
-        WHERE pageview_flag = 1 AND timestamp >= ? AND timestamp < ?
-        GROUP BY bucket`,
-		tableName))
-
-	rows, err := m.repo.GetDB().Query(query, startTime.Unix(), endTime.Unix())
+func (m *RealtimeStatsManager) activeSeries(websiteID string, timeRange store.TimeRange, window int) ([]int, error) {
+	buckets, err := m.stats.VisitorBuckets(websiteID, timeRange, 60)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	buckets := make(map[int64]int)
-	for rows.Next() {
-		var bucket int64
-		var uv int
-		if err := rows.Scan(&bucket, &uv); err != nil {
-			return nil, err
-		}
-		buckets[bucket] = uv
-	}
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
 
-	startBucket := startTime.Unix() / 60
+	startBucket := timeRange.Start / 60
 	series := make([]int, window)
 	for i := 0; i < window; i++ {
 		series[i] = buckets[startBucket+int64(i)]
@@ -159,20 +109,16 @@ func (m *RealtimeStatsManager) activeSeries(tableName string, startTime, endTime
 	return series, nil
 }
 
-func (m *RealtimeStatsManager) deviceBreakdown(tableName string, startTime, endTime time.Time) []RealtimeItem {
-	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT ua.device, COUNT(DISTINCT l.ip_id) as uv
-        FROM "%s" l
-        JOIN "%s_dim_ua" ua ON ua.id = l.ua_id
-        WHERE l.pageview_flag = 1 AND l.timestamp >= ? AND l.timestamp < ?
-        GROUP BY ua.device`,
-		tableName, strings.TrimSuffix(tableName, "_nginx_logs")))
-
-	rows, err := m.repo.GetDB().Query(query, startTime.Unix(), endTime.Unix())
+func (m *RealtimeStatsManager) deviceBreakdown(websiteID string, startTime, endTime time.Time) []RealtimeItem {
+	devices, err := m.stats.TopDimension(websiteID, store.DimensionQuery{
+		Dimension: store.DimensionDevice,
+		Start:     startTime,
+		End:       endTime,
+		Limit:     -1,
+	})
 	if err != nil {
 		return []RealtimeItem{}
 	}
-	defer rows.Close()
 
 	var (
 		pc     int
@@ -181,21 +127,16 @@ func (m *RealtimeStatsManager) deviceBreakdown(tableName string, startTime, endT
 		total  int
 	)
 
-	for rows.Next() {
-		var device string
-		var count int
-		if err := rows.Scan(&device, &count); err != nil {
-			return []RealtimeItem{}
-		}
-		switch device {
+	for _, row := range devices.Rows {
+		switch row.Key {
 		case "桌面设备":
-			pc += count
+			pc += row.CurUV
 		case "手机", "平板":
-			mobile += count
+			mobile += row.CurUV
 		default:
-			other += count
+			other += row.CurUV
 		}
-		total += count
+		total += row.CurUV
 	}
 
 	return []RealtimeItem{
@@ -205,11 +146,10 @@ func (m *RealtimeStatsManager) deviceBreakdown(tableName string, startTime, endT
 	}
 }
 
+// queryTopItems 窗口内的维度排行，distinctIP 为 true 时按访客数计数，否则按浏览量计数
 func (m *RealtimeStatsManager) queryTopItems(
-	tableName string,
-	joinClause string,
-	selectExpr string,
-	groupExpr string,
+	websiteID string,
+	dimension store.Dimension,
 	startTime, endTime time.Time,
 	limit int,
 	distinctIP bool,
@@ -217,49 +157,39 @@ func (m *RealtimeStatsManager) queryTopItems(
 	if limit <= 0 {
 		limit = 10
 	}
-	countExpr := "COUNT(*)"
-	if distinctIP {
-		countExpr = "COUNT(DISTINCT l.ip_id)"
+	dimQuery := store.DimensionQuery{
+		Dimension: dimension,
+		Start:     startTime,
+		End:       endTime,
+		OrderBy:   store.MetricUV,
+		Limit:     limit,
 	}
-
-	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT %[1]s as key, %[2]s as cnt
-        FROM "%[3]s" l
-        %[4]s
-        WHERE l.pageview_flag = 1 AND l.timestamp >= ? AND l.timestamp < ?
-        GROUP BY %[5]s
-        ORDER BY cnt DESC
-        LIMIT ?`,
-		selectExpr, countExpr, tableName, joinClause, groupExpr))
-
-	rows, err := m.repo.GetDB().Query(query, startTime.Unix(), endTime.Unix(), limit)
+	if !distinctIP {
+		dimQuery.OrderBy = store.MetricPV
+	}
+	dimResult, err := m.stats.TopDimension(websiteID, dimQuery)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
 	type item struct {
 		key   string
 		count int
 	}
-	items := make([]item, 0)
+	items := make([]item, 0, len(dimResult.Rows))
 	total := 0
-	for rows.Next() {
-		var key string
-		var count int
-		if err := rows.Scan(&key, &count); err != nil {
-			return nil, err
-		}
-		key = strings.TrimSpace(key)
+	for _, row := range dimResult.Rows {
+		key := strings.TrimSpace(row.Key)
 		if key == "" {
 			key = "未知"
 		}
+		count := row.CurUV
+		if !distinctIP {
+			count = row.CurPV
+		}
 		items = append(items, item{key: key, count: count})
 		total += count
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
 
 	result := make([]RealtimeItem, 0, len(items))
 	for _, item := range items {
@@ -273,61 +203,21 @@ func (m *RealtimeStatsManager) queryTopItems(
 }
 
 func (m *RealtimeStatsManager) entryPages(
-	tableName string,
+	websiteID string,
 	startTime, endTime time.Time,
 ) ([]RealtimeItem, error) {
-	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT l.timestamp, l.ip_id, l.ua_id, u.url
-        FROM "%s" l
-        JOIN "%s_dim_url" u ON u.id = l.url_id
-        WHERE l.pageview_flag = 1 AND l.timestamp >= ? AND l.timestamp < ?
-        ORDER BY l.ip_id, l.ua_id, l.timestamp`,
-		tableName, strings.TrimSuffix(tableName, "_nginx_logs")))
-
-	rows, err := m.repo.GetDB().Query(query, startTime.Unix(), endTime.Unix())
+	metrics, err := m.stats.SessionMetrics(websiteID, startTime, endTime)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	entryCounts := make(map[string]int)
-	var (
-		currentKey    string
-		lastTimestamp int64
-		initialized   bool
-	)
-
-	for rows.Next() {
-		var (
-			timestamp int64
-			url       string
-			ipID      int64
-			uaID      int64
-		)
-
-		if err := rows.Scan(&timestamp, &ipID, &uaID, &url); err != nil {
-			return nil, err
-		}
-
-		key := fmt.Sprintf("%d|%d", ipID, uaID)
-		if !initialized || key != currentKey || timestamp-lastTimestamp > sessionGapSeconds {
-			entryCounts[url]++
-			currentKey = key
-			initialized = true
-		}
-		lastTimestamp = timestamp
-	}
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
 
 	type entry struct {
 		Key   string
 		Count int
 	}
-	entries := make([]entry, 0, len(entryCounts))
+	entries := make([]entry, 0, len(metrics.EntryCounts))
 	total := 0
-	for key, count := range entryCounts {
+	for key, count := range metrics.EntryCounts {
 		entries = append(entries, entry{Key: key, Count: count})
 		total += count
 	}
@@ -352,21 +242,6 @@ func (m *RealtimeStatsManager) entryPages(
 	return result, nil
 }
 
-func buildRealtimeRefererExpr(websiteID string, refererColumn string) string {
-	internalCond := ""
-	if website, ok := config.GetWebsiteByID(websiteID); ok {
-		internalCond = buildInternalRefererCondition(website.Domains, refererColumn)
-	}
-	if internalCond != "" {
-		return fmt.Sprintf(
-			"CASE WHEN %[1]s = '-' OR %[1]s = '' THEN '直接输入网址访问' WHEN %s THEN '站内访问' ELSE %[1]s END",
-			refererColumn,
-			internalCond,
-		)
-	}
-	return fmt.Sprintf("CASE WHEN %[1]s = '-' OR %[1]s = '' THEN '直接输入网址访问' ELSE %[1]s END", refererColumn)
-}
-
 func safePercent(value, total int) float64 {
 	if total <= 0 {
 		return 0
@@ -6,9 +6,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/likaia/nginxpulse/internal/sqlutil"
 	"github.com/likaia/nginxpulse/internal/store"
-	"github.com/likaia/nginxpulse/internal/timeutil"
 )
 
 // SessionEntry 表示一条会话记录
@@ -44,15 +42,23 @@ func (s SessionsStats) GetType() string {
 	return "session"
 }
 
+// sessionGapSeconds 同一访客两次浏览间隔超过该值时切分为新会话
+const sessionGapSeconds = int64(1800)
+
 // SessionsStatsManager 实现会话查询功能
 type SessionsStatsManager struct {
-	repo *store.Repository
+	stats store.StatsQuerier
 }
 
 // NewSessionsStatsManager 创建会话查询管理器
 func NewSessionsStatsManager(userRepoPtr *store.Repository) *SessionsStatsManager {
+	return NewSessionsStatsManagerWithStats(userRepoPtr.Stats())
+}
+
+// NewSessionsStatsManagerWithStats 使用指定的查询层创建会话查询管理器
+func NewSessionsStatsManagerWithStats(stats store.StatsQuerier) *SessionsStatsManager {
 	return &SessionsStatsManager{
-		repo: userRepoPtr,
+		stats: stats,
 	}
 }
 
@@ -63,6 +69,7 @@ func (m *SessionsStatsManager) Query(query StatsQuery) (StatsResult, error) {
 	page := 1
 	pageSize := 100
 	var timeRange string
+	loc := queryLocation(query)
 	var timeStart int64
 	var timeEnd int64
 	var ipFilter string
@@ -83,14 +90,14 @@ func (m *SessionsStatsManager) Query(query StatsQuery) (StatsResult, error) {
 		timeRange = timeRangeVal
 	}
 	if timeStartVal, ok := query.ExtraParam["timeStart"].(string); ok && timeStartVal != "" {
-		parsed, err := parseTimeFilter(timeStartVal)
+		parsed, err := parseTimeFilter(timeStartVal, loc)
 		if err != nil {
 			return result, fmt.Errorf("解析开始时间失败: %v", err)
 		}
 		timeStart = parsed
 	}
 	if timeEndVal, ok := query.ExtraParam["timeEnd"].(string); ok && timeEndVal != "" {
-		parsed, err := parseTimeFilter(timeEndVal)
+		parsed, err := parseTimeFilter(timeEndVal, loc)
 		if err != nil {
 			return result, fmt.Errorf("解析结束时间失败: %v", err)
 		}
@@ -109,67 +116,18 @@ func (m *SessionsStatsManager) Query(query StatsQuery) (StatsResult, error) {
 		osFilter = strings.TrimSpace(osFilterVal)
 	}
 
-	var queryBuilder strings.Builder
-	queryBuilder.WriteString(fmt.Sprintf(`
-        SELECT l.timestamp, l.ip_id, l.ua_id, ip.ip, ua.browser, ua.os, ua.device,
-               u.url, loc.domestic, loc.global
-        FROM "%s_nginx_logs" l
-        JOIN "%s_dim_ip" ip ON ip.id = l.ip_id
-        JOIN "%s_dim_ua" ua ON ua.id = l.ua_id
-        JOIN "%s_dim_url" u ON u.id = l.url_id
-        JOIN "%s_dim_location" loc ON loc.id = l.location_id`,
-		query.WebsiteID, query.WebsiteID, query.WebsiteID, query.WebsiteID, query.WebsiteID))
-
-	conditions := make([]string, 0, 4)
-	args := make([]interface{}, 0, 6)
-	conditions = append(conditions, "pageview_flag = 1")
-
-	if timeRange != "" {
-		startTime, endTime, err := timeutil.TimePeriod(timeRange)
-		if err != nil {
-			return result, fmt.Errorf("解析时间范围失败: %v", err)
-		}
-		conditions = append(conditions, "timestamp >= ? AND timestamp < ?")
-		args = append(args, startTime.Unix(), endTime.Unix())
-	}
-	if timeStart > 0 {
-		conditions = append(conditions, "timestamp >= ?")
-		args = append(args, timeStart)
-	}
-	if timeEnd > 0 {
-		conditions = append(conditions, "timestamp <= ?")
-		args = append(args, timeEnd)
-	}
-	if ipFilter != "" {
-		conditions = append(conditions, "ip.ip LIKE ?")
-		args = append(args, "%"+ipFilter+"%")
-	}
-	if deviceFilter != "" {
-		conditions = append(conditions, "ua.device LIKE ?")
-		args = append(args, "%"+deviceFilter+"%")
-	}
-	if browserFilter != "" {
-		conditions = append(conditions, "ua.browser LIKE ?")
-		args = append(args, "%"+browserFilter+"%")
-	}
-	if osFilter != "" {
-		conditions = append(conditions, "ua.os LIKE ?")
-		args = append(args, "%"+osFilter+"%")
-	}
-
-	if len(conditions) > 0 {
-		queryBuilder.WriteString(" WHERE ")
-		queryBuilder.WriteString(strings.Join(conditions, " AND "))
-	}
-
-	queryBuilder.WriteString(" ORDER BY l.ip_id, l.ua_id, l.timestamp")
-
-	queryStr := sqlutil.ReplacePlaceholders(queryBuilder.String())
-	rows, err := m.repo.GetDB().Query(queryStr, args...)
+	filterStart, filterEnd, err := resolveFilterRange(timeRange, timeStart, timeEnd, loc)
 	if err != nil {
-		return result, fmt.Errorf("查询会话日志失败: %v", err)
+		return result, err
+	}
+	filter := store.LogFilter{
+		Start:   filterStart,
+		End:     filterEnd,
+		IP:      ipFilter,
+		Device:  deviceFilter,
+		Browser: browserFilter,
+		OS:      osFilter,
 	}
-	defer rows.Close()
 
 	sessions := make([]SessionEntry, 0)
 	var (
@@ -179,57 +137,38 @@ func (m *SessionsStatsManager) Query(query StatsQuery) (StatsResult, error) {
 		initialized   bool
 	)
 
-	for rows.Next() {
-		var (
-			timestamp int64
-			ipID      int64
-			uaID      int64
-			ip        string
-			browser   string
-			os        string
-			device    string
-			url       string
-			domestic  string
-			global    string
-		)
-
-		if err := rows.Scan(&timestamp, &ipID, &uaID, &ip, &browser, &os, &device, &url, &domestic, &global); err != nil {
-			return result, fmt.Errorf("解析会话日志失败: %v", err)
-		}
-
-		key := fmt.Sprintf("%d|%d", ipID, uaID)
-
-		if !initialized || key != currentKey || timestamp-lastTimestamp > sessionGapSeconds {
+	err = m.stats.ScanPageviews(query.WebsiteID, filter, func(row store.PageviewRow) error {
+		if !initialized || row.Visitor != currentKey || row.Timestamp-lastTimestamp > sessionGapSeconds {
 			if initialized {
 				finalizeSession(&current)
 				sessions = append(sessions, current)
 			}
-			currentKey = key
+			currentKey = row.Visitor
 			current = SessionEntry{
-				IP:               ip,
-				DomesticLocation: domestic,
-				GlobalLocation:   global,
-				UserDevice:       device,
-				UserBrowser:      browser,
-				UserOS:           os,
-				StartTimestamp:   timestamp,
-				EndTimestamp:     timestamp,
-				EntryURL:         url,
-				ExitURL:          url,
+				IP:               row.IP,
+				DomesticLocation: row.Domestic,
+				GlobalLocation:   row.Global,
+				UserDevice:       row.Device,
+				UserBrowser:      row.Browser,
+				UserOS:           row.OS,
+				StartTimestamp:   row.Timestamp,
+				EndTimestamp:     row.Timestamp,
+				EntryURL:         row.URL,
+				ExitURL:          row.URL,
 				PageCount:        1,
 			}
 			initialized = true
 		} else {
-			current.EndTimestamp = timestamp
-			current.ExitURL = url
+			current.EndTimestamp = row.Timestamp
+			current.ExitURL = row.URL
 			current.PageCount++
 		}
 
-		lastTimestamp = timestamp
-	}
-
-	if err := rows.Err(); err != nil {
-		return result, fmt.Errorf("遍历会话日志失败: %v", err)
+		lastTimestamp = row.Timestamp
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("查询会话日志失败: %v", err)
 	}
 
 	if initialized {
@@ -3,7 +3,6 @@ package analytics
 import (
 	"fmt"
 
-	"github.com/likaia/nginxpulse/internal/sqlutil"
 	"github.com/likaia/nginxpulse/internal/store"
 	"github.com/likaia/nginxpulse/internal/timeutil"
 )
@@ -20,12 +19,17 @@ func (s SessionSummary) GetType() string {
 }
 
 type SessionSummaryStatsManager struct {
-	repo *store.Repository
+	stats store.StatsQuerier
 }
 
 func NewSessionSummaryStatsManager(userRepoPtr *store.Repository) *SessionSummaryStatsManager {
+	return NewSessionSummaryStatsManagerWithStats(userRepoPtr.Stats())
+}
+
+// NewSessionSummaryStatsManagerWithStats 使用指定的查询层创建 SessionSummaryStatsManager
+func NewSessionSummaryStatsManagerWithStats(stats store.StatsQuerier) *SessionSummaryStatsManager {
 	return &SessionSummaryStatsManager{
-		repo: userRepoPtr,
+		stats: stats,
 	}
 }
 
@@ -37,26 +41,11 @@ func (m *SessionSummaryStatsManager) Query(query StatsQuery) (StatsResult, error
 		return result, fmt.Errorf("timeRange 参数缺失")
 	}
 
-	startTime, endTime, err := timeutil.TimePeriod(timeRange)
+	startTime, endTime, err := timeutil.TimePeriodIn(timeRange, queryLocation(query))
 	if err != nil {
 		return result, fmt.Errorf("解析时间范围失败: %v", err)
 	}
 
-	tableName := fmt.Sprintf("%s_nginx_logs", query.WebsiteID)
-	rows, err := m.repo.GetDB().Query(
-		sqlutil.ReplacePlaceholders(fmt.Sprintf(`
-        SELECT timestamp, ip_id, ua_id
-        FROM "%s"
-        WHERE pageview_flag = 1 AND timestamp >= ? AND timestamp < ?
-        ORDER BY ip_id, ua_id, timestamp`,
-			tableName)),
-		startTime.Unix(), endTime.Unix(),
-	)
-	if err != nil {
-		return result, fmt.Errorf("查询会话摘要失败: %v", err)
-	}
-	defer rows.Close()
-
 	var (
 		currentKey     string
 		lastTimestamp  int64
@@ -67,35 +56,26 @@ func (m *SessionSummaryStatsManager) Query(query StatsQuery) (StatsResult, error
 		totalDuration  int64
 	)
 
-	for rows.Next() {
-		var (
-			timestamp int64
-			ipID      int64
-			uaID      int64
-		)
-		if err := rows.Scan(&timestamp, &ipID, &uaID); err != nil {
-			return result, fmt.Errorf("解析会话摘要失败: %v", err)
-		}
-
-		key := fmt.Sprintf("%d|%d", ipID, uaID)
-		if !initialized || key != currentKey || timestamp-lastTimestamp > sessionGapSeconds {
+	filter := store.LogFilter{Start: startTime.Unix(), End: endTime.Unix()}
+	err = m.stats.ScanPageviews(query.WebsiteID, filter, func(row store.PageviewRow) error {
+		if !initialized || row.Visitor != currentKey || row.Timestamp-lastTimestamp > sessionGapSeconds {
 			if initialized {
 				finalizeSessionSummary(&result, startTimestamp, endTimestamp, pageCount, &totalDuration)
 			}
-			currentKey = key
-			startTimestamp = timestamp
-			endTimestamp = timestamp
+			currentKey = row.Visitor
+			startTimestamp = row.Timestamp
+			endTimestamp = row.Timestamp
 			pageCount = 1
 			initialized = true
 		} else {
-			endTimestamp = timestamp
+			endTimestamp = row.Timestamp
 			pageCount++
 		}
-		lastTimestamp = timestamp
-	}
-
-	if err := rows.Err(); err != nil {
-		return result, fmt.Errorf("遍历会话摘要失败: %v", err)
+		lastTimestamp = row.Timestamp
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("查询会话摘要失败: %v", err)
 	}
 
 	if initialized {
@@ -64,6 +64,7 @@ func (f *StatsFactory) registerDefaultManagers() {
 
 	f.managers["url"] = NewURLStatsManager(f.repo)
 	f.managers["referer"] = NewrefererStatsManager(f.repo)
+	f.managers["channel"] = NewChannelStatsManager(f.repo)
 
 	f.managers["browser"] = NewBrowserStatsManager(f.repo)
 	f.managers["os"] = NewOsStatsManager(f.repo)
@@ -191,6 +192,7 @@ func (f *StatsFactory) BuildQueryFromRequest(
 		"overall":         {"id": "string", "timeRange": "string"},
 		"url":             {"id": "string", "timeRange": "string", "limit": "int"},
 		"referer":         {"id": "string", "timeRange": "string", "limit": "int"},
+		"channel":         {"id": "string", "timeRange": "string", "limit": "int"},
 		"browser":         {"id": "string", "timeRange": "string", "limit": "int"},
 		"os":              {"id": "string", "timeRange": "string", "limit": "int"},
 		"device":          {"id": "string", "timeRange": "string", "limit": "int"},
@@ -207,6 +209,15 @@ func (f *StatsFactory) BuildQueryFromRequest(
 		return query, fmt.Errorf("不支持的统计类型: %s", statsType)
 	}
 
+	// from/to 自定义区间与时区
+	params, err := parseTimeParams(params)
+	if err != nil {
+		return query, err
+	}
+	if timezone := params["timezone"]; timezone != "" {
+		query.ExtraParam["timezone"] = timezone
+	}
+
 	// 获取网站ID
 	websiteID, err := getRequiredString(params, "id")
 	if err != nil {
@@ -248,6 +259,11 @@ func (f *StatsFactory) BuildQueryFromRequest(
 	}
 
 	// 处理特殊可选参数
+	if compareSupportedTypes[statsType] {
+		if err := parseCompareParams(params, query.ExtraParam); err != nil {
+			return query, err
+		}
+	}
 	if statsType == "logs" {
 		if filter, ok := params["filter"]; ok && filter != "" {
 			query.ExtraParam["filter"] = filter
@@ -374,6 +390,16 @@ func (f *StatsFactory) BuildQueryFromRequest(
 			query.ExtraParam["osFilter"] = osFilter
 		}
 	}
+	if statsType == "referer" {
+		if groupBy, ok := params["groupBy"]; ok && groupBy != "" {
+			switch groupBy {
+			case "url", "host", "source", "keyword":
+				query.ExtraParam["groupBy"] = groupBy
+			default:
+				return query, fmt.Errorf("groupBy 参数无效")
+			}
+		}
+	}
 	if statsType == "overall" {
 		if entryLimit, ok := params["entryLimit"]; ok && entryLimit != "" {
 			value, err := getRequiredInt(params, "entryLimit", 1)
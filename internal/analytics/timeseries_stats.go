@@ -4,9 +4,9 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/likaia/nginxpulse/internal/sqlutil"
 	"github.com/likaia/nginxpulse/internal/store"
 	"github.com/likaia/nginxpulse/internal/timeutil"
+	"github.com/sirupsen/logrus"
 )
 
 type StatPoint struct {
@@ -19,6 +19,29 @@ type TimeSeriesStats struct {
 	Visitors  []int    `json:"visitors"`
 	Pageviews []int    `json:"pageviews"`
 	PvMinusUv []int    `json:"pvMinusUv"` // PV - UV
+
+	Compare     *TimeSeriesCompare     `json:"compare,omitempty"`     // 对比区间数据（与 Labels 按位置对齐）
+	Annotations []TimeSeriesAnnotation `json:"annotations,omitempty"` // 流量异常标注
+
+	UVRelativeError *float64 `json:"uvRelativeError,omitempty"` // UV 近似计数时的相对标准误差，精确计数时不返回
+}
+
+// TimeSeriesAnnotation 落在某个时间点上的流量异常，Index 对应 Labels 下标
+type TimeSeriesAnnotation struct {
+	Index int `json:"index"`
+	store.TrafficAnomaly
+}
+
+// TimeSeriesCompare 对比区间的时间序列及逐点变化
+type TimeSeriesCompare struct {
+	CompareRange
+	Labels                 []string   `json:"labels"`
+	Visitors               []int      `json:"visitors"`
+	Pageviews              []int      `json:"pageviews"`
+	VisitorsChange         []int      `json:"visitorsChange"`
+	PageviewsChange        []int      `json:"pageviewsChange"`
+	VisitorsChangePercent  []*float64 `json:"visitorsChangePercent"`  // 对比值为 0 时为 null
+	PageviewsChangePercent []*float64 `json:"pageviewsChangePercent"` // 对比值为 0 时为 null
 }
 
 // TimeSeriesStats 实现 StatsResult 接口
@@ -27,13 +50,18 @@ func (s TimeSeriesStats) GetType() string {
 }
 
 type TimeSeriesStatsManager struct {
-	repo *store.Repository
+	stats store.StatsQuerier
 }
 
 // NewTimeSeriesStatsManager 创建一个新的 TimeSeriesStatsManager 实例
 func NewTimeSeriesStatsManager(userRepoPtr *store.Repository) *TimeSeriesStatsManager {
+	return NewTimeSeriesStatsManagerWithStats(userRepoPtr.Stats())
+}
+
+// NewTimeSeriesStatsManagerWithStats 使用指定的查询层创建 TimeSeriesStatsManager
+func NewTimeSeriesStatsManagerWithStats(stats store.StatsQuerier) *TimeSeriesStatsManager {
 	return &TimeSeriesStatsManager{
-		repo: userRepoPtr,
+		stats: stats,
 	}
 }
 
@@ -41,12 +69,15 @@ func NewTimeSeriesStatsManager(userRepoPtr *store.Repository) *TimeSeriesStatsMa
 func (s *TimeSeriesStatsManager) Query(query StatsQuery) (StatsResult, error) {
 	timeRange := query.ExtraParam["timeRange"].(string)
 	viewType := query.ExtraParam["viewType"].(string)
-	timePoints, labels := timeutil.TimePointsAndLabels(timeRange, viewType)
+	loc := queryLocation(query)
+	timePoints, labels := timeutil.TimePointsAndLabelsIn(timeRange, viewType, loc)
 	result := TimeSeriesStats{
 		Labels:    labels,
 		Visitors:  make([]int, len(timePoints)),
 		Pageviews: make([]int, len(timePoints)),
 		PvMinusUv: make([]int, len(timePoints)),
+
+		UVRelativeError: uvRelativeError(query.WebsiteID),
 	}
 
 	statPoints, err := s.statsByTimePointsForWebsite(query.WebsiteID, timePoints, viewType)
@@ -59,144 +90,125 @@ func (s *TimeSeriesStatsManager) Query(query StatsQuery) (StatsResult, error) {
 		result.PvMinusUv[i] = point.PV - point.UV
 	}
 
-	return result, nil
-}
-
-// statsByTimePointsForWebsite 根据多个时间点批量查询统计数据
-func (s *TimeSeriesStatsManager) statsByTimePointsForWebsite(
-	websiteID string, timePoints []time.Time, viewType string) ([]StatPoint, error) {
-
-	timePointsSize := len(timePoints)
-	results := make([]StatPoint, timePointsSize)
-
-	if timePointsSize == 0 {
-		return results, nil
+	annotations, err := s.buildAnnotations(query.WebsiteID, timePoints, viewType)
+	if err != nil {
+		logrus.WithError(err).Warn("获取流量异常标注失败")
+	} else {
+		result.Annotations = annotations
 	}
 
-	if viewType == "hourly" {
-		return s.statsByHourlyBuckets(websiteID, timePoints, results)
+	startTime, endTime, err := timeutil.TimePeriodIn(timeRange, loc)
+	if err != nil {
+		return result, err
+	}
+	if cmp := compareRangeFromQuery(query, timeRange, startTime, endTime); cmp != nil {
+		compare, err := s.buildCompareSeries(query.WebsiteID, timePoints, startTime, viewType, cmp, statPoints)
+		if err != nil {
+			return result, fmt.Errorf("获取对比图表数据失败: %v", err)
+		}
+		result.Compare = compare
 	}
 
-	return s.statsByDailyBuckets(websiteID, timePoints, results)
+	return result, nil
 }
 
-func (s *TimeSeriesStatsManager) statsByHourlyBuckets(
-	websiteID string, timePoints []time.Time, results []StatPoint) ([]StatPoint, error) {
+// buildAnnotations 把已检测到的小时级异常映射到图表的时间点上
+func (s *TimeSeriesStatsManager) buildAnnotations(
+	websiteID string, timePoints []time.Time, viewType string) ([]TimeSeriesAnnotation, error) {
 
-	bucketIndex := make(map[int64]int, len(timePoints))
-	startBucket := hourBucket(timePoints[0])
-	endBucket := hourBucket(timePoints[len(timePoints)-1])
+	if len(timePoints) == 0 {
+		return nil, nil
+	}
+	hourly := viewType == "hourly"
+	indexByKey := make(map[string]int, len(timePoints))
 	for i, point := range timePoints {
-		bucket := hourBucket(point)
-		results[i] = StatPoint{}
-		bucketIndex[bucket] = i
+		if hourly {
+			indexByKey[fmt.Sprint(hourBucket(point))] = i
+		} else {
+			indexByKey[point.Format("2006-01-02")] = i
+		}
 	}
 
-	rows, err := s.repo.GetDB().Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
-		`SELECT bucket, pv FROM "%s_agg_hourly" WHERE bucket >= ? AND bucket <= ?`,
-		websiteID,
-	)), startBucket, endBucket)
+	start := hourBucket(timePoints[0])
+	end := hourBucket(timePoints[len(timePoints)-1])
+	if !hourly {
+		last := timePoints[len(timePoints)-1]
+		end = time.Date(last.Year(), last.Month(), last.Day(), 23, 0, 0, 0, last.Location()).Unix()
+	}
+	anomalies, err := s.stats.TrafficAnomalies(websiteID, start, end)
 	if err != nil {
-		return results, err
+		return nil, err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var bucket int64
-		var pv int
-		if err := rows.Scan(&bucket, &pv); err != nil {
-			return results, err
+
+	annotations := make([]TimeSeriesAnnotation, 0, len(anomalies))
+	for _, anomaly := range anomalies {
+		key := fmt.Sprint(anomaly.Bucket)
+		if !hourly {
+			key = time.Unix(anomaly.Bucket, 0).In(timePoints[0].Location()).Format("2006-01-02")
 		}
-		if idx, ok := bucketIndex[bucket]; ok {
-			results[idx].PV = pv
+		idx, ok := indexByKey[key]
+		if !ok {
+			continue
 		}
+		annotations = append(annotations, TimeSeriesAnnotation{Index: idx, TrafficAnomaly: anomaly})
 	}
-	if err := rows.Err(); err != nil {
-		return results, err
-	}
+	return annotations, nil
+}
 
-	uvRows, err := s.repo.GetDB().Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
-		`SELECT bucket, COUNT(*) FROM "%s_agg_hourly_ip" WHERE bucket >= ? AND bucket <= ? GROUP BY bucket`,
-		websiteID,
-	)), startBucket, endBucket)
+// buildCompareSeries 把当前时间点平移到对比区间后查询，超出对比区间的点记为 0
+func (s *TimeSeriesStatsManager) buildCompareSeries(
+	websiteID string, timePoints []time.Time, startTime time.Time, viewType string,
+	cmp *CompareRange, current []StatPoint) (*TimeSeriesCompare, error) {
+
+	comparePoints := shiftComparePoints(timePoints, startTime, cmp)
+	size := len(comparePoints)
+	compare := &TimeSeriesCompare{
+		CompareRange:           *cmp,
+		Labels:                 make([]string, size),
+		Visitors:               make([]int, size),
+		Pageviews:              make([]int, size),
+		VisitorsChange:         make([]int, size),
+		PageviewsChange:        make([]int, size),
+		VisitorsChangePercent:  make([]*float64, size),
+		PageviewsChangePercent: make([]*float64, size),
+	}
+
+	statPoints, err := s.statsByTimePointsForWebsite(websiteID, comparePoints, viewType)
 	if err != nil {
-		return results, err
+		return compare, err
 	}
-	defer uvRows.Close()
-	for uvRows.Next() {
-		var bucket int64
-		var uv int
-		if err := uvRows.Scan(&bucket, &uv); err != nil {
-			return results, err
+	for i, point := range comparePoints {
+		if viewType == "hourly" {
+			compare.Labels[i] = fmt.Sprintf("%s %d:00", timeutil.FormatDateWithWeekday(point, false), point.Hour())
+		} else {
+			compare.Labels[i] = timeutil.FormatDateWithWeekday(point, false)
 		}
-		if idx, ok := bucketIndex[bucket]; ok {
-			results[idx].UV = uv
+		if point.Unix() > cmp.End || point.Unix() < cmp.Start {
+			statPoints[i] = StatPoint{}
 		}
-	}
-	if err := uvRows.Err(); err != nil {
-		return results, err
+		compare.Pageviews[i] = statPoints[i].PV
+		compare.Visitors[i] = statPoints[i].UV
+		compare.PageviewsChange[i] = current[i].PV - statPoints[i].PV
+		compare.VisitorsChange[i] = current[i].UV - statPoints[i].UV
+		compare.PageviewsChangePercent[i] = changePercent(current[i].PV, statPoints[i].PV)
+		compare.VisitorsChangePercent[i] = changePercent(current[i].UV, statPoints[i].UV)
 	}
 
-	return results, nil
+	return compare, nil
 }
 
-func (s *TimeSeriesStatsManager) statsByDailyBuckets(
-	websiteID string, timePoints []time.Time, results []StatPoint) ([]StatPoint, error) {
-
-	dayIndex := make(map[string]int, len(timePoints))
-	startDay := dayBucket(timePoints[0])
-	endDay := dayBucket(timePoints[len(timePoints)-1])
-	for i, point := range timePoints {
-		day := dayBucket(point)
-		results[i] = StatPoint{}
-		dayIndex[day] = i
-	}
-
-	rows, err := s.repo.GetDB().Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
-		`SELECT day, pv FROM "%s_agg_daily" WHERE day >= ? AND day <= ?`,
-		websiteID,
-	)), startDay, endDay)
-	if err != nil {
-		return results, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var day time.Time
-		var pv int
-		if err := rows.Scan(&day, &pv); err != nil {
-			return results, err
-		}
-		dayKey := day.Format("2006-01-02")
-		if idx, ok := dayIndex[dayKey]; ok {
-			results[idx].PV = pv
-		}
-	}
-	if err := rows.Err(); err != nil {
-		return results, err
-	}
+// statsByTimePointsForWebsite 根据多个时间点批量查询统计数据
+func (s *TimeSeriesStatsManager) statsByTimePointsForWebsite(
+	websiteID string, timePoints []time.Time, viewType string) ([]StatPoint, error) {
 
-	uvRows, err := s.repo.GetDB().Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
-		`SELECT day, COUNT(*) FROM "%s_agg_daily_ip" WHERE day >= ? AND day <= ? GROUP BY day`,
-		websiteID,
-	)), startDay, endDay)
+	results := make([]StatPoint, len(timePoints))
+	points, err := s.stats.Series(websiteID, timePoints, viewType == "hourly")
 	if err != nil {
 		return results, err
 	}
-	defer uvRows.Close()
-	for uvRows.Next() {
-		var day time.Time
-		var uv int
-		if err := uvRows.Scan(&day, &uv); err != nil {
-			return results, err
-		}
-		dayKey := day.Format("2006-01-02")
-		if idx, ok := dayIndex[dayKey]; ok {
-			results[idx].UV = uv
-		}
-	}
-	if err := uvRows.Err(); err != nil {
-		return results, err
+	for i, point := range points {
+		results[i] = StatPoint{PV: point.PV, UV: point.UV}
 	}
-
 	return results, nil
 }
 
@@ -205,7 +217,3 @@ func hourBucket(ts time.Time) int64 {
 	start := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, local.Location())
 	return start.Unix()
 }
-
-func dayBucket(ts time.Time) string {
-	return ts.In(time.Local).Format("2006-01-02")
-}
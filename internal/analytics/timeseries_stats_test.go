@@ -0,0 +1,112 @@
+package analytics
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/likaia/nginxpulse/internal/store"
+)
+
+func TestTimeSeriesStatsManagerDaily(t *testing.T) {
+	manager := NewTimeSeriesStatsManagerWithStats(newTestStats())
+	raw, err := manager.Query(testQuery(map[string]interface{}{
+		"timeRange": "2025-03-09~2025-03-10",
+		"viewType":  "daily",
+	}))
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	got := raw.(TimeSeriesStats)
+
+	if want := []string{"3.9", "3.10"}; !reflect.DeepEqual(got.Labels, want) {
+		t.Errorf("Labels = %v, want %v", got.Labels, want)
+	}
+	if want := []int{2, 4}; !reflect.DeepEqual(got.Pageviews, want) {
+		t.Errorf("Pageviews = %v, want %v", got.Pageviews, want)
+	}
+	if want := []int{2, 2}; !reflect.DeepEqual(got.Visitors, want) {
+		t.Errorf("Visitors = %v, want %v", got.Visitors, want)
+	}
+	if want := []int{0, 2}; !reflect.DeepEqual(got.PvMinusUv, want) {
+		t.Errorf("PvMinusUv = %v, want %v", got.PvMinusUv, want)
+	}
+	if got.Compare != nil {
+		t.Errorf("Compare = %+v, want nil without compare param", got.Compare)
+	}
+}
+
+func TestTimeSeriesStatsManagerHourlyWithAnnotations(t *testing.T) {
+	stats := newTestStats()
+	anomaly := store.TrafficAnomaly{
+		ID:        1,
+		Bucket:    testTime(10, 14, 0).Unix(),
+		Metric:    "pv",
+		Value:     1,
+		Direction: "spike",
+	}
+	outside := anomaly
+	outside.ID = 2
+	outside.Bucket = testTime(11, 14, 0).Unix()
+	stats.AddTrafficAnomalies(testWebsiteID, anomaly, outside)
+
+	manager := NewTimeSeriesStatsManagerWithStats(stats)
+	raw, err := manager.Query(testQuery(map[string]interface{}{
+		"timeRange": "2025-03-10",
+		"viewType":  "hourly",
+	}))
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	got := raw.(TimeSeriesStats)
+
+	if len(got.Pageviews) != 24 {
+		t.Fatalf("len(Pageviews) = %d, want 24", len(got.Pageviews))
+	}
+	wantPV := map[int]int{9: 2, 10: 1, 14: 1}
+	for hour, pv := range got.Pageviews {
+		if pv != wantPV[hour] {
+			t.Errorf("Pageviews[%d] = %d, want %d", hour, pv, wantPV[hour])
+		}
+	}
+	if got.Visitors[9] != 1 {
+		t.Errorf("Visitors[9] = %d, want 1", got.Visitors[9])
+	}
+	if len(got.Annotations) != 1 || got.Annotations[0].Index != 14 || got.Annotations[0].ID != 1 {
+		t.Errorf("Annotations = %+v, want anomaly 1 at index 14", got.Annotations)
+	}
+}
+
+func TestTimeSeriesStatsManagerCompare(t *testing.T) {
+	manager := NewTimeSeriesStatsManagerWithStats(newTestStats())
+	raw, err := manager.Query(testQuery(map[string]interface{}{
+		"timeRange": "2025-03-10",
+		"viewType":  "hourly",
+		"compare":   compareModePrevious,
+	}))
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	got := raw.(TimeSeriesStats)
+	cmp := got.Compare
+	if cmp == nil {
+		t.Fatal("Compare = nil, want previous-day series")
+	}
+	if cmp.Mode != compareModePrevious || cmp.Start != testTime(9, 0, 0).Unix() {
+		t.Errorf("Compare range = %+v, want previous starting 2025-03-09", cmp.CompareRange)
+	}
+	if cmp.Labels[9] != "3.9 9:00" {
+		t.Errorf("Compare.Labels[9] = %q, want %q", cmp.Labels[9], "3.9 9:00")
+	}
+	if cmp.Pageviews[9] != 2 || cmp.Visitors[9] != 2 {
+		t.Errorf("Compare[9] PV/UV = %d/%d, want 2/2", cmp.Pageviews[9], cmp.Visitors[9])
+	}
+	if cmp.PageviewsChange[9] != 0 || cmp.VisitorsChange[9] != -1 {
+		t.Errorf("change[9] PV/UV = %d/%d, want 0/-1", cmp.PageviewsChange[9], cmp.VisitorsChange[9])
+	}
+	if p := cmp.VisitorsChangePercent[9]; p == nil || *p != -50 {
+		t.Errorf("VisitorsChangePercent[9] = %v, want -50", p)
+	}
+	if p := cmp.PageviewsChangePercent[10]; p != nil {
+		t.Errorf("PageviewsChangePercent[10] = %v, want nil when previous is 0", *p)
+	}
+}
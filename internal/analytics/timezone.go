@@ -0,0 +1,62 @@
+package analytics
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/timeutil"
+)
+
+// parseTimeParams 处理 from/to 自定义区间与时区参数。
+// from/to 会被合并为 timeRange（from~to），时区优先取请求参数，其次取站点配置。
+func parseTimeParams(params map[string]string) (map[string]string, error) {
+	from := strings.TrimSpace(params["from"])
+	to := strings.TrimSpace(params["to"])
+	timezone := strings.TrimSpace(params["timezone"])
+	if timezone == "" {
+		if website, ok := config.GetWebsiteByID(params["id"]); ok {
+			timezone = strings.TrimSpace(website.Timezone)
+		}
+	}
+	if from == "" && to == "" && timezone == "" {
+		return params, nil
+	}
+
+	normalized := make(map[string]string, len(params)+1)
+	for key, value := range params {
+		normalized[key] = value
+	}
+
+	loc, err := timeutil.LoadLocation(timezone)
+	if err != nil {
+		return params, err
+	}
+	if timezone != "" {
+		normalized["timezone"] = timezone
+	}
+
+	if from != "" || to != "" {
+		if from == "" || to == "" {
+			return params, fmt.Errorf("from 与 to 参数需同时提供")
+		}
+		normalized["timeRange"] = timeutil.CustomRange(from, to)
+	}
+	if timeRange := normalized["timeRange"]; strings.Contains(timeRange, timeutil.CustomRangeSeparator) {
+		if _, _, _, err := timeutil.ParseCustomRange(timeRange, loc); err != nil {
+			return params, err
+		}
+	}
+	return normalized, nil
+}
+
+// queryLocation 返回查询使用的时区，未指定时为服务器本地时区
+func queryLocation(query StatsQuery) *time.Location {
+	name, _ := query.ExtraParam["timezone"].(string)
+	loc, err := timeutil.LoadLocation(name)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
@@ -0,0 +1,18 @@
+package analytics
+
+import (
+	"github.com/likaia/nginxpulse/internal/store"
+	"github.com/likaia/nginxpulse/internal/store/hll"
+)
+
+// uvRelativeError 站点使用近似 UV 时返回相对标准误差，精确计数时返回 nil
+func uvRelativeError(websiteID string) *float64 {
+	if !store.UVApproximate(websiteID) {
+		return nil
+	}
+	value := hll.New().RelativeError()
+	if store.UsesClickHouse(websiteID) {
+		value = store.ClickHouseUVRelativeError
+	}
+	return &value
+}
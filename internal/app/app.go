@@ -57,6 +57,9 @@ func Run() error {
 	if err := enrich.InitIPGeoLocation(); err != nil {
 		return err
 	}
+	if err := enrich.InitRefererSources(); err != nil {
+		logrus.WithError(err).Warn("初始化来源库失败，使用内置来源库")
+	}
 
 	repository, err := initRepository()
 	if err != nil {
@@ -73,6 +76,16 @@ func Run() error {
 	}
 	printStartupNotice(cfg)
 
+	if cfg.System.OTLP != nil {
+		grpcServer, err := server.StartOTLPGRPCServer(statsFactory, logParser, cfg.System.OTLP.GRPCListen)
+		if err != nil {
+			return err
+		}
+		if grpcServer != nil {
+			defer grpcServer.GracefulStop()
+		}
+	}
+
 	interval := config.ParseInterval(cfg.System.TaskInterval, 5*time.Minute)
 	go worker.InitialScan(logParser, interval)
 
@@ -81,6 +94,8 @@ func Run() error {
 	}
 
 	go worker.RunScheduler(ctx, logParser, interval)
+	logParser.RunStreamSources(ctx)
+	logParser.RunFileWatcher(ctx)
 
 	return waitForShutdown(cancel, serverHandle)
 }
@@ -15,6 +15,14 @@ import (
 
 // HandleAppConfig 处理应用程序配置初始化和命令行参数
 func ProcessCliCommands() bool {
+	// 子命令
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if code := runImport(os.Args[2:]); code != 0 {
+			os.Exit(code)
+		}
+		return true
+	}
+
 	// 命令行参数
 	cleanApp := flag.Bool("clean", false, "清理nginxpulse服务、释放端口和删除数据")
 	showVer := flag.Bool("v", false, "显示版本信息")
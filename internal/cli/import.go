@@ -0,0 +1,299 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/enrich"
+	"github.com/likaia/nginxpulse/internal/ingest"
+	"github.com/likaia/nginxpulse/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// importTimeLayouts -since / -until 支持的时间格式，按本地时区解析
+var importTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// runImport 处理 nginxpulse import 子命令，返回进程退出码
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	websiteArg := fs.String("website", "", "目标网站名称或 ID")
+	sinceArg := fs.String("since", "", "只导入该时间及之后的日志，如 2024-01-01 或 2024-01-01 08:00:00")
+	untilArg := fs.String("until", "", "只导入该时间之前的日志（不含），格式同 -since")
+	logType := fs.String("log-type", "", "覆盖网站的 logType（nginx / caddy / ...）")
+	logFormat := fs.String("log-format", "", "覆盖网站的 logFormat")
+	logRegex := fs.String("log-regex", "", "覆盖网站的 logRegex")
+	timeLayout := fs.String("time-layout", "", "覆盖网站的 timeLayout")
+	dryRun := fs.Bool("dry-run", false, "只解析并统计解析失败率，不写入数据库")
+	batchSize := fs.Int("batch", 0, "每批写入的条数，默认 5000")
+	checkpointArg := fs.String("checkpoint", "", "检查点文件，默认 <dataDir>/import_<网站ID>.json")
+	reset := fs.Bool("reset", false, "删除已有检查点，从头导入")
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintln(out, "用法: nginxpulse import -website <名称或ID> [选项] <文件或 glob>...")
+		fmt.Fprintln(out, "支持未压缩与 gzip / zstd / bzip2 压缩的日志文件，选项需写在文件之前")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if strings.TrimSpace(*websiteArg) == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if _, err := config.ReadRawConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "读取配置文件失败: %v\n", err)
+		return 1
+	}
+	if config.NeedsSetup() {
+		fmt.Fprintln(os.Stderr, "尚未完成初始化配置，请先启动服务完成配置")
+		return 1
+	}
+	config.ReadConfig()
+
+	websiteID, err := resolveImportWebsite(*websiteArg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	files, err := expandImportFiles(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	since, err := parseImportTime(*sinceArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-since 格式错误: %v\n", err)
+		return 2
+	}
+	until, err := parseImportTime(*untilArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "-until 格式错误: %v\n", err)
+		return 2
+	}
+
+	opts := ingest.ImportOptions{
+		WebsiteID: websiteID,
+		Files:     files,
+		Since:     since,
+		Until:     until,
+		DryRun:    *dryRun,
+		BatchSize: *batchSize,
+		Progress:  printImportProgress,
+	}
+	if *logType != "" || *logFormat != "" || *logRegex != "" || *timeLayout != "" {
+		opts.Parse = &config.ParseConfig{
+			LogType:    *logType,
+			LogFormat:  *logFormat,
+			LogRegex:   *logRegex,
+			TimeLayout: *timeLayout,
+		}
+	}
+
+	// 进度由本命令输出，只保留警告以上的日志
+	logrus.SetLevel(logrus.WarnLevel)
+	if err := enrich.InitRefererSources(); err != nil {
+		logrus.WithError(err).Warn("初始化来源库失败，使用内置来源库")
+	}
+
+	var repo *store.Repository
+	if !*dryRun {
+		if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "初始化目录失败: %v\n", err)
+			return 1
+		}
+		opts.CheckpointPath = *checkpointArg
+		if opts.CheckpointPath == "" {
+			opts.CheckpointPath = filepath.Join(config.DataDir, fmt.Sprintf("import_%s.json", websiteID))
+		}
+		if *reset {
+			if err := os.Remove(opts.CheckpointPath); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "删除检查点失败: %v\n", err)
+				return 1
+			}
+		}
+
+		repo, err = store.NewRepository()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "连接数据库失败: %v\n", err)
+			return 1
+		}
+		defer repo.Close()
+		if err := repo.Init(); err != nil {
+			fmt.Fprintf(os.Stderr, "初始化数据库失败: %v\n", err)
+			return 1
+		}
+	}
+
+	importer, err := ingest.NewImporter(repo, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "创建导入任务失败: %v\n", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mode := "导入"
+	if *dryRun {
+		mode = "试运行（不写入数据库）"
+	}
+	fmt.Fprintf(os.Stderr, "%s %d 个文件到网站 %s\n", mode, len(files), websiteID)
+
+	report, err := importer.Run(ctx)
+	printImportSummary(report, *dryRun)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "导入已中断，使用相同参数重新执行即可从检查点继续")
+		} else {
+			fmt.Fprintf(os.Stderr, "导入失败: %v\n", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// resolveImportWebsite 按 ID 或名称查找网站
+func resolveImportWebsite(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if _, ok := config.GetWebsiteByID(value); ok {
+		return value, nil
+	}
+	for _, id := range config.GetAllWebsiteIDs() {
+		if website, ok := config.GetWebsiteByID(id); ok && website.Name == value {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("未找到网站: %s", value)
+}
+
+// expandImportFiles 展开 glob；未包含通配符的参数原样保留，由导入器检查是否存在
+func expandImportFiles(args []string) ([]string, error) {
+	files := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			files = append(files, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("无效的文件匹配模式 %s: %v", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("没有匹配 %s 的文件", arg)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+func parseImportTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range importTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("无法识别的时间 %q，支持 2006-01-02、2006-01-02 15:04:05 与 RFC3339", value)
+}
+
+func printImportProgress(report ingest.ImportReport) {
+	if report.Done || len(report.Files) == 0 {
+		return
+	}
+	total := report.Total()
+	current := report.Files[report.Current]
+	rate := 0.0
+	if seconds := report.Elapsed.Seconds(); seconds > 0 {
+		rate = float64(total.Lines) / seconds
+	}
+	fmt.Fprintf(os.Stderr, "[%d/%d] %s %s  已读 %s / %s  %d 行  失败 %.2f%%  写入 %d 条  %.0f 行/秒\n",
+		report.Current+1, len(report.Files), filepath.Base(current.Path),
+		formatImportPercent(current.ReadBytes, current.Size),
+		formatImportBytes(total.ReadBytes), formatImportBytes(total.Size),
+		total.Lines, total.ErrorRate()*100, total.Imported, rate)
+}
+
+func printImportSummary(report ingest.ImportReport, dryRun bool) {
+	if len(report.Files) == 0 {
+		return
+	}
+	fmt.Println()
+	// 中文表头宽度不固定，文件名放在最后一列
+	fmt.Println("行数 / 解析失败 / 失败率 / 范围外 / 超保留期 / 写入 / 文件")
+	for _, file := range report.Files {
+		name := filepath.Base(file.Path)
+		if file.Skipped {
+			fmt.Printf("%s（已在之前的导入中完成，跳过）\n", name)
+			continue
+		}
+		fmt.Printf("%12d %10d %7.2f%% %10d %10d %12d  %s\n",
+			file.Lines, file.ParseErrors, file.ErrorRate()*100,
+			file.OutOfWindow, file.Expired, importedCount(file, dryRun), name)
+	}
+	total := report.Total()
+	fmt.Printf("%12d %10d %7.2f%% %10d %10d %12d  合计\n",
+		total.Lines, total.ParseErrors, total.ErrorRate()*100,
+		total.OutOfWindow, total.Expired, importedCount(total, dryRun))
+	fmt.Printf("耗时 %s\n", report.Elapsed.Round(time.Second))
+	if dryRun {
+		fmt.Println("试运行未写入数据库，写入列为可导入的条数")
+	}
+
+	for _, file := range report.Files {
+		if len(file.ErrorSamples) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s 解析失败样例:\n", filepath.Base(file.Path))
+		for _, sample := range file.ErrorSamples {
+			fmt.Printf("  %s\n", sample)
+		}
+	}
+}
+
+func importedCount(stats ingest.ImportFileStats, dryRun bool) int64 {
+	if dryRun {
+		return stats.Accepted
+	}
+	return stats.Imported
+}
+
+func formatImportPercent(read, size int64) string {
+	if size <= 0 {
+		return "100.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(read)*100/float64(size))
+}
+
+func formatImportBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for value := n / unit; value >= unit; value /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
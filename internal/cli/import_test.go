@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+)
+
+func TestParseImportTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: ""},
+		{value: "2024-01-02", want: time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)},
+		{value: " 2024-01-02 08:30 ", want: time.Date(2024, 1, 2, 8, 30, 0, 0, time.Local)},
+		{value: "2024-01-02 08:30:15", want: time.Date(2024, 1, 2, 8, 30, 15, 0, time.Local)},
+		{value: "2024-01-02T08:30:15+08:00", want: time.Date(2024, 1, 2, 0, 30, 15, 0, time.UTC)},
+		{value: "01/02/2024", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseImportTime(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseImportTime(%q) error = %v, wantErr %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseImportTime(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestExpandImportFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"access.log", "access.log.1.gz", "error.log"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	missing := filepath.Join(dir, "missing.log")
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "glob",
+			args: []string{filepath.Join(dir, "access.log*")},
+			want: []string{filepath.Join(dir, "access.log"), filepath.Join(dir, "access.log.1.gz")},
+		},
+		{
+			name: "plain path kept for the importer to check",
+			args: []string{missing},
+			want: []string{missing},
+		},
+		{
+			name:    "glob without matches",
+			args:    []string{filepath.Join(dir, "*.zst")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := expandImportFiles(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: files = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestRunImportDryRun 试运行按网站名称解析目标，只统计不写入：不连接数据库，也不在数据目录留下检查点
+func TestRunImportDryRun(t *testing.T) {
+	t.Setenv("CONFIG_JSON", `{"websites":[{"name":"import-cli","logPath":"/dev/null"}]}`)
+	// config.DataDir 是相对路径，切到临时目录避免影响仓库
+	t.Chdir(t.TempDir())
+
+	logDir := t.TempDir()
+	line := `10.0.0.1 - - [` + time.Now().Add(-time.Hour).Format("02/Jan/2006:15:04:05 -0700") +
+		`] "GET / HTTP/1.1" 200 10 "-" "Mozilla/5.0"` + "\n"
+	logPath := filepath.Join(logDir, "access.log")
+	if err := os.WriteFile(logPath, []byte(line+"garbage\n"), 0644); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"missing website", []string{"-dry-run", logPath}, 2},
+		{"unknown website", []string{"-website", "nope", "-dry-run", logPath}, 1},
+		{"bad since", []string{"-website", "import-cli", "-dry-run", "-since", "yesterday", logPath}, 2},
+		{"dry run", []string{"-website", "import-cli", "-dry-run", filepath.Join(logDir, "*.log")}, 0},
+	}
+	for _, tt := range tests {
+		if got := runImport(tt.args); got != tt.want {
+			t.Errorf("%s: runImport = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// 数据目录中只允许来源库缓存，不能有检查点
+	if checkpoints, _ := filepath.Glob(filepath.Join(config.DataDir, "import_*.json")); len(checkpoints) != 0 {
+		t.Errorf("dry run wrote checkpoints %v", checkpoints)
+	}
+}
@@ -22,23 +22,29 @@ const (
 )
 
 type Config struct {
-	System   SystemConfig    `json:"system"`
-	Server   ServerConfig    `json:"server"`
-	Database DatabaseConfig  `json:"database"`
-	Websites []WebsiteConfig `json:"websites"`
-	PVFilter PVFilterConfig  `json:"pvFilter"`
+	System     SystemConfig     `json:"system"`
+	Server     ServerConfig     `json:"server"`
+	Database   DatabaseConfig   `json:"database"`
+	ClickHouse ClickHouseConfig `json:"clickhouse,omitempty"`
+	Websites   []WebsiteConfig  `json:"websites"`
+	PVFilter   PVFilterConfig   `json:"pvFilter"`
 }
 
 type WebsiteConfig struct {
-	Name       string           `json:"name"`
-	LogPath    string           `json:"logPath"`
-	Domains    []string         `json:"domains,omitempty"`
-	LogType    string           `json:"logType,omitempty"`
-	LogFormat  string           `json:"logFormat,omitempty"`
-	LogRegex   string           `json:"logRegex,omitempty"`
-	TimeLayout string           `json:"timeLayout,omitempty"`
-	Sources    []SourceConfig   `json:"sources,omitempty"`
-	Whitelist  *WhitelistConfig `json:"whitelist,omitempty"`
+	Name         string              `json:"name"`
+	LogPath      string              `json:"logPath"`
+	Domains      []string            `json:"domains,omitempty"`
+	LogType      string              `json:"logType,omitempty"`
+	LogFormat    string              `json:"logFormat,omitempty"`
+	LogRegex     string              `json:"logRegex,omitempty"`
+	TimeLayout   string              `json:"timeLayout,omitempty"`
+	Timezone     string              `json:"timezone,omitempty"` // 统计展示使用的 IANA 时区，默认服务器时区
+	Sources      []SourceConfig      `json:"sources,omitempty"`
+	Whitelist    *WhitelistConfig    `json:"whitelist,omitempty"`
+	URLNormalize *URLNormalizeConfig `json:"urlNormalize,omitempty"`
+	Retention    *RetentionConfig    `json:"retention,omitempty"` // 覆盖 system.retention 中的分层保留天数
+	UVMode       string              `json:"uvMode,omitempty"`    // UV 计数方式：exact（默认，逐 IP 精确去重）/ approximate（HyperLogLog 草图）
+	Storage      string              `json:"storage,omitempty"`   // 日志与统计存储：postgres（默认）/ clickhouse
 }
 
 type SourceConfig struct {
@@ -64,6 +70,15 @@ type SourceConfig struct {
 	Prefix       string            `json:"prefix,omitempty"`
 	AccessKey    string            `json:"accessKey,omitempty"`
 	SecretKey    string            `json:"secretKey,omitempty"`
+	Stream       string            `json:"stream,omitempty"`     // docker：stdout（默认）/ stderr / all
+	Containers   []string          `json:"containers,omitempty"` // docker 容器名或 journald CONTAINER_NAME，支持通配符
+	Labels       map[string]string `json:"labels,omitempty"`     // docker 容器标签，值为空或 * 时只要求存在
+	Units        []string          `json:"units,omitempty"`      // journald _SYSTEMD_UNIT 或 SYSLOG_IDENTIFIER，支持通配符
+	Brokers      []string          `json:"brokers,omitempty"`    // kafka broker 地址
+	Topic        string            `json:"topic,omitempty"`      // kafka topic / NATS JetStream stream / Redis stream key
+	Group        string            `json:"group,omitempty"`      // kafka 消费组 / NATS durable consumer / Redis 消费组
+	Consumer     string            `json:"consumer,omitempty"`   // Redis 消费者名称，默认主机名
+	StartFrom    string            `json:"startFrom,omitempty"`  // 新建消费组时的起始位置：latest（默认）/ earliest
 }
 
 type SourceAuth struct {
@@ -92,16 +107,66 @@ type WhitelistConfig struct {
 	NonMainland bool     `json:"nonMainland"`
 }
 
+// URLNormalizeConfig 入库前的 URL 归一化规则
+type URLNormalizeConfig struct {
+	Enabled     bool             `json:"enabled"`
+	Rules       []URLRewriteRule `json:"rules,omitempty"`
+	CollapseIDs bool             `json:"collapseIds"`
+	QueryAllow  []string         `json:"queryAllow,omitempty"`
+	QueryDeny   []string         `json:"queryDeny,omitempty"`
+	StripQuery  bool             `json:"stripQuery"`
+	Lowercase   bool             `json:"lowercase"`
+	KeepRawURL  bool             `json:"keepRawUrl"`
+}
+
+// URLRewriteRule 将匹配 pattern 的路径改写为 replace（支持 $1 引用）
+type URLRewriteRule struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+}
+
 type SystemConfig struct {
 	LogDestination   string   `json:"logDestination"`
 	TaskInterval     string   `json:"taskInterval"` // "5m" "25s"
 	LogRetentionDays int      `json:"logRetentionDays"`
 	ParseBatchSize   int      `json:"parseBatchSize"`
+	ParseWorkers     int      `json:"parseWorkers"` // 并行扫描日志的工作协程数，0 表示按 CPU 核数自动选择（最多 4）
 	IPGeoCacheLimit  int      `json:"ipGeoCacheLimit"`
 	IPGeoAPIURL      string   `json:"ipGeoApiUrl"`
 	DemoMode         bool     `json:"demoMode"`
 	AccessKeys       []string `json:"accessKeys"`
 	Language         string   `json:"language"`
+	AgentSilentAfter string   `json:"agentSilentAfter"` // agent 超过该时长未上报心跳视为失联，默认 "5m"
+
+	Anomaly   *AnomalyConfig   `json:"anomaly,omitempty"`
+	OTLP      *OTLPConfig      `json:"otlp,omitempty"`
+	Retention *RetentionConfig `json:"retention,omitempty"`
+}
+
+// AnomalyConfig 流量异常检测配置（按周季节性的小时级 PV/UV/5xx 序列）
+type AnomalyConfig struct {
+	Enabled   bool    `json:"enabled"`
+	Threshold float64 `json:"threshold"` // 鲁棒 z 分数阈值，默认 4
+	MinVolume int     `json:"minVolume"` // 实际值与基线都低于该值时不判定，默认 20
+	Notify    bool    `json:"notify"`    // 检测到新异常时写入系统通知
+}
+
+// RetentionConfig 分层保留天数，0 表示未配置：rawDays 回退到 logRetentionDays，
+// 其余各层回退到 rawDays。各层不能短于原始日志
+type RetentionConfig struct {
+	RawDays       int `json:"rawDays,omitempty"`       // 原始日志
+	SessionDays   int `json:"sessionDays,omitempty"`   // 会话明细
+	HourlyDays    int `json:"hourlyDays,omitempty"`    // 小时聚合与流量异常
+	DailyDays     int `json:"dailyDays,omitempty"`     // 日聚合（含会话与入口页日聚合）
+	FirstSeenDays int `json:"firstSeenDays,omitempty"` // 首次访问记录（新老访客判断）
+}
+
+// OTLPConfig OpenTelemetry 日志接收配置；OTLP/HTTP 固定在 /api/otlp/v1/logs
+type OTLPConfig struct {
+	GRPCListen        string            `json:"grpcListen,omitempty"`        // OTLP/gRPC 监听地址，如 ":4317"，留空不启用
+	WebsiteAttributes []string          `json:"websiteAttributes,omitempty"` // 依次读取以确定站点的 resource 属性
+	Websites          map[string]string `json:"websites,omitempty"`          // 属性值 → 站点 ID
+	DefaultWebsite    string            `json:"defaultWebsite,omitempty"`    // 无法确定站点时写入的站点 ID，留空则拒收
 }
 
 type ServerConfig struct {
@@ -109,11 +174,21 @@ type ServerConfig struct {
 }
 
 type DatabaseConfig struct {
-	Driver          string `json:"driver"`
-	DSN             string `json:"dsn"`
-	MaxOpenConns    int    `json:"maxOpenConns"`
-	MaxIdleConns    int    `json:"maxIdleConns"`
-	ConnMaxLifetime string `json:"connMaxLifetime"`
+	Driver            string `json:"driver"`
+	DSN               string `json:"dsn"`
+	MaxOpenConns      int    `json:"maxOpenConns"`
+	MaxIdleConns      int    `json:"maxIdleConns"`
+	ConnMaxLifetime   string `json:"connMaxLifetime"`
+	PartitionInterval string `json:"partitionInterval,omitempty"` // 日志表分区粒度：day（默认）或 month
+}
+
+// ClickHouseConfig storage 为 clickhouse 的站点使用的 ClickHouse HTTP 接口
+type ClickHouseConfig struct {
+	URL      string `json:"url,omitempty"`      // HTTP 接口地址，如 http://127.0.0.1:8123
+	Database string `json:"database,omitempty"` // 默认 default
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Timeout  string `json:"timeout,omitempty"` // 单次请求超时，默认 30s
 }
 
 type PVFilterConfig struct {
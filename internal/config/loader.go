@@ -16,6 +16,7 @@ const (
 	envTaskInterval      = "TASK_INTERVAL"
 	envLogRetentionDays  = "LOG_RETENTION_DAYS"
 	envLogParseBatchSize = "LOG_PARSE_BATCH_SIZE"
+	envLogParseWorkers   = "LOG_PARSE_WORKERS"
 	envServerPort        = "SERVER_PORT"
 	envPVStatusCodes     = "PV_STATUS_CODES"
 	envPVExcludePatterns = "PV_EXCLUDE_PATTERNS"
@@ -30,6 +31,11 @@ const (
 	envDBMaxOpenConns    = "DB_MAX_OPEN_CONNS"
 	envDBMaxIdleConns    = "DB_MAX_IDLE_CONNS"
 	envDBConnMaxLifetime = "DB_CONN_MAX_LIFETIME"
+	envDBPartition       = "DB_PARTITION_INTERVAL"
+	envClickHouseURL     = "CLICKHOUSE_URL"
+	envClickHouseDB      = "CLICKHOUSE_DATABASE"
+	envClickHouseUser    = "CLICKHOUSE_USER"
+	envClickHousePass    = "CLICKHOUSE_PASSWORD"
 )
 
 var (
@@ -62,11 +68,12 @@ var (
 		Port: ":8089",
 	}
 	defaultDatabase = DatabaseConfig{
-		Driver:          "postgres",
-		DSN:             "",
-		MaxOpenConns:    10,
-		MaxIdleConns:    5,
-		ConnMaxLifetime: "30m",
+		Driver:            "postgres",
+		DSN:               "",
+		MaxOpenConns:      10,
+		MaxIdleConns:      5,
+		ConnMaxLifetime:   "30m",
+		PartitionInterval: "day",
 	}
 )
 
@@ -75,11 +82,12 @@ func DefaultConfig() Config {
 		System: defaultSystem,
 		Server: defaultServer,
 		Database: DatabaseConfig{
-			Driver:          defaultDatabase.Driver,
-			DSN:             defaultDatabase.DSN,
-			MaxOpenConns:    defaultDatabase.MaxOpenConns,
-			MaxIdleConns:    defaultDatabase.MaxIdleConns,
-			ConnMaxLifetime: defaultDatabase.ConnMaxLifetime,
+			Driver:            defaultDatabase.Driver,
+			DSN:               defaultDatabase.DSN,
+			MaxOpenConns:      defaultDatabase.MaxOpenConns,
+			MaxIdleConns:      defaultDatabase.MaxIdleConns,
+			ConnMaxLifetime:   defaultDatabase.ConnMaxLifetime,
+			PartitionInterval: defaultDatabase.PartitionInterval,
 		},
 		PVFilter: PVFilterConfig{
 			StatusCodeInclude: copyIntSlice(defaultStatusCodeInclude),
@@ -169,6 +177,16 @@ func applyEnvOverrides(cfg *Config) error {
 		}
 		cfg.System.ParseBatchSize = parsed
 	}
+	if raw, key := getEnvValue(envLogParseWorkers); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("解析 %s 失败: %w", key, err)
+		}
+		if parsed <= 0 {
+			return fmt.Errorf("%s 必须大于0", key)
+		}
+		cfg.System.ParseWorkers = parsed
+	}
 	if raw, key := getEnvValue(envIPGeoCacheLimit); raw != "" {
 		parsed, err := strconv.Atoi(raw)
 		if err != nil {
@@ -242,6 +260,21 @@ func applyEnvOverrides(cfg *Config) error {
 		}
 		cfg.Database.ConnMaxLifetime = raw
 	}
+	if raw, _ := getEnvValue(envDBPartition); raw != "" {
+		cfg.Database.PartitionInterval = raw
+	}
+	if raw, _ := getEnvValue(envClickHouseURL); raw != "" {
+		cfg.ClickHouse.URL = raw
+	}
+	if raw, _ := getEnvValue(envClickHouseDB); raw != "" {
+		cfg.ClickHouse.Database = raw
+	}
+	if raw, _ := getEnvValue(envClickHouseUser); raw != "" {
+		cfg.ClickHouse.Username = raw
+	}
+	if raw, _ := getEnvValue(envClickHousePass); raw != "" {
+		cfg.ClickHouse.Password = raw
+	}
 
 	if raw, key := getEnvValue(envPVStatusCodes); raw != "" {
 		values, err := parseIntSlice(raw)
@@ -308,6 +341,9 @@ func applyDefaults(cfg *Config) {
 	if cfg.Database.ConnMaxLifetime == "" {
 		cfg.Database.ConnMaxLifetime = defaultDatabase.ConnMaxLifetime
 	}
+	if cfg.Database.PartitionInterval == "" {
+		cfg.Database.PartitionInterval = defaultDatabase.PartitionInterval
+	}
 	if len(cfg.PVFilter.StatusCodeInclude) == 0 {
 		cfg.PVFilter.StatusCodeInclude = copyIntSlice(defaultStatusCodeInclude)
 	}
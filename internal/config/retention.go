@@ -0,0 +1,37 @@
+package config
+
+// ResolveRetention 合并系统与站点的分层保留配置，返回各层均已填充的天数；
+// 站点配置优先，其次 system.retention，rawDays 最终回退到 logRetentionDays
+func ResolveRetention(system SystemConfig, site *RetentionConfig) RetentionConfig {
+	pick := func(get func(*RetentionConfig) int, fallback int) int {
+		for _, cfg := range []*RetentionConfig{site, system.Retention} {
+			if cfg != nil && get(cfg) > 0 {
+				return get(cfg)
+			}
+		}
+		return fallback
+	}
+
+	rawFallback := system.LogRetentionDays
+	if rawFallback <= 0 {
+		rawFallback = defaultSystem.LogRetentionDays
+	}
+	raw := pick(func(c *RetentionConfig) int { return c.RawDays }, rawFallback)
+	return RetentionConfig{
+		RawDays:       raw,
+		SessionDays:   pick(func(c *RetentionConfig) int { return c.SessionDays }, raw),
+		HourlyDays:    pick(func(c *RetentionConfig) int { return c.HourlyDays }, raw),
+		DailyDays:     pick(func(c *RetentionConfig) int { return c.DailyDays }, raw),
+		FirstSeenDays: pick(func(c *RetentionConfig) int { return c.FirstSeenDays }, raw),
+	}
+}
+
+// RetentionForWebsite 返回站点生效的分层保留天数，未知站点只使用系统配置
+func RetentionForWebsite(websiteID string) RetentionConfig {
+	cfg := ReadConfig()
+	var site *RetentionConfig
+	if website, ok := GetWebsiteByID(websiteID); ok {
+		site = website.Retention
+	}
+	return ResolveRetention(cfg.System, site)
+}
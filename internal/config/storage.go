@@ -0,0 +1,19 @@
+package config
+
+import "strings"
+
+const (
+	// StoragePostgres 日志与聚合都存放在 Postgres（默认）
+	StoragePostgres = "postgres"
+	// StorageClickHouse 日志与聚合写入 ClickHouse，Postgres 只保存元数据
+	StorageClickHouse = "clickhouse"
+)
+
+// StorageForWebsite 返回站点生效的日志存储，未配置或未知站点为 postgres
+func StorageForWebsite(websiteID string) string {
+	if website, ok := GetWebsiteByID(websiteID); ok &&
+		strings.TrimSpace(website.Storage) == StorageClickHouse {
+		return StorageClickHouse
+	}
+	return StoragePostgres
+}
@@ -0,0 +1,19 @@
+package config
+
+import "strings"
+
+const (
+	// UVModeExact 按 (时间桶, ip_id) 明细精确去重
+	UVModeExact = "exact"
+	// UVModeApproximate 只保存每个时间桶的 HyperLogLog 草图，UV 为近似值
+	UVModeApproximate = "approximate"
+)
+
+// UVModeForWebsite 返回站点生效的 UV 计数方式，未配置或未知站点为 exact
+func UVModeForWebsite(websiteID string) string {
+	if website, ok := GetWebsiteByID(websiteID); ok &&
+		strings.TrimSpace(website.UVMode) == UVModeApproximate {
+		return UVModeApproximate
+	}
+	return UVModeExact
+}
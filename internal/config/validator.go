@@ -6,7 +6,9 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 )
 
 type FieldError struct {
@@ -48,6 +50,49 @@ func ValidateConfig(cfg *Config, opts ValidateOptions) ValidationResult {
 			addError(sitePrefix+".name", "站点名称不能为空")
 		}
 
+		if tz := strings.TrimSpace(site.Timezone); tz != "" {
+			if _, err := time.LoadLocation(tz); err != nil {
+				addError(sitePrefix+".timezone", fmt.Sprintf("无效的时区: %s", tz))
+			}
+		}
+
+		if site.Retention != nil {
+			validateRetention(sitePrefix+".retention", cfg.System, site.Retention, addError)
+		}
+
+		switch strings.TrimSpace(site.UVMode) {
+		case "", UVModeExact, UVModeApproximate:
+		default:
+			addError(sitePrefix+".uvMode", "uvMode 仅支持 exact 或 approximate")
+		}
+
+		switch strings.TrimSpace(site.Storage) {
+		case "", StoragePostgres:
+		case StorageClickHouse:
+			if strings.TrimSpace(cfg.ClickHouse.URL) == "" {
+				addError(sitePrefix+".storage", "storage 为 clickhouse 时需要配置 clickhouse.url")
+			}
+		default:
+			addError(sitePrefix+".storage", "storage 仅支持 postgres 或 clickhouse")
+		}
+
+		if site.URLNormalize != nil && site.URLNormalize.Enabled {
+			normalizePrefix := sitePrefix + ".urlNormalize"
+			for ridx, rule := range site.URLNormalize.Rules {
+				rulePrefix := fmt.Sprintf("%s.rules[%d]", normalizePrefix, ridx)
+				if strings.TrimSpace(rule.Pattern) == "" {
+					addError(rulePrefix+".pattern", "URL 改写规则 pattern 不能为空")
+					continue
+				}
+				if _, err := regexp.Compile(rule.Pattern); err != nil {
+					addError(rulePrefix+".pattern", fmt.Sprintf("URL 改写规则正则无效: %v", err))
+				}
+			}
+			if len(site.URLNormalize.QueryAllow) > 0 && site.URLNormalize.StripQuery {
+				addWarning(normalizePrefix+".queryAllow", "已启用 stripQuery，queryAllow 不会生效")
+			}
+		}
+
 		if len(site.Sources) == 0 {
 			if strings.TrimSpace(site.LogPath) == "" {
 				addError(sitePrefix+".logPath", "日志路径不能为空")
@@ -122,8 +167,41 @@ func ValidateConfig(cfg *Config, opts ValidateOptions) ValidationResult {
 				if (strings.TrimSpace(src.AccessKey) == "") != (strings.TrimSpace(src.SecretKey) == "") {
 					addError(srcPrefix+".accessKey", "s3 accessKey/secretKey 需同时配置")
 				}
-			case "agent":
+			case "agent", "otlp":
 				// no-op
+			case "docker":
+				if stream := strings.ToLower(strings.TrimSpace(src.Stream)); stream != "" && stream != "stdout" && stream != "stderr" && stream != "all" {
+					addError(srcPrefix+".stream", "docker.stream 只能是 stdout、stderr 或 all")
+				}
+				if strings.ToLower(strings.TrimSpace(src.Mode)) == "stream" {
+					addError(srcPrefix+".mode", "docker 仅支持 poll 模式")
+				}
+				if opts.CheckPaths && strings.TrimSpace(src.Path) != "" {
+					if err := validatePath(src.Path); err != nil {
+						addError(srcPrefix+".path", err.Error())
+					}
+				}
+			case "kafka", "nats", "redis":
+				if stype == "kafka" && len(src.Brokers) == 0 {
+					addError(srcPrefix+".brokers", "kafka.brokers 不能为空")
+				}
+				if strings.TrimSpace(src.Topic) == "" {
+					addError(srcPrefix+".topic", stype+".topic 不能为空")
+				}
+				if strings.TrimSpace(src.Group) == "" {
+					addError(srcPrefix+".group", stype+".group 不能为空")
+				}
+				if start := strings.ToLower(strings.TrimSpace(src.StartFrom)); start != "" && start != "latest" && start != "earliest" {
+					addError(srcPrefix+".startFrom", "startFrom 只能是 latest 或 earliest")
+				}
+			case "journald":
+				if strings.TrimSpace(src.Path) == "" && strings.TrimSpace(src.Pattern) == "" {
+					addError(srcPrefix, "journald 需要 path 或 pattern（journal export 文件）")
+				} else if opts.CheckPaths && src.Path != "" {
+					if err := validatePath(src.Path); err != nil {
+						addError(srcPrefix+".path", err.Error())
+					}
+				}
 			default:
 				addError(srcPrefix+".type", "不支持的 source.type")
 			}
@@ -153,15 +231,49 @@ func ValidateConfig(cfg *Config, opts ValidateOptions) ValidationResult {
 	if strings.TrimSpace(cfg.Database.DSN) == "" {
 		addError("database.dsn", "数据库 DSN 不能为空")
 	}
+	if interval := strings.ToLower(strings.TrimSpace(cfg.Database.PartitionInterval)); interval != "" && interval != "day" && interval != "month" {
+		addError("database.partitionInterval", "partitionInterval 只能是 day 或 month")
+	}
+	if raw := strings.TrimSpace(cfg.ClickHouse.Timeout); raw != "" {
+		if d, err := time.ParseDuration(raw); err != nil || d <= 0 {
+			addError("clickhouse.timeout", "clickhouse.timeout 格式不正确")
+		}
+	}
 	if cfg.System.LogRetentionDays <= 0 {
 		addError("system.logRetentionDays", "logRetentionDays 必须大于 0")
 	}
+	if cfg.System.Retention != nil {
+		validateRetention("system.retention", cfg.System, nil, addError)
+	}
 	if cfg.System.ParseBatchSize <= 0 {
 		addError("system.parseBatchSize", "parseBatchSize 必须大于 0")
 	}
+	if cfg.System.ParseWorkers < 0 {
+		addError("system.parseWorkers", "parseWorkers 不能为负数")
+	}
 	if cfg.System.IPGeoCacheLimit <= 0 {
 		addError("system.ipGeoCacheLimit", "ipGeoCacheLimit 必须大于 0")
 	}
+	if cfg.System.Anomaly != nil {
+		if cfg.System.Anomaly.Threshold < 0 {
+			addError("system.anomaly.threshold", "threshold 不能为负数")
+		}
+		if cfg.System.Anomaly.MinVolume < 0 {
+			addError("system.anomaly.minVolume", "minVolume 不能为负数")
+		}
+	}
+	if cfg.System.OTLP != nil {
+		if listen := strings.TrimSpace(cfg.System.OTLP.GRPCListen); listen != "" {
+			if _, _, err := net.SplitHostPort(listen); err != nil {
+				addError("system.otlp.grpcListen", "grpcListen 格式不正确，应为 host:port 或 :port")
+			}
+		}
+	}
+	if raw := strings.TrimSpace(cfg.System.AgentSilentAfter); raw != "" {
+		if d, err := time.ParseDuration(raw); err != nil || d <= 0 {
+			addError("system.agentSilentAfter", "agentSilentAfter 格式不正确")
+		}
+	}
 
 	if len(cfg.PVFilter.StatusCodeInclude) == 0 {
 		addError("pvFilter.statusCodeInclude", "statusCodeInclude 不能为空")
@@ -173,6 +285,46 @@ func ValidateConfig(cfg *Config, opts ValidateOptions) ValidationResult {
 	return result
 }
 
+// validateRetention 校验分层保留天数：不能为负，且合并后各层不能短于原始日志
+func validateRetention(prefix string, system SystemConfig, site *RetentionConfig, addError func(field, msg string)) {
+	own := site
+	if own == nil {
+		own = system.Retention
+	}
+	fields := []struct {
+		name string
+		days int
+	}{
+		{"rawDays", own.RawDays},
+		{"sessionDays", own.SessionDays},
+		{"hourlyDays", own.HourlyDays},
+		{"dailyDays", own.DailyDays},
+		{"firstSeenDays", own.FirstSeenDays},
+	}
+	for _, field := range fields {
+		if field.days < 0 {
+			addError(prefix+"."+field.name, field.name+" 不能为负数")
+			return
+		}
+	}
+
+	resolved := ResolveRetention(system, site)
+	tiers := []struct {
+		name string
+		days int
+	}{
+		{"sessionDays", resolved.SessionDays},
+		{"hourlyDays", resolved.HourlyDays},
+		{"dailyDays", resolved.DailyDays},
+		{"firstSeenDays", resolved.FirstSeenDays},
+	}
+	for _, tier := range tiers {
+		if tier.days < resolved.RawDays {
+			addError(prefix+"."+tier.name, fmt.Sprintf("%s 不能小于原始日志保留天数 %d", tier.name, resolved.RawDays))
+		}
+	}
+}
+
 func validateWhitelistIP(value string) error {
 	trimmed := strings.TrimSpace(value)
 	if trimmed == "" {
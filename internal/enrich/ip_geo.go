@@ -682,6 +682,11 @@ func resolveIPAPIURL() string {
 	return config.GetIPGeoAPIURL()
 }
 
+// LookupIPLocationLocal 只查内存缓存与本地 IP 库，不请求远端 API；用于实时日志等不能阻塞的场景
+func LookupIPLocationLocal(ip string) (string, string, bool) {
+	return getIPLocationLocalOnly(ip)
+}
+
 func getIPLocationLocalOnly(ip string) (string, string, bool) {
 	if ip == "" || ip == "localhost" || ip == "127.0.0.1" || ip == "::1" {
 		return "", "", false
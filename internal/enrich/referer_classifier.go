@@ -0,0 +1,315 @@
+package enrich
+
+import (
+	"cmp"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed data/referer_sources.json
+var refererDataFiles embed.FS
+
+const refererSourcesFile = "referer_sources.json"
+
+// 来源渠道；internal（站内）依赖站点域名配置，在查询时判定
+const (
+	RefererChannelDirect      = "direct"
+	RefererChannelSearch      = "search"
+	RefererChannelSocial      = "social"
+	RefererChannelEmail       = "email"
+	RefererChannelAIAssistant = "ai-assistant"
+	RefererChannelOther       = "other"
+	RefererChannelInternal    = "internal"
+)
+
+// RefererInfo 来源解析结果
+type RefererInfo struct {
+	Host    string
+	Channel string
+	Source  string
+	Keyword string
+}
+
+type refererSourceFile struct {
+	Version string          `json:"version"`
+	Sources []refererSource `json:"sources"`
+}
+
+type refererSource struct {
+	Name    string   `json:"name"`
+	Channel string   `json:"channel"`
+	Domains []string `json:"domains"`
+	Params  []string `json:"params,omitempty"`
+}
+
+type refererSourceDB struct {
+	version  string
+	exact    map[string]*refererSource
+	wildcard map[string]*refererSource // google.* -> google
+}
+
+var (
+	refererDB     *refererSourceDB
+	refererDBMu   sync.RWMutex
+	refererDBOnce sync.Once
+)
+
+// InitRefererSources 加载来源库：数据目录中的文件优先，内置版本更新时会覆盖旧文件
+func InitRefererSources() error {
+	embedded, err := fs.ReadFile(refererDataFiles, "data/"+refererSourcesFile)
+	if err != nil {
+		return fmt.Errorf("读取内置来源库失败: %v", err)
+	}
+	embeddedFile, err := parseRefererSourceFile(embedded)
+	if err != nil {
+		return fmt.Errorf("解析内置来源库失败: %v", err)
+	}
+
+	data := embedded
+	targetPath := filepath.Join(config.DataDir, refererSourcesFile)
+	if existing, err := os.ReadFile(targetPath); err == nil {
+		if parsed, err := parseRefererSourceFile(existing); err != nil {
+			logrus.WithError(err).Warn("数据目录中的来源库无效，使用内置版本")
+		} else if compareRefererVersions(parsed.Version, embeddedFile.Version) >= 0 {
+			data = existing
+		}
+	}
+	if string(data) == string(embedded) {
+		if err := os.MkdirAll(config.DataDir, 0755); err == nil {
+			if err := os.WriteFile(targetPath, embedded, 0644); err != nil {
+				logrus.WithError(err).Warn("写入来源库文件失败")
+			}
+		}
+	}
+
+	return loadRefererSources(data)
+}
+
+// compareRefererVersions 按点分段逐段比较版本号（如 2026.9 < 2026.10），数字段按数值比较，
+// 非数字段按字符串比较，缺少的段视为 0
+func compareRefererVersions(a, b string) int {
+	left := strings.Split(strings.TrimSpace(a), ".")
+	right := strings.Split(strings.TrimSpace(b), ".")
+	for i := 0; i < len(left) || i < len(right); i++ {
+		x, y := "0", "0"
+		if i < len(left) && left[i] != "" {
+			x = left[i]
+		}
+		if i < len(right) && right[i] != "" {
+			y = right[i]
+		}
+		xn, xErr := strconv.Atoi(x)
+		yn, yErr := strconv.Atoi(y)
+		c := strings.Compare(x, y)
+		if xErr == nil && yErr == nil {
+			c = cmp.Compare(xn, yn)
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// RefererSourcesVersion 当前使用的来源库版本
+func RefererSourcesVersion() string {
+	db := currentRefererDB()
+	if db == nil {
+		return ""
+	}
+	return db.version
+}
+
+// ClassifyReferer 解析来源 URL 的主机、渠道、来源名称与搜索关键词
+func ClassifyReferer(raw string) RefererInfo {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || raw == "-" {
+		return RefererInfo{Channel: RefererChannelDirect}
+	}
+
+	host, query := splitRefererURL(raw)
+	if host == "" {
+		return RefererInfo{Channel: RefererChannelOther}
+	}
+	info := RefererInfo{Host: host, Channel: RefererChannelOther}
+
+	db := currentRefererDB()
+	if db == nil {
+		return info
+	}
+	source := db.lookup(host)
+	if source == nil {
+		return info
+	}
+	info.Channel = source.Channel
+	info.Source = source.Name
+	if len(source.Params) > 0 && query != "" {
+		info.Keyword = extractQueryParam(query, source.Params)
+	}
+	return info
+}
+
+func currentRefererDB() *refererSourceDB {
+	refererDBOnce.Do(func() {
+		refererDBMu.RLock()
+		loaded := refererDB != nil
+		refererDBMu.RUnlock()
+		if loaded {
+			return
+		}
+		// 未显式初始化时回退到内置来源库
+		if data, err := fs.ReadFile(refererDataFiles, "data/"+refererSourcesFile); err == nil {
+			if err := loadRefererSources(data); err != nil {
+				logrus.WithError(err).Warn("加载内置来源库失败")
+			}
+		}
+	})
+	refererDBMu.RLock()
+	defer refererDBMu.RUnlock()
+	return refererDB
+}
+
+func parseRefererSourceFile(data []byte) (*refererSourceFile, error) {
+	var file refererSourceFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Sources) == 0 {
+		return nil, fmt.Errorf("来源库为空")
+	}
+	return &file, nil
+}
+
+func loadRefererSources(data []byte) error {
+	file, err := parseRefererSourceFile(data)
+	if err != nil {
+		return err
+	}
+	db := &refererSourceDB{
+		version:  file.Version,
+		exact:    make(map[string]*refererSource),
+		wildcard: make(map[string]*refererSource),
+	}
+	for i := range file.Sources {
+		source := &file.Sources[i]
+		source.Channel = strings.ToLower(strings.TrimSpace(source.Channel))
+		if source.Channel == "" {
+			source.Channel = RefererChannelOther
+		}
+		for _, domain := range source.Domains {
+			domain = strings.ToLower(strings.TrimSpace(domain))
+			if domain == "" {
+				continue
+			}
+			if strings.HasSuffix(domain, ".*") {
+				db.wildcard[strings.TrimSuffix(domain, ".*")] = source
+				continue
+			}
+			db.exact[domain] = source
+		}
+	}
+
+	refererDBMu.Lock()
+	refererDB = db
+	refererDBMu.Unlock()
+	logrus.Infof("来源库加载完成，版本: %s，共 %d 个来源", db.version, len(file.Sources))
+	return nil
+}
+
+// lookup 先按域名后缀精确匹配（越具体越优先），再匹配 name.* 形式的通配域名
+func (db *refererSourceDB) lookup(host string) *refererSource {
+	host = strings.TrimPrefix(host, "www.")
+	labels := strings.Split(host, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		if source, ok := db.exact[strings.Join(labels[i:], ".")]; ok {
+			return source
+		}
+	}
+	for i := 0; i < len(labels)-1; i++ {
+		source, ok := db.wildcard[labels[i]]
+		if !ok {
+			continue
+		}
+		// 通配部分只允许是顶级域，如 google.com / google.co.jp
+		switch len(labels) - i - 1 {
+		case 1:
+			return source
+		case 2:
+			if _, ok := secondLevelLabels[labels[i+1]]; ok {
+				return source
+			}
+		}
+	}
+	return nil
+}
+
+// secondLevelLabels 常见的二级公共后缀（co.jp / com.hk 等）
+var secondLevelLabels = map[string]struct{}{
+	"co": {}, "com": {}, "net": {}, "org": {}, "ac": {}, "edu": {}, "gov": {}, "ne": {}, "or": {},
+}
+
+// splitRefererURL 日志中的 referer 已做过 URL 解码，这里手动切分避免 url.Parse 因特殊字符失败
+func splitRefererURL(raw string) (string, string) {
+	rest := raw
+	if idx := strings.Index(rest, "://"); idx >= 0 {
+		rest = rest[idx+3:]
+	} else if strings.HasPrefix(rest, "//") {
+		rest = rest[2:]
+	}
+
+	hostPart := rest
+	query := ""
+	if idx := strings.IndexAny(rest, "/?#"); idx >= 0 {
+		hostPart = rest[:idx]
+		rest = rest[idx:]
+		if q := strings.Index(rest, "?"); q >= 0 {
+			query = rest[q+1:]
+			if hash := strings.Index(query, "#"); hash >= 0 {
+				query = query[:hash]
+			}
+		}
+	}
+	if at := strings.LastIndex(hostPart, "@"); at >= 0 {
+		hostPart = hostPart[at+1:]
+	}
+	if host, _, err := net.SplitHostPort(hostPart); err == nil {
+		hostPart = host
+	}
+	hostPart = strings.ToLower(strings.Trim(hostPart, "[]."))
+	if hostPart == "" || strings.ContainsAny(hostPart, " \t") {
+		return "", ""
+	}
+	return hostPart, query
+}
+
+func extractQueryParam(query string, names []string) string {
+	values := make(map[string]string)
+	for _, part := range strings.Split(query, "&") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(key)
+		if _, exists := values[key]; !exists {
+			values[key] = value
+		}
+	}
+	for _, name := range names {
+		value := strings.TrimSpace(strings.ReplaceAll(values[strings.ToLower(name)], "+", " "))
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,24 @@
+package enrich
+
+import "testing"
+
+func TestCompareRefererVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "2026.10", b: "2026.9", want: 1},
+		{a: "2026.9", b: "2026.10", want: -1},
+		{a: "2026.10", b: "2026.10", want: 0},
+		{a: "2026.10", b: "2026.10.0", want: 0},
+		{a: "2026.10.1", b: "2026.10", want: 1},
+		{a: "2027", b: "2026.12", want: 1},
+		{a: "", b: "2026.1", want: -1},
+		{a: "2026.10-beta", b: "2026.10-alpha", want: 1},
+	}
+	for _, tt := range tests {
+		if got := compareRefererVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareRefererVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
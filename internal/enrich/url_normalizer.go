@@ -0,0 +1,170 @@
+package enrich
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/likaia/nginxpulse/internal/config"
+)
+
+var (
+	uuidSegmentPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hashSegmentPattern = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	numSegmentPattern  = regexp.MustCompile(`^[0-9]+$`)
+)
+
+type urlRewriteRule struct {
+	pattern *regexp.Regexp
+	replace string
+}
+
+// URLNormalizer 按站点配置把原始 URL 归一化为路由模板，降低 URL 维表基数
+type URLNormalizer struct {
+	rules       []urlRewriteRule
+	collapseIDs bool
+	queryAllow  map[string]struct{}
+	queryDeny   map[string]struct{}
+	stripQuery  bool
+	lowercase   bool
+	keepRaw     bool
+}
+
+// NewURLNormalizer 根据配置创建归一化器，未启用时返回 nil
+func NewURLNormalizer(cfg *config.URLNormalizeConfig) (*URLNormalizer, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	normalizer := &URLNormalizer{
+		collapseIDs: cfg.CollapseIDs,
+		queryAllow:  buildQueryKeySet(cfg.QueryAllow),
+		queryDeny:   buildQueryKeySet(cfg.QueryDeny),
+		stripQuery:  cfg.StripQuery,
+		lowercase:   cfg.Lowercase,
+		keepRaw:     cfg.KeepRawURL,
+	}
+	for _, rule := range cfg.Rules {
+		pattern := strings.TrimSpace(rule.Pattern)
+		if pattern == "" {
+			continue
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("URL 改写规则正则无效 (%s): %w", pattern, err)
+		}
+		normalizer.rules = append(normalizer.rules, urlRewriteRule{
+			pattern: compiled,
+			replace: rule.Replace,
+		})
+	}
+	return normalizer, nil
+}
+
+// KeepRaw 是否需要保留归一化前的原始 URL
+func (n *URLNormalizer) KeepRaw() bool {
+	return n != nil && n.keepRaw
+}
+
+// Normalize 返回归一化后的 URL；路径与查询参数分别处理
+func (n *URLNormalizer) Normalize(raw string) string {
+	if n == nil || raw == "" {
+		return raw
+	}
+
+	path, query, hasQuery := strings.Cut(raw, "?")
+	if n.lowercase {
+		path = strings.ToLower(path)
+	}
+
+	matched := false
+	for _, rule := range n.rules {
+		if rule.pattern.MatchString(path) {
+			path = rule.pattern.ReplaceAllString(path, rule.replace)
+			matched = true
+			break
+		}
+	}
+	// 命中改写规则时视为已是路由模板，不再折叠 ID
+	if n.collapseIDs && !matched {
+		path = collapseIDSegments(path)
+	}
+
+	if !hasQuery || n.stripQuery {
+		return path
+	}
+	query = n.filterQuery(query)
+	if query == "" {
+		return path
+	}
+	return path + "?" + query
+}
+
+func (n *URLNormalizer) filterQuery(query string) string {
+	if query == "" {
+		return ""
+	}
+	parts := strings.Split(query, "&")
+	kept := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		key, _, _ := strings.Cut(part, "=")
+		normalizedKey := strings.ToLower(strings.TrimSpace(key))
+		if len(n.queryAllow) > 0 {
+			if _, ok := n.queryAllow[normalizedKey]; !ok {
+				continue
+			}
+		}
+		if _, ok := n.queryDeny[normalizedKey]; ok {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	// 参数顺序不同的同一请求归并到同一条 URL
+	sort.SliceStable(kept, func(i, j int) bool {
+		ki, _, _ := strings.Cut(kept[i], "=")
+		kj, _, _ := strings.Cut(kept[j], "=")
+		return ki < kj
+	})
+	return strings.Join(kept, "&")
+}
+
+func collapseIDSegments(path string) string {
+	segments := strings.Split(path, "/")
+	changed := false
+	for i, segment := range segments {
+		replacement := ""
+		switch {
+		case segment == "":
+			continue
+		case numSegmentPattern.MatchString(segment):
+			replacement = ":id"
+		case uuidSegmentPattern.MatchString(segment):
+			replacement = ":uuid"
+		case hashSegmentPattern.MatchString(segment):
+			replacement = ":hash"
+		default:
+			continue
+		}
+		segments[i] = replacement
+		changed = true
+	}
+	if !changed {
+		return path
+	}
+	return strings.Join(segments, "/")
+}
+
+func buildQueryKeySet(keys []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+		set[key] = struct{}{}
+	}
+	return set
+}
@@ -0,0 +1,80 @@
+package ingest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultAgentSilentAfter = 5 * time.Minute
+
+// RecordAgentHeartbeat 记录 agent 心跳，返回其远程配置
+func (p *LogParser) RecordAgentHeartbeat(info store.AgentInfo) (store.AgentInfo, error) {
+	return p.repo.RecordAgentHeartbeat(info)
+}
+
+// ListAgents 返回所有已注册的 agent
+func (p *LogParser) ListAgents() ([]store.AgentInfo, error) {
+	return p.repo.ListAgents()
+}
+
+// GetAgent 查询单个 agent
+func (p *LogParser) GetAgent(agentID string) (store.AgentInfo, error) {
+	return p.repo.GetAgent(agentID)
+}
+
+// SetAgentConfig 更新 agent 的远程配置，agent 在下次心跳时拉取
+func (p *LogParser) SetAgentConfig(agentID string, cfg json.RawMessage) (int64, error) {
+	return p.repo.SetAgentConfig(agentID, cfg)
+}
+
+// DeleteAgent 移除 agent 记录
+func (p *LogParser) DeleteAgent(agentID string) error {
+	return p.repo.DeleteAgent(agentID)
+}
+
+// AgentSilentAfter agent 超过该时长未上报心跳视为失联
+func AgentSilentAfter() time.Duration {
+	raw := strings.TrimSpace(config.ReadConfig().System.AgentSilentAfter)
+	if raw == "" {
+		return defaultAgentSilentAfter
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return defaultAgentSilentAfter
+	}
+	return d
+}
+
+// CheckSilentAgents 标记超时未上报心跳的 agent 并写入系统通知，返回新失联的 agent 数
+func (p *LogParser) CheckSilentAgents() int {
+	silentAfter := AgentSilentAfter()
+	agents, err := p.repo.MarkSilentAgents(int64(silentAfter / time.Second))
+	if err != nil {
+		logrus.WithError(err).Warn("检查 agent 心跳失败")
+		return 0
+	}
+	for _, agent := range agents {
+		lastSeen := time.Unix(agent.LastSeenAt, 0)
+		message := fmt.Sprintf("agent %s（%s）自 %s 起未上报心跳",
+			agent.AgentID, agent.Hostname, lastSeen.Format("2006-01-02 15:04:05"))
+		websiteIDs := make([]string, 0, len(agent.Routes))
+		for _, route := range agent.Routes {
+			websiteIDs = append(websiteIDs, route.WebsiteID)
+		}
+		p.notifySystem("warning", "agent", "Agent 失联", message, "agent_silent:"+agent.AgentID,
+			map[string]interface{}{
+				"agent_id":     agent.AgentID,
+				"hostname":     agent.Hostname,
+				"version":      agent.Version,
+				"last_seen_at": agent.LastSeenAt,
+				"website_ids":  websiteIDs,
+			})
+	}
+	return len(agents)
+}
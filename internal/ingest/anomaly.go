@@ -0,0 +1,219 @@
+package ingest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	anomalyMetricPV   = "pv"
+	anomalyMetricUV   = "uv"
+	anomalyMetricS5xx = "s5xx"
+
+	anomalySeasonWeeks = 4  // 基线取前几周同一小时
+	anomalyEvalHours   = 48 // 每次重新评估最近多少个已结束的小时（迟到日志会改变结果）
+	anomalyMinSamples  = 6  // 至少两周历史才开始判定
+
+	defaultAnomalyThreshold = 4.0
+	defaultAnomalyMinVolume = 20
+)
+
+var anomalyMetricNames = map[string]string{
+	anomalyMetricPV:   "PV",
+	anomalyMetricUV:   "UV",
+	anomalyMetricS5xx: "5xx",
+}
+
+// DetectTrafficAnomalies 对所有站点最近已结束的小时做异常检测，返回新发现的异常数
+func (p *LogParser) DetectTrafficAnomalies() int {
+	cfg := config.ReadConfig().System.Anomaly
+	if cfg == nil || !cfg.Enabled {
+		return 0
+	}
+	threshold := cfg.Threshold
+	if threshold <= 0 {
+		threshold = defaultAnomalyThreshold
+	}
+	minVolume := cfg.MinVolume
+	if minVolume <= 0 {
+		minVolume = defaultAnomalyMinVolume
+	}
+
+	now := time.Now()
+	currentHour := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	evalEnd := currentHour.Add(-time.Hour)
+
+	total := 0
+	for _, websiteID := range config.GetAllWebsiteIDs() {
+		created, err := p.detectWebsiteAnomalies(websiteID, evalEnd, threshold, float64(minVolume))
+		if err != nil {
+			logrus.WithError(err).Warnf("网站 %s 流量异常检测失败", websiteID)
+			continue
+		}
+		if cfg.Notify {
+			for _, anomaly := range created {
+				p.notifyTrafficAnomaly(websiteID, anomaly)
+			}
+		}
+		total += len(created)
+	}
+	return total
+}
+
+func (p *LogParser) detectWebsiteAnomalies(
+	websiteID string, evalEnd time.Time, threshold, minVolume float64,
+) ([]store.TrafficAnomaly, error) {
+	firstBucket, err := p.repo.GetFirstHourlyBucket(websiteID)
+	if err != nil || firstBucket == 0 {
+		return nil, err
+	}
+
+	evalStart := evalEnd.Add(-(anomalyEvalHours - 1) * time.Hour)
+	fetchStart := evalStart.AddDate(0, 0, -7*anomalySeasonWeeks).Add(-time.Hour)
+	points, err := p.repo.GetHourlyMetrics(websiteID, fetchStart.Unix(), evalEnd.Unix())
+	if err != nil {
+		return nil, err
+	}
+	series := make(map[int64]store.HourlyMetricPoint, len(points))
+	for _, point := range points {
+		series[point.Bucket] = point
+	}
+
+	detected := make([]store.TrafficAnomaly, 0)
+	for t := evalStart; !t.After(evalEnd); t = t.Add(time.Hour) {
+		if t.Unix() < firstBucket {
+			continue
+		}
+		lagBuckets := seasonalLagBuckets(t, firstBucket)
+		if len(lagBuckets) < anomalyMinSamples {
+			continue
+		}
+		current := series[t.Unix()]
+		for _, metric := range []string{anomalyMetricPV, anomalyMetricUV, anomalyMetricS5xx} {
+			samples := make([]float64, 0, len(lagBuckets))
+			for _, bucket := range lagBuckets {
+				samples = append(samples, hourlyMetricValue(series[bucket], metric))
+			}
+			value := hourlyMetricValue(current, metric)
+			baseline, score := robustAnomalyScore(value, samples)
+			if math.Max(value, baseline) < minVolume || math.Abs(score) < threshold {
+				continue
+			}
+			direction := "spike"
+			if score < 0 {
+				direction = "drop"
+			}
+			// 错误数下降不是需要关注的异常
+			if metric == anomalyMetricS5xx && direction == "drop" {
+				continue
+			}
+			detected = append(detected, store.TrafficAnomaly{
+				Bucket:    t.Unix(),
+				Metric:    metric,
+				Value:     value,
+				Baseline:  baseline,
+				Score:     math.Round(score*100) / 100,
+				Direction: direction,
+			})
+		}
+	}
+
+	if err := p.repo.DeleteTrafficAnomalies(websiteID, evalStart.Unix(), evalEnd.Unix(), detected); err != nil {
+		return nil, err
+	}
+	return p.repo.SaveTrafficAnomalies(websiteID, detected)
+}
+
+// seasonalLagBuckets 返回前几周同一小时及前后各一小时的桶；按日历日平移，跨夏令时仍对齐本地小时
+func seasonalLagBuckets(t time.Time, firstBucket int64) []int64 {
+	buckets := make([]int64, 0, anomalySeasonWeeks*3)
+	for week := 1; week <= anomalySeasonWeeks; week++ {
+		lagged := t.AddDate(0, 0, -7*week)
+		for _, offset := range []time.Duration{-time.Hour, 0, time.Hour} {
+			bucket := lagged.Add(offset).Unix()
+			if bucket < firstBucket {
+				continue
+			}
+			buckets = append(buckets, bucket)
+		}
+	}
+	return buckets
+}
+
+func hourlyMetricValue(point store.HourlyMetricPoint, metric string) float64 {
+	switch metric {
+	case anomalyMetricUV:
+		return float64(point.UV)
+	case anomalyMetricS5xx:
+		return float64(point.S5xx)
+	default:
+		return float64(point.PV)
+	}
+}
+
+// robustAnomalyScore 以中位数为基线、MAD 为尺度计算鲁棒 z 分数
+func robustAnomalyScore(value float64, samples []float64) (float64, float64) {
+	median := medianOf(samples)
+	deviations := make([]float64, len(samples))
+	for i, sample := range samples {
+		deviations[i] = math.Abs(sample - median)
+	}
+	sigma := 1.4826 * medianOf(deviations)
+	// 低流量时 MAD 常为 0，用泊松噪声量级兜底，避免把正常抖动判为异常
+	if floor := math.Sqrt(math.Max(median, 1)); sigma < floor {
+		sigma = floor
+	}
+	return median, (value - median) / sigma
+}
+
+func medianOf(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func (p *LogParser) notifyTrafficAnomaly(websiteID string, anomaly store.TrafficAnomaly) {
+	siteName := websiteID
+	if site, ok := config.GetWebsiteByID(websiteID); ok {
+		siteName = site.Name
+	}
+	metricName := anomalyMetricNames[anomaly.Metric]
+	action := "突增"
+	level := "info"
+	if anomaly.Direction == "drop" {
+		action = "骤降"
+		level = "warning"
+	}
+	if anomaly.Metric == anomalyMetricS5xx {
+		level = "warning"
+	}
+	hour := time.Unix(anomaly.Bucket, 0).Format("2006-01-02 15:00")
+	title := "流量异常"
+	message := fmt.Sprintf("%s 在 %s %s%s：%.0f（基线 %.0f，分数 %.1f）",
+		siteName, hour, metricName, action, anomaly.Value, anomaly.Baseline, anomaly.Score)
+	fingerprint := fmt.Sprintf("traffic_anomaly:%s:%d:%s", websiteID, anomaly.Bucket, anomaly.Metric)
+	metadata := map[string]interface{}{
+		"website_id":   websiteID,
+		"website_name": siteName,
+		"bucket":       anomaly.Bucket,
+		"metric":       anomaly.Metric,
+		"value":        anomaly.Value,
+		"baseline":     anomaly.Baseline,
+		"score":        anomaly.Score,
+		"direction":    anomaly.Direction,
+	}
+	p.notifySystem(level, "traffic_anomaly", title, message, fingerprint, metadata)
+}
@@ -73,46 +73,19 @@ func (p *LogParser) BackfillHistory(maxDuration time.Duration, maxBytes int64) B
 	websiteIDs := config.GetAllWebsiteIDs()
 
 	for _, websiteID := range websiteIDs {
-		state, ok := p.states[websiteID]
-		if !ok || state.Files == nil {
+		files := p.fileStatesSnapshot(websiteID)
+		if files == nil {
 			continue
 		}
 
-		for filePath, fileState := range state.Files {
+		for filePath, fileState := range files {
 			if budget.exhausted() {
 				break
 			}
 			if fileState.BackfillDone {
 				continue
 			}
-
-			if isGzipFile(filePath) {
-				processed, entries, err := p.backfillGzipFile(websiteID, filePath, &fileState, budget)
-				if err != nil {
-					logrus.Warnf("回填 gzip 日志文件 %s 失败: %v", filePath, err)
-					p.notifyFileIO(websiteID, filePath, "回填 gzip 日志文件", err)
-				} else {
-					result.ProcessedBytes += processed
-					result.ProcessedEntries += entries
-					result.CompletedFiles++
-				}
-				p.setFileState(websiteID, filePath, fileState)
-				continue
-			}
-
-			processed, entries, err := p.backfillPlainFile(websiteID, filePath, &fileState, budget)
-			if err != nil {
-				if !errors.Is(err, io.EOF) {
-					logrus.Warnf("回填日志文件 %s 失败: %v", filePath, err)
-					p.notifyFileIO(websiteID, filePath, "回填日志文件", err)
-				}
-			}
-			result.ProcessedBytes += processed
-			result.ProcessedEntries += entries
-			if fileState.BackfillDone {
-				result.CompletedFiles++
-			}
-			p.setFileState(websiteID, filePath, fileState)
+			p.backfillFile(websiteID, filePath, budget, &result)
 		}
 
 		p.refreshWebsiteRanges(websiteID)
@@ -125,6 +98,43 @@ func (p *LogParser) BackfillHistory(maxDuration time.Duration, maxBytes int64) B
 	return result
 }
 
+// backfillFile 在文件锁内回填单个文件；状态在锁内重新读取，避免覆盖文件监听刚推进的偏移
+func (p *LogParser) backfillFile(websiteID, filePath string, budget *backfillBudget, result *BackfillResult) {
+	defer p.lockScanFile(websiteID, filePath)()
+	fileState, ok := p.getFileState(websiteID, filePath)
+	if !ok || fileState.BackfillDone {
+		return
+	}
+
+	if isGzipFile(filePath) {
+		processed, entries, err := p.backfillGzipFile(websiteID, filePath, &fileState, budget)
+		if err != nil {
+			logrus.Warnf("回填 gzip 日志文件 %s 失败: %v", filePath, err)
+			p.notifyFileIO(websiteID, filePath, "回填 gzip 日志文件", err)
+		} else {
+			result.ProcessedBytes += processed
+			result.ProcessedEntries += entries
+			result.CompletedFiles++
+		}
+		p.setFileState(websiteID, filePath, fileState)
+		return
+	}
+
+	processed, entries, err := p.backfillPlainFile(websiteID, filePath, &fileState, budget)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			logrus.Warnf("回填日志文件 %s 失败: %v", filePath, err)
+			p.notifyFileIO(websiteID, filePath, "回填日志文件", err)
+		}
+	}
+	result.ProcessedBytes += processed
+	result.ProcessedEntries += entries
+	if fileState.BackfillDone {
+		result.CompletedFiles++
+	}
+	p.setFileState(websiteID, filePath, fileState)
+}
+
 func (p *LogParser) backfillPlainFile(
 	websiteID, filePath string,
 	state *FileState,
@@ -149,16 +159,17 @@ func (p *LogParser) backfillPlainFile(
 	if cutoffTs == 0 {
 		cutoffTs = time.Now().AddDate(0, 0, -recentLogWindowDays).Unix()
 	}
-	window := parseWindow{maxTs: cutoffTs}
+	window := parseWindow{maxTs: cutoffTs, bulk: true}
 
-	batch := make([]store.NginxLogRecord, 0, p.parseBatchSize)
+	batchSize := p.batchSizeFor(true)
+	batch := make([]store.NginxLogRecord, 0, batchSize)
 	processBatch := func() {
 		if len(batch) == 0 {
 			return
 		}
 		// 先标记 location 为“待解析”，再在成功落库后写入 ip_geo_pending（避免竞态导致“待解析”长期不变）
 		p.markBatchIPGeoPending(batch)
-		if err := p.repo.BatchInsertLogsForWebsite(websiteID, batch); err != nil {
+		if err := p.repo.BulkInsertLogsForWebsite(websiteID, batch); err != nil {
 			logrus.Errorf("批量插入网站 %s 的日志记录失败: %v", websiteID, err)
 			p.notifyDatabaseWrite(websiteID, "回填写入日志批次", err)
 		} else {
@@ -222,7 +233,7 @@ func (p *LogParser) backfillPlainFile(
 		}
 		entryCount++
 
-		if len(batch) >= p.parseBatchSize {
+		if len(batch) >= batchSize {
 			processBatch()
 		}
 
@@ -276,7 +287,7 @@ func (p *LogParser) backfillGzipFile(
 	if cutoffTs == 0 {
 		cutoffTs = time.Now().AddDate(0, 0, -recentLogWindowDays).Unix()
 	}
-	window := parseWindow{maxTs: cutoffTs}
+	window := parseWindow{maxTs: cutoffTs, bulk: true}
 
 	parserResult := EmptyParserResult("", "")
 	entriesCount, bytesRead, minTs, maxTs := p.parseLogLines(gzReader, websiteID, "", &parserResult, window)
@@ -0,0 +1,111 @@
+package envelope
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DefaultDockerRoot Docker json-file 日志所在目录：<root>/<id>/<id>-json.log
+	DefaultDockerRoot = "/var/lib/docker/containers"
+	// DefaultPodsRoot kubelet（containerd/CRI-O）日志所在目录：<root>/<ns>_<pod>_<uid>/<container>/0.log
+	DefaultPodsRoot = "/var/log/pods"
+)
+
+// ContainerInfo 日志文件所属容器
+type ContainerInfo struct {
+	ID     string
+	Name   string
+	Labels map[string]string
+}
+
+// dockerContainerConfig config.v2.json 中用到的字段
+type dockerContainerConfig struct {
+	ID     string `json:"ID"`
+	Name   string `json:"Name"`
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
+
+// LookupContainer 根据日志路径识别所属容器：Docker 读取同目录的 config.v2.json；
+// kubelet 目录结构从路径中解析命名空间、Pod 与容器名，并以 io.kubernetes.* 标签给出
+func LookupContainer(logPath string) (ContainerInfo, bool) {
+	dir := filepath.Dir(logPath)
+	if data, err := os.ReadFile(filepath.Join(dir, "config.v2.json")); err == nil {
+		var cfg dockerContainerConfig
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return ContainerInfo{}, false
+		}
+		id := cfg.ID
+		if id == "" {
+			id = filepath.Base(dir)
+		}
+		return ContainerInfo{
+			ID:     id,
+			Name:   strings.TrimPrefix(cfg.Name, "/"),
+			Labels: cfg.Config.Labels,
+		}, true
+	}
+
+	// /var/log/pods/<ns>_<pod>_<uid>/<container>/0.log
+	podParts := strings.Split(filepath.Base(filepath.Dir(dir)), "_")
+	if len(podParts) == 3 {
+		container := filepath.Base(dir)
+		return ContainerInfo{
+			ID:     podParts[2] + "/" + container,
+			Name:   container,
+			Labels: kubernetesLabels(podParts[0], podParts[1], container),
+		}, true
+	}
+
+	// /var/log/containers/<pod>_<ns>_<container>-<id>.log
+	base := strings.TrimSuffix(filepath.Base(logPath), ".log")
+	if parts := strings.Split(base, "_"); len(parts) == 3 {
+		idx := strings.LastIndex(parts[2], "-")
+		if idx > 0 {
+			container := parts[2][:idx]
+			return ContainerInfo{
+				ID:     parts[2][idx+1:],
+				Name:   container,
+				Labels: kubernetesLabels(parts[1], parts[0], container),
+			}, true
+		}
+	}
+	return ContainerInfo{}, false
+}
+
+func kubernetesLabels(namespace, pod, container string) map[string]string {
+	return map[string]string{
+		"io.kubernetes.pod.namespace":  namespace,
+		"io.kubernetes.pod.name":       pod,
+		"io.kubernetes.container.name": container,
+	}
+}
+
+// MatchContainer 容器名匹配 containers 中任一通配符，且包含 labels 中的全部标签（值为空或 * 时只要求存在）。
+// 未配置任何条件时全部匹配；配置了条件但无法识别容器时不匹配
+func MatchContainer(logPath string, containers []string, labels map[string]string) bool {
+	if len(containers) == 0 && len(labels) == 0 {
+		return true
+	}
+	info, ok := LookupContainer(logPath)
+	if !ok {
+		return false
+	}
+	if !MatchName(containers, info.Name, info.ID) {
+		return false
+	}
+	for key, want := range labels {
+		value, ok := info.Labels[key]
+		if !ok {
+			return false
+		}
+		if want != "" && want != "*" && want != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+// Package envelope 解开容器运行时与 journald 对日志行的封装，还原 nginx 写出的原始行。
+// 解码按原始行逐行进行，调用方仍按原始字节推进读取位置
+package envelope
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	FormatDocker   = "docker"
+	FormatCRI      = "cri"
+	FormatJournald = "journald"
+)
+
+// maxPartialBytes 拼接分片行的上限，超出后丢弃，避免异常日志撑爆内存
+const maxPartialBytes = 1 << 20
+
+// Decoder 逐行解码；返回 false 表示该原始行不产生日志（分片未结束、被过滤或格式不符）。
+// raw 为去掉结尾 \n 的原始字节，\r 需保留，二进制字段依赖精确内容。
+// 解码器有状态，每个文件使用独立的实例
+type Decoder interface {
+	Decode(raw string) (string, bool)
+	// Pending 是否缓存了尚未输出的分片或未结束的条目；为 false 时已读取的原始行都已处理完毕
+	Pending() bool
+}
+
+// Options 解码选项
+type Options struct {
+	Format string // docker / cri / journald
+	// Stream 只保留指定输出流：stdout（默认）/ stderr / all，仅对 docker/cri 生效
+	Stream string
+	// Units journald 条目的 _SYSTEMD_UNIT 或 SYSLOG_IDENTIFIER，支持通配符
+	Units []string
+	// Containers journald 条目的 CONTAINER_NAME，支持通配符；docker/cri 在列出文件时按容器名过滤
+	Containers []string
+}
+
+// Validate 校验格式与输出流
+func (o Options) Validate() error {
+	switch NormalizeFormat(o.Format) {
+	case FormatDocker, FormatCRI, FormatJournald:
+	default:
+		return fmt.Errorf("不支持的日志封装格式: %s", o.Format)
+	}
+	switch normalizeStream(o.Stream) {
+	case "stdout", "stderr", "all":
+	default:
+		return fmt.Errorf("stream 只能是 stdout、stderr 或 all: %s", o.Stream)
+	}
+	for _, pattern := range append(append([]string{}, o.Units...), o.Containers...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("通配符无效: %s", pattern)
+		}
+	}
+	return nil
+}
+
+// NewDecoder 按格式创建解码器；docker 与 cri 每行自动识别，两种格式混用也能解开
+func NewDecoder(opts Options) Decoder {
+	if NormalizeFormat(opts.Format) == FormatJournald {
+		return &journalDecoder{units: opts.Units, containers: opts.Containers}
+	}
+	return &containerDecoder{stream: normalizeStream(opts.Stream)}
+}
+
+func NormalizeFormat(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+func normalizeStream(value string) string {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if value == "" {
+		return "stdout"
+	}
+	return value
+}
+
+// containerDecoder 解开 Docker json-file（{"log","stream","time"}）与 CRI（<time> <stream> <P|F> <log>）格式。
+// 超长行会被运行时拆成多条：docker 以未带换行结尾的 log 表示分片，CRI 以 P 标记表示分片
+type containerDecoder struct {
+	stream  string
+	partial map[string]*strings.Builder // 按输出流分别拼接
+}
+
+type dockerRecord struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+}
+
+func (d *containerDecoder) Pending() bool {
+	return len(d.partial) > 0
+}
+
+func (d *containerDecoder) Decode(raw string) (string, bool) {
+	raw = strings.TrimRight(raw, "\r")
+	if raw == "" {
+		return "", false
+	}
+	var (
+		stream string
+		text   string
+		final  bool
+	)
+	if raw[0] == '{' {
+		var record dockerRecord
+		if err := json.Unmarshal([]byte(raw), &record); err != nil {
+			return "", false
+		}
+		stream = record.Stream
+		final = strings.HasSuffix(record.Log, "\n")
+		text = strings.TrimSuffix(record.Log, "\n")
+	} else {
+		// CRI：2024-01-02T03:04:05.123456789Z stdout F message
+		parts := strings.SplitN(raw, " ", 4)
+		if len(parts) < 3 {
+			return "", false
+		}
+		stream = parts[1]
+		final = parts[2] != "P"
+		if len(parts) == 4 {
+			text = parts[3]
+		}
+	}
+	if d.stream != "all" && stream != d.stream {
+		return "", false
+	}
+
+	if builder := d.partial[stream]; builder != nil {
+		if builder.Len()+len(text) <= maxPartialBytes {
+			builder.WriteString(text)
+		}
+		if !final {
+			return "", false
+		}
+		delete(d.partial, stream)
+		text = builder.String()
+	} else if !final {
+		if d.partial == nil {
+			d.partial = make(map[string]*strings.Builder)
+		}
+		builder := &strings.Builder{}
+		builder.WriteString(text)
+		d.partial[stream] = builder
+		return "", false
+	}
+	text = strings.TrimRight(text, "\r")
+	if text == "" {
+		return "", false
+	}
+	return text, true
+}
+
+// MatchName 名称匹配任一通配符即可；未配置时全部匹配
+func MatchName(patterns []string, names ...string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			if name == pattern {
+				return true
+			}
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
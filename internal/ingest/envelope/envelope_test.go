@@ -0,0 +1,222 @@
+package envelope
+
+import (
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// journalBinary 按 journal export 格式编码二进制字段：KEY、换行、8 字节小端长度、内容、换行
+func journalBinary(key, value string) string {
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len(value)))
+	return key + "\n" + string(size) + value + "\n"
+}
+
+// decodeAll 按 \n 切分原始内容（保留 \r）逐行解码，返回输出的日志
+func decodeAll(decoder Decoder, input string) []string {
+	var out []string
+	lines := strings.Split(input, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		if text, ok := decoder.Decode(line); ok {
+			out = append(out, text)
+		}
+	}
+	return out
+}
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		input   string
+		want    []string
+		pending bool
+	}{
+		{
+			name: "docker json-file",
+			opts: Options{Format: FormatDocker},
+			input: `{"log":"GET /a\n","stream":"stdout","time":"2024-01-02T03:04:05Z"}` + "\n" +
+				`{"log":"error\n","stream":"stderr","time":"2024-01-02T03:04:05Z"}` + "\n" +
+				`{"log":"GET /b\r\n","stream":"stdout","time":"2024-01-02T03:04:06Z"}` + "\r\n" +
+				"not json\n",
+			want: []string{"GET /a", "GET /b"},
+		},
+		{
+			name: "docker partial",
+			opts: Options{Format: FormatDocker},
+			input: `{"log":"GET ","stream":"stdout"}` + "\n" +
+				`{"log":"/long","stream":"stdout"}` + "\n" +
+				`{"log":"?q=1\n","stream":"stdout"}` + "\n",
+			want: []string{"GET /long?q=1"},
+		},
+		{
+			name: "cri P/F",
+			opts: Options{Format: FormatCRI},
+			input: "2024-01-02T03:04:05.1Z stdout P GET /lo\n" +
+				"2024-01-02T03:04:05.2Z stdout P ng?q\n" +
+				"2024-01-02T03:04:05.3Z stdout F =1\n" +
+				"2024-01-02T03:04:05.4Z stdout F GET /b\n",
+			want: []string{"GET /long?q=1", "GET /b"},
+		},
+		{
+			name: "docker and cri mixed",
+			opts: Options{Format: FormatCRI},
+			input: `{"log":"GET /a\n","stream":"stdout"}` + "\n" +
+				"2024-01-02T03:04:05Z stdout F GET /b\n",
+			want: []string{"GET /a", "GET /b"},
+		},
+		{
+			name: "mixed stream partials",
+			opts: Options{Format: FormatCRI, Stream: "all"},
+			input: "t stdout P out-1 \n" +
+				"t stderr P err-1 \n" +
+				"t stdout F out-2\n" +
+				"t stderr F err-2\n",
+			want: []string{"out-1 out-2", "err-1 err-2"},
+		},
+		{
+			name: "stderr only",
+			opts: Options{Format: FormatCRI, Stream: "stderr"},
+			input: "t stdout P out-1 \n" +
+				"t stderr F err\n" +
+				"t stdout F out-2\n",
+			want: []string{"err"},
+		},
+		{
+			name:    "unfinished partial",
+			opts:    Options{Format: FormatDocker},
+			input:   `{"log":"GET /a\n","stream":"stdout"}` + "\n" + `{"log":"GET ","stream":"stdout"}` + "\n",
+			want:    []string{"GET /a"},
+			pending: true,
+		},
+		{
+			name: "journald text fields",
+			opts: Options{Format: FormatJournald},
+			input: "__CURSOR=s=1\n_SYSTEMD_UNIT=nginx.service\nMESSAGE=GET /a\n\n" +
+				"__CURSOR=s=2\n_SYSTEMD_UNIT=nginx.service\nMESSAGE=GET /b\r\n\n",
+			want: []string{"GET /a", "GET /b"},
+		},
+		{
+			name: "journald binary field",
+			opts: Options{Format: FormatJournald},
+			input: "_SYSTEMD_UNIT=nginx.service\n" + journalBinary("MESSAGE", "GET /a\r\nHost: x\n\nend") + "\n" +
+				"_SYSTEMD_UNIT=nginx.service\n" + journalBinary("OTHER", "a\r\n\n") + "MESSAGE=GET /b\n\n",
+			want: []string{"GET /a\r\nHost: x\n\nend", "GET /b"},
+		},
+		{
+			name: "journald binary length contains newline and cr",
+			opts: Options{Format: FormatJournald},
+			// 长度 0x0d0a = 3338，小端编码为 \n\r
+			input: "SYSLOG_IDENTIFIER=nginx\n" + journalBinary("MESSAGE", strings.Repeat("x", 0x0d0a)) + "\n",
+			want:  []string{strings.Repeat("x", 0x0d0a)},
+		},
+		{
+			name: "journald unit filter",
+			opts: Options{Format: FormatJournald, Units: []string{"nginx*"}},
+			input: "_SYSTEMD_UNIT=nginx.service\nMESSAGE=keep\n\n" +
+				"_SYSTEMD_UNIT=sshd.service\nMESSAGE=drop\n\n" +
+				"SYSLOG_IDENTIFIER=nginx-proxy\nMESSAGE=keep-ident\n\n",
+			want: []string{"keep", "keep-ident"},
+		},
+		{
+			name: "journald container filter",
+			opts: Options{Format: FormatJournald, Containers: []string{"web-*"}},
+			input: "CONTAINER_NAME=web-1\nMESSAGE=keep\n\n" +
+				"CONTAINER_NAME=db\nMESSAGE=drop\n\n" +
+				"MESSAGE=no-container\n\n",
+			want: []string{"keep"},
+		},
+		{
+			name:    "journald unfinished entry",
+			opts:    Options{Format: FormatJournald},
+			input:   "MESSAGE=GET /a\n\n__CURSOR=s=2\n",
+			want:    []string{"GET /a"},
+			pending: true,
+		},
+		{
+			name:    "journald unfinished binary",
+			opts:    Options{Format: FormatJournald},
+			input:   "MESSAGE\n\x05\x00\x00\x00\x00\x00\x00\x00ab\n",
+			pending: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			decoder := NewDecoder(tt.opts)
+			if got := decodeAll(decoder, tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded = %q, want %q", got, tt.want)
+			}
+			if got := decoder.Pending(); got != tt.pending {
+				t.Errorf("Pending() = %t, want %t", got, tt.pending)
+			}
+		})
+	}
+}
+
+// TestDecoderAcrossCalls 同一解码器分两次喂入，跨批次的分片与条目不丢失
+func TestDecoderAcrossCalls(t *testing.T) {
+	tests := []struct {
+		name          string
+		opts          Options
+		first, second string
+		want          []string
+	}{
+		{
+			name:   "cri partial",
+			opts:   Options{Format: FormatCRI},
+			first:  "t stdout P GET /lo\n",
+			second: "t stdout F ng\n",
+			want:   []string{"GET /long"},
+		},
+		{
+			name:   "journald entry",
+			opts:   Options{Format: FormatJournald},
+			first:  "_SYSTEMD_UNIT=nginx.service\n",
+			second: "MESSAGE=GET /a\n\n",
+			want:   []string{"GET /a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoder := NewDecoder(tt.opts)
+			got := decodeAll(decoder, tt.first)
+			if !decoder.Pending() {
+				t.Fatal("Pending() = false after first half")
+			}
+			got = append(got, decodeAll(decoder, tt.second)...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded = %q, want %q", got, tt.want)
+			}
+			if decoder.Pending() {
+				t.Error("Pending() = true after entry finished")
+			}
+		})
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		opts    Options
+		wantErr bool
+	}{
+		{Options{Format: "Docker"}, false},
+		{Options{Format: "cri", Stream: "all"}, false},
+		{Options{Format: "journald", Units: []string{"nginx*"}}, false},
+		{Options{Format: "syslog"}, true},
+		{Options{Format: "docker", Stream: "stdin"}, true},
+		{Options{Format: "journald", Containers: []string{"["}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%+v) = %v, wantErr %t", tt.opts, err, tt.wantErr)
+		}
+	}
+}
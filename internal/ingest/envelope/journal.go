@@ -0,0 +1,103 @@
+package envelope
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// journalDecoder 解析 journal export 格式（journalctl -o export）：
+// 每个字段一行 KEY=value，条目之间以空行分隔；含换行等二进制内容的字段写作
+// KEY 换行、8 字节小端长度、内容、换行。读到空行时输出该条目的 MESSAGE
+type journalDecoder struct {
+	units      []string
+	containers []string
+
+	fields     map[string]string
+	binaryKey  string
+	binaryData []byte
+	inBinary   bool
+	inEntry    bool // 已读到当前条目的字段，尚未遇到结束的空行
+}
+
+// journalFields 过滤与输出需要的字段，其余字段不保留
+var journalFields = map[string]bool{
+	"MESSAGE":           true,
+	"_SYSTEMD_UNIT":     true,
+	"SYSLOG_IDENTIFIER": true,
+	"CONTAINER_NAME":    true,
+}
+
+func (d *journalDecoder) Pending() bool {
+	return d.inEntry || d.inBinary
+}
+
+func (d *journalDecoder) Decode(raw string) (string, bool) {
+	if d.inBinary {
+		return "", d.feedBinary(raw)
+	}
+	if raw == "" {
+		return d.finish()
+	}
+	d.inEntry = true
+	if key, value, ok := strings.Cut(raw, "="); ok {
+		if journalFields[key] {
+			d.set(key, value)
+		}
+		return "", false
+	}
+	// 二进制字段：本行只有字段名，后续原始行拼接出长度与内容
+	d.inBinary = true
+	d.binaryKey = raw
+	d.binaryData = d.binaryData[:0]
+	return "", false
+}
+
+// feedBinary 逐行还原二进制字段；按行切分时去掉的换行在这里补回
+func (d *journalDecoder) feedBinary(raw string) bool {
+	d.binaryData = append(d.binaryData, raw...)
+	d.binaryData = append(d.binaryData, '\n')
+	if len(d.binaryData) < 8 {
+		return false
+	}
+	size := binary.LittleEndian.Uint64(d.binaryData[:8])
+	if size > maxPartialBytes {
+		// 异常长度：放弃该条目，等待下一个空行重新同步
+		d.inBinary = false
+		d.fields = nil
+		return false
+	}
+	if uint64(len(d.binaryData)) < 8+size+1 {
+		return false
+	}
+	if journalFields[d.binaryKey] {
+		d.set(d.binaryKey, string(d.binaryData[8:8+size]))
+	}
+	d.inBinary = false
+	d.binaryKey = ""
+	return false
+}
+
+func (d *journalDecoder) set(key, value string) {
+	if d.fields == nil {
+		d.fields = make(map[string]string, len(journalFields))
+	}
+	d.fields[key] = value
+}
+
+// finish 条目结束：满足过滤条件时输出 MESSAGE
+func (d *journalDecoder) finish() (string, bool) {
+	fields := d.fields
+	d.fields = nil
+	d.inEntry = false
+	message := strings.TrimRight(fields["MESSAGE"], "\r\n")
+	if message == "" {
+		return "", false
+	}
+	if !MatchName(d.units, fields["_SYSTEMD_UNIT"], fields["SYSLOG_IDENTIFIER"]) {
+		return "", false
+	}
+	if !MatchName(d.containers, fields["CONTAINER_NAME"]) {
+		return "", false
+	}
+	return message, true
+}
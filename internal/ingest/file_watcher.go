@@ -0,0 +1,266 @@
+package ingest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/ingest/source"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	watchDebounce       = 200 * time.Millisecond // 最后一次事件后等待的静默时间
+	watchMaxDelay       = time.Second            // 持续写入时最多合并这么久的事件
+	watchResyncInterval = time.Minute            // 重新同步监听目录，覆盖新建目录与配置变化
+)
+
+// watchPattern 一个被监听的本地日志路径或 glob；sourceID 为空表示网站的 logPath
+type watchPattern struct {
+	websiteID string
+	sourceID  string
+	pattern   string // 清理后的路径或 glob
+	exact     string // 非 glob 时为配置中的原始路径，与定时扫描使用的状态键保持一致
+}
+
+// watchKey 去抖期间累积的待扫描文件
+type watchKey struct {
+	websiteID string
+	sourceID  string
+	path      string
+}
+
+// target 返回事件路径对应的扫描路径，不匹配时返回空
+func (w watchPattern) target(path string) string {
+	if w.exact != "" {
+		if w.pattern == path {
+			return w.exact
+		}
+		return ""
+	}
+	if matched, err := filepath.Match(w.pattern, path); err == nil && matched {
+		return path
+	}
+	return ""
+}
+
+// RunFileWatcher 监听本地日志（logPath 与 local 来源）的写入和轮转事件，去抖合并后立即增量读取；
+// 定时任务仍按 taskInterval 兜底扫描，监听创建失败时只记录警告
+func (p *LogParser) RunFileWatcher(ctx context.Context) {
+	if p.demoMode {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.WithError(err).Warn("创建日志文件监听失败，仅按定时任务扫描")
+		return
+	}
+	go p.watchLoop(ctx, watcher)
+}
+
+func (p *LogParser) watchLoop(ctx context.Context, watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+
+	patterns := make(map[string][]watchPattern) // 目录 -> 该目录下监听的路径
+	syncDirs := func() {
+		next := collectWatchPatterns()
+		for dir := range next {
+			if _, ok := patterns[dir]; ok {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				logrus.WithError(err).Warnf("监听日志目录 %s 失败，该目录仅按定时任务扫描", dir)
+				delete(next, dir)
+			}
+		}
+		for dir := range patterns {
+			if _, ok := next[dir]; !ok {
+				_ = watcher.Remove(dir)
+			}
+		}
+		patterns = next
+	}
+	syncDirs()
+
+	resync := time.NewTicker(watchResyncInterval)
+	defer resync.Stop()
+
+	pending := make(map[watchKey]struct{})
+	var (
+		timer   *time.Timer
+		timerC  <-chan time.Time
+		firstAt time.Time
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-resync.C:
+			syncDirs()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logrus.WithError(err).Warn("日志文件监听出错")
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// 轮转时新文件以 Create 出现在原路径，写入为 Write，其余事件无需读取
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			path := filepath.Clean(event.Name)
+			added := false
+			for _, pattern := range patterns[filepath.Dir(path)] {
+				if target := pattern.target(path); target != "" {
+					pending[watchKey{websiteID: pattern.websiteID, sourceID: pattern.sourceID, path: target}] = struct{}{}
+					added = true
+				}
+			}
+			if !added {
+				continue
+			}
+			now := time.Now()
+			if timer == nil {
+				firstAt = now
+				timer = time.NewTimer(watchDebounce)
+				timerC = timer.C
+				continue
+			}
+			delay := watchDebounce
+			if remaining := firstAt.Add(watchMaxDelay).Sub(now); remaining < delay {
+				delay = remaining
+			}
+			if !timer.Stop() {
+				// 已到期但尚未读取，保留这次到期
+				continue
+			}
+			timer.Reset(delay)
+		case <-timerC:
+			timer, timerC = nil, nil
+			batch := pending
+			pending = make(map[watchKey]struct{})
+			p.scanWatched(ctx, batch)
+		}
+	}
+}
+
+// collectWatchPatterns 按目录归集需要监听的本地日志；目录本身含通配符时无法监听，交给定时任务
+func collectWatchPatterns() map[string][]watchPattern {
+	patterns := make(map[string][]watchPattern)
+	add := func(websiteID, sourceID, pattern string) {
+		raw := strings.TrimSpace(pattern)
+		if raw == "" {
+			return
+		}
+		watch := watchPattern{websiteID: websiteID, sourceID: sourceID, pattern: filepath.Clean(raw)}
+		dir := filepath.Dir(watch.pattern)
+		if strings.ContainsAny(dir, "*?[") {
+			return
+		}
+		if !strings.ContainsAny(watch.pattern, "*?[") {
+			watch.exact = raw
+		}
+		patterns[dir] = append(patterns[dir], watch)
+	}
+
+	for _, websiteID := range config.GetAllWebsiteIDs() {
+		site, ok := config.GetWebsiteByID(websiteID)
+		if !ok {
+			continue
+		}
+		if len(site.Sources) == 0 {
+			add(websiteID, "", site.LogPath)
+			continue
+		}
+		for _, srcCfg := range site.Sources {
+			if strings.ToLower(strings.TrimSpace(srcCfg.Type)) != string(source.SourceLocal) {
+				continue
+			}
+			mode := strings.ToLower(strings.TrimSpace(srcCfg.Mode))
+			if mode != "" && mode != "poll" {
+				continue
+			}
+			if srcCfg.Pattern != "" {
+				add(websiteID, srcCfg.ID, srcCfg.Pattern)
+			} else {
+				add(websiteID, srcCfg.ID, srcCfg.Path)
+			}
+		}
+	}
+	return patterns
+}
+
+// scanWatched 增量读取一批被修改的文件；尚未完成首次解析的网站留给定时任务处理
+func (p *LogParser) scanWatched(ctx context.Context, batch map[watchKey]struct{}) {
+	if len(batch) == 0 {
+		return
+	}
+	p.reparseMu.RLock()
+	defer p.reparseMu.RUnlock()
+
+	byWebsite := make(map[string][]watchKey)
+	for key := range batch {
+		byWebsite[key.websiteID] = append(byWebsite[key.websiteID], key)
+	}
+	for websiteID, keys := range byWebsite {
+		if p.hasUnparsedWebsite([]string{websiteID}) {
+			continue
+		}
+		site, ok := config.GetWebsiteByID(websiteID)
+		if !ok {
+			continue
+		}
+		result := EmptyParserResult(site.Name, websiteID)
+		sources := make(map[string]source.LogSource)
+		for _, key := range keys {
+			if _, err := os.Stat(key.path); err != nil {
+				continue
+			}
+			if key.sourceID == "" {
+				p.scanFileExclusive(websiteID, key.path, &result)
+				continue
+			}
+			src, ok := sources[key.sourceID]
+			if !ok {
+				src = newWatchedSource(websiteID, site, key.sourceID)
+				if src == nil {
+					continue
+				}
+				sources[key.sourceID] = src
+			}
+			target := source.TargetRef{WebsiteID: websiteID, SourceID: key.sourceID, Key: key.path}
+			p.scanTargetExclusive(ctx, websiteID, src, target, &result)
+		}
+		p.refreshWebsiteRanges(websiteID)
+		if !result.Success {
+			logrus.Warnf("网站 %s (%s) 监听触发的扫描失败: %v", site.Name, websiteID, result.Error)
+		} else if result.TotalEntries > 0 {
+			logrus.Debugf("网站 %s (%s) 监听触发扫描: %d 条记录", site.Name, websiteID, result.TotalEntries)
+		}
+	}
+	p.updateState()
+}
+
+func newWatchedSource(websiteID string, site config.WebsiteConfig, sourceID string) source.LogSource {
+	for _, srcCfg := range site.Sources {
+		if srcCfg.ID != sourceID {
+			continue
+		}
+		src, err := source.NewFromConfig(websiteID, srcCfg)
+		if err != nil {
+			logrus.WithError(err).Warnf("创建网站 %s 的日志来源 %s 失败", websiteID, sourceID)
+			return nil
+		}
+		return src
+	}
+	return nil
+}
@@ -0,0 +1,645 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/enrich"
+	"github.com/likaia/nginxpulse/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	importProgressInterval = 2 * time.Second
+	importErrorSamples     = 5   // 每个文件保留的解析失败样例行数
+	importSampleMaxBytes   = 200 // 样例行截断长度
+	importPeekLines        = 200 // 判断文件首条日志时间时最多读取的行数
+	importCancelCheckLines = 10000
+)
+
+// ImportOptions 离线导入参数
+type ImportOptions struct {
+	WebsiteID      string
+	Files          []string            // 已展开的文件路径，支持未压缩与 gzip / zstd / bzip2
+	Parse          *config.ParseConfig // 非空时覆盖网站的解析配置
+	Since          time.Time           // 零值表示不限制
+	Until          time.Time           // 不含；零值表示不限制
+	DryRun         bool                // 只解析并统计，不写数据库与检查点
+	BatchSize      int                 // 每批写入条数，默认 bulkParseBatchSize
+	CheckpointPath string              // 为空时不记录检查点
+	Progress       func(ImportReport)  // 定期回调导入进度
+}
+
+// ImportFileStats 单个文件的导入统计
+type ImportFileStats struct {
+	Path         string   `json:"path"`
+	Size         int64    `json:"size"`
+	ReadBytes    int64    `json:"readBytes"` // 已读取的文件字节，压缩文件按压缩后计
+	Lines        int64    `json:"lines"`     // 非空行
+	Accepted     int64    `json:"accepted"`  // 解析成功且在时间范围、保留期内
+	Imported     int64    `json:"imported"`  // 已写入数据库，dry-run 时为 0
+	ParseErrors  int64    `json:"parseErrors"`
+	OutOfWindow  int64    `json:"outOfWindow"` // 不在 since / until 范围内
+	Expired      int64    `json:"expired"`     // 早于原始日志保留期
+	Skipped      bool     `json:"skipped"`     // 检查点显示已导入完成
+	Resumed      int64    `json:"resumed"`     // 从检查点继续时跳过的解压后字节
+	ErrorSamples []string `json:"errorSamples,omitempty"`
+}
+
+// ErrorRate 解析失败行占非空行的比例
+func (s ImportFileStats) ErrorRate() float64 {
+	if s.Lines == 0 {
+		return 0
+	}
+	return float64(s.ParseErrors) / float64(s.Lines)
+}
+
+func (s *ImportFileStats) add(other ImportFileStats) {
+	s.Size += other.Size
+	s.ReadBytes += other.ReadBytes
+	s.Lines += other.Lines
+	s.Accepted += other.Accepted
+	s.Imported += other.Imported
+	s.ParseErrors += other.ParseErrors
+	s.OutOfWindow += other.OutOfWindow
+	s.Expired += other.Expired
+}
+
+// ImportReport 导入进度与结果，Files 按导入顺序排列
+type ImportReport struct {
+	Current int               `json:"current"` // 正在读取的文件下标
+	Files   []ImportFileStats `json:"files"`
+	Elapsed time.Duration     `json:"elapsed"`
+	Done    bool              `json:"done"`
+}
+
+// Total 汇总全部文件的统计
+func (r ImportReport) Total() ImportFileStats {
+	total := ImportFileStats{}
+	for _, file := range r.Files {
+		total.add(file)
+	}
+	return total
+}
+
+// importCheckpoint 导入检查点：每批写入成功后记录各文件已写入的位置，参数不同的导入不能共用
+type importCheckpoint struct {
+	WebsiteID string                          `json:"websiteID"`
+	Since     int64                           `json:"since,omitempty"`
+	Until     int64                           `json:"until,omitempty"`
+	Parse     *config.ParseConfig             `json:"parse,omitempty"`
+	Files     map[string]importFileCheckpoint `json:"files"`
+}
+
+type importFileCheckpoint struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"modTime"`
+	Offset  int64 `json:"offset"` // 已写入部分对应的解压后字节数
+	Done    bool  `json:"done"`
+}
+
+// importBatch 读取协程交给写入协程的一批记录；offset 为批次最后一行之后的解压后位置
+type importBatch struct {
+	index   int
+	records []store.NginxLogRecord
+	offset  int64
+	done    bool
+}
+
+// Importer 离线导入历史日志：不经过扫描状态与回溯预算，解析与 COPY 批量写入并行进行
+type Importer struct {
+	parser     *LogParser
+	lineParser *logLineParser
+	opts       ImportOptions
+	writeLogs  func(websiteID string, records []store.NginxLogRecord) error // 批量写入，默认 repo.BulkInsertLogsForWebsite
+
+	mu         sync.Mutex // 保护 report、checkpoint 与 reading
+	report     ImportReport
+	checkpoint importCheckpoint
+	reading    *countingReader
+	start      time.Time
+}
+
+// NewImporter 按网站配置（或 opts.Parse 覆盖）创建导入器；dry-run 时 repo 可以为空
+func NewImporter(repo *store.Repository, opts ImportOptions) (*Importer, error) {
+	website, ok := config.GetWebsiteByID(opts.WebsiteID)
+	if !ok {
+		return nil, fmt.Errorf("未找到网站配置: %s", opts.WebsiteID)
+	}
+	if len(opts.Files) == 0 {
+		return nil, errors.New("没有需要导入的文件")
+	}
+	if repo == nil && !opts.DryRun {
+		return nil, errors.New("导入需要数据库连接")
+	}
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && !opts.Until.After(opts.Since) {
+		return nil, errors.New("until 必须晚于 since")
+	}
+	var sourceCfg *config.SourceConfig
+	if opts.Parse != nil {
+		sourceCfg = &config.SourceConfig{Parse: opts.Parse}
+	}
+	lineParser, err := newLogLineParser(website, sourceCfg)
+	if err != nil {
+		return nil, err
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = bulkParseBatchSize
+	}
+
+	parser := newLogParser(repo)
+	enrich.InitPVFilters()
+	im := &Importer{parser: parser, lineParser: lineParser, opts: opts}
+	if repo != nil {
+		im.writeLogs = repo.BulkInsertLogsForWebsite
+	}
+	return im, nil
+}
+
+// Run 按文件内首条日志时间顺序导入全部文件；ctx 取消时已写入的批次保留在检查点中，
+// 相同参数再次执行会从检查点继续
+func (im *Importer) Run(ctx context.Context) (ImportReport, error) {
+	im.start = time.Now()
+	if err := im.loadCheckpoint(); err != nil {
+		return im.snapshot(), err
+	}
+	if err := im.planFiles(); err != nil {
+		return im.snapshot(), err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stopProgress := make(chan struct{})
+	var progressWG sync.WaitGroup
+	if im.opts.Progress != nil {
+		progressWG.Add(1)
+		go func() {
+			defer progressWG.Done()
+			ticker := time.NewTicker(importProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					im.opts.Progress(im.snapshot())
+				case <-stopProgress:
+					return
+				}
+			}
+		}()
+	}
+
+	writes := make(chan importBatch, 2)
+	writeDone := make(chan error, 1)
+	go func() {
+		writeDone <- im.writeBatches(cancel, writes)
+	}()
+
+	var readErr error
+	for i := range im.report.Files {
+		if im.report.Files[i].Skipped {
+			continue
+		}
+		if readErr = im.readFile(ctx, i, writes); readErr != nil {
+			break
+		}
+	}
+	close(writes)
+	writeErr := <-writeDone
+	close(stopProgress)
+	progressWG.Wait()
+
+	// 写入失败时读取协程因 ctx 取消而退出，返回写入错误更有意义
+	err := writeErr
+	if err == nil {
+		err = readErr
+	}
+	im.mu.Lock()
+	im.report.Done = err == nil
+	im.mu.Unlock()
+	report := im.snapshot()
+	if im.opts.Progress != nil {
+		im.opts.Progress(report)
+	}
+	return report, err
+}
+
+// planFiles 去重并按首条日志时间排序：会话按时间推进，较早的文件需要先导入
+func (im *Importer) planFiles() error {
+	type plannedFile struct {
+		stats   ImportFileStats
+		modTime int64
+		firstTs int64
+	}
+	seen := make(map[string]struct{}, len(im.opts.Files))
+	planned := make([]plannedFile, 0, len(im.opts.Files))
+	for _, raw := range im.opts.Files {
+		path, err := filepath.Abs(raw)
+		if err != nil {
+			return err
+		}
+		if _, ok := seen[path]; ok {
+			continue
+		}
+		seen[path] = struct{}{}
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("读取文件 %s 失败: %w", raw, err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s 是目录，请使用 glob 指定其中的日志文件", raw)
+		}
+		planned = append(planned, plannedFile{
+			stats:   ImportFileStats{Path: path, Size: info.Size()},
+			modTime: info.ModTime().Unix(),
+			firstTs: im.firstTimestamp(path),
+		})
+	}
+	sort.SliceStable(planned, func(i, j int) bool {
+		ti, tj := planned[i].firstTs, planned[j].firstTs
+		if (ti == 0) != (tj == 0) {
+			return tj == 0
+		}
+		if ti != tj {
+			return ti < tj
+		}
+		return planned[i].stats.Path < planned[j].stats.Path
+	})
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.report.Files = make([]ImportFileStats, len(planned))
+	for i, file := range planned {
+		stats := file.stats
+		saved, ok := im.checkpoint.Files[stats.Path]
+		if ok && (saved.Size != stats.Size || saved.ModTime != file.modTime) {
+			logrus.Warnf("文件 %s 自上次导入后已变化，将从头导入", stats.Path)
+			ok = false
+		}
+		if !ok {
+			saved = importFileCheckpoint{Size: stats.Size, ModTime: file.modTime}
+		}
+		if saved.Done {
+			stats.Skipped = true
+			stats.ReadBytes = stats.Size
+		}
+		stats.Resumed = saved.Offset
+		im.checkpoint.Files[stats.Path] = saved
+		im.report.Files[i] = stats
+	}
+	return nil
+}
+
+// firstTimestamp 读取文件开头的若干行，返回第一条可解析日志的时间，无法判断时返回 0
+func (im *Importer) firstTimestamp(path string) int64 {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	reader, closeReader, err := openImportReader(file)
+	if err != nil {
+		return 0
+	}
+	defer closeReader()
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for i := 0; i < importPeekLines && scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if ts, err := im.parser.parseLogTimestamp(im.lineParser, line); err == nil {
+			return ts.Unix()
+		}
+	}
+	return 0
+}
+
+// readFile 读取并解析单个文件，整批交给写入协程；从检查点继续时跳过已写入的部分
+func (im *Importer) readFile(ctx context.Context, index int, writes chan<- importBatch) error {
+	im.mu.Lock()
+	stats := im.report.Files[index]
+	im.mu.Unlock()
+	path := stats.Path
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("打开文件 %s 失败: %w", path, err)
+	}
+	defer file.Close()
+
+	offset := stats.Resumed
+	counter := &countingReader{reader: file}
+	var decoded io.Reader = counter
+	closeReader := func() {}
+	if compressed, err := isCompressedFile(file); err != nil {
+		return fmt.Errorf("读取文件 %s 失败: %w", path, err)
+	} else if compressed {
+		decoded, closeReader, err = openImportReader(counter)
+		if err != nil {
+			return fmt.Errorf("解压文件 %s 失败: %w", path, err)
+		}
+		if err := skipReaderBytes(decoded, offset); err != nil {
+			closeReader()
+			return fmt.Errorf("跳过文件 %s 已导入的部分失败: %w", path, err)
+		}
+	} else if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("设置文件 %s 读取位置失败: %w", path, err)
+		}
+		counter.count.Store(offset)
+	}
+	defer closeReader()
+
+	im.mu.Lock()
+	im.report.Current = index
+	im.reading = counter
+	im.mu.Unlock()
+	defer func() {
+		im.mu.Lock()
+		im.reading = nil
+		im.report.Files[index].ReadBytes = counter.count.Load()
+		im.mu.Unlock()
+	}()
+
+	reader := bufio.NewReaderSize(decoded, 1024*1024)
+	batch := make([]store.NginxLogRecord, 0, im.opts.BatchSize)
+	emit := func(done bool) error {
+		im.publish(index, stats)
+		select {
+		case writes <- importBatch{index: index, records: batch, offset: offset, done: done}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		batch = make([]store.NginxLogRecord, 0, im.opts.BatchSize)
+		return nil
+	}
+
+	for {
+		line, readErr := reader.ReadString('\n')
+		offset += int64(len(line))
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			if record, ok := im.parseLine(line, &stats); ok {
+				batch = append(batch, *record)
+				if len(batch) >= im.opts.BatchSize {
+					if err := emit(false); err != nil {
+						return err
+					}
+				}
+			}
+			if stats.Lines%importCancelCheckLines == 0 && ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("读取文件 %s 失败: %w", path, readErr)
+		}
+	}
+	return emit(true)
+}
+
+// parseLine 解析一行并按时间范围与保留期过滤，计入 stats
+func (im *Importer) parseLine(line string, stats *ImportFileStats) (*store.NginxLogRecord, bool) {
+	stats.Lines++
+	record, err := im.parser.parseWithParser(im.lineParser, line)
+	if err != nil {
+		stats.ParseErrors++
+		if len(stats.ErrorSamples) < importErrorSamples {
+			stats.ErrorSamples = append(stats.ErrorSamples, truncateSample(line))
+		}
+		return nil, false
+	}
+	ts := record.Timestamp
+	if (!im.opts.Since.IsZero() && ts.Before(im.opts.Since)) || (!im.opts.Until.IsZero() && !ts.Before(im.opts.Until)) {
+		stats.OutOfWindow++
+		return nil, false
+	}
+	if err := checkRetention(im.opts.WebsiteID, ts); err != nil {
+		stats.Expired++
+		return nil, false
+	}
+	im.parser.normalizeRecordURL(im.opts.WebsiteID, record)
+	stats.Accepted++
+	return record, true
+}
+
+// publish 更新读取协程维护的计数，Imported 由写入协程维护
+func (im *Importer) publish(index int, stats ImportFileStats) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	current := &im.report.Files[index]
+	stats.Imported = current.Imported
+	stats.ReadBytes = current.ReadBytes
+	*current = stats
+}
+
+// writeBatches 按顺序写入批次并推进检查点；失败后取消读取并丢弃剩余批次
+func (im *Importer) writeBatches(cancel context.CancelFunc, writes <-chan importBatch) error {
+	var firstErr error
+	for batch := range writes {
+		if firstErr != nil {
+			continue
+		}
+		if err := im.writeBatch(batch); err != nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	return firstErr
+}
+
+func (im *Importer) writeBatch(batch importBatch) error {
+	im.mu.Lock()
+	path := im.report.Files[batch.index].Path
+	im.mu.Unlock()
+
+	if !im.opts.DryRun && len(batch.records) > 0 {
+		p := im.parser
+		p.markBatchIPGeoPending(batch.records)
+		if err := im.writeLogs(im.opts.WebsiteID, batch.records); err != nil {
+			return fmt.Errorf("写入文件 %s 的日志批次失败: %w", path, err)
+		}
+		p.enqueueBatchIPGeo(batch.records)
+	}
+
+	im.mu.Lock()
+	if !im.opts.DryRun {
+		im.report.Files[batch.index].Imported += int64(len(batch.records))
+	}
+	saved := im.checkpoint.Files[path]
+	saved.Offset = batch.offset
+	saved.Done = batch.done
+	im.checkpoint.Files[path] = saved
+	im.mu.Unlock()
+	return im.saveCheckpoint()
+}
+
+func (im *Importer) snapshot() ImportReport {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	report := im.report
+	report.Files = append([]ImportFileStats(nil), im.report.Files...)
+	if im.reading != nil && report.Current < len(report.Files) {
+		report.Files[report.Current].ReadBytes = im.reading.count.Load()
+	}
+	report.Elapsed = time.Since(im.start)
+	return report
+}
+
+func (im *Importer) loadCheckpoint() error {
+	checkpoint := importCheckpoint{
+		WebsiteID: im.opts.WebsiteID,
+		Parse:     im.opts.Parse,
+		Files:     make(map[string]importFileCheckpoint),
+	}
+	if !im.opts.Since.IsZero() {
+		checkpoint.Since = im.opts.Since.Unix()
+	}
+	if !im.opts.Until.IsZero() {
+		checkpoint.Until = im.opts.Until.Unix()
+	}
+	im.checkpoint = checkpoint
+	if im.opts.DryRun || im.opts.CheckpointPath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(im.opts.CheckpointPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取检查点文件失败: %w", err)
+	}
+	var saved importCheckpoint
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("解析检查点文件 %s 失败: %w", im.opts.CheckpointPath, err)
+	}
+	if saved.WebsiteID != checkpoint.WebsiteID || saved.Since != checkpoint.Since ||
+		saved.Until != checkpoint.Until || !sameParseConfig(saved.Parse, checkpoint.Parse) {
+		return fmt.Errorf("检查点 %s 与本次导入的网站、时间范围或解析配置不一致，请使用相同参数或删除该文件后重新导入",
+			im.opts.CheckpointPath)
+	}
+	if saved.Files != nil {
+		checkpoint.Files = saved.Files
+	}
+	im.checkpoint = checkpoint
+	return nil
+}
+
+// saveCheckpoint 先写临时文件再替换，避免中断时留下不完整的检查点
+func (im *Importer) saveCheckpoint() error {
+	if im.opts.DryRun || im.opts.CheckpointPath == "" {
+		return nil
+	}
+	im.mu.Lock()
+	data, err := json.MarshalIndent(im.checkpoint, "", "  ")
+	im.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpPath := im.opts.CheckpointPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("写入检查点文件失败: %w", err)
+	}
+	if err := os.Rename(tmpPath, im.opts.CheckpointPath); err != nil {
+		return fmt.Errorf("写入检查点文件失败: %w", err)
+	}
+	return nil
+}
+
+// truncateSample 截断过长的样例行，不切断多字节字符
+func truncateSample(line string) string {
+	if len(line) <= importSampleMaxBytes {
+		return line
+	}
+	cut := importSampleMaxBytes
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	return line[:cut] + "..."
+}
+
+func sameParseConfig(a, b *config.ParseConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// countingReader 统计已读取的原始字节，用于按文件大小估算进度
+type countingReader struct {
+	reader io.Reader
+	count  atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
+)
+
+// isCompressedFile 按文件头判断是否为 gzip / zstd / bzip2，不改变读取位置
+func isCompressedFile(file *os.File) (bool, error) {
+	magic := make([]byte, 4)
+	n, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	magic = magic[:n]
+	return bytes.HasPrefix(magic, gzipMagic) || bytes.HasPrefix(magic, zstdMagic) || bytes.HasPrefix(magic, bzip2Magic), nil
+}
+
+// openImportReader 按文件头选择解压方式，未压缩时原样返回
+func openImportReader(reader io.Reader) (io.Reader, func(), error) {
+	buffered := bufio.NewReaderSize(reader, 64*1024)
+	magic, err := buffered.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gzReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gzReader, func() { gzReader.Close() }, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zstdReader, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zstdReader, zstdReader.Close, nil
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return bzip2.NewReader(buffered), func() {}, nil
+	default:
+		return buffered, func() {}, nil
+	}
+}
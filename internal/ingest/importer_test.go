@@ -0,0 +1,351 @@
+package ingest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/store"
+)
+
+// testConfigJSON 包内测试共用的配置：首次调用 config.ReadConfig 后全局缓存，各测试按名称取站点 ID
+const testConfigJSON = `{"websites":[{"name":"import-test","logPath":"/dev/null"},{"name":"otlp-test","logPath":"/dev/null"}]}`
+
+// testWebsiteID 通过 CONFIG_JSON 注册默认 nginx 格式的测试站点，返回名称对应的 ID
+func testWebsiteID(t *testing.T, name string) string {
+	t.Helper()
+	t.Setenv("CONFIG_JSON", testConfigJSON)
+	config.ReadConfig()
+	for _, id := range config.GetAllWebsiteIDs() {
+		if website, ok := config.GetWebsiteByID(id); ok && website.Name == name {
+			return id
+		}
+	}
+	t.Fatalf("test website %s not configured", name)
+	return ""
+}
+
+// importLine 生成一行默认 nginx 格式的日志
+func importLine(url string, ts time.Time) string {
+	return fmt.Sprintf(`10.0.0.1 - - [%s] "GET %s HTTP/1.1" 200 10 "-" "Mozilla/5.0"`,
+		ts.Format(defaultNginxTimeLayout), url)
+}
+
+// writeImportFile 按 compression（""、gz、zst）写入测试日志文件
+func writeImportFile(t *testing.T, dir, name, compression string, lines []string) string {
+	t.Helper()
+	content := []byte(strings.Join(lines, "\n") + "\n")
+	var buf bytes.Buffer
+	switch compression {
+	case "":
+		buf.Write(content)
+	case "gz":
+		writer := gzip.NewWriter(&buf)
+		writer.Write(content)
+		writer.Close()
+	case "zst":
+		writer, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("zstd writer: %v", err)
+		}
+		writer.Write(content)
+		writer.Close()
+	default:
+		t.Fatalf("unknown compression %q", compression)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+	return path
+}
+
+// importTestFiles 写入三个文件：plain 最早、gz 居中、zst 最晚，每个文件 4 条日志
+func importTestFiles(t *testing.T, dir string, base time.Time) ([]string, []string) {
+	t.Helper()
+	var files, urls []string
+	for i, compression := range []string{"", "gz", "zst"} {
+		name := "access" + map[string]string{"": ".log", "gz": ".log.gz", "zst": ".log.zst"}[compression]
+		lines := make([]string, 0, 4)
+		for j := 0; j < 4; j++ {
+			url := fmt.Sprintf("/%d/%d", i, j)
+			urls = append(urls, url)
+			lines = append(lines, importLine(url, base.Add(time.Duration(i*4+j)*time.Minute)))
+		}
+		files = append(files, writeImportFile(t, dir, name, compression, lines))
+	}
+	return files, urls
+}
+
+// importRecorder 记录写入的 URL；failAt 为第几次写入（从 1 开始）返回错误，0 表示不失败
+type importRecorder struct {
+	calls  int
+	failAt int
+	urls   []string
+}
+
+var errImportWrite = errors.New("write failed")
+
+func (r *importRecorder) write(websiteID string, records []store.NginxLogRecord) error {
+	r.calls++
+	if r.calls == r.failAt {
+		return errImportWrite
+	}
+	for _, record := range records {
+		r.urls = append(r.urls, record.Url)
+	}
+	return nil
+}
+
+func newTestImporter(t *testing.T, opts ImportOptions, recorder *importRecorder) *Importer {
+	t.Helper()
+	im, err := NewImporter(nil, ImportOptions{WebsiteID: opts.WebsiteID, Files: opts.Files, DryRun: true})
+	if err != nil {
+		t.Fatalf("NewImporter: %v", err)
+	}
+	// 没有数据库：沿用 dry-run 创建的解析器，写入交给 recorder
+	im.opts = opts
+	if im.opts.BatchSize <= 0 {
+		im.opts.BatchSize = bulkParseBatchSize
+	}
+	if recorder != nil {
+		im.writeLogs = recorder.write
+	}
+	return im
+}
+
+func TestImporterReadsPlainAndCompressedFiles(t *testing.T) {
+	websiteID := testWebsiteID(t, "import-test")
+	dir := t.TempDir()
+	base := time.Now().Add(-2 * time.Hour).Truncate(time.Minute)
+	files, urls := importTestFiles(t, dir, base)
+	checkpointPath := filepath.Join(dir, "checkpoint.json")
+
+	recorder := &importRecorder{}
+	// 倒序传入，导入按文件内首条日志时间排序
+	im := newTestImporter(t, ImportOptions{
+		WebsiteID:      websiteID,
+		Files:          []string{files[2], files[1], files[0]},
+		BatchSize:      3,
+		CheckpointPath: checkpointPath,
+	}, recorder)
+	report, err := im.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !reflect.DeepEqual(recorder.urls, urls) {
+		t.Fatalf("written = %v, want %v", recorder.urls, urls)
+	}
+	if !report.Done || len(report.Files) != 3 {
+		t.Fatalf("report done = %t with %d files, want done with 3", report.Done, len(report.Files))
+	}
+	for i, file := range report.Files {
+		if file.Path != files[i] {
+			t.Errorf("file %d = %s, want %s", i, file.Path, files[i])
+		}
+		if file.Lines != 4 || file.Accepted != 4 || file.Imported != 4 || file.ParseErrors != 0 {
+			t.Errorf("%s: lines/accepted/imported/errors = %d/%d/%d/%d, want 4/4/4/0",
+				filepath.Base(file.Path), file.Lines, file.Accepted, file.Imported, file.ParseErrors)
+		}
+		if file.ReadBytes != file.Size {
+			t.Errorf("%s: read %d of %d bytes", filepath.Base(file.Path), file.ReadBytes, file.Size)
+		}
+	}
+
+	data, err := os.ReadFile(checkpointPath)
+	if err != nil {
+		t.Fatalf("read checkpoint: %v", err)
+	}
+	var checkpoint importCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		t.Fatalf("decode checkpoint: %v", err)
+	}
+	for _, path := range files {
+		if !checkpoint.Files[path].Done {
+			t.Errorf("checkpoint for %s not done: %+v", filepath.Base(path), checkpoint.Files[path])
+		}
+	}
+}
+
+// TestImporterResumesFromCheckpoint 第 4 次写入（gz 文件的第二批）失败后中断；
+// 相同参数重新导入时跳过已完成的文件，gz 从检查点位置继续，每条日志只写入一次
+func TestImporterResumesFromCheckpoint(t *testing.T) {
+	websiteID := testWebsiteID(t, "import-test")
+	dir := t.TempDir()
+	base := time.Now().Add(-2 * time.Hour).Truncate(time.Minute)
+	files, urls := importTestFiles(t, dir, base)
+	opts := ImportOptions{
+		WebsiteID:      websiteID,
+		Files:          files,
+		BatchSize:      3,
+		CheckpointPath: filepath.Join(dir, "checkpoint.json"),
+	}
+
+	first := &importRecorder{failAt: 4}
+	report, err := newTestImporter(t, opts, first).Run(context.Background())
+	if !errors.Is(err, errImportWrite) {
+		t.Fatalf("interrupted Run = %v, want %v", err, errImportWrite)
+	}
+	if report.Done {
+		t.Fatal("interrupted report marked done")
+	}
+	if want := urls[:7]; !reflect.DeepEqual(first.urls, want) {
+		t.Fatalf("written before interruption = %v, want %v", first.urls, want)
+	}
+
+	second := &importRecorder{}
+	report, err = newTestImporter(t, opts, second).Run(context.Background())
+	if err != nil {
+		t.Fatalf("resumed Run: %v", err)
+	}
+	if want := urls[7:]; !reflect.DeepEqual(second.urls, want) {
+		t.Fatalf("written after resume = %v, want %v", second.urls, want)
+	}
+	if all := append(append([]string(nil), first.urls...), second.urls...); !reflect.DeepEqual(all, urls) {
+		t.Fatalf("written in total = %v, want each of %v once", all, urls)
+	}
+
+	tests := []struct {
+		skipped  bool
+		resumed  bool
+		imported int64
+	}{
+		{skipped: true, resumed: true},
+		{resumed: true, imported: 1},
+		{imported: 4},
+	}
+	for i, tt := range tests {
+		file := report.Files[i]
+		if file.Skipped != tt.skipped || (file.Resumed > 0) != tt.resumed || file.Imported != tt.imported {
+			t.Errorf("%s: skipped/resumed/imported = %t/%d/%d, want %t/%t/%d",
+				filepath.Base(file.Path), file.Skipped, file.Resumed, file.Imported, tt.skipped, tt.resumed, tt.imported)
+		}
+	}
+	if total := report.Total(); total.Imported != 5 || total.Lines != 5 {
+		t.Errorf("resumed total imported/lines = %d/%d, want 5/5", total.Imported, total.Lines)
+	}
+}
+
+func TestImporterDryRun(t *testing.T) {
+	websiteID := testWebsiteID(t, "import-test")
+	dir := t.TempDir()
+	base := time.Now().Add(-2 * time.Hour).Truncate(time.Minute)
+	lines := []string{
+		importLine("/a", base),
+		"not a log line",
+		"",
+		importLine("/b", base.Add(time.Minute)),
+		`10.0.0.1 - - [bad time] "GET /c HTTP/1.1" 200 10 "-" "-"`,
+	}
+	path := writeImportFile(t, dir, "access.log.gz", "gz", lines)
+	checkpointPath := filepath.Join(dir, "checkpoint.json")
+
+	recorder := &importRecorder{}
+	im := newTestImporter(t, ImportOptions{
+		WebsiteID:      websiteID,
+		Files:          []string{path},
+		DryRun:         true,
+		CheckpointPath: checkpointPath,
+	}, recorder)
+	report, err := im.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if recorder.calls != 0 {
+		t.Errorf("dry run wrote %d batches", recorder.calls)
+	}
+	if _, err := os.Stat(checkpointPath); !os.IsNotExist(err) {
+		t.Errorf("dry run left a checkpoint: %v", err)
+	}
+
+	total := report.Total()
+	if total.Lines != 4 || total.Accepted != 2 || total.Imported != 0 || total.ParseErrors != 2 {
+		t.Errorf("lines/accepted/imported/errors = %d/%d/%d/%d, want 4/2/0/2",
+			total.Lines, total.Accepted, total.Imported, total.ParseErrors)
+	}
+	if got := total.ErrorRate(); got != 0.5 {
+		t.Errorf("ErrorRate = %v, want 0.5", got)
+	}
+	if samples := report.Files[0].ErrorSamples; len(samples) != 2 || samples[0] != "not a log line" {
+		t.Errorf("error samples = %q", samples)
+	}
+}
+
+func TestImporterSkipsRecordsOutsideWindow(t *testing.T) {
+	websiteID := testWebsiteID(t, "import-test")
+	dir := t.TempDir()
+	base := time.Now().Add(-2 * time.Hour).Truncate(time.Minute)
+	lines := []string{importLine("/expired", time.Now().AddDate(0, 0, -40))}
+	for i := 0; i < 5; i++ {
+		lines = append(lines, importLine(fmt.Sprintf("/%d", i), base.Add(time.Duration(i)*time.Minute)))
+	}
+	path := writeImportFile(t, dir, "access.log", "", lines)
+
+	tests := []struct {
+		name         string
+		since, until time.Time
+		want         []string
+		outOfWindow  int64
+		expired      int64
+	}{
+		{
+			name:    "no window",
+			want:    []string{"/0", "/1", "/2", "/3", "/4"},
+			expired: 1,
+		},
+		{
+			name:        "since and until",
+			since:       base.Add(time.Minute),
+			until:       base.Add(3 * time.Minute),
+			want:        []string{"/1", "/2"},
+			outOfWindow: 4,
+		},
+		{
+			name:        "since only",
+			since:       base.Add(3 * time.Minute),
+			want:        []string{"/3", "/4"},
+			outOfWindow: 4,
+		},
+		{
+			name:        "until only",
+			until:       base.Add(time.Minute),
+			want:        []string{"/0"},
+			outOfWindow: 4,
+			expired:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &importRecorder{}
+			im := newTestImporter(t, ImportOptions{
+				WebsiteID: websiteID,
+				Files:     []string{path},
+				Since:     tt.since,
+				Until:     tt.until,
+			}, recorder)
+			report, err := im.Run(context.Background())
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if !reflect.DeepEqual(recorder.urls, tt.want) {
+				t.Errorf("written = %v, want %v", recorder.urls, tt.want)
+			}
+			total := report.Total()
+			if total.OutOfWindow != tt.outOfWindow || total.Expired != tt.expired || total.Imported != int64(len(tt.want)) {
+				t.Errorf("outOfWindow/expired/imported = %d/%d/%d, want %d/%d/%d",
+					total.OutOfWindow, total.Expired, total.Imported, tt.outOfWindow, tt.expired, len(tt.want))
+			}
+		})
+	}
+}
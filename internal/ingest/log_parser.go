@@ -22,6 +22,7 @@ import (
 	"github.com/likaia/nginxpulse/internal/config"
 	"github.com/likaia/nginxpulse/internal/enrich"
 	"github.com/likaia/nginxpulse/internal/ingest/dedup"
+	"github.com/likaia/nginxpulse/internal/ingest/envelope"
 	"github.com/likaia/nginxpulse/internal/store"
 	"github.com/sirupsen/logrus"
 )
@@ -44,6 +45,7 @@ const (
 	recentLogWindowDays   = 7
 	recentScanChunkSize   = 256 * 1024
 	defaultParseBatchSize = 100
+	bulkParseBatchSize    = 5000 // 首次解析与历史回溯走 COPY 批量写入时的最小批次
 )
 
 var (
@@ -124,6 +126,7 @@ const (
 type parseWindow struct {
 	minTs int64
 	maxTs int64
+	bulk  bool // 首次解析（含重新解析）与历史回溯：数据量大，按大批次走 COPY 批量写入
 }
 
 func (w parseWindow) allows(ts int64) bool {
@@ -147,24 +150,37 @@ type logLineParser struct {
 type LogParser struct {
 	repo              *store.Repository
 	statePath         string
+	stateMu           sync.Mutex              // 保护 states，并行扫描时各工作协程共享
 	states            map[string]LogScanState // 各网站的扫描状态，以网站ID为键
 	demoMode          bool
-	retentionDays     int
 	parseBatchSize    int
+	parseWorkers      int
 	ipGeoCacheLimit   int
+	lineParserMu      sync.Mutex
+	scanLocks         keyedLocks                // 同一文件/目标同时只允许一个扫描（定时扫描、文件监听、回填）
+	reparseMu         sync.RWMutex              // 重新解析清空数据期间阻止文件监听触发的扫描
 	lineParsers       map[string]*logLineParser // key: websiteID or websiteID:sourceID
 	dedup             *dedup.Cache
 	whitelistMatchers map[string]*enrich.WhitelistMatcher
+	urlNormalizers    map[string]*enrich.URLNormalizer
+	tail              tailHub // 实时日志订阅
+	decoderMu         sync.Mutex
+	lineDecoders      map[string]*targetDecoder // 远端目标的封装解码器，跨扫描保留分片，key: websiteID|targetKey
 }
 
 // NewLogParser 创建新的日志解析器
 func NewLogParser(userRepoPtr *store.Repository) *LogParser {
+	parser := newLogParser(userRepoPtr)
+	parser.loadState()
+	parser.resetStateIfEmptyDB()
+	enrich.InitPVFilters()
+	return parser
+}
+
+// newLogParser 创建解析器但不加载扫描状态，离线导入只复用解析与写入逻辑
+func newLogParser(userRepoPtr *store.Repository) *LogParser {
 	statePath := filepath.Join(config.DataDir, "nginx_scan_state.json")
 	cfg := config.ReadConfig()
-	retentionDays := cfg.System.LogRetentionDays
-	if retentionDays <= 0 {
-		retentionDays = 30
-	}
 	parseBatchSize := cfg.System.ParseBatchSize
 	if parseBatchSize <= 0 {
 		parseBatchSize = defaultParseBatchSize
@@ -178,23 +194,27 @@ func NewLogParser(userRepoPtr *store.Repository) *LogParser {
 		statePath:         statePath,
 		states:            make(map[string]LogScanState),
 		demoMode:          cfg.System.DemoMode,
-		retentionDays:     retentionDays,
 		parseBatchSize:    parseBatchSize,
+		parseWorkers:      resolveParseWorkers(cfg.System.ParseWorkers),
 		ipGeoCacheLimit:   ipGeoCacheLimit,
 		lineParsers:       make(map[string]*logLineParser),
 		dedup:             dedup.NewCache(100000, 10*time.Minute),
 		whitelistMatchers: make(map[string]*enrich.WhitelistMatcher),
+		urlNormalizers:    make(map[string]*enrich.URLNormalizer),
 	}
 	for _, websiteID := range config.GetAllWebsiteIDs() {
 		if site, ok := config.GetWebsiteByID(websiteID); ok {
 			if matcher := enrich.NewWhitelistMatcher(site.Whitelist); matcher != nil {
 				parser.whitelistMatchers[websiteID] = matcher
 			}
+			normalizer, err := enrich.NewURLNormalizer(site.URLNormalize)
+			if err != nil {
+				logrus.WithError(err).Warnf("网站 %s 的 URL 归一化配置无效，已忽略", site.Name)
+			} else if normalizer != nil {
+				parser.urlNormalizers[websiteID] = normalizer
+			}
 		}
 	}
-	parser.loadState()
-	parser.resetStateIfEmptyDB()
-	enrich.InitPVFilters()
 	return parser
 }
 
@@ -242,6 +262,8 @@ func (p *LogParser) loadState() {
 
 // updateState 更新并保存状态
 func (p *LogParser) updateState() {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	data, err := json.Marshal(p.states)
 	if err != nil {
 		logrus.Errorf("保存扫描状态失败: %v", err)
@@ -302,6 +324,7 @@ func (p *LogParser) resetStateIfEmptyDB() {
 	p.ResetScanState("")
 }
 
+// ensureWebsiteState 调用方需持有 stateMu
 func (p *LogParser) ensureWebsiteState(websiteID string) LogScanState {
 	state, ok := p.states[websiteID]
 	if !ok {
@@ -323,6 +346,8 @@ func (p *LogParser) ensureWebsiteState(websiteID string) LogScanState {
 }
 
 func (p *LogParser) hasUnparsedWebsite(websiteIDs []string) bool {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	for _, id := range websiteIDs {
 		state, ok := p.states[id]
 		if !ok || !state.InitialParsed {
@@ -333,6 +358,8 @@ func (p *LogParser) hasUnparsedWebsite(websiteIDs []string) bool {
 }
 
 func (p *LogParser) markInitialParsed(websiteID string) {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	state := p.ensureWebsiteState(websiteID)
 	if state.InitialParsed {
 		return
@@ -342,6 +369,8 @@ func (p *LogParser) markInitialParsed(websiteID string) {
 }
 
 func (p *LogParser) getFileState(websiteID, filePath string) (FileState, bool) {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	state, ok := p.states[websiteID]
 	if !ok || state.Files == nil {
 		return FileState{}, false
@@ -350,13 +379,32 @@ func (p *LogParser) getFileState(websiteID, filePath string) (FileState, bool) {
 	return fileState, ok
 }
 
+// fileStatesSnapshot 返回网站各文件状态的副本，供回填在锁外遍历
+func (p *LogParser) fileStatesSnapshot(websiteID string) map[string]FileState {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
+	state, ok := p.states[websiteID]
+	if !ok || state.Files == nil {
+		return nil
+	}
+	files := make(map[string]FileState, len(state.Files))
+	for path, fileState := range state.Files {
+		files[path] = fileState
+	}
+	return files
+}
+
 func (p *LogParser) setFileState(websiteID, filePath string, fileState FileState) {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	state := p.ensureWebsiteState(websiteID)
 	state.Files[normalizeLogPath(filePath)] = fileState
 	p.states[websiteID] = state
 }
 
 func (p *LogParser) deleteFileState(websiteID, filePath string) {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	state, ok := p.states[websiteID]
 	if !ok || state.Files == nil {
 		return
@@ -369,6 +417,8 @@ func (p *LogParser) recordParsedHourBuckets(websiteID string, buckets map[int64]
 	if len(buckets) == 0 {
 		return
 	}
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	state := p.ensureWebsiteState(websiteID)
 	if state.ParsedHourBuckets == nil {
 		state.ParsedHourBuckets = make(map[int64]bool)
@@ -380,6 +430,8 @@ func (p *LogParser) recordParsedHourBuckets(websiteID string, buckets map[int64]
 }
 
 func (p *LogParser) getTargetState(websiteID, targetKey string) (TargetState, bool) {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	state, ok := p.states[websiteID]
 	if !ok || state.Targets == nil {
 		return TargetState{}, false
@@ -389,12 +441,16 @@ func (p *LogParser) getTargetState(websiteID, targetKey string) (TargetState, bo
 }
 
 func (p *LogParser) setTargetState(websiteID, targetKey string, targetState TargetState) {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	state := p.ensureWebsiteState(websiteID)
 	state.Targets[targetKey] = targetState
 	p.states[websiteID] = state
 }
 
 func (p *LogParser) deleteTargetState(websiteID, targetKey string) {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	state, ok := p.states[websiteID]
 	if !ok || state.Targets == nil {
 		return
@@ -404,6 +460,8 @@ func (p *LogParser) deleteTargetState(websiteID, targetKey string) {
 }
 
 func (p *LogParser) refreshWebsiteRanges(websiteID string) {
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	state, ok := p.states[websiteID]
 	if !ok || (state.Files == nil && state.Targets == nil) {
 		return
@@ -509,10 +567,19 @@ func (p *LogParser) refreshWebsiteRanges(websiteID string) {
 		BackfillPending:        backfillPending,
 		BackfillTotalBytes:     backfillTotalBytes,
 		BackfillProcessedBytes: backfillProcessedBytes,
-		ParsedHourBuckets:      state.ParsedHourBuckets,
+		ParsedHourBuckets:      copyHourBuckets(state.ParsedHourBuckets),
 	})
 }
 
+// copyHourBuckets 发布给状态查询的小时桶副本，避免与后续扫描并发读写同一个 map
+func copyHourBuckets(buckets map[int64]bool) map[int64]bool {
+	copied := make(map[int64]bool, len(buckets))
+	for bucket, parsed := range buckets {
+		copied[bucket] = parsed
+	}
+	return copied
+}
+
 func computeBackfillBytes(done bool, backfillEnd, backfillOffset, lastSize int64) (int64, int64) {
 	if done {
 		total := backfillEnd
@@ -598,6 +665,7 @@ func (p *LogParser) ScanNginxLogsForWebsite(websiteID string) []ParserResult {
 
 // ResetScanState 重置日志扫描状态
 func (p *LogParser) ResetScanState(websiteID string) {
+	p.stateMu.Lock()
 	if websiteID == "" {
 		p.states = make(map[string]LogScanState)
 		ResetWebsiteParseStatus("")
@@ -605,6 +673,7 @@ func (p *LogParser) ResetScanState(websiteID string) {
 		delete(p.states, websiteID)
 		ResetWebsiteParseStatus(websiteID)
 	}
+	p.stateMu.Unlock()
 	p.updateState()
 }
 
@@ -635,6 +704,7 @@ func (p *LogParser) TriggerReparse(websiteID string) error {
 		ids = []string{websiteID}
 	}
 
+	p.reparseMu.Lock()
 	var err error
 	if websiteID == "" {
 		err = p.repo.ClearAllLogs()
@@ -642,11 +712,13 @@ func (p *LogParser) TriggerReparse(websiteID string) error {
 		err = p.repo.ClearLogsForWebsite(websiteID)
 	}
 	if err != nil {
+		p.reparseMu.Unlock()
 		finishIPParsing()
 		return err
 	}
 
 	p.ResetScanState(websiteID)
+	p.reparseMu.Unlock()
 
 	go func() {
 		defer finishIPParsing()
@@ -658,54 +730,7 @@ func (p *LogParser) TriggerReparse(websiteID string) error {
 
 func (p *LogParser) scanNginxLogsInternal(websiteIDs []string) []ParserResult {
 	setParsingTotalBytes(p.calculateTotalBytesToScan(websiteIDs))
-	parserResults := make([]ParserResult, len(websiteIDs))
-
-	for i, id := range websiteIDs {
-		startTime := time.Now()
-
-		website, _ := config.GetWebsiteByID(id)
-		parserResult := EmptyParserResult(website.Name, id)
-		p.markInitialParsed(id)
-		if len(website.Sources) > 0 {
-			p.scanSources(id, website, &parserResult)
-		} else {
-			if _, err := p.getLineParser(id); err != nil {
-				parserResult.Success = false
-				parserResult.Error = err
-				p.notifyLogParsing(id, "", "日志解析配置", err)
-				parserResults[i] = parserResult
-				continue
-			}
-
-			logPath := website.LogPath
-			if strings.Contains(logPath, "*") {
-				matches, err := filepath.Glob(logPath)
-				if err != nil {
-					errstr := "解析日志路径模式 " + logPath + " 失败: " + err.Error()
-					parserResult.Success = false
-					parserResult.Error = errors.New(errstr)
-					p.notifyLogParsing(id, logPath, "解析日志路径模式", err)
-				} else if len(matches) == 0 {
-					errstr := "日志路径模式 " + logPath + " 未匹配到任何文件"
-					parserResult.Success = false
-					parserResult.Error = errors.New(errstr)
-					p.notifyLogParsing(id, logPath, "日志路径未匹配到文件", errors.New(errstr))
-				} else {
-					for _, matchPath := range matches {
-						p.scanSingleFile(id, matchPath, &parserResult)
-					}
-				}
-			} else {
-				p.scanSingleFile(id, logPath, &parserResult)
-			}
-		}
-
-		p.refreshWebsiteRanges(id)
-		p.updateState()
-		parserResult.Duration = time.Since(startTime)
-		parserResults[i] = parserResult
-	}
-
+	parserResults := p.runScanPool(websiteIDs)
 	p.updateState()
 
 	return parserResults
@@ -860,7 +885,7 @@ func (p *LogParser) scanSingleFile(
 				if _, err := file.Seek(0, 0); err == nil {
 					if gzReader, err := gzip.NewReader(file); err == nil {
 						entriesCount, _, minTs, maxTs := p.parseLogLines(
-							gzReader, websiteID, "", parserResult, parseWindow{minTs: cutoffTs},
+							gzReader, websiteID, "", parserResult, parseWindow{minTs: cutoffTs, bulk: true},
 						)
 						gzReader.Close()
 						p.updateParsedRange(&fileState, minTs, maxTs)
@@ -914,7 +939,7 @@ func (p *LogParser) scanSingleFile(
 				p.notifyFileIO(websiteID, logPath, "设置文件读取位置", err)
 			} else {
 				entriesCount, _, minTs, maxTs := p.parseLogLines(
-					file, websiteID, "", parserResult, parseWindow{minTs: cutoffTs},
+					file, websiteID, "", parserResult, parseWindow{minTs: cutoffTs, bulk: true},
 				)
 				p.updateParsedRange(&fileState, minTs, maxTs)
 				if maxTs > fileState.LastTimestamp {
@@ -1012,6 +1037,8 @@ func (p *LogParser) scanSingleFile(
 func (p *LogParser) determineStartOffset(
 	websiteID string, filePath string, currentSize int64) int64 {
 
+	p.stateMu.Lock()
+	defer p.stateMu.Unlock()
 	state, ok := p.states[websiteID]
 	if !ok { // 网站没有扫描记录，创建新状态
 		p.states[websiteID] = LogScanState{
@@ -1210,10 +1237,44 @@ func (p *LogParser) findRecentOffset(
 	return 0, lastTs, nil
 }
 
+// batchSizeFor 返回每批写入的条数；批量写入时不小于 bulkParseBatchSize
+func (p *LogParser) batchSizeFor(bulk bool) int {
+	if bulk && p.parseBatchSize < bulkParseBatchSize {
+		return bulkParseBatchSize
+	}
+	return p.parseBatchSize
+}
+
+// insertBatch 写入一批日志；bulk 时走 COPY 批量写入
+func (p *LogParser) insertBatch(websiteID string, batch []store.NginxLogRecord, bulk bool) error {
+	if bulk {
+		return p.repo.BulkInsertLogsForWebsite(websiteID, batch)
+	}
+	return p.repo.BatchInsertLogsForWebsite(websiteID, batch)
+}
+
 // parseLogLines 解析日志行并返回解析的记录数
 func (p *LogParser) parseLogLines(
 	reader io.Reader, websiteID, sourceID string, parserResult *ParserResult, window parseWindow) (int, int64, int64, int64) {
+	entries, totalBytes, _, minTs, maxTs := p.parseDecodedLines(reader, nil, websiteID, sourceID, parserResult, window)
+	return entries, totalBytes, minTs, maxTs
+}
+
+// parseDecodedLines 同 parseLogLines；decoder 不为空时先解开容器/journald 封装再解析。
+// 此时只读取以换行结尾的完整原始行，保留 \r 等原始字节，未结束的末行留到下次读取。
+// 额外返回 settled：decoder 最后一次没有缓存分片或未结束条目时已读取的字节数，
+// 从该位置用新的解码器重新读取不会丢失内容；整段读取中都有缓存时为 -1
+func (p *LogParser) parseDecodedLines(
+	reader io.Reader, decoder envelope.Decoder, websiteID, sourceID string, parserResult *ParserResult, window parseWindow,
+) (int, int64, int64, int64, int64) {
 	scanner := bufio.NewScanner(reader)
+	settled := int64(-1)
+	if decoder != nil {
+		scanner.Split(scanRawLines)
+		if !decoder.Pending() {
+			settled = 0
+		}
+	}
 	entriesCount := 0
 	var minTs int64
 	var maxTs int64
@@ -1222,7 +1283,8 @@ func (p *LogParser) parseLogLines(
 	var batchWhitelistHits map[string]*whitelistHit
 
 	// 批量插入相关
-	batch := make([]store.NginxLogRecord, 0, p.parseBatchSize)
+	batchSize := p.batchSizeFor(window.bulk)
+	batch := make([]store.NginxLogRecord, 0, batchSize)
 
 	// 处理一批数据
 	processBatch := func() {
@@ -1233,11 +1295,12 @@ func (p *LogParser) parseLogLines(
 		// 先把本批次 location 标记为“待解析”，确保日志落库后前端可见；
 		// 再在日志成功落库后写入 ip_geo_pending，避免“先入队、后落库”导致回填命中空 ip_id 后把队列误删。
 		p.markBatchIPGeoPending(batch)
-		if err := p.repo.BatchInsertLogsForWebsite(websiteID, batch); err != nil {
+		if err := p.insertBatch(websiteID, batch, window.bulk); err != nil {
 			logrus.Errorf("批量插入网站 %s 的日志记录失败: %v", websiteID, err)
 			p.notifyDatabaseWrite(websiteID, "写入日志批次", err)
 		} else {
 			p.enqueueBatchIPGeo(batch)
+			p.publishTail(websiteID, batch)
 			whitelistHits = mergeWhitelistHits(whitelistHits, batchWhitelistHits)
 		}
 
@@ -1252,12 +1315,27 @@ func (p *LogParser) parseLogLines(
 	for scanner.Scan() {
 		line := scanner.Text()
 		lineBytes := int64(len(line) + 1)
+		if decoder != nil {
+			// scanRawLines 的结果带有结尾换行
+			lineBytes = int64(len(line))
+			line = line[:len(line)-1]
+		}
 		pendingBytes += lineBytes
 		totalBytes += lineBytes
 		if pendingBytes >= progressChunk {
 			addParsingProgress(pendingBytes)
 			pendingBytes = 0
 		}
+		if decoder != nil {
+			decoded, ok := decoder.Decode(line)
+			if !decoder.Pending() {
+				settled = totalBytes
+			}
+			if !ok {
+				continue
+			}
+			line = decoded
+		}
 
 		entry, err := p.parseLogLine(websiteID, sourceID, line)
 		if err != nil {
@@ -1284,7 +1362,7 @@ func (p *LogParser) parseLogLines(
 		entriesCount++
 		parserResult.TotalEntries++ // 累加到总结果中，而非赋值
 
-		if len(batch) >= p.parseBatchSize {
+		if len(batch) >= batchSize {
 			processBatch()
 		}
 	}
@@ -1301,19 +1379,67 @@ func (p *LogParser) parseLogLines(
 	p.flushWhitelistHits(whitelistHits)
 
 	p.recordParsedHourBuckets(websiteID, parsedBuckets)
-	return entriesCount, totalBytes, minTs, maxTs // 返回当前文件的日志条数
+	if decoder == nil {
+		settled = totalBytes
+	}
+	return entriesCount, totalBytes, settled, minTs, maxTs // 返回当前文件的日志条数
+}
+
+// scanRawLines 按 \n 切分且保留结尾换行与 \r；末尾没有换行的半行不返回
+func scanRawLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF {
+		// 丢弃未结束的半行，调用方不计入读取位置，下次从行首重新读取
+		return len(data), nil, nil
+	}
+	return 0, nil, nil
 }
 
 // IngestLines parses and inserts streamed log lines for a website/source.
-func (p *LogParser) IngestLines(websiteID, sourceID string, lines []string) (int, int, error) {
+// sampleRates 与 lines 一一对应（可为空），为 agent 采样时每行代表的请求数。
+func (p *LogParser) IngestLines(websiteID, sourceID string, lines []string, sampleRates []int) (int, int, error) {
+	accepted, deduped, _, err := p.ingestLines(websiteID, sourceID, lines, sampleRates, ingestOptions{})
+	return accepted, deduped, err
+}
+
+// IngestAgentBatch 写入带序号的 agent 批次：整批在同一事务内入库并推进确认序号，
+// 依靠序号而不是去重缓存保证重试时只入库一次；重发的批次返回 duplicate=true
+func (p *LogParser) IngestAgentBatch(
+	websiteID, sourceID string, lines []string, sampleRates []int, ack store.AgentAck,
+) (int, bool, error) {
+	accepted, _, duplicate, err := p.ingestLines(websiteID, sourceID, lines, sampleRates, ingestOptions{ack: &ack, atomic: true})
+	return accepted, duplicate, err
+}
+
+// GetAgentAck 返回 agent 已确认的序号与文件位置，agent 启动时据此续传
+func (p *LogParser) GetAgentAck(agentID, websiteID string) (store.AgentAck, error) {
+	return p.repo.GetAgentAck(agentID, websiteID)
+}
+
+// ingestOptions 流式写入方式
+type ingestOptions struct {
+	ack *store.AgentAck // 非空时与确认序号在同一事务内写入
+	// atomic 整批在一个事务内写入且不经过去重缓存：由调用方保证重试不重复（agent 序号），
+	// 或入库成功后才提交位点（消息队列），失败重投的行不能被去重缓存拦下
+	atomic bool
+	// records 与 lines 一一对应，非空的项已组装好（OTLP 语义约定属性），不再按行解析
+	records []*store.NginxLogRecord
+}
+
+func (p *LogParser) ingestLines(
+	websiteID, sourceID string, lines []string, sampleRates []int, opts ingestOptions,
+) (int, int, bool, error) {
+	ack := opts.ack
 	if websiteID == "" {
-		return 0, 0, errors.New("websiteID 不能为空")
+		return 0, 0, false, errors.New("websiteID 不能为空")
 	}
 	if len(lines) == 0 {
-		return 0, 0, nil
+		return 0, 0, false, nil
 	}
 	if _, err := p.getLineParserForSource(websiteID, sourceID); err != nil {
-		return 0, 0, err
+		return 0, 0, false, err
 	}
 
 	batch := make([]store.NginxLogRecord, 0, p.parseBatchSize)
@@ -1326,31 +1452,52 @@ func (p *LogParser) IngestLines(websiteID, sourceID string, lines []string) (int
 	var batchWhitelistHits map[string]*whitelistHit
 
 	processBatch := func() error {
-		if len(batch) == 0 {
+		if len(batch) == 0 && ack == nil {
 			return nil
 		}
 		// 先标记 location 为“待解析”，再在成功落库后写入 ip_geo_pending（避免竞态导致“待解析”长期不变）
 		p.markBatchIPGeoPending(batch)
-		if err := p.repo.BatchInsertLogsForWebsite(websiteID, batch); err != nil {
-			p.notifyDatabaseWrite(websiteID, "写入日志批次", err)
+		var err error
+		if ack != nil {
+			err = p.repo.BatchInsertLogsWithAck(websiteID, batch, *ack)
+		} else {
+			err = p.repo.BatchInsertLogsForWebsite(websiteID, batch)
+		}
+		if err != nil {
+			if !errors.Is(err, store.ErrDuplicateBatch) {
+				p.notifyDatabaseWrite(websiteID, "写入日志批次", err)
+			}
 			return err
 		}
 		p.enqueueBatchIPGeo(batch)
+		p.publishTail(websiteID, batch)
 		whitelistHits = mergeWhitelistHits(whitelistHits, batchWhitelistHits)
 		batch = batch[:0]
 		batchWhitelistHits = nil
 		return nil
 	}
 
-	for _, line := range lines {
-		entry, err := p.parseLogLine(websiteID, sourceID, line)
-		if err != nil {
-			continue
+	for i, line := range lines {
+		var entry *store.NginxLogRecord
+		if i < len(opts.records) && opts.records[i] != nil {
+			entry = opts.records[i]
+			p.normalizeRecordURL(websiteID, entry)
+		} else {
+			parsed, err := p.parseLogLine(websiteID, sourceID, line)
+			if err != nil {
+				continue
+			}
+			entry = parsed
 		}
-		key := buildDedupKey(websiteID, sourceID, line)
-		if p.dedup != nil && p.dedup.Seen(key) {
-			deduped++
-			continue
+		if i < len(sampleRates) && sampleRates[i] > 1 {
+			entry.SampleRate = sampleRates[i]
+		}
+		if !opts.atomic {
+			key := buildDedupKey(websiteID, sourceID, line)
+			if p.dedup != nil && p.dedup.Seen(key) {
+				deduped++
+				continue
+			}
 		}
 		if matcher := p.whitelistMatchers[websiteID]; matcher != nil && matcher.Enabled() {
 			if match, ok := matcher.Match(entry.IP); ok {
@@ -1369,15 +1516,19 @@ func (p *LogParser) IngestLines(websiteID, sourceID string, lines []string) (int
 			maxTs = ts
 		}
 
-		if len(batch) >= p.parseBatchSize {
+		// agent 与消息队列批次需要整批在一个事务内确认，不拆分
+		if !opts.atomic && len(batch) >= p.parseBatchSize {
 			if err := processBatch(); err != nil {
-				return accepted, deduped, err
+				return accepted, deduped, false, err
 			}
 		}
 	}
 
 	if err := processBatch(); err != nil {
-		return accepted, deduped, err
+		if errors.Is(err, store.ErrDuplicateBatch) {
+			return 0, 0, true, nil
+		}
+		return accepted, deduped, false, err
 	}
 	p.flushWhitelistHits(whitelistHits)
 
@@ -1395,7 +1546,7 @@ func (p *LogParser) IngestLines(websiteID, sourceID string, lines []string) (int
 		p.updateState()
 	}
 
-	return accepted, deduped, nil
+	return accepted, deduped, false, nil
 }
 
 func buildDedupKey(websiteID, sourceID, line string) string {
@@ -1509,6 +1660,8 @@ func (p *LogParser) getLineParserForSource(websiteID, sourceID string) (*logLine
 	if sourceID != "" {
 		key = websiteID + ":" + sourceID
 	}
+	p.lineParserMu.Lock()
+	defer p.lineParserMu.Unlock()
 	if parser, ok := p.lineParsers[key]; ok {
 		return parser, nil
 	}
@@ -1777,12 +1930,32 @@ func (p *LogParser) parseLogLine(websiteID, sourceID string, line string) (*stor
 		return nil, err
 	}
 
-	switch parser.parseType {
-	case parseTypeCaddyJSON:
+	record, err := p.parseWithParser(parser, line)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRetention(websiteID, record.Timestamp); err != nil {
+		return nil, err
+	}
+	p.normalizeRecordURL(websiteID, record)
+	return record, nil
+}
+
+// parseWithParser 按解析配置解析单行，不做保留期检查与 URL 归一化
+func (p *LogParser) parseWithParser(parser *logLineParser, line string) (*store.NginxLogRecord, error) {
+	if parser.parseType == parseTypeCaddyJSON {
 		return p.parseCaddyJSONLine(line, parser)
-	default:
-		return p.parseRegexLogLine(parser, line)
 	}
+	return p.parseRegexLogLine(parser, line)
+}
+
+// checkRetention 早于站点原始日志保留期的记录不再入库
+func checkRetention(websiteID string, timestamp time.Time) error {
+	rawDays := config.RetentionForWebsite(websiteID).RawDays
+	if timestamp.Before(time.Now().AddDate(0, 0, -rawDays)) {
+		return errors.New("日志超过保留天数")
+	}
+	return nil
 }
 
 func (p *LogParser) parseLogTimestamp(parser *logLineParser, line string) (time.Time, error) {
@@ -1920,11 +2093,6 @@ func (p *LogParser) buildLogRecord(
 		return nil, errors.New("日志缺少状态码")
 	}
 
-	cutoffTime := time.Now().AddDate(0, 0, -p.retentionDays)
-	if timestamp.Before(cutoffTime) {
-		return nil, errors.New("日志超过保留天数")
-	}
-
 	decodedPath, err := url.QueryUnescape(urlValue)
 	if err != nil {
 		decodedPath = urlValue
@@ -1937,12 +2105,14 @@ func (p *LogParser) buildLogRecord(
 		}
 	}
 
+	rawUserAgent := userAgent
 	if userAgent == "" {
 		userAgent = "-"
 	}
 
 	pageviewFlag := enrich.ShouldCountAsPageView(statusCode, decodedPath, ip)
 	browser, os, device := enrich.ParseUserAgent(userAgent)
+	refererInfo := enrich.ClassifyReferer(referPath)
 
 	return &store.NginxLogRecord{
 		ID:               0,
@@ -1954,9 +2124,14 @@ func (p *LogParser) buildLogRecord(
 		Status:           statusCode,
 		BytesSent:        bytesSent,
 		Referer:          referPath,
+		RefererHost:      refererInfo.Host,
+		RefererChannel:   refererInfo.Channel,
+		RefererSource:    refererInfo.Source,
+		RefererKeyword:   refererInfo.Keyword,
 		UserBrowser:      browser,
 		UserOs:           os,
 		UserDevice:       device,
+		UserAgent:        rawUserAgent,
 		DomesticLocation: "",
 		GlobalLocation:   "",
 	}, nil
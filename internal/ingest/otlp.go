@@ -0,0 +1,327 @@
+package ingest
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/store"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+)
+
+const (
+	otlpDefaultSourceID = "otlp"
+	// otlpSourceAttribute 资源或日志属性中指定来源 ID，用于按来源覆盖解析配置
+	otlpSourceAttribute = "nginxpulse.source.id"
+)
+
+// defaultOTLPWebsiteAttributes 未配置 websiteAttributes 时依次查找的资源属性
+var defaultOTLPWebsiteAttributes = []string{"nginxpulse.website.id", "service.name", "host.name"}
+
+// OTLP HTTP 语义约定属性，新旧命名依次查找
+var (
+	otlpMethodKeys    = []string{"http.request.method", "http.method"}
+	otlpStatusKeys    = []string{"http.response.status_code", "http.status_code"}
+	otlpTargetKeys    = []string{"http.target"}
+	otlpFullURLKeys   = []string{"url.full", "http.url"}
+	otlpClientIPKeys  = []string{"client.address", "http.client_ip", "source.address", "net.peer.ip", "network.peer.address"}
+	otlpUserAgentKeys = []string{"user_agent.original", "http.user_agent"}
+	otlpRefererKeys   = []string{"http.request.header.referer", "http.referer"}
+	otlpBytesKeys     = []string{"http.response.body.size", "http.response_content_length"}
+)
+
+// OTLPResult 一次 OTLP 导出请求的处理结果；Rejected 对应 OTLP partial_success 中的 rejected_log_records
+type OTLPResult struct {
+	Accepted int
+	Deduped  int
+	Rejected int
+	Message  string // 首个拒绝原因
+}
+
+// otlpGroup 同一站点、同一来源的日志，按一个流式批次入库
+type otlpGroup struct {
+	websiteID string
+	sourceID  string
+	lines     []string
+	records   []*store.NginxLogRecord
+}
+
+// IngestOTLPLogs 将 OTLP 日志写入对应站点：日志属性符合 HTTP 语义约定时直接组装记录，
+// 否则把字符串 body 当作一行 nginx 日志按站点（或来源）的日志格式解析
+func (p *LogParser) IngestOTLPLogs(req *collogspb.ExportLogsServiceRequest) (OTLPResult, error) {
+	var result OTLPResult
+	if req == nil {
+		return result, nil
+	}
+	resolver := newOTLPWebsiteResolver(config.ReadConfig().System.OTLP)
+
+	reject := func(reason string) {
+		result.Rejected++
+		if result.Message == "" {
+			result.Message = reason
+		}
+	}
+
+	groups := make(map[string]*otlpGroup)
+	var order []string
+	for _, resourceLogs := range req.GetResourceLogs() {
+		resourceAttrs := otlpAttributes(resourceLogs.GetResource().GetAttributes())
+		for _, scopeLogs := range resourceLogs.GetScopeLogs() {
+			for _, logRecord := range scopeLogs.GetLogRecords() {
+				attrs := otlpRecordAttributes(logRecord)
+				websiteID, ok := resolver.resolve(attrs, resourceAttrs)
+				if !ok {
+					reject("无法确定日志所属站点")
+					continue
+				}
+				sourceID := otlpDefaultSourceID
+				if value := otlpString(otlpSourceAttribute, attrs, resourceAttrs); value != "" {
+					sourceID = value
+				}
+
+				line, record, err := p.buildOTLPEntry(websiteID, logRecord, attrs)
+				if err != nil {
+					reject(err.Error())
+					continue
+				}
+
+				key := websiteID + "\x00" + sourceID
+				group := groups[key]
+				if group == nil {
+					group = &otlpGroup{websiteID: websiteID, sourceID: sourceID}
+					groups[key] = group
+					order = append(order, key)
+				}
+				group.lines = append(group.lines, line)
+				group.records = append(group.records, record)
+			}
+		}
+	}
+
+	for _, key := range order {
+		group := groups[key]
+		accepted, deduped, _, err := p.ingestLines(
+			group.websiteID, group.sourceID, group.lines, nil, ingestOptions{records: group.records},
+		)
+		result.Accepted += accepted
+		result.Deduped += deduped
+		if err != nil {
+			return result, err
+		}
+		if skipped := len(group.lines) - accepted - deduped; skipped > 0 {
+			result.Rejected += skipped
+			if result.Message == "" {
+				result.Message = "日志格式无法解析"
+			}
+		}
+	}
+	return result, nil
+}
+
+// buildOTLPEntry 返回用于去重的行内容与已组装的记录；record 为 nil 时按行解析
+func (p *LogParser) buildOTLPEntry(
+	websiteID string, logRecord *logspb.LogRecord, attrs map[string]*commonpb.AnyValue,
+) (string, *store.NginxLogRecord, error) {
+	method := otlpFirstString(otlpMethodKeys, attrs)
+	if method == "" {
+		line := strings.TrimSpace(logRecord.GetBody().GetStringValue())
+		if line == "" {
+			return "", nil, fmt.Errorf("日志缺少 body 与 HTTP 属性")
+		}
+		return line, nil, nil
+	}
+
+	timestamp := otlpTimestamp(logRecord)
+	requestURL := otlpRequestURL(attrs)
+	ip := otlpFirstString(otlpClientIPKeys, attrs)
+	status := otlpFirstInt(otlpStatusKeys, attrs)
+	bytesSent := otlpFirstInt(otlpBytesKeys, attrs)
+	referer := otlpFirstString(otlpRefererKeys, attrs)
+	userAgent := otlpFirstString(otlpUserAgentKeys, attrs)
+
+	record, err := p.buildLogRecord(
+		ip, strings.ToUpper(method), requestURL, referer, userAgent, status, bytesSent, timestamp,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := checkRetention(websiteID, record.Timestamp); err != nil {
+		return "", nil, err
+	}
+	// 属性组装的记录没有原始行，拼出等价内容供去重缓存使用
+	line := fmt.Sprintf("otlp %d %s %s %s %d %d %q %q",
+		timestamp.UnixNano(), ip, method, requestURL, status, bytesSent, referer, userAgent)
+	return line, record, nil
+}
+
+// otlpWebsiteResolver 按资源属性确定站点：先查 websites 映射，再按站点 ID、站点名称匹配，最后使用默认站点
+type otlpWebsiteResolver struct {
+	attributes     []string
+	mapping        map[string]string
+	byName         map[string]string
+	defaultWebsite string
+}
+
+func newOTLPWebsiteResolver(cfg *config.OTLPConfig) *otlpWebsiteResolver {
+	resolver := &otlpWebsiteResolver{
+		attributes: defaultOTLPWebsiteAttributes,
+		byName:     make(map[string]string),
+	}
+	if cfg != nil {
+		if len(cfg.WebsiteAttributes) > 0 {
+			resolver.attributes = cfg.WebsiteAttributes
+		}
+		resolver.mapping = cfg.Websites
+		resolver.defaultWebsite = strings.TrimSpace(cfg.DefaultWebsite)
+	}
+	for _, id := range config.GetAllWebsiteIDs() {
+		if site, ok := config.GetWebsiteByID(id); ok {
+			resolver.byName[strings.TrimSpace(site.Name)] = id
+		}
+	}
+	return resolver
+}
+
+func (r *otlpWebsiteResolver) resolve(attrs, resourceAttrs map[string]*commonpb.AnyValue) (string, bool) {
+	for _, name := range r.attributes {
+		value := otlpString(name, attrs, resourceAttrs)
+		if value == "" {
+			continue
+		}
+		if id, ok := r.mapping[value]; ok {
+			return id, true
+		}
+		if _, ok := config.GetWebsiteByID(value); ok {
+			return value, true
+		}
+		if id, ok := r.byName[value]; ok {
+			return id, true
+		}
+	}
+	if r.defaultWebsite != "" {
+		if _, ok := config.GetWebsiteByID(r.defaultWebsite); ok {
+			return r.defaultWebsite, true
+		}
+	}
+	return "", false
+}
+
+// otlpRecordAttributes 合并日志属性；body 为 kvlist 时展开为属性（嵌套键以 . 连接），日志属性优先
+func otlpRecordAttributes(logRecord *logspb.LogRecord) map[string]*commonpb.AnyValue {
+	attrs := make(map[string]*commonpb.AnyValue)
+	if kvlist := logRecord.GetBody().GetKvlistValue(); kvlist != nil {
+		flattenOTLPAttributes("", kvlist.GetValues(), attrs)
+	}
+	for _, kv := range logRecord.GetAttributes() {
+		attrs[kv.GetKey()] = kv.GetValue()
+	}
+	return attrs
+}
+
+func flattenOTLPAttributes(prefix string, values []*commonpb.KeyValue, out map[string]*commonpb.AnyValue) {
+	for _, kv := range values {
+		key := kv.GetKey()
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if nested := kv.GetValue().GetKvlistValue(); nested != nil {
+			flattenOTLPAttributes(key, nested.GetValues(), out)
+			continue
+		}
+		out[key] = kv.GetValue()
+	}
+}
+
+func otlpAttributes(values []*commonpb.KeyValue) map[string]*commonpb.AnyValue {
+	attrs := make(map[string]*commonpb.AnyValue, len(values))
+	for _, kv := range values {
+		attrs[kv.GetKey()] = kv.GetValue()
+	}
+	return attrs
+}
+
+// otlpString 依次在多组属性中查找 key，返回其字符串形式
+func otlpString(key string, sets ...map[string]*commonpb.AnyValue) string {
+	for _, attrs := range sets {
+		value, ok := attrs[key]
+		if !ok || value == nil {
+			continue
+		}
+		switch v := value.GetValue().(type) {
+		case *commonpb.AnyValue_StringValue:
+			if text := strings.TrimSpace(v.StringValue); text != "" {
+				return text
+			}
+		case *commonpb.AnyValue_IntValue:
+			return strconv.FormatInt(v.IntValue, 10)
+		case *commonpb.AnyValue_DoubleValue:
+			return strconv.FormatFloat(v.DoubleValue, 'f', -1, 64)
+		case *commonpb.AnyValue_ArrayValue:
+			// http.request.header.* 按约定为字符串数组
+			if items := v.ArrayValue.GetValues(); len(items) > 0 {
+				if text := strings.TrimSpace(items[0].GetStringValue()); text != "" {
+					return text
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func otlpFirstString(keys []string, attrs map[string]*commonpb.AnyValue) string {
+	for _, key := range keys {
+		if value := otlpString(key, attrs); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func otlpFirstInt(keys []string, attrs map[string]*commonpb.AnyValue) int {
+	for _, key := range keys {
+		value := otlpString(key, attrs)
+		if value == "" {
+			continue
+		}
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			return int(number)
+		}
+	}
+	return 0
+}
+
+// otlpRequestURL 优先使用 url.path + url.query，其次 http.target，最后从完整 URL 中取路径
+func otlpRequestURL(attrs map[string]*commonpb.AnyValue) string {
+	if path := otlpString("url.path", attrs); path != "" {
+		if query := otlpString("url.query", attrs); query != "" {
+			return path + "?" + query
+		}
+		return path
+	}
+	if target := otlpFirstString(otlpTargetKeys, attrs); target != "" {
+		return target
+	}
+	if full := otlpFirstString(otlpFullURLKeys, attrs); full != "" {
+		if parsed, err := url.Parse(full); err == nil {
+			return parsed.RequestURI()
+		}
+		return full
+	}
+	return ""
+}
+
+// otlpTimestamp 优先使用事件时间，未设置时使用采集时间
+func otlpTimestamp(logRecord *logspb.LogRecord) time.Time {
+	if ts := logRecord.GetTimeUnixNano(); ts > 0 {
+		return time.Unix(0, int64(ts))
+	}
+	if ts := logRecord.GetObservedTimeUnixNano(); ts > 0 {
+		return time.Unix(0, int64(ts))
+	}
+	return time.Now()
+}
@@ -0,0 +1,335 @@
+package ingest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+func otlpStr(value string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}
+}
+
+func otlpInt(value int64) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}
+}
+
+func otlpKV(key string, value *commonpb.AnyValue) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: value}
+}
+
+func otlpKVList(values ...*commonpb.KeyValue) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: values}}}
+}
+
+func otlpAttrs(values ...*commonpb.KeyValue) map[string]*commonpb.AnyValue {
+	return otlpAttributes(values)
+}
+
+func TestBuildOTLPEntry(t *testing.T) {
+	websiteID := testWebsiteID(t, "otlp-test")
+	ts := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+
+	type want struct {
+		ip, method, url, referer string
+		status, bytes            int
+	}
+	tests := []struct {
+		name     string
+		record   *logspb.LogRecord
+		wantLine string // 非空时应按 body 原样返回，不组装记录
+		want     want
+		wantErr  bool
+	}{
+		{
+			name: "new semconv",
+			record: &logspb.LogRecord{
+				TimeUnixNano: uint64(ts.UnixNano()),
+				Attributes: []*commonpb.KeyValue{
+					otlpKV("http.request.method", otlpStr("get")),
+					otlpKV("http.response.status_code", otlpInt(200)),
+					otlpKV("url.path", otlpStr("/a")),
+					otlpKV("url.query", otlpStr("q=1")),
+					otlpKV("client.address", otlpStr("1.2.3.4")),
+					otlpKV("user_agent.original", otlpStr("curl/8.0")),
+					otlpKV("http.response.body.size", otlpInt(512)),
+					// http.request.header.* 为字符串数组，取第一个值
+					otlpKV("http.request.header.referer", &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{
+						ArrayValue: &commonpb.ArrayValue{Values: []*commonpb.AnyValue{otlpStr("https://example.org/"), otlpStr("ignored")}},
+					}}),
+				},
+			},
+			want: want{ip: "1.2.3.4", method: "GET", url: "/a?q=1", referer: "https://example.org/", status: 200, bytes: 512},
+		},
+		{
+			name: "old semconv",
+			record: &logspb.LogRecord{
+				ObservedTimeUnixNano: uint64(ts.UnixNano()),
+				Attributes: []*commonpb.KeyValue{
+					otlpKV("http.method", otlpStr("POST")),
+					otlpKV("http.status_code", otlpStr("404")),
+					otlpKV("http.target", otlpStr("/b?x=1")),
+					otlpKV("net.peer.ip", otlpStr("5.6.7.8")),
+					otlpKV("http.user_agent", otlpStr("curl/8.0")),
+					otlpKV("http.referer", otlpStr("https://example.com/")),
+					otlpKV("http.response_content_length", &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: 12}}),
+				},
+			},
+			want: want{ip: "5.6.7.8", method: "POST", url: "/b?x=1", referer: "https://example.com/", status: 404, bytes: 12},
+		},
+		{
+			name: "kvlist body",
+			record: &logspb.LogRecord{
+				TimeUnixNano: uint64(ts.UnixNano()),
+				Body: otlpKVList(
+					otlpKV("http", otlpKVList(
+						otlpKV("request", otlpKVList(otlpKV("method", otlpStr("GET")))),
+						otlpKV("response", otlpKVList(otlpKV("status_code", otlpInt(301)))),
+					)),
+					otlpKV("url", otlpKVList(otlpKV("full", otlpStr("https://example.com/c/d?e=f#top")))),
+					otlpKV("client.address", otlpStr("10.0.0.1")),
+				),
+				// 日志属性优先于 body 展开的同名属性
+				Attributes: []*commonpb.KeyValue{otlpKV("client.address", otlpStr("10.0.0.2"))},
+			},
+			want: want{ip: "10.0.0.2", method: "GET", url: "/c/d?e=f", status: 301},
+		},
+		{
+			name: "string body",
+			record: &logspb.LogRecord{
+				Body: otlpStr(`  1.2.3.4 - - [02/Jan/2024:03:04:05 +0000] "GET / HTTP/1.1" 200 1 "-" "-"` + "\n"),
+			},
+			wantLine: `1.2.3.4 - - [02/Jan/2024:03:04:05 +0000] "GET / HTTP/1.1" 200 1 "-" "-"`,
+		},
+		{
+			name:    "no body and no http attributes",
+			record:  &logspb.LogRecord{Attributes: []*commonpb.KeyValue{otlpKV("service.name", otlpStr("web"))}},
+			wantErr: true,
+		},
+		{
+			name: "missing status",
+			record: &logspb.LogRecord{
+				TimeUnixNano: uint64(ts.UnixNano()),
+				Attributes: []*commonpb.KeyValue{
+					otlpKV("http.request.method", otlpStr("GET")),
+					otlpKV("url.path", otlpStr("/")),
+					otlpKV("client.address", otlpStr("1.2.3.4")),
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "older than retention",
+			record: &logspb.LogRecord{
+				TimeUnixNano: uint64(time.Now().AddDate(0, 0, -40).UnixNano()),
+				Attributes: []*commonpb.KeyValue{
+					otlpKV("http.request.method", otlpStr("GET")),
+					otlpKV("http.response.status_code", otlpInt(200)),
+					otlpKV("url.path", otlpStr("/")),
+					otlpKV("client.address", otlpStr("1.2.3.4")),
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &LogParser{}
+			line, record, err := p.buildOTLPEntry(websiteID, tt.record, otlpRecordAttributes(tt.record))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildOTLPEntry error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if tt.wantLine != "" {
+				if line != tt.wantLine || record != nil {
+					t.Fatalf("buildOTLPEntry = %q, %+v; want body line %q without record", line, record, tt.wantLine)
+				}
+				return
+			}
+			if record == nil || line == "" {
+				t.Fatalf("buildOTLPEntry = %q, %v; want an assembled record", line, record)
+			}
+			got := want{
+				ip: record.IP, method: record.Method, url: record.Url, referer: record.Referer,
+				status: record.Status, bytes: record.BytesSent,
+			}
+			if got != tt.want {
+				t.Errorf("record = %+v, want %+v", got, tt.want)
+			}
+			if !record.Timestamp.Equal(ts) {
+				t.Errorf("timestamp = %v, want %v", record.Timestamp, ts)
+			}
+		})
+	}
+}
+
+func TestOTLPRequestURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs map[string]*commonpb.AnyValue
+		want  string
+	}{
+		{"path and query", otlpAttrs(otlpKV("url.path", otlpStr("/a")), otlpKV("url.query", otlpStr("q=1"))), "/a?q=1"},
+		{"path only", otlpAttrs(otlpKV("url.path", otlpStr("/a"))), "/a"},
+		{"path wins over target and full", otlpAttrs(
+			otlpKV("url.path", otlpStr("/a")),
+			otlpKV("http.target", otlpStr("/b")),
+			otlpKV("url.full", otlpStr("https://example.com/c")),
+		), "/a"},
+		{"target wins over full", otlpAttrs(
+			otlpKV("http.target", otlpStr("/b?x=1")),
+			otlpKV("url.full", otlpStr("https://example.com/c")),
+		), "/b?x=1"},
+		{"query without path ignored", otlpAttrs(
+			otlpKV("url.query", otlpStr("q=1")),
+			otlpKV("http.target", otlpStr("/b")),
+		), "/b"},
+		{"url.full", otlpAttrs(otlpKV("url.full", otlpStr("https://example.com/c/d?e=f#top"))), "/c/d?e=f"},
+		{"http.url", otlpAttrs(otlpKV("http.url", otlpStr("http://example.com"))), "/"},
+		{"unparsable full url", otlpAttrs(otlpKV("url.full", otlpStr("http://[::1"))), "http://[::1"},
+		{"none", otlpAttrs(otlpKV("http.request.method", otlpStr("GET"))), ""},
+	}
+	for _, tt := range tests {
+		if got := otlpRequestURL(tt.attrs); got != tt.want {
+			t.Errorf("%s: otlpRequestURL = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOTLPWebsiteResolver(t *testing.T) {
+	otlpID := testWebsiteID(t, "otlp-test")
+	importID := testWebsiteID(t, "import-test")
+	mapped := &config.OTLPConfig{
+		Websites:       map[string]string{"web-svc": otlpID},
+		DefaultWebsite: importID,
+	}
+
+	tests := []struct {
+		name     string
+		cfg      *config.OTLPConfig
+		attrs    map[string]*commonpb.AnyValue
+		resource map[string]*commonpb.AnyValue
+		want     string
+		wantOK   bool
+	}{
+		{
+			name:     "mapping",
+			cfg:      mapped,
+			resource: otlpAttrs(otlpKV("service.name", otlpStr("web-svc"))),
+			want:     otlpID,
+			wantOK:   true,
+		},
+		{
+			name:     "website id",
+			resource: otlpAttrs(otlpKV("nginxpulse.website.id", otlpStr(otlpID))),
+			want:     otlpID,
+			wantOK:   true,
+		},
+		{
+			name:     "website name",
+			resource: otlpAttrs(otlpKV("host.name", otlpStr("otlp-test"))),
+			want:     otlpID,
+			wantOK:   true,
+		},
+		{
+			name:     "record attribute before resource",
+			attrs:    otlpAttrs(otlpKV("service.name", otlpStr("import-test"))),
+			resource: otlpAttrs(otlpKV("service.name", otlpStr("otlp-test"))),
+			want:     importID,
+			wantOK:   true,
+		},
+		{
+			name:     "earlier attribute name wins",
+			resource: otlpAttrs(otlpKV("service.name", otlpStr("import-test")), otlpKV("host.name", otlpStr("otlp-test"))),
+			want:     importID,
+			wantOK:   true,
+		},
+		{
+			name:     "unknown value falls through to later attribute",
+			resource: otlpAttrs(otlpKV("service.name", otlpStr("unknown")), otlpKV("host.name", otlpStr("otlp-test"))),
+			want:     otlpID,
+			wantOK:   true,
+		},
+		{
+			name: "custom attributes",
+			cfg: &config.OTLPConfig{
+				WebsiteAttributes: []string{"k8s.namespace.name"},
+				Websites:          map[string]string{"shop": otlpID},
+			},
+			resource: otlpAttrs(otlpKV("k8s.namespace.name", otlpStr("shop")), otlpKV("host.name", otlpStr("import-test"))),
+			want:     otlpID,
+			wantOK:   true,
+		},
+		{
+			name:     "default website",
+			cfg:      mapped,
+			resource: otlpAttrs(otlpKV("service.name", otlpStr("unknown"))),
+			want:     importID,
+			wantOK:   true,
+		},
+		{
+			name:     "unknown default website",
+			cfg:      &config.OTLPConfig{DefaultWebsite: "missing"},
+			resource: otlpAttrs(otlpKV("service.name", otlpStr("unknown"))),
+		},
+		{
+			name:     "no match without default",
+			resource: otlpAttrs(otlpKV("service.name", otlpStr("unknown"))),
+		},
+	}
+	for _, tt := range tests {
+		got, ok := newOTLPWebsiteResolver(tt.cfg).resolve(tt.attrs, tt.resource)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: resolve = %q, %t; want %q, %t", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// TestIngestOTLPLogsRejected 无法确定站点或无法组装的日志计入 Rejected，Message 保留首个原因；
+// 全部被拒时不写入数据库
+func TestIngestOTLPLogsRejected(t *testing.T) {
+	websiteID := testWebsiteID(t, "otlp-test")
+	resourceLogs := func(resource *commonpb.KeyValue, records ...*logspb.LogRecord) *logspb.ResourceLogs {
+		return &logspb.ResourceLogs{
+			Resource:  &resourcepb.Resource{Attributes: []*commonpb.KeyValue{resource}},
+			ScopeLogs: []*logspb.ScopeLogs{{LogRecords: records}},
+		}
+	}
+	req := &collogspb.ExportLogsServiceRequest{ResourceLogs: []*logspb.ResourceLogs{
+		resourceLogs(otlpKV("service.name", otlpStr("unknown")),
+			&logspb.LogRecord{Body: otlpStr("GET /")},
+			&logspb.LogRecord{Body: otlpStr("GET /")},
+		),
+		resourceLogs(otlpKV("nginxpulse.website.id", otlpStr(websiteID)),
+			&logspb.LogRecord{},
+			&logspb.LogRecord{Attributes: []*commonpb.KeyValue{
+				otlpKV("http.request.method", otlpStr("GET")),
+				otlpKV("url.path", otlpStr("/")),
+				otlpKV("client.address", otlpStr("1.2.3.4")),
+			}},
+		),
+	}}
+
+	p := &LogParser{}
+	result, err := p.IngestOTLPLogs(req)
+	if err != nil {
+		t.Fatalf("IngestOTLPLogs: %v", err)
+	}
+	if result.Rejected != 4 || result.Accepted != 0 || result.Deduped != 0 {
+		t.Errorf("accepted/deduped/rejected = %d/%d/%d, want 0/0/4", result.Accepted, result.Deduped, result.Rejected)
+	}
+	if result.Message != "无法确定日志所属站点" {
+		t.Errorf("message = %q, want the first rejection reason", result.Message)
+	}
+
+	if result, err := p.IngestOTLPLogs(nil); err != nil || result != (OTLPResult{}) {
+		t.Errorf("IngestOTLPLogs(nil) = %+v, %v", result, err)
+	}
+}
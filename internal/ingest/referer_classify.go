@@ -0,0 +1,42 @@
+package ingest
+
+import (
+	"fmt"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/enrich"
+	"github.com/likaia/nginxpulse/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+func classifyRefererForStore(referer string) store.RefererClass {
+	info := enrich.ClassifyReferer(referer)
+	return store.RefererClass{
+		Host:    info.Host,
+		Channel: info.Channel,
+		Source:  info.Source,
+		Keyword: info.Keyword,
+	}
+}
+
+// ClassifyPendingReferers 为升级前入库、尚未分类的来源维表行补齐分类，返回处理的行数
+func (p *LogParser) ClassifyPendingReferers() int {
+	total := 0
+	for _, websiteID := range config.GetAllWebsiteIDs() {
+		count, err := p.repo.ClassifyReferers(websiteID, classifyRefererForStore, true)
+		if err != nil {
+			logrus.WithError(err).Warnf("网站 %s 来源分类回填失败", websiteID)
+			continue
+		}
+		total += count
+	}
+	return total
+}
+
+// ReclassifyReferers 使用当前来源库重新分类指定网站的全部来源
+func (p *LogParser) ReclassifyReferers(websiteID string) (int, error) {
+	if _, ok := config.GetWebsiteByID(websiteID); !ok {
+		return 0, fmt.Errorf("未找到网站配置: %s", websiteID)
+	}
+	return p.repo.ClassifyReferers(websiteID, classifyRefererForStore, false)
+}
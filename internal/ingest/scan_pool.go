@@ -0,0 +1,289 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/ingest/source"
+)
+
+// defaultMaxParseWorkers 未配置 parseWorkers 时按 CPU 核数取值的上限
+const defaultMaxParseWorkers = 4
+
+func resolveParseWorkers(configured int) int {
+	if configured > 0 {
+		return configured
+	}
+	workers := runtime.NumCPU()
+	if workers > defaultMaxParseWorkers {
+		workers = defaultMaxParseWorkers
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// scanJob 一次扫描任务：网站下的一个日志文件或来源目标
+type scanJob struct {
+	live bool // 已有扫描状态的未压缩文件，只需追读新增内容，优先于首次解析与 gzip 历史文件
+	run  func(result *ParserResult)
+}
+
+// siteScan 一个网站本轮的任务队列与汇总结果，字段由 scanScheduler.mu 保护
+type siteScan struct {
+	id      string
+	name    string
+	start   time.Time
+	queue   []scanJob
+	running int
+	pending int // 尚未完成的任务数（含排队与执行中）
+	result  ParserResult
+}
+
+// scanScheduler 为工作协程分配任务：实时追读优先，同一优先级内按网站轮询；
+// 其他网站仍有排队任务时限制单个网站同时占用的协程数，避免大体量回溯拖慢其他网站
+type scanScheduler struct {
+	mu        sync.Mutex
+	sites     []*siteScan
+	next      int
+	siteLimit int
+	queued    int
+}
+
+func newScanScheduler(sites []*siteScan, workers int) *scanScheduler {
+	s := &scanScheduler{sites: sites}
+	active := 0
+	for _, site := range sites {
+		if len(site.queue) > 0 {
+			active++
+			s.queued += len(site.queue)
+		}
+	}
+	s.siteLimit = 1
+	if active > 0 {
+		s.siteLimit = (workers + active - 1) / active
+	}
+	return s
+}
+
+// take 取出下一个任务，全部任务分配完后返回 false
+func (s *scanScheduler) take() (*siteScan, scanJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queued == 0 {
+		return nil, scanJob{}, false
+	}
+	site := s.pick(true, true)
+	if site == nil {
+		site = s.pick(false, true)
+	}
+	if site == nil {
+		// 有排队任务的网站都已达到上限，放开上限避免协程空闲
+		site = s.pick(true, false)
+	}
+	if site == nil {
+		site = s.pick(false, false)
+	}
+	job := site.queue[0]
+	site.queue = site.queue[1:]
+	site.running++
+	s.queued--
+	return site, job, true
+}
+
+func (s *scanScheduler) pick(liveOnly, capped bool) *siteScan {
+	for offset := 0; offset < len(s.sites); offset++ {
+		idx := (s.next + offset) % len(s.sites)
+		site := s.sites[idx]
+		if len(site.queue) == 0 || (capped && site.running >= s.siteLimit) {
+			continue
+		}
+		if liveOnly && !site.queue[0].live {
+			continue
+		}
+		s.next = idx + 1
+		return site
+	}
+	return nil
+}
+
+// done 合并任务结果，返回该网站的任务是否已全部完成
+func (s *scanScheduler) done(site *siteScan, result ParserResult) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	site.running--
+	site.pending--
+	site.result.TotalEntries += result.TotalEntries
+	if !result.Success {
+		site.result.Success = false
+		site.result.Error = result.Error
+	}
+	return site.pending == 0
+}
+
+// keyedLocks 按键划分的互斥锁
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (l *keyedLocks) lock(key string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[key] = lock
+	}
+	l.mu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// lockScanFile 锁定网站 logPath 下的单个文件，返回解锁函数
+func (p *LogParser) lockScanFile(websiteID, filePath string) func() {
+	return p.scanLocks.lock(websiteID + "|" + normalizeLogPath(filePath))
+}
+
+// scanFileExclusive 在文件锁内扫描单个日志文件
+func (p *LogParser) scanFileExclusive(websiteID, filePath string, result *ParserResult) {
+	defer p.lockScanFile(websiteID, filePath)()
+	p.scanSingleFile(websiteID, filePath, result)
+}
+
+// scanTargetExclusive 在目标锁内扫描来源目标，错误记录到 result
+func (p *LogParser) scanTargetExclusive(
+	ctx context.Context, websiteID string, src source.LogSource, target source.TargetRef, result *ParserResult) {
+	defer p.scanLocks.lock(websiteID + "|" + buildTargetStateKey(target.SourceID, target.Key))()
+	if err := p.scanTarget(ctx, websiteID, src, target, result); err != nil {
+		result.Success = false
+		result.Error = err
+	}
+}
+
+// runScanPool 并行扫描多个网站的日志文件与来源目标，结果顺序与 websiteIDs 一致
+func (p *LogParser) runScanPool(websiteIDs []string) []ParserResult {
+	sites := make([]*siteScan, len(websiteIDs))
+	var planWG sync.WaitGroup
+	planSlots := make(chan struct{}, p.parseWorkers)
+	for i, id := range websiteIDs {
+		planWG.Add(1)
+		go func() {
+			defer planWG.Done()
+			planSlots <- struct{}{}
+			defer func() { <-planSlots }()
+			sites[i] = p.planWebsiteScan(id)
+		}()
+	}
+	planWG.Wait()
+
+	total := 0
+	for _, site := range sites {
+		total += len(site.queue)
+		if site.pending == 0 {
+			p.finishSiteScan(site)
+		}
+	}
+
+	workers := p.parseWorkers
+	if workers > total {
+		workers = total
+	}
+	scheduler := newScanScheduler(sites, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				site, job, ok := scheduler.take()
+				if !ok {
+					return
+				}
+				result := EmptyParserResult(site.name, site.id)
+				job.run(&result)
+				if scheduler.done(site, result) {
+					p.finishSiteScan(site)
+					p.updateState()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	parserResults := make([]ParserResult, len(sites))
+	for i, site := range sites {
+		parserResults[i] = site.result
+	}
+	return parserResults
+}
+
+// finishSiteScan 网站全部任务完成后刷新时间范围并记录耗时
+func (p *LogParser) finishSiteScan(site *siteScan) {
+	p.refreshWebsiteRanges(site.id)
+	site.result.Duration = time.Since(site.start)
+}
+
+// planWebsiteScan 展开网站的日志路径或来源目标，生成本轮扫描任务；
+// 配置错误直接记录到结果中
+func (p *LogParser) planWebsiteScan(websiteID string) *siteScan {
+	website, _ := config.GetWebsiteByID(websiteID)
+	site := &siteScan{
+		id:     websiteID,
+		name:   website.Name,
+		start:  time.Now(),
+		result: EmptyParserResult(website.Name, websiteID),
+	}
+	p.markInitialParsed(websiteID)
+
+	if len(website.Sources) > 0 {
+		site.queue = p.planSourceJobs(websiteID, website, &site.result)
+	} else if _, err := p.getLineParser(websiteID); err != nil {
+		site.result.Success = false
+		site.result.Error = err
+		p.notifyLogParsing(websiteID, "", "日志解析配置", err)
+	} else {
+		logPath := website.LogPath
+		paths := []string{logPath}
+		if strings.Contains(logPath, "*") {
+			matches, err := filepath.Glob(logPath)
+			if err != nil {
+				errstr := "解析日志路径模式 " + logPath + " 失败: " + err.Error()
+				site.result.Success = false
+				site.result.Error = errors.New(errstr)
+				p.notifyLogParsing(websiteID, logPath, "解析日志路径模式", err)
+			} else if len(matches) == 0 {
+				errstr := "日志路径模式 " + logPath + " 未匹配到任何文件"
+				site.result.Success = false
+				site.result.Error = errors.New(errstr)
+				p.notifyLogParsing(websiteID, logPath, "日志路径未匹配到文件", errors.New(errstr))
+			}
+			paths = matches
+		}
+		for _, path := range paths {
+			_, known := p.getFileState(websiteID, path)
+			site.queue = append(site.queue, scanJob{
+				live: known && !isGzipFile(path),
+				run: func(result *ParserResult) {
+					p.scanFileExclusive(websiteID, path, result)
+				},
+			})
+		}
+	}
+
+	sort.SliceStable(site.queue, func(i, j int) bool {
+		return site.queue[i].live && !site.queue[j].live
+	})
+	site.pending = len(site.queue)
+	return site
+}
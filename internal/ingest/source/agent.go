@@ -5,15 +5,26 @@ import (
 	"io"
 )
 
+// AgentSource 推送类来源（agent / otlp）：日志由对端主动推送，不参与扫描，仅用于按来源覆盖解析配置
 type AgentSource struct {
-	websiteID string
-	id        string
+	websiteID  string
+	id         string
+	sourceType SourceType
 }
 
 func NewAgentSource(websiteID, id string) *AgentSource {
 	return &AgentSource{
-		websiteID: websiteID,
-		id:        id,
+		websiteID:  websiteID,
+		id:         id,
+		sourceType: SourceAgent,
+	}
+}
+
+func NewOTLPSource(websiteID, id string) *AgentSource {
+	return &AgentSource{
+		websiteID:  websiteID,
+		id:         id,
+		sourceType: SourceOTLP,
 	}
 }
 
@@ -22,7 +33,7 @@ func (s *AgentSource) ID() string {
 }
 
 func (s *AgentSource) Type() SourceType {
-	return SourceAgent
+	return s.sourceType
 }
 
 func (s *AgentSource) ListTargets(ctx context.Context) ([]TargetRef, error) {
@@ -0,0 +1,212 @@
+package source
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/likaia/nginxpulse/internal/ingest/envelope"
+)
+
+// fingerprintBytes 文件指纹读取的首行长度上限
+const fingerprintBytes = 1024
+
+// LineDecoder 由需要解开日志封装的来源实现；扫描时仍按原始字节推进 offset，只对读出的行解码
+type LineDecoder interface {
+	NewLineDecoder(target TargetRef) envelope.Decoder
+}
+
+// DockerSource 读取 Docker json-file 与 kubelet（CRI）写出的容器标准输出日志。
+// 运行时轮转时会把 xxx-json.log 改名为 xxx-json.log.1，目标因此以“容器 + 首行指纹”标识，
+// 改名后的文件沿用原来的读取位置，新文件从头读取
+type DockerSource struct {
+	websiteID  string
+	id         string
+	root       string
+	pattern    string
+	stream     string
+	containers []string
+	labels     map[string]string
+
+	mu    sync.Mutex
+	paths map[string]string // 目标 key → 当前路径
+}
+
+func NewDockerSource(
+	websiteID, id, root, pattern, stream string, containers []string, labels map[string]string,
+) *DockerSource {
+	if strings.TrimSpace(root) == "" {
+		root = envelope.DefaultDockerRoot
+	}
+	return &DockerSource{
+		websiteID:  websiteID,
+		id:         id,
+		root:       root,
+		pattern:    pattern,
+		stream:     stream,
+		containers: containers,
+		labels:     labels,
+		paths:      make(map[string]string),
+	}
+}
+
+func (s *DockerSource) ID() string {
+	return s.id
+}
+
+func (s *DockerSource) Type() SourceType {
+	return SourceDocker
+}
+
+func (s *DockerSource) ListTargets(ctx context.Context) ([]TargetRef, error) {
+	_ = ctx
+	patterns := []string{
+		filepath.Join(s.root, "*", "*-json.log*"),
+		filepath.Join(s.root, "*", "*", "*.log*"),
+	}
+	if s.pattern != "" {
+		patterns = []string{s.pattern}
+	}
+	seen := make(map[string]bool)
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range matches {
+			// 运行时压缩过的轮转文件在压缩前已经读过，跳过以免重复
+			if seen[path] || strings.HasSuffix(strings.ToLower(path), ".gz") {
+				continue
+			}
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+
+	paths := make(map[string]string, len(files))
+	targets := make([]TargetRef, 0, len(files))
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if !envelope.MatchContainer(path, s.containers, s.labels) {
+			continue
+		}
+		fingerprint, err := fileFingerprint(path)
+		if err != nil || fingerprint == "" {
+			// 空文件还没有首行，下次扫描再处理
+			continue
+		}
+		key := containerKey(path) + "@" + fingerprint
+		if _, ok := paths[key]; ok {
+			continue
+		}
+		paths[key] = path
+		targets = append(targets, TargetRef{
+			WebsiteID: s.websiteID,
+			SourceID:  s.id,
+			Key:       key,
+			Meta: TargetMeta{
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			},
+		})
+	}
+
+	s.mu.Lock()
+	s.paths = paths
+	s.mu.Unlock()
+	return targets, nil
+}
+
+func (s *DockerSource) OpenRange(ctx context.Context, target TargetRef, start, end int64) (io.ReadCloser, error) {
+	path, err := s.resolve(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return NewLocalSource(s.websiteID, s.id, path, "", "none").OpenRange(ctx, TargetRef{Key: path}, start, end)
+}
+
+func (s *DockerSource) OpenStream(ctx context.Context, target TargetRef) (io.ReadCloser, error) {
+	_ = ctx
+	_ = target
+	return nil, ErrStreamNotSupported
+}
+
+func (s *DockerSource) Stat(ctx context.Context, target TargetRef) (TargetMeta, error) {
+	path, err := s.resolve(ctx, target)
+	if err != nil {
+		return TargetMeta{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return TargetMeta{}, err
+	}
+	return TargetMeta{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *DockerSource) NewLineDecoder(target TargetRef) envelope.Decoder {
+	_ = target
+	return envelope.NewDecoder(envelope.Options{Stream: s.stream})
+}
+
+// resolve 找到目标当前所在的路径，轮转改名后重新列出一次
+func (s *DockerSource) resolve(ctx context.Context, target TargetRef) (string, error) {
+	s.mu.Lock()
+	path, ok := s.paths[target.Key]
+	s.mu.Unlock()
+	if ok {
+		return path, nil
+	}
+	if _, err := s.ListTargets(ctx); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	path, ok = s.paths[target.Key]
+	s.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("container log not found: %s", target.Key)
+	}
+	return path, nil
+}
+
+// containerKey 日志文件所属容器的标识：Docker 为容器 ID 前 12 位，kubelet 为 Pod 目录/容器名
+func containerKey(path string) string {
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(filepath.Join(dir, "config.v2.json")); err == nil {
+		id := filepath.Base(dir)
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		return id
+	}
+	return filepath.Base(filepath.Dir(dir)) + "/" + filepath.Base(dir)
+}
+
+// fileFingerprint 首行（最多 fingerprintBytes 字节）的哈希；容器日志首行带纳秒时间戳，足以区分文件
+func fileFingerprint(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	line, err := bufio.NewReaderSize(file, fingerprintBytes).ReadSlice('\n')
+	if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+		// 首行尚未写完整
+		return "", nil
+	}
+	sum := sha1.Sum(line)
+	return hex.EncodeToString(sum[:8]), nil
+}
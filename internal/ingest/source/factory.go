@@ -64,6 +64,14 @@ func NewFromConfig(websiteID string, cfg config.SourceConfig) (LogSource, error)
 		)
 	case string(SourceAgent):
 		return NewAgentSource(websiteID, cfg.ID), nil
+	case string(SourceOTLP):
+		return NewOTLPSource(websiteID, cfg.ID), nil
+	case string(SourceDocker):
+		return NewDockerSource(websiteID, cfg.ID, cfg.Path, cfg.Pattern, cfg.Stream, cfg.Containers, cfg.Labels), nil
+	case string(SourceJournald):
+		return NewJournaldSource(websiteID, cfg.ID, cfg.Path, cfg.Pattern, cfg.Compression, cfg.Units, cfg.Containers), nil
+	case string(SourceKafka), string(SourceNATS), string(SourceRedis):
+		return nil, fmt.Errorf("%s is a stream source, use NewStreamFromConfig", cfg.Type)
 	default:
 		return nil, fmt.Errorf("unsupported source type: %s", cfg.Type)
 	}
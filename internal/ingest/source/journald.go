@@ -0,0 +1,35 @@
+package source
+
+import (
+	"github.com/likaia/nginxpulse/internal/ingest/envelope"
+)
+
+// JournaldSource 读取 journal export 格式的文件（journalctl -o export 的输出），
+// 按 unit / SYSLOG_IDENTIFIER / CONTAINER_NAME 过滤后取 MESSAGE 作为日志行。
+// 文件的列出与读取与 local 相同
+type JournaldSource struct {
+	*LocalSource
+	units      []string
+	containers []string
+}
+
+func NewJournaldSource(websiteID, id, path, pattern, compression string, units, containers []string) *JournaldSource {
+	return &JournaldSource{
+		LocalSource: NewLocalSource(websiteID, id, path, pattern, compression),
+		units:       units,
+		containers:  containers,
+	}
+}
+
+func (s *JournaldSource) Type() SourceType {
+	return SourceJournald
+}
+
+func (s *JournaldSource) NewLineDecoder(target TargetRef) envelope.Decoder {
+	_ = target
+	return envelope.NewDecoder(envelope.Options{
+		Format:     envelope.FormatJournald,
+		Units:      s.units,
+		Containers: s.containers,
+	})
+}
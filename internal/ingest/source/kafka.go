@@ -0,0 +1,99 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// KafkaSource 以消费组消费 Kafka topic，关闭自动提交，入库成功后同步提交 offset
+type KafkaSource struct {
+	websiteID string
+	id        string
+	reader    kafkaReader
+}
+
+// kafkaReader KafkaSource 用到的消费组读取接口，由 *kafka.Reader 实现
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+func NewKafkaSource(websiteID, id string, brokers []string, topic, group, user, password string, fromStart bool) (*KafkaSource, error) {
+	if len(brokers) == 0 || strings.TrimSpace(topic) == "" || strings.TrimSpace(group) == "" {
+		return nil, errors.New("kafka source requires brokers, topic and group")
+	}
+	dialer := &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true}
+	if user != "" {
+		dialer.SASLMechanism = plain.Mechanism{Username: user, Password: password}
+	}
+	startOffset := kafka.LastOffset
+	if fromStart {
+		startOffset = kafka.FirstOffset
+	}
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     brokers,
+		GroupID:     group,
+		Topic:       topic,
+		Dialer:      dialer,
+		StartOffset: startOffset,
+		MaxWait:     streamFetchWait,
+		// CommitInterval 为 0 表示 CommitMessages 同步提交
+		CommitInterval: 0,
+	})
+	return newKafkaSource(websiteID, id, reader), nil
+}
+
+func newKafkaSource(websiteID, id string, reader kafkaReader) *KafkaSource {
+	return &KafkaSource{websiteID: websiteID, id: id, reader: reader}
+}
+
+func (s *KafkaSource) ID() string {
+	return s.id
+}
+
+func (s *KafkaSource) Type() SourceType {
+	return SourceKafka
+}
+
+func (s *KafkaSource) Fetch(ctx context.Context, max int) (*StreamBatch, error) {
+	batch := &StreamBatch{}
+	var messages []kafka.Message
+	deadline := time.Now().Add(streamFetchWait)
+	for len(messages) < max {
+		fetchCtx, cancel := context.WithDeadline(ctx, deadline)
+		msg, err := s.reader.FetchMessage(fetchCtx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				break
+			}
+			return nil, fmt.Errorf("kafka fetch: %w", err)
+		}
+		messages = append(messages, msg)
+		batch.add(msg.Value)
+	}
+	batch.commit = messages
+	return batch, nil
+}
+
+func (s *KafkaSource) Commit(ctx context.Context, batch *StreamBatch) error {
+	messages, _ := batch.commit.([]kafka.Message)
+	if len(messages) == 0 {
+		return nil
+	}
+	if err := s.reader.CommitMessages(ctx, messages...); err != nil {
+		return fmt.Errorf("kafka commit: %w", err)
+	}
+	return nil
+}
+
+func (s *KafkaSource) Close() error {
+	return s.reader.Close()
+}
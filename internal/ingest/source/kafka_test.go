@@ -0,0 +1,186 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafkaBroker 单分区 topic 的进程内模拟：按消费组记录已提交的 offset，
+// 新加入的 reader 从已提交位置开始读，未提交的消息会被重新投递
+type fakeKafkaBroker struct {
+	mu        sync.Mutex
+	messages  []kafka.Message
+	committed map[string]int64
+	published chan struct{} // 有新消息时关闭并替换，唤醒等待中的 FetchMessage
+}
+
+func newFakeKafkaBroker() *fakeKafkaBroker {
+	return &fakeKafkaBroker{committed: make(map[string]int64), published: make(chan struct{})}
+}
+
+func (b *fakeKafkaBroker) publish(payloads ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, payload := range payloads {
+		b.messages = append(b.messages, kafka.Message{
+			Topic:  "logs",
+			Offset: int64(len(b.messages)),
+			Value:  []byte(payload),
+		})
+	}
+	close(b.published)
+	b.published = make(chan struct{})
+}
+
+func (b *fakeKafkaBroker) reader(group string) *fakeKafkaReader {
+	return &fakeKafkaReader{broker: b, group: group, next: -1}
+}
+
+type fakeKafkaReader struct {
+	broker *fakeKafkaBroker
+	group  string
+	next   int64 // 下一条要读取的 offset，-1 表示尚未加入消费组
+	closed bool
+}
+
+func (r *fakeKafkaReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	b := r.broker
+	for {
+		b.mu.Lock()
+		if r.closed {
+			b.mu.Unlock()
+			return kafka.Message{}, errors.New("reader closed")
+		}
+		if r.next < 0 {
+			r.next = b.committed[r.group]
+		}
+		if r.next < int64(len(b.messages)) {
+			msg := b.messages[r.next]
+			r.next++
+			b.mu.Unlock()
+			return msg, nil
+		}
+		published := b.published
+		b.mu.Unlock()
+		select {
+		case <-published:
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		}
+	}
+}
+
+func (r *fakeKafkaReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	b := r.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.closed {
+		return errors.New("reader closed")
+	}
+	for _, msg := range msgs {
+		if msg.Offset+1 > b.committed[r.group] {
+			b.committed[r.group] = msg.Offset + 1
+		}
+	}
+	return nil
+}
+
+func (r *fakeKafkaReader) Close() error {
+	r.broker.mu.Lock()
+	defer r.broker.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func TestKafkaSourceRedeliversUncommitted(t *testing.T) {
+	broker := newFakeKafkaBroker()
+	broker.publish("a\nb", "c")
+	ctx := context.Background()
+
+	first := newKafkaSource("site", "kafka", broker.reader("nginxpulse"))
+	batch, err := first.Fetch(ctx, 2)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(batch.Lines, want) || batch.Messages != 2 {
+		t.Fatalf("Fetch = %v (%d messages), want %v (2 messages)", batch.Lines, batch.Messages, want)
+	}
+	first.Close()
+
+	// 未提交 offset：同一消费组重新加入后从头读到同样的消息
+	second := newKafkaSource("site", "kafka", broker.reader("nginxpulse"))
+	replayed, err := second.Fetch(ctx, 2)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if !reflect.DeepEqual(replayed.Lines, batch.Lines) {
+		t.Fatalf("replayed %v, want %v", replayed.Lines, batch.Lines)
+	}
+	if err := second.Commit(ctx, replayed); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	second.Close()
+
+	// 已提交：新连接只读到之后写入的消息；其他消费组不受影响
+	broker.publish("d")
+	third := newKafkaSource("site", "kafka", broker.reader("nginxpulse"))
+	defer third.Close()
+	next, err := third.Fetch(ctx, 1)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if want := []string{"d"}; !reflect.DeepEqual(next.Lines, want) {
+		t.Fatalf("Fetch after commit = %v, want %v", next.Lines, want)
+	}
+	other := newKafkaSource("site", "kafka", broker.reader("other"))
+	defer other.Close()
+	all, err := other.Fetch(ctx, 3)
+	if err != nil {
+		t.Fatalf("Fetch other group: %v", err)
+	}
+	if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(all.Lines, want) {
+		t.Fatalf("Fetch other group = %v, want %v", all.Lines, want)
+	}
+}
+
+// TestKafkaSourceFetchWait 消息不足一批时等待 streamFetchWait 后返回已拉到的部分；
+// 调用方取消时返回错误
+func TestKafkaSourceFetchWait(t *testing.T) {
+	broker := newFakeKafkaBroker()
+	broker.publish("a")
+	src := newKafkaSource("site", "kafka", broker.reader("nginxpulse"))
+	defer src.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		broker.publish("b")
+	}()
+	started := time.Now()
+	batch, err := src.Fetch(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(batch.Lines, want) {
+		t.Fatalf("Fetch = %v, want %v", batch.Lines, want)
+	}
+	if elapsed := time.Since(started); elapsed < streamFetchWait {
+		t.Fatalf("Fetch returned after %s, want to wait %s for a full batch", elapsed, streamFetchWait)
+	}
+
+	empty := &StreamBatch{}
+	if err := src.Commit(context.Background(), empty); err != nil {
+		t.Fatalf("Commit empty batch: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := src.Fetch(ctx, 10); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Fetch with canceled context = %v, want context.Canceled", err)
+	}
+}
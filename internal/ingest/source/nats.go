@@ -0,0 +1,109 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSSource 以 durable pull consumer 消费 JetStream stream，入库成功后逐条 ack；
+// 未 ack 的消息在 AckWait 到期后由服务端重新投递
+type NATSSource struct {
+	websiteID string
+	id        string
+	conn      *nats.Conn
+	consumer  jetstream.Consumer
+}
+
+func NewNATSSource(
+	ctx context.Context, websiteID, id, url, stream, subject, durable, user, password string, fromStart bool,
+) (*NATSSource, error) {
+	if strings.TrimSpace(stream) == "" || strings.TrimSpace(durable) == "" {
+		return nil, errors.New("nats source requires topic (stream name) and group (durable consumer)")
+	}
+	if strings.TrimSpace(url) == "" {
+		url = nats.DefaultURL
+	}
+	opts := []nats.Option{nats.Name("nginxpulse")}
+	if user != "" {
+		opts = append(opts, nats.UserInfo(user, password))
+	}
+	conn, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("nats connect: %w", err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// 已存在的 consumer 沿用服务端配置，保留其消费位置
+	consumer, err := js.Consumer(ctx, stream, durable)
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		deliver := jetstream.DeliverNewPolicy
+		if fromStart {
+			deliver = jetstream.DeliverAllPolicy
+		}
+		consumer, err = js.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+			Durable:       durable,
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			DeliverPolicy: deliver,
+			FilterSubject: subject,
+		})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("nats consumer: %w", err)
+	}
+	return &NATSSource{websiteID: websiteID, id: id, conn: conn, consumer: consumer}, nil
+}
+
+func (s *NATSSource) ID() string {
+	return s.id
+}
+
+func (s *NATSSource) Type() SourceType {
+	return SourceNATS
+}
+
+func (s *NATSSource) Fetch(ctx context.Context, max int) (*StreamBatch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result, err := s.consumer.Fetch(max, jetstream.FetchMaxWait(streamFetchWait))
+	if err != nil {
+		return nil, fmt.Errorf("nats fetch: %w", err)
+	}
+	batch := &StreamBatch{}
+	var messages []jetstream.Msg
+	for msg := range result.Messages() {
+		messages = append(messages, msg)
+		batch.add(msg.Data())
+	}
+	if err := result.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) {
+		return nil, fmt.Errorf("nats fetch: %w", err)
+	}
+	batch.commit = messages
+	return batch, nil
+}
+
+func (s *NATSSource) Commit(ctx context.Context, batch *StreamBatch) error {
+	messages, _ := batch.commit.([]jetstream.Msg)
+	for _, msg := range messages {
+		// 等待服务端确认，避免 ack 丢失时误以为已提交
+		if err := msg.DoubleAck(ctx); err != nil {
+			return fmt.Errorf("nats ack: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *NATSSource) Close() error {
+	s.conn.Close()
+	return nil
+}
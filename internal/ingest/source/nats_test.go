@@ -0,0 +1,144 @@
+package source
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// newTestJetStream 启动进程内的 JetStream 服务端并创建 LOGS stream
+func newTestJetStream(t *testing.T) (string, jetstream.JetStream) {
+	t.Helper()
+	server, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      natsserver.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("nats server: %v", err)
+	}
+	go server.Start()
+	if !server.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(server.Shutdown)
+
+	conn, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatalf("nats connect: %v", err)
+	}
+	t.Cleanup(conn.Close)
+	js, err := jetstream.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = js.CreateStream(context.Background(), jetstream.StreamConfig{Name: "LOGS", Subjects: []string{"logs.>"}})
+	if err != nil {
+		t.Fatalf("create stream: %v", err)
+	}
+	return server.ClientURL(), js
+}
+
+func newTestNATSSource(t *testing.T, url string, fromStart bool) *NATSSource {
+	t.Helper()
+	src, err := NewNATSSource(context.Background(), "site", "nats", url, "LOGS", "logs.access", "nginxpulse", "", "", fromStart)
+	if err != nil {
+		t.Fatalf("NewNATSSource: %v", err)
+	}
+	t.Cleanup(func() { src.Close() })
+	return src
+}
+
+func publishNATS(t *testing.T, js jetstream.JetStream, payloads ...string) {
+	t.Helper()
+	for _, payload := range payloads {
+		if _, err := js.Publish(context.Background(), "logs.access", []byte(payload)); err != nil {
+			t.Fatalf("publish: %v", err)
+		}
+	}
+}
+
+func TestNATSSourceRedeliversUnacked(t *testing.T) {
+	ctx := context.Background()
+	url, js := newTestJetStream(t)
+	// 预先创建 durable 并缩短 AckWait，source 沿用服务端配置
+	_, err := js.CreateOrUpdateConsumer(ctx, "LOGS", jetstream.ConsumerConfig{
+		Durable:       "nginxpulse",
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+		FilterSubject: "logs.access",
+		AckWait:       200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("create consumer: %v", err)
+	}
+	publishNATS(t, js, "a\nb", "c")
+
+	first := newTestNATSSource(t, url, true)
+	batch, err := first.Fetch(ctx, 2)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(batch.Lines, want) || batch.Messages != 2 {
+		t.Fatalf("Fetch = %v (%d messages), want %v (2 messages)", batch.Lines, batch.Messages, want)
+	}
+	first.Close()
+
+	// 未 ack 的消息在 AckWait 到期后重新投递给新连接
+	second := newTestNATSSource(t, url, true)
+	replayed, err := second.Fetch(ctx, 2)
+	if err != nil {
+		t.Fatalf("Fetch after restart: %v", err)
+	}
+	if !reflect.DeepEqual(replayed.Lines, batch.Lines) {
+		t.Fatalf("replayed %v, want %v", replayed.Lines, batch.Lines)
+	}
+	if err := second.Commit(ctx, replayed); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	consumer, err := js.Consumer(ctx, "LOGS", "nginxpulse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := consumer.Info(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.NumAckPending != 0 || info.NumPending != 0 {
+		t.Fatalf("after commit ack pending = %d, pending = %d; want 0, 0", info.NumAckPending, info.NumPending)
+	}
+	if info.AckFloor.Stream != 2 {
+		t.Fatalf("ack floor = %d, want 2", info.AckFloor.Stream)
+	}
+}
+
+func TestNATSSourceCreatesConsumer(t *testing.T) {
+	ctx := context.Background()
+	for _, fromStart := range []bool{true, false} {
+		url, js := newTestJetStream(t)
+		publishNATS(t, js, "old")
+		src := newTestNATSSource(t, url, fromStart)
+		publishNATS(t, js, "new")
+
+		want := []string{"new"}
+		if fromStart {
+			want = []string{"old", "new"}
+		}
+		batch, err := src.Fetch(ctx, len(want))
+		if err != nil {
+			t.Fatalf("fromStart=%t: Fetch: %v", fromStart, err)
+		}
+		if !reflect.DeepEqual(batch.Lines, want) {
+			t.Errorf("fromStart=%t: Fetch = %v, want %v", fromStart, batch.Lines, want)
+		}
+	}
+}
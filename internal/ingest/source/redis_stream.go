@@ -0,0 +1,141 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisMessageFields 消息中存放日志内容的字段，依次查找；只有一个字段时直接使用
+var redisMessageFields = []string{"message", "line", "log"}
+
+// RedisStreamSource 以消费组消费 Redis Stream，入库成功后 XACK。
+// 启动时先重新读取本消费者未确认的消息（上次入库失败或进程退出时遗留），再读取新消息
+type RedisStreamSource struct {
+	websiteID    string
+	id           string
+	client       *redis.Client
+	key          string
+	group        string
+	consumer     string
+	pendingDrain bool // 是否已读完未确认的消息
+}
+
+func NewRedisStreamSource(
+	ctx context.Context, websiteID, id, url, key, group, consumer, user, password string, fromStart bool,
+) (*RedisStreamSource, error) {
+	if strings.TrimSpace(key) == "" || strings.TrimSpace(group) == "" {
+		return nil, errors.New("redis source requires topic (stream key) and group")
+	}
+	if strings.TrimSpace(url) == "" {
+		url = "redis://localhost:6379/0"
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("redis url: %w", err)
+	}
+	if user != "" {
+		opts.Username = user
+	}
+	if password != "" {
+		opts.Password = password
+	}
+	client := redis.NewClient(opts)
+
+	start := "$"
+	if fromStart {
+		start = "0"
+	}
+	if err := client.XGroupCreateMkStream(ctx, key, group, start).Err(); err != nil &&
+		!strings.Contains(err.Error(), "BUSYGROUP") {
+		client.Close()
+		return nil, fmt.Errorf("redis xgroup create: %w", err)
+	}
+	return &RedisStreamSource{
+		websiteID: websiteID,
+		id:        id,
+		client:    client,
+		key:       key,
+		group:     group,
+		consumer:  consumer,
+	}, nil
+}
+
+func (s *RedisStreamSource) ID() string {
+	return s.id
+}
+
+func (s *RedisStreamSource) Type() SourceType {
+	return SourceRedis
+}
+
+func (s *RedisStreamSource) Fetch(ctx context.Context, max int) (*StreamBatch, error) {
+	// ID 为 0 时返回已投递给本消费者但未确认的消息，不会阻塞
+	start := ">"
+	block := streamFetchWait
+	if !s.pendingDrain {
+		start = "0"
+		block = -1
+	}
+	streams, err := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    s.group,
+		Consumer: s.consumer,
+		Streams:  []string{s.key, start},
+		Count:    int64(max),
+		Block:    block,
+	}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("redis xreadgroup: %w", err)
+	}
+
+	batch := &StreamBatch{}
+	var ids []string
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			ids = append(ids, msg.ID)
+			if value, ok := redisMessageValue(msg.Values); ok {
+				batch.add([]byte(value))
+			} else {
+				batch.Messages++
+			}
+		}
+	}
+	if start == "0" && len(ids) == 0 {
+		s.pendingDrain = true
+	}
+	batch.commit = ids
+	return batch, nil
+}
+
+func (s *RedisStreamSource) Commit(ctx context.Context, batch *StreamBatch) error {
+	ids, _ := batch.commit.([]string)
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := s.client.XAck(ctx, s.key, s.group, ids...).Err(); err != nil {
+		return fmt.Errorf("redis xack: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisStreamSource) Close() error {
+	return s.client.Close()
+}
+
+func redisMessageValue(values map[string]interface{}) (string, bool) {
+	for _, field := range redisMessageFields {
+		if value, ok := values[field].(string); ok {
+			return value, true
+		}
+	}
+	if len(values) == 1 {
+		for _, value := range values {
+			text, ok := value.(string)
+			return text, ok
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,114 @@
+package source
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) (string, *redis.Client) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return "redis://" + server.Addr() + "/0", client
+}
+
+func newTestRedisSource(t *testing.T, url string) *RedisStreamSource {
+	t.Helper()
+	src, err := NewRedisStreamSource(context.Background(), "site", "redis", url, "logs", "nginxpulse", "worker-1", "", "", true)
+	if err != nil {
+		t.Fatalf("NewRedisStreamSource: %v", err)
+	}
+	t.Cleanup(func() { src.Close() })
+	return src
+}
+
+func redisPending(t *testing.T, client *redis.Client) int64 {
+	t.Helper()
+	pending, err := client.XPending(context.Background(), "logs", "nginxpulse").Result()
+	if err != nil {
+		t.Fatalf("XPending: %v", err)
+	}
+	return pending.Count
+}
+
+func TestRedisStreamSourceReplaysPendingAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	url, client := newTestRedis(t)
+	first := newTestRedisSource(t, url)
+	client.XAdd(ctx, &redis.XAddArgs{Stream: "logs", Values: map[string]interface{}{"message": "a\nb"}})
+	client.XAdd(ctx, &redis.XAddArgs{Stream: "logs", Values: map[string]interface{}{"message": "c"}})
+
+	// 首次启动没有遗留消息，先读空 PEL，再读新消息
+	batch, err := first.Fetch(ctx, 10)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if batch.Messages != 0 {
+		t.Fatalf("first Fetch drained %d pending messages, want 0", batch.Messages)
+	}
+	batch, err = first.Fetch(ctx, 10)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(batch.Lines, want) || batch.Messages != 2 {
+		t.Fatalf("Fetch = %v (%d messages), want %v (2 messages)", batch.Lines, batch.Messages, want)
+	}
+	// 未提交：消息留在 PEL 中
+	if got := redisPending(t, client); got != 2 {
+		t.Fatalf("pending after uncommitted fetch = %d, want 2", got)
+	}
+	first.Close()
+
+	// 重启后同一消费者先拿回未确认的消息
+	second := newTestRedisSource(t, url)
+	replayed, err := second.Fetch(ctx, 10)
+	if err != nil {
+		t.Fatalf("Fetch after restart: %v", err)
+	}
+	if !reflect.DeepEqual(replayed.Lines, batch.Lines) {
+		t.Fatalf("replayed %v, want %v", replayed.Lines, batch.Lines)
+	}
+	if err := second.Commit(ctx, replayed); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if got := redisPending(t, client); got != 0 {
+		t.Fatalf("pending after commit = %d, want 0", got)
+	}
+
+	// PEL 读空后切换到新消息
+	if batch, err := second.Fetch(ctx, 10); err != nil || batch.Messages != 0 {
+		t.Fatalf("Fetch after commit = %+v, %v; want empty", batch, err)
+	}
+	client.XAdd(ctx, &redis.XAddArgs{Stream: "logs", Values: map[string]interface{}{"line": "d"}})
+	batch, err = second.Fetch(ctx, 10)
+	if err != nil {
+		t.Fatalf("Fetch new: %v", err)
+	}
+	if want := []string{"d"}; !reflect.DeepEqual(batch.Lines, want) {
+		t.Fatalf("Fetch new = %v, want %v", batch.Lines, want)
+	}
+}
+
+func TestRedisMessageValue(t *testing.T) {
+	tests := []struct {
+		values map[string]interface{}
+		want   string
+		ok     bool
+	}{
+		{values: map[string]interface{}{"message": "m", "host": "web-1"}, want: "m", ok: true},
+		{values: map[string]interface{}{"log": "l", "host": "web-1"}, want: "l", ok: true},
+		{values: map[string]interface{}{"payload": "p"}, want: "p", ok: true},
+		{values: map[string]interface{}{"host": "web-1", "payload": "p"}, ok: false},
+	}
+	for _, tt := range tests {
+		got, ok := redisMessageValue(tt.values)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("redisMessageValue(%v) = %q, %t; want %q, %t", tt.values, got, ok, tt.want, tt.ok)
+		}
+	}
+}
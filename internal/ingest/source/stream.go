@@ -0,0 +1,85 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+)
+
+// streamFetchWait 单次拉取等待消息的最长时间，超时后返回已拉到的部分
+const streamFetchWait = 2 * time.Second
+
+// StreamSource 消息队列类来源（Kafka / NATS JetStream / Redis Streams）。
+// 以消费组拉取消息，调用方在日志入库成功后再 Commit，保证至少一次投递；
+// 出错时调用方关闭并重建来源，从上次提交的位置重新消费
+type StreamSource interface {
+	ID() string
+	Type() SourceType
+	// Fetch 拉取最多 max 条消息，没有新消息时最多等待 streamFetchWait，可能返回空批次
+	Fetch(ctx context.Context, max int) (*StreamBatch, error)
+	// Commit 提交该批次的消费位点
+	Commit(ctx context.Context, batch *StreamBatch) error
+	Close() error
+}
+
+// StreamBatch 一次拉取到的消息；每条消息可包含多行日志，Lines 为按换行拆分后的结果
+type StreamBatch struct {
+	Lines    []string
+	Messages int
+	commit   interface{} // 各实现提交位点所需的数据
+}
+
+func (b *StreamBatch) add(value []byte) {
+	b.Messages++
+	for _, line := range strings.Split(string(value), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) != "" {
+			b.Lines = append(b.Lines, line)
+		}
+	}
+}
+
+// IsStreamType 该类型是否为消息队列来源；这类来源不参与定期扫描
+func IsStreamType(value string) bool {
+	switch SourceType(strings.ToLower(strings.TrimSpace(value))) {
+	case SourceKafka, SourceNATS, SourceRedis:
+		return true
+	}
+	return false
+}
+
+// NewStreamFromConfig 创建消息队列来源并完成连接与消费组初始化
+func NewStreamFromConfig(ctx context.Context, websiteID string, cfg config.SourceConfig) (StreamSource, error) {
+	password := ""
+	if cfg.Auth != nil {
+		password = cfg.Auth.Password
+	}
+	fromStart := strings.EqualFold(strings.TrimSpace(cfg.StartFrom), "earliest")
+	switch SourceType(strings.ToLower(strings.TrimSpace(cfg.Type))) {
+	case SourceKafka:
+		return NewKafkaSource(websiteID, cfg.ID, cfg.Brokers, cfg.Topic, cfg.Group, cfg.User, password, fromStart)
+	case SourceNATS:
+		return NewNATSSource(ctx, websiteID, cfg.ID, cfg.URL, cfg.Topic, cfg.Pattern, cfg.Group, cfg.User, password, fromStart)
+	case SourceRedis:
+		return NewRedisStreamSource(
+			ctx, websiteID, cfg.ID, cfg.URL, cfg.Topic, cfg.Group, streamConsumerName(cfg.Consumer), cfg.User, password, fromStart,
+		)
+	default:
+		return nil, fmt.Errorf("unsupported stream source type: %s", cfg.Type)
+	}
+}
+
+// streamConsumerName 消费者名称，默认取主机名；同一消费组内的多个实例需各不相同
+func streamConsumerName(value string) string {
+	if value = strings.TrimSpace(value); value != "" {
+		return value
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return "nginxpulse"
+}
@@ -15,6 +15,14 @@ const (
 	SourceHTTP  SourceType = "http"
 	SourceS3    SourceType = "s3"
 	SourceAgent SourceType = "agent"
+	SourceOTLP  SourceType = "otlp"
+
+	SourceDocker   SourceType = "docker"
+	SourceJournald SourceType = "journald"
+
+	SourceKafka SourceType = "kafka"
+	SourceNATS  SourceType = "nats"
+	SourceRedis SourceType = "redis"
 )
 
 type RangePolicy string
@@ -8,13 +8,21 @@ import (
 	"time"
 
 	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/ingest/envelope"
 	"github.com/likaia/nginxpulse/internal/ingest/source"
 	"github.com/sirupsen/logrus"
 )
 
-func (p *LogParser) scanSources(websiteID string, website config.WebsiteConfig, parserResult *ParserResult) {
+// planSourceJobs 列出网站各轮询来源的目标，每个目标生成一个扫描任务；
+// 列举失败记录到 parserResult，不影响其他来源
+func (p *LogParser) planSourceJobs(websiteID string, website config.WebsiteConfig, parserResult *ParserResult) []scanJob {
 	ctx := context.Background()
+	var jobs []scanJob
 	for _, srcCfg := range website.Sources {
+		if source.IsStreamType(srcCfg.Type) {
+			// 消息队列来源由 RunStreamSources 持续消费
+			continue
+		}
 		if _, err := p.getLineParserForSource(websiteID, srcCfg.ID); err != nil {
 			parserResult.Success = false
 			parserResult.Error = err
@@ -42,12 +50,16 @@ func (p *LogParser) scanSources(websiteID string, website config.WebsiteConfig,
 			continue
 		}
 		for _, target := range targets {
-			if err := p.scanTarget(ctx, websiteID, src, target, parserResult); err != nil {
-				parserResult.Success = false
-				parserResult.Error = err
-			}
+			_, known := p.getTargetState(websiteID, buildTargetStateKey(target.SourceID, target.Key))
+			jobs = append(jobs, scanJob{
+				live: known && !target.Meta.Compressed,
+				run: func(result *ParserResult) {
+					p.scanTargetExclusive(ctx, websiteID, src, target, result)
+				},
+			})
 		}
 	}
+	return jobs
 }
 
 func (p *LogParser) scanTarget(
@@ -104,7 +116,21 @@ func (p *LogParser) scanTarget(
 		startOffset = 0
 	}
 
+	// 封装格式的目标：沿用上次扫描的解码器，从其已读位置继续；
+	// 解码器缓存与持久化的位置对不上（重启、重置、全量扫描）时，从持久化位置用新解码器重读
+	var decoder *targetDecoder
+	if provider, isDecoded := src.(source.LineDecoder); isDecoded {
+		decoder = p.takeTargetDecoder(websiteID, targetKey)
+		if decoder == nil || !ok || needsFullScan || decoder.settled != startOffset {
+			decoder = &targetDecoder{decoder: provider.NewLineDecoder(target), offset: startOffset, settled: startOffset}
+		}
+		startOffset = decoder.offset
+	}
+
 	if !needsFullScan && meta.Size > 0 && startOffset >= meta.Size {
+		if decoder != nil {
+			p.putTargetDecoder(websiteID, targetKey, decoder)
+		}
 		state.LastSize = meta.Size
 		state.LastETag = meta.ETag
 		state.LastModTime = meta.ModTime.Unix()
@@ -134,12 +160,18 @@ func (p *LogParser) scanTarget(
 
 	window := parseWindow{}
 	if !ok {
-		window = parseWindow{minTs: state.RecentCutoffTs}
+		window = parseWindow{minTs: state.RecentCutoffTs, bulk: true}
+	}
+
+	var lineDecoder envelope.Decoder
+	if decoder != nil {
+		lineDecoder = decoder.decoder
 	}
 
 	var (
 		entriesCount int
 		bytesRead    int64
+		settled      int64
 		minTs        int64
 		maxTs        int64
 	)
@@ -149,10 +181,10 @@ func (p *LogParser) scanTarget(
 		if err != nil {
 			return err
 		}
-		entriesCount, bytesRead, minTs, maxTs = p.parseLogLines(gzReader, websiteID, target.SourceID, parserResult, window)
+		entriesCount, bytesRead, settled, minTs, maxTs = p.parseDecodedLines(gzReader, lineDecoder, websiteID, target.SourceID, parserResult, window)
 		gzReader.Close()
 	} else {
-		entriesCount, bytesRead, minTs, maxTs = p.parseLogLines(reader, websiteID, target.SourceID, parserResult, window)
+		entriesCount, bytesRead, settled, minTs, maxTs = p.parseDecodedLines(reader, lineDecoder, websiteID, target.SourceID, parserResult, window)
 	}
 
 	updateTargetParsedRange(&state, minTs, maxTs)
@@ -164,8 +196,16 @@ func (p *LogParser) scanTarget(
 		state.LastOffset = meta.Size
 		state.BackfillDone = true
 	} else {
-		state.LastOffset = startOffset + bytesRead
+		if settled >= 0 {
+			// 只持久化到最后一个完整条目，解码器缓存的分片在重启后可以重新读到
+			state.LastOffset = startOffset + settled
+		}
 		state.BackfillDone = true
+		if decoder != nil {
+			decoder.offset = startOffset + bytesRead
+			decoder.settled = state.LastOffset
+			p.putTargetDecoder(websiteID, targetKey, decoder)
+		}
 	}
 	state.LastSize = meta.Size
 	state.LastETag = meta.ETag
@@ -178,6 +218,33 @@ func (p *LogParser) scanTarget(
 	return nil
 }
 
+// targetDecoder 远端目标的解码器及其读取位置：offset 为已交给解码器的原始字节位置，
+// settled 为同时持久化的 LastOffset，两者之间是解码器缓存的分片
+type targetDecoder struct {
+	decoder envelope.Decoder
+	offset  int64
+	settled int64
+}
+
+// takeTargetDecoder 取出目标的解码器缓存；扫描期间不在缓存中，出错返回时自然丢弃
+func (p *LogParser) takeTargetDecoder(websiteID, targetKey string) *targetDecoder {
+	p.decoderMu.Lock()
+	defer p.decoderMu.Unlock()
+	key := websiteID + "|" + targetKey
+	decoder := p.lineDecoders[key]
+	delete(p.lineDecoders, key)
+	return decoder
+}
+
+func (p *LogParser) putTargetDecoder(websiteID, targetKey string, decoder *targetDecoder) {
+	p.decoderMu.Lock()
+	defer p.decoderMu.Unlock()
+	if p.lineDecoders == nil {
+		p.lineDecoders = make(map[string]*targetDecoder)
+	}
+	p.lineDecoders[websiteID+"|"+targetKey] = decoder
+}
+
 func buildTargetStateKey(sourceID, key string) string {
 	if sourceID == "" {
 		return key
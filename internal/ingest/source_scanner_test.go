@@ -0,0 +1,91 @@
+package ingest
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/likaia/nginxpulse/internal/ingest/envelope"
+)
+
+// recordingDecoder 记录解码输出；测试中的网站没有配置，解码后的行不会入库
+type recordingDecoder struct {
+	envelope.Decoder
+	out []string
+}
+
+func (d *recordingDecoder) Decode(raw string) (string, bool) {
+	text, ok := d.Decoder.Decode(raw)
+	if ok {
+		d.out = append(d.out, text)
+	}
+	return text, ok
+}
+
+// TestParseDecodedLinesAcrossReads 一个 journald 条目、一个 docker 分片行被两次读取切开：
+// 沿用同一解码器时内容完整；settled 不越过未结束的条目，从该位置用新解码器重读也不丢内容
+func TestParseDecodedLinesAcrossReads(t *testing.T) {
+	tests := []struct {
+		name          string
+		opts          envelope.Options
+		first, second string
+		settled       string // first 中解码器没有缓存内容的前缀
+		want          []string
+	}{
+		{
+			name: "journald",
+			opts: envelope.Options{Format: envelope.FormatJournald},
+			first: "_SYSTEMD_UNIT=nginx.service\nMESSAGE=GET /a\n\n" +
+				"_SYSTEMD_UNIT=nginx.service\nMESSAGE\n\x0b\x00\x00\x00\x00\x00\x00\x00GET /b\r",
+			second:  "\nxyz\n\n",
+			settled: "_SYSTEMD_UNIT=nginx.service\nMESSAGE=GET /a\n\n",
+			want:    []string{"GET /a", "GET /b\r\nxyz"},
+		},
+		{
+			name:    "docker partial",
+			opts:    envelope.Options{Format: envelope.FormatDocker},
+			first:   `{"log":"GET /a\n","stream":"stdout"}` + "\n" + `{"log":"GET /lo","stream":"stdout"}` + "\n" + `{"log":"ng`,
+			second:  `\n","stream":"stdout"}` + "\n",
+			settled: `{"log":"GET /a\n","stream":"stdout"}` + "\n",
+			want:    []string{"GET /a", "GET /long"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &LogParser{}
+			result := &ParserResult{}
+			wantSettled := int64(len(tt.settled))
+
+			// 第一次读取：末尾未结束的半行不计入读取位置
+			decoder := &recordingDecoder{Decoder: envelope.NewDecoder(tt.opts)}
+			_, readBytes, settled, _, _ := p.parseDecodedLines(strings.NewReader(tt.first), decoder, "site", "", result, parseWindow{})
+			if want := int64(strings.LastIndex(tt.first, "\n") + 1); readBytes != want {
+				t.Fatalf("first read bytes = %d, want %d", readBytes, want)
+			}
+			second := tt.first[readBytes:] + tt.second
+			if !reflect.DeepEqual(decoder.out, tt.want[:1]) {
+				t.Fatalf("first read decoded = %q, want %q", decoder.out, tt.want[:1])
+			}
+			if settled != wantSettled {
+				t.Fatalf("first read settled = %d, want %d", settled, wantSettled)
+			}
+
+			// 第二次读取沿用同一解码器
+			_, readBytes, settled, _, _ = p.parseDecodedLines(strings.NewReader(second), decoder, "site", "", result, parseWindow{})
+			if readBytes != int64(len(second)) || settled != readBytes {
+				t.Fatalf("second read bytes = %d, settled = %d; want %d", readBytes, settled, len(second))
+			}
+			if !reflect.DeepEqual(decoder.out, tt.want) {
+				t.Fatalf("decoded = %q, want %q", decoder.out, tt.want)
+			}
+
+			// 重启后从持久化的 settled 位置用新解码器重读，得到完整的第二条
+			full := tt.first + tt.second
+			restarted := &recordingDecoder{Decoder: envelope.NewDecoder(tt.opts)}
+			p.parseDecodedLines(strings.NewReader(full[wantSettled:]), restarted, "site", "", result, parseWindow{})
+			if !reflect.DeepEqual(restarted.out, tt.want[1:]) {
+				t.Fatalf("decoded after restart = %q, want %q", restarted.out, tt.want[1:])
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package ingest
+
+import (
+	"context"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/ingest/source"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	streamRetryMin = time.Second
+	streamRetryMax = time.Minute
+)
+
+// RunStreamSources 为配置了消息队列来源（kafka / nats / redis）的站点启动消费者，直到 ctx 取消。
+// 每个来源一个 goroutine；来源配置在启动时读取，修改后需重启生效
+func (p *LogParser) RunStreamSources(ctx context.Context) {
+	if p.demoMode {
+		return
+	}
+	for _, websiteID := range config.GetAllWebsiteIDs() {
+		site, ok := config.GetWebsiteByID(websiteID)
+		if !ok {
+			continue
+		}
+		for _, srcCfg := range site.Sources {
+			if !source.IsStreamType(srcCfg.Type) {
+				continue
+			}
+			go p.consumeStream(ctx, websiteID, srcCfg)
+		}
+	}
+}
+
+// consumeStream 持续消费单个来源；出错后关闭连接，按指数退避重建，从上次提交的位点继续
+func (p *LogParser) consumeStream(ctx context.Context, websiteID string, srcCfg config.SourceConfig) {
+	backoff := streamRetryMin
+	failures := 0
+	for {
+		consumed, err := p.consumeStreamOnce(ctx, websiteID, srcCfg)
+		if ctx.Err() != nil {
+			return
+		}
+		if consumed {
+			backoff = streamRetryMin
+			failures = 0
+		}
+		failures++
+		logrus.WithError(err).Warnf("网站 %s 的消息队列来源 %s 消费中断，%s 后重试", websiteID, srcCfg.ID, backoff)
+		if failures == 1 {
+			p.notifyFileIO(websiteID, srcCfg.Type+":"+srcCfg.ID, "消费消息队列", err)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > streamRetryMax {
+			backoff = streamRetryMax
+		}
+	}
+}
+
+// consumeStreamOnce 建立连接并循环拉取、入库、提交，直到出错；consumed 表示期间至少提交过一个批次
+func (p *LogParser) consumeStreamOnce(ctx context.Context, websiteID string, srcCfg config.SourceConfig) (bool, error) {
+	src, err := source.NewStreamFromConfig(ctx, websiteID, srcCfg)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	logrus.Infof("网站 %s 的消息队列来源 %s (%s) 开始消费", websiteID, srcCfg.ID, src.Type())
+
+	return consumeStreamBatches(ctx, src, p.parseBatchSize, func(lines []string) error {
+		_, _, _, err := p.ingestLines(websiteID, srcCfg.ID, lines, nil, ingestOptions{atomic: true})
+		return err
+	})
+}
+
+// consumeStreamBatches 循环拉取批次交给 ingest，成功后提交位点，直到出错
+func consumeStreamBatches(
+	ctx context.Context, src source.StreamSource, batchSize int, ingest func(lines []string) error,
+) (bool, error) {
+	consumed := false
+	for {
+		batch, err := src.Fetch(ctx, batchSize)
+		if err != nil {
+			return consumed, err
+		}
+		if batch.Messages == 0 {
+			continue
+		}
+		// 入库失败时不提交位点，重建连接后这批消息会被重新投递
+		if err := ingest(batch.Lines); err != nil {
+			return consumed, err
+		}
+		if err := src.Commit(ctx, batch); err != nil {
+			return consumed, err
+		}
+		consumed = true
+	}
+}
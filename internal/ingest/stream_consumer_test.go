@@ -0,0 +1,192 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/likaia/nginxpulse/internal/ingest/source"
+)
+
+// testBroker 封装一个测试用消息队列：创建 source、投递消息、查询已投递未确认的消息数
+type testBroker struct {
+	newSource func(t *testing.T) source.StreamSource
+	publish   func(t *testing.T, payload string)
+	unacked   func(t *testing.T) int
+}
+
+func newRedisBroker(t *testing.T) testBroker {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	url := "redis://" + server.Addr() + "/0"
+	return testBroker{
+		newSource: func(t *testing.T) source.StreamSource {
+			src, err := source.NewRedisStreamSource(context.Background(), "site", "redis", url, "logs", "nginxpulse", "worker-1", "", "", true)
+			if err != nil {
+				t.Fatalf("NewRedisStreamSource: %v", err)
+			}
+			return src
+		},
+		publish: func(t *testing.T, payload string) {
+			err := client.XAdd(context.Background(), &redis.XAddArgs{
+				Stream: "logs",
+				Values: map[string]interface{}{"message": payload},
+			}).Err()
+			if err != nil {
+				t.Fatalf("XAdd: %v", err)
+			}
+		},
+		unacked: func(t *testing.T) int {
+			pending, err := client.XPending(context.Background(), "logs", "nginxpulse").Result()
+			if err != nil {
+				t.Fatalf("XPending: %v", err)
+			}
+			return int(pending.Count)
+		},
+	}
+}
+
+func newNATSBroker(t *testing.T) testBroker {
+	ctx := context.Background()
+	server, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      natsserver.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("nats server: %v", err)
+	}
+	go server.Start()
+	if !server.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(server.Shutdown)
+
+	conn, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatalf("nats connect: %v", err)
+	}
+	t.Cleanup(conn.Close)
+	js, err := jetstream.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: "LOGS", Subjects: []string{"logs.>"}}); err != nil {
+		t.Fatalf("create stream: %v", err)
+	}
+	// 缩短 AckWait 让未 ack 的消息尽快重新投递
+	consumer, err := js.CreateOrUpdateConsumer(ctx, "LOGS", jetstream.ConsumerConfig{
+		Durable:       "nginxpulse",
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+		FilterSubject: "logs.access",
+		AckWait:       200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("create consumer: %v", err)
+	}
+	return testBroker{
+		newSource: func(t *testing.T) source.StreamSource {
+			src, err := source.NewNATSSource(ctx, "site", "nats", server.ClientURL(), "LOGS", "logs.access", "nginxpulse", "", "", true)
+			if err != nil {
+				t.Fatalf("NewNATSSource: %v", err)
+			}
+			return src
+		},
+		publish: func(t *testing.T, payload string) {
+			if _, err := js.Publish(ctx, "logs.access", []byte(payload)); err != nil {
+				t.Fatalf("publish: %v", err)
+			}
+		},
+		unacked: func(t *testing.T) int {
+			info, err := consumer.Info(ctx)
+			if err != nil {
+				t.Fatalf("consumer info: %v", err)
+			}
+			return info.NumAckPending + int(info.NumPending)
+		},
+	}
+}
+
+// cancelOnCommit 在第一次提交成功后取消消费循环
+type cancelOnCommit struct {
+	source.StreamSource
+	cancel  context.CancelFunc
+	commits int
+}
+
+func (s *cancelOnCommit) Commit(ctx context.Context, batch *source.StreamBatch) error {
+	if err := s.StreamSource.Commit(ctx, batch); err != nil {
+		return err
+	}
+	s.commits++
+	s.cancel()
+	return nil
+}
+
+func TestConsumeStreamBatchesRedeliversAfterFailedIngest(t *testing.T) {
+	brokers := map[string]func(t *testing.T) testBroker{
+		"redis": newRedisBroker,
+		"nats":  newNATSBroker,
+	}
+	for name, newBroker := range brokers {
+		t.Run(name, func(t *testing.T) {
+			broker := newBroker(t)
+			broker.publish(t, "a\nb")
+
+			// 入库失败：不提交，消息仍处于未确认状态
+			errIngest := errors.New("ingest failed")
+			failed := 0
+			first := broker.newSource(t)
+			consumed, err := consumeStreamBatches(context.Background(), first, 1, func(lines []string) error {
+				failed++
+				return errIngest
+			})
+			first.Close()
+			if !errors.Is(err, errIngest) || consumed {
+				t.Fatalf("consumeStreamBatches = %t, %v; want false, %v", consumed, err, errIngest)
+			}
+			if failed != 1 {
+				t.Fatalf("ingest called %d times, want 1", failed)
+			}
+			if got := broker.unacked(t); got != 1 {
+				t.Fatalf("unacked after failed ingest = %d, want 1", got)
+			}
+
+			// 重建 source 后同一条消息被重新投递，入库成功后提交
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			second := &cancelOnCommit{StreamSource: broker.newSource(t), cancel: cancel}
+			defer second.Close()
+			var ingested []string
+			consumed, err = consumeStreamBatches(ctx, second, 1, func(lines []string) error {
+				ingested = append(ingested, lines...)
+				return nil
+			})
+			if !consumed || !errors.Is(err, context.Canceled) {
+				t.Fatalf("consumeStreamBatches = %t, %v; want true, context.Canceled", consumed, err)
+			}
+			if want := []string{"a", "b"}; !reflect.DeepEqual(ingested, want) {
+				t.Fatalf("ingested %v, want %v", ingested, want)
+			}
+			if second.commits != 1 {
+				t.Fatalf("commits = %d, want 1", second.commits)
+			}
+			if got := broker.unacked(t); got != 0 {
+				t.Fatalf("unacked after commit = %d, want 0", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/likaia/nginxpulse/internal/enrich"
+	"github.com/likaia/nginxpulse/internal/store"
+)
+
+const (
+	tailDefaultBuffer  = 256
+	tailMaxBuffer      = 4096
+	tailMaxSubscribers = 32
+)
+
+var ErrTailSubscriberLimit = errors.New("实时日志订阅数已达上限")
+
+// TailFilter 实时日志的订阅条件，空字段表示不过滤
+type TailFilter struct {
+	WebsiteID string
+	ip        net.IP
+	ipNet     *net.IPNet
+	url       *regexp.Regexp
+	statuses  []int // 3 位为精确状态码，1 位为状态类（如 5 表示 5xx）
+	userAgent string
+	location  string
+}
+
+// NewTailFilter 解析订阅条件：ip 为单个 IP 或 CIDR；urlPattern 为正则；
+// status 为逗号分隔的状态码或状态类（如 "404,5xx"）；ua 与 location 为不区分大小写的子串，
+// ua 同时匹配原始 User-Agent 与解析出的浏览器、系统、设备
+func NewTailFilter(websiteID, ip, urlPattern, status, ua, location string) (TailFilter, error) {
+	filter := TailFilter{
+		WebsiteID: websiteID,
+		userAgent: strings.ToLower(strings.TrimSpace(ua)),
+		location:  strings.ToLower(strings.TrimSpace(location)),
+	}
+	if ip = strings.TrimSpace(ip); ip != "" {
+		if strings.Contains(ip, "/") {
+			_, ipNet, err := net.ParseCIDR(ip)
+			if err != nil {
+				return filter, fmt.Errorf("IP 段格式不正确: %s", ip)
+			}
+			filter.ipNet = ipNet
+		} else if filter.ip = net.ParseIP(ip); filter.ip == nil {
+			return filter, fmt.Errorf("IP 格式不正确: %s", ip)
+		}
+	}
+	if urlPattern = strings.TrimSpace(urlPattern); urlPattern != "" {
+		re, err := regexp.Compile(urlPattern)
+		if err != nil {
+			return filter, fmt.Errorf("URL 正则无效: %v", err)
+		}
+		filter.url = re
+	}
+	for _, part := range strings.Split(status, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		if len(part) == 3 && strings.HasSuffix(part, "xx") {
+			part = part[:1]
+		}
+		code, err := strconv.Atoi(part)
+		if err != nil || !((code >= 1 && code <= 5) || (code >= 100 && code <= 599)) {
+			return filter, fmt.Errorf("状态码条件无效: %s", part)
+		}
+		filter.statuses = append(filter.statuses, code)
+	}
+	return filter, nil
+}
+
+func (f *TailFilter) match(record *store.NginxLogRecord) bool {
+	if f.ip != nil || f.ipNet != nil {
+		ip := net.ParseIP(record.IP)
+		if ip == nil {
+			return false
+		}
+		if f.ip != nil && !f.ip.Equal(ip) {
+			return false
+		}
+		if f.ipNet != nil && !f.ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.statuses) > 0 {
+		matched := false
+		for _, code := range f.statuses {
+			if code == record.Status || (code < 10 && record.Status/100 == code) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.url != nil && !f.url.MatchString(record.Url) {
+		return false
+	}
+	if f.userAgent != "" {
+		ua := strings.ToLower(record.UserAgent + " " + record.UserBrowser + " " + record.UserOs + " " + record.UserDevice)
+		if !strings.Contains(ua, f.userAgent) {
+			return false
+		}
+	}
+	if f.location != "" &&
+		!strings.Contains(strings.ToLower(record.DomesticLocation), f.location) &&
+		!strings.Contains(strings.ToLower(record.GlobalLocation), f.location) {
+		return false
+	}
+	return true
+}
+
+// TailSubscription 一个实时日志订阅；缓冲区满时丢弃新记录并计数，不阻塞入库
+type TailSubscription struct {
+	hub     *tailHub
+	filter  TailFilter
+	records chan store.NginxLogRecord
+	dropped atomic.Uint64
+	closed  bool
+}
+
+// Records 返回推送记录的通道；订阅关闭（包括服务关闭）后通道被关闭
+func (s *TailSubscription) Records() <-chan store.NginxLogRecord {
+	return s.records
+}
+
+// Dropped 因缓冲区已满被丢弃的记录数
+func (s *TailSubscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close 取消订阅，可重复调用
+func (s *TailSubscription) Close() {
+	s.hub.remove(s)
+}
+
+// tailHub 管理所有订阅；入库批次写入成功后按站点分发
+type tailHub struct {
+	mu     sync.RWMutex
+	subs   map[*TailSubscription]struct{}
+	active atomic.Int32
+}
+
+func (h *tailHub) remove(sub *TailSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(h.subs, sub)
+	h.active.Add(-1)
+	close(sub.records)
+}
+
+// SubscribeTail 订阅新入库的日志；buffer 为缓冲记录数，<=0 时使用默认值
+func (p *LogParser) SubscribeTail(filter TailFilter, buffer int) (*TailSubscription, error) {
+	if buffer <= 0 {
+		buffer = tailDefaultBuffer
+	}
+	if buffer > tailMaxBuffer {
+		buffer = tailMaxBuffer
+	}
+	hub := &p.tail
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.subs) >= tailMaxSubscribers {
+		return nil, ErrTailSubscriberLimit
+	}
+	if hub.subs == nil {
+		hub.subs = make(map[*TailSubscription]struct{})
+	}
+	sub := &TailSubscription{
+		hub:     hub,
+		filter:  filter,
+		records: make(chan store.NginxLogRecord, buffer),
+	}
+	hub.subs[sub] = struct{}{}
+	hub.active.Add(1)
+	return sub, nil
+}
+
+// CloseTailSubscriptions 关闭全部订阅，服务关闭时调用以结束长连接
+func (p *LogParser) CloseTailSubscriptions() {
+	p.tail.mu.RLock()
+	subs := make([]*TailSubscription, 0, len(p.tail.subs))
+	for sub := range p.tail.subs {
+		subs = append(subs, sub)
+	}
+	p.tail.mu.RUnlock()
+	for _, sub := range subs {
+		sub.Close()
+	}
+}
+
+// publishTail 将已落库的批次推送给订阅者。入库时归属地尚未解析（“待解析”），
+// 这里只查内存缓存与本地 IP 库补全，不请求远端
+func (p *LogParser) publishTail(websiteID string, batch []store.NginxLogRecord) {
+	if p.tail.active.Load() == 0 || len(batch) == 0 {
+		return
+	}
+	p.tail.mu.RLock()
+	defer p.tail.mu.RUnlock()
+
+	var subs []*TailSubscription
+	for sub := range p.tail.subs {
+		if sub.filter.WebsiteID == websiteID {
+			subs = append(subs, sub)
+		}
+	}
+	if len(subs) == 0 {
+		return
+	}
+
+	for i := range batch {
+		record := batch[i]
+		if record.DomesticLocation == pendingLocationLabel {
+			if domestic, global, ok := enrich.LookupIPLocationLocal(record.IP); ok {
+				record.DomesticLocation = domestic
+				record.GlobalLocation = global
+			}
+		}
+		for _, sub := range subs {
+			if !sub.filter.match(&record) {
+				continue
+			}
+			select {
+			case sub.records <- record:
+			default:
+				sub.dropped.Add(1)
+			}
+		}
+	}
+}
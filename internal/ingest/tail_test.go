@@ -0,0 +1,105 @@
+package ingest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/store"
+)
+
+func TestNewTailFilterRejectsInvalidConditions(t *testing.T) {
+	tests := []struct {
+		name            string
+		ip, url, status string
+	}{
+		{name: "ip", ip: "1.2.3"},
+		{name: "cidr", ip: "10.0.0.0/33"},
+		{name: "url", url: "("},
+		{name: "status", status: "200,abc"},
+		{name: "status class", status: "6xx"},
+	}
+	for _, tt := range tests {
+		if _, err := NewTailFilter("site", tt.ip, tt.url, tt.status, "", ""); err == nil {
+			t.Errorf("%s: NewTailFilter accepted an invalid condition", tt.name)
+		}
+	}
+}
+
+func TestTailFilterMatch(t *testing.T) {
+	record := store.NginxLogRecord{
+		IP:               "10.1.2.3",
+		Url:              "/api/orders",
+		Status:           502,
+		UserAgent:        "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+		UserBrowser:      "Googlebot",
+		UserOs:           "Other",
+		UserDevice:       "Spider",
+		DomesticLocation: "浙江·杭州",
+		GlobalLocation:   "中国",
+	}
+	tests := []struct {
+		name                          string
+		ip, url, status, ua, location string
+		want                          bool
+	}{
+		{name: "no filter", want: true},
+		{name: "ip", ip: "10.1.2.3", want: true},
+		{name: "other ip", ip: "10.1.2.4"},
+		{name: "cidr", ip: "10.0.0.0/8", want: true},
+		{name: "status code", status: "404, 502", want: true},
+		{name: "status class", status: "5xx", want: true},
+		{name: "other status", status: "4xx,200"},
+		{name: "url", url: "^/api/", want: true},
+		{name: "other url", url: "^/admin"},
+		{name: "raw user agent", ua: "google.com/bot", want: true},
+		{name: "parsed device", ua: "SPIDER", want: true},
+		{name: "other user agent", ua: "curl"},
+		{name: "domestic location", location: "杭州", want: true},
+		{name: "global location", location: "中国", want: true},
+		{name: "other location", location: "美国"},
+		{name: "all conditions", ip: "10.0.0.0/8", url: "orders", status: "5", ua: "googlebot", location: "浙江", want: true},
+	}
+	for _, tt := range tests {
+		filter, err := NewTailFilter("site", tt.ip, tt.url, tt.status, tt.ua, tt.location)
+		if err != nil {
+			t.Fatalf("%s: NewTailFilter: %v", tt.name, err)
+		}
+		if got := filter.match(&record); got != tt.want {
+			t.Errorf("%s: match = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestPublishTailMatchesRawUserAgent 解析结果只有 Windows / Chrome，Win64 只出现在原始 User-Agent 中
+func TestPublishTailMatchesRawUserAgent(t *testing.T) {
+	p := &LogParser{}
+	var batch []store.NginxLogRecord
+	for _, ua := range []string{"curl/8.4.0", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/120.0 Safari/537.36", ""} {
+		record, err := p.buildLogRecord("1.2.3.4", "GET", "/", "", ua, 200, 0, time.Now())
+		if err != nil {
+			t.Fatalf("buildLogRecord: %v", err)
+		}
+		batch = append(batch, *record)
+	}
+	filter, err := NewTailFilter("site", "", "", "", "WIN64", "")
+	if err != nil {
+		t.Fatalf("NewTailFilter: %v", err)
+	}
+	sub, err := p.SubscribeTail(filter, 0)
+	if err != nil {
+		t.Fatalf("SubscribeTail: %v", err)
+	}
+	defer sub.Close()
+
+	p.publishTail("other", batch)
+	p.publishTail("site", batch)
+	if got := len(sub.Records()); got != 1 {
+		t.Fatalf("received %d records, want 1", got)
+	}
+	record := <-sub.Records()
+	if record.UserAgent != batch[1].UserAgent || strings.Contains(strings.ToLower(record.UserBrowser+record.UserOs+record.UserDevice), "win64") {
+		t.Errorf("received %q parsed as %s/%s/%s, want the Win64 user agent matched by its raw value",
+			record.UserAgent, record.UserBrowser, record.UserOs, record.UserDevice)
+	}
+}
@@ -0,0 +1,43 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/enrich"
+	"github.com/likaia/nginxpulse/internal/store"
+)
+
+var ErrURLNormalizeDisabled = errors.New("站点未启用 URL 归一化")
+
+func (p *LogParser) normalizeRecordURL(websiteID string, record *store.NginxLogRecord) {
+	if record == nil {
+		return
+	}
+	normalizer := p.urlNormalizers[websiteID]
+	if normalizer == nil {
+		return
+	}
+	raw := record.Url
+	record.Url = normalizer.Normalize(raw)
+	if normalizer.KeepRaw() && record.Url != raw {
+		record.RawUrl = raw
+	}
+}
+
+// RenormalizeURLs 使用当前配置对指定网站已入库的 URL 维表重新归一化
+func (p *LogParser) RenormalizeURLs(websiteID string) (int, error) {
+	site, ok := config.GetWebsiteByID(websiteID)
+	if !ok {
+		return 0, fmt.Errorf("未找到网站配置: %s", websiteID)
+	}
+	normalizer, err := enrich.NewURLNormalizer(site.URLNormalize)
+	if err != nil {
+		return 0, err
+	}
+	if normalizer == nil {
+		return 0, ErrURLNormalizeDisabled
+	}
+	return p.repo.RenormalizeURLs(websiteID, normalizer.Normalize, normalizer.KeepRaw())
+}
@@ -10,7 +10,11 @@ import (
 
 const accessKeyHeader = "X-NginxPulse-Key"
 
-func accessKeyMiddleware() gin.HandlerFunc {
+// tailPath 实时日志使用 EventSource 连接，无法携带请求头，允许通过查询参数传递访问密钥
+const tailPath = "/api/logs/tail"
+
+// loadAccessKeys 读取配置中的访问密钥，为空表示不启用鉴权
+func loadAccessKeys() map[string]struct{} {
 	cfg := config.ReadConfig()
 	keys := make(map[string]struct{})
 	for _, key := range cfg.System.AccessKeys {
@@ -20,7 +24,11 @@ func accessKeyMiddleware() gin.HandlerFunc {
 		}
 		keys[key] = struct{}{}
 	}
+	return keys
+}
 
+func accessKeyMiddleware() gin.HandlerFunc {
+	keys := loadAccessKeys()
 	if len(keys) == 0 {
 		return func(c *gin.Context) {
 			c.Next()
@@ -38,6 +46,9 @@ func accessKeyMiddleware() gin.HandlerFunc {
 		}
 
 		value := strings.TrimSpace(c.GetHeader(accessKeyHeader))
+		if value == "" && c.Request.URL.Path == tailPath {
+			value = strings.TrimSpace(c.Query("accessKey"))
+		}
 		if value == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": "需要访问密钥",
@@ -21,6 +21,10 @@ func StartHTTPServer(statsFactory *analytics.StatsFactory, logParser *ingest.Log
 		Addr:    addr,
 		Handler: router,
 	}
+	if logParser != nil {
+		// Shutdown 不会中断长连接，先关闭实时日志订阅让 SSE 请求返回
+		server.RegisterOnShutdown(logParser.CloseTailSubscriptions)
+	}
 
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -72,7 +76,7 @@ func requestLogger() gin.HandlerFunc {
 			return
 		}
 
-		if strings.HasPrefix(path, "/api/") && duration > 100*time.Millisecond {
+		if strings.HasPrefix(path, "/api/") && path != tailPath && duration > 100*time.Millisecond {
 			logrus.Warnf("高延迟 %s %s %d %s %v",
 				c.Request.Method, path, status, c.ClientIP(), duration)
 		}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/likaia/nginxpulse/internal/analytics"
+	"github.com/likaia/nginxpulse/internal/ingest"
+	"github.com/likaia/nginxpulse/internal/web"
+	"github.com/sirupsen/logrus"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// otlpMaxRecvBytes gRPC 单个请求的大小上限，与 HTTP 推送一致
+const otlpMaxRecvBytes = 64 << 20
+
+// otlpLogsService 实现 OTLP LogsService；访问密钥通过 metadata x-nginxpulse-key 传递
+type otlpLogsService struct {
+	collogspb.UnimplementedLogsServiceServer
+	statsFactory *analytics.StatsFactory
+	logParser    *ingest.LogParser
+	keys         map[string]struct{}
+}
+
+// StartOTLPGRPCServer 在 addr 上启动 OTLP/gRPC 日志接收服务；addr 为空时不启动，返回 nil
+func StartOTLPGRPCServer(statsFactory *analytics.StatsFactory, logParser *ingest.LogParser, addr string) (*grpc.Server, error) {
+	if strings.TrimSpace(addr) == "" || logParser == nil {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server := grpc.NewServer(grpc.MaxRecvMsgSize(otlpMaxRecvBytes))
+	collogspb.RegisterLogsServiceServer(server, &otlpLogsService{
+		statsFactory: statsFactory,
+		logParser:    logParser,
+		keys:         loadAccessKeys(),
+	})
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logrus.WithError(err).Error("OTLP gRPC 服务运行失败")
+		}
+	}()
+
+	logrus.Infof("OTLP gRPC 服务已启动，监听地址: %s", addr)
+	return server, nil
+}
+
+func (s *otlpLogsService) Export(
+	ctx context.Context, req *collogspb.ExportLogsServiceRequest,
+) (*collogspb.ExportLogsServiceResponse, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	result, err := s.logParser.IngestOTLPLogs(req)
+	if err != nil {
+		logrus.WithError(err).Error("OTLP 日志写入失败")
+		// Unavailable 属于 OTLP 规定的可重试错误
+		return nil, status.Errorf(codes.Unavailable, "写入失败: %v", err)
+	}
+	if result.Accepted > 0 && s.statsFactory != nil {
+		s.statsFactory.ClearCache()
+	}
+	return web.NewOTLPLogsResponse(result), nil
+}
+
+func (s *otlpLogsService) authorize(ctx context.Context) error {
+	if len(s.keys) == 0 {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(strings.ToLower(accessKeyHeader))
+	if len(values) == 0 || strings.TrimSpace(values[0]) == "" {
+		return status.Error(codes.Unauthenticated, "需要访问密钥")
+	}
+	if _, ok := s.keys[strings.TrimSpace(values[0])]; !ok {
+		return status.Error(codes.Unauthenticated, "访问密钥无效")
+	}
+	return nil
+}
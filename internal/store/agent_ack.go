@@ -0,0 +1,122 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+)
+
+// ErrDuplicateBatch agent 批次序号不大于已确认序号，说明是重发的批次
+var ErrDuplicateBatch = errors.New("批次已确认")
+
+// AgentFileOffset agent 侧文件读取位置，随批次一起确认，便于 agent 丢失本地状态后恢复
+type AgentFileOffset struct {
+	Path   string `json:"path"`
+	Dev    uint64 `json:"dev,omitempty"`
+	Ino    uint64 `json:"ino,omitempty"`
+	Offset int64  `json:"offset"`
+}
+
+// AgentAck 每个 agent 在每个站点上已确认的最大批次序号
+type AgentAck struct {
+	AgentID   string            `json:"agent_id"`
+	WebsiteID string            `json:"website_id"`
+	Seq       int64             `json:"seq"`
+	Files     []AgentFileOffset `json:"files"`
+	UpdatedAt int64             `json:"updated_at"`
+}
+
+func (r *Repository) ensureAgentAckTable() error {
+	_, err := r.db.Exec(`CREATE TABLE IF NOT EXISTS "agent_acks" (
+            agent_id TEXT NOT NULL,
+            website_id TEXT NOT NULL,
+            last_seq BIGINT NOT NULL DEFAULT 0,
+            files JSONB,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (agent_id, website_id)
+        )`)
+	return err
+}
+
+// GetAgentAck 查询 agent 已确认的序号与文件位置，没有记录时返回零值
+func (r *Repository) GetAgentAck(agentID, websiteID string) (AgentAck, error) {
+	ack := AgentAck{AgentID: agentID, WebsiteID: websiteID}
+	var files sql.NullString
+	var updatedAt sql.NullInt64
+	err := r.db.QueryRow(sqlutil.ReplacePlaceholders(
+		`SELECT last_seq, files, EXTRACT(EPOCH FROM updated_at)::BIGINT
+        FROM "agent_acks" WHERE agent_id = ? AND website_id = ?`,
+	), agentID, websiteID).Scan(&ack.Seq, &files, &updatedAt)
+	if err == sql.ErrNoRows {
+		return ack, nil
+	}
+	if err != nil {
+		return ack, err
+	}
+	ack.UpdatedAt = updatedAt.Int64
+	if files.Valid && files.String != "" {
+		if err := json.Unmarshal([]byte(files.String), &ack.Files); err != nil {
+			return ack, err
+		}
+	}
+	return ack, nil
+}
+
+// AckAgentBatch 记录没有可入库日志的批次（例如整批解析失败），同样需要推进序号
+func (r *Repository) AckAgentBatch(ack AgentAck) (err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if err = lockAgentAck(tx, ack); err != nil {
+		return err
+	}
+	if err = saveAgentAck(tx, ack); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockAgentAck 锁定 agent 的确认行；同一 agent 的并发重试会在此排队，
+// 等前一个事务提交后再判断序号，保证同一批次只入库一次
+func lockAgentAck(tx *sql.Tx, ack AgentAck) error {
+	if _, err := tx.Exec(sqlutil.ReplacePlaceholders(
+		`INSERT INTO "agent_acks" (agent_id, website_id) VALUES (?, ?)
+        ON CONFLICT (agent_id, website_id) DO NOTHING`,
+	), ack.AgentID, ack.WebsiteID); err != nil {
+		return err
+	}
+	var lastSeq int64
+	if err := tx.QueryRow(sqlutil.ReplacePlaceholders(
+		`SELECT last_seq FROM "agent_acks" WHERE agent_id = ? AND website_id = ? FOR UPDATE`,
+	), ack.AgentID, ack.WebsiteID).Scan(&lastSeq); err != nil {
+		return err
+	}
+	if ack.Seq <= lastSeq {
+		return ErrDuplicateBatch
+	}
+	return nil
+}
+
+func saveAgentAck(tx *sql.Tx, ack AgentAck) error {
+	var files interface{}
+	if len(ack.Files) > 0 {
+		data, err := json.Marshal(ack.Files)
+		if err != nil {
+			return err
+		}
+		files = string(data)
+	}
+	_, err := tx.Exec(sqlutil.ReplacePlaceholders(
+		`UPDATE "agent_acks" SET last_seq = ?, files = COALESCE(?::jsonb, files), updated_at = NOW()
+        WHERE agent_id = ? AND website_id = ?`,
+	), ack.Seq, files, ack.AgentID, ack.WebsiteID)
+	return err
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+)
+
+// ErrAgentNotFound agent 尚未注册
+var ErrAgentNotFound = errors.New("agent 不存在")
+
+// AgentRouteStatus agent 上报的单个站点推送状态
+type AgentRouteStatus struct {
+	WebsiteID    string `json:"website_id"`
+	SourceID     string `json:"source_id"`
+	Files        int    `json:"files"`
+	LagBytes     int64  `json:"lag_bytes"`
+	PendingLines int    `json:"pending_lines"`
+	SpoolBytes   int64  `json:"spool_bytes"`
+	Failures     int    `json:"failures"`
+	Dropped      int64  `json:"dropped_lines,omitempty"`     // 按过滤规则丢弃的行数
+	SampledOut   int64  `json:"sampled_out_lines,omitempty"` // 采样未保留的行数
+	LastPushAt   int64  `json:"last_push_at,omitempty"`
+	LastError    string `json:"last_error,omitempty"`
+}
+
+// AgentInfo 已注册的 agent、最近一次心跳上报的状态以及下发给它的远程配置
+type AgentInfo struct {
+	AgentID              string             `json:"agent_id"`
+	Hostname             string             `json:"hostname"`
+	Version              string             `json:"version"`
+	HeartbeatInterval    int64              `json:"heartbeat_interval"` // 秒
+	Paths                []string           `json:"paths"`
+	Routes               []AgentRouteStatus `json:"routes"`
+	LagBytes             int64              `json:"lag_bytes"`
+	LastPushAt           int64              `json:"last_push_at"`
+	Config               json.RawMessage    `json:"config,omitempty"`
+	ConfigVersion        int64              `json:"config_version"`
+	AppliedConfigVersion int64              `json:"applied_config_version"`
+	RegisteredAt         int64              `json:"registered_at"`
+	LastSeenAt           int64              `json:"last_seen_at"`
+	Silent               bool               `json:"silent"` // 已因超时未上报发出过失联通知
+}
+
+func (r *Repository) ensureAgentsTable() error {
+	_, err := r.db.Exec(`CREATE TABLE IF NOT EXISTS "agents" (
+            agent_id TEXT PRIMARY KEY,
+            hostname TEXT NOT NULL DEFAULT '',
+            version TEXT NOT NULL DEFAULT '',
+            heartbeat_interval INTEGER NOT NULL DEFAULT 0,
+            paths JSONB,
+            routes JSONB,
+            lag_bytes BIGINT NOT NULL DEFAULT 0,
+            last_push_at TIMESTAMPTZ,
+            config JSONB,
+            config_version BIGINT NOT NULL DEFAULT 0,
+            applied_config_version BIGINT NOT NULL DEFAULT 0,
+            registered_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            silent_notified BOOLEAN NOT NULL DEFAULT FALSE
+        )`)
+	return err
+}
+
+const agentColumns = `agent_id, hostname, version, heartbeat_interval, paths, routes, lag_bytes,
+        COALESCE(EXTRACT(EPOCH FROM last_push_at)::BIGINT, 0), config, config_version, applied_config_version,
+        EXTRACT(EPOCH FROM registered_at)::BIGINT, EXTRACT(EPOCH FROM last_seen_at)::BIGINT, silent_notified`
+
+type agentScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAgent(row agentScanner) (AgentInfo, error) {
+	var (
+		info   AgentInfo
+		paths  sql.NullString
+		routes sql.NullString
+		cfg    sql.NullString
+	)
+	if err := row.Scan(
+		&info.AgentID, &info.Hostname, &info.Version, &info.HeartbeatInterval, &paths, &routes, &info.LagBytes,
+		&info.LastPushAt, &cfg, &info.ConfigVersion, &info.AppliedConfigVersion,
+		&info.RegisteredAt, &info.LastSeenAt, &info.Silent,
+	); err != nil {
+		return info, err
+	}
+	if paths.Valid && paths.String != "" {
+		if err := json.Unmarshal([]byte(paths.String), &info.Paths); err != nil {
+			return info, err
+		}
+	}
+	if routes.Valid && routes.String != "" {
+		if err := json.Unmarshal([]byte(routes.String), &info.Routes); err != nil {
+			return info, err
+		}
+	}
+	if cfg.Valid && cfg.String != "" {
+		info.Config = json.RawMessage(cfg.String)
+	}
+	return info, nil
+}
+
+// RecordAgentHeartbeat 注册或更新 agent 状态，返回包含当前远程配置的完整记录
+func (r *Repository) RecordAgentHeartbeat(info AgentInfo) (AgentInfo, error) {
+	paths, err := json.Marshal(info.Paths)
+	if err != nil {
+		return info, err
+	}
+	routes, err := json.Marshal(info.Routes)
+	if err != nil {
+		return info, err
+	}
+	var lastPushAt interface{}
+	if info.LastPushAt > 0 {
+		lastPushAt = info.LastPushAt
+	}
+	row := r.db.QueryRow(sqlutil.ReplacePlaceholders(
+		`INSERT INTO "agents" (agent_id, hostname, version, heartbeat_interval, paths, routes, lag_bytes,
+            last_push_at, applied_config_version)
+        VALUES (?, ?, ?, ?, ?::jsonb, ?::jsonb, ?, to_timestamp(?::BIGINT), ?)
+        ON CONFLICT (agent_id) DO UPDATE SET
+            hostname = EXCLUDED.hostname,
+            version = EXCLUDED.version,
+            heartbeat_interval = EXCLUDED.heartbeat_interval,
+            paths = EXCLUDED.paths,
+            routes = EXCLUDED.routes,
+            lag_bytes = EXCLUDED.lag_bytes,
+            last_push_at = COALESCE(EXCLUDED.last_push_at, "agents".last_push_at),
+            applied_config_version = EXCLUDED.applied_config_version,
+            last_seen_at = NOW(),
+            silent_notified = FALSE
+        RETURNING `+agentColumns,
+	), info.AgentID, info.Hostname, info.Version, info.HeartbeatInterval, string(paths), string(routes),
+		info.LagBytes, lastPushAt, info.AppliedConfigVersion)
+	return scanAgent(row)
+}
+
+// ListAgents 按 agent ID 排序返回所有已注册的 agent
+func (r *Repository) ListAgents() ([]AgentInfo, error) {
+	rows, err := r.db.Query(`SELECT ` + agentColumns + ` FROM "agents" ORDER BY agent_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	agents := make([]AgentInfo, 0)
+	for rows.Next() {
+		info, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, info)
+	}
+	return agents, rows.Err()
+}
+
+// GetAgent 查询单个 agent
+func (r *Repository) GetAgent(agentID string) (AgentInfo, error) {
+	info, err := scanAgent(r.db.QueryRow(sqlutil.ReplacePlaceholders(
+		`SELECT `+agentColumns+` FROM "agents" WHERE agent_id = ?`,
+	), agentID))
+	if err == sql.ErrNoRows {
+		return info, ErrAgentNotFound
+	}
+	return info, err
+}
+
+// SetAgentConfig 更新下发给 agent 的远程配置并递增版本号；config 为空表示清除远程配置
+func (r *Repository) SetAgentConfig(agentID string, config json.RawMessage) (int64, error) {
+	var value interface{}
+	if len(config) > 0 {
+		value = string(config)
+	}
+	var version int64
+	err := r.db.QueryRow(sqlutil.ReplacePlaceholders(
+		`UPDATE "agents" SET config = ?::jsonb, config_version = config_version + 1
+        WHERE agent_id = ? RETURNING config_version`,
+	), value, agentID).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, ErrAgentNotFound
+	}
+	return version, err
+}
+
+// DeleteAgent 移除 agent 记录；agent 仍在运行时下次心跳会重新注册
+func (r *Repository) DeleteAgent(agentID string) error {
+	result, err := r.db.Exec(sqlutil.ReplacePlaceholders(
+		`DELETE FROM "agents" WHERE agent_id = ?`,
+	), agentID)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrAgentNotFound
+	}
+	return nil
+}
+
+// MarkSilentAgents 把超过 silentAfter 秒（且超过 3 个心跳周期）未上报的 agent 标记为失联，
+// 返回本次新标记的 agent；已标记的 agent 恢复心跳前不会重复返回
+func (r *Repository) MarkSilentAgents(silentAfter int64) ([]AgentInfo, error) {
+	rows, err := r.db.Query(sqlutil.ReplacePlaceholders(
+		`UPDATE "agents" SET silent_notified = TRUE
+        WHERE silent_notified = FALSE
+          AND last_seen_at < NOW() - make_interval(secs => GREATEST(?::BIGINT, heartbeat_interval * 3))
+        RETURNING `+agentColumns,
+	), silentAfter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	agents := make([]AgentInfo, 0)
+	for rows.Next() {
+		info, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, info)
+	}
+	return agents, rows.Err()
+}
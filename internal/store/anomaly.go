@@ -0,0 +1,232 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+	"github.com/likaia/nginxpulse/internal/store/hll"
+)
+
+// HourlyMetricPoint 小时级指标（来自小时聚合表），用于异常检测建模
+type HourlyMetricPoint struct {
+	Bucket int64
+	PV     int64
+	UV     int64
+	S5xx   int64
+}
+
+// TrafficAnomaly 检测到的流量异常
+type TrafficAnomaly struct {
+	ID        int64     `json:"id"`
+	Bucket    int64     `json:"bucket"`    // 小时桶起始时间（Unix 秒）
+	Metric    string    `json:"metric"`    // pv / uv / s5xx
+	Value     float64   `json:"value"`     // 实际值
+	Baseline  float64   `json:"baseline"`  // 季节性基线（中位数）
+	Score     float64   `json:"score"`     // 鲁棒 z 分数，正为突增、负为骤降
+	Direction string    `json:"direction"` // spike / drop
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func createAnomalyTable(execer sqlExecer, websiteID string) error {
+	stmts := []string{
+		fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS "%s_anomalies" (
+                id BIGSERIAL PRIMARY KEY,
+                bucket BIGINT NOT NULL,
+                metric TEXT NOT NULL,
+                value DOUBLE PRECISION NOT NULL,
+                baseline DOUBLE PRECISION NOT NULL,
+                score DOUBLE PRECISION NOT NULL,
+                direction TEXT NOT NULL,
+                created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+                UNIQUE(bucket, metric)
+            )`, websiteID,
+		),
+	}
+	for _, stmt := range stmts {
+		if _, err := execer.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetHourlyMetrics 读取 [start, end] 范围内的小时聚合，没有记录的小时不返回；
+// 近似计数与 ClickHouse 站点的 UV 取自小时草图的估计值
+func (r *Repository) GetHourlyMetrics(websiteID string, start, end int64) ([]HourlyMetricPoint, error) {
+	if ch := r.ClickHouse(websiteID); ch != nil {
+		return ch.HourlyMetrics(websiteID, start, end)
+	}
+	approximate := UVApproximate(websiteID)
+	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT h.bucket, h.pv, h.s5xx, COALESCE(u.uv, 0)
+         FROM "%[1]s_agg_hourly" h
+         LEFT JOIN (
+             SELECT bucket, COUNT(*) AS uv
+             FROM "%[1]s_agg_hourly_ip"
+             WHERE bucket >= ? AND bucket <= ?
+             GROUP BY bucket
+         ) u ON u.bucket = h.bucket
+         WHERE h.bucket >= ? AND h.bucket <= ?
+         ORDER BY h.bucket`,
+		websiteID,
+	))
+	if approximate {
+		query = sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`SELECT h.bucket, h.pv, h.s5xx, u.uv_sketch
+             FROM "%s" h
+             LEFT JOIN "%s" u ON u.bucket = h.bucket AND u.bucket >= ? AND u.bucket <= ?
+             WHERE h.bucket >= ? AND h.bucket <= ?
+             ORDER BY h.bucket`,
+			fmt.Sprintf("%s_agg_hourly", websiteID), UVSketchTable(websiteID, "hourly"),
+		))
+	}
+	rows, err := r.db.Query(query, start, end, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := make([]HourlyMetricPoint, 0)
+	for rows.Next() {
+		var point HourlyMetricPoint
+		if !approximate {
+			if err := rows.Scan(&point.Bucket, &point.PV, &point.S5xx, &point.UV); err != nil {
+				return nil, err
+			}
+			points = append(points, point)
+			continue
+		}
+		var raw []byte
+		if err := rows.Scan(&point.Bucket, &point.PV, &point.S5xx, &raw); err != nil {
+			return nil, err
+		}
+		if sketch, err := hll.Decode(raw); err == nil {
+			point.UV = int64(sketch.Estimate())
+		}
+		points = append(points, point)
+	}
+	return points, rows.Err()
+}
+
+// GetFirstHourlyBucket 返回小时聚合中最早的桶，无数据时返回 0
+func (r *Repository) GetFirstHourlyBucket(websiteID string) (int64, error) {
+	if ch := r.ClickHouse(websiteID); ch != nil {
+		return ch.firstHourlyBucket(websiteID)
+	}
+	var bucket int64
+	err := r.db.QueryRow(fmt.Sprintf(
+		`SELECT COALESCE(MIN(bucket), 0) FROM "%s_agg_hourly"`, websiteID,
+	)).Scan(&bucket)
+	return bucket, err
+}
+
+// SaveTrafficAnomalies 写入异常记录（同一小时同一指标只保留一条，重复检测时更新数值），
+// 返回首次写入的记录，用于决定是否发送通知
+func (r *Repository) SaveTrafficAnomalies(websiteID string, anomalies []TrafficAnomaly) ([]TrafficAnomaly, error) {
+	if len(anomalies) == 0 {
+		return nil, nil
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := tx.Prepare(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`INSERT INTO "%[1]s_anomalies" (bucket, metric, value, baseline, score, direction)
+         VALUES (?, ?, ?, ?, ?, ?)
+         ON CONFLICT(bucket, metric) DO UPDATE SET
+             value = excluded.value,
+             baseline = excluded.baseline,
+             score = excluded.score,
+             direction = excluded.direction
+         RETURNING id, created_at, (xmax = 0) AS inserted`,
+		websiteID,
+	)))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	defer stmt.Close()
+
+	created := make([]TrafficAnomaly, 0)
+	for _, anomaly := range anomalies {
+		var inserted bool
+		if err := stmt.QueryRow(
+			anomaly.Bucket, anomaly.Metric, anomaly.Value, anomaly.Baseline, anomaly.Score, anomaly.Direction,
+		).Scan(&anomaly.ID, &anomaly.CreatedAt, &inserted); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if inserted {
+			created = append(created, anomaly)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// DeleteTrafficAnomalies 删除 [start, end] 内不在 keep 中的异常（重新检测后已恢复正常的点）
+func (r *Repository) DeleteTrafficAnomalies(websiteID string, start, end int64, keep []TrafficAnomaly) error {
+	keepKeys := make(map[string]struct{}, len(keep))
+	for _, anomaly := range keep {
+		keepKeys[fmt.Sprintf("%d:%s", anomaly.Bucket, anomaly.Metric)] = struct{}{}
+	}
+	existing, err := r.ListTrafficAnomalies(websiteID, start, end)
+	if err != nil {
+		return err
+	}
+	for _, anomaly := range existing {
+		if _, ok := keepKeys[fmt.Sprintf("%d:%s", anomaly.Bucket, anomaly.Metric)]; ok {
+			continue
+		}
+		if _, err := r.db.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`DELETE FROM "%s_anomalies" WHERE id = ?`, websiteID,
+		)), anomaly.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListTrafficAnomalies 查询 [start, end] 内的异常，按时间排序
+func (r *Repository) ListTrafficAnomalies(websiteID string, start, end int64) ([]TrafficAnomaly, error) {
+	rows, err := r.db.Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT id, bucket, metric, value, baseline, score, direction, created_at
+         FROM "%s_anomalies"
+         WHERE bucket >= ? AND bucket <= ?
+         ORDER BY bucket, metric`,
+		websiteID,
+	)), start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	anomalies := make([]TrafficAnomaly, 0)
+	for rows.Next() {
+		var anomaly TrafficAnomaly
+		if err := rows.Scan(
+			&anomaly.ID, &anomaly.Bucket, &anomaly.Metric, &anomaly.Value,
+			&anomaly.Baseline, &anomaly.Score, &anomaly.Direction, &anomaly.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		anomalies = append(anomalies, anomaly)
+	}
+	return anomalies, rows.Err()
+}
+
+func (r *Repository) cleanupAnomalies(websiteID string, cutoff time.Time) error {
+	_, err := r.db.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`DELETE FROM "%s_anomalies" WHERE bucket < ?`, websiteID,
+	)), cutoff.Unix())
+	return err
+}
+
+func (r *Repository) clearAnomaliesForWebsite(websiteID string) error {
+	_, err := r.db.Exec(fmt.Sprintf(`DELETE FROM "%s_anomalies"`, websiteID))
+	return err
+}
@@ -0,0 +1,463 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+	"github.com/likaia/nginxpulse/internal/store/hll"
+)
+
+// bulkInsertMinRows 少于该条数时临时表的开销大于收益，仍走逐行写入
+const bulkInsertMinRows = 500
+
+const (
+	bulkStagingTable  = "bulk_logs"     // COPY 写入的原始字段
+	bulkResolvedTable = "bulk_resolved" // 换算为维表 ID 后的行
+)
+
+var bulkStagingColumns = []string{
+	"seq", "ip", "pageview_flag", "ts", "hour_bucket", "day", "method", "url", "raw_url",
+	"status_code", "bytes_sent", "referer", "referer_host", "referer_channel", "referer_source",
+	"referer_keyword", "browser", "os", "device", "domestic", "global", "sample_rate",
+}
+
+// bulkCountColumns 与 addCounts 一致：pv/traffic 只计 pageview，状态码分类计全部请求，均按采样倍数加权
+const bulkCountColumns = `
+    SUM(CASE WHEN pageview_flag = 1 THEN sample_rate ELSE 0 END),
+    SUM(CASE WHEN pageview_flag = 1 THEN bytes_sent * sample_rate ELSE 0 END),
+    SUM(CASE WHEN status_code >= 200 AND status_code < 300 THEN sample_rate ELSE 0 END),
+    SUM(CASE WHEN status_code >= 300 AND status_code < 400 THEN sample_rate ELSE 0 END),
+    SUM(CASE WHEN status_code >= 400 AND status_code < 500 THEN sample_rate ELSE 0 END),
+    SUM(CASE WHEN status_code >= 500 AND status_code < 600 THEN sample_rate ELSE 0 END),
+    SUM(CASE WHEN status_code < 200 OR status_code >= 600 THEN sample_rate ELSE 0 END)`
+
+// bulkCountUpdates 计数列冲突时累加
+func bulkCountUpdates(table string) string {
+	columns := []string{"pv", "traffic", "s2xx", "s3xx", "s4xx", "s5xx", "other"}
+	sets := make([]string, len(columns))
+	for i, column := range columns {
+		sets[i] = fmt.Sprintf(`%[1]s = "%[2]s".%[1]s + excluded.%[1]s`, column, table)
+	}
+	return strings.Join(sets, ", ")
+}
+
+// BulkInsertLogsForWebsite 首次解析、重新解析与历史回溯使用的批量写入：COPY 到临时表后用集合 SQL
+// 完成维表 upsert、日志写入和计数聚合，HLL 草图与会话仍在 Go 中计算，结果与 BatchInsertLogsForWebsite 一致。
+// ClickHouse 站点与小批次沿用原写入路径
+func (r *Repository) BulkInsertLogsForWebsite(websiteID string, logs []NginxLogRecord) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	unlock, err := r.lockWebsite(websiteID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if ch := r.ClickHouse(websiteID); ch != nil {
+		return r.batchInsertClickHouse(ch, websiteID, logs, nil)
+	}
+	if len(logs) < bulkInsertMinRows {
+		return r.batchInsertLogs(websiteID, logs, nil)
+	}
+	return r.bulkInsertLogs(websiteID, logs)
+}
+
+func (r *Repository) bulkInsertLogs(websiteID string, logs []NginxLogRecord) error {
+	// 会话按 (IP, 时间) 顺序推进，与逐行写入的排序保持一致
+	logsCopy := make([]NginxLogRecord, len(logs))
+	for i, log := range logs {
+		logsCopy[i] = sanitizeLogRecord(log)
+	}
+	sortLogsForLocking(logsCopy)
+	r.ensureLogPartitionsForLogs(websiteID, logsCopy)
+
+	return retryOnDeadlock(websiteID, func() error {
+		return r.bulkInsertLogsOnce(websiteID, logsCopy)
+	})
+}
+
+// bulkPageview 写入后读回的 pageview 行，seq 为其在批次中的下标
+type bulkPageview struct {
+	seq    int
+	ipID   int64
+	dimIDs [4]int64 // url / referer / ua / location，与 dimAggSpecs 顺序一致
+}
+
+func (r *Repository) bulkInsertLogsOnce(websiteID string, logs []NginxLogRecord) (err error) {
+	ctx := context.Background()
+	// COPY 需要直接使用 pgx 连接，事务与 COPY 必须在同一个连接上
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// 与 URL 重新归一化互斥（共享锁，批量写入之间互不阻塞）
+	if _, err = tx.Exec(fmt.Sprintf(
+		`SELECT pg_advisory_xact_lock_shared(hashtext('%s:url_renormalize'))`, websiteID,
+	)); err != nil {
+		return err
+	}
+
+	if err = copyLogsToStaging(ctx, conn, tx, logs); err != nil {
+		return err
+	}
+	if err = upsertDimsFromStaging(tx, websiteID); err != nil {
+		return err
+	}
+	if err = insertLogsFromStaging(tx, websiteID, len(logs)); err != nil {
+		return err
+	}
+	pageviews, err := fetchStagedPageviews(tx)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := prepareSessionStatements(tx, websiteID)
+	if err != nil {
+		return err
+	}
+	defer sessions.Close()
+
+	sessionCache := make(map[string]sessionState)
+	sessionAggDaily := make(map[string]int64)
+	sessionAggEntry := make(map[string]map[int64]int64)
+	sessionUpdates := make(map[int64]*pendingSessionUpdate)
+	sessionStateUpserts := make(map[string]pendingSessionStateUpsert)
+	lockedSessionKeys := make(map[string]struct{})
+	sketches := newAggBatch()
+	for _, pv := range pageviews {
+		log := logs[pv.seq]
+		if err = updateSessionFromLog(
+			sessions,
+			sessionCache,
+			sessionAggDaily,
+			sessionAggEntry,
+			sessionUpdates,
+			sessionStateUpserts,
+			lockedSessionKeys,
+			pv.ipID,
+			pv.dimIDs[2],
+			pv.dimIDs[3],
+			pv.dimIDs[0],
+			log.Timestamp.Unix(),
+		); err != nil {
+			return err
+		}
+		sketches.addSketches(log, pv.ipID, pv.dimIDs)
+	}
+
+	if err = applyStagedAggregates(tx, websiteID); err != nil {
+		return err
+	}
+	dimAggs, err := prepareDimAggStatements(tx, websiteID)
+	if err != nil {
+		return err
+	}
+	defer dimAggs.Close()
+	if err = applyDimAggUpdates(dimAggs, sketches); err != nil {
+		return err
+	}
+	uvSketches, err := prepareUVSketchStatements(tx, websiteID)
+	if err != nil {
+		return err
+	}
+	defer uvSketches.Close()
+	if err = applyUVSketchUpdates(uvSketches, sketches); err != nil {
+		return err
+	}
+
+	if err = applySessionAggUpdatesWithLocks(sessions, sessionAggDaily, sessionAggEntry); err != nil {
+		return err
+	}
+	if err = applySessionUpdates(sessions, sessionUpdates); err != nil {
+		return err
+	}
+	if err = applySessionStateUpserts(sessions, sessionStateUpserts); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// copyLogsToStaging 建立事务级临时表并用 COPY 写入整批日志；小时桶与日期在 Go 中按服务器时区计算，
+// 与逐行写入的 hourBucket / dayBucket 一致
+func copyLogsToStaging(ctx context.Context, conn *sql.Conn, tx *sql.Tx, logs []NginxLogRecord) error {
+	if _, err := tx.Exec(fmt.Sprintf(
+		`CREATE TEMP TABLE "%s" (
+            seq INT NOT NULL,
+            ip TEXT NOT NULL,
+            pageview_flag SMALLINT NOT NULL,
+            ts BIGINT NOT NULL,
+            hour_bucket BIGINT NOT NULL,
+            day TEXT NOT NULL,
+            method TEXT NOT NULL,
+            url TEXT NOT NULL,
+            raw_url TEXT,
+            status_code INT NOT NULL,
+            bytes_sent BIGINT NOT NULL,
+            referer TEXT NOT NULL,
+            referer_host TEXT NOT NULL,
+            referer_channel TEXT NOT NULL,
+            referer_source TEXT NOT NULL,
+            referer_keyword TEXT NOT NULL,
+            browser TEXT NOT NULL,
+            os TEXT NOT NULL,
+            device TEXT NOT NULL,
+            domestic TEXT NOT NULL,
+            global TEXT NOT NULL,
+            sample_rate INT NOT NULL
+        ) ON COMMIT DROP`, bulkStagingTable,
+	)); err != nil {
+		return err
+	}
+
+	err := conn.Raw(func(driverConn any) error {
+		pgConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("COPY 需要 pgx 连接，当前为 %T", driverConn)
+		}
+		_, err := pgConn.Conn().CopyFrom(
+			ctx,
+			pgx.Identifier{bulkStagingTable},
+			bulkStagingColumns,
+			pgx.CopyFromSlice(len(logs), func(i int) ([]any, error) {
+				log := logs[i]
+				var rawURL any
+				if log.RawUrl != "" && log.RawUrl != log.Url {
+					rawURL = log.RawUrl
+				}
+				return []any{
+					i, log.IP, log.PageviewFlag, log.Timestamp.Unix(),
+					hourBucket(log.Timestamp), dayBucket(log.Timestamp),
+					log.Method, log.Url, rawURL, log.Status, int64(log.BytesSent),
+					log.Referer, log.RefererHost, log.RefererChannel, log.RefererSource, log.RefererKeyword,
+					log.UserBrowser, log.UserOs, log.UserDevice,
+					log.DomesticLocation, log.GlobalLocation, log.weight(),
+				}, nil
+			}),
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// 临时表没有统计信息，后续按维表连接前先收集，避免规划器按空表估算
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`ANALYZE "%s"`, bulkStagingTable))
+	return err
+}
+
+// upsertDimsFromStaging 一次写入批次中的全部维度值；按唯一键排序，保证并发事务的加锁顺序一致
+func upsertDimsFromStaging(tx *sql.Tx, websiteID string) error {
+	stmts := []string{
+		fmt.Sprintf(
+			`INSERT INTO "%s_dim_ip" (ip)
+             SELECT DISTINCT ip FROM "%s" ORDER BY ip
+             ON CONFLICT DO NOTHING`, websiteID, bulkStagingTable,
+		),
+		fmt.Sprintf(
+			`INSERT INTO "%s_dim_url" (url)
+             SELECT DISTINCT url FROM "%s" ORDER BY url
+             ON CONFLICT DO NOTHING`, websiteID, bulkStagingTable,
+		),
+		// 同一来源的附加列取批次中第一条，与逐行写入的缓存行为一致
+		fmt.Sprintf(
+			`INSERT INTO "%s_dim_referer" (referer, host, channel, source, keyword)
+             SELECT DISTINCT ON (referer)
+                 referer, referer_host, referer_channel, referer_source, referer_keyword
+             FROM "%s" ORDER BY referer, seq
+             ON CONFLICT DO NOTHING`, websiteID, bulkStagingTable,
+		),
+		fmt.Sprintf(
+			`INSERT INTO "%s_dim_ua" (browser, os, device)
+             SELECT DISTINCT browser, os, device FROM "%s" ORDER BY browser, os, device
+             ON CONFLICT DO NOTHING`, websiteID, bulkStagingTable,
+		),
+		fmt.Sprintf(
+			`INSERT INTO "%s_dim_location" (domestic, global)
+             SELECT DISTINCT domestic, global FROM "%s" ORDER BY domestic, global
+             ON CONFLICT DO NOTHING`, websiteID, bulkStagingTable,
+		),
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertLogsFromStaging 换算维表 ID 后写入日志表；expected 用于确认没有行因维表缺失被丢弃
+func insertLogsFromStaging(tx *sql.Tx, websiteID string, expected int) error {
+	if _, err := tx.Exec(fmt.Sprintf(
+		`CREATE TEMP TABLE "%[2]s" ON COMMIT DROP AS
+         SELECT
+             b.seq, b.pageview_flag, b.ts, b.hour_bucket, b.day, b.method, b.raw_url,
+             b.status_code, b.bytes_sent, b.sample_rate,
+             i.id AS ip_id, u.id AS url_id, rf.id AS referer_id, ua.id AS ua_id, l.id AS location_id
+         FROM "%[3]s" b
+         JOIN "%[1]s_dim_ip" i ON i.ip = b.ip
+         JOIN "%[1]s_dim_url" u ON u.url = b.url
+         JOIN "%[1]s_dim_referer" rf ON rf.referer = b.referer
+         JOIN "%[1]s_dim_ua" ua ON ua.browser = b.browser AND ua.os = b.os AND ua.device = b.device
+         JOIN "%[1]s_dim_location" l ON l.domestic = b.domestic AND l.global = b.global`,
+		websiteID, bulkResolvedTable, bulkStagingTable,
+	)); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(fmt.Sprintf(
+		`INSERT INTO "%s_nginx_logs" (
+             ip_id, pageview_flag, timestamp, method, url_id,
+             status_code, bytes_sent, referer_id, ua_id, location_id, raw_url, sample_rate)
+         SELECT
+             ip_id, pageview_flag, ts, method, url_id,
+             status_code, bytes_sent, referer_id, ua_id, location_id, raw_url, sample_rate
+         FROM "%s"
+         ORDER BY seq`, websiteID, bulkResolvedTable,
+	))
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err == nil && inserted != int64(expected) {
+		return fmt.Errorf("批量写入日志条数不一致: 期望 %d，实际 %d", expected, inserted)
+	}
+	return nil
+}
+
+// fetchStagedPageviews 按批次顺序读回 pageview 行，供会话与草图计算
+func fetchStagedPageviews(tx *sql.Tx) ([]bulkPageview, error) {
+	rows, err := tx.Query(fmt.Sprintf(
+		`SELECT seq, ip_id, url_id, referer_id, ua_id, location_id
+         FROM "%s"
+         WHERE pageview_flag = 1
+         ORDER BY seq`, bulkResolvedTable,
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pageviews []bulkPageview
+	for rows.Next() {
+		var pv bulkPageview
+		if err := rows.Scan(&pv.seq, &pv.ipID, &pv.dimIDs[0], &pv.dimIDs[1], &pv.dimIDs[2], &pv.dimIDs[3]); err != nil {
+			return nil, err
+		}
+		pageviews = append(pageviews, pv)
+	}
+	return pageviews, rows.Err()
+}
+
+// applyStagedAggregates 在 SQL 中汇总首次访问、小时 / 日计数、(桶, ip_id) 明细与维度计数；
+// 写入顺序与 batchInsertLogsForWebsiteOnce 相同，并按主键排序保证加锁顺序一致
+func applyStagedAggregates(tx *sql.Tx, websiteID string) error {
+	firstSeenTable := fmt.Sprintf("%s_first_seen", websiteID)
+	hourlyTable := fmt.Sprintf("%s_agg_hourly", websiteID)
+	dailyTable := fmt.Sprintf("%s_agg_daily", websiteID)
+
+	stmts := []string{
+		fmt.Sprintf(
+			`SELECT pg_advisory_xact_lock(hashtext('%s:first_seen'), hashint8(ip_id))
+             FROM (SELECT DISTINCT ip_id FROM "%s" WHERE pageview_flag = 1 ORDER BY ip_id) ids`,
+			websiteID, bulkResolvedTable,
+		),
+		fmt.Sprintf(
+			`INSERT INTO "%[1]s" (ip_id, first_ts)
+             SELECT ip_id, MIN(ts) FROM "%[2]s"
+             WHERE pageview_flag = 1
+             GROUP BY ip_id ORDER BY ip_id
+             ON CONFLICT (ip_id) DO UPDATE SET
+                 first_ts = LEAST("%[1]s".first_ts, excluded.first_ts)`,
+			firstSeenTable, bulkResolvedTable,
+		),
+		fmt.Sprintf(
+			`INSERT INTO "%s" (bucket, pv, traffic, s2xx, s3xx, s4xx, s5xx, other)
+             SELECT hour_bucket, %s
+             FROM "%s"
+             GROUP BY hour_bucket ORDER BY hour_bucket
+             ON CONFLICT(bucket) DO UPDATE SET %s`,
+			hourlyTable, bulkCountColumns, bulkResolvedTable, bulkCountUpdates(hourlyTable),
+		),
+		fmt.Sprintf(
+			`INSERT INTO "%s" (day, pv, traffic, s2xx, s3xx, s4xx, s5xx, other)
+             SELECT day::date, %s
+             FROM "%s"
+             GROUP BY day ORDER BY day
+             ON CONFLICT(day) DO UPDATE SET %s`,
+			dailyTable, bulkCountColumns, bulkResolvedTable, bulkCountUpdates(dailyTable),
+		),
+	}
+	if !UVApproximate(websiteID) {
+		stmts = append(stmts,
+			fmt.Sprintf(
+				`INSERT INTO "%s_agg_hourly_ip" (bucket, ip_id)
+                 SELECT DISTINCT hour_bucket, ip_id FROM "%s"
+                 WHERE pageview_flag = 1
+                 ORDER BY hour_bucket, ip_id
+                 ON CONFLICT DO NOTHING`, websiteID, bulkResolvedTable,
+			),
+			fmt.Sprintf(
+				`INSERT INTO "%s_agg_daily_ip" (day, ip_id)
+                 SELECT DISTINCT day::date, ip_id FROM "%s"
+                 WHERE pageview_flag = 1
+                 ORDER BY 1, 2
+                 ON CONFLICT DO NOTHING`, websiteID, bulkResolvedTable,
+			),
+		)
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	// 维度计数同样在 SQL 中累加，新行先写入空草图，随后由 applyDimAggUpdates 合并
+	emptySketch := hll.New().Encode()
+	for _, spec := range dimAggSpecs {
+		table := DimAggregateTable(websiteID, spec.name)
+		if _, err := tx.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`INSERT INTO "%[1]s" (day, dim_id, pv, traffic, s2xx, s3xx, s4xx, s5xx, other, uv_sketch)
+             SELECT day::date, %[2]s, %[3]s, ?::bytea
+             FROM "%[4]s"
+             GROUP BY day, %[2]s ORDER BY day, %[2]s
+             ON CONFLICT(day, dim_id) DO UPDATE SET %[5]s`,
+			table, spec.logColumn, bulkCountColumns, bulkResolvedTable, bulkCountUpdates(table),
+		)), emptySketch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addSketches 只累加 UV 与维度草图；批量路径的计数已在 SQL 中汇总，维度项计数保持为 0
+func (b *aggBatch) addSketches(log NginxLogRecord, ipID int64, dimIDs [4]int64) {
+	if b == nil || log.PageviewFlag != 1 {
+		return
+	}
+	b.addUV(log, ipID)
+	day := dayBucket(log.Timestamp)
+	for spec, dimID := range dimIDs {
+		key := dimAggKey{spec: spec, day: day, dimID: dimID}
+		entry := b.dims[key]
+		if entry == nil {
+			entry = &dimAggEntry{sketch: hll.New()}
+			b.dims[key] = entry
+		}
+		entry.sketch.AddInt64(ipID)
+	}
+}
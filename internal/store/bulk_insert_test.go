@@ -0,0 +1,214 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+)
+
+// testDSNEnv 指向可随意建表、删表的测试库；未设置时跳过需要 Postgres 的测试与基准测试：
+//
+//	NGINXPULSE_TEST_DSN=postgres://... go test ./internal/store -run '^$' -bench BulkInsert -benchtime 3x
+const testDSNEnv = "NGINXPULSE_TEST_DSN"
+
+const (
+	benchRows      = 50000
+	benchBatchSize = 5000
+	benchDays      = 90
+	benchIPs       = 5000
+	benchURLs      = 1000
+)
+
+var (
+	benchMethods  = []string{"GET", "GET", "GET", "POST", "HEAD"}
+	benchStatuses = []int{200, 200, 200, 200, 204, 301, 302, 304, 400, 403, 404, 404, 500, 502}
+	benchBrowsers = []string{"Chrome", "Safari", "Firefox", "Edge", "Bot"}
+	benchSystems  = []string{"Windows", "macOS", "iOS", "Android", "Linux"}
+	benchDevices  = []string{"Desktop", "Mobile", "Tablet"}
+	benchRegions  = []string{"北京", "上海", "广东", "浙江", "美国", "日本", "德国"}
+)
+
+// openTestRepository 连接 testDSNEnv 指定的测试库，不读取配置文件
+func openTestRepository(tb testing.TB) *Repository {
+	tb.Helper()
+	dsn := strings.TrimSpace(os.Getenv(testDSNEnv))
+	if dsn == "" {
+		tb.Skipf("未设置 %s，跳过需要数据库的测试", testDSNEnv)
+	}
+	tb.Setenv("CONFIG_JSON", "{}")
+	tb.Setenv("DB_DSN", dsn)
+	repo, err := NewRepository()
+	if err != nil {
+		tb.Fatalf("连接测试库失败: %v", err)
+	}
+	tb.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+// BenchmarkBulkInsert 在临时网站表上分别用逐行写入与 COPY 批量写入导入同一批合成日志，
+// 每个子测试结束后核对两条路径的聚合结果一致并删除临时表
+func BenchmarkBulkInsert(b *testing.B) {
+	repo := openTestRepository(b)
+	logs := generateBenchLogs(benchRows, benchDays, benchIPs, benchURLs, 1)
+
+	paths := []struct {
+		name   string
+		insert func(websiteID string, batch []NginxLogRecord) error
+	}{
+		{name: "row", insert: func(websiteID string, batch []NginxLogRecord) error {
+			return repo.batchInsertLogs(websiteID, batch, nil)
+		}},
+		{name: "copy", insert: repo.bulkInsertLogs},
+	}
+
+	summaries := make(map[string]string, len(paths))
+	for _, path := range paths {
+		b.Run(path.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				websiteID := fmt.Sprintf("bench_%x_%s", time.Now().UnixNano(), path.name)
+				if err := repo.ensureWebsiteSchema(websiteID); err != nil {
+					b.Fatal(err)
+				}
+				if err := repo.initLogPartitions(websiteID); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+
+				for offset := 0; offset < len(logs); offset += benchBatchSize {
+					end := min(offset+benchBatchSize, len(logs))
+					if err := path.insert(websiteID, logs[offset:end]); err != nil {
+						b.Fatalf("%s 写入失败: %v", path.name, err)
+					}
+				}
+
+				b.StopTimer()
+				summary, err := repo.scratchSummary(websiteID)
+				dropScratchTables(b, repo, websiteID)
+				if err != nil {
+					b.Fatal(err)
+				}
+				summaries[path.name] = summary
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(len(logs)*b.N)/b.Elapsed().Seconds(), "rows/s")
+		})
+	}
+
+	if row, copied := summaries["row"], summaries["copy"]; row != "" && copied != "" && row != copied {
+		b.Fatalf("写入结果不一致: row=%s, copy=%s", row, copied)
+	}
+}
+
+// generateBenchLogs 生成按时间均匀分布的合成日志；IP 与 URL 按近似长尾分布取值，使维表与会话接近真实站点
+func generateBenchLogs(rows, days, ips, urls int, seed int64) []NginxLogRecord {
+	rng := rand.New(rand.NewSource(seed))
+	end := time.Now().Truncate(time.Hour)
+	span := time.Duration(days) * 24 * time.Hour
+	step := span / time.Duration(rows)
+
+	pick := func(n int) int {
+		// 两次取最小值让小编号更常见
+		a, b := rng.Intn(n), rng.Intn(n)
+		if a < b {
+			return a
+		}
+		return b
+	}
+
+	logs := make([]NginxLogRecord, rows)
+	for i := range logs {
+		status := benchStatuses[rng.Intn(len(benchStatuses))]
+		url := fmt.Sprintf("/page/%d", pick(urls))
+		pageview := 0
+		if status < 400 && rng.Intn(4) > 0 {
+			pageview = 1
+		} else if status < 400 {
+			url = fmt.Sprintf("/assets/%d.js", pick(urls))
+		}
+		referer := "-"
+		if rng.Intn(3) == 0 {
+			referer = fmt.Sprintf("https://ref%d.example.com/", rng.Intn(200))
+		}
+		region := benchRegions[rng.Intn(len(benchRegions))]
+		ip := pick(ips)
+		logs[i] = NginxLogRecord{
+			IP:               fmt.Sprintf("10.%d.%d.%d", (ip>>16)&0xff, (ip>>8)&0xff, ip&0xff),
+			PageviewFlag:     pageview,
+			Timestamp:        end.Add(-span + step*time.Duration(i)),
+			Method:           benchMethods[rng.Intn(len(benchMethods))],
+			Url:              url,
+			Status:           status,
+			BytesSent:        rng.Intn(64*1024) + 200,
+			Referer:          referer,
+			UserBrowser:      benchBrowsers[rng.Intn(len(benchBrowsers))],
+			UserOs:           benchSystems[rng.Intn(len(benchSystems))],
+			UserDevice:       benchDevices[rng.Intn(len(benchDevices))],
+			DomesticLocation: region,
+			GlobalLocation:   region,
+		}
+	}
+	return logs
+}
+
+// scratchSummary 汇总日志条数、日聚合、首次访问、会话与维度聚合，用于比对不同写入路径
+func (r *Repository) scratchSummary(websiteID string) (string, error) {
+	var logs, pv, traffic, failed, visitors, sessions, sessionPages, urlPV int64
+	err := r.db.QueryRow(fmt.Sprintf(
+		`SELECT
+             (SELECT COUNT(*) FROM "%[1]s_nginx_logs"),
+             (SELECT COALESCE(SUM(pv), 0) FROM "%[1]s_agg_daily"),
+             (SELECT COALESCE(SUM(traffic), 0) FROM "%[1]s_agg_daily"),
+             (SELECT COALESCE(SUM(s4xx + s5xx), 0) FROM "%[1]s_agg_hourly"),
+             (SELECT COUNT(*) FROM "%[1]s_first_seen"),
+             (SELECT COALESCE(SUM(sessions), 0) FROM "%[1]s_agg_session_daily"),
+             (SELECT COALESCE(SUM(page_count), 0) FROM "%[1]s_sessions"),
+             (SELECT COALESCE(SUM(pv), 0) FROM "%[2]s")`,
+		websiteID, DimAggregateTable(websiteID, "url"),
+	)).Scan(&logs, &pv, &traffic, &failed, &visitors, &sessions, &sessionPages, &urlPV)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("logs=%d pv=%d traffic=%d errors=%d visitors=%d sessions=%d session_pages=%d url_pv=%d",
+		logs, pv, traffic, failed, visitors, sessions, sessionPages, urlPV), nil
+}
+
+// dropScratchTables 删除临时网站的全部表（分区随父表一并删除）
+func dropScratchTables(tb testing.TB, r *Repository, websiteID string) {
+	tb.Helper()
+	rows, err := r.db.Query(sqlutil.ReplacePlaceholders(`
+        SELECT c.relname
+        FROM pg_class c
+        JOIN pg_namespace n ON n.oid = c.relnamespace
+        WHERE n.nspname = 'public'
+          AND c.relkind IN ('r', 'p')
+          AND c.relispartition = false
+          AND c.relname LIKE ? ESCAPE '\'`), strings.ReplaceAll(websiteID, "_", `\_`)+`\_%`)
+	if err != nil {
+		tb.Fatalf("查询临时表失败: %v", err)
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			tb.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	for _, table := range tables {
+		if _, err := r.db.Exec(fmt.Sprintf(`DROP TABLE IF EXISTS "%s" CASCADE`, table)); err != nil {
+			tb.Errorf("删除临时表 %s 失败: %v", table, err)
+		}
+	}
+
+	r.partitionMu.Lock()
+	delete(r.partitions, websiteID)
+	r.partitionMu.Unlock()
+}
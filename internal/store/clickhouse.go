@@ -0,0 +1,517 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	clickHouseDefaultDatabase = "default"
+	clickHouseDefaultTimeout  = 30 * time.Second
+	// clickHouseDedupWindow 保留的插入去重令牌数量，agent 重发的批次在窗口内会被丢弃
+	clickHouseDedupWindow = 1000
+)
+
+// ClickHouseUVRelativeError uniqCombined64 默认精度（2^17 个寄存器）下的相对标准误差
+var ClickHouseUVRelativeError = 1.04 / math.Sqrt(1<<17)
+
+// ClickHouseStore 通过 HTTP 接口读写 storage 为 clickhouse 的站点；
+// 原始日志写入 MergeTree 表，小时 / 日汇总由物化视图在插入时生成，过期数据交给 TTL 删除
+type ClickHouseStore struct {
+	endpoint string
+	database string
+	username string
+	password string
+	client   *http.Client
+	timezone string
+}
+
+func newClickHouseStore(cfg config.ClickHouseConfig) (*ClickHouseStore, error) {
+	endpoint := strings.TrimRight(strings.TrimSpace(cfg.URL), "/")
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return nil, fmt.Errorf("解析 clickhouse.url 失败: %w", err)
+	}
+	database := strings.TrimSpace(cfg.Database)
+	if database == "" {
+		database = clickHouseDefaultDatabase
+	}
+	timeout := clickHouseDefaultTimeout
+	if raw := strings.TrimSpace(cfg.Timeout); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("解析 clickhouse.timeout 失败: %w", err)
+		}
+		timeout = parsed
+	}
+	return &ClickHouseStore{
+		endpoint: endpoint,
+		database: database,
+		username: cfg.Username,
+		password: cfg.Password,
+		client:   &http.Client{Timeout: timeout},
+		timezone: clickHouseTimezone(),
+	}, nil
+}
+
+// clickHouseTimezone 汇总按服务器本地时区分桶，与 Postgres 聚合表一致；
+// 本地时区没有 IANA 名称时退回 TZ 环境变量，仍无法确定则使用 UTC
+func clickHouseTimezone() string {
+	if name := time.Local.String(); name != "" && name != "Local" {
+		return name
+	}
+	if name := strings.TrimSpace(os.Getenv("TZ")); name != "" {
+		if _, err := time.LoadLocation(name); err == nil {
+			return name
+		}
+	}
+	return "UTC"
+}
+
+// UsesClickHouse 站点是否配置为 ClickHouse 存储
+func UsesClickHouse(websiteID string) bool {
+	return config.StorageForWebsite(websiteID) == config.StorageClickHouse
+}
+
+// ClickHouse 返回站点使用的 ClickHouse 存储，站点仍使用 Postgres 时返回 nil
+func (r *Repository) ClickHouse(websiteID string) *ClickHouseStore {
+	if r.clickhouse == nil || !UsesClickHouse(websiteID) {
+		return nil
+	}
+	return r.clickhouse
+}
+
+// table 返回站点表的完整限定名
+func (c *ClickHouseStore) table(websiteID, suffix string) string {
+	return fmt.Sprintf("`%s`.`%s_%s`", c.database, websiteID, suffix)
+}
+
+// request 发送一条语句；body 不为空时语句放在 URL 中，body 作为 INSERT 的数据
+func (c *ClickHouseStore) request(query string, params map[string]string, body io.Reader) (io.ReadCloser, error) {
+	values := url.Values{}
+	values.Set("database", c.database)
+	values.Set("output_format_json_quote_64bit_integers", "0")
+	for key, value := range params {
+		values.Set(key, value)
+	}
+	if body == nil {
+		body = strings.NewReader(query)
+	} else {
+		values.Set("query", query)
+	}
+	req, err := http.NewRequest(http.MethodPost, c.endpoint+"/?"+values.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.username != "" {
+		req.Header.Set("X-ClickHouse-User", c.username)
+	}
+	if c.password != "" {
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ClickHouse 请求失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("ClickHouse 返回 %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+// exec 执行不返回结果的语句
+func (c *ClickHouseStore) exec(query string, params map[string]string) error {
+	body, err := c.request(query, params, nil)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, body)
+	return body.Close()
+}
+
+// selectEach 以 JSONEachRow 格式执行查询，逐行解码后交给 scan
+func (c *ClickHouseStore) selectEach(query string, params map[string]string, scan func(decode func(v interface{}) error) error) error {
+	body, err := c.request(query+"\nFORMAT JSONEachRow", params, nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	decoder := json.NewDecoder(body)
+	for decoder.More() {
+		if err := scan(decoder.Decode); err != nil {
+			return fmt.Errorf("解析 ClickHouse 结果失败: %w", err)
+		}
+	}
+	return nil
+}
+
+// ensureClickHouseSchema 建立站点的原始日志表、小时 / 日汇总表与对应的物化视图，
+// 并让各表的 TTL 跟随当前的分层保留配置
+func (c *ClickHouseStore) ensureClickHouseSchema(websiteID string) error {
+	retention := config.RetentionForWebsite(websiteID)
+	logs := c.table(websiteID, "logs")
+	hourly := c.table(websiteID, "agg_hourly")
+	daily := c.table(websiteID, "agg_daily")
+
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+            timestamp DateTime,
+            ip String,
+            pageview UInt8,
+            method LowCardinality(String),
+            url String,
+            raw_url String,
+            status UInt16,
+            bytes_sent UInt64,
+            referer String,
+            host String,
+            channel LowCardinality(String),
+            source LowCardinality(String),
+            keyword String,
+            browser LowCardinality(String),
+            os LowCardinality(String),
+            device LowCardinality(String),
+            domestic String,
+            global LowCardinality(String),
+            sample_rate UInt32
+        ) ENGINE = MergeTree
+        PARTITION BY toYYYYMMDD(timestamp)
+        ORDER BY (timestamp, ip)
+        TTL timestamp + INTERVAL %d DAY
+        SETTINGS ttl_only_drop_parts = 1, non_replicated_deduplication_window = %d`,
+			logs, retention.RawDays, clickHouseDedupWindow),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+            bucket DateTime,
+            %s
+        ) ENGINE = AggregatingMergeTree
+        ORDER BY bucket
+        TTL bucket + INTERVAL %d DAY`,
+			hourly, clickHouseRollupColumns, retention.HourlyDays),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+            day Date,
+            %s
+        ) ENGINE = AggregatingMergeTree
+        ORDER BY day
+        TTL day + INTERVAL %d DAY`,
+			daily, clickHouseRollupColumns, retention.DailyDays),
+		fmt.Sprintf(`CREATE MATERIALIZED VIEW IF NOT EXISTS %s TO %s AS
+        SELECT toStartOfHour(timestamp, '%s') AS bucket, %s
+        FROM %s GROUP BY bucket`,
+			c.table(websiteID, "agg_hourly_mv"), hourly, c.timezone, clickHouseRollupSelect, logs),
+		fmt.Sprintf(`CREATE MATERIALIZED VIEW IF NOT EXISTS %s TO %s AS
+        SELECT toDate(timestamp, '%s') AS day, %s
+        FROM %s GROUP BY day`,
+			c.table(websiteID, "agg_daily_mv"), daily, c.timezone, clickHouseRollupSelect, logs),
+	}
+	for _, stmt := range stmts {
+		if err := c.exec(stmt, nil); err != nil {
+			return fmt.Errorf("创建 ClickHouse 表失败: %w", err)
+		}
+	}
+
+	ttls := []struct {
+		suffix string
+		expr   string
+		days   int
+	}{
+		{"logs", "timestamp", retention.RawDays},
+		{"agg_hourly", "bucket", retention.HourlyDays},
+		{"agg_daily", "day", retention.DailyDays},
+	}
+	for _, ttl := range ttls {
+		if err := c.syncTTL(websiteID, ttl.suffix, ttl.expr, ttl.days); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clickHouseRollupColumns 汇总表的指标列，计数列按 sum 合并，UV 保存 uniqCombined64 的中间状态
+const clickHouseRollupColumns = `pv SimpleAggregateFunction(sum, UInt64),
+            traffic SimpleAggregateFunction(sum, UInt64),
+            s2xx SimpleAggregateFunction(sum, UInt64),
+            s3xx SimpleAggregateFunction(sum, UInt64),
+            s4xx SimpleAggregateFunction(sum, UInt64),
+            s5xx SimpleAggregateFunction(sum, UInt64),
+            other SimpleAggregateFunction(sum, UInt64),
+            uv AggregateFunction(uniqCombined64If, String, UInt8)`
+
+// clickHouseRollupSelect 物化视图的汇总表达式，口径与 Postgres 聚合表一致：
+// PV / 流量只算 pageview，状态码计入全部请求，采样日志按 sample_rate 还原
+const clickHouseRollupSelect = `sum(if(pageview = 1, toUInt64(sample_rate), 0)) AS pv,
+            sum(if(pageview = 1, bytes_sent * sample_rate, 0)) AS traffic,
+            sum(if(status >= 200 AND status < 300, toUInt64(sample_rate), 0)) AS s2xx,
+            sum(if(status >= 300 AND status < 400, toUInt64(sample_rate), 0)) AS s3xx,
+            sum(if(status >= 400 AND status < 500, toUInt64(sample_rate), 0)) AS s4xx,
+            sum(if(status >= 500 AND status < 600, toUInt64(sample_rate), 0)) AS s5xx,
+            sum(if(status < 200 OR status >= 600, toUInt64(sample_rate), 0)) AS other,
+            uniqCombined64IfState(ip, pageview = 1) AS uv`
+
+// syncTTL 保留天数变化时修改表的 TTL；只比较建表语句中的天数，避免每次启动都触发 TTL 重算
+func (c *ClickHouseStore) syncTTL(websiteID, suffix, expr string, days int) error {
+	var engineFull string
+	err := c.selectEach(
+		`SELECT engine_full FROM system.tables WHERE database = {db:String} AND name = {name:String}`,
+		map[string]string{"param_db": c.database, "param_name": websiteID + "_" + suffix},
+		func(decode func(v interface{}) error) error {
+			var row struct {
+				EngineFull string `json:"engine_full"`
+			}
+			if err := decode(&row); err != nil {
+				return err
+			}
+			engineFull = row.EngineFull
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if engineFull == "" || strings.Contains(engineFull, fmt.Sprintf("toIntervalDay(%d)", days)) {
+		return nil
+	}
+	logrus.Infof("网站 %s 的 ClickHouse 表 %s 保留期调整为 %d 天", websiteID, suffix, days)
+	return c.exec(fmt.Sprintf(
+		`ALTER TABLE %s MODIFY TTL %s + INTERVAL %d DAY`, c.table(websiteID, suffix), expr, days,
+	), nil)
+}
+
+// clickHouseLogRow 原始日志表的一行，字段名与列名一致
+type clickHouseLogRow struct {
+	Timestamp  int64  `json:"timestamp"`
+	IP         string `json:"ip"`
+	Pageview   int    `json:"pageview"`
+	Method     string `json:"method"`
+	URL        string `json:"url"`
+	RawURL     string `json:"raw_url"`
+	Status     int    `json:"status"`
+	BytesSent  int    `json:"bytes_sent"`
+	Referer    string `json:"referer"`
+	Host       string `json:"host"`
+	Channel    string `json:"channel"`
+	Source     string `json:"source"`
+	Keyword    string `json:"keyword"`
+	Browser    string `json:"browser"`
+	Os         string `json:"os"`
+	Device     string `json:"device"`
+	Domestic   string `json:"domestic"`
+	Global     string `json:"global"`
+	SampleRate int64  `json:"sample_rate"`
+}
+
+// InsertLogs 以 JSONEachRow 批量写入原始日志，物化视图随之更新汇总表；
+// dedupToken 不为空时同一令牌的重复写入会被 ClickHouse 丢弃
+func (c *ClickHouseStore) InsertLogs(websiteID string, logs []NginxLogRecord, dedupToken string) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, raw := range logs {
+		log := sanitizeLogRecord(raw)
+		row := clickHouseLogRow{
+			Timestamp:  log.Timestamp.Unix(),
+			IP:         log.IP,
+			Pageview:   log.PageviewFlag,
+			Method:     log.Method,
+			URL:        log.Url,
+			RawURL:     log.RawUrl,
+			Status:     log.Status,
+			BytesSent:  log.BytesSent,
+			Referer:    log.Referer,
+			Host:       log.RefererHost,
+			Channel:    log.RefererChannel,
+			Source:     log.RefererSource,
+			Keyword:    log.RefererKeyword,
+			Browser:    log.UserBrowser,
+			Os:         log.UserOs,
+			Device:     log.UserDevice,
+			Domestic:   log.DomesticLocation,
+			Global:     log.GlobalLocation,
+			SampleRate: log.weight(),
+		}
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+	params := map[string]string{}
+	if dedupToken != "" {
+		params["insert_deduplication_token"] = dedupToken
+	}
+	body, err := c.request(
+		fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", c.table(websiteID, "logs")), params, &buf,
+	)
+	if err != nil {
+		return fmt.Errorf("写入 ClickHouse 日志失败: %w", err)
+	}
+	_, _ = io.Copy(io.Discard, body)
+	return body.Close()
+}
+
+// HasLogs 站点原始日志表中是否有数据
+func (c *ClickHouseStore) HasLogs(websiteID string) (bool, error) {
+	found := false
+	err := c.selectEach(
+		fmt.Sprintf(`SELECT 1 AS marker FROM %s LIMIT 1`, c.table(websiteID, "logs")), nil,
+		func(decode func(v interface{}) error) error {
+			found = true
+			var row map[string]interface{}
+			return decode(&row)
+		},
+	)
+	return found, err
+}
+
+// clearWebsite 清空站点的原始日志与汇总表
+func (c *ClickHouseStore) clearWebsite(websiteID string) error {
+	for _, suffix := range []string{"logs", "agg_hourly", "agg_daily"} {
+		if err := c.exec(fmt.Sprintf(`TRUNCATE TABLE IF EXISTS %s`, c.table(websiteID, suffix)), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchPendingIPs 返回归属地仍为待解析标记的 IP
+func (c *ClickHouseStore) fetchPendingIPs(websiteID, pendingLabel string, limit int) ([]string, error) {
+	ips := make([]string, 0, limit)
+	err := c.selectEach(
+		fmt.Sprintf(
+			`SELECT DISTINCT ip FROM %s
+            WHERE domestic = {pending:String} AND global = {pending:String}
+            LIMIT {limit:UInt32}`,
+			c.table(websiteID, "logs"),
+		),
+		map[string]string{"param_pending": pendingLabel, "param_limit": strconv.Itoa(limit)},
+		func(decode func(v interface{}) error) error {
+			var row struct {
+				IP string `json:"ip"`
+			}
+			if err := decode(&row); err != nil {
+				return err
+			}
+			if ip := strings.TrimSpace(row.IP); ip != "" {
+				ips = append(ips, ip)
+			}
+			return nil
+		},
+	)
+	return ips, err
+}
+
+// updateLocations 用 ALTER TABLE UPDATE 回填归属地；只改写仍为待解析标记的行，
+// 汇总表不含归属地，无需重建
+func (c *ClickHouseStore) updateLocations(websiteID string, locations map[string]IPGeoCacheEntry, pendingLabel string) error {
+	ips := make([]string, 0, len(locations))
+	domestic := make([]string, 0, len(locations))
+	global := make([]string, 0, len(locations))
+	for ip, entry := range locations {
+		ip = strings.TrimSpace(ip)
+		if ip == "" {
+			continue
+		}
+		ips = append(ips, ip)
+		domestic = append(domestic, entry.Domestic)
+		global = append(global, entry.Global)
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+	return c.exec(
+		fmt.Sprintf(
+			`ALTER TABLE %s UPDATE
+                domestic = transform(ip, {ips:Array(String)}, {domestic:Array(String)}, domestic),
+                global = transform(ip, {ips:Array(String)}, {global:Array(String)}, global)
+            WHERE has({ips:Array(String)}, ip) AND domestic = {pending:String}`,
+			c.table(websiteID, "logs"),
+		),
+		map[string]string{
+			"param_ips":      clickHouseArray(ips),
+			"param_domestic": clickHouseArray(domestic),
+			"param_global":   clickHouseArray(global),
+			"param_pending":  pendingLabel,
+		},
+	)
+}
+
+// markPending 把指定 IP 的归属地改回待解析标记，等待重新解析
+func (c *ClickHouseStore) markPending(websiteID string, ips []string, pendingLabel string) error {
+	if len(ips) == 0 {
+		return nil
+	}
+	return c.exec(
+		fmt.Sprintf(
+			`ALTER TABLE %s UPDATE domestic = {pending:String}, global = {pending:String}
+            WHERE has({ips:Array(String)}, ip)`,
+			c.table(websiteID, "logs"),
+		),
+		map[string]string{"param_ips": clickHouseArray(ips), "param_pending": pendingLabel},
+	)
+}
+
+// clickHouseArray 把字符串切片编码为查询参数中的 Array(String) 字面量
+func clickHouseArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		value = strings.ReplaceAll(value, `\`, `\\`)
+		quoted[i] = "'" + strings.ReplaceAll(value, "'", `\'`) + "'"
+	}
+	return "[" + strings.Join(quoted, ",") + "]"
+}
+
+// batchInsertClickHouse 写入 ClickHouse 站点的日志批次。agent 批次仍在 Postgres 事务里锁定并推进确认序号，
+// ClickHouse 写入使用由 agent 与序号组成的去重令牌：写入成功但确认提交失败时，重发的批次不会重复入库
+func (r *Repository) batchInsertClickHouse(ch *ClickHouseStore, websiteID string, logs []NginxLogRecord, ack *AgentAck) (err error) {
+	if ack == nil {
+		return ch.InsertLogs(websiteID, logs, "")
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if err = lockAgentAck(tx, *ack); err != nil {
+		return err
+	}
+	token := fmt.Sprintf("%s:%s:%d", ack.AgentID, ack.WebsiteID, ack.Seq)
+	if err = ch.InsertLogs(websiteID, logs, token); err != nil {
+		return err
+	}
+	if err = saveAgentAck(tx, *ack); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ensureClickHouseSchemas 为所有 ClickHouse 站点建表
+func (r *Repository) ensureClickHouseSchemas() error {
+	for _, id := range config.GetAllWebsiteIDs() {
+		if !UsesClickHouse(id) {
+			continue
+		}
+		if r.clickhouse == nil {
+			return fmt.Errorf("网站 %s 使用 clickhouse 存储，但未配置 clickhouse.url", id)
+		}
+		if err := r.clickhouse.ensureClickHouseSchema(id); err != nil {
+			return fmt.Errorf("初始化网站 %s 的 ClickHouse 表失败: %w", id, err)
+		}
+	}
+	return nil
+}
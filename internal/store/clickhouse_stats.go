@@ -0,0 +1,325 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ClickHouseMetrics 区间内的 PV / UV / 流量与状态码分布
+type ClickHouseMetrics struct {
+	PV      int64 `json:"pv"`
+	UV      int64 `json:"uv"`
+	Traffic int64 `json:"traffic"`
+	S2xx    int64 `json:"s2xx"`
+	S3xx    int64 `json:"s3xx"`
+	S4xx    int64 `json:"s4xx"`
+	S5xx    int64 `json:"s5xx"`
+	Other   int64 `json:"other"`
+}
+
+// ClickHouseSeriesPoint 趋势图的一个时间点；按小时时 Key 为桶起始 Unix 秒，按日时为 YYYY-MM-DD
+type ClickHouseSeriesPoint struct {
+	Key string `json:"grp_key"`
+	PV  int64  `json:"pv"`
+	UV  int64  `json:"uv"`
+}
+
+// ClickHouseDimensionQuery 按维度排行的查询。KeyExpr 与 Filter 是基于原始日志表列名的表达式，
+// Filter 以 " AND " 开头；Compare 为 true 时同时统计 [PrevStart, PrevEnd) 区间
+type ClickHouseDimensionQuery struct {
+	KeyExpr     string
+	Filter      string
+	Start, End  int64
+	Compare     bool
+	PrevStart   int64
+	PrevEnd     int64
+	CompareSort string // 空为按当前 UV 降序，decline / growth 按变化量排序
+	OrderByPV   bool   // 非对比模式下按当前 PV 降序
+	Limit       int    // 小于 0 时不限制条数
+}
+
+// ClickHouseDimensionRow 维度排行的一行
+type ClickHouseDimensionRow struct {
+	Key    string `json:"grp_key"`
+	CurPV  int64  `json:"cur_pv"`
+	CurUV  int64  `json:"cur_uv"`
+	PrevPV int64  `json:"prev_pv"`
+	PrevUV int64  `json:"prev_uv"`
+}
+
+// clickHouseRollup 选出能覆盖 start 的汇总表：小时汇总已过保留期而日汇总保留更久时改用日汇总
+func (c *ClickHouseStore) clickHouseRollup(websiteID string, start time.Time) (string, string) {
+	tiers := RetentionTiersFor(websiteID)
+	if start.Before(tiers.Hourly) && tiers.Daily.Before(tiers.Hourly) {
+		return c.table(websiteID, "agg_daily"), "day"
+	}
+	return c.table(websiteID, "agg_hourly"), "bucket"
+}
+
+// rollupRangeCond 汇总表的区间条件，起止时刻所在的桶都计入，与 Postgres 聚合表的取法一致
+func (c *ClickHouseStore) rollupRangeCond(column string) string {
+	if column == "day" {
+		return fmt.Sprintf(
+			`day >= toDate(toDateTime({start:Int64}), '%[1]s') AND day <= toDate(toDateTime({end:Int64}), '%[1]s')`,
+			c.timezone,
+		)
+	}
+	return fmt.Sprintf(
+		`bucket >= toStartOfHour(toDateTime({start:Int64}), '%[1]s') AND bucket <= toStartOfHour(toDateTime({end:Int64}), '%[1]s')`,
+		c.timezone,
+	)
+}
+
+// exactUV 精确计数的站点在原始日志仍覆盖区间起点时逐 IP 去重，否则只能合并汇总表中的近似状态
+func exactUV(websiteID string, start time.Time) bool {
+	return !UVApproximate(websiteID) && !start.Before(RetentionTiersFor(websiteID).Raw)
+}
+
+func rangeParams(start, end int64) map[string]string {
+	return map[string]string{
+		"param_start": strconv.FormatInt(start, 10),
+		"param_end":   strconv.FormatInt(end, 10),
+	}
+}
+
+// Metrics 统计 [start, end) 的总体指标
+func (c *ClickHouseStore) Metrics(websiteID string, start, end time.Time) (ClickHouseMetrics, error) {
+	var result ClickHouseMetrics
+	table, column := c.clickHouseRollup(websiteID, start)
+	params := rangeParams(start.Unix(), end.Unix())
+	err := c.selectEach(
+		fmt.Sprintf(
+			`SELECT sum(pv) AS pv, sum(traffic) AS traffic,
+                sum(s2xx) AS s2xx, sum(s3xx) AS s3xx, sum(s4xx) AS s4xx, sum(s5xx) AS s5xx,
+                sum(other) AS other, uniqCombined64IfMerge(uv) AS uv
+            FROM %s WHERE %s`,
+			table, c.rollupRangeCond(column),
+		),
+		params,
+		func(decode func(v interface{}) error) error { return decode(&result) },
+	)
+	if err != nil {
+		return result, fmt.Errorf("查询 ClickHouse 总体统计失败: %w", err)
+	}
+	if exactUV(websiteID, start) {
+		uv, err := c.Visitors(websiteID, start.Unix(), end.Unix())
+		if err != nil {
+			return result, err
+		}
+		result.UV = uv
+	}
+	return result, nil
+}
+
+// Visitors 从原始日志精确统计 [start, end) 内的独立访客数
+func (c *ClickHouseStore) Visitors(websiteID string, start, end int64) (int64, error) {
+	var row struct {
+		UV int64 `json:"uv"`
+	}
+	err := c.selectEach(
+		fmt.Sprintf(
+			`SELECT uniqExact(ip) AS uv FROM %s
+            WHERE pageview = 1 AND timestamp >= toDateTime({start:Int64}) AND timestamp < toDateTime({end:Int64})`,
+			c.table(websiteID, "logs"),
+		),
+		rangeParams(start, end),
+		func(decode func(v interface{}) error) error { return decode(&row) },
+	)
+	if err != nil {
+		return 0, fmt.Errorf("查询 ClickHouse 访客数失败: %w", err)
+	}
+	return row.UV, nil
+}
+
+// Series 统计 [start, end) 的趋势。hourly 为 true 时按小时分组，否则按 tz 时区的自然日分组；
+// 小时汇总已过保留期时日趋势退回日汇总，此时只能按服务器时区分日
+func (c *ClickHouseStore) Series(websiteID string, start, end time.Time, hourly bool, tz string) ([]ClickHouseSeriesPoint, error) {
+	if tz == "" || tz == "Local" {
+		tz = c.timezone
+	}
+	table, column := c.clickHouseRollup(websiteID, start)
+	if hourly {
+		table, column = c.table(websiteID, "agg_hourly"), "bucket"
+	}
+	keyExpr := fmt.Sprintf(`toString(toDate(bucket, '%s'))`, tz)
+	rawKeyExpr := fmt.Sprintf(`toString(toDate(timestamp, '%s'))`, tz)
+	switch {
+	case hourly:
+		keyExpr = `toString(toUnixTimestamp(bucket))`
+		rawKeyExpr = fmt.Sprintf(`toString(toUnixTimestamp(toStartOfHour(timestamp, '%s')))`, c.timezone)
+	case column == "day":
+		keyExpr = `toString(day)`
+		rawKeyExpr = fmt.Sprintf(`toString(toDate(timestamp, '%s'))`, c.timezone)
+	}
+	params := rangeParams(start.Unix(), end.Unix())
+
+	points := make([]ClickHouseSeriesPoint, 0)
+	index := make(map[string]int)
+	err := c.selectEach(
+		fmt.Sprintf(
+			`SELECT %s AS grp_key, sum(pv) AS pv, uniqCombined64IfMerge(uv) AS uv
+            FROM %s WHERE %s AND %s < toDateTime({end:Int64})
+            GROUP BY grp_key`,
+			keyExpr, table, c.rollupRangeCond(column), column,
+		),
+		params,
+		func(decode func(v interface{}) error) error {
+			var point ClickHouseSeriesPoint
+			if err := decode(&point); err != nil {
+				return err
+			}
+			index[point.Key] = len(points)
+			points = append(points, point)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("查询 ClickHouse 趋势失败: %w", err)
+	}
+	if !exactUV(websiteID, start) {
+		return points, nil
+	}
+
+	err = c.selectEach(
+		fmt.Sprintf(
+			`SELECT %s AS grp_key, uniqExact(ip) AS uv FROM %s
+            WHERE pageview = 1 AND timestamp >= toDateTime({start:Int64}) AND timestamp < toDateTime({end:Int64})
+            GROUP BY grp_key`,
+			rawKeyExpr, c.table(websiteID, "logs"),
+		),
+		params,
+		func(decode func(v interface{}) error) error {
+			var point ClickHouseSeriesPoint
+			if err := decode(&point); err != nil {
+				return err
+			}
+			if idx, ok := index[point.Key]; ok {
+				points[idx].UV = point.UV
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("查询 ClickHouse 趋势UV失败: %w", err)
+	}
+	return points, nil
+}
+
+// TopDimension 按维度统计 PV / UV 排行，对比模式下两个区间在同一次扫描中分别计数
+func (c *ClickHouseStore) TopDimension(websiteID string, query ClickHouseDimensionQuery) ([]ClickHouseDimensionRow, error) {
+	uniq := "uniqExactIf"
+	if UVApproximate(websiteID) {
+		uniq = "uniqCombined64If"
+	}
+	const (
+		curCond  = `timestamp >= toDateTime({start:Int64}) AND timestamp < toDateTime({end:Int64})`
+		prevCond = `timestamp >= toDateTime({prev_start:Int64}) AND timestamp < toDateTime({prev_end:Int64})`
+	)
+	rangeCond := curCond
+	orderBy := "cur_uv DESC, grp_key"
+	params := rangeParams(query.Start, query.End)
+	if query.Compare {
+		rangeCond = fmt.Sprintf("(%s) OR (%s)", curCond, prevCond)
+		params["param_prev_start"] = strconv.FormatInt(query.PrevStart, 10)
+		params["param_prev_end"] = strconv.FormatInt(query.PrevEnd, 10)
+		switch query.CompareSort {
+		case "decline":
+			orderBy = "toInt64(cur_uv) - toInt64(prev_uv) ASC, prev_uv DESC, grp_key"
+		case "growth":
+			orderBy = "toInt64(cur_uv) - toInt64(prev_uv) DESC, cur_uv DESC, grp_key"
+		default:
+			orderBy = "cur_uv DESC, prev_uv DESC, grp_key"
+		}
+	} else {
+		params["param_prev_start"] = "0"
+		params["param_prev_end"] = "0"
+		if query.OrderByPV {
+			orderBy = "cur_pv DESC, grp_key"
+		}
+	}
+	limit := ""
+	if query.Limit >= 0 {
+		limit = "\n            LIMIT {limit:UInt32}"
+		params["param_limit"] = strconv.Itoa(query.Limit)
+	}
+
+	rows := make([]ClickHouseDimensionRow, 0)
+	err := c.selectEach(
+		fmt.Sprintf(
+			`SELECT grp_key, cur_pv, cur_uv, prev_pv, prev_uv FROM (
+                SELECT %[1]s AS grp_key,
+                    sumIf(sample_rate, %[4]s) AS cur_pv,
+                    %[2]s(ip, %[4]s) AS cur_uv,
+                    sumIf(sample_rate, %[5]s) AS prev_pv,
+                    %[2]s(ip, %[5]s) AS prev_uv
+                FROM %[3]s
+                WHERE pageview = 1 AND (%[6]s)%[7]s
+                GROUP BY grp_key
+            )
+            WHERE cur_pv > 0 OR prev_pv > 0
+            ORDER BY %[8]s%[9]s`,
+			query.KeyExpr, uniq, c.table(websiteID, "logs"),
+			curCond, prevCond, rangeCond, query.Filter, orderBy, limit,
+		),
+		params,
+		func(decode func(v interface{}) error) error {
+			var row ClickHouseDimensionRow
+			if err := decode(&row); err != nil {
+				return err
+			}
+			rows = append(rows, row)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("查询 ClickHouse 维度统计失败: %w", err)
+	}
+	return rows, nil
+}
+
+// HourlyMetrics 读取 [start, end] 范围内的小时汇总，UV 为汇总状态的近似值
+func (c *ClickHouseStore) HourlyMetrics(websiteID string, start, end int64) ([]HourlyMetricPoint, error) {
+	points := make([]HourlyMetricPoint, 0)
+	err := c.selectEach(
+		fmt.Sprintf(
+			`SELECT toInt64(toUnixTimestamp(bucket)) AS bucket, sum(pv) AS pv, sum(s5xx) AS s5xx,
+                uniqCombined64IfMerge(uv) AS uv
+            FROM %s
+            WHERE bucket >= toDateTime({start:Int64}) AND bucket <= toDateTime({end:Int64})
+            GROUP BY bucket ORDER BY bucket`,
+			c.table(websiteID, "agg_hourly"),
+		),
+		rangeParams(start, end),
+		func(decode func(v interface{}) error) error {
+			var row struct {
+				Bucket int64 `json:"bucket"`
+				PV     int64 `json:"pv"`
+				S5xx   int64 `json:"s5xx"`
+				UV     int64 `json:"uv"`
+			}
+			if err := decode(&row); err != nil {
+				return err
+			}
+			points = append(points, HourlyMetricPoint{Bucket: row.Bucket, PV: row.PV, UV: row.UV, S5xx: row.S5xx})
+			return nil
+		},
+	)
+	return points, err
+}
+
+// firstHourlyBucket 返回小时汇总中最早的桶，无数据时返回 0
+func (c *ClickHouseStore) firstHourlyBucket(websiteID string) (int64, error) {
+	var row struct {
+		Bucket int64 `json:"bucket"`
+	}
+	err := c.selectEach(
+		fmt.Sprintf(
+			`SELECT if(count() = 0, 0, toInt64(toUnixTimestamp(min(bucket)))) AS bucket FROM %s`,
+			c.table(websiteID, "agg_hourly"),
+		),
+		nil,
+		func(decode func(v interface{}) error) error { return decode(&row) },
+	)
+	return row.Bucket, err
+}
@@ -0,0 +1,895 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+)
+
+// fakeClickHouseRequest 记录下的一条 HTTP 请求
+type fakeClickHouseRequest struct {
+	Query  string
+	Params url.Values
+	Body   string
+	User   string
+	Key    string
+}
+
+// fakeClickHouse 模拟 ClickHouse HTTP 接口：记录每条语句与参数，保存 JSONEachRow 写入的原始日志，
+// 并对 ClickHouseStore 发出的几类查询在内存中按原始日志求值（汇总表视为物化视图的即时结果）
+type fakeClickHouse struct {
+	mu       sync.Mutex
+	requests []fakeClickHouseRequest
+	rows     map[string][]clickHouseLogRow // key: 表名，如 site_logs
+	tokens   map[string]bool
+	engines  map[string]string // system.tables 的 engine_full，key: 表名
+	status   int               // 不为 0 时所有请求返回该状态码
+}
+
+func newFakeClickHouse(t *testing.T) (*fakeClickHouse, *ClickHouseStore) {
+	t.Helper()
+	t.Setenv("CONFIG_JSON", "{}")
+	fake := &fakeClickHouse{
+		rows:    make(map[string][]clickHouseLogRow),
+		tokens:  make(map[string]bool),
+		engines: make(map[string]string),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	ch, err := newClickHouseStore(config.ClickHouseConfig{
+		URL:      server.URL + "/",
+		Database: "analytics",
+		Username: "reader",
+		Password: "secret",
+	})
+	if err != nil {
+		t.Fatalf("newClickHouseStore: %v", err)
+	}
+	return fake, ch
+}
+
+// take 返回并清空已记录的请求
+func (f *fakeClickHouse) take() []fakeClickHouseRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests := f.requests
+	f.requests = nil
+	return requests
+}
+
+func (f *fakeClickHouse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	params := r.URL.Query()
+	req := fakeClickHouseRequest{
+		Query:  string(body),
+		Params: params,
+		User:   r.Header.Get("X-ClickHouse-User"),
+		Key:    r.Header.Get("X-ClickHouse-Key"),
+	}
+	if query := params.Get("query"); query != "" {
+		req.Query, req.Body = query, string(body)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	if f.status != 0 {
+		http.Error(w, "Code: 241. DB::Exception: fake failure", f.status)
+		return
+	}
+	query := strings.TrimSpace(req.Query)
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO"):
+		if err := f.insert(query, req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	case strings.HasPrefix(query, "TRUNCATE TABLE"):
+		delete(f.rows, tableName(query))
+	case strings.HasPrefix(query, "CREATE"), strings.HasPrefix(query, "ALTER"):
+	case strings.HasPrefix(query, "SELECT"):
+		rows, err := f.selectRows(strings.TrimSuffix(query, "\nFORMAT JSONEachRow"), params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		encoder := json.NewEncoder(w)
+		for _, row := range rows {
+			encoder.Encode(row)
+		}
+	default:
+		http.Error(w, "unexpected statement: "+query, http.StatusBadRequest)
+	}
+}
+
+var (
+	clickHouseTableRe = regexp.MustCompile("`[^`]+`\\.`([^`]+)`")
+	clickHouseZoneRe  = regexp.MustCompile(`toStartOfHour\(toDateTime\(\{start:Int64\}\), '([^']+)'\)`)
+	clickHouseKeyRe   = regexp.MustCompile(`SELECT (.+?) AS grp_key`)
+	clickHouseOrderRe = regexp.MustCompile(`ORDER BY ([^\n]+)`)
+	clickHouseDateRe  = regexp.MustCompile(`^toString\(toDate\((bucket|timestamp), '([^']+)'\)\)$`)
+	clickHouseHourRe  = regexp.MustCompile(`^toString\(toUnixTimestamp\(toStartOfHour\(timestamp, '([^']+)'\)\)\)$`)
+)
+
+// tableName 返回语句中第一个表的表名（不含库名）
+func tableName(query string) string {
+	if match := clickHouseTableRe.FindStringSubmatch(query); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+func (f *fakeClickHouse) insert(query string, req fakeClickHouseRequest) error {
+	if !strings.HasSuffix(query, "FORMAT JSONEachRow") {
+		return fmt.Errorf("unexpected insert format: %s", query)
+	}
+	if token := req.Params.Get("insert_deduplication_token"); token != "" {
+		if f.tokens[token] {
+			return nil
+		}
+		f.tokens[token] = true
+	}
+	table := tableName(query)
+	scanner := bufio.NewScanner(strings.NewReader(req.Body))
+	for scanner.Scan() {
+		var row clickHouseLogRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return err
+		}
+		f.rows[table] = append(f.rows[table], row)
+	}
+	return nil
+}
+
+func paramInt(params url.Values, name string) int64 {
+	value, _ := strconv.ParseInt(params.Get("param_"+name), 10, 64)
+	return value
+}
+
+func hourStart(ts time.Time, loc *time.Location) time.Time {
+	ts = ts.In(loc)
+	return time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), 0, 0, 0, loc)
+}
+
+// selectRows 按查询的形态求值，只支持 ClickHouseStore 实际发出的几类查询
+func (f *fakeClickHouse) selectRows(query string, params url.Values) ([]map[string]interface{}, error) {
+	if strings.Contains(query, "system.tables") {
+		if engine, ok := f.engines[params.Get("param_name")]; ok {
+			return []map[string]interface{}{{"engine_full": engine}}, nil
+		}
+		return nil, nil
+	}
+	table := tableName(query)
+	site := table
+	for _, suffix := range []string{"_logs", "_agg_hourly", "_agg_daily"} {
+		site = strings.TrimSuffix(site, suffix)
+	}
+	logs := f.rows[site+"_logs"]
+	start, end := paramInt(params, "start"), paramInt(params, "end")
+	inRaw := func(row clickHouseLogRow) bool { return row.Timestamp >= start && row.Timestamp < end }
+
+	// 汇总表：小时桶落在起止时刻所在的桶之间，且桶起点早于 end
+	server := time.UTC
+	if match := clickHouseZoneRe.FindStringSubmatch(query); match != nil {
+		loc, err := time.LoadLocation(match[1])
+		if err != nil {
+			return nil, err
+		}
+		server = loc
+	}
+	inRollup := func(row clickHouseLogRow) bool {
+		bucket := hourStart(time.Unix(row.Timestamp, 0), server).Unix()
+		first := hourStart(time.Unix(start, 0), server).Unix()
+		last := hourStart(time.Unix(end, 0), server).Unix()
+		return bucket >= first && bucket <= last
+	}
+
+	switch {
+	case strings.Contains(query, "AS cur_pv"):
+		return f.topDimension(query, params, logs)
+
+	case strings.HasSuffix(table, "_agg_hourly") && strings.Contains(query, "GROUP BY grp_key"):
+		keyExpr := clickHouseKeyRe.FindStringSubmatch(query)[1]
+		groups := make(map[string]*fakeClickHouseGroup)
+		for _, row := range logs {
+			bucket := hourStart(time.Unix(row.Timestamp, 0), server)
+			if !inRollup(row) || bucket.Unix() >= end {
+				continue
+			}
+			var key string
+			if keyExpr == "toString(toUnixTimestamp(bucket))" {
+				key = strconv.FormatInt(bucket.Unix(), 10)
+			} else if match := clickHouseDateRe.FindStringSubmatch(keyExpr); match != nil && match[1] == "bucket" {
+				loc, err := time.LoadLocation(match[2])
+				if err != nil {
+					return nil, err
+				}
+				key = bucket.In(loc).Format("2006-01-02")
+			} else {
+				return nil, fmt.Errorf("unsupported rollup key: %s", keyExpr)
+			}
+			groupFor(groups, key).add(row)
+		}
+		return groupRows(groups, "pv", "uv"), nil
+
+	case strings.HasSuffix(table, "_agg_hourly") && strings.Contains(query, "uniqCombined64IfMerge(uv) AS uv"):
+		var counts fakeClickHouseGroup
+		for _, row := range logs {
+			if inRollup(row) {
+				counts.add(row)
+			}
+		}
+		return []map[string]interface{}{counts.metrics()}, nil
+
+	case strings.HasSuffix(table, "_logs") && strings.Contains(query, "uniqExact(ip) AS uv") && strings.Contains(query, "GROUP BY grp_key"):
+		keyExpr := clickHouseKeyRe.FindStringSubmatch(query)[1]
+		groups := make(map[string]*fakeClickHouseGroup)
+		for _, row := range logs {
+			if row.Pageview != 1 || !inRaw(row) {
+				continue
+			}
+			ts := time.Unix(row.Timestamp, 0)
+			var key string
+			if match := clickHouseDateRe.FindStringSubmatch(keyExpr); match != nil && match[1] == "timestamp" {
+				loc, err := time.LoadLocation(match[2])
+				if err != nil {
+					return nil, err
+				}
+				key = ts.In(loc).Format("2006-01-02")
+			} else if match := clickHouseHourRe.FindStringSubmatch(keyExpr); match != nil {
+				loc, err := time.LoadLocation(match[1])
+				if err != nil {
+					return nil, err
+				}
+				key = strconv.FormatInt(hourStart(ts, loc).Unix(), 10)
+			} else {
+				return nil, fmt.Errorf("unsupported raw key: %s", keyExpr)
+			}
+			groupFor(groups, key).add(row)
+		}
+		return groupRows(groups, "uv"), nil
+
+	case strings.HasSuffix(table, "_logs") && strings.Contains(query, "uniqExact(ip) AS uv"):
+		var visitors fakeClickHouseGroup
+		for _, row := range logs {
+			if row.Pageview == 1 && inRaw(row) {
+				visitors.add(row)
+			}
+		}
+		return []map[string]interface{}{{"uv": len(visitors.visitors)}}, nil
+	}
+	return nil, fmt.Errorf("unsupported query: %s", query)
+}
+
+// topDimension 对维度排行求值：分组键只支持单列，排序由 ORDER BY 子句对应回 sortDimensionRows 的排序方式
+func (f *fakeClickHouse) topDimension(query string, params url.Values, logs []clickHouseLogRow) ([]map[string]interface{}, error) {
+	column := clickHouseKeyRe.FindStringSubmatch(query)[1]
+	cur := TimeRange{Start: paramInt(params, "start"), End: paramInt(params, "end")}
+	prev := TimeRange{Start: paramInt(params, "prev_start"), End: paramInt(params, "prev_end")}
+	curGroups := make(map[string]*fakeClickHouseGroup)
+	prevGroups := make(map[string]*fakeClickHouseGroup)
+	for _, row := range logs {
+		if row.Pageview != 1 {
+			continue
+		}
+		var key string
+		switch column {
+		case "url":
+			key = row.URL
+		case "browser":
+			key = row.Browser
+		case "os":
+			key = row.Os
+		case "global":
+			key = row.Global
+		default:
+			return nil, fmt.Errorf("unsupported dimension key: %s", column)
+		}
+		if strings.Contains(query, "global = '中国'") && row.Global != "中国" {
+			continue
+		}
+		if inRange(row.Timestamp, cur) {
+			groupFor(curGroups, key).add(row)
+		}
+		if inRange(row.Timestamp, prev) {
+			groupFor(prevGroups, key).add(row)
+		}
+	}
+
+	sortQuery := DimensionQuery{Limit: -1}
+	switch order := clickHouseOrderRe.FindAllStringSubmatch(query, -1); order[len(order)-1][1] {
+	case "cur_uv DESC, grp_key":
+	case "cur_pv DESC, grp_key":
+		sortQuery.OrderBy = MetricPV
+	case "cur_uv DESC, prev_uv DESC, grp_key":
+		sortQuery.Compare = &prev
+	case "toInt64(cur_uv) - toInt64(prev_uv) ASC, prev_uv DESC, grp_key":
+		sortQuery.Compare, sortQuery.CompareSort = &prev, "decline"
+	case "toInt64(cur_uv) - toInt64(prev_uv) DESC, cur_uv DESC, grp_key":
+		sortQuery.Compare, sortQuery.CompareSort = &prev, "growth"
+	default:
+		return nil, fmt.Errorf("unsupported order: %s", order[len(order)-1][1])
+	}
+	if params.Has("param_limit") {
+		sortQuery.Limit = int(paramInt(params, "limit"))
+	}
+
+	merged := make(map[string]*DimensionRow)
+	for key, group := range curGroups {
+		merged[key] = &DimensionRow{Key: key, CurPV: group.pv, CurUV: len(group.visitors)}
+	}
+	for key, group := range prevGroups {
+		if merged[key] == nil {
+			merged[key] = &DimensionRow{Key: key}
+		}
+		merged[key].PrevPV, merged[key].PrevUV = group.pv, len(group.visitors)
+	}
+	rows := make([]DimensionRow, 0, len(merged))
+	for _, row := range merged {
+		rows = append(rows, *row)
+	}
+	var result []map[string]interface{}
+	for _, row := range sortDimensionRows(rows, sortQuery) {
+		result = append(result, map[string]interface{}{
+			"grp_key": row.Key, "cur_pv": row.CurPV, "cur_uv": row.CurUV, "prev_pv": row.PrevPV, "prev_uv": row.PrevUV,
+		})
+	}
+	return result, nil
+}
+
+// fakeClickHouseGroup 一个分组的计数，口径同 clickHouseRollupSelect
+type fakeClickHouseGroup struct {
+	pv, traffic, s2xx, s3xx, s4xx, s5xx, other int
+	visitors                                   map[string]struct{}
+}
+
+func groupFor(groups map[string]*fakeClickHouseGroup, key string) *fakeClickHouseGroup {
+	if groups[key] == nil {
+		groups[key] = &fakeClickHouseGroup{}
+	}
+	return groups[key]
+}
+
+func (g *fakeClickHouseGroup) add(row clickHouseLogRow) {
+	rate := int(row.SampleRate)
+	switch {
+	case row.Status >= 200 && row.Status < 300:
+		g.s2xx += rate
+	case row.Status >= 300 && row.Status < 400:
+		g.s3xx += rate
+	case row.Status >= 400 && row.Status < 500:
+		g.s4xx += rate
+	case row.Status >= 500 && row.Status < 600:
+		g.s5xx += rate
+	default:
+		g.other += rate
+	}
+	if row.Pageview != 1 {
+		return
+	}
+	g.pv += rate
+	g.traffic += row.BytesSent * rate
+	if g.visitors == nil {
+		g.visitors = make(map[string]struct{})
+	}
+	g.visitors[row.IP] = struct{}{}
+}
+
+func (g *fakeClickHouseGroup) metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"pv": g.pv, "traffic": g.traffic, "uv": len(g.visitors),
+		"s2xx": g.s2xx, "s3xx": g.s3xx, "s4xx": g.s4xx, "s5xx": g.s5xx, "other": g.other,
+	}
+}
+
+func groupRows(groups map[string]*fakeClickHouseGroup, columns ...string) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for key, group := range groups {
+		metrics := group.metrics()
+		row := map[string]interface{}{"grp_key": key}
+		for _, column := range columns {
+			row[column] = metrics[column]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// clickHouseTestDay 最近的一个本地自然日，位于默认 30 天的保留期内，UV 走原始日志精确计数
+func clickHouseTestDay(offsetDays, hour, minute int) time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day()-3+offsetDays, hour, minute, 0, 0, time.Local)
+}
+
+func clickHouseTestLog(ip, url, browser string, ts time.Time) NginxLogRecord {
+	return NginxLogRecord{
+		IP:           ip,
+		Timestamp:    ts,
+		Method:       "GET",
+		Url:          url,
+		Status:       200,
+		BytesSent:    1000,
+		Referer:      "-",
+		UserBrowser:  browser,
+		UserOs:       "Windows",
+		UserDevice:   "Desktop",
+		PageviewFlag: 1,
+	}
+}
+
+// clickHouseTestLogs 两天的样本：前一天 A、B 浏览；当天 A 浏览两页，C 为 10 倍采样的一条，另有一条 404 静态资源
+func clickHouseTestLogs() []NginxLogRecord {
+	sampled := clickHouseTestLog("10.0.0.3", "/b", "Firefox", clickHouseTestDay(0, 14, 0))
+	sampled.SampleRate = 10
+	missing := clickHouseTestLog("10.0.0.4", "/app.js", "Chrome", clickHouseTestDay(0, 11, 0))
+	missing.Status = 404
+	missing.BytesSent = 300
+	missing.PageviewFlag = 0
+	return []NginxLogRecord{
+		clickHouseTestLog("10.0.0.1", "/a", "Chrome", clickHouseTestDay(-1, 9, 0)),
+		clickHouseTestLog("10.0.0.2", "/b", "Safari", clickHouseTestDay(-1, 23, 30)),
+		clickHouseTestLog("10.0.0.1", "/a", "Chrome", clickHouseTestDay(0, 9, 0)),
+		clickHouseTestLog("10.0.0.1", "/b", "Chrome", clickHouseTestDay(0, 9, 5)),
+		sampled,
+		missing,
+	}
+}
+
+func TestClickHouseArray(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{nil, "[]"},
+		{[]string{"1.1.1.1", "::1"}, "['1.1.1.1','::1']"},
+		{[]string{"O'Brien"}, `['O\'Brien']`},
+		{[]string{`C:\path`}, `['C:\\path']`},
+		{[]string{`\'`}, `['\\\'']`},
+		{[]string{"北京·海淀"}, "['北京·海淀']"},
+	}
+	for _, tt := range tests {
+		if got := clickHouseArray(tt.values); got != tt.want {
+			t.Errorf("clickHouseArray(%q) = %s, want %s", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestClickHouseEnsureSchema(t *testing.T) {
+	fake, ch := newFakeClickHouse(t)
+	ch.timezone = "Asia/Shanghai"
+	// 原始日志表与默认保留期一致；小时汇总为 300 天，不能被当作 30 天；日汇总表查不到
+	fake.engines["site_logs"] = "MergeTree PARTITION BY toYYYYMMDD(timestamp) ORDER BY (timestamp, ip) TTL timestamp + toIntervalDay(30) SETTINGS index_granularity = 8192"
+	fake.engines["site_agg_hourly"] = "AggregatingMergeTree ORDER BY bucket TTL bucket + toIntervalDay(300)"
+
+	if err := ch.ensureClickHouseSchema("site"); err != nil {
+		t.Fatalf("ensureClickHouseSchema: %v", err)
+	}
+	requests := fake.take()
+	var statements []string
+	for _, req := range requests {
+		if req.Params.Get("database") != "analytics" || req.User != "reader" || req.Key != "secret" {
+			t.Errorf("request params/headers = %v %q %q", req.Params, req.User, req.Key)
+		}
+		statements = append(statements, req.Query)
+	}
+	if len(statements) != 9 {
+		t.Fatalf("got %d statements, want 5 CREATE + 3 TTL lookups + 1 ALTER:\n%s", len(statements), strings.Join(statements, "\n---\n"))
+	}
+
+	contains := []struct {
+		index int
+		parts []string
+	}{
+		{0, []string{"CREATE TABLE IF NOT EXISTS `analytics`.`site_logs`", "sample_rate UInt32", "TTL timestamp + INTERVAL 30 DAY", "non_replicated_deduplication_window = 1000"}},
+		{1, []string{"CREATE TABLE IF NOT EXISTS `analytics`.`site_agg_hourly`", "AggregatingMergeTree", "uv AggregateFunction(uniqCombined64If, String, UInt8)", "TTL bucket + INTERVAL 30 DAY"}},
+		{2, []string{"CREATE TABLE IF NOT EXISTS `analytics`.`site_agg_daily`", "day Date", "TTL day + INTERVAL 30 DAY"}},
+		{3, []string{"CREATE MATERIALIZED VIEW IF NOT EXISTS `analytics`.`site_agg_hourly_mv` TO `analytics`.`site_agg_hourly`", "toStartOfHour(timestamp, 'Asia/Shanghai') AS bucket", "sum(if(pageview = 1, toUInt64(sample_rate), 0)) AS pv", "FROM `analytics`.`site_logs`"}},
+		{4, []string{"CREATE MATERIALIZED VIEW IF NOT EXISTS `analytics`.`site_agg_daily_mv` TO `analytics`.`site_agg_daily`", "toDate(timestamp, 'Asia/Shanghai') AS day"}},
+		{5, []string{"SELECT engine_full FROM system.tables WHERE database = {db:String} AND name = {name:String}"}},
+		{7, []string{"ALTER TABLE `analytics`.`site_agg_hourly` MODIFY TTL bucket + INTERVAL 30 DAY"}},
+	}
+	for _, tt := range contains {
+		for _, part := range tt.parts {
+			if !strings.Contains(statements[tt.index], part) {
+				t.Errorf("statement %d missing %q:\n%s", tt.index, part, statements[tt.index])
+			}
+		}
+	}
+	lookups := []string{requests[5].Params.Get("param_name"), requests[6].Params.Get("param_name"), requests[8].Params.Get("param_name")}
+	if want := []string{"site_logs", "site_agg_hourly", "site_agg_daily"}; !reflect.DeepEqual(lookups, want) {
+		t.Errorf("TTL lookups = %v, want %v", lookups, want)
+	}
+	if got := requests[5].Params.Get("param_db"); got != "analytics" {
+		t.Errorf("param_db = %q, want analytics", got)
+	}
+}
+
+func TestClickHouseInsertLogs(t *testing.T) {
+	fake, ch := newFakeClickHouse(t)
+	logs := clickHouseTestLogs()[3:5]
+	logs[0].RefererChannel = "search"
+	if err := ch.InsertLogs("site", logs, "agent:site:7"); err != nil {
+		t.Fatalf("InsertLogs: %v", err)
+	}
+	if err := ch.InsertLogs("site", nil, ""); err != nil {
+		t.Fatalf("InsertLogs empty: %v", err)
+	}
+
+	requests := fake.take()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1 (empty batch must not be sent)", len(requests))
+	}
+	req := requests[0]
+	if want := "INSERT INTO `analytics`.`site_logs` FORMAT JSONEachRow"; req.Query != want {
+		t.Errorf("query = %q, want %q", req.Query, want)
+	}
+	if got := req.Params.Get("insert_deduplication_token"); got != "agent:site:7" {
+		t.Errorf("insert_deduplication_token = %q", got)
+	}
+	lines := strings.Split(strings.TrimSpace(req.Body), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("body has %d rows, want 2:\n%s", len(lines), req.Body)
+	}
+	var first, second map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[1]), &second)
+	if first["timestamp"] != float64(logs[0].Timestamp.Unix()) || first["url"] != "/b" || first["channel"] != "search" {
+		t.Errorf("first row = %v", first)
+	}
+	// 未采样的日志 sample_rate 为 1，采样日志按采样倍数写入
+	if first["sample_rate"] != float64(1) || second["sample_rate"] != float64(10) {
+		t.Errorf("sample_rate = %v, %v; want 1, 10", first["sample_rate"], second["sample_rate"])
+	}
+
+	// 同一令牌重发被 ClickHouse 丢弃；不带令牌时不设置去重参数
+	if err := ch.InsertLogs("site", logs, "agent:site:7"); err != nil {
+		t.Fatalf("InsertLogs retry: %v", err)
+	}
+	if got := len(fake.rows["site_logs"]); got != 2 {
+		t.Errorf("rows after retry = %d, want 2", got)
+	}
+	repo := &Repository{}
+	if err := repo.batchInsertClickHouse(ch, "site", logs[:1], nil); err != nil {
+		t.Fatalf("batchInsertClickHouse: %v", err)
+	}
+	requests = fake.take()
+	if last := requests[len(requests)-1]; last.Params.Has("insert_deduplication_token") {
+		t.Errorf("insert without ack sent token %q", last.Params.Get("insert_deduplication_token"))
+	}
+
+	fake.status = http.StatusInternalServerError
+	err := ch.InsertLogs("site", logs, "")
+	if err == nil || !strings.Contains(err.Error(), "ClickHouse 返回 500") || !strings.Contains(err.Error(), "fake failure") {
+		t.Errorf("InsertLogs on server error = %v", err)
+	}
+}
+
+// TestClickHouseBatchInsertAck agent 批次：ClickHouse 写入失败时不推进确认序号；
+// 重发同一序号时带相同的去重令牌，已确认的序号视为重复批次
+func TestClickHouseBatchInsertAck(t *testing.T) {
+	repo := openTestRepository(t)
+	fake, ch := newFakeClickHouse(t)
+	ack := AgentAck{AgentID: fmt.Sprintf("agent_%x", time.Now().UnixNano()), WebsiteID: "site", Seq: 1}
+	t.Cleanup(func() {
+		repo.db.Exec(`DELETE FROM "agent_acks" WHERE agent_id = $1`, ack.AgentID)
+	})
+	logs := clickHouseTestLogs()[:2]
+
+	fake.status = http.StatusServiceUnavailable
+	if err := repo.batchInsertClickHouse(ch, "site", logs, &ack); err == nil {
+		t.Fatal("batchInsertClickHouse succeeded while ClickHouse is down")
+	}
+	if got, err := repo.GetAgentAck(ack.AgentID, ack.WebsiteID); err != nil || got.Seq != 0 {
+		t.Fatalf("ack after failed insert = %d, %v; want 0", got.Seq, err)
+	}
+
+	fake.status = 0
+	fake.take()
+	if err := repo.batchInsertClickHouse(ch, "site", logs, &ack); err != nil {
+		t.Fatalf("batchInsertClickHouse: %v", err)
+	}
+	requests := fake.take()
+	if len(requests) != 1 || requests[0].Params.Get("insert_deduplication_token") != ack.AgentID+":site:1" {
+		t.Fatalf("insert requests = %+v", requests)
+	}
+	if got, err := repo.GetAgentAck(ack.AgentID, ack.WebsiteID); err != nil || got.Seq != 1 {
+		t.Fatalf("ack after insert = %d, %v; want 1", got.Seq, err)
+	}
+
+	if err := repo.batchInsertClickHouse(ch, "site", logs, &ack); err != ErrDuplicateBatch {
+		t.Fatalf("resend of acked batch = %v, want ErrDuplicateBatch", err)
+	}
+	if len(fake.take()) != 0 || len(fake.rows["site_logs"]) != 2 {
+		t.Errorf("duplicate batch reached ClickHouse, rows = %d", len(fake.rows["site_logs"]))
+	}
+}
+
+func TestClickHouseClearAndLocations(t *testing.T) {
+	fake, ch := newFakeClickHouse(t)
+	if err := ch.InsertLogs("site", clickHouseTestLogs(), ""); err != nil {
+		t.Fatal(err)
+	}
+	fake.take()
+
+	err := ch.updateLocations("site", map[string]IPGeoCacheEntry{"10.0.0.1": {Domestic: "北京·海淀", Global: "中国"}, " ": {}}, "待解析")
+	if err != nil {
+		t.Fatalf("updateLocations: %v", err)
+	}
+	if err := ch.markPending("site", nil, "待解析"); err != nil {
+		t.Fatalf("markPending: %v", err)
+	}
+	if err := ch.markPending("site", []string{"10.0.0.2", "x'y"}, "待解析"); err != nil {
+		t.Fatalf("markPending: %v", err)
+	}
+	if err := ch.clearWebsite("site"); err != nil {
+		t.Fatalf("clearWebsite: %v", err)
+	}
+
+	requests := fake.take()
+	if len(requests) != 5 {
+		t.Fatalf("got %d requests, want 2 ALTER + 3 TRUNCATE", len(requests))
+	}
+	update := requests[0]
+	if !strings.HasPrefix(update.Query, "ALTER TABLE `analytics`.`site_logs` UPDATE") ||
+		!strings.Contains(update.Query, "WHERE has({ips:Array(String)}, ip) AND domestic = {pending:String}") {
+		t.Errorf("update query = %s", update.Query)
+	}
+	wantParams := map[string]string{
+		"param_ips": "['10.0.0.1']", "param_domestic": "['北京·海淀']", "param_global": "['中国']", "param_pending": "待解析",
+	}
+	for key, want := range wantParams {
+		if got := update.Params.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if got := requests[1].Params.Get("param_ips"); got != `['10.0.0.2','x\'y']` {
+		t.Errorf("markPending param_ips = %s", got)
+	}
+	for i, suffix := range []string{"logs", "agg_hourly", "agg_daily"} {
+		if want := "TRUNCATE TABLE IF EXISTS `analytics`.`site_" + suffix + "`"; requests[2+i].Query != want {
+			t.Errorf("clear statement %d = %q, want %q", i, requests[2+i].Query, want)
+		}
+	}
+	if len(fake.rows["site_logs"]) != 0 {
+		t.Errorf("rows after clear = %d, want 0", len(fake.rows["site_logs"]))
+	}
+}
+
+func TestClickHouseSeries(t *testing.T) {
+	fake, ch := newFakeClickHouse(t)
+	ch.timezone = "UTC"
+	if err := ch.InsertLogs("site", clickHouseTestLogs(), ""); err != nil {
+		t.Fatal(err)
+	}
+	fake.take()
+	day := clickHouseTestDay(0, 0, 0).In(time.UTC)
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+
+	t.Run("hourly", func(t *testing.T) {
+		points, err := ch.Series("site", day, day.Add(24*time.Hour), true, "")
+		if err != nil {
+			t.Fatalf("Series: %v", err)
+		}
+		requests := fake.take()
+		if len(requests) != 2 {
+			t.Fatalf("got %d queries, want rollup + exact UV", len(requests))
+		}
+		if q := requests[0].Query; !strings.Contains(q, "SELECT toString(toUnixTimestamp(bucket)) AS grp_key") ||
+			!strings.Contains(q, "FROM `analytics`.`site_agg_hourly`") ||
+			!strings.Contains(q, "bucket >= toStartOfHour(toDateTime({start:Int64}), 'UTC')") {
+			t.Errorf("rollup query = %s", q)
+		}
+		if q := requests[1].Query; !strings.Contains(q, "toString(toUnixTimestamp(toStartOfHour(timestamp, 'UTC'))) AS grp_key, uniqExact(ip) AS uv") {
+			t.Errorf("uv query = %s", q)
+		}
+		for _, req := range requests {
+			if req.Params.Get("param_start") != strconv.FormatInt(day.Unix(), 10) ||
+				req.Params.Get("param_end") != strconv.FormatInt(day.Add(24*time.Hour).Unix(), 10) {
+				t.Errorf("range params = %s, %s", req.Params.Get("param_start"), req.Params.Get("param_end"))
+			}
+		}
+		got := make(map[string]ClickHouseSeriesPoint)
+		for _, point := range points {
+			got[point.Key] = point
+		}
+		// 11 点只有 404 静态资源：汇总表中有该小时，PV 为 0
+		hour := func(h int) string { return strconv.FormatInt(day.Add(time.Duration(h)*time.Hour).Unix(), 10) }
+		want := map[string]ClickHouseSeriesPoint{
+			hour(9):  {Key: hour(9), PV: 2, UV: 1},
+			hour(11): {Key: hour(11)},
+			hour(14): {Key: hour(14), PV: 10, UV: 1},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("hourly points = %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("zoned daily", func(t *testing.T) {
+		// 前一天 23:30 UTC 在东八区已是当天
+		points, err := ch.Series("site", day.Add(-24*time.Hour), day.Add(24*time.Hour), false, "Asia/Shanghai")
+		if err != nil {
+			t.Fatalf("Series: %v", err)
+		}
+		requests := fake.take()
+		if len(requests) != 2 {
+			t.Fatalf("got %d queries, want rollup + exact UV", len(requests))
+		}
+		if q := requests[0].Query; !strings.Contains(q, "SELECT toString(toDate(bucket, 'Asia/Shanghai')) AS grp_key") {
+			t.Errorf("rollup query = %s", q)
+		}
+		if q := requests[1].Query; !strings.Contains(q, "SELECT toString(toDate(timestamp, 'Asia/Shanghai')) AS grp_key") {
+			t.Errorf("uv query = %s", q)
+		}
+		shanghai, _ := time.LoadLocation("Asia/Shanghai")
+		got := make(map[string]ClickHouseSeriesPoint)
+		for _, point := range points {
+			got[point.Key] = point
+		}
+		prevKey := day.Add(-24 * time.Hour).In(shanghai).Format("2006-01-02")
+		curKey := day.In(shanghai).Format("2006-01-02")
+		want := map[string]ClickHouseSeriesPoint{
+			prevKey: {Key: prevKey, PV: 1, UV: 1},
+			curKey:  {Key: curKey, PV: 13, UV: 3},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("daily points = %+v, want %+v", got, want)
+		}
+	})
+}
+
+func TestClickHouseTopDimensionCompare(t *testing.T) {
+	fake, ch := newFakeClickHouse(t)
+	if err := ch.InsertLogs("site", clickHouseTestLogs(), ""); err != nil {
+		t.Fatal(err)
+	}
+	fake.take()
+	cur := clickHouseTestDay(0, 0, 0)
+	query := ClickHouseDimensionQuery{
+		KeyExpr:     "url",
+		Filter:      " AND global = '中国'",
+		Start:       cur.Unix(),
+		End:         cur.AddDate(0, 0, 1).Unix(),
+		Compare:     true,
+		PrevStart:   cur.AddDate(0, 0, -1).Unix(),
+		PrevEnd:     cur.Unix(),
+		CompareSort: "growth",
+		Limit:       5,
+	}
+	if _, err := ch.TopDimension("site", query); err != nil {
+		t.Fatalf("TopDimension: %v", err)
+	}
+	req := fake.take()[0]
+	for _, part := range []string{
+		"SELECT url AS grp_key",
+		"uniqExactIf(ip, timestamp >= toDateTime({prev_start:Int64}) AND timestamp < toDateTime({prev_end:Int64})) AS prev_uv",
+		"sumIf(sample_rate, timestamp >= toDateTime({start:Int64}) AND timestamp < toDateTime({end:Int64})) AS cur_pv",
+		"WHERE pageview = 1 AND ((timestamp >= toDateTime({start:Int64})",
+		") OR (timestamp >= toDateTime({prev_start:Int64})",
+		"AND global = '中国'",
+		"ORDER BY toInt64(cur_uv) - toInt64(prev_uv) DESC, cur_uv DESC, grp_key",
+		"LIMIT {limit:UInt32}",
+	} {
+		if !strings.Contains(req.Query, part) {
+			t.Errorf("query missing %q:\n%s", part, req.Query)
+		}
+	}
+	wantParams := map[string]int64{
+		"param_start": query.Start, "param_end": query.End, "param_prev_start": query.PrevStart, "param_prev_end": query.PrevEnd, "param_limit": 5,
+	}
+	for key, want := range wantParams {
+		if got := req.Params.Get(key); got != strconv.FormatInt(want, 10) {
+			t.Errorf("%s = %s, want %d", key, got, want)
+		}
+	}
+
+	// 非对比模式：上一期参数置 0，按 PV 排序且不限制条数
+	query = ClickHouseDimensionQuery{KeyExpr: "browser", Start: query.Start, End: query.End, OrderByPV: true, Limit: -1}
+	rows, err := ch.TopDimension("site", query)
+	if err != nil {
+		t.Fatalf("TopDimension: %v", err)
+	}
+	req = fake.take()[0]
+	if req.Params.Get("param_prev_start") != "0" || req.Params.Get("param_prev_end") != "0" || req.Params.Has("param_limit") {
+		t.Errorf("params without compare = %v", req.Params)
+	}
+	if !strings.Contains(req.Query, "ORDER BY cur_pv DESC, grp_key") || strings.Contains(req.Query, "LIMIT") {
+		t.Errorf("query without compare:\n%s", req.Query)
+	}
+	want := []ClickHouseDimensionRow{{Key: "Firefox", CurPV: 10, CurUV: 1}, {Key: "Chrome", CurPV: 2, CurUV: 1}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %+v, want %+v", rows, want)
+	}
+}
+
+// TestClickHouseStatsParity 与 analytics 测试相同的做法：同一批日志分别写入 MemoryStats 与 ClickHouse，
+// 汇总、趋势与维度排行的结果应一致
+func TestClickHouseStatsParity(t *testing.T) {
+	_, ch := newFakeClickHouse(t)
+	if loc, err := time.LoadLocation(ch.timezone); err != nil || !sameOffsets(loc, time.Local) {
+		t.Skipf("ClickHouse 时区 %s 与本地时区 %s 不一致，汇总分桶不可比", ch.timezone, time.Local)
+	}
+	logs := clickHouseTestLogs()
+	memory := NewMemoryStats()
+	memory.AddLogs("site", logs...)
+	if err := ch.InsertLogs("site", logs, ""); err != nil {
+		t.Fatal(err)
+	}
+	stats := &clickHouseStats{ch: ch}
+
+	start, end := clickHouseTestDay(-1, 0, 0), clickHouseTestDay(1, 0, 0)
+	for _, r := range []struct{ start, end time.Time }{{start, end}, {clickHouseTestDay(0, 0, 0), end}} {
+		want, _ := memory.Totals("site", r.start, r.end.Add(-time.Second))
+		got, err := stats.Totals("site", r.start, r.end.Add(-time.Second))
+		if err != nil {
+			t.Fatalf("Totals: %v", err)
+		}
+		if got != want {
+			t.Errorf("Totals(%s) = %+v, want %+v", r.start, got, want)
+		}
+	}
+
+	var hours []time.Time
+	for hour := start; hour.Before(end); hour = hour.Add(time.Hour) {
+		hours = append(hours, hour)
+	}
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	days := []time.Time{start.In(shanghai), start.AddDate(0, 0, 1).In(shanghai)}
+	for _, series := range []struct {
+		name   string
+		points []time.Time
+		hourly bool
+	}{{"hourly", hours, true}, {"daily", []time.Time{start, start.AddDate(0, 0, 1)}, false}, {"zoned daily", days, false}} {
+		want, _ := memory.Series("site", series.points, series.hourly)
+		got, err := stats.Series("site", series.points, series.hourly)
+		if err != nil {
+			t.Fatalf("Series %s: %v", series.name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Series %s = %+v, want %+v", series.name, got, want)
+		}
+	}
+
+	cur := clickHouseTestDay(0, 0, 0)
+	compare := &TimeRange{Start: start.Unix(), End: cur.Unix()}
+	for _, query := range []DimensionQuery{
+		{Dimension: DimensionURL, Start: cur, End: end, Limit: -1},
+		{Dimension: DimensionBrowser, Start: cur, End: end, OrderBy: MetricPV, Limit: 1},
+		{Dimension: DimensionURL, Start: cur, End: end, Compare: compare, Limit: 10},
+		{Dimension: DimensionURL, Start: cur, End: end, Compare: compare, CompareSort: "decline", Limit: 10},
+		{Dimension: DimensionBrowser, Start: cur, End: end, Compare: compare, CompareSort: "growth", Limit: 10},
+	} {
+		want, _ := memory.TopDimension("site", query)
+		got, err := stats.TopDimension("site", query)
+		if err != nil {
+			t.Fatalf("TopDimension: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("TopDimension(%s, compare=%t, sort=%q) = %+v, want %+v",
+				query.Dimension, query.Compare != nil, query.CompareSort, got.Rows, want.Rows)
+		}
+	}
+}
+
+// sameOffsets 两个时区在样本时间附近的 UTC 偏移是否一致
+func sameOffsets(a, b *time.Location) bool {
+	for _, ts := range []time.Time{clickHouseTestDay(-1, 0, 0), clickHouseTestDay(1, 0, 0)} {
+		_, offsetA := ts.In(a).Zone()
+		_, offsetB := ts.In(b).Zone()
+		if offsetA != offsetB {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,394 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+	"github.com/likaia/nginxpulse/internal/store/hll"
+	"github.com/sirupsen/logrus"
+)
+
+// dimAggSpec 按日维度聚合表：{site}_agg_{name}_daily(day, dim_id, pv, traffic, 状态码分类, uv_sketch)。
+// pv/traffic 只计 pageview，状态码分类计全部请求，与 _agg_daily 一致；uv_sketch 为 pageview IP 的 HLL 草图
+type dimAggSpec struct {
+	name      string // url / referer / ua / location
+	logColumn string // 日志表中的维度列
+}
+
+var dimAggSpecs = []dimAggSpec{
+	{name: "url", logColumn: "url_id"},
+	{name: "referer", logColumn: "referer_id"},
+	{name: "ua", logColumn: "ua_id"},
+	{name: "location", logColumn: "location_id"},
+}
+
+// DimAggregateTable 返回站点某个维度的按日聚合表名，dim 为 url / referer / ua / location
+func DimAggregateTable(websiteID, dim string) string {
+	return fmt.Sprintf("%s_agg_%s_daily", websiteID, dim)
+}
+
+func dimAggregateTables(websiteID string) []string {
+	tables := make([]string, 0, len(dimAggSpecs))
+	for _, spec := range dimAggSpecs {
+		tables = append(tables, DimAggregateTable(websiteID, spec.name))
+	}
+	return tables
+}
+
+func createDimAggTables(execer sqlExecer, websiteID string) error {
+	for _, table := range dimAggregateTables(websiteID) {
+		stmts := []string{
+			fmt.Sprintf(
+				`CREATE TABLE IF NOT EXISTS "%s" (
+                    day DATE NOT NULL,
+                    dim_id BIGINT NOT NULL,
+                    pv BIGINT NOT NULL DEFAULT 0,
+                    traffic BIGINT NOT NULL DEFAULT 0,
+                    s2xx BIGINT NOT NULL DEFAULT 0,
+                    s3xx BIGINT NOT NULL DEFAULT 0,
+                    s4xx BIGINT NOT NULL DEFAULT 0,
+                    s5xx BIGINT NOT NULL DEFAULT 0,
+                    other BIGINT NOT NULL DEFAULT 0,
+                    uv_sketch BYTEA NOT NULL,
+                    PRIMARY KEY(day, dim_id)
+                )`, table,
+			),
+			// 维表孤儿清理与 URL 重新归一化按 dim_id 查找
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS "idx_%s_dim" ON "%s"(dim_id)`, table, table),
+		}
+		for _, stmt := range stmts {
+			if _, err := execer.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type dimAggKey struct {
+	spec  int
+	day   string
+	dimID int64
+}
+
+type dimAggEntry struct {
+	counts aggCounts
+	sketch *hll.Sketch
+}
+
+func (b *aggBatch) addDims(log NginxLogRecord, ipID int64, dimIDs [4]int64) {
+	if b == nil {
+		return
+	}
+	day := dayBucket(log.Timestamp)
+	for spec, dimID := range dimIDs {
+		key := dimAggKey{spec: spec, day: day, dimID: dimID}
+		entry := b.dims[key]
+		if entry == nil {
+			entry = &dimAggEntry{sketch: hll.New()}
+			b.dims[key] = entry
+		}
+		addCounts(&entry.counts, log)
+		if log.PageviewFlag == 1 {
+			entry.sketch.AddInt64(ipID)
+		}
+	}
+}
+
+type dimAggStatements struct {
+	upsert       []*sql.Stmt
+	updateSketch []*sql.Stmt
+}
+
+func (d *dimAggStatements) Close() {
+	for _, stmts := range [][]*sql.Stmt{d.upsert, d.updateSketch} {
+		for _, stmt := range stmts {
+			if stmt != nil {
+				stmt.Close()
+			}
+		}
+	}
+}
+
+func prepareDimAggStatements(tx *sql.Tx, websiteID string) (*dimAggStatements, error) {
+	stmts := &dimAggStatements{}
+	for _, table := range dimAggregateTables(websiteID) {
+		// 计数在 SQL 中累加；草图无法在 SQL 中合并，返回已有草图由调用方合并后写回
+		upsert, err := tx.Prepare(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`INSERT INTO "%[1]s" (day, dim_id, pv, traffic, s2xx, s3xx, s4xx, s5xx, other, uv_sketch)
+             VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+             ON CONFLICT(day, dim_id) DO UPDATE SET
+                 pv = "%[1]s".pv + excluded.pv,
+                 traffic = "%[1]s".traffic + excluded.traffic,
+                 s2xx = "%[1]s".s2xx + excluded.s2xx,
+                 s3xx = "%[1]s".s3xx + excluded.s3xx,
+                 s4xx = "%[1]s".s4xx + excluded.s4xx,
+                 s5xx = "%[1]s".s5xx + excluded.s5xx,
+                 other = "%[1]s".other + excluded.other
+             RETURNING uv_sketch`, table,
+		)))
+		if err != nil {
+			stmts.Close()
+			return nil, err
+		}
+		stmts.upsert = append(stmts.upsert, upsert)
+
+		updateSketch, err := tx.Prepare(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`UPDATE "%s" SET uv_sketch = ? WHERE day = ? AND dim_id = ?`, table,
+		)))
+		if err != nil {
+			stmts.Close()
+			return nil, err
+		}
+		stmts.updateSketch = append(stmts.updateSketch, updateSketch)
+	}
+	return stmts, nil
+}
+
+// applyDimAggUpdates 按 (维度, 日, ID) 排序写入，与 applyAggUpdates 一样保证并发事务的加锁顺序一致
+func applyDimAggUpdates(stmts *dimAggStatements, batch *aggBatch) error {
+	if stmts == nil || batch == nil || len(batch.dims) == 0 {
+		return nil
+	}
+	keys := make([]dimAggKey, 0, len(batch.dims))
+	for key := range batch.dims {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].spec != keys[j].spec {
+			return keys[i].spec < keys[j].spec
+		}
+		if keys[i].day != keys[j].day {
+			return keys[i].day < keys[j].day
+		}
+		return keys[i].dimID < keys[j].dimID
+	})
+
+	for _, key := range keys {
+		entry := batch.dims[key]
+		counts := entry.counts
+		encoded := entry.sketch.Encode()
+		var existing []byte
+		if err := stmts.upsert[key.spec].QueryRow(
+			key.day, key.dimID,
+			counts.pv, counts.traffic, counts.s2xx, counts.s3xx, counts.s4xx, counts.s5xx, counts.other,
+			encoded,
+		).Scan(&existing); err != nil {
+			return err
+		}
+		if entry.sketch.Empty() {
+			continue
+		}
+		merged, err := hll.Decode(existing)
+		if err != nil {
+			// 草图损坏时以本批数据重新开始，计数不受影响
+			merged = hll.New()
+		}
+		if err := merged.Merge(entry.sketch); err != nil {
+			return err
+		}
+		if next := merged.Encode(); !bytes.Equal(next, existing) {
+			if _, err := stmts.updateSketch[key.spec].Exec(next, key.day, key.dimID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Repository) backfillDimAggregatesIfEmpty(websiteID string) error {
+	hasAgg, err := r.tableHasRows(DimAggregateTable(websiteID, dimAggSpecs[0].name))
+	if err != nil || hasAgg {
+		return err
+	}
+	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
+	hasLogs, err := r.tableHasRows(logTable)
+	if err != nil || !hasLogs {
+		return err
+	}
+	return r.backfillDimAggregates(websiteID)
+}
+
+// backfillDimAggregates 按日从原始日志重建维度聚合；草图需要在 Go 中计算，逐日读取以控制内存
+func (r *Repository) backfillDimAggregates(websiteID string) error {
+	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
+	var minTs, maxTs sql.NullInt64
+	if err := r.db.QueryRow(fmt.Sprintf(
+		`SELECT MIN(timestamp), MAX(timestamp) FROM "%s"`, logTable,
+	)).Scan(&minTs, &maxTs); err != nil {
+		return err
+	}
+
+	logrus.WithField("website", websiteID).Info("开始回填维度聚合数据")
+	for _, table := range dimAggregateTables(websiteID) {
+		if _, err := r.db.Exec(fmt.Sprintf(`DELETE FROM "%s"`, table)); err != nil {
+			return err
+		}
+	}
+	if !minTs.Valid {
+		return nil
+	}
+	first := time.Unix(minTs.Int64, 0).In(time.Local)
+	last := time.Unix(maxTs.Int64, 0)
+	for day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.Local); !day.After(last); day = day.AddDate(0, 0, 1) {
+		if err := r.rebuildDimAggregatesForDay(websiteID, dayBucket(day)); err != nil {
+			return err
+		}
+	}
+	logrus.WithField("website", websiteID).Info("维度聚合数据回填完成")
+	return nil
+}
+
+// rebuildDimAggregatesForDay 按剩余日志重建某个服务器本地日的维度聚合
+func (r *Repository) rebuildDimAggregatesForDay(websiteID, day string) error {
+	start, err := time.ParseInLocation("2006-01-02", day, time.Local)
+	if err != nil {
+		return err
+	}
+	end := start.AddDate(0, 0, 1)
+
+	rows, err := r.db.Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT url_id, referer_id, ua_id, location_id, ip_id, pageview_flag, bytes_sent, status_code, sample_rate
+         FROM "%s_nginx_logs"
+         WHERE timestamp >= ? AND timestamp < ?`, websiteID,
+	)), start.Unix(), end.Unix())
+	if err != nil {
+		return err
+	}
+	batch := &aggBatch{dims: make(map[dimAggKey]*dimAggEntry)}
+	for rows.Next() {
+		var (
+			dimIDs [4]int64
+			ipID   int64
+			log    NginxLogRecord
+		)
+		if err := rows.Scan(
+			&dimIDs[0], &dimIDs[1], &dimIDs[2], &dimIDs[3], &ipID,
+			&log.PageviewFlag, &log.BytesSent, &log.Status, &log.SampleRate,
+		); err != nil {
+			rows.Close()
+			return err
+		}
+		log.Timestamp = start
+		batch.addDims(log, ipID, dimIDs)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	for _, table := range dimAggregateTables(websiteID) {
+		if _, err = tx.Exec(
+			sqlutil.ReplacePlaceholders(fmt.Sprintf(`DELETE FROM "%s" WHERE day = ?`, table)),
+			day,
+		); err != nil {
+			return err
+		}
+	}
+	stmts, err := prepareDimAggStatements(tx, websiteID)
+	if err != nil {
+		return err
+	}
+	defer stmts.Close()
+	if err = applyDimAggUpdates(stmts, batch); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// remapDimAggregates URL 重新归一化时把旧 URL 的聚合行并入新 URL；草图按 (日, 新 ID) 合并。
+// 必须在 applyURLRemaps 的事务内、url_remap 临时表填充完成后调用
+func remapDimAggregates(tx *sql.Tx, websiteID string) error {
+	table := DimAggregateTable(websiteID, "url")
+	rows, err := tx.Query(fmt.Sprintf(
+		`SELECT a.day, COALESCE(m.new_id, a.dim_id), a.pv, a.traffic, a.s2xx, a.s3xx, a.s4xx, a.s5xx, a.other, a.uv_sketch
+         FROM "%s" a
+         LEFT JOIN url_remap m ON m.old_id = a.dim_id
+         WHERE a.dim_id IN (SELECT old_id FROM url_remap UNION SELECT new_id FROM url_remap)`, table,
+	))
+	if err != nil {
+		return err
+	}
+	batch := &aggBatch{dims: make(map[dimAggKey]*dimAggEntry)}
+	for rows.Next() {
+		var (
+			day     time.Time
+			key     dimAggKey
+			counts  aggCounts
+			encoded []byte
+		)
+		if err := rows.Scan(
+			&day, &key.dimID, &counts.pv, &counts.traffic,
+			&counts.s2xx, &counts.s3xx, &counts.s4xx, &counts.s5xx, &counts.other, &encoded,
+		); err != nil {
+			rows.Close()
+			return err
+		}
+		key.day = day.Format("2006-01-02")
+		entry := batch.dims[key]
+		if entry == nil {
+			entry = &dimAggEntry{sketch: hll.New()}
+			batch.dims[key] = entry
+		}
+		entry.counts.pv += counts.pv
+		entry.counts.traffic += counts.traffic
+		entry.counts.s2xx += counts.s2xx
+		entry.counts.s3xx += counts.s3xx
+		entry.counts.s4xx += counts.s4xx
+		entry.counts.s5xx += counts.s5xx
+		entry.counts.other += counts.other
+		if sketch, err := hll.Decode(encoded); err == nil {
+			if err := entry.sketch.Merge(sketch); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+	if len(batch.dims) == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf(
+		`DELETE FROM "%s" WHERE dim_id IN (SELECT old_id FROM url_remap UNION SELECT new_id FROM url_remap)`, table,
+	)); err != nil {
+		return err
+	}
+	insert, err := tx.Prepare(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`INSERT INTO "%s" (day, dim_id, pv, traffic, s2xx, s3xx, s4xx, s5xx, other, uv_sketch)
+         VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, table,
+	)))
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for key, entry := range batch.dims {
+		counts := entry.counts
+		if _, err := insert.Exec(
+			key.day, key.dimID,
+			counts.pv, counts.traffic, counts.s2xx, counts.s3xx, counts.s4xx, counts.s5xx, counts.other,
+			entry.sketch.Encode(),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+// Package hll 提供可合并的 HyperLogLog 基数估计，用于按时间段与维度存储 UV 草图。
+//
+// 二进制格式：第 1 字节为编码（1 稀疏 / 2 稠密），第 2 字节为精度 p；
+// 稀疏编码随后是按寄存器下标升序的 (uint16 下标, uint8 秩) 三元组，稠密编码随后是 2^p 个寄存器。
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// Precision 默认精度，4096 个寄存器，标准误差约 1.6%
+	Precision = 12
+
+	encodingSparse = 1
+	encodingDense  = 2
+)
+
+var ErrInvalidSketch = errors.New("invalid hll sketch")
+
+// Sketch HyperLogLog 草图；基数较小时以稀疏形式保存，编码后只占几个字节
+type Sketch struct {
+	p      uint8
+	sparse map[uint16]uint8
+	dense  []uint8
+}
+
+// New 创建默认精度的空草图
+func New() *Sketch {
+	return &Sketch{p: Precision, sparse: make(map[uint16]uint8)}
+}
+
+// Decode 解析编码后的草图，空数据视为空草图
+func Decode(data []byte) (*Sketch, error) {
+	if len(data) == 0 {
+		return New(), nil
+	}
+	if len(data) < 2 || data[1] < 4 || data[1] > 16 {
+		return nil, ErrInvalidSketch
+	}
+	s := &Sketch{p: data[1]}
+	m := 1 << s.p
+	maxRank := s.maxRank()
+	body := data[2:]
+	switch data[0] {
+	case encodingSparse:
+		if len(body)%3 != 0 {
+			return nil, ErrInvalidSketch
+		}
+		s.sparse = make(map[uint16]uint8, len(body)/3)
+		for i := 0; i < len(body); i += 3 {
+			idx := binary.BigEndian.Uint16(body[i:])
+			if int(idx) >= m || body[i+2] == 0 || body[i+2] > maxRank {
+				return nil, ErrInvalidSketch
+			}
+			s.sparse[idx] = body[i+2]
+		}
+	case encodingDense:
+		if len(body) != m {
+			return nil, ErrInvalidSketch
+		}
+		for _, rank := range body {
+			if rank > maxRank {
+				return nil, ErrInvalidSketch
+			}
+		}
+		s.dense = append([]uint8(nil), body...)
+	default:
+		return nil, ErrInvalidSketch
+	}
+	return s, nil
+}
+
+// AddInt64 记录一个整数 ID（如 ip_id）
+func (s *Sketch) AddInt64(id int64) {
+	s.AddHash(mix64(uint64(id)))
+}
+
+// AddHash 记录一个已均匀分布的 64 位哈希
+func (s *Sketch) AddHash(hash uint64) {
+	idx := uint16(hash >> (64 - s.p))
+	rank := uint8(bits.LeadingZeros64(hash<<s.p|1<<(s.p-1)) + 1)
+	s.set(idx, rank)
+}
+
+// maxRank 秩的上限：哈希去掉下标位后剩余 64-p 位，全为 0 时秩为 64-p+1
+func (s *Sketch) maxRank() uint8 {
+	return 64 - s.p + 1
+}
+
+func (s *Sketch) set(idx uint16, rank uint8) {
+	if s.dense != nil {
+		if rank > s.dense[idx] {
+			s.dense[idx] = rank
+		}
+		return
+	}
+	if rank > s.sparse[idx] {
+		s.sparse[idx] = rank
+		// 稀疏编码每项 3 字节，超过稠密编码大小后转换
+		if len(s.sparse)*3 >= 1<<s.p {
+			s.toDense()
+		}
+	}
+}
+
+func (s *Sketch) toDense() {
+	s.dense = make([]uint8, 1<<s.p)
+	for idx, rank := range s.sparse {
+		s.dense[idx] = rank
+	}
+	s.sparse = nil
+}
+
+// Merge 合并另一个草图（取各寄存器最大值）；精度不同的草图无法合并
+func (s *Sketch) Merge(other *Sketch) error {
+	if other == nil {
+		return nil
+	}
+	if other.p != s.p {
+		return ErrInvalidSketch
+	}
+	if other.dense != nil {
+		if s.dense == nil {
+			s.toDense()
+		}
+		for idx, rank := range other.dense {
+			if rank > s.dense[idx] {
+				s.dense[idx] = rank
+			}
+		}
+		return nil
+	}
+	for idx, rank := range other.sparse {
+		s.set(idx, rank)
+	}
+	return nil
+}
+
+// Empty 草图是否未记录任何值
+func (s *Sketch) Empty() bool {
+	if s.dense == nil {
+		return len(s.sparse) == 0
+	}
+	for _, rank := range s.dense {
+		if rank != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Estimate 返回基数估计；寄存器空位较多时使用线性计数，小基数下接近精确
+func (s *Sketch) Estimate() uint64 {
+	m := float64(int(1) << s.p)
+	zeros := 0
+	sum := 0.0
+	if s.dense != nil {
+		for _, rank := range s.dense {
+			if rank == 0 {
+				zeros++
+			}
+			sum += math.Ldexp(1, -int(rank))
+		}
+	} else {
+		zeros = int(m) - len(s.sparse)
+		sum = float64(zeros)
+		for _, rank := range s.sparse {
+			sum += math.Ldexp(1, -int(rank))
+		}
+	}
+	estimate := alpha(m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// RelativeError 估计值的相对标准误差
+func (s *Sketch) RelativeError() float64 {
+	return 1.04 / math.Sqrt(float64(int(1)<<s.p))
+}
+
+// Encode 编码为二进制，稀疏形式按下标排序以保证相同内容得到相同字节
+func (s *Sketch) Encode() []byte {
+	if s.dense != nil {
+		out := make([]byte, 2, 2+len(s.dense))
+		out[0], out[1] = encodingDense, s.p
+		return append(out, s.dense...)
+	}
+	indexes := make([]int, 0, len(s.sparse))
+	for idx := range s.sparse {
+		indexes = append(indexes, int(idx))
+	}
+	sort.Ints(indexes)
+	out := make([]byte, 2, 2+3*len(indexes))
+	out[0], out[1] = encodingSparse, s.p
+	for _, idx := range indexes {
+		out = binary.BigEndian.AppendUint16(out, uint16(idx))
+		out = append(out, s.sparse[uint16(idx)])
+	}
+	return out
+}
+
+func alpha(m float64) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/m)
+}
+
+// mix64 splitmix64 的终结函数，把连续的 ID 打散为均匀分布的哈希
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
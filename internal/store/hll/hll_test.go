@@ -0,0 +1,147 @@
+package hll
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+// sketchOf 记录 [from, to) 内的整数 ID
+func sketchOf(from, to int64) *Sketch {
+	s := New()
+	for id := from; id < to; id++ {
+		s.AddInt64(id)
+	}
+	return s
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		sketch   *Sketch
+		encoding byte
+	}{
+		{"empty", New(), encodingSparse},
+		{"sparse", sketchOf(0, 100), encodingSparse},
+		{"dense", sketchOf(0, 10000), encodingDense},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.sketch.Encode()
+			if data[0] != tt.encoding || data[1] != Precision {
+				t.Fatalf("header = %v, want encoding %d, precision %d", data[:2], tt.encoding, Precision)
+			}
+			decoded, err := Decode(data)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if again := decoded.Encode(); !bytes.Equal(again, data) {
+				t.Fatalf("re-encoded %d bytes differ from original %d bytes", len(again), len(data))
+			}
+			if decoded.Estimate() != tt.sketch.Estimate() || decoded.Empty() != tt.sketch.Empty() {
+				t.Errorf("decoded estimate/empty = %d/%t, want %d/%t",
+					decoded.Estimate(), decoded.Empty(), tt.sketch.Estimate(), tt.sketch.Empty())
+			}
+
+			// 解码结果不引用输入缓冲区
+			for i := 2; i < len(data); i++ {
+				data[i] = 0
+			}
+			if again := decoded.Encode(); bytes.Equal(again, data) && !tt.sketch.Empty() {
+				t.Error("decoded sketch shares memory with its input")
+			}
+		})
+	}
+
+	if s, err := Decode(nil); err != nil || !s.Empty() || s.Estimate() != 0 {
+		t.Errorf("Decode(nil) = %v, %v; want empty sketch", s, err)
+	}
+}
+
+func TestDecodeRejectsInvalidInput(t *testing.T) {
+	sparse := sketchOf(0, 10).Encode()
+	dense := sketchOf(0, 10000).Encode()
+	maxRank := byte(64 - Precision + 1)
+
+	withByte := func(data []byte, i int, value byte) []byte {
+		out := append([]byte(nil), data...)
+		out[i] = value
+		return out
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"header only byte", []byte{encodingSparse}},
+		{"unknown encoding", withByte(sparse, 0, 3)},
+		{"precision too small", []byte{encodingSparse, 3}},
+		{"precision too large", []byte{encodingDense, 17}},
+		{"truncated sparse entry", sparse[:len(sparse)-1]},
+		{"truncated dense", dense[:len(dense)-1]},
+		{"dense too long", append(append([]byte(nil), dense...), 0)},
+		{"sparse index out of range", []byte{encodingSparse, Precision, 0x10, 0x00, 1}},
+		{"sparse zero rank", []byte{encodingSparse, Precision, 0x00, 0x01, 0}},
+		{"sparse rank out of range", []byte{encodingSparse, Precision, 0x00, 0x01, maxRank + 1}},
+		{"dense rank out of range", withByte(dense, 2, maxRank+1)},
+	}
+	for _, tt := range tests {
+		if s, err := Decode(tt.data); !errors.Is(err, ErrInvalidSketch) {
+			t.Errorf("%s: Decode = %v, %v; want ErrInvalidSketch", tt.name, s, err)
+		}
+	}
+
+	// 边界值仍可解码
+	if _, err := Decode([]byte{encodingSparse, Precision, 0x0f, 0xff, maxRank}); err != nil {
+		t.Errorf("last index with max rank: %v", err)
+	}
+}
+
+func TestMergeEqualsUnion(t *testing.T) {
+	tests := []struct {
+		name        string
+		left, right [2]int64
+	}{
+		{"sparse+dense", [2]int64{0, 100}, [2]int64{50, 20000}},
+		{"dense+sparse", [2]int64{50, 20000}, [2]int64{0, 100}},
+		{"sparse+sparse", [2]int64{0, 500}, [2]int64{400, 1200}},
+		{"dense+dense", [2]int64{0, 20000}, [2]int64{10000, 40000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged := sketchOf(tt.left[0], tt.left[1])
+			if err := merged.Merge(sketchOf(tt.right[0], tt.right[1])); err != nil {
+				t.Fatalf("Merge: %v", err)
+			}
+			from := min(tt.left[0], tt.right[0])
+			to := max(tt.left[1], tt.right[1])
+			union := sketchOf(from, to)
+			if !bytes.Equal(merged.Encode(), union.Encode()) {
+				t.Errorf("merged sketch differs from union: estimate %d vs %d", merged.Estimate(), union.Estimate())
+			}
+		})
+	}
+
+	s := sketchOf(0, 10)
+	if err := s.Merge(nil); err != nil {
+		t.Errorf("Merge(nil) = %v", err)
+	}
+	other := &Sketch{p: Precision - 1, sparse: map[uint16]uint8{}}
+	if err := s.Merge(other); !errors.Is(err, ErrInvalidSketch) {
+		t.Errorf("Merge with different precision = %v, want ErrInvalidSketch", err)
+	}
+}
+
+func TestEstimateWithinRelativeError(t *testing.T) {
+	for _, n := range []int64{1e2, 1e4, 1e6} {
+		s := sketchOf(0, n)
+		estimate := float64(s.Estimate())
+		sigma := s.RelativeError() * float64(n)
+		if diff := math.Abs(estimate - float64(n)); diff > 3*sigma {
+			t.Errorf("n = %d: estimate %.0f off by %.0f, want within 3σ = %.0f", n, estimate, diff, 3*sigma)
+		}
+	}
+	if got := New().RelativeError(); math.Abs(got-1.04/64) > 1e-12 {
+		t.Errorf("RelativeError = %f, want 1.04/sqrt(4096)", got)
+	}
+}
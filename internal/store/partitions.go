@@ -0,0 +1,558 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PartitionDay   = "day"
+	PartitionMonth = "month"
+
+	// logPartitionsAhead 提前创建的分区个数（不含当前分区）
+	logPartitionsAhead = 3
+
+	dayPartitionLayout   = "20060102"
+	monthPartitionLayout = "200601"
+)
+
+// logColumns 日志表的列，在分区之间搬移数据时使用
+const logColumns = `id, ip_id, pageview_flag, timestamp, method, url_id, status_code,
+            bytes_sent, referer_id, ua_id, location_id, raw_url, sample_rate`
+
+// logPartition 日志表的一个时间分区，范围为 [start, end)，按本地时区对齐
+type logPartition struct {
+	name  string
+	start time.Time
+	end   time.Time
+}
+
+func partitionInterval() string {
+	if strings.EqualFold(strings.TrimSpace(config.ReadConfig().Database.PartitionInterval), PartitionMonth) {
+		return PartitionMonth
+	}
+	return PartitionDay
+}
+
+// partitionFor 返回 ts 所在的分区范围与名称
+func partitionFor(websiteID, interval string, ts time.Time) logPartition {
+	local := ts.In(time.Local)
+	if interval == PartitionMonth {
+		start := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, time.Local)
+		return logPartition{
+			name:  fmt.Sprintf("%s_nginx_logs_p%s", websiteID, start.Format(monthPartitionLayout)),
+			start: start,
+			end:   start.AddDate(0, 1, 0),
+		}
+	}
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.Local)
+	return logPartition{
+		name:  fmt.Sprintf("%s_nginx_logs_p%s", websiteID, start.Format(dayPartitionLayout)),
+		start: start,
+		end:   start.AddDate(0, 0, 1),
+	}
+}
+
+// parsePartitionName 从分区名还原范围；切换 partitionInterval 后旧粒度的分区仍能识别
+func parsePartitionName(websiteID, name string) (logPartition, bool) {
+	prefix := websiteID + "_nginx_logs_p"
+	if !strings.HasPrefix(name, prefix) {
+		return logPartition{}, false
+	}
+	suffix := strings.TrimPrefix(name, prefix)
+	switch len(suffix) {
+	case len(dayPartitionLayout):
+		start, err := time.ParseInLocation(dayPartitionLayout, suffix, time.Local)
+		if err != nil {
+			return logPartition{}, false
+		}
+		return logPartition{name: name, start: start, end: start.AddDate(0, 0, 1)}, true
+	case len(monthPartitionLayout):
+		start, err := time.ParseInLocation(monthPartitionLayout, suffix, time.Local)
+		if err != nil {
+			return logPartition{}, false
+		}
+		return logPartition{name: name, start: start, end: start.AddDate(0, 1, 0)}, true
+	}
+	return logPartition{}, false
+}
+
+func (p logPartition) overlaps(other logPartition) bool {
+	return p.start.Before(other.end) && other.start.Before(p.end)
+}
+
+func (p logPartition) contains(ts time.Time) bool {
+	return !ts.Before(p.start) && ts.Before(p.end)
+}
+
+// isPartitionedTable 日志表是否为分区表（早期版本迁移前可能是普通表）
+func (r *Repository) isPartitionedTable(tableName string) (bool, error) {
+	row := r.db.QueryRow(sqlutil.ReplacePlaceholders(
+		`SELECT c.relkind = 'p'
+         FROM pg_class c
+         JOIN pg_namespace n ON n.oid = c.relnamespace
+         WHERE n.nspname = 'public'
+           AND c.relname = ?`,
+	), tableName)
+	var partitioned bool
+	if err := row.Scan(&partitioned); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return partitioned, nil
+}
+
+// defaultPartitionName 返回分区表的 DEFAULT 分区名，没有时返回空
+func (r *Repository) defaultPartitionName(tableName string) (string, error) {
+	row := r.db.QueryRow(sqlutil.ReplacePlaceholders(
+		`SELECT d.relname
+         FROM pg_partitioned_table pt
+         JOIN pg_class p ON p.oid = pt.partrelid
+         JOIN pg_namespace n ON n.oid = p.relnamespace
+         JOIN pg_class d ON d.oid = pt.partdefid
+         WHERE n.nspname = 'public'
+           AND p.relname = ?`,
+	), tableName)
+	var name string
+	if err := row.Scan(&name); err != nil {
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		return "", err
+	}
+	return name, nil
+}
+
+// loadLogPartitions 读取日志表现有的时间分区，按起始时间排序
+func (r *Repository) loadLogPartitions(websiteID string) ([]logPartition, error) {
+	rows, err := r.db.Query(sqlutil.ReplacePlaceholders(
+		`SELECT c.relname
+         FROM pg_inherits i
+         JOIN pg_class c ON c.oid = i.inhrelid
+         JOIN pg_class p ON p.oid = i.inhparent
+         JOIN pg_namespace n ON n.oid = p.relnamespace
+         WHERE n.nspname = 'public'
+           AND p.relname = ?`,
+	), fmt.Sprintf("%s_nginx_logs", websiteID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []logPartition
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if partition, ok := parsePartitionName(websiteID, name); ok {
+			partitions = append(partitions, partition)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].start.Before(partitions[j].start)
+	})
+	return partitions, nil
+}
+
+// cachedLogPartitions 返回缓存的分区列表，首次访问时从数据库加载；调用方需持有 partitionMu
+func (r *Repository) cachedLogPartitions(websiteID string) ([]logPartition, error) {
+	if partitions, ok := r.partitions[websiteID]; ok {
+		return partitions, nil
+	}
+	partitions, err := r.loadLogPartitions(websiteID)
+	if err != nil {
+		return nil, err
+	}
+	r.partitions[websiteID] = partitions
+	return partitions, nil
+}
+
+// ensureLogPartition 确保 ts 所在的时间落在某个分区内，缺少时创建。
+// 与已有分区重叠时（切换过 partitionInterval）退回按天创建，仍重叠说明已被覆盖
+func (r *Repository) ensureLogPartition(websiteID string, ts time.Time) error {
+	r.partitionMu.Lock()
+	defer r.partitionMu.Unlock()
+
+	partitions, err := r.cachedLogPartitions(websiteID)
+	if err != nil {
+		return err
+	}
+	for _, existing := range partitions {
+		if existing.contains(ts) {
+			return nil
+		}
+	}
+
+	target := partitionFor(websiteID, partitionInterval(), ts)
+	for _, existing := range partitions {
+		if target.overlaps(existing) {
+			target = partitionFor(websiteID, PartitionDay, ts)
+			break
+		}
+	}
+	for _, existing := range partitions {
+		if target.overlaps(existing) {
+			return nil
+		}
+	}
+
+	if err := r.createLogPartition(websiteID, target); err != nil {
+		// 其他进程可能并发创建或调整了分区，丢弃缓存下次重新加载
+		delete(r.partitions, websiteID)
+		return err
+	}
+	partitions = append(partitions, target)
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].start.Before(partitions[j].start)
+	})
+	r.partitions[websiteID] = partitions
+	return nil
+}
+
+// createLogPartition 创建分区；DEFAULT 分区中已有该范围的数据时先搬入新表再挂载，
+// 否则 PostgreSQL 会拒绝创建与 DEFAULT 分区数据冲突的分区
+func (r *Repository) createLogPartition(websiteID string, partition logPartition) (err error) {
+	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
+	defaultTable, err := r.defaultPartitionName(logTable)
+	if err != nil {
+		return err
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// 多个实例共用数据库时串行创建
+	if _, err = tx.Exec(fmt.Sprintf(
+		`SELECT pg_advisory_xact_lock(hashtext('%s:log_partition'))`, websiteID,
+	)); err != nil {
+		return err
+	}
+	var existing sql.NullString
+	if err = tx.QueryRow(
+		sqlutil.ReplacePlaceholders(`SELECT to_regclass(?)::text`), fmt.Sprintf(`"%s"`, partition.name),
+	).Scan(&existing); err != nil {
+		return err
+	}
+	if existing.Valid {
+		return tx.Commit()
+	}
+
+	start, end := partition.start.Unix(), partition.end.Unix()
+	hasDefaultRows := false
+	if defaultTable != "" {
+		if err = tx.QueryRow(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`SELECT EXISTS (SELECT 1 FROM "%s" WHERE timestamp >= ? AND timestamp < ?)`, defaultTable,
+		)), start, end).Scan(&hasDefaultRows); err != nil {
+			return err
+		}
+	}
+
+	if !hasDefaultRows {
+		if _, err = tx.Exec(fmt.Sprintf(
+			`CREATE TABLE "%s" PARTITION OF "%s" FOR VALUES FROM (%d) TO (%d)`,
+			partition.name, logTable, start, end,
+		)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	if _, err = tx.Exec(fmt.Sprintf(
+		`CREATE TABLE "%s" (LIKE "%s" INCLUDING DEFAULTS)`, partition.name, logTable,
+	)); err != nil {
+		return err
+	}
+	result, err := tx.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`WITH moved AS (
+            DELETE FROM "%s" WHERE timestamp >= ? AND timestamp < ?
+            RETURNING %s
+        )
+        INSERT INTO "%s" (%s) SELECT %s FROM moved`,
+		defaultTable, logColumns, partition.name, logColumns, logColumns,
+	)), start, end)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf(
+		`ALTER TABLE "%s" ATTACH PARTITION "%s" FOR VALUES FROM (%d) TO (%d)`,
+		logTable, partition.name, start, end,
+	)); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	moved, _ := result.RowsAffected()
+	logrus.WithFields(logrus.Fields{
+		"website":   websiteID,
+		"partition": partition.name,
+		"rows":      moved,
+	}).Info("已将 DEFAULT 分区中的日志迁入时间分区")
+	return nil
+}
+
+// ensureLogPartitionsForLogs 写入前为批次涉及的时间创建分区；超出保留期的记录留在 DEFAULT 分区等待清理
+func (r *Repository) ensureLogPartitionsForLogs(websiteID string, logs []NginxLogRecord) {
+	cutoff := retentionCutoff(websiteID)
+	interval := partitionInterval()
+	seen := make(map[string]struct{})
+	for _, entry := range logs {
+		if entry.Timestamp.Before(cutoff) {
+			continue
+		}
+		partition := partitionFor(websiteID, interval, entry.Timestamp)
+		if _, ok := seen[partition.name]; ok {
+			continue
+		}
+		seen[partition.name] = struct{}{}
+		if err := r.ensureLogPartition(websiteID, entry.Timestamp); err != nil {
+			logrus.WithError(err).Warnf("创建网站 %s 的日志分区 %s 失败，日志将写入 DEFAULT 分区", websiteID, partition.name)
+		}
+	}
+}
+
+// ensureUpcomingLogPartitions 创建当前及后续 logPartitionsAhead 个分区
+func (r *Repository) ensureUpcomingLogPartitions(websiteID string) error {
+	interval := partitionInterval()
+	ts := time.Now()
+	for i := 0; i <= logPartitionsAhead; i++ {
+		if err := r.ensureLogPartition(websiteID, ts); err != nil {
+			return err
+		}
+		ts = partitionFor(websiteID, interval, ts).end
+	}
+	return nil
+}
+
+// migrateDefaultLogPartition 把 DEFAULT 分区中保留期内的日志迁入对应的时间分区；
+// 早期版本只创建了 DEFAULT 分区，升级后首次启动会在这里完成迁移
+func (r *Repository) migrateDefaultLogPartition(websiteID string) error {
+	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
+	defaultTable, err := r.defaultPartitionName(logTable)
+	if err != nil || defaultTable == "" {
+		return err
+	}
+	cutoff := retentionCutoff(websiteID)
+
+	var minTs, maxTs sql.NullInt64
+	if err := r.db.QueryRow(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT MIN(timestamp), MAX(timestamp) FROM "%s" WHERE timestamp >= ?`, defaultTable,
+	)), cutoff.Unix()).Scan(&minTs, &maxTs); err != nil {
+		return err
+	}
+	if !minTs.Valid {
+		return nil
+	}
+
+	logrus.WithField("website", websiteID).Info("开始将 DEFAULT 分区中的日志迁入时间分区")
+	interval := partitionInterval()
+	end := time.Unix(maxTs.Int64, 0)
+	for ts := time.Unix(minTs.Int64, 0); !ts.After(end); ts = partitionFor(websiteID, interval, ts).end {
+		if err := r.ensureLogPartition(websiteID, ts); err != nil {
+			return err
+		}
+	}
+	logrus.WithField("website", websiteID).Info("DEFAULT 分区日志迁移完成")
+	return nil
+}
+
+// initLogPartitions 启动时迁移 DEFAULT 分区数据并预建分区
+func (r *Repository) initLogPartitions(websiteID string) error {
+	partitioned, err := r.isPartitionedTable(fmt.Sprintf("%s_nginx_logs", websiteID))
+	if err != nil || !partitioned {
+		return err
+	}
+	if err := r.migrateDefaultLogPartition(websiteID); err != nil {
+		return err
+	}
+	return r.ensureUpcomingLogPartitions(websiteID)
+}
+
+// dropExpiredLogPartitions 摘除并删除整体早于原始日志保留起点的分区，返回已删除的分区。
+// 删除前先清理只被该分区引用的维表记录
+func (r *Repository) dropExpiredLogPartitions(websiteID string, tiers RetentionTiers) ([]logPartition, error) {
+	cutoff := tiers.Raw
+	r.partitionMu.Lock()
+	defer r.partitionMu.Unlock()
+
+	partitions, err := r.loadLogPartitions(websiteID)
+	if err != nil {
+		return nil, err
+	}
+	r.partitions[websiteID] = partitions
+
+	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
+	var dropped []logPartition
+	for _, partition := range partitions {
+		if partition.end.After(cutoff) {
+			break
+		}
+		if _, err := r.db.Exec(fmt.Sprintf(
+			`ALTER TABLE "%s" DETACH PARTITION "%s"`, logTable, partition.name,
+		)); err != nil {
+			delete(r.partitions, websiteID)
+			return dropped, err
+		}
+		if err := r.cleanupDetachedDims(websiteID, partition.name, tiers); err != nil {
+			logrus.WithError(err).Warnf("清理分区 %s 引用的维表数据失败", partition.name)
+		}
+		if _, err := r.db.Exec(fmt.Sprintf(`DROP TABLE "%s"`, partition.name)); err != nil {
+			delete(r.partitions, websiteID)
+			return dropped, err
+		}
+		dropped = append(dropped, partition)
+	}
+	r.partitions[websiteID] = partitions[len(dropped):]
+	return dropped, nil
+}
+
+// cleanupDetachedDims 删除已摘除分区引用、且不再被日志表与长期保留层引用的维表记录；
+// 只检查该分区出现过的 ID，不扫描整个维表
+func (r *Repository) cleanupDetachedDims(websiteID, detachedTable string, tiers RetentionTiers) error {
+	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
+	dims := []struct {
+		table  string
+		column string
+	}{
+		{table: fmt.Sprintf("%s_dim_ip", websiteID), column: "ip_id"},
+		{table: fmt.Sprintf("%s_dim_url", websiteID), column: "url_id"},
+		{table: fmt.Sprintf("%s_dim_referer", websiteID), column: "referer_id"},
+		{table: fmt.Sprintf("%s_dim_ua", websiteID), column: "ua_id"},
+		{table: fmt.Sprintf("%s_dim_location", websiteID), column: "location_id"},
+	}
+	retained, err := r.retainedDimReferences(websiteID, tiers)
+	if err != nil {
+		return err
+	}
+	for _, dim := range dims {
+		exists, err := r.tableExists(dim.table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if _, err := r.db.Exec(fmt.Sprintf(
+			`DELETE FROM "%s" d
+             WHERE d.id IN (SELECT DISTINCT %s FROM "%s")
+               AND NOT EXISTS (SELECT 1 FROM "%s" l WHERE l.%s = d.id)%s`,
+			dim.table, dim.column, detachedTable, logTable, dim.column, retainedDimClause("d", retained[dim.column]),
+		)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupDroppedRange 清理已删除分区时间范围内、跟随原始日志保留的聚合、首次访问、会话与异常记录；
+// 保留期更长的层由 cleanupLongTiers 按各自期限处理。
+// 分区按本地零点对齐，小时与天聚合不会跨越分区边界，无需重建边界桶
+func (r *Repository) cleanupDroppedRange(websiteID string, partition logPartition, tiers RetentionTiers) error {
+	start, end := partition.start, partition.end
+	if !tiers.outlives(tiers.Hourly) {
+		for _, table := range []string{
+			fmt.Sprintf("%s_agg_hourly", websiteID),
+			fmt.Sprintf("%s_agg_hourly_ip", websiteID),
+			UVSketchTable(websiteID, "hourly"),
+		} {
+			if _, err := r.db.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+				`DELETE FROM "%s" WHERE bucket >= ? AND bucket < ?`, table,
+			)), start.Unix(), end.Unix()); err != nil {
+				return err
+			}
+		}
+		if err := r.cleanupAnomalies(websiteID, end); err != nil {
+			return err
+		}
+	}
+	if !tiers.outlives(tiers.Daily) {
+		daily := append([]string{
+			fmt.Sprintf("%s_agg_daily", websiteID),
+			fmt.Sprintf("%s_agg_daily_ip", websiteID),
+			UVSketchTable(websiteID, "daily"),
+		}, dimAggregateTables(websiteID)...)
+		for _, table := range daily {
+			if _, err := r.db.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+				`DELETE FROM "%s" WHERE day >= ? AND day < ?`, table,
+			)), dayBucket(start), dayBucket(end)); err != nil {
+				return err
+			}
+		}
+	}
+	if !tiers.outlives(tiers.FirstSeen) {
+		if err := r.cleanupFirstSeenBefore(websiteID, end); err != nil {
+			return err
+		}
+	}
+	if !tiers.outlives(tiers.Sessions) {
+		if err := r.cleanupSessions(websiteID, end); err != nil {
+			return err
+		}
+	}
+	if !tiers.outlives(tiers.Daily) {
+		return r.cleanupSessionAggregates(websiteID, end, true)
+	}
+	return nil
+}
+
+// cleanupFirstSeenBefore 首次访问早于 end 的 IP 改为其剩余日志中最早的 PV 时间，没有剩余 PV 的删除
+func (r *Repository) cleanupFirstSeenBefore(websiteID string, end time.Time) error {
+	firstSeenTable := fmt.Sprintf("%s_first_seen", websiteID)
+	exists, err := r.tableExists(firstSeenTable)
+	if err != nil || !exists {
+		return err
+	}
+	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`UPDATE "%s" fs
+         SET first_ts = remaining.first_ts
+         FROM (
+             SELECT l.ip_id, MIN(l.timestamp) AS first_ts
+             FROM "%s" l
+             WHERE l.pageview_flag = 1
+               AND l.ip_id IN (SELECT ip_id FROM "%s" WHERE first_ts < ?)
+             GROUP BY l.ip_id
+         ) remaining
+         WHERE fs.ip_id = remaining.ip_id`,
+		firstSeenTable, logTable, firstSeenTable,
+	)), end.Unix()); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`DELETE FROM "%s" WHERE first_ts < ?`, firstSeenTable,
+	)), end.Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+)
+
+const refererClassifyBatchSize = 2000
+
+// RefererClass 来源维表的分类列
+type RefererClass struct {
+	Host    string
+	Channel string
+	Source  string
+	Keyword string
+}
+
+type refererClassRow struct {
+	id    int64
+	class RefererClass
+}
+
+// ClassifyReferers 为来源维表写入 host/channel/source/keyword。
+// onlyMissing 为 true 时只处理尚未分类（channel 为空）的行，用于升级后的回填；
+// 为 false 时重算全部行，用于来源库更新后的重新分类。返回更新的行数。
+func (r *Repository) ClassifyReferers(websiteID string, classify func(string) RefererClass, onlyMissing bool) (int, error) {
+	if classify == nil {
+		return 0, nil
+	}
+	refererTable := fmt.Sprintf("%s_dim_referer", websiteID)
+	exists, err := r.tableExists(refererTable)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	filter := ""
+	if onlyMissing {
+		filter = "AND channel = ''"
+	}
+	selectQuery := sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT id, referer FROM "%s" WHERE id > ? %s ORDER BY id LIMIT ?`, refererTable, filter,
+	))
+
+	total := 0
+	lastID := int64(0)
+	for {
+		rows, err := r.db.Query(selectQuery, lastID, refererClassifyBatchSize)
+		if err != nil {
+			return total, fmt.Errorf("读取来源维表失败: %w", err)
+		}
+		batch := make([]refererClassRow, 0, refererClassifyBatchSize)
+		for rows.Next() {
+			var (
+				id      int64
+				referer string
+			)
+			if err := rows.Scan(&id, &referer); err != nil {
+				rows.Close()
+				return total, err
+			}
+			lastID = id
+			class := classify(referer)
+			class.Host = sanitizeAndTruncate(class.Host, maxUABytes)
+			class.Channel = sanitizeAndTruncate(class.Channel, maxUABytes)
+			class.Source = sanitizeAndTruncate(class.Source, maxUABytes)
+			class.Keyword = sanitizeAndTruncate(class.Keyword, maxUABytes)
+			batch = append(batch, refererClassRow{id: id, class: class})
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return total, err
+		}
+		rows.Close()
+
+		if err := r.updateRefererClasses(refererTable, batch); err != nil {
+			return total, fmt.Errorf("更新来源分类失败: %w", err)
+		}
+		total += len(batch)
+		if len(batch) < refererClassifyBatchSize {
+			return total, nil
+		}
+	}
+}
+
+func (r *Repository) updateRefererClasses(refererTable string, batch []refererClassRow) error {
+	const chunkSize = 500
+	for start := 0; start < len(batch); start += chunkSize {
+		end := start + chunkSize
+		if end > len(batch) {
+			end = len(batch)
+		}
+		chunk := batch[start:end]
+		placeholders := make([]string, 0, len(chunk))
+		args := make([]interface{}, 0, len(chunk)*5)
+		for _, item := range chunk {
+			placeholders = append(placeholders, "(?::bigint, ?, ?, ?, ?)")
+			args = append(args, item.id, item.class.Host, item.class.Channel, item.class.Source, item.class.Keyword)
+		}
+		query := fmt.Sprintf(
+			`UPDATE "%s" d
+             SET host = v.host, channel = v.channel, source = v.source, keyword = v.keyword
+             FROM (VALUES %s) AS v(id, host, channel, source, keyword)
+             WHERE d.id = v.id`,
+			refererTable, strings.Join(placeholders, ","),
+		)
+		if _, err := r.db.Exec(sqlutil.ReplacePlaceholders(query), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/likaia/nginxpulse/internal/config"
 	"github.com/likaia/nginxpulse/internal/sqlutil"
+	"github.com/likaia/nginxpulse/internal/store/hll"
 	"github.com/sirupsen/logrus"
 )
 
@@ -26,14 +28,29 @@ type NginxLogRecord struct {
 	Timestamp        time.Time `json:"timestamp"`
 	Method           string    `json:"method"`
 	Url              string    `json:"url"`
+	RawUrl           string    `json:"raw_url,omitempty"`
 	Status           int       `json:"status"`
 	BytesSent        int       `json:"bytes_sent"`
 	Referer          string    `json:"referer"`
+	RefererHost      string    `json:"referer_host,omitempty"`
+	RefererChannel   string    `json:"referer_channel,omitempty"`
+	RefererSource    string    `json:"referer_source,omitempty"`
+	RefererKeyword   string    `json:"referer_keyword,omitempty"`
 	UserBrowser      string    `json:"user_browser"`
 	UserOs           string    `json:"user_os"`
 	UserDevice       string    `json:"user_device"`
+	UserAgent        string    `json:"user_agent,omitempty"` // 原始 User-Agent，不入库，供实时日志过滤与展示
 	DomesticLocation string    `json:"domestic_location"`
 	GlobalLocation   string    `json:"global_location"`
+	SampleRate       int       `json:"sample_rate,omitempty"` // agent 采样倍数（保留 1/N 时为 N），0 或 1 表示未采样
+}
+
+// weight 聚合计数时该条日志代表的请求数
+func (l NginxLogRecord) weight() int64 {
+	if l.SampleRate > 1 {
+		return int64(l.SampleRate)
+	}
+	return 1
 }
 
 type IPGeoAnomalyLog struct {
@@ -106,7 +123,12 @@ func sanitizeLogRecord(log NginxLogRecord) NginxLogRecord {
 	log.IP = sanitizeUTF8(log.IP)
 	log.Method = sanitizeUTF8(log.Method)
 	log.Url = sanitizeAndTruncate(log.Url, maxURLBytes)
+	log.RawUrl = sanitizeAndTruncate(log.RawUrl, maxURLBytes)
 	log.Referer = sanitizeAndTruncate(log.Referer, maxRefererBytes)
+	log.RefererHost = sanitizeAndTruncate(log.RefererHost, maxUABytes)
+	log.RefererChannel = sanitizeAndTruncate(log.RefererChannel, maxUABytes)
+	log.RefererSource = sanitizeAndTruncate(log.RefererSource, maxUABytes)
+	log.RefererKeyword = sanitizeAndTruncate(log.RefererKeyword, maxUABytes)
 	log.UserBrowser = sanitizeAndTruncate(log.UserBrowser, maxUABytes)
 	log.UserOs = sanitizeAndTruncate(log.UserOs, maxUABytes)
 	log.UserDevice = sanitizeAndTruncate(log.UserDevice, maxUABytes)
@@ -123,6 +145,13 @@ type IPGeoCacheEntry struct {
 
 type Repository struct {
 	db *sql.DB
+
+	partitionMu sync.Mutex
+	partitions  map[string][]logPartition // 各网站已知的日志时间分区
+
+	websiteLocks websiteLocks // 同一网站的写入、清空与归属地回填串行执行（跨进程）
+
+	clickhouse *ClickHouseStore // 配置了 clickhouse.url 时存在，storage 为 clickhouse 的站点经由它读写日志
 }
 
 func NewRepository() (*Repository, error) {
@@ -132,8 +161,27 @@ func NewRepository() (*Repository, error) {
 		return nil, err
 	}
 
+	lockDB, err := openWebsiteLockDB(cfg.Database)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	var ch *ClickHouseStore
+	if strings.TrimSpace(cfg.ClickHouse.URL) != "" {
+		ch, err = newClickHouseStore(cfg.ClickHouse)
+		if err != nil {
+			db.Close()
+			lockDB.Close()
+			return nil, err
+		}
+	}
+
 	return &Repository{
-		db: db,
+		db:           db,
+		partitions:   make(map[string][]logPartition),
+		websiteLocks: websiteLocks{db: lockDB},
+		clickhouse:   ch,
 	}, nil
 }
 
@@ -184,6 +232,9 @@ func (r *Repository) Init() error {
 // 关闭数据库连接
 func (r *Repository) Close() error {
 	logrus.Info("关闭数据库")
+	if r.websiteLocks.db != nil {
+		r.websiteLocks.db.Close()
+	}
 	if r.db != nil {
 		return r.db.Close()
 	}
@@ -447,6 +498,9 @@ func (r *Repository) FetchPendingIPGeoFromLogs(websiteID, pendingLabel string, l
 	if limit <= 0 {
 		return nil, nil
 	}
+	if ch := r.ClickHouse(websiteID); ch != nil {
+		return ch.fetchPendingIPs(websiteID, pendingLabel, limit)
+	}
 	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
 	exists, err := r.tableExists(logTable)
 	if err != nil || !exists {
@@ -1145,6 +1199,9 @@ func isISPKeyword(value string) bool {
 }
 
 func (r *Repository) HasLogs(websiteID string) (bool, error) {
+	if ch := r.ClickHouse(websiteID); ch != nil {
+		return ch.HasLogs(websiteID)
+	}
 	tableName := fmt.Sprintf("%s_nginx_logs", websiteID)
 	query := fmt.Sprintf(`SELECT 1 FROM "%s" LIMIT 1`, tableName)
 	var marker int
@@ -1208,11 +1265,49 @@ func (r *Repository) BatchInsertLogsForWebsite(websiteID string, logs []NginxLog
 	if len(logs) == 0 {
 		return nil
 	}
+	unlock, err := r.lockWebsite(websiteID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if ch := r.ClickHouse(websiteID); ch != nil {
+		return r.batchInsertClickHouse(ch, websiteID, logs, nil)
+	}
+	return r.batchInsertLogs(websiteID, logs, nil)
+}
+
+// BatchInsertLogsWithAck 在同一事务内写入 agent 批次并推进确认序号；
+// 序号已确认过时返回 ErrDuplicateBatch，日志不会重复入库
+func (r *Repository) BatchInsertLogsWithAck(websiteID string, logs []NginxLogRecord, ack AgentAck) error {
+	if len(logs) == 0 {
+		return r.AckAgentBatch(ack)
+	}
+	unlock, err := r.lockWebsite(websiteID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if ch := r.ClickHouse(websiteID); ch != nil {
+		return r.batchInsertClickHouse(ch, websiteID, logs, &ack)
+	}
+	return r.batchInsertLogs(websiteID, logs, &ack)
+}
+
+func (r *Repository) batchInsertLogs(websiteID string, logs []NginxLogRecord, ack *AgentAck) error {
 
 	// 不修改调用方的 slice，避免潜在副作用
 	logsCopy := append([]NginxLogRecord(nil), logs...)
 	sortLogsForLocking(logsCopy)
+	// 分区需在事务外创建，失败时日志落入 DEFAULT 分区，不影响写入
+	r.ensureLogPartitionsForLogs(websiteID, logsCopy)
+
+	return retryOnDeadlock(websiteID, func() error {
+		return r.batchInsertLogsForWebsiteOnce(websiteID, logsCopy, ack)
+	})
+}
 
+// retryOnDeadlock 执行一次批量写入事务，遇到 PostgreSQL 死锁时按指数退避重试
+func retryOnDeadlock(websiteID string, insert func() error) error {
 	const (
 		maxAttempts = 5
 		baseDelay   = 50 * time.Millisecond
@@ -1222,7 +1317,7 @@ func (r *Repository) BatchInsertLogsForWebsite(websiteID string, logs []NginxLog
 
 	var lastErr error
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		err := r.batchInsertLogsForWebsiteOnce(websiteID, logsCopy)
+		err := insert()
 		if err == nil {
 			return nil
 		}
@@ -1251,7 +1346,7 @@ func (r *Repository) BatchInsertLogsForWebsite(websiteID string, logs []NginxLog
 	return lastErr
 }
 
-func (r *Repository) batchInsertLogsForWebsiteOnce(websiteID string, logs []NginxLogRecord) (err error) {
+func (r *Repository) batchInsertLogsForWebsiteOnce(websiteID string, logs []NginxLogRecord, ack *AgentAck) (err error) {
 	tx, err := r.db.Begin()
 	if err != nil {
 		return err
@@ -1262,6 +1357,19 @@ func (r *Repository) batchInsertLogsForWebsiteOnce(websiteID string, logs []Ngin
 		}
 	}()
 
+	if ack != nil {
+		if err = lockAgentAck(tx, *ack); err != nil {
+			return err
+		}
+	}
+
+	// 与 URL 重新归一化互斥（共享锁，批量写入之间互不阻塞）
+	if _, err = tx.Exec(fmt.Sprintf(
+		`SELECT pg_advisory_xact_lock_shared(hashtext('%s:url_renormalize'))`, websiteID,
+	)); err != nil {
+		return err
+	}
+
 	// 准备批量插入语句
 	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
 	dims, err := prepareDimStatements(tx, websiteID)
@@ -1274,6 +1382,16 @@ func (r *Repository) batchInsertLogsForWebsiteOnce(websiteID string, logs []Ngin
 		return err
 	}
 	defer aggs.Close()
+	dimAggs, err := prepareDimAggStatements(tx, websiteID)
+	if err != nil {
+		return err
+	}
+	defer dimAggs.Close()
+	uvSketches, err := prepareUVSketchStatements(tx, websiteID)
+	if err != nil {
+		return err
+	}
+	defer uvSketches.Close()
 	firstSeenStmt, err := prepareFirstSeenStatement(tx, websiteID)
 	if err != nil {
 		return err
@@ -1296,8 +1414,8 @@ func (r *Repository) batchInsertLogsForWebsiteOnce(websiteID string, logs []Ngin
 	stmtNginx, err := tx.Prepare(sqlutil.ReplacePlaceholders(fmt.Sprintf(`
         INSERT INTO "%s" (
         ip_id, pageview_flag, timestamp, method, url_id, 
-        status_code, bytes_sent, referer_id, ua_id, location_id)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        status_code, bytes_sent, referer_id, ua_id, location_id, raw_url, sample_rate)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `, logTable)))
 	if err != nil {
 		return err
@@ -1306,6 +1424,7 @@ func (r *Repository) batchInsertLogsForWebsiteOnce(websiteID string, logs []Ngin
 
 	cache := newDimCaches()
 	aggBatch := newAggBatch()
+	aggBatch.skipIPs = UVApproximate(websiteID)
 	sessionCache := make(map[string]sessionState)
 	// 会话聚合：在事务内先累加，提交前收敛落库，避免每条新会话都去争抢同一天聚合行。
 	sessionAggDaily := make(map[string]int64)
@@ -1335,8 +1454,10 @@ func (r *Repository) batchInsertLogsForWebsiteOnce(websiteID string, logs []Ngin
 			return err
 		}
 
-		refererID, err := getOrCreateDimID(
-			cache.referer, dims.insertReferer, dims.selectReferer, log.Referer, log.Referer,
+		refererID, err := getOrCreateDimIDWithInsertArgs(
+			cache.referer, dims.insertReferer, dims.selectReferer, log.Referer,
+			[]any{log.Referer, log.RefererHost, log.RefererChannel, log.RefererSource, log.RefererKeyword},
+			[]any{log.Referer},
 		)
 		if err != nil {
 			return err
@@ -1360,9 +1481,13 @@ func (r *Repository) batchInsertLogsForWebsiteOnce(websiteID string, logs []Ngin
 			return err
 		}
 
+		var rawURL interface{}
+		if log.RawUrl != "" && log.RawUrl != log.Url {
+			rawURL = log.RawUrl
+		}
 		_, err = stmtNginx.Exec(
 			ipID, log.PageviewFlag, log.Timestamp.Unix(), log.Method, urlID,
-			log.Status, log.BytesSent, refererID, uaID, locationID,
+			log.Status, log.BytesSent, refererID, uaID, locationID, rawURL, log.weight(),
 		)
 		if err != nil {
 			return err
@@ -1392,6 +1517,8 @@ func (r *Repository) batchInsertLogsForWebsiteOnce(websiteID string, logs []Ngin
 		}
 
 		aggBatch.add(log, ipID)
+		aggBatch.addDims(log, ipID, [4]int64{urlID, refererID, uaID, locationID})
+		aggBatch.addUV(log, ipID)
 	}
 
 	// 统一顺序写入 first_seen：按 ip_id 升序，避免不同事务对同一批 key 的锁顺序不一致。
@@ -1414,6 +1541,12 @@ func (r *Repository) batchInsertLogsForWebsiteOnce(websiteID string, logs []Ngin
 	if err := applyAggUpdates(aggs, aggBatch); err != nil {
 		return err
 	}
+	if err := applyDimAggUpdates(dimAggs, aggBatch); err != nil {
+		return err
+	}
+	if err := applyUVSketchUpdates(uvSketches, aggBatch); err != nil {
+		return err
+	}
 
 	// 在提交前的收敛阶段一次性写入会话聚合，并在每个 day 上使用 advisory lock 将并发写串行化（避免死锁）。
 	if err := applySessionAggUpdatesWithLocks(sessions, sessionAggDaily, sessionAggEntry); err != nil {
@@ -1427,23 +1560,20 @@ func (r *Repository) batchInsertLogsForWebsiteOnce(websiteID string, logs []Ngin
 	if err := applySessionStateUpserts(sessions, sessionStateUpserts); err != nil {
 		return err
 	}
+	if ack != nil {
+		if err := saveAgentAck(tx, *ack); err != nil {
+			return err
+		}
+	}
 
 	return tx.Commit()
 }
 
-// CleanOldLogs 清理保留天数之前的日志数据
+// CleanOldLogs 按站点的分层保留期清理数据：原始日志的分区表整体删除过期的时间分区，
+// DEFAULT 分区与旧版普通表仍按行删除；保留期更长的聚合、会话与首次访问层再按各自期限清理
 func (r *Repository) CleanOldLogs() error {
-	retentionDays := config.ReadConfig().System.LogRetentionDays
-	if retentionDays <= 0 {
-		retentionDays = 30
-	}
-	cutoffTime := time.Now().AddDate(0, 0, -retentionDays).Unix()
-	cutoff := time.Unix(cutoffTime, 0)
-
-	deletedCount := 0
-
 	rows, err := r.db.Query(`
-        SELECT c.relname
+        SELECT c.relname, c.relkind = 'p'
         FROM pg_class c
         JOIN pg_namespace n ON n.oid = c.relnamespace
         WHERE n.nspname = 'public'
@@ -1456,63 +1586,129 @@ func (r *Repository) CleanOldLogs() error {
 	}
 	defer rows.Close()
 
-	var tableNames []string
+	type logTableInfo struct {
+		name        string
+		partitioned bool
+	}
+	var tables []logTableInfo
 	for rows.Next() {
-		var tableName string
-		if err := rows.Scan(&tableName); err != nil {
+		var table logTableInfo
+		if err := rows.Scan(&table.name, &table.partitioned); err != nil {
 			logrus.WithError(err).Error("扫描表名失败")
 			continue
 		}
-		tableNames = append(tableNames, tableName)
+		tables = append(tables, table)
 	}
 
-	for _, tableName := range tableNames {
-		result, err := r.db.Exec(
-			sqlutil.ReplacePlaceholders(fmt.Sprintf(`DELETE FROM "%s" WHERE timestamp < ?`, tableName)),
-			cutoffTime,
-		)
-		if err != nil {
-			logrus.WithError(err).Errorf("清理表 %s 的旧日志失败", tableName)
+	deletedCount := 0
+	droppedCount := 0
+	for _, table := range tables {
+		websiteID := strings.TrimSuffix(table.name, "_nginx_logs")
+		if websiteID == "" {
 			continue
 		}
+		tiers := RetentionTiersFor(websiteID)
+		cutoff := tiers.Raw
 
-		count, _ := result.RowsAffected()
-		deletedCount += int(count)
-	}
-
-	if deletedCount > 0 {
-		visited := make(map[string]struct{})
-		for _, tableName := range tableNames {
-			if !strings.HasSuffix(tableName, "_nginx_logs") {
-				continue
-			}
-			websiteID := strings.TrimSuffix(tableName, "_nginx_logs")
-			if websiteID == "" {
+		// 先按行清理 DEFAULT 分区（或普通表），保证随后按分区范围修正首次访问时不会读到更早的残留数据
+		target := table.name
+		if table.partitioned {
+			target, err = r.defaultPartitionName(table.name)
+			if err != nil {
+				logrus.WithError(err).Errorf("查询表 %s 的默认分区失败", table.name)
 				continue
 			}
-			if _, ok := visited[websiteID]; ok {
+		}
+		deleted := int64(0)
+		if target != "" {
+			result, err := r.db.Exec(
+				sqlutil.ReplacePlaceholders(fmt.Sprintf(`DELETE FROM "%s" WHERE timestamp < ?`, target)),
+				cutoff.Unix(),
+			)
+			if err != nil {
+				logrus.WithError(err).Errorf("清理表 %s 的旧日志失败", target)
 				continue
 			}
-			visited[websiteID] = struct{}{}
-			if err := r.cleanupOrphanDims(websiteID); err != nil {
-				logrus.WithError(err).Warnf("清理网站 %s 的维表孤儿数据失败", websiteID)
+			deleted, _ = result.RowsAffected()
+			deletedCount += int(deleted)
+		}
+
+		if table.partitioned {
+			dropped, err := r.dropExpiredLogPartitions(websiteID, tiers)
+			if err != nil {
+				logrus.WithError(err).Errorf("删除网站 %s 的过期日志分区失败", websiteID)
 			}
-			if err := r.cleanupAggregates(websiteID, cutoff); err != nil {
-				logrus.WithError(err).Warnf("清理网站 %s 的聚合数据失败", websiteID)
+			for _, partition := range dropped {
+				if err := r.cleanupDroppedRange(websiteID, partition, tiers); err != nil {
+					logrus.WithError(err).Warnf("清理网站 %s 分区 %s 范围内的聚合数据失败", websiteID, partition.name)
+				}
 			}
-			if err := r.cleanupSessions(websiteID, cutoff); err != nil {
-				logrus.WithError(err).Warnf("清理网站 %s 的会话数据失败", websiteID)
+			droppedCount += len(dropped)
+			if _, ok := config.GetWebsiteByID(websiteID); ok {
+				if err := r.ensureUpcomingLogPartitions(websiteID); err != nil {
+					logrus.WithError(err).Warnf("预建网站 %s 的日志分区失败", websiteID)
+				}
 			}
 		}
 
-		logrus.Infof("删除了 %d 条 %d 天前的日志记录", deletedCount, retentionDays)
+		// 按行删除的数据分散在各个时间段，沿用整表清理
+		if deleted > 0 {
+			r.cleanupAfterRowDelete(websiteID, tiers)
+		}
+		if err := r.cleanupLongTiers(websiteID, tiers); err != nil {
+			logrus.WithError(err).Warnf("按分层保留期清理网站 %s 的数据失败", websiteID)
+		}
+	}
+
+	if deletedCount > 0 || droppedCount > 0 {
+		logrus.Infof("删除了 %d 个过期日志分区、%d 条过期日志记录", droppedCount, deletedCount)
 	}
 
 	return nil
 }
 
+// cleanupAfterRowDelete 原始日志按行删除后清理跟随原始日志保留的层，并按剩余日志重建边界桶
+func (r *Repository) cleanupAfterRowDelete(websiteID string, tiers RetentionTiers) {
+	cutoff := tiers.Raw
+	if err := r.cleanupOrphanDims(websiteID, tiers); err != nil {
+		logrus.WithError(err).Warnf("清理网站 %s 的维表孤儿数据失败", websiteID)
+	}
+	if !tiers.outlives(tiers.Hourly) {
+		if err := r.cleanupHourlyAggregates(websiteID, cutoff, true); err != nil {
+			logrus.WithError(err).Warnf("清理网站 %s 的小时聚合数据失败", websiteID)
+		}
+		if err := r.cleanupAnomalies(websiteID, cutoff); err != nil {
+			logrus.WithError(err).Warnf("清理网站 %s 的异常记录失败", websiteID)
+		}
+	}
+	if !tiers.outlives(tiers.Sessions) {
+		if err := r.cleanupSessions(websiteID, cutoff); err != nil {
+			logrus.WithError(err).Warnf("清理网站 %s 的会话数据失败", websiteID)
+		}
+	}
+	if !tiers.outlives(tiers.Daily) {
+		if err := r.cleanupDailyAggregates(websiteID, cutoff, true); err != nil {
+			logrus.WithError(err).Warnf("清理网站 %s 的日聚合数据失败", websiteID)
+		}
+		// 日聚合层不长于会话层，边界日的会话仍在，可以重建
+		if err := r.cleanupSessionAggregates(websiteID, cutoff, true); err != nil {
+			logrus.WithError(err).Warnf("清理网站 %s 的会话聚合数据失败", websiteID)
+		}
+	}
+	if !tiers.outlives(tiers.FirstSeen) {
+		if err := r.rebuildFirstSeen(websiteID); err != nil {
+			logrus.WithError(err).Warnf("重建网站 %s 的首次访问数据失败", websiteID)
+		}
+	}
+}
+
 // ClearLogsForWebsite 清空指定网站的日志数据
 func (r *Repository) ClearLogsForWebsite(websiteID string) error {
+	unlock, err := r.lockWebsite(websiteID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	tableName := fmt.Sprintf("%s_nginx_logs", websiteID)
 	if _, err := r.db.Exec(fmt.Sprintf(`DELETE FROM "%s"`, tableName)); err != nil {
 		return fmt.Errorf("清空网站日志失败: %w", err)
@@ -1532,6 +1728,14 @@ func (r *Repository) ClearLogsForWebsite(websiteID string) error {
 	if err := r.clearSessionAggTablesForWebsite(websiteID); err != nil {
 		return fmt.Errorf("清空网站会话聚合表失败: %w", err)
 	}
+	if err := r.clearAnomaliesForWebsite(websiteID); err != nil {
+		return fmt.Errorf("清空网站异常记录失败: %w", err)
+	}
+	if ch := r.ClickHouse(websiteID); ch != nil {
+		if err := ch.clearWebsite(websiteID); err != nil {
+			return fmt.Errorf("清空网站 ClickHouse 日志失败: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -1558,12 +1762,24 @@ func (r *Repository) createTables() error {
 	if err := r.ensureSystemNotificationTable(); err != nil {
 		return err
 	}
+	if err := r.ensureAgentAckTable(); err != nil {
+		return err
+	}
+	if err := r.ensureAgentsTable(); err != nil {
+		return err
+	}
 	for _, id := range config.GetAllWebsiteIDs() {
 		if err := r.ensureWebsiteSchema(id); err != nil {
 			return err
 		}
+		if err := r.initLogPartitions(id); err != nil {
+			return err
+		}
+		if err := createAnomalyTable(r.db, id); err != nil {
+			return err
+		}
 	}
-	return nil
+	return r.ensureClickHouseSchemas()
 }
 
 func (r *Repository) ensureIPGeoCacheTable() error {
@@ -1675,6 +1891,14 @@ func (r *Repository) MarkIPGeoPendingForWebsite(
 	if len(ips) == 0 {
 		return nil
 	}
+	unlock, err := r.lockWebsite(websiteID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if ch := r.ClickHouse(websiteID); ch != nil {
+		return ch.markPending(websiteID, ips, pendingLabel)
+	}
 	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
 	exists, err := r.tableExists(logTable)
 	if err != nil || !exists {
@@ -1786,6 +2010,14 @@ func (r *Repository) updateIPGeoLocationsForWebsite(
 	locations map[string]IPGeoCacheEntry,
 	pendingLabel string,
 ) error {
+	unlock, err := r.lockWebsite(websiteID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if ch := r.ClickHouse(websiteID); ch != nil {
+		return ch.updateLocations(websiteID, locations, pendingLabel)
+	}
 	const (
 		maxAttempts = 5
 		baseDelay   = 50 * time.Millisecond
@@ -2014,6 +2246,11 @@ type aggBatch struct {
 	daily     map[string]*aggCounts
 	hourlyIPs map[int64]map[int64]struct{}
 	dailyIPs  map[string]map[int64]struct{}
+	dims      map[dimAggKey]*dimAggEntry
+
+	hourlySketches map[int64]*hll.Sketch
+	dailySketches  map[string]*hll.Sketch
+	skipIPs        bool // approximate 模式只写草图，不写 (桶, ip_id) 明细
 }
 
 type sessionState struct {
@@ -2052,6 +2289,10 @@ func newAggBatch() *aggBatch {
 		daily:     make(map[string]*aggCounts),
 		hourlyIPs: make(map[int64]map[int64]struct{}),
 		dailyIPs:  make(map[string]map[int64]struct{}),
+		dims:      make(map[dimAggKey]*dimAggEntry),
+
+		hourlySketches: make(map[int64]*hll.Sketch),
+		dailySketches:  make(map[string]*hll.Sketch),
 	}
 }
 
@@ -2141,7 +2382,7 @@ func prepareDimStatements(tx *sql.Tx, websiteID string) (*dimStatements, error)
 	}
 
 	insertReferer, err := tx.Prepare(sqlutil.ReplacePlaceholders(
-		fmt.Sprintf(`INSERT INTO "%s" (referer) VALUES (?) ON CONFLICT DO NOTHING`, refererTable),
+		fmt.Sprintf(`INSERT INTO "%s" (referer, host, channel, source, keyword) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`, refererTable),
 	))
 	if err != nil {
 		selectURL.Close()
@@ -2713,15 +2954,27 @@ func getOrCreateDimID(
 	selectStmt *sql.Stmt,
 	cacheKey string,
 	args ...any,
+) (int64, error) {
+	return getOrCreateDimIDWithInsertArgs(cache, insertStmt, selectStmt, cacheKey, args, args)
+}
+
+// getOrCreateDimIDWithInsertArgs 用于维表除唯一键外还有附加列的情况（插入与查询参数不同）
+func getOrCreateDimIDWithInsertArgs(
+	cache map[string]int64,
+	insertStmt *sql.Stmt,
+	selectStmt *sql.Stmt,
+	cacheKey string,
+	insertArgs []any,
+	selectArgs []any,
 ) (int64, error) {
 	if id, ok := cache[cacheKey]; ok {
 		return id, nil
 	}
-	if _, err := insertStmt.Exec(args...); err != nil {
+	if _, err := insertStmt.Exec(insertArgs...); err != nil {
 		return 0, err
 	}
 	var id int64
-	if err := selectStmt.QueryRow(args...).Scan(&id); err != nil {
+	if err := selectStmt.QueryRow(selectArgs...).Scan(&id); err != nil {
 		return 0, err
 	}
 	cache[cacheKey] = id
@@ -2810,7 +3063,7 @@ func (b *aggBatch) add(log NginxLogRecord, ipID int64) {
 	addCounts(hourCounts, log)
 	addCounts(dayCounts, log)
 
-	if log.PageviewFlag == 1 {
+	if log.PageviewFlag == 1 && !b.skipIPs {
 		if b.hourlyIPs[hour] == nil {
 			b.hourlyIPs[hour] = make(map[int64]struct{})
 		}
@@ -2826,21 +3079,22 @@ func addCounts(counts *aggCounts, log NginxLogRecord) {
 	if counts == nil {
 		return
 	}
+	weight := log.weight()
 	if log.PageviewFlag == 1 {
-		counts.pv++
-		counts.traffic += int64(log.BytesSent)
+		counts.pv += weight
+		counts.traffic += int64(log.BytesSent) * weight
 	}
 	switch {
 	case log.Status >= 200 && log.Status < 300:
-		counts.s2xx++
+		counts.s2xx += weight
 	case log.Status >= 300 && log.Status < 400:
-		counts.s3xx++
+		counts.s3xx += weight
 	case log.Status >= 400 && log.Status < 500:
-		counts.s4xx++
+		counts.s4xx += weight
 	case log.Status >= 500 && log.Status < 600:
-		counts.s5xx++
+		counts.s5xx += weight
 	default:
-		counts.other++
+		counts.other += weight
 	}
 }
 
@@ -2952,7 +3206,8 @@ func dayBucket(ts time.Time) string {
 	return ts.In(time.Local).Format("2006-01-02")
 }
 
-func (r *Repository) cleanupOrphanDims(websiteID string) error {
+// cleanupOrphanDims 删除不再被日志表、也不再被长期保留层引用的维表记录
+func (r *Repository) cleanupOrphanDims(websiteID string, tiers RetentionTiers) error {
 	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
 	hasIPID, err := r.tableHasColumn(logTable, "ip_id")
 	if err != nil || !hasIPID {
@@ -2970,6 +3225,10 @@ func (r *Repository) cleanupOrphanDims(websiteID string) error {
 		{table: fmt.Sprintf("%s_dim_ua", websiteID), column: "ua_id"},
 		{table: fmt.Sprintf("%s_dim_location", websiteID), column: "location_id"},
 	}
+	retained, err := r.retainedDimReferences(websiteID, tiers)
+	if err != nil {
+		return err
+	}
 
 	for _, dim := range dims {
 		exists, err := r.tableExists(dim.table)
@@ -2980,8 +3239,8 @@ func (r *Repository) cleanupOrphanDims(websiteID string) error {
 			continue
 		}
 		if _, err := r.db.Exec(fmt.Sprintf(
-			`DELETE FROM "%s" WHERE id NOT IN (SELECT %s FROM "%s")`,
-			dim.table, dim.column, logTable,
+			`DELETE FROM "%s" d WHERE d.id NOT IN (SELECT %s FROM "%s")%s`,
+			dim.table, dim.column, logTable, retainedDimClause("d", retained[dim.column]),
 		)); err != nil {
 			return err
 		}
@@ -3087,6 +3346,12 @@ func (r *Repository) ensureWebsiteSchema(websiteID string) error {
 		if err := createAggTables(r.db, websiteID); err != nil {
 			return err
 		}
+		if err := createDimAggTables(r.db, websiteID); err != nil {
+			return err
+		}
+		if err := createUVSketchTables(r.db, websiteID); err != nil {
+			return err
+		}
 		if err := createFirstSeenTable(r.db, websiteID); err != nil {
 			return err
 		}
@@ -3099,6 +3364,12 @@ func (r *Repository) ensureWebsiteSchema(websiteID string) error {
 		if err := r.backfillAggregatesIfEmpty(websiteID); err != nil {
 			return err
 		}
+		if err := r.backfillDimAggregatesIfEmpty(websiteID); err != nil {
+			return err
+		}
+		if err := r.backfillUVSketchesIfEmpty(websiteID); err != nil {
+			return err
+		}
 		if err := r.backfillFirstSeenIfEmpty(websiteID); err != nil {
 			return err
 		}
@@ -3117,6 +3388,10 @@ func (r *Repository) ensureWebsiteSchema(websiteID string) error {
 		return r.migrateLegacyLogs(websiteID)
 	}
 
+	if err := upgradeWebsiteColumns(r.db, websiteID); err != nil {
+		return err
+	}
+
 	if err := createDimTables(r.db, websiteID); err != nil {
 		return err
 	}
@@ -3126,6 +3401,12 @@ func (r *Repository) ensureWebsiteSchema(websiteID string) error {
 	if err := createAggTables(r.db, websiteID); err != nil {
 		return err
 	}
+	if err := createDimAggTables(r.db, websiteID); err != nil {
+		return err
+	}
+	if err := createUVSketchTables(r.db, websiteID); err != nil {
+		return err
+	}
 	if err := createFirstSeenTable(r.db, websiteID); err != nil {
 		return err
 	}
@@ -3138,6 +3419,15 @@ func (r *Repository) ensureWebsiteSchema(websiteID string) error {
 	if err := r.backfillAggregatesIfEmpty(websiteID); err != nil {
 		return err
 	}
+	if err := r.backfillDimAggregatesIfEmpty(websiteID); err != nil {
+		return err
+	}
+	if err := r.backfillUVSketchesIfEmpty(websiteID); err != nil {
+		return err
+	}
+	if err := r.applyUVMode(websiteID); err != nil {
+		return err
+	}
 	if err := r.backfillFirstSeenIfEmpty(websiteID); err != nil {
 		return err
 	}
@@ -3175,6 +3465,12 @@ func (r *Repository) migrateLegacyLogs(websiteID string) error {
 	if err := createAggTables(tx, websiteID); err != nil {
 		return err
 	}
+	if err := createDimAggTables(tx, websiteID); err != nil {
+		return err
+	}
+	if err := createUVSketchTables(tx, websiteID); err != nil {
+		return err
+	}
 	if err := createFirstSeenTable(tx, websiteID); err != nil {
 		return err
 	}
@@ -3347,7 +3643,11 @@ func createDimTables(execer sqlExecer, websiteID string) error {
 		fmt.Sprintf(
 			`CREATE TABLE IF NOT EXISTS "%s_dim_referer" (
                 id BIGSERIAL PRIMARY KEY,
-                referer TEXT NOT NULL UNIQUE
+                referer TEXT NOT NULL UNIQUE,
+                host TEXT NOT NULL DEFAULT '',
+                channel TEXT NOT NULL DEFAULT '',
+                source TEXT NOT NULL DEFAULT '',
+                keyword TEXT NOT NULL DEFAULT ''
             )`, websiteID,
 		),
 		fmt.Sprintf(
@@ -3377,6 +3677,29 @@ func createDimTables(execer sqlExecer, websiteID string) error {
 	return nil
 }
 
+// upgradeWebsiteColumns 为旧版本创建的表补齐后续新增的列及依赖这些列的索引
+func upgradeWebsiteColumns(execer sqlExecer, websiteID string) error {
+	stmts := []string{
+		fmt.Sprintf(`ALTER TABLE "%s_nginx_logs" ADD COLUMN IF NOT EXISTS raw_url TEXT`, websiteID),
+		fmt.Sprintf(`ALTER TABLE "%s_nginx_logs" ADD COLUMN IF NOT EXISTS sample_rate INT NOT NULL DEFAULT 1`, websiteID),
+		fmt.Sprintf(`ALTER TABLE "%s_dim_referer" ADD COLUMN IF NOT EXISTS host TEXT NOT NULL DEFAULT ''`, websiteID),
+		fmt.Sprintf(`ALTER TABLE "%s_dim_referer" ADD COLUMN IF NOT EXISTS channel TEXT NOT NULL DEFAULT ''`, websiteID),
+		fmt.Sprintf(`ALTER TABLE "%s_dim_referer" ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT ''`, websiteID),
+		fmt.Sprintf(`ALTER TABLE "%s_dim_referer" ADD COLUMN IF NOT EXISTS keyword TEXT NOT NULL DEFAULT ''`, websiteID),
+		// 调度器每轮查找未分类的来源，部分索引只包含这些行，分类完成后几乎为空
+		fmt.Sprintf(
+			`CREATE INDEX IF NOT EXISTS idx_%s_dim_referer_unclassified ON "%s_dim_referer"(id) WHERE channel = ''`,
+			websiteID, websiteID,
+		),
+	}
+	for _, stmt := range stmts {
+		if _, err := execer.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func createLogTable(execer sqlExecer, tableName string) error {
 	stmt := fmt.Sprintf(
 		`CREATE TABLE IF NOT EXISTS "%s" (
@@ -3391,6 +3714,8 @@ func createLogTable(execer sqlExecer, tableName string) error {
             referer_id BIGINT NOT NULL,
             ua_id BIGINT NOT NULL,
             location_id BIGINT NOT NULL,
+            raw_url TEXT,
+            sample_rate INT NOT NULL DEFAULT 1,
             PRIMARY KEY (id, timestamp)
         ) PARTITION BY RANGE (timestamp)`, tableName,
 	)
@@ -3681,60 +4006,40 @@ func (r *Repository) backfillAggregates(websiteID string) error {
 		`INSERT INTO "%s" (bucket, pv, traffic, s2xx, s3xx, s4xx, s5xx, other)
          SELECT
              (timestamp / 3600) * 3600 AS bucket,
-             SUM(CASE WHEN pageview_flag = 1 THEN 1 ELSE 0 END) AS pv,
-             SUM(CASE WHEN pageview_flag = 1 THEN bytes_sent ELSE 0 END) AS traffic,
-             SUM(CASE WHEN status_code >= 200 AND status_code < 300 THEN 1 ELSE 0 END) AS s2xx,
-             SUM(CASE WHEN status_code >= 300 AND status_code < 400 THEN 1 ELSE 0 END) AS s3xx,
-             SUM(CASE WHEN status_code >= 400 AND status_code < 500 THEN 1 ELSE 0 END) AS s4xx,
-             SUM(CASE WHEN status_code >= 500 AND status_code < 600 THEN 1 ELSE 0 END) AS s5xx,
-             SUM(CASE WHEN status_code < 200 OR status_code >= 600 THEN 1 ELSE 0 END) AS other
+             SUM(CASE WHEN pageview_flag = 1 THEN sample_rate ELSE 0 END) AS pv,
+             SUM(CASE WHEN pageview_flag = 1 THEN bytes_sent * sample_rate ELSE 0 END) AS traffic,
+             SUM(CASE WHEN status_code >= 200 AND status_code < 300 THEN sample_rate ELSE 0 END) AS s2xx,
+             SUM(CASE WHEN status_code >= 300 AND status_code < 400 THEN sample_rate ELSE 0 END) AS s3xx,
+             SUM(CASE WHEN status_code >= 400 AND status_code < 500 THEN sample_rate ELSE 0 END) AS s4xx,
+             SUM(CASE WHEN status_code >= 500 AND status_code < 600 THEN sample_rate ELSE 0 END) AS s5xx,
+             SUM(CASE WHEN status_code < 200 OR status_code >= 600 THEN sample_rate ELSE 0 END) AS other
          FROM "%s"
          GROUP BY bucket`, aggHourly, logTable,
 	)); err != nil {
 		return err
 	}
 
-	if _, err = tx.Exec(fmt.Sprintf(
-		`INSERT INTO "%s" (bucket, ip_id)
-         SELECT
-             (timestamp / 3600) * 3600 AS bucket,
-             ip_id
-         FROM "%s"
-         WHERE pageview_flag = 1
-         GROUP BY bucket, ip_id
-         ON CONFLICT DO NOTHING`, aggHourlyIP, logTable,
-	)); err != nil {
-		return err
-	}
-
 	if _, err = tx.Exec(fmt.Sprintf(
 		`INSERT INTO "%s" (day, pv, traffic, s2xx, s3xx, s4xx, s5xx, other)
          SELECT
              date(to_timestamp(timestamp)) AS day,
-             SUM(CASE WHEN pageview_flag = 1 THEN 1 ELSE 0 END) AS pv,
-             SUM(CASE WHEN pageview_flag = 1 THEN bytes_sent ELSE 0 END) AS traffic,
-             SUM(CASE WHEN status_code >= 200 AND status_code < 300 THEN 1 ELSE 0 END) AS s2xx,
-             SUM(CASE WHEN status_code >= 300 AND status_code < 400 THEN 1 ELSE 0 END) AS s3xx,
-             SUM(CASE WHEN status_code >= 400 AND status_code < 500 THEN 1 ELSE 0 END) AS s4xx,
-             SUM(CASE WHEN status_code >= 500 AND status_code < 600 THEN 1 ELSE 0 END) AS s5xx,
-             SUM(CASE WHEN status_code < 200 OR status_code >= 600 THEN 1 ELSE 0 END) AS other
+             SUM(CASE WHEN pageview_flag = 1 THEN sample_rate ELSE 0 END) AS pv,
+             SUM(CASE WHEN pageview_flag = 1 THEN bytes_sent * sample_rate ELSE 0 END) AS traffic,
+             SUM(CASE WHEN status_code >= 200 AND status_code < 300 THEN sample_rate ELSE 0 END) AS s2xx,
+             SUM(CASE WHEN status_code >= 300 AND status_code < 400 THEN sample_rate ELSE 0 END) AS s3xx,
+             SUM(CASE WHEN status_code >= 400 AND status_code < 500 THEN sample_rate ELSE 0 END) AS s4xx,
+             SUM(CASE WHEN status_code >= 500 AND status_code < 600 THEN sample_rate ELSE 0 END) AS s5xx,
+             SUM(CASE WHEN status_code < 200 OR status_code >= 600 THEN sample_rate ELSE 0 END) AS other
          FROM "%s"
          GROUP BY day`, aggDaily, logTable,
 	)); err != nil {
 		return err
 	}
 
-	if _, err = tx.Exec(fmt.Sprintf(
-		`INSERT INTO "%s" (day, ip_id)
-         SELECT
-             date(to_timestamp(timestamp)) AS day,
-             ip_id
-         FROM "%s"
-         WHERE pageview_flag = 1
-         GROUP BY day, ip_id
-         ON CONFLICT DO NOTHING`, aggDailyIP, logTable,
-	)); err != nil {
-		return err
+	if !UVApproximate(websiteID) {
+		if err = backfillAggregateIPs(tx, websiteID); err != nil {
+			return err
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -3742,7 +4047,10 @@ func (r *Repository) backfillAggregates(websiteID string) error {
 	}
 
 	logrus.WithField("website", websiteID).Info("聚合数据回填完成")
-	return nil
+	if err := r.backfillUVSketches(websiteID); err != nil {
+		return err
+	}
+	return r.backfillDimAggregates(websiteID)
 }
 
 func (r *Repository) backfillFirstSeen(websiteID string) error {
@@ -3933,11 +4241,10 @@ func (r *Repository) backfillSessionAggregates(websiteID string) error {
 	return nil
 }
 
-func (r *Repository) cleanupAggregates(websiteID string, cutoff time.Time) error {
+// cleanupHourlyAggregates 删除早于 cutoff 所在小时的小时聚合；rebuild 时按剩余日志重建该小时
+func (r *Repository) cleanupHourlyAggregates(websiteID string, cutoff time.Time, rebuild bool) error {
 	aggHourly := fmt.Sprintf("%s_agg_hourly", websiteID)
 	aggHourlyIP := fmt.Sprintf("%s_agg_hourly_ip", websiteID)
-	aggDaily := fmt.Sprintf("%s_agg_daily", websiteID)
-	aggDailyIP := fmt.Sprintf("%s_agg_daily_ip", websiteID)
 
 	hasAgg, err := r.tableExists(aggHourly)
 	if err != nil || !hasAgg {
@@ -3945,42 +4252,52 @@ func (r *Repository) cleanupAggregates(websiteID string, cutoff time.Time) error
 	}
 
 	cutoffHour := hourBucket(cutoff)
-	cutoffDay := dayBucket(cutoff)
-
-	if _, err := r.db.Exec(
-		sqlutil.ReplacePlaceholders(fmt.Sprintf(`DELETE FROM "%s" WHERE bucket < ?`, aggHourly)),
-		cutoffHour,
-	); err != nil {
+	tables := []string{aggHourly, aggHourlyIP, UVSketchTable(websiteID, "hourly")}
+	if err := r.deleteAggregatesBefore(tables, "bucket", cutoffHour); err != nil {
 		return err
 	}
-	if _, err := r.db.Exec(
-		sqlutil.ReplacePlaceholders(fmt.Sprintf(`DELETE FROM "%s" WHERE bucket < ?`, aggHourlyIP)),
-		cutoffHour,
-	); err != nil {
-		return err
+	if !rebuild {
+		return nil
 	}
-	if _, err := r.db.Exec(
-		sqlutil.ReplacePlaceholders(fmt.Sprintf(`DELETE FROM "%s" WHERE day < ?`, aggDaily)),
-		cutoffDay,
-	); err != nil {
+	if err := r.rebuildHourlyAggregate(websiteID, cutoffHour); err != nil {
 		return err
 	}
-	if _, err := r.db.Exec(
-		sqlutil.ReplacePlaceholders(fmt.Sprintf(`DELETE FROM "%s" WHERE day < ?`, aggDailyIP)),
-		cutoffDay,
-	); err != nil {
+	start := time.Unix(cutoffHour, 0)
+	return r.rebuildUVSketches(websiteID, start, start.Add(time.Hour), true, false)
+}
+
+// cleanupDailyAggregates 删除早于 cutoff 所在日的日聚合；rebuild 时按剩余日志重建该日
+func (r *Repository) cleanupDailyAggregates(websiteID string, cutoff time.Time, rebuild bool) error {
+	aggDaily := fmt.Sprintf("%s_agg_daily", websiteID)
+	aggDailyIP := fmt.Sprintf("%s_agg_daily_ip", websiteID)
+
+	hasAgg, err := r.tableExists(aggDaily)
+	if err != nil || !hasAgg {
 		return err
 	}
 
-	if err := r.rebuildHourlyAggregate(websiteID, cutoffHour); err != nil {
+	cutoffDay := dayBucket(cutoff)
+	tables := append([]string{aggDaily, aggDailyIP, UVSketchTable(websiteID, "daily")}, dimAggregateTables(websiteID)...)
+	if err := r.deleteAggregatesBefore(tables, "day", cutoffDay); err != nil {
 		return err
 	}
+	if !rebuild {
+		return nil
+	}
 	if err := r.rebuildDailyAggregate(websiteID, cutoffDay); err != nil {
 		return err
 	}
-	return r.rebuildFirstSeen(websiteID)
+	start, err := time.ParseInLocation("2006-01-02", cutoffDay, time.Local)
+	if err != nil {
+		return err
+	}
+	if err := r.rebuildUVSketches(websiteID, start, start.AddDate(0, 0, 1), false, true); err != nil {
+		return err
+	}
+	return r.rebuildDimAggregatesForDay(websiteID, cutoffDay)
 }
 
+// cleanupSessions 删除早于 cutoff 开始的会话并重建会话状态；会话日聚合随日聚合层单独清理
 func (r *Repository) cleanupSessions(websiteID string, cutoff time.Time) error {
 	sessionTable := fmt.Sprintf("%s_sessions", websiteID)
 	stateTable := fmt.Sprintf("%s_session_state", websiteID)
@@ -4017,11 +4334,11 @@ func (r *Repository) cleanupSessions(websiteID string, cutoff time.Time) error {
 	)); err != nil {
 		return err
 	}
-
-	return r.cleanupSessionAggregates(websiteID, cutoff)
+	return nil
 }
 
-func (r *Repository) cleanupSessionAggregates(websiteID string, cutoff time.Time) error {
+// cleanupSessionAggregates 删除早于 cutoff 所在日的会话日聚合；rebuild 时按剩余会话重建该日
+func (r *Repository) cleanupSessionAggregates(websiteID string, cutoff time.Time, rebuild bool) error {
 	dailyTable := fmt.Sprintf("%s_agg_session_daily", websiteID)
 	entryTable := fmt.Sprintf("%s_agg_entry_daily", websiteID)
 
@@ -4052,6 +4369,9 @@ func (r *Repository) cleanupSessionAggregates(websiteID string, cutoff time.Time
 		}
 	}
 
+	if !rebuild {
+		return nil
+	}
 	return r.rebuildSessionAggregatesForDay(websiteID, cutoffDay)
 }
 
@@ -4153,13 +4473,13 @@ func (r *Repository) rebuildHourlyAggregate(websiteID string, bucket int64) erro
 		`INSERT INTO "%s" (bucket, pv, traffic, s2xx, s3xx, s4xx, s5xx, other)
          SELECT
              (timestamp / 3600) * 3600 AS bucket,
-             SUM(CASE WHEN pageview_flag = 1 THEN 1 ELSE 0 END) AS pv,
-             SUM(CASE WHEN pageview_flag = 1 THEN bytes_sent ELSE 0 END) AS traffic,
-             SUM(CASE WHEN status_code >= 200 AND status_code < 300 THEN 1 ELSE 0 END) AS s2xx,
-             SUM(CASE WHEN status_code >= 300 AND status_code < 400 THEN 1 ELSE 0 END) AS s3xx,
-             SUM(CASE WHEN status_code >= 400 AND status_code < 500 THEN 1 ELSE 0 END) AS s4xx,
-             SUM(CASE WHEN status_code >= 500 AND status_code < 600 THEN 1 ELSE 0 END) AS s5xx,
-             SUM(CASE WHEN status_code < 200 OR status_code >= 600 THEN 1 ELSE 0 END) AS other
+             SUM(CASE WHEN pageview_flag = 1 THEN sample_rate ELSE 0 END) AS pv,
+             SUM(CASE WHEN pageview_flag = 1 THEN bytes_sent * sample_rate ELSE 0 END) AS traffic,
+             SUM(CASE WHEN status_code >= 200 AND status_code < 300 THEN sample_rate ELSE 0 END) AS s2xx,
+             SUM(CASE WHEN status_code >= 300 AND status_code < 400 THEN sample_rate ELSE 0 END) AS s3xx,
+             SUM(CASE WHEN status_code >= 400 AND status_code < 500 THEN sample_rate ELSE 0 END) AS s4xx,
+             SUM(CASE WHEN status_code >= 500 AND status_code < 600 THEN sample_rate ELSE 0 END) AS s5xx,
+             SUM(CASE WHEN status_code < 200 OR status_code >= 600 THEN sample_rate ELSE 0 END) AS other
          FROM "%s"
          WHERE timestamp >= ? AND timestamp < ?
          GROUP BY bucket`, aggHourly, logTable,
@@ -4167,17 +4487,19 @@ func (r *Repository) rebuildHourlyAggregate(websiteID string, bucket int64) erro
 		return err
 	}
 
-	if _, err = tx.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
-		`INSERT INTO "%s" (bucket, ip_id)
-         SELECT
-             (timestamp / 3600) * 3600 AS bucket,
-             ip_id
-         FROM "%s"
-         WHERE pageview_flag = 1 AND timestamp >= ? AND timestamp < ?
-         GROUP BY bucket, ip_id
-         ON CONFLICT DO NOTHING`, aggHourlyIP, logTable,
-	)), start, end); err != nil {
-		return err
+	if !UVApproximate(websiteID) {
+		if _, err = tx.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`INSERT INTO "%s" (bucket, ip_id)
+             SELECT
+                 (timestamp / 3600) * 3600 AS bucket,
+                 ip_id
+             FROM "%s"
+             WHERE pageview_flag = 1 AND timestamp >= ? AND timestamp < ?
+             GROUP BY bucket, ip_id
+             ON CONFLICT DO NOTHING`, aggHourlyIP, logTable,
+		)), start, end); err != nil {
+			return err
+		}
 	}
 
 	return tx.Commit()
@@ -4221,13 +4543,13 @@ func (r *Repository) rebuildDailyAggregate(websiteID string, day string) error {
 		`INSERT INTO "%s" (day, pv, traffic, s2xx, s3xx, s4xx, s5xx, other)
          SELECT
              date(to_timestamp(timestamp)) AS day,
-             SUM(CASE WHEN pageview_flag = 1 THEN 1 ELSE 0 END) AS pv,
-             SUM(CASE WHEN pageview_flag = 1 THEN bytes_sent ELSE 0 END) AS traffic,
-             SUM(CASE WHEN status_code >= 200 AND status_code < 300 THEN 1 ELSE 0 END) AS s2xx,
-             SUM(CASE WHEN status_code >= 300 AND status_code < 400 THEN 1 ELSE 0 END) AS s3xx,
-             SUM(CASE WHEN status_code >= 400 AND status_code < 500 THEN 1 ELSE 0 END) AS s4xx,
-             SUM(CASE WHEN status_code >= 500 AND status_code < 600 THEN 1 ELSE 0 END) AS s5xx,
-             SUM(CASE WHEN status_code < 200 OR status_code >= 600 THEN 1 ELSE 0 END) AS other
+             SUM(CASE WHEN pageview_flag = 1 THEN sample_rate ELSE 0 END) AS pv,
+             SUM(CASE WHEN pageview_flag = 1 THEN bytes_sent * sample_rate ELSE 0 END) AS traffic,
+             SUM(CASE WHEN status_code >= 200 AND status_code < 300 THEN sample_rate ELSE 0 END) AS s2xx,
+             SUM(CASE WHEN status_code >= 300 AND status_code < 400 THEN sample_rate ELSE 0 END) AS s3xx,
+             SUM(CASE WHEN status_code >= 400 AND status_code < 500 THEN sample_rate ELSE 0 END) AS s4xx,
+             SUM(CASE WHEN status_code >= 500 AND status_code < 600 THEN sample_rate ELSE 0 END) AS s5xx,
+             SUM(CASE WHEN status_code < 200 OR status_code >= 600 THEN sample_rate ELSE 0 END) AS other
          FROM "%s"
          WHERE timestamp >= ? AND timestamp < ?
          GROUP BY day`, aggDaily, logTable,
@@ -4235,17 +4557,19 @@ func (r *Repository) rebuildDailyAggregate(websiteID string, day string) error {
 		return err
 	}
 
-	if _, err = tx.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
-		`INSERT INTO "%s" (day, ip_id)
-         SELECT
-             date(to_timestamp(timestamp)) AS day,
-             ip_id
-         FROM "%s"
-         WHERE pageview_flag = 1 AND timestamp >= ? AND timestamp < ?
-         GROUP BY day, ip_id
-         ON CONFLICT DO NOTHING`, aggDailyIP, logTable,
-	)), start.Unix(), end.Unix()); err != nil {
-		return err
+	if !UVApproximate(websiteID) {
+		if _, err = tx.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`INSERT INTO "%s" (day, ip_id)
+             SELECT
+                 date(to_timestamp(timestamp)) AS day,
+                 ip_id
+             FROM "%s"
+             WHERE pageview_flag = 1 AND timestamp >= ? AND timestamp < ?
+             GROUP BY day, ip_id
+             ON CONFLICT DO NOTHING`, aggDailyIP, logTable,
+		)), start.Unix(), end.Unix()); err != nil {
+			return err
+		}
 	}
 
 	return tx.Commit()
@@ -4258,6 +4582,8 @@ func (r *Repository) clearAggregateTablesForWebsite(websiteID string) error {
 		fmt.Sprintf("%s_agg_daily", websiteID),
 		fmt.Sprintf("%s_agg_daily_ip", websiteID),
 	}
+	aggTables = append(aggTables, uvSketchTables(websiteID)...)
+	aggTables = append(aggTables, dimAggregateTables(websiteID)...)
 	for _, table := range aggTables {
 		exists, err := r.tableExists(table)
 		if err != nil {
@@ -0,0 +1,156 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+)
+
+// RetentionTiers 站点各数据层的保留起点，早于该时间的数据会在清理任务中删除
+type RetentionTiers struct {
+	Raw       time.Time
+	Sessions  time.Time
+	Hourly    time.Time
+	Daily     time.Time
+	FirstSeen time.Time
+}
+
+// RetentionTiersFor 按站点生效的分层保留天数计算各层的保留起点
+func RetentionTiersFor(websiteID string) RetentionTiers {
+	retention := config.RetentionForWebsite(websiteID)
+	now := time.Now()
+	cutoff := func(days int) time.Time {
+		return now.AddDate(0, 0, -days)
+	}
+	return RetentionTiers{
+		Raw:       cutoff(retention.RawDays),
+		Sessions:  cutoff(retention.SessionDays),
+		Hourly:    cutoff(retention.HourlyDays),
+		Daily:     cutoff(retention.DailyDays),
+		FirstSeen: cutoff(retention.FirstSeenDays),
+	}
+}
+
+// outlives 该层是否比原始日志保留得更久；这样的层不再跟随原始日志清理，只按自身期限删除
+func (t RetentionTiers) outlives(cutoff time.Time) bool {
+	return cutoff.Before(t.Raw)
+}
+
+// retentionCutoff 站点原始日志的保留起点
+func retentionCutoff(websiteID string) time.Time {
+	return RetentionTiersFor(websiteID).Raw
+}
+
+// cleanupLongTiers 按各自期限清理比原始日志保留更久的层。
+// 这些层的数据无法再从原始日志重建，只整桶删除，不重建边界
+func (r *Repository) cleanupLongTiers(websiteID string, tiers RetentionTiers) error {
+	if tiers.outlives(tiers.Hourly) {
+		if err := r.cleanupHourlyAggregates(websiteID, tiers.Hourly, false); err != nil {
+			return err
+		}
+		if err := r.cleanupAnomalies(websiteID, tiers.Hourly); err != nil {
+			return err
+		}
+	}
+	if tiers.outlives(tiers.Sessions) {
+		if err := r.cleanupSessions(websiteID, tiers.Sessions); err != nil {
+			return err
+		}
+	}
+	if tiers.outlives(tiers.Daily) {
+		if err := r.cleanupDailyAggregates(websiteID, tiers.Daily, false); err != nil {
+			return err
+		}
+		if err := r.cleanupSessionAggregates(websiteID, tiers.Daily, false); err != nil {
+			return err
+		}
+	}
+	if tiers.outlives(tiers.FirstSeen) {
+		if err := r.cleanupFirstSeenBefore(websiteID, tiers.FirstSeen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dimReference 引用维表 ID 的表与列
+type dimReference struct {
+	table  string
+	column string
+}
+
+// retainedDimReferences 返回比原始日志保留更久的层对维表的引用，按日志表中的列名分组。
+// 清理维表孤儿记录时这些 ID 必须保留，否则入口页无法关联 URL，
+// 同一 IP 再次出现时也会拿到新 ID，导致首次访问记录失效
+func (r *Repository) retainedDimReferences(websiteID string, tiers RetentionTiers) (map[string][]dimReference, error) {
+	candidates := make(map[string][]dimReference)
+	add := func(column, table, refColumn string) {
+		candidates[column] = append(candidates[column], dimReference{
+			table:  fmt.Sprintf("%s_%s", websiteID, table),
+			column: refColumn,
+		})
+	}
+	if tiers.outlives(tiers.Sessions) {
+		add("ip_id", "sessions", "ip_id")
+		add("ip_id", "session_state", "ip_id")
+		add("ua_id", "sessions", "ua_id")
+		add("ua_id", "session_state", "ua_id")
+		add("location_id", "sessions", "location_id")
+		add("url_id", "sessions", "entry_url_id")
+		add("url_id", "sessions", "exit_url_id")
+	}
+	if tiers.outlives(tiers.Hourly) {
+		add("ip_id", "agg_hourly_ip", "ip_id")
+	}
+	if tiers.outlives(tiers.Daily) {
+		add("ip_id", "agg_daily_ip", "ip_id")
+		add("url_id", "agg_entry_daily", "entry_url_id")
+		for _, spec := range dimAggSpecs {
+			add(spec.logColumn, "agg_"+spec.name+"_daily", "dim_id")
+		}
+	}
+	if tiers.outlives(tiers.FirstSeen) {
+		add("ip_id", "first_seen", "ip_id")
+	}
+
+	refs := make(map[string][]dimReference, len(candidates))
+	for column, list := range candidates {
+		for _, ref := range list {
+			exists, err := r.tableExists(ref.table)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				refs[column] = append(refs[column], ref)
+			}
+		}
+	}
+	return refs, nil
+}
+
+// retainedDimClause 为维表删除语句追加“未被长期层引用”的条件，alias 为维表别名
+func retainedDimClause(alias string, refs []dimReference) string {
+	clause := ""
+	for _, ref := range refs {
+		clause += fmt.Sprintf(
+			` AND NOT EXISTS (SELECT 1 FROM "%s" x WHERE x.%s = %s.id)`,
+			ref.table, ref.column, alias,
+		)
+	}
+	return clause
+}
+
+// deleteAggregatesBefore 删除聚合表中 column 早于 bucket 的行
+func (r *Repository) deleteAggregatesBefore(tables []string, column string, bucket interface{}) error {
+	for _, table := range tables {
+		if _, err := r.db.Exec(
+			sqlutil.ReplacePlaceholders(fmt.Sprintf(`DELETE FROM "%s" WHERE %s < ?`, table, column)),
+			bucket,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
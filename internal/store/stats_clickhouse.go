@@ -0,0 +1,149 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// clickHouseStats ClickHouse 站点的查询实现：汇总、趋势、排行与活跃访客读 ClickHouse，
+// 会话与日志明细仍落在 Postgres 的站点分表上（ClickHouse 站点不写这些表，结果为空）
+type clickHouseStats struct {
+	*postgresStats
+	ch *ClickHouseStore
+}
+
+func (s *clickHouseStats) Totals(websiteID string, start, end time.Time) (StatsTotals, error) {
+	metrics, err := s.ch.Metrics(websiteID, start, end)
+	if err != nil {
+		return StatsTotals{}, err
+	}
+	return StatsTotals{
+		PV:      int(metrics.PV),
+		UV:      int(metrics.UV),
+		Traffic: metrics.Traffic,
+		S2xx:    int(metrics.S2xx),
+		S3xx:    int(metrics.S3xx),
+		S4xx:    int(metrics.S4xx),
+		S5xx:    int(metrics.S5xx),
+		Other:   int(metrics.Other),
+	}, nil
+}
+
+// VisitorSplit ClickHouse 站点没有首次访问表，无法区分新老访客
+func (s *clickHouseStats) VisitorSplit(websiteID string, start, end time.Time) (int, int, error) {
+	return 0, 0, nil
+}
+
+// Series 用 ClickHouse 汇总表填充趋势图；按日时以时间点所在时区的自然日分组
+func (s *clickHouseStats) Series(websiteID string, timePoints []time.Time, hourly bool) ([]SeriesPoint, error) {
+	results := make([]SeriesPoint, len(timePoints))
+	if len(timePoints) == 0 {
+		return results, nil
+	}
+	index := make(map[string]int, len(timePoints))
+	var start, end time.Time
+	if hourly {
+		for i, point := range timePoints {
+			index[strconv.FormatInt(hourBucket(point), 10)] = i
+		}
+		start = time.Unix(hourBucket(timePoints[0]), 0)
+		end = time.Unix(hourBucket(timePoints[len(timePoints)-1]), 0).Add(time.Hour)
+	} else {
+		loc := timePoints[0].Location()
+		for i, point := range timePoints {
+			index[point.In(loc).Format("2006-01-02")] = i
+		}
+		startUnix, endUnix := zonedDayBounds(timePoints)
+		start, end = time.Unix(startUnix, 0), time.Unix(endUnix, 0)
+	}
+
+	points, err := s.ch.Series(websiteID, start, end, hourly, timePoints[0].Location().String())
+	if err != nil {
+		return results, err
+	}
+	for _, point := range points {
+		if idx, ok := index[point.Key]; ok {
+			results[idx] = SeriesPoint{PV: int(point.PV), UV: int(point.UV)}
+		}
+	}
+	return results, nil
+}
+
+// clickHouseKeyExpr 返回维度在 ClickHouse 原始日志表上的分组表达式与附加过滤条件，
+// 归类规则与 Postgres 查询一致
+func clickHouseKeyExpr(websiteID string, query DimensionQuery) (string, string, error) {
+	keyExpr, filter := "", ""
+	switch query.Dimension {
+	case DimensionURL:
+		keyExpr = "url"
+	case DimensionReferer, DimensionRefererHost, DimensionRefererSource, DimensionRefererKeyword, DimensionChannel:
+		keyExpr, filter = refererKeyExpr(query.Dimension, internalRefererCondition(websiteID, "referer"), "")
+	case DimensionBrowser:
+		keyExpr = "browser"
+	case DimensionOS:
+		keyExpr = "os"
+	case DimensionDevice:
+		keyExpr = "device"
+	case DimensionProvince:
+		keyExpr = "splitByString('·', domestic)[1]"
+	case DimensionCity:
+		keyExpr = "if(position(domestic, '·') > 0, substring(domestic, position(domestic, '·') + length('·')), domestic)"
+	case DimensionCountry:
+		keyExpr = "global"
+	default:
+		return "", "", fmt.Errorf("不支持的统计维度: %s", query.Dimension)
+	}
+	if query.DomesticOnly {
+		filter += " AND global = '中国'"
+	}
+	return keyExpr, filter, nil
+}
+
+// TopDimension 在 ClickHouse 原始日志上统计维度排行，对比区间与排序规则同 Postgres 查询
+func (s *clickHouseStats) TopDimension(websiteID string, query DimensionQuery) (DimensionResult, error) {
+	result := DimensionResult{Rows: make([]DimensionRow, 0)}
+	keyExpr, filter, err := clickHouseKeyExpr(websiteID, query)
+	if err != nil {
+		return result, err
+	}
+	chQuery := ClickHouseDimensionQuery{
+		KeyExpr:     keyExpr,
+		Filter:      filter,
+		Start:       query.Start.Unix(),
+		End:         query.End.Unix(),
+		CompareSort: query.CompareSort,
+		Limit:       query.Limit,
+	}
+	if query.Compare != nil {
+		chQuery.Compare = true
+		chQuery.PrevStart = query.Compare.Start
+		chQuery.PrevEnd = query.Compare.End
+	}
+	if query.OrderBy == MetricPV && query.Compare == nil {
+		chQuery.OrderByPV = true
+	}
+	rows, err := s.ch.TopDimension(websiteID, chQuery)
+	if err != nil {
+		return result, err
+	}
+	for _, row := range rows {
+		result.Rows = append(result.Rows, DimensionRow{
+			Key:    row.Key,
+			CurPV:  int(row.CurPV),
+			CurUV:  int(row.CurUV),
+			PrevPV: int(row.PrevPV),
+			PrevUV: int(row.PrevUV),
+		})
+	}
+	if UVApproximate(websiteID) {
+		relativeError := ClickHouseUVRelativeError
+		result.UVRelativeError = &relativeError
+	}
+	return result, nil
+}
+
+func (s *clickHouseStats) ActiveVisitors(websiteID string, r TimeRange) (int, error) {
+	count, err := s.ch.Visitors(websiteID, r.Start, r.End)
+	return int(count), err
+}
@@ -0,0 +1,581 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+)
+
+// MemoryStats 在内存中按原始日志即时计算的 StatsQuerier，供单元测试使用。
+// 汇总类查询按服务器本地小时桶取区间，与 Postgres 聚合表的口径一致；UV 始终精确计数
+type MemoryStats struct {
+	mu        sync.RWMutex
+	logs      map[string][]NginxLogRecord
+	anomalies map[string][]TrafficAnomaly
+	nextID    int64
+}
+
+// NewMemoryStats 创建空的内存查询实现
+func NewMemoryStats() *MemoryStats {
+	return &MemoryStats{
+		logs:      make(map[string][]NginxLogRecord),
+		anomalies: make(map[string][]TrafficAnomaly),
+	}
+}
+
+// AddLogs 追加站点日志，ID 为 0 的记录按写入顺序分配 ID
+func (m *MemoryStats) AddLogs(websiteID string, logs ...NginxLogRecord) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, log := range logs {
+		if log.ID == 0 {
+			m.nextID++
+			log.ID = m.nextID
+		} else if log.ID > m.nextID {
+			m.nextID = log.ID
+		}
+		m.logs[websiteID] = append(m.logs[websiteID], log)
+	}
+}
+
+// AddTrafficAnomalies 追加站点的流量异常记录
+func (m *MemoryStats) AddTrafficAnomalies(websiteID string, anomalies ...TrafficAnomaly) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.anomalies[websiteID] = append(m.anomalies[websiteID], anomalies...)
+}
+
+// snapshot 返回站点日志的副本，查询期间不持有锁
+func (m *MemoryStats) snapshot(websiteID string) []NginxLogRecord {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]NginxLogRecord(nil), m.logs[websiteID]...)
+}
+
+// firstSeen 每个 IP 首次浏览的时间，与首次访问表一样只统计页面浏览
+func firstSeen(logs []NginxLogRecord) map[string]int64 {
+	first := make(map[string]int64)
+	for _, log := range logs {
+		if log.PageviewFlag != 1 {
+			continue
+		}
+		ts := log.Timestamp.Unix()
+		if prev, ok := first[log.IP]; !ok || ts < prev {
+			first[log.IP] = ts
+		}
+	}
+	return first
+}
+
+// inHourBuckets 日志所在小时桶是否落在 start、end 所在小时桶之间（含两端）
+func inHourBuckets(log NginxLogRecord, start, end time.Time) bool {
+	bucket := hourBucket(log.Timestamp)
+	return bucket >= hourBucket(start) && bucket <= hourBucket(end)
+}
+
+func inRange(ts int64, r TimeRange) bool {
+	return ts >= r.Start && ts < r.End
+}
+
+func (m *MemoryStats) Totals(websiteID string, start, end time.Time) (StatsTotals, error) {
+	var counts aggCounts
+	visitors := make(map[string]struct{})
+	for _, log := range m.snapshot(websiteID) {
+		if !inHourBuckets(log, start, end) {
+			continue
+		}
+		addCounts(&counts, log)
+		if log.PageviewFlag == 1 {
+			visitors[log.IP] = struct{}{}
+		}
+	}
+	return StatsTotals{
+		PV:      int(counts.pv),
+		UV:      len(visitors),
+		Traffic: counts.traffic,
+		S2xx:    int(counts.s2xx),
+		S3xx:    int(counts.s3xx),
+		S4xx:    int(counts.s4xx),
+		S5xx:    int(counts.s5xx),
+		Other:   int(counts.other),
+	}, nil
+}
+
+func (m *MemoryStats) VisitorSplit(websiteID string, start, end time.Time) (int, int, error) {
+	logs := m.snapshot(websiteID)
+	first := firstSeen(logs)
+	active := make(map[string]struct{})
+	for _, log := range logs {
+		if log.PageviewFlag == 1 && inHourBuckets(log, start, end) {
+			active[log.IP] = struct{}{}
+		}
+	}
+	newCount, returningCount := 0, 0
+	for ip := range active {
+		ts := first[ip]
+		switch {
+		case ts >= start.Unix() && ts < end.Unix():
+			newCount++
+		case ts < start.Unix():
+			returningCount++
+		}
+	}
+	return newCount, returningCount, nil
+}
+
+func (m *MemoryStats) Series(websiteID string, timePoints []time.Time, hourly bool) ([]SeriesPoint, error) {
+	results := make([]SeriesPoint, len(timePoints))
+	if len(timePoints) == 0 {
+		return results, nil
+	}
+	loc := timePoints[0].Location()
+	key := func(ts time.Time) string {
+		if hourly {
+			return time.Unix(hourBucket(ts), 0).String()
+		}
+		return ts.In(loc).Format("2006-01-02")
+	}
+	index := make(map[string]int, len(timePoints))
+	for i, point := range timePoints {
+		index[key(point)] = i
+	}
+	visitors := make([]map[string]struct{}, len(timePoints))
+	for _, log := range m.snapshot(websiteID) {
+		idx, ok := index[key(log.Timestamp)]
+		if !ok || log.PageviewFlag != 1 {
+			continue
+		}
+		results[idx].PV += int(log.weight())
+		if visitors[idx] == nil {
+			visitors[idx] = make(map[string]struct{})
+		}
+		visitors[idx][log.IP] = struct{}{}
+	}
+	for i := range results {
+		results[i].UV = len(visitors[i])
+	}
+	return results, nil
+}
+
+// memoryGroup 单个分组在一个区间内的 PV 与访客集合
+type memoryGroup struct {
+	pv       int
+	visitors map[string]struct{}
+}
+
+func (g *memoryGroup) add(log NginxLogRecord) {
+	if g.visitors == nil {
+		g.visitors = make(map[string]struct{})
+	}
+	g.pv += int(log.weight())
+	g.visitors[log.IP] = struct{}{}
+}
+
+func (m *MemoryStats) TopDimension(websiteID string, query DimensionQuery) (DimensionResult, error) {
+	result := DimensionResult{Rows: make([]DimensionRow, 0)}
+	keyFn, err := memoryDimensionKey(websiteID, query)
+	if err != nil {
+		return result, err
+	}
+	current := TimeRange{Start: query.Start.Unix(), End: query.End.Unix()}
+	cur := make(map[string]*memoryGroup)
+	prev := make(map[string]*memoryGroup)
+	for _, log := range m.snapshot(websiteID) {
+		if log.PageviewFlag != 1 {
+			continue
+		}
+		key, ok := keyFn(log)
+		if !ok {
+			continue
+		}
+		ts := log.Timestamp.Unix()
+		if inRange(ts, current) {
+			if cur[key] == nil {
+				cur[key] = &memoryGroup{}
+			}
+			cur[key].add(log)
+		}
+		if query.Compare != nil && inRange(ts, *query.Compare) {
+			if prev[key] == nil {
+				prev[key] = &memoryGroup{}
+			}
+			prev[key].add(log)
+		}
+	}
+
+	merged := make(map[string]*DimensionRow, len(cur))
+	for key, group := range cur {
+		merged[key] = &DimensionRow{Key: key, CurPV: group.pv, CurUV: len(group.visitors)}
+	}
+	for key, group := range prev {
+		row := merged[key]
+		if row == nil {
+			row = &DimensionRow{Key: key}
+			merged[key] = row
+		}
+		row.PrevPV = group.pv
+		row.PrevUV = len(group.visitors)
+	}
+	for _, row := range merged {
+		result.Rows = append(result.Rows, *row)
+	}
+	result.Rows = sortDimensionRows(result.Rows, query)
+	return result, nil
+}
+
+// memoryDimensionKey 返回从日志取分组键的函数，第二个返回值为 false 时该日志不参与统计；
+// 归类规则与 Postgres 查询的 SQL 表达式一致
+func memoryDimensionKey(websiteID string, query DimensionQuery) (func(NginxLogRecord) (string, bool), error) {
+	var domains []string
+	if website, ok := config.GetWebsiteByID(websiteID); ok {
+		domains = siteDomains(website.Domains)
+	}
+	var keyFn func(NginxLogRecord) (string, bool)
+	switch query.Dimension {
+	case DimensionURL:
+		keyFn = func(log NginxLogRecord) (string, bool) { return log.Url, true }
+	case DimensionReferer, DimensionRefererHost, DimensionRefererSource, DimensionRefererKeyword, DimensionChannel:
+		keyFn = func(log NginxLogRecord) (string, bool) { return memoryRefererKey(query.Dimension, log, domains) }
+	case DimensionBrowser:
+		keyFn = func(log NginxLogRecord) (string, bool) { return log.UserBrowser, true }
+	case DimensionOS:
+		keyFn = func(log NginxLogRecord) (string, bool) { return log.UserOs, true }
+	case DimensionDevice:
+		keyFn = func(log NginxLogRecord) (string, bool) { return log.UserDevice, true }
+	case DimensionProvince:
+		keyFn = func(log NginxLogRecord) (string, bool) {
+			province, _, _ := strings.Cut(log.DomesticLocation, "·")
+			return province, true
+		}
+	case DimensionCity:
+		keyFn = func(log NginxLogRecord) (string, bool) {
+			if _, city, ok := strings.Cut(log.DomesticLocation, "·"); ok {
+				return city, true
+			}
+			return log.DomesticLocation, true
+		}
+	case DimensionCountry:
+		keyFn = func(log NginxLogRecord) (string, bool) { return log.GlobalLocation, true }
+	default:
+		return nil, fmt.Errorf("不支持的统计维度: %s", query.Dimension)
+	}
+	if !query.DomesticOnly {
+		return keyFn, nil
+	}
+	return func(log NginxLogRecord) (string, bool) {
+		if log.GlobalLocation != "中国" {
+			return "", false
+		}
+		return keyFn(log)
+	}, nil
+}
+
+// memoryRefererKey 来源类维度的分组键，直接访问与站内访问单独归类
+func memoryRefererKey(dimension Dimension, log NginxLogRecord, domains []string) (string, bool) {
+	direct := log.Referer == "-" || log.Referer == ""
+	internal := !direct && internalReferer(log.Referer, domains)
+	switch dimension {
+	case DimensionChannel:
+		switch {
+		case direct:
+			return "direct", true
+		case internal:
+			return "internal", true
+		case log.RefererChannel == "":
+			return "other", true
+		}
+		return log.RefererChannel, true
+	case DimensionRefererKeyword:
+		return log.RefererKeyword, log.RefererKeyword != ""
+	}
+	switch {
+	case direct:
+		return "直接输入网址访问", true
+	case internal:
+		return "站内访问", true
+	}
+	switch {
+	case dimension == DimensionRefererSource && log.RefererSource != "":
+		return log.RefererSource, true
+	case (dimension == DimensionRefererSource || dimension == DimensionRefererHost) && log.RefererHost != "":
+		return log.RefererHost, true
+	}
+	return log.Referer, true
+}
+
+// internalReferer 与 internalRefererCondition 的 LIKE 规则一致：
+// 来源以 http 开头，其后某处出现 "://域名"，且域名之后为结尾、"/" 或 ":"
+func internalReferer(referer string, domains []string) bool {
+	if !strings.HasPrefix(referer, "http") {
+		return false
+	}
+	rest := referer[len("http"):]
+	for _, domain := range domains {
+		marker := "://" + domain
+		for offset := 0; ; {
+			idx := strings.Index(rest[offset:], marker)
+			if idx < 0 {
+				break
+			}
+			after := rest[offset+idx+len(marker):]
+			if after == "" || after[0] == '/' || after[0] == ':' {
+				return true
+			}
+			offset += idx + 1
+		}
+	}
+	return false
+}
+
+func (m *MemoryStats) ActiveVisitors(websiteID string, r TimeRange) (int, error) {
+	visitors := make(map[string]struct{})
+	for _, log := range m.snapshot(websiteID) {
+		if log.PageviewFlag == 1 && inRange(log.Timestamp.Unix(), r) {
+			visitors[log.IP] = struct{}{}
+		}
+	}
+	return len(visitors), nil
+}
+
+func (m *MemoryStats) VisitorBuckets(websiteID string, r TimeRange, step int64) (map[int64]int, error) {
+	visitors := make(map[int64]map[string]struct{})
+	for _, log := range m.snapshot(websiteID) {
+		ts := log.Timestamp.Unix()
+		if log.PageviewFlag != 1 || !inRange(ts, r) {
+			continue
+		}
+		bucket := ts / step
+		if visitors[bucket] == nil {
+			visitors[bucket] = make(map[string]struct{})
+		}
+		visitors[bucket][log.IP] = struct{}{}
+	}
+	buckets := make(map[int64]int, len(visitors))
+	for bucket, set := range visitors {
+		buckets[bucket] = len(set)
+	}
+	return buckets, nil
+}
+
+func (m *MemoryStats) SessionMetrics(websiteID string, start, end time.Time) (SessionMetrics, error) {
+	return sessionMetricsFromPageviews(m, websiteID, start, end)
+}
+
+// memoryVisitor 内存实现没有 UA 维表，以 IP 与浏览器、系统、设备组合区分访客
+func memoryVisitor(log NginxLogRecord) string {
+	return strings.Join([]string{log.IP, log.UserBrowser, log.UserOs, log.UserDevice}, "|")
+}
+
+func (m *MemoryStats) ScanPageviews(websiteID string, filter LogFilter, fn func(PageviewRow) error) error {
+	filter.PageviewOnly = true
+	rows := make([]PageviewRow, 0)
+	for _, log := range m.snapshot(websiteID) {
+		if !matchLog(filter, log) {
+			continue
+		}
+		rows = append(rows, PageviewRow{
+			Timestamp: log.Timestamp.Unix(),
+			Visitor:   memoryVisitor(log),
+			IP:        log.IP,
+			Browser:   log.UserBrowser,
+			OS:        log.UserOs,
+			Device:    log.UserDevice,
+			URL:       log.Url,
+			Domestic:  log.DomesticLocation,
+			Global:    log.GlobalLocation,
+		})
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Visitor != rows[j].Visitor {
+			return rows[i].Visitor < rows[j].Visitor
+		}
+		return rows[i].Timestamp < rows[j].Timestamp
+	})
+	for _, row := range rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchLog 内存实现的过滤规则，与 logConditions 生成的 SQL 条件一致
+func matchLog(filter LogFilter, log NginxLogRecord) bool {
+	ts := log.Timestamp.Unix()
+	switch {
+	case filter.Start > 0 && ts < filter.Start,
+		filter.End > 0 && ts >= filter.End,
+		filter.PageviewOnly && log.PageviewFlag != 1,
+		filter.IP != "" && !strings.Contains(log.IP, filter.IP),
+		filter.URL != "" && !strings.Contains(log.Url, filter.URL),
+		filter.Device != "" && !strings.Contains(log.UserDevice, filter.Device),
+		filter.Browser != "" && !strings.Contains(log.UserBrowser, filter.Browser),
+		filter.OS != "" && !strings.Contains(log.UserOs, filter.OS),
+		filter.ExcludeSpider && log.UserDevice == spiderDeviceLabel:
+		return false
+	}
+	if filter.Keyword != "" &&
+		!strings.Contains(log.Url, filter.Keyword) && !strings.Contains(log.IP, filter.Keyword) &&
+		!strings.Contains(log.Referer, filter.Keyword) && !strings.Contains(log.DomesticLocation, filter.Keyword) {
+		return false
+	}
+	if filter.Location != "" &&
+		!strings.Contains(log.DomesticLocation, filter.Location) && !strings.Contains(log.GlobalLocation, filter.Location) {
+		return false
+	}
+	if filter.StatusCode > 0 {
+		if log.Status != filter.StatusCode {
+			return false
+		}
+	} else if low, high, ok := statusClassRange(filter.StatusClass); ok && (log.Status < low || log.Status >= high) {
+		return false
+	}
+	if filter.ExcludeInternalIP && internalIP(log.IP) {
+		return false
+	}
+	if filter.ExcludeForeign && log.GlobalLocation != "中国" && strings.ToLower(log.GlobalLocation) != "china" {
+		return false
+	}
+	return true
+}
+
+// internalIP 按 internalIPPatterns 判断内网与回环地址
+func internalIP(ip string) bool {
+	for _, pattern := range internalIPPatterns {
+		if prefix, ok := strings.CutSuffix(pattern, "%"); ok {
+			if strings.HasPrefix(ip, prefix) {
+				return true
+			}
+		} else if ip == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStats) ListLogs(websiteID string, query LogQuery) ([]LogRow, int, error) {
+	logs := m.snapshot(websiteID)
+	first := firstSeen(logs)
+	isNew := func(ip string) bool {
+		ts, ok := first[ip]
+		return ok && ts >= query.NewSince && ts < query.NewUntil
+	}
+
+	matched := make([]LogRow, 0)
+	for _, log := range logs {
+		if !matchLog(query.Filter, log) {
+			continue
+		}
+		switch query.NewVisitor {
+		case "new":
+			if !isNew(log.IP) {
+				continue
+			}
+		case "returning":
+			if ts, ok := first[log.IP]; !ok || ts >= query.NewSince {
+				continue
+			}
+		}
+		matched = append(matched, LogRow{
+			ID:           log.ID,
+			IP:           log.IP,
+			Timestamp:    log.Timestamp.Unix(),
+			Method:       log.Method,
+			URL:          log.Url,
+			RawURL:       log.RawUrl,
+			StatusCode:   log.Status,
+			BytesSent:    log.BytesSent,
+			Referer:      log.Referer,
+			Browser:      log.UserBrowser,
+			OS:           log.UserOs,
+			Device:       log.UserDevice,
+			Domestic:     log.DomesticLocation,
+			Global:       log.GlobalLocation,
+			Pageview:     log.PageviewFlag == 1,
+			IsNewVisitor: query.NewVisitor != "" && isNew(log.IP),
+		})
+	}
+
+	if query.DistinctIP {
+		latest := make(map[string]int, len(matched))
+		for i, row := range matched {
+			j, ok := latest[row.IP]
+			if !ok || row.Timestamp > matched[j].Timestamp ||
+				(row.Timestamp == matched[j].Timestamp && row.ID > matched[j].ID) {
+				latest[row.IP] = i
+			}
+		}
+		distinct := make([]LogRow, 0, len(latest))
+		for _, i := range latest {
+			distinct = append(distinct, matched[i])
+		}
+		matched = distinct
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if query.SortDesc {
+			return logRowLess(matched[j], matched[i], query.SortField)
+		}
+		return logRowLess(matched[i], matched[j], query.SortField)
+	})
+
+	total := len(matched)
+	start := query.Offset
+	if start > total {
+		start = total
+	}
+	end := start + query.Limit
+	if end > total {
+		end = total
+	}
+	return matched[start:end], total, nil
+}
+
+// logRowLess 按排序字段比较两行，相同时按 ID 保证稳定
+func logRowLess(a, b LogRow, field string) bool {
+	switch field {
+	case "ip":
+		if a.IP != b.IP {
+			return a.IP < b.IP
+		}
+	case "url":
+		if a.URL != b.URL {
+			return a.URL < b.URL
+		}
+	case "status_code":
+		if a.StatusCode != b.StatusCode {
+			return a.StatusCode < b.StatusCode
+		}
+	case "bytes_sent":
+		if a.BytesSent != b.BytesSent {
+			return a.BytesSent < b.BytesSent
+		}
+	default:
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+	}
+	return a.ID < b.ID
+}
+
+func (m *MemoryStats) TrafficAnomalies(websiteID string, start, end int64) ([]TrafficAnomaly, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	anomalies := make([]TrafficAnomaly, 0)
+	for _, anomaly := range m.anomalies[websiteID] {
+		if anomaly.Bucket >= start && anomaly.Bucket <= end {
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+	sort.SliceStable(anomalies, func(i, j int) bool {
+		if anomalies[i].Bucket != anomalies[j].Bucket {
+			return anomalies[i].Bucket < anomalies[j].Bucket
+		}
+		return anomalies[i].Metric < anomalies[j].Metric
+	})
+	return anomalies, nil
+}
@@ -0,0 +1,648 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+	"github.com/likaia/nginxpulse/internal/store/hll"
+)
+
+// postgresStats 基于站点分表与聚合表的 StatsQuerier 实现
+type postgresStats struct {
+	repo *Repository
+}
+
+// aggRange 描述一次按聚合表查询使用的表与范围
+type aggRange struct {
+	suffix string      // daily / hourly
+	column string      // day / bucket
+	start  interface{} // 起始（含）
+	end    interface{} // 结束（含）
+}
+
+// aggRangeFor 按日聚合表以服务器本地日期为键，只有区间正好落在服务器本地整日边界时才能使用；
+// 其它时区或带时刻的区间改用按小时聚合表。小时聚合已过保留期而日聚合仍在时，
+// 退回日聚合并把区间扩展到服务器本地整日
+func aggRangeFor(websiteID string, startTime, endTime time.Time) aggRange {
+	if alignedToServerDays(startTime, endTime) {
+		return aggRange{suffix: "daily", column: "day", start: dayBucket(startTime), end: dayBucket(endTime)}
+	}
+	tiers := RetentionTiersFor(websiteID)
+	if useCoarserTier(startTime, tiers.Hourly, tiers.Daily) {
+		return aggRange{suffix: "daily", column: "day", start: dayBucket(startTime), end: dayBucket(endTime)}
+	}
+	return aggRange{suffix: "hourly", column: "bucket", start: hourBucket(startTime), end: hourBucket(endTime)}
+}
+
+// useCoarserTier 细粒度层已不覆盖 start、且粗粒度层保留得更久时返回 true；
+// 两层保留期相同时改用粗粒度层也补不回数据，保持原有查询
+func useCoarserTier(start, fine, coarse time.Time) bool {
+	return start.Before(fine) && coarse.Before(fine)
+}
+
+func alignedToServerDays(startTime, endTime time.Time) bool {
+	if startTime.Location() != time.Local || endTime.Location() != time.Local {
+		return false
+	}
+	return startTime.Hour() == 0 && startTime.Minute() == 0 && startTime.Second() == 0 &&
+		endTime.Hour() == 23
+}
+
+func (s *postgresStats) db() *sql.DB {
+	return s.repo.db
+}
+
+func (s *postgresStats) Totals(websiteID string, startTime, endTime time.Time) (StatsTotals, error) {
+	var totals StatsTotals
+	agg := aggRangeFor(websiteID, startTime, endTime)
+
+	aggQuery := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
+        SELECT
+            COALESCE(SUM(pv), 0) AS pv,
+            COALESCE(SUM(traffic), 0) AS traffic,
+            COALESCE(SUM(s2xx), 0) AS s2xx,
+            COALESCE(SUM(s3xx), 0) AS s3xx,
+            COALESCE(SUM(s4xx), 0) AS s4xx,
+            COALESCE(SUM(s5xx), 0) AS s5xx,
+            COALESCE(SUM(other), 0) AS other
+        FROM "%[1]s_agg_%[2]s"
+        WHERE %[3]s >= ? AND %[3]s <= ?`,
+		websiteID, agg.suffix, agg.column))
+
+	row := s.db().QueryRow(aggQuery, agg.start, agg.end)
+	if err := row.Scan(
+		&totals.PV, &totals.Traffic,
+		&totals.S2xx, &totals.S3xx, &totals.S4xx, &totals.S5xx, &totals.Other,
+	); err != nil {
+		return totals, fmt.Errorf("查询总体统计数据失败: %v", err)
+	}
+
+	if UVApproximate(websiteID) {
+		uv, err := s.mergedUV(websiteID, agg)
+		if err != nil {
+			return totals, fmt.Errorf("查询总体统计UV失败: %v", err)
+		}
+		totals.UV = uv
+		return totals, nil
+	}
+
+	uvQuery := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
+        SELECT COUNT(DISTINCT ip_id) as uv
+        FROM "%[1]s_agg_%[2]s_ip"
+        WHERE %[3]s >= ? AND %[3]s <= ?`,
+		websiteID, agg.suffix, agg.column))
+
+	if err := s.db().QueryRow(uvQuery, agg.start, agg.end).Scan(&totals.UV); err != nil {
+		return totals, fmt.Errorf("查询总体统计UV失败: %v", err)
+	}
+	return totals, nil
+}
+
+func (s *postgresStats) VisitorSplit(websiteID string, startTime, endTime time.Time) (int, int, error) {
+	agg := aggRangeFor(websiteID, startTime, endTime)
+	if UVApproximate(websiteID) {
+		return s.visitorSplitApprox(websiteID, startTime, endTime, agg)
+	}
+
+	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
+        WITH active_ips AS (
+            SELECT DISTINCT ip_id
+            FROM "%[1]s_agg_%[2]s_ip"
+            WHERE %[3]s >= ? AND %[3]s <= ?
+        )
+        SELECT
+            COALESCE(SUM(CASE WHEN fs.first_ts >= ? AND fs.first_ts < ? THEN 1 ELSE 0 END), 0) AS new_uv,
+            COALESCE(SUM(CASE WHEN fs.first_ts < ? THEN 1 ELSE 0 END), 0) AS returning_uv
+        FROM active_ips a
+        LEFT JOIN "%[1]s_first_seen" fs ON fs.ip_id = a.ip_id`,
+		websiteID, agg.suffix, agg.column))
+
+	row := s.db().QueryRow(
+		query,
+		agg.start, agg.end,
+		startTime.Unix(), endTime.Unix(),
+		startTime.Unix(),
+	)
+
+	var newCount, returningCount int
+	if err := row.Scan(&newCount, &returningCount); err != nil {
+		return 0, 0, err
+	}
+	return newCount, returningCount, nil
+}
+
+// visitorSplitApprox 近似计数时没有 IP 明细：首次访问落在区间内的 IP 必然在区间内活跃，
+// 新访客可由首次访问表精确统计，老访客取 UV 估计值与新访客之差
+func (s *postgresStats) visitorSplitApprox(
+	websiteID string, startTime, endTime time.Time, agg aggRange,
+) (int, int, error) {
+	var newCount int
+	if err := s.db().QueryRow(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT COUNT(*) FROM "%s_first_seen" WHERE first_ts >= ? AND first_ts < ?`, websiteID,
+	)), startTime.Unix(), endTime.Unix()).Scan(&newCount); err != nil {
+		return 0, 0, err
+	}
+	uv, err := s.mergedUV(websiteID, agg)
+	if err != nil {
+		return 0, 0, err
+	}
+	returningCount := uv - newCount
+	if returningCount < 0 {
+		returningCount = 0
+	}
+	return newCount, returningCount, nil
+}
+
+func (s *postgresStats) Series(websiteID string, timePoints []time.Time, hourly bool) ([]SeriesPoint, error) {
+	results := make([]SeriesPoint, len(timePoints))
+	if len(timePoints) == 0 {
+		return results, nil
+	}
+	if hourly {
+		return s.seriesByHourlyBuckets(websiteID, timePoints, results)
+	}
+
+	// 按日聚合表以服务器本地日期为键，其它时区需从小时聚合表按该时区重新分日；
+	// 小时聚合已过保留期时只能按服务器本地日近似
+	tiers := RetentionTiersFor(websiteID)
+	if timePoints[0].Location() != time.Local && !useCoarserTier(timePoints[0], tiers.Hourly, tiers.Daily) {
+		return s.seriesByZonedDays(websiteID, timePoints, results)
+	}
+	return s.seriesByDailyBuckets(websiteID, timePoints, results)
+}
+
+func (s *postgresStats) seriesByHourlyBuckets(
+	websiteID string, timePoints []time.Time, results []SeriesPoint) ([]SeriesPoint, error) {
+
+	bucketIndex := make(map[int64]int, len(timePoints))
+	startBucket := hourBucket(timePoints[0])
+	endBucket := hourBucket(timePoints[len(timePoints)-1])
+	for i, point := range timePoints {
+		bucketIndex[hourBucket(point)] = i
+	}
+
+	rows, err := s.db().Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT bucket, pv FROM "%s_agg_hourly" WHERE bucket >= ? AND bucket <= ?`,
+		websiteID,
+	)), startBucket, endBucket)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bucket int64
+		var pv int
+		if err := rows.Scan(&bucket, &pv); err != nil {
+			return results, err
+		}
+		if idx, ok := bucketIndex[bucket]; ok {
+			results[idx].PV = pv
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return results, err
+	}
+
+	if UVApproximate(websiteID) {
+		sketches, err := s.hourlyUVSketches(websiteID, startBucket, endBucket)
+		if err != nil {
+			return results, err
+		}
+		for bucket, sketch := range sketches {
+			if idx, ok := bucketIndex[bucket]; ok {
+				results[idx].UV = int(sketch.Estimate())
+			}
+		}
+		return results, nil
+	}
+
+	uvRows, err := s.db().Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT bucket, COUNT(*) FROM "%s_agg_hourly_ip" WHERE bucket >= ? AND bucket <= ? GROUP BY bucket`,
+		websiteID,
+	)), startBucket, endBucket)
+	if err != nil {
+		return results, err
+	}
+	defer uvRows.Close()
+	for uvRows.Next() {
+		var bucket int64
+		var uv int
+		if err := uvRows.Scan(&bucket, &uv); err != nil {
+			return results, err
+		}
+		if idx, ok := bucketIndex[bucket]; ok {
+			results[idx].UV = uv
+		}
+	}
+	return results, uvRows.Err()
+}
+
+func (s *postgresStats) seriesByDailyBuckets(
+	websiteID string, timePoints []time.Time, results []SeriesPoint) ([]SeriesPoint, error) {
+
+	dayIndex := make(map[string]int, len(timePoints))
+	startDay := dayBucket(timePoints[0])
+	endDay := dayBucket(timePoints[len(timePoints)-1])
+	for i, point := range timePoints {
+		dayIndex[dayBucket(point)] = i
+	}
+
+	rows, err := s.db().Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT day, pv FROM "%s_agg_daily" WHERE day >= ? AND day <= ?`,
+		websiteID,
+	)), startDay, endDay)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day time.Time
+		var pv int
+		if err := rows.Scan(&day, &pv); err != nil {
+			return results, err
+		}
+		if idx, ok := dayIndex[day.Format("2006-01-02")]; ok {
+			results[idx].PV = pv
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return results, err
+	}
+
+	if UVApproximate(websiteID) {
+		sketches, err := s.dailyUVSketches(websiteID, startDay, endDay)
+		if err != nil {
+			return results, err
+		}
+		for day, sketch := range sketches {
+			if idx, ok := dayIndex[day]; ok {
+				results[idx].UV = int(sketch.Estimate())
+			}
+		}
+		return results, nil
+	}
+
+	uvRows, err := s.db().Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT day, COUNT(*) FROM "%s_agg_daily_ip" WHERE day >= ? AND day <= ? GROUP BY day`,
+		websiteID,
+	)), startDay, endDay)
+	if err != nil {
+		return results, err
+	}
+	defer uvRows.Close()
+	for uvRows.Next() {
+		var day time.Time
+		var uv int
+		if err := uvRows.Scan(&day, &uv); err != nil {
+			return results, err
+		}
+		if idx, ok := dayIndex[day.Format("2006-01-02")]; ok {
+			results[idx].UV = uv
+		}
+	}
+	return results, uvRows.Err()
+}
+
+// seriesByZonedDays 用小时聚合表按时间点所在时区的自然日汇总，夏令时切换日按实际 23/25 小时计算
+func (s *postgresStats) seriesByZonedDays(
+	websiteID string, timePoints []time.Time, results []SeriesPoint) ([]SeriesPoint, error) {
+
+	loc := timePoints[0].Location()
+	dayIndex := make(map[string]int, len(timePoints))
+	for i, point := range timePoints {
+		dayIndex[point.In(loc).Format("2006-01-02")] = i
+	}
+	startBucket, endBucket := zonedDayBounds(timePoints)
+	dayExpr := `to_char(to_timestamp(bucket) AT TIME ZONE ?, 'YYYY-MM-DD')`
+
+	rows, err := s.db().Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT %[2]s AS day, SUM(pv) FROM "%[1]s_agg_hourly"
+		WHERE bucket >= ? AND bucket < ? GROUP BY day`,
+		websiteID, dayExpr,
+	)), loc.String(), startBucket, endBucket)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day string
+		var pv int
+		if err := rows.Scan(&day, &pv); err != nil {
+			return results, err
+		}
+		if idx, ok := dayIndex[day]; ok {
+			results[idx].PV = pv
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return results, err
+	}
+
+	if UVApproximate(websiteID) {
+		// 按该时区把小时草图归入自然日后合并；草图表的范围是闭区间，结束桶取前一小时
+		sketches, err := s.hourlyUVSketches(websiteID, startBucket, endBucket-3600)
+		if err != nil {
+			return results, err
+		}
+		merged := make(map[string]*hll.Sketch, len(timePoints))
+		for bucket, sketch := range sketches {
+			day := time.Unix(bucket, 0).In(loc).Format("2006-01-02")
+			if merged[day] == nil {
+				merged[day] = hll.New()
+			}
+			if err := merged[day].Merge(sketch); err != nil {
+				return results, err
+			}
+		}
+		for day, sketch := range merged {
+			if idx, ok := dayIndex[day]; ok {
+				results[idx].UV = int(sketch.Estimate())
+			}
+		}
+		return results, nil
+	}
+
+	uvRows, err := s.db().Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT %[2]s AS day, COUNT(DISTINCT ip_id) FROM "%[1]s_agg_hourly_ip"
+		WHERE bucket >= ? AND bucket < ? GROUP BY day`,
+		websiteID, dayExpr,
+	)), loc.String(), startBucket, endBucket)
+	if err != nil {
+		return results, err
+	}
+	defer uvRows.Close()
+	for uvRows.Next() {
+		var day string
+		var uv int
+		if err := uvRows.Scan(&day, &uv); err != nil {
+			return results, err
+		}
+		if idx, ok := dayIndex[day]; ok {
+			results[idx].UV = uv
+		}
+	}
+	return results, uvRows.Err()
+}
+
+// zonedDayBounds 返回时间点所在时区中首日零点到末日次日零点的 Unix 秒区间
+func zonedDayBounds(timePoints []time.Time) (int64, int64) {
+	loc := timePoints[0].Location()
+	first := timePoints[0].In(loc)
+	last := timePoints[len(timePoints)-1].In(loc)
+	start := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc)
+	end := time.Date(last.Year(), last.Month(), last.Day()+1, 0, 0, 0, 0, loc)
+	return start.Unix(), end.Unix()
+}
+
+func (s *postgresStats) ActiveVisitors(websiteID string, r TimeRange) (int, error) {
+	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
+        SELECT COUNT(DISTINCT ip_id)
+        FROM "%s_nginx_logs"
+        WHERE pageview_flag = 1 AND timestamp >= ? AND timestamp < ?`,
+		websiteID))
+
+	var count int
+	if err := s.db().QueryRow(query, r.Start, r.End).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *postgresStats) VisitorBuckets(websiteID string, r TimeRange, step int64) (map[int64]int, error) {
+	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
+        SELECT (timestamp / ?) as bucket, COUNT(DISTINCT ip_id) as uv
+        FROM "%s_nginx_logs"
+        WHERE pageview_flag = 1 AND timestamp >= ? AND timestamp < ?
+        GROUP BY bucket`,
+		websiteID))
+
+	rows, err := s.db().Query(query, step, r.Start, r.End)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := make(map[int64]int)
+	for rows.Next() {
+		var bucket int64
+		var uv int
+		if err := rows.Scan(&bucket, &uv); err != nil {
+			return nil, err
+		}
+		buckets[bucket] = uv
+	}
+	return buckets, rows.Err()
+}
+
+func (s *postgresStats) SessionMetrics(websiteID string, startTime, endTime time.Time) (SessionMetrics, error) {
+	empty := SessionMetrics{EntryCounts: make(map[string]int)}
+	hasSessionAgg, err := s.repo.tableExists(fmt.Sprintf("%s_agg_session_daily", websiteID))
+	if err != nil {
+		return empty, err
+	}
+	hasEntryAgg, err := s.repo.tableExists(fmt.Sprintf("%s_agg_entry_daily", websiteID))
+	if err != nil {
+		return empty, err
+	}
+	// 会话聚合按服务器本地日存储，区间未对齐时直接查会话明细；会话明细已过保留期时退回会话日聚合
+	tiers := RetentionTiersFor(websiteID)
+	if hasSessionAgg && hasEntryAgg &&
+		(alignedToServerDays(startTime, endTime) || useCoarserTier(startTime, tiers.Sessions, tiers.Daily)) {
+		return s.sessionMetricsFromAggregates(websiteID, startTime, endTime)
+	}
+
+	exists, err := s.repo.tableExists(fmt.Sprintf("%s_sessions", websiteID))
+	if err != nil {
+		return empty, err
+	}
+	if !exists {
+		return sessionMetricsFromPageviews(s, websiteID, startTime, endTime)
+	}
+	return s.sessionMetricsFromSessions(websiteID, startTime, endTime)
+}
+
+func (s *postgresStats) sessionMetricsFromAggregates(
+	websiteID string, startTime, endTime time.Time,
+) (SessionMetrics, error) {
+	metrics := SessionMetrics{EntryCounts: make(map[string]int)}
+	startDay := dayBucket(startTime)
+	endDay := dayBucket(endTime)
+
+	row := s.db().QueryRow(
+		sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`SELECT COALESCE(SUM(sessions), 0) FROM "%s_agg_session_daily" WHERE day >= ? AND day <= ?`, websiteID,
+		)),
+		startDay, endDay,
+	)
+	if err := row.Scan(&metrics.SessionCount); err != nil {
+		return metrics, err
+	}
+
+	err := s.scanEntryCounts(metrics.EntryCounts, fmt.Sprintf(
+		`SELECT u.url, SUM(e.count)
+         FROM "%[1]s_agg_entry_daily" e
+         JOIN "%[1]s_dim_url" u ON u.id = e.entry_url_id
+         WHERE e.day >= ? AND e.day <= ?
+         GROUP BY e.entry_url_id, u.url`,
+		websiteID,
+	), startDay, endDay)
+	return metrics, err
+}
+
+func (s *postgresStats) sessionMetricsFromSessions(
+	websiteID string, startTime, endTime time.Time,
+) (SessionMetrics, error) {
+	metrics := SessionMetrics{EntryCounts: make(map[string]int)}
+
+	row := s.db().QueryRow(
+		sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`SELECT COUNT(*) FROM "%s_sessions" WHERE start_ts >= ? AND start_ts < ?`, websiteID,
+		)),
+		startTime.Unix(), endTime.Unix(),
+	)
+	if err := row.Scan(&metrics.SessionCount); err != nil {
+		return metrics, err
+	}
+
+	err := s.scanEntryCounts(metrics.EntryCounts, fmt.Sprintf(
+		`SELECT u.url, COUNT(*)
+         FROM "%[1]s_sessions" s
+         JOIN "%[1]s_dim_url" u ON u.id = s.entry_url_id
+         WHERE s.start_ts >= ? AND s.start_ts < ?
+         GROUP BY s.entry_url_id, u.url`,
+		websiteID,
+	), startTime.Unix(), endTime.Unix())
+	return metrics, err
+}
+
+// scanEntryCounts 读取 (入口页, 会话数) 结果写入 counts
+func (s *postgresStats) scanEntryCounts(counts map[string]int, query string, args ...interface{}) error {
+	rows, err := s.db().Query(sqlutil.ReplacePlaceholders(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			url   string
+			count int
+		)
+		if err := rows.Scan(&url, &count); err != nil {
+			return err
+		}
+		counts[url] = count
+	}
+	return rows.Err()
+}
+
+// sessionMetricsFromPageviews 没有会话表时按浏览记录即时切分会话
+func sessionMetricsFromPageviews(
+	querier StatsQuerier, websiteID string, startTime, endTime time.Time,
+) (SessionMetrics, error) {
+	metrics := SessionMetrics{EntryCounts: make(map[string]int)}
+	var (
+		currentVisitor string
+		lastTimestamp  int64
+		initialized    bool
+	)
+	filter := LogFilter{Start: startTime.Unix(), End: endTime.Unix(), PageviewOnly: true}
+	err := querier.ScanPageviews(websiteID, filter, func(row PageviewRow) error {
+		if !initialized || row.Visitor != currentVisitor || row.Timestamp-lastTimestamp > sessionGapSeconds {
+			currentVisitor = row.Visitor
+			metrics.SessionCount++
+			metrics.EntryCounts[row.URL]++
+			initialized = true
+		}
+		lastTimestamp = row.Timestamp
+		return nil
+	})
+	return metrics, err
+}
+
+func (s *postgresStats) TrafficAnomalies(websiteID string, start, end int64) ([]TrafficAnomaly, error) {
+	return s.repo.ListTrafficAnomalies(websiteID, start, end)
+}
+
+// hourlyUVSketches 读取 [start, end] 内各小时桶的 UV 草图
+func (s *postgresStats) hourlyUVSketches(websiteID string, start, end int64) (map[int64]*hll.Sketch, error) {
+	sketches := make(map[int64]*hll.Sketch)
+	err := s.scanUVSketches(UVSketchTable(websiteID, "hourly"), "bucket", start, end, func(rows *sql.Rows) error {
+		var bucket int64
+		var raw []byte
+		if err := rows.Scan(&bucket, &raw); err != nil {
+			return err
+		}
+		sketch, err := hll.Decode(raw)
+		if err != nil {
+			return err
+		}
+		sketches[bucket] = sketch
+		return nil
+	})
+	return sketches, err
+}
+
+// dailyUVSketches 读取 [startDay, endDay] 内各日的 UV 草图，键为 YYYY-MM-DD
+func (s *postgresStats) dailyUVSketches(websiteID, startDay, endDay string) (map[string]*hll.Sketch, error) {
+	sketches := make(map[string]*hll.Sketch)
+	err := s.scanUVSketches(UVSketchTable(websiteID, "daily"), "day", startDay, endDay, func(rows *sql.Rows) error {
+		var day time.Time
+		var raw []byte
+		if err := rows.Scan(&day, &raw); err != nil {
+			return err
+		}
+		sketch, err := hll.Decode(raw)
+		if err != nil {
+			return err
+		}
+		sketches[day.Format("2006-01-02")] = sketch
+		return nil
+	})
+	return sketches, err
+}
+
+// mergedUV 合并聚合区间内所有桶的草图后估算 UV
+func (s *postgresStats) mergedUV(websiteID string, agg aggRange) (int, error) {
+	merged := hll.New()
+	err := s.scanUVSketches(UVSketchTable(websiteID, agg.suffix), agg.column, agg.start, agg.end, func(rows *sql.Rows) error {
+		var key interface{}
+		var raw []byte
+		if err := rows.Scan(&key, &raw); err != nil {
+			return err
+		}
+		sketch, err := hll.Decode(raw)
+		if err != nil {
+			return err
+		}
+		return merged.Merge(sketch)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(merged.Estimate()), nil
+}
+
+// scanUVSketches 逐行读取草图表 [start, end] 内的记录，每行 (键, uv_sketch) 交给 scan 处理
+func (s *postgresStats) scanUVSketches(
+	table, column string, start, end interface{},
+	scan func(rows *sql.Rows) error,
+) error {
+	rows, err := s.db().Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT %[2]s, uv_sketch FROM "%[1]s" WHERE %[2]s >= ? AND %[2]s <= ?`, table, column,
+	)), start, end)
+	if err != nil {
+		return fmt.Errorf("查询UV草图失败: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return fmt.Errorf("解析UV草图失败: %v", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("遍历UV草图失败: %v", err)
+	}
+	return nil
+}
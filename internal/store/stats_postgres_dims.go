@@ -0,0 +1,435 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+	"github.com/likaia/nginxpulse/internal/store/hll"
+)
+
+// pgDimension 维度在 Postgres 上的维表、别名、分组表达式与附加过滤条件
+type pgDimension struct {
+	dim     string // 维表后缀：url / referer / ua / location
+	alias   string
+	keyExpr string
+	filter  string // 以 " AND " 开头
+}
+
+// rawJoin 原始日志表 l 关联维表的子句
+func (d pgDimension) rawJoin(websiteID string) string {
+	return fmt.Sprintf(`JOIN "%[1]s_dim_%[2]s" %[3]s ON %[3]s.id = l.%[2]s_id`, websiteID, d.dim, d.alias)
+}
+
+// rollupJoin 按日维度聚合表 a 关联维表的子句，别名与原始日志查询一致
+func (d pgDimension) rollupJoin(websiteID string) string {
+	return fmt.Sprintf(`JOIN "%[1]s_dim_%[2]s" %[3]s ON %[3]s.id = a.dim_id`, websiteID, d.dim, d.alias)
+}
+
+func pgDimensionFor(websiteID string, query DimensionQuery) (pgDimension, error) {
+	var d pgDimension
+	switch query.Dimension {
+	case DimensionURL:
+		d = pgDimension{dim: "url", alias: "u", keyExpr: "u.url"}
+	case DimensionReferer, DimensionRefererHost, DimensionRefererSource, DimensionRefererKeyword, DimensionChannel:
+		d = pgDimension{dim: "referer", alias: "r"}
+		d.keyExpr, d.filter = refererKeyExpr(query.Dimension, internalRefererCondition(websiteID, "r.referer"), "r.")
+	case DimensionBrowser:
+		d = pgDimension{dim: "ua", alias: "ua", keyExpr: "ua.browser"}
+	case DimensionOS:
+		d = pgDimension{dim: "ua", alias: "ua", keyExpr: "ua.os"}
+	case DimensionDevice:
+		d = pgDimension{dim: "ua", alias: "ua", keyExpr: "ua.device"}
+	case DimensionProvince:
+		d = pgDimension{dim: "location", alias: "loc",
+			keyExpr: "CASE WHEN position('·' in loc.domestic) > 0 THEN substring(loc.domestic from 1 for position('·' in loc.domestic) - 1) ELSE loc.domestic END"}
+	case DimensionCity:
+		d = pgDimension{dim: "location", alias: "loc",
+			keyExpr: "CASE WHEN position('·' in loc.domestic) > 0 THEN substring(loc.domestic from position('·' in loc.domestic) + 1) ELSE loc.domestic END"}
+	case DimensionCountry:
+		d = pgDimension{dim: "location", alias: "loc", keyExpr: "loc.global"}
+	default:
+		return d, fmt.Errorf("不支持的统计维度: %s", query.Dimension)
+	}
+	if query.DomesticOnly {
+		if d.dim != "location" {
+			return d, fmt.Errorf("维度 %s 不支持只统计国内", query.Dimension)
+		}
+		d.filter += " AND loc.global = '中国'"
+	}
+	return d, nil
+}
+
+func (s *postgresStats) TopDimension(websiteID string, query DimensionQuery) (DimensionResult, error) {
+	result := DimensionResult{Rows: make([]DimensionRow, 0)}
+	dim, err := pgDimensionFor(websiteID, query)
+	if err != nil {
+		return result, err
+	}
+
+	useRollup, err := s.canUseRollup(websiteID, dim, query)
+	if err != nil {
+		return result, err
+	}
+	if useRollup {
+		return s.topDimensionFromRollup(websiteID, dim, query)
+	}
+	if query.Compare != nil {
+		return s.topDimensionWithCompare(websiteID, dim, query)
+	}
+
+	orderBy := "uv DESC"
+	if query.OrderBy == MetricPV {
+		orderBy = "pv DESC"
+	}
+	args := []interface{}{query.Start.Unix(), query.End.Unix()}
+	dbQueryStr := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
+        SELECT
+            %[1]s AS grp_key,
+            COALESCE(SUM(l.sample_rate), 0) AS pv,
+            COUNT(DISTINCT l.ip_id) AS uv
+        FROM "%[2]s_nginx_logs" l
+        %[3]s
+        WHERE l.pageview_flag = 1 AND l.timestamp >= ? AND l.timestamp < ?%[4]s
+        GROUP BY %[1]s
+        ORDER BY %[5]s%[6]s`,
+		dim.keyExpr, websiteID, dim.rawJoin(websiteID), dim.filter, orderBy, limitClause(query.Limit, &args)))
+
+	rows, err := s.db().Query(dbQueryStr, args...)
+	if err != nil {
+		return result, fmt.Errorf("查询维度统计失败: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row DimensionRow
+		if err := rows.Scan(&row.Key, &row.CurPV, &row.CurUV); err != nil {
+			return result, fmt.Errorf("解析维度统计结果失败: %v", err)
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("遍历维度统计结果失败: %v", err)
+	}
+	return result, nil
+}
+
+// limitClause limit 不小于 0 时返回 LIMIT 子句并追加参数
+func limitClause(limit int, args *[]interface{}) string {
+	if limit < 0 {
+		return ""
+	}
+	*args = append(*args, limit)
+	return "\n        LIMIT ?"
+}
+
+// topDimensionWithCompare 同时统计当前区间与对比区间，两边按分组键全外连接，
+// 这样当前区间已消失的条目也能出现在结果中（当前值为 0）
+func (s *postgresStats) topDimensionWithCompare(
+	websiteID string, dim pgDimension, query DimensionQuery,
+) (DimensionResult, error) {
+	result := DimensionResult{Rows: make([]DimensionRow, 0)}
+
+	orderBy := "cur_uv DESC, prev_uv DESC"
+	switch query.CompareSort {
+	case "decline":
+		orderBy = "cur_uv - prev_uv ASC, prev_uv DESC"
+	case "growth":
+		orderBy = "cur_uv - prev_uv DESC, cur_uv DESC"
+	}
+
+	periodQuery := fmt.Sprintf(`
+            SELECT
+                %[1]s AS grp_key,
+                COALESCE(SUM(l.sample_rate), 0) AS pv,
+                COUNT(DISTINCT l.ip_id) AS uv
+            FROM "%[2]s_nginx_logs" l
+            %[3]s
+            WHERE l.pageview_flag = 1 AND l.timestamp >= ? AND l.timestamp < ?%[4]s
+            GROUP BY %[1]s`,
+		dim.keyExpr, websiteID, dim.rawJoin(websiteID), dim.filter)
+
+	args := []interface{}{query.Start.Unix(), query.End.Unix(), query.Compare.Start, query.Compare.End}
+	dbQueryStr := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
+        WITH cur AS (%[1]s),
+        prev AS (%[1]s)
+        SELECT grp_key, cur_pv, cur_uv, prev_pv, prev_uv
+        FROM (
+            SELECT
+                COALESCE(cur.grp_key, prev.grp_key) AS grp_key,
+                COALESCE(cur.pv, 0) AS cur_pv,
+                COALESCE(cur.uv, 0) AS cur_uv,
+                COALESCE(prev.pv, 0) AS prev_pv,
+                COALESCE(prev.uv, 0) AS prev_uv
+            FROM cur
+            FULL OUTER JOIN prev ON prev.grp_key = cur.grp_key
+        ) merged
+        ORDER BY %[2]s%[3]s`, periodQuery, orderBy, limitClause(query.Limit, &args)))
+
+	rows, err := s.db().Query(dbQueryStr, args...)
+	if err != nil {
+		return result, fmt.Errorf("查询对比统计失败: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row DimensionRow
+		if err := rows.Scan(&row.Key, &row.CurPV, &row.CurUV, &row.PrevPV, &row.PrevUV); err != nil {
+			return result, fmt.Errorf("解析对比统计结果失败: %v", err)
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("遍历对比统计结果失败: %v", err)
+	}
+	return result, nil
+}
+
+// rollupCovers 区间按服务器自然日对齐，或原始日志已不覆盖起点而按日聚合保留得更久时，可改读维度聚合表
+func rollupCovers(websiteID string, startTime, endTime time.Time) bool {
+	if alignedToServerDays(startTime, endTime) {
+		return true
+	}
+	tiers := RetentionTiersFor(websiteID)
+	return useCoarserTier(startTime, tiers.Raw, tiers.Daily)
+}
+
+// canUseRollup 当前区间（以及对比区间）都能由维度聚合表回答且表已存在；
+// 聚合表只能按 UV 排序，按 PV 排行时始终查原始日志
+func (s *postgresStats) canUseRollup(websiteID string, dim pgDimension, query DimensionQuery) (bool, error) {
+	if query.OrderBy == MetricPV || !rollupCovers(websiteID, query.Start, query.End) {
+		return false, nil
+	}
+	if query.Compare != nil {
+		loc := query.Start.Location()
+		if !rollupCovers(websiteID, time.Unix(query.Compare.Start, 0).In(loc), time.Unix(query.Compare.End, 0).In(loc)) {
+			return false, nil
+		}
+	}
+	return s.repo.tableExists(DimAggregateTable(websiteID, dim.dim))
+}
+
+// rollupGroup 单个分组在区间内的 PV 与合并后的 UV 草图
+type rollupGroup struct {
+	pv     int
+	sketch *hll.Sketch
+}
+
+// topDimensionFromRollup 从按日维度聚合表统计，UV 由各天的 HLL 草图合并估算；
+// 排序与截断规则和原始日志查询保持一致
+func (s *postgresStats) topDimensionFromRollup(
+	websiteID string, dim pgDimension, query DimensionQuery,
+) (DimensionResult, error) {
+	result := DimensionResult{Rows: make([]DimensionRow, 0)}
+
+	cur, err := s.rollupPeriod(websiteID, dim, query.Start, query.End)
+	if err != nil {
+		return result, err
+	}
+	merged := make(map[string]*DimensionRow, len(cur))
+	for key, group := range cur {
+		merged[key] = &DimensionRow{Key: key, CurPV: group.pv, CurUV: int(group.sketch.Estimate())}
+	}
+	if query.Compare != nil {
+		loc := query.Start.Location()
+		prev, err := s.rollupPeriod(
+			websiteID, dim,
+			time.Unix(query.Compare.Start, 0).In(loc), time.Unix(query.Compare.End, 0).In(loc),
+		)
+		if err != nil {
+			return result, err
+		}
+		for key, group := range prev {
+			row := merged[key]
+			if row == nil {
+				row = &DimensionRow{Key: key}
+				merged[key] = row
+			}
+			row.PrevPV = group.pv
+			row.PrevUV = int(group.sketch.Estimate())
+		}
+	}
+
+	for _, row := range merged {
+		result.Rows = append(result.Rows, *row)
+	}
+	result.Rows = sortDimensionRows(result.Rows, query)
+	relativeError := hll.New().RelativeError()
+	result.UVRelativeError = &relativeError
+	return result, nil
+}
+
+// rollupPeriod 读取区间内各天的聚合行，按分组键累加 PV 并合并 UV 草图；
+// 只有非 pageview 请求的行 pv 为 0，与原始日志查询一样不参与统计
+func (s *postgresStats) rollupPeriod(
+	websiteID string, dim pgDimension, startTime, endTime time.Time,
+) (map[string]*rollupGroup, error) {
+	dbQueryStr := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
+        SELECT %[1]s AS grp_key, a.pv, a.uv_sketch
+        FROM "%[2]s" a
+        %[3]s
+        WHERE a.day >= ? AND a.day <= ? AND a.pv > 0%[4]s`,
+		dim.keyExpr, DimAggregateTable(websiteID, dim.dim), dim.rollupJoin(websiteID), dim.filter))
+
+	rows, err := s.db().Query(dbQueryStr, dayBucket(startTime), dayBucket(endTime))
+	if err != nil {
+		return nil, fmt.Errorf("查询维度聚合统计失败: %v", err)
+	}
+	defer rows.Close()
+
+	groups := make(map[string]*rollupGroup)
+	for rows.Next() {
+		var key string
+		var pv int
+		var raw []byte
+		if err := rows.Scan(&key, &pv, &raw); err != nil {
+			return nil, fmt.Errorf("解析维度聚合统计结果失败: %v", err)
+		}
+		sketch, err := hll.Decode(raw)
+		if err != nil {
+			return nil, fmt.Errorf("解析UV草图失败: %v", err)
+		}
+		group := groups[key]
+		if group == nil {
+			group = &rollupGroup{sketch: hll.New()}
+			groups[key] = group
+		}
+		group.pv += pv
+		if err := group.sketch.Merge(sketch); err != nil {
+			return nil, fmt.Errorf("合并UV草图失败: %v", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("遍历维度聚合统计结果失败: %v", err)
+	}
+	return groups, nil
+}
+
+// sortDimensionRows 与 SQL 查询相同的排序与截断：默认按 UV（或 PV）降序，
+// 对比模式支持 decline / growth，最后按键排序保证稳定
+func sortDimensionRows(rows []DimensionRow, query DimensionQuery) []DimensionRow {
+	compare := query.Compare != nil
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		keys := []int{-a.CurUV, -b.CurUV}
+		if !compare && query.OrderBy == MetricPV {
+			keys = []int{-a.CurPV, -b.CurPV}
+		}
+		if compare {
+			switch query.CompareSort {
+			case "decline":
+				keys = []int{a.CurUV - a.PrevUV, b.CurUV - b.PrevUV, -a.PrevUV, -b.PrevUV}
+			case "growth":
+				keys = []int{a.PrevUV - a.CurUV, b.PrevUV - b.CurUV, -a.CurUV, -b.CurUV}
+			default:
+				keys = []int{-a.CurUV, -b.CurUV, -a.PrevUV, -b.PrevUV}
+			}
+		}
+		for k := 0; k < len(keys); k += 2 {
+			if keys[k] != keys[k+1] {
+				return keys[k] < keys[k+1]
+			}
+		}
+		return a.Key < b.Key
+	})
+	if query.Limit >= 0 && len(rows) > query.Limit {
+		rows = rows[:query.Limit]
+	}
+	return rows
+}
+
+// refererKeyExpr 返回来源类维度的分组表达式与附加过滤条件，prefix 为来源列所在表的别名前缀；
+// 直接访问与站内访问始终单独归类，站内判断依赖站点域名，因此在查询时计算
+func refererKeyExpr(dimension Dimension, internalCond, prefix string) (string, string) {
+	directCond := fmt.Sprintf("%[1]sreferer = '-' OR %[1]sreferer = ''", prefix)
+
+	switch dimension {
+	case DimensionChannel:
+		if internalCond != "" {
+			return fmt.Sprintf(
+				"CASE WHEN %[1]s THEN 'direct' WHEN %[2]s THEN 'internal' WHEN %[3]schannel = '' THEN 'other' ELSE %[3]schannel END",
+				directCond, internalCond, prefix,
+			), ""
+		}
+		return fmt.Sprintf(
+			"CASE WHEN %[1]s THEN 'direct' WHEN %[2]schannel = '' THEN 'other' ELSE %[2]schannel END",
+			directCond, prefix,
+		), ""
+	case DimensionRefererKeyword:
+		// 关键词只对带搜索词的来源有意义，其余来源不参与统计
+		return prefix + "keyword", fmt.Sprintf(" AND %skeyword <> ''", prefix)
+	case DimensionRefererSource:
+		return refererCaseExpr(directCond, internalCond, fmt.Sprintf(
+			"CASE WHEN %[1]ssource <> '' THEN %[1]ssource WHEN %[1]shost <> '' THEN %[1]shost ELSE %[1]sreferer END", prefix,
+		)), ""
+	case DimensionRefererHost:
+		return refererCaseExpr(directCond, internalCond, fmt.Sprintf(
+			"CASE WHEN %[1]shost <> '' THEN %[1]shost ELSE %[1]sreferer END", prefix,
+		)), ""
+	default:
+		return refererCaseExpr(directCond, internalCond, prefix+"referer"), ""
+	}
+}
+
+func refererCaseExpr(directCond, internalCond, valueExpr string) string {
+	if internalCond != "" {
+		return fmt.Sprintf(
+			"CASE WHEN %s THEN '直接输入网址访问' WHEN %s THEN '站内访问' ELSE %s END",
+			directCond, internalCond, valueExpr,
+		)
+	}
+	return fmt.Sprintf("CASE WHEN %s THEN '直接输入网址访问' ELSE %s END", directCond, valueExpr)
+}
+
+// internalRefererCondition 来源指向站点自身域名的条件，站点未配置域名时为空
+func internalRefererCondition(websiteID, refererColumn string) string {
+	website, ok := config.GetWebsiteByID(websiteID)
+	if !ok {
+		return ""
+	}
+	conditions := make([]string, 0, len(website.Domains))
+	for _, domain := range siteDomains(website.Domains) {
+		domain = strings.ReplaceAll(domain, "'", "''")
+		conditions = append(conditions,
+			fmt.Sprintf(
+				"%[1]s LIKE 'http%%://%[2]s/%%' OR %[1]s LIKE 'http%%://%[2]s' OR %[1]s LIKE 'http%%://%[2]s:%%'",
+				refererColumn, domain,
+			),
+		)
+	}
+	if len(conditions) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("(%s)", strings.Join(conditions, " OR "))
+}
+
+// siteDomains 规范化站点配置的域名，去掉协议与末尾斜杠并跳过空值
+func siteDomains(raw []string) []string {
+	domains := make([]string, 0, len(raw))
+	for _, item := range raw {
+		if domain := normalizeDomain(item); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+func normalizeDomain(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return ""
+	}
+	if strings.Contains(raw, "://") {
+		parsed, err := url.Parse(raw)
+		if err == nil && parsed.Host != "" {
+			return strings.TrimSuffix(parsed.Host, "/")
+		}
+	}
+	raw = strings.TrimPrefix(raw, "//")
+	raw = strings.TrimSuffix(raw, "/")
+	return raw
+}
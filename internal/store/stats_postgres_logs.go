@@ -0,0 +1,306 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+)
+
+// logDimJoins 原始日志表 l 关联全部维表
+func logDimJoins(websiteID string) string {
+	return fmt.Sprintf(`
+        JOIN "%[1]s_dim_ip" ip ON ip.id = l.ip_id
+        JOIN "%[1]s_dim_url" u ON u.id = l.url_id
+        JOIN "%[1]s_dim_referer" r ON r.id = l.referer_id
+        JOIN "%[1]s_dim_ua" ua ON ua.id = l.ua_id
+        JOIN "%[1]s_dim_location" loc ON loc.id = l.location_id`, websiteID)
+}
+
+// logColumn 日志字段在关联查询中的列表达式
+func logColumn(name string) string {
+	switch name {
+	case "ip":
+		return "ip.ip"
+	case "url":
+		return "u.url"
+	case "raw_url":
+		return "COALESCE(l.raw_url, '')"
+	case "referer":
+		return "r.referer"
+	case "user_browser":
+		return "ua.browser"
+	case "user_os":
+		return "ua.os"
+	case "user_device":
+		return "ua.device"
+	case "domestic_location":
+		return "loc.domestic"
+	case "global_location":
+		return "loc.global"
+	default:
+		return "l." + name
+	}
+}
+
+// logConditions 把过滤条件转换为 WHERE 子句片段与参数
+func logConditions(filter LogFilter) ([]string, []interface{}) {
+	conditions := make([]string, 0, 4)
+	args := make([]interface{}, 0, 4)
+	like := func(value string) string { return "%" + value + "%" }
+
+	if filter.Keyword != "" {
+		conditions = append(conditions, fmt.Sprintf("(%s LIKE ? OR %s LIKE ? OR %s LIKE ? OR %s LIKE ?)",
+			logColumn("url"), logColumn("ip"), logColumn("referer"), logColumn("domestic_location")))
+		arg := like(filter.Keyword)
+		args = append(args, arg, arg, arg, arg)
+	}
+	if filter.Start > 0 {
+		conditions = append(conditions, "l.timestamp >= ?")
+		args = append(args, filter.Start)
+	}
+	if filter.End > 0 {
+		conditions = append(conditions, "l.timestamp < ?")
+		args = append(args, filter.End)
+	}
+	if filter.IP != "" {
+		conditions = append(conditions, fmt.Sprintf("%s LIKE ?", logColumn("ip")))
+		args = append(args, like(filter.IP))
+	}
+	if filter.Location != "" {
+		conditions = append(conditions, fmt.Sprintf("(%s LIKE ? OR %s LIKE ?)",
+			logColumn("domestic_location"), logColumn("global_location")))
+		arg := like(filter.Location)
+		args = append(args, arg, arg)
+	}
+	if filter.URL != "" {
+		conditions = append(conditions, fmt.Sprintf("%s LIKE ?", logColumn("url")))
+		args = append(args, like(filter.URL))
+	}
+	if filter.Device != "" {
+		conditions = append(conditions, fmt.Sprintf("%s LIKE ?", logColumn("user_device")))
+		args = append(args, like(filter.Device))
+	}
+	if filter.Browser != "" {
+		conditions = append(conditions, fmt.Sprintf("%s LIKE ?", logColumn("user_browser")))
+		args = append(args, like(filter.Browser))
+	}
+	if filter.OS != "" {
+		conditions = append(conditions, fmt.Sprintf("%s LIKE ?", logColumn("user_os")))
+		args = append(args, like(filter.OS))
+	}
+	if filter.StatusCode > 0 {
+		conditions = append(conditions, "l.status_code = ?")
+		args = append(args, filter.StatusCode)
+	} else if low, high, ok := statusClassRange(filter.StatusClass); ok {
+		conditions = append(conditions, "l.status_code >= ? AND l.status_code < ?")
+		args = append(args, low, high)
+	}
+	if filter.ExcludeInternalIP {
+		clauses := make([]string, 0, len(internalIPPatterns))
+		for _, pattern := range internalIPPatterns {
+			if pattern == "::1" {
+				clauses = append(clauses, fmt.Sprintf("%s = ?", logColumn("ip")))
+			} else {
+				clauses = append(clauses, fmt.Sprintf("%s LIKE ?", logColumn("ip")))
+			}
+			args = append(args, pattern)
+		}
+		conditions = append(conditions, fmt.Sprintf("NOT (%s)", strings.Join(clauses, " OR ")))
+	}
+	if filter.ExcludeSpider {
+		conditions = append(conditions, fmt.Sprintf("%s <> ?", logColumn("user_device")))
+		args = append(args, spiderDeviceLabel)
+	}
+	if filter.ExcludeForeign {
+		conditions = append(conditions, fmt.Sprintf("(%s = ? OR LOWER(%s) = ?)",
+			logColumn("global_location"), logColumn("global_location")))
+		args = append(args, "中国", "china")
+	}
+	if filter.PageviewOnly {
+		conditions = append(conditions, "l.pageview_flag = 1")
+	}
+	return conditions, args
+}
+
+// statusClassRange 把 2xx / 3xx / 4xx / 5xx 转换为状态码的左闭右开区间
+func statusClassRange(class string) (int, int, bool) {
+	switch strings.ToLower(class) {
+	case "2xx":
+		return 200, 300, true
+	case "3xx":
+		return 300, 400, true
+	case "4xx":
+		return 400, 500, true
+	case "5xx":
+		return 500, 600, true
+	}
+	return 0, 0, false
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+func (s *postgresStats) ScanPageviews(websiteID string, filter LogFilter, fn func(PageviewRow) error) error {
+	filter.PageviewOnly = true
+	conditions, args := logConditions(filter)
+	query := sqlutil.ReplacePlaceholders(fmt.Sprintf(`
+        SELECT l.timestamp, l.ip_id, l.ua_id, ip.ip, ua.browser, ua.os, ua.device,
+               u.url, loc.domestic, loc.global
+        FROM "%s_nginx_logs" l%s%s
+        ORDER BY l.ip_id, l.ua_id, l.timestamp`,
+		websiteID, logDimJoins(websiteID), whereClause(conditions)))
+
+	rows, err := s.db().Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("查询浏览记录失败: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			row  PageviewRow
+			ipID int64
+			uaID int64
+		)
+		if err := rows.Scan(&row.Timestamp, &ipID, &uaID, &row.IP, &row.Browser, &row.OS, &row.Device,
+			&row.URL, &row.Domestic, &row.Global); err != nil {
+			return fmt.Errorf("解析浏览记录失败: %v", err)
+		}
+		row.Visitor = fmt.Sprintf("%d|%d", ipID, uaID)
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("遍历浏览记录失败: %v", err)
+	}
+	return nil
+}
+
+// logSelectFields 日志列表返回的字段，顺序与 LogRow 扫描顺序一致
+var logSelectFields = []string{
+	"id", "ip", "timestamp", "method", "url", "status_code",
+	"bytes_sent", "referer", "user_browser", "user_os", "user_device",
+	"domestic_location", "global_location", "pageview_flag", "raw_url",
+}
+
+// logSortColumns 允许排序的字段
+var logSortColumns = map[string]bool{
+	"timestamp": true, "ip": true, "url": true, "status_code": true, "bytes_sent": true,
+}
+
+func (s *postgresStats) ListLogs(websiteID string, query LogQuery) ([]LogRow, int, error) {
+	sortField := query.SortField
+	if !logSortColumns[sortField] {
+		sortField = "timestamp"
+	}
+	sortOrder := "ASC"
+	if query.SortDesc {
+		sortOrder = "DESC"
+	}
+	markNew := query.NewVisitor != ""
+	firstSeenJoin := fmt.Sprintf(`
+        LEFT JOIN "%s_first_seen" fs ON fs.ip_id = l.ip_id`, websiteID)
+
+	conditions, filterArgs := logConditions(query.Filter)
+	switch query.NewVisitor {
+	case "new":
+		conditions = append(conditions, "fs.first_ts >= ? AND fs.first_ts < ?")
+		filterArgs = append(filterArgs, query.NewSince, query.NewUntil)
+	case "returning":
+		conditions = append(conditions, "fs.first_ts < ?")
+		filterArgs = append(filterArgs, query.NewSince)
+	}
+
+	selectColumns := make([]string, 0, len(logSelectFields)+1)
+	for _, field := range logSelectFields {
+		selectColumns = append(selectColumns, fmt.Sprintf("%s AS %s", logColumn(field), field))
+	}
+	args := make([]interface{}, 0, len(filterArgs)+4)
+	joins := logDimJoins(websiteID)
+	if markNew {
+		selectColumns = append(selectColumns,
+			"CASE WHEN fs.first_ts >= ? AND fs.first_ts < ? THEN 1 ELSE 0 END AS is_new_visitor")
+		args = append(args, query.NewSince, query.NewUntil)
+		joins += firstSeenJoin
+	}
+	args = append(args, filterArgs...)
+	baseQuery := fmt.Sprintf(`
+        SELECT
+            %s
+        FROM "%s_nginx_logs" l%s%s`,
+		strings.Join(selectColumns, ", "), websiteID, joins, whereClause(conditions))
+
+	var listQuery string
+	if query.DistinctIP {
+		outerSelect := strings.Join(logSelectFields, ", ")
+		if markNew {
+			outerSelect += ", is_new_visitor"
+		}
+		listQuery = fmt.Sprintf(`
+        WITH base AS (%s
+        )
+        SELECT %s FROM (
+            SELECT base.*, ROW_NUMBER() OVER (PARTITION BY ip ORDER BY timestamp DESC, id DESC) AS rn
+            FROM base
+        )
+        WHERE rn = 1 ORDER BY %s %s LIMIT ? OFFSET ?`,
+			baseQuery, outerSelect, sortField, sortOrder)
+	} else {
+		listQuery = fmt.Sprintf("%s ORDER BY %s %s LIMIT ? OFFSET ?", baseQuery, logColumn(sortField), sortOrder)
+	}
+	args = append(args, query.Limit, query.Offset)
+
+	rows, err := s.db().Query(sqlutil.ReplacePlaceholders(listQuery), args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("查询日志失败: %v", err)
+	}
+	defer rows.Close()
+
+	logs := make([]LogRow, 0)
+	for rows.Next() {
+		var (
+			log          LogRow
+			pageviewFlag int
+			isNewVisitor int
+		)
+		dest := []interface{}{&log.ID, &log.IP, &log.Timestamp, &log.Method, &log.URL, &log.StatusCode,
+			&log.BytesSent, &log.Referer, &log.Browser, &log.OS, &log.Device,
+			&log.Domestic, &log.Global, &pageviewFlag, &log.RawURL}
+		if markNew {
+			dest = append(dest, &isNewVisitor)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, 0, fmt.Errorf("解析日志行失败: %v", err)
+		}
+		log.Pageview = pageviewFlag == 1
+		log.IsNewVisitor = isNewVisitor == 1
+		logs = append(logs, log)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("遍历日志失败: %v", err)
+	}
+
+	// 总数只在按新老访客过滤时才需要关联首次访问表
+	countSelect := "COUNT(*)"
+	if query.DistinctIP {
+		countSelect = "COUNT(DISTINCT l.ip_id)"
+	}
+	countJoins := logDimJoins(websiteID)
+	if query.NewVisitor == "new" || query.NewVisitor == "returning" {
+		countJoins += firstSeenJoin
+	}
+	countQuery := fmt.Sprintf(`SELECT %s FROM "%s_nginx_logs" l%s%s`,
+		countSelect, websiteID, countJoins, whereClause(conditions))
+
+	var total int
+	if err := s.db().QueryRow(sqlutil.ReplacePlaceholders(countQuery), filterArgs...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("获取日志总数失败: %v", err)
+	}
+	return logs, total, nil
+}
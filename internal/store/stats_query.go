@@ -0,0 +1,248 @@
+package store
+
+import (
+	"time"
+)
+
+// StatsQuerier 分析管理器使用的类型化查询层：调用方只描述时间范围、过滤条件、分组维度与指标，
+// 表结构、聚合表选择与 SQL 方言由实现负责。Repository.Stats 返回按站点存储后端路由的实现，
+// MemoryStats 在内存中按原始日志计算，供单元测试使用
+type StatsQuerier interface {
+	// Totals 统计 [start, end] 的 PV、UV、流量与状态码分布，起止时刻所在的聚合桶都计入
+	Totals(websiteID string, start, end time.Time) (StatsTotals, error)
+	// VisitorSplit 区间内活跃访客中首次访问落在 [start, end) 的新访客数与此前来过的老访客数
+	VisitorSplit(websiteID string, start, end time.Time) (int, int, error)
+	// Series 返回与 points 一一对应的 PV/UV；hourly 为 true 时按服务器本地小时，
+	// 否则按时间点所在时区的自然日统计
+	Series(websiteID string, points []time.Time, hourly bool) ([]SeriesPoint, error)
+	// TopDimension 按维度分组的 PV/UV 排行，可同时统计对比区间
+	TopDimension(websiteID string, query DimensionQuery) (DimensionResult, error)
+	// ActiveVisitors 区间内产生浏览的独立访客数
+	ActiveVisitors(websiteID string, r TimeRange) (int, error)
+	// VisitorBuckets 区间内按 step 秒分桶的独立访客数，键为 timestamp / step
+	VisitorBuckets(websiteID string, r TimeRange, step int64) (map[int64]int, error)
+	// SessionMetrics 区间内的会话数与各入口页的会话数
+	SessionMetrics(websiteID string, start, end time.Time) (SessionMetrics, error)
+	// ScanPageviews 按访客（IP + UA）、时间升序遍历满足条件的浏览记录，用于切分会话
+	ScanPageviews(websiteID string, filter LogFilter, fn func(PageviewRow) error) error
+	// ListLogs 分页查询原始日志，同时返回满足条件的总数
+	ListLogs(websiteID string, query LogQuery) ([]LogRow, int, error)
+	// TrafficAnomalies 返回 [start, end] 内已检测到的小时级流量异常
+	TrafficAnomalies(websiteID string, start, end int64) ([]TrafficAnomaly, error)
+}
+
+// TimeRange 左闭右开的 Unix 秒区间
+type TimeRange struct {
+	Start int64
+	End   int64
+}
+
+// StatsTotals 区间汇总指标
+type StatsTotals struct {
+	PV      int
+	UV      int
+	Traffic int64
+	S2xx    int
+	S3xx    int
+	S4xx    int
+	S5xx    int
+	Other   int
+}
+
+// SeriesPoint 趋势图的一个时间点
+type SeriesPoint struct {
+	PV int
+	UV int
+}
+
+// Dimension 排行的分组维度
+type Dimension string
+
+const (
+	DimensionURL            Dimension = "url"
+	DimensionReferer        Dimension = "referer"         // 完整来源，直接访问与站内访问单独归类
+	DimensionRefererHost    Dimension = "referer_host"    // 来源域名
+	DimensionRefererSource  Dimension = "referer_source"  // 识别出的来源名称，未识别时退回域名
+	DimensionRefererKeyword Dimension = "referer_keyword" // 搜索关键词，只统计带关键词的来源
+	DimensionChannel        Dimension = "channel"         // 来源渠道
+	DimensionBrowser        Dimension = "browser"
+	DimensionOS             Dimension = "os"
+	DimensionDevice         Dimension = "device"
+	DimensionProvince       Dimension = "province" // 国内地域 "省·市" 的省
+	DimensionCity           Dimension = "city"     // 国内地域 "省·市" 的市
+	DimensionCountry        Dimension = "country"  // 全球地域
+)
+
+// Metric 排行的排序指标
+type Metric string
+
+const (
+	MetricUV Metric = "uv"
+	MetricPV Metric = "pv"
+)
+
+// DimensionQuery 维度排行查询
+type DimensionQuery struct {
+	Dimension    Dimension
+	Start, End   time.Time  // 当前区间，End 不含
+	Compare      *TimeRange // 不为空时同时统计对比区间，两边按分组键全外连接
+	CompareSort  string     // 对比模式的排序：空为按 UV 降序，decline / growth 按变化量排序
+	OrderBy      Metric     // 非对比模式的排序指标，默认 UV
+	DomesticOnly bool       // 只统计国内（global = 中国）的访问
+	Limit        int        // 小于 0 时不限制条数
+}
+
+// DimensionRow 维度排行的一行，Prev* 只在对比模式下有值
+type DimensionRow struct {
+	Key    string
+	CurPV  int
+	CurUV  int
+	PrevPV int
+	PrevUV int
+}
+
+// DimensionResult 维度排行结果；UV 为近似值时 UVRelativeError 为其相对标准误差
+type DimensionResult struct {
+	Rows            []DimensionRow
+	UVRelativeError *float64
+}
+
+// SessionMetrics 会话数与入口页分布
+type SessionMetrics struct {
+	SessionCount int
+	EntryCounts  map[string]int
+}
+
+// LogFilter 原始日志的过滤条件，字符串条件均为包含匹配，零值表示不过滤
+type LogFilter struct {
+	Start, End        int64  // [Start, End)，为 0 时该端不限
+	PageviewOnly      bool   // 只保留页面浏览
+	Keyword           string // 同时匹配 URL、IP、来源与国内地域
+	IP                string
+	URL               string
+	Location          string // 同时匹配国内与全球地域
+	Device            string
+	Browser           string
+	OS                string
+	StatusCode        int
+	StatusClass       string // 2xx / 3xx / 4xx / 5xx，StatusCode 不为 0 时忽略
+	ExcludeInternalIP bool   // 排除内网与回环地址
+	ExcludeSpider     bool   // 排除蜘蛛
+	ExcludeForeign    bool   // 只保留国内访问
+}
+
+// LogQuery 原始日志分页查询
+type LogQuery struct {
+	Filter     LogFilter
+	NewVisitor string // 为空不判断新访客；all 只标记，new / returning 同时过滤
+	NewSince   int64  // 首次访问落在 [NewSince, NewUntil) 的 IP 视为新访客
+	NewUntil   int64
+	DistinctIP bool   // 每个 IP 只保留最近一条
+	SortField  string // timestamp / ip / url / status_code / bytes_sent
+	SortDesc   bool
+	Limit      int
+	Offset     int
+}
+
+// LogRow 原始日志的一行
+type LogRow struct {
+	ID           int64
+	IP           string
+	Timestamp    int64
+	Method       string
+	URL          string
+	RawURL       string
+	StatusCode   int
+	BytesSent    int
+	Referer      string
+	Browser      string
+	OS           string
+	Device       string
+	Domestic     string
+	Global       string
+	Pageview     bool
+	IsNewVisitor bool
+}
+
+// PageviewRow 切分会话使用的浏览记录，Visitor 相同的记录属于同一访客
+type PageviewRow struct {
+	Timestamp int64
+	Visitor   string
+	IP        string
+	Browser   string
+	OS        string
+	Device    string
+	URL       string
+	Domestic  string
+	Global    string
+}
+
+// spiderDeviceLabel 蜘蛛请求的设备类型
+const spiderDeviceLabel = "蜘蛛"
+
+// internalIPPatterns 内网与回环地址的 LIKE 前缀，"::1" 为精确匹配
+var internalIPPatterns = []string{
+	"10.%", "127.%", "192.168.%",
+	"172.16.%", "172.17.%", "172.18.%", "172.19.%", "172.20.%",
+	"172.21.%", "172.22.%", "172.23.%", "172.24.%", "172.25.%",
+	"172.26.%", "172.27.%", "172.28.%", "172.29.%", "172.30.%", "172.31.%",
+	"fc%", "fd%", "fe80:%", "::1",
+}
+
+// Stats 返回分析查询层，按站点的存储后端路由到 Postgres 或 ClickHouse
+func (r *Repository) Stats() StatsQuerier {
+	return &repositoryStats{repo: r, pg: &postgresStats{repo: r}}
+}
+
+// repositoryStats 按站点选择实现：ClickHouse 站点的汇总类查询走 ClickHouse，其余仍查 Postgres
+type repositoryStats struct {
+	repo *Repository
+	pg   *postgresStats
+}
+
+func (s *repositoryStats) pick(websiteID string) StatsQuerier {
+	if ch := s.repo.ClickHouse(websiteID); ch != nil {
+		return &clickHouseStats{postgresStats: s.pg, ch: ch}
+	}
+	return s.pg
+}
+
+func (s *repositoryStats) Totals(websiteID string, start, end time.Time) (StatsTotals, error) {
+	return s.pick(websiteID).Totals(websiteID, start, end)
+}
+
+func (s *repositoryStats) VisitorSplit(websiteID string, start, end time.Time) (int, int, error) {
+	return s.pick(websiteID).VisitorSplit(websiteID, start, end)
+}
+
+func (s *repositoryStats) Series(websiteID string, points []time.Time, hourly bool) ([]SeriesPoint, error) {
+	return s.pick(websiteID).Series(websiteID, points, hourly)
+}
+
+func (s *repositoryStats) TopDimension(websiteID string, query DimensionQuery) (DimensionResult, error) {
+	return s.pick(websiteID).TopDimension(websiteID, query)
+}
+
+func (s *repositoryStats) ActiveVisitors(websiteID string, r TimeRange) (int, error) {
+	return s.pick(websiteID).ActiveVisitors(websiteID, r)
+}
+
+func (s *repositoryStats) VisitorBuckets(websiteID string, r TimeRange, step int64) (map[int64]int, error) {
+	return s.pick(websiteID).VisitorBuckets(websiteID, r, step)
+}
+
+func (s *repositoryStats) SessionMetrics(websiteID string, start, end time.Time) (SessionMetrics, error) {
+	return s.pick(websiteID).SessionMetrics(websiteID, start, end)
+}
+
+func (s *repositoryStats) ScanPageviews(websiteID string, filter LogFilter, fn func(PageviewRow) error) error {
+	return s.pick(websiteID).ScanPageviews(websiteID, filter, fn)
+}
+
+func (s *repositoryStats) ListLogs(websiteID string, query LogQuery) ([]LogRow, int, error) {
+	return s.pick(websiteID).ListLogs(websiteID, query)
+}
+
+func (s *repositoryStats) TrafficAnomalies(websiteID string, start, end int64) ([]TrafficAnomaly, error) {
+	return s.pick(websiteID).TrafficAnomalies(websiteID, start, end)
+}
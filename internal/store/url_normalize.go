@@ -0,0 +1,225 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+	"github.com/sirupsen/logrus"
+)
+
+const renormalizeBatchSize = 2000
+
+type urlRemap struct {
+	oldID  int64
+	oldURL string
+	newURL string
+}
+
+// RenormalizeURLs 按 normalize 重新归一化已有 URL 维表，并把日志/会话引用迁移到新维表行
+// keepRaw 为 true 时把旧 URL 写入日志的 raw_url（已有值则保留）。返回被改写的维表行数。
+func (r *Repository) RenormalizeURLs(websiteID string, normalize func(string) string, keepRaw bool) (int, error) {
+	if normalize == nil {
+		return 0, nil
+	}
+	urlTable := fmt.Sprintf("%s_dim_url", websiteID)
+	exists, err := r.tableExists(urlTable)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	remaps, err := r.collectURLRemaps(urlTable, normalize)
+	if err != nil {
+		return 0, fmt.Errorf("读取 URL 维表失败: %w", err)
+	}
+	if len(remaps) == 0 {
+		return 0, nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"website": websiteID,
+		"urls":    len(remaps),
+	}).Info("开始重新归一化 URL 维表")
+
+	if err := r.applyURLRemaps(websiteID, remaps, keepRaw); err != nil {
+		return 0, fmt.Errorf("重新归一化 URL 失败: %w", err)
+	}
+
+	logrus.WithField("website", websiteID).Info("URL 维表重新归一化完成")
+	return len(remaps), nil
+}
+
+func (r *Repository) collectURLRemaps(urlTable string, normalize func(string) string) ([]urlRemap, error) {
+	remaps := make([]urlRemap, 0)
+	lastID := int64(0)
+	for {
+		rows, err := r.db.Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`SELECT id, url FROM "%s" WHERE id > ? ORDER BY id LIMIT ?`, urlTable,
+		)), lastID, renormalizeBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		count := 0
+		for rows.Next() {
+			var (
+				id  int64
+				raw string
+			)
+			if err := rows.Scan(&id, &raw); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			count++
+			lastID = id
+			normalized := sanitizeAndTruncate(normalize(raw), maxURLBytes)
+			if normalized == "" || normalized == raw {
+				continue
+			}
+			remaps = append(remaps, urlRemap{oldID: id, oldURL: raw, newURL: normalized})
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rows.Close()
+		if count < renormalizeBatchSize {
+			return remaps, nil
+		}
+	}
+}
+
+func (r *Repository) applyURLRemaps(websiteID string, remaps []urlRemap, keepRaw bool) (err error) {
+	urlTable := fmt.Sprintf("%s_dim_url", websiteID)
+	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
+	sessionTable := fmt.Sprintf("%s_sessions", websiteID)
+	entryTable := fmt.Sprintf("%s_agg_entry_daily", websiteID)
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	// 与入库写维表互斥，避免迁移过程中新日志引用到即将删除的维表行。
+	if _, err = tx.Exec(fmt.Sprintf(
+		`SELECT pg_advisory_xact_lock(hashtext('%s:url_renormalize'))`, websiteID,
+	)); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`CREATE TEMP TABLE url_remap (
+            old_id BIGINT PRIMARY KEY,
+            old_url TEXT NOT NULL,
+            new_url TEXT NOT NULL,
+            new_id BIGINT
+        ) ON COMMIT DROP`); err != nil {
+		return err
+	}
+	if err = insertURLRemaps(tx, remaps); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(fmt.Sprintf(
+		`INSERT INTO "%s" (url) SELECT DISTINCT new_url FROM url_remap ON CONFLICT DO NOTHING`, urlTable,
+	)); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf(
+		`UPDATE url_remap m SET new_id = d.id FROM "%s" d WHERE d.url = m.new_url`, urlTable,
+	)); err != nil {
+		return err
+	}
+
+	logUpdate := `UPDATE "%s" l SET url_id = m.new_id FROM url_remap m WHERE l.url_id = m.old_id`
+	if keepRaw {
+		logUpdate = `UPDATE "%s" l SET url_id = m.new_id, raw_url = COALESCE(l.raw_url, m.old_url)
+         FROM url_remap m WHERE l.url_id = m.old_id`
+	}
+	if _, err = tx.Exec(fmt.Sprintf(logUpdate, logTable)); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf(
+		`UPDATE "%s" s SET entry_url_id = m.new_id FROM url_remap m WHERE s.entry_url_id = m.old_id`, sessionTable,
+	)); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf(
+		`UPDATE "%s" s SET exit_url_id = m.new_id FROM url_remap m WHERE s.exit_url_id = m.old_id`, sessionTable,
+	)); err != nil {
+		return err
+	}
+
+	// 以 URL 维表 id 为键的聚合（入口页、URL 按日维度聚合）把旧 id 的行合并到新 id，日期沿用原行：
+	// 不从会话表按日重建，日期分桶与入库时一致，也不会丢失会话已过保留期的天
+	if err = remapEntryAggregates(tx, entryTable); err != nil {
+		return err
+	}
+	if err = remapDimAggregates(tx, websiteID); err != nil {
+		return err
+	}
+
+	// 链式改写时旧行可能仍是其它 URL 的目标，只删除不再被引用的旧行。
+	if _, err = tx.Exec(fmt.Sprintf(
+		`DELETE FROM "%s" d
+         USING url_remap m
+         WHERE d.id = m.old_id
+           AND NOT EXISTS (SELECT 1 FROM url_remap t WHERE t.new_id = d.id)`, urlTable,
+	)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// remapEntryAggregates 把入口页聚合中旧 URL 的计数按 (day, new_id) 累加到新 URL 上
+func remapEntryAggregates(tx *sql.Tx, entryTable string) error {
+	if _, err := tx.Exec(fmt.Sprintf(
+		`CREATE TEMP TABLE entry_remap ON COMMIT DROP AS
+         SELECT e.day, m.new_id AS entry_url_id, SUM(e.count) AS count
+         FROM "%s" e
+         JOIN url_remap m ON m.old_id = e.entry_url_id
+         GROUP BY e.day, m.new_id`, entryTable,
+	)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(
+		`DELETE FROM "%s" e USING url_remap m WHERE e.entry_url_id = m.old_id`, entryTable,
+	)); err != nil {
+		return err
+	}
+	_, err := tx.Exec(fmt.Sprintf(
+		`INSERT INTO "%[1]s" (day, entry_url_id, count)
+         SELECT day, entry_url_id, count FROM entry_remap
+         ON CONFLICT (day, entry_url_id) DO UPDATE SET count = "%[1]s".count + EXCLUDED.count`, entryTable,
+	))
+	return err
+}
+
+func insertURLRemaps(tx *sql.Tx, remaps []urlRemap) error {
+	const chunkSize = 500
+	for start := 0; start < len(remaps); start += chunkSize {
+		end := start + chunkSize
+		if end > len(remaps) {
+			end = len(remaps)
+		}
+		chunk := remaps[start:end]
+		placeholders := make([]string, 0, len(chunk))
+		args := make([]interface{}, 0, len(chunk)*3)
+		for _, item := range chunk {
+			placeholders = append(placeholders, "(?, ?, ?)")
+			args = append(args, item.oldID, item.oldURL, item.newURL)
+		}
+		query := fmt.Sprintf(
+			`INSERT INTO url_remap (old_id, old_url, new_url) VALUES %s`,
+			strings.Join(placeholders, ","),
+		)
+		if _, err := tx.Exec(sqlutil.ReplacePlaceholders(query), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRenormalizeURLsMergesAggregates 归一化后入口页与 URL 维度聚合合并到新 URL，日期沿用入库时的本地日期
+func TestRenormalizeURLsMergesAggregates(t *testing.T) {
+	repo := openTestRepository(t)
+	websiteID := fmt.Sprintf("renorm_%x", time.Now().UnixNano())
+	if err := repo.ensureWebsiteSchema(websiteID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.initLogPartitions(websiteID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dropScratchTables(t, repo, websiteID) })
+
+	// 接近本地午夜，会话时区与服务器时区不一致时容易落到另一天
+	base := time.Now().Add(-48 * time.Hour)
+	base = time.Date(base.Year(), base.Month(), base.Day(), 23, 30, 0, 0, time.Local)
+	pageview := func(ip, url string, offset time.Duration) NginxLogRecord {
+		return NginxLogRecord{
+			IP:           ip,
+			PageviewFlag: 1,
+			Timestamp:    base.Add(offset),
+			Method:       "GET",
+			Url:          url,
+			Status:       200,
+			BytesSent:    100,
+			Referer:      "-",
+			UserBrowser:  "Chrome",
+			UserOs:       "macOS",
+			UserDevice:   "Desktop",
+		}
+	}
+	logs := []NginxLogRecord{
+		pageview("10.0.0.1", "/a?x=1", 0),
+		pageview("10.0.0.1", "/a?x=2", 5*time.Minute),
+		pageview("10.0.0.2", "/a", 10*time.Minute),
+	}
+	if err := repo.batchInsertLogs(websiteID, logs, nil); err != nil {
+		t.Fatalf("batchInsertLogs: %v", err)
+	}
+
+	stripQuery := func(raw string) string {
+		if i := strings.IndexByte(raw, '?'); i >= 0 {
+			return raw[:i]
+		}
+		return raw
+	}
+	changed, err := repo.RenormalizeURLs(websiteID, stripQuery, false)
+	if err != nil {
+		t.Fatalf("RenormalizeURLs: %v", err)
+	}
+	if changed != 2 {
+		t.Fatalf("RenormalizeURLs changed %d urls, want 2", changed)
+	}
+
+	var urlID int64
+	if err := repo.db.QueryRow(fmt.Sprintf(`SELECT id FROM "%s_dim_url" WHERE url = '/a'`, websiteID)).Scan(&urlID); err != nil {
+		t.Fatalf("lookup /a: %v", err)
+	}
+	var urls int
+	if err := repo.db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM "%s_dim_url"`, websiteID)).Scan(&urls); err != nil {
+		t.Fatal(err)
+	}
+	if urls != 1 {
+		t.Errorf("dim_url rows = %d, want 1", urls)
+	}
+
+	wantDay := dayBucket(base)
+	rows, err := repo.db.Query(fmt.Sprintf(
+		`SELECT to_char(day, 'YYYY-MM-DD'), entry_url_id, count FROM "%s_agg_entry_daily"`, websiteID,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	for rows.Next() {
+		var (
+			day   string
+			id    int64
+			count int64
+		)
+		if err := rows.Scan(&day, &id, &count); err != nil {
+			rows.Close()
+			t.Fatal(err)
+		}
+		entries = append(entries, fmt.Sprintf("%s/%d/%d", day, id, count))
+	}
+	rows.Close()
+	if want := fmt.Sprintf("%s/%d/2", wantDay, urlID); len(entries) != 1 || entries[0] != want {
+		t.Errorf("entry aggregates = %v, want [%s]", entries, want)
+	}
+
+	var (
+		dims int
+		pv   int64
+		day  string
+	)
+	err = repo.db.QueryRow(fmt.Sprintf(
+		`SELECT COUNT(*), COALESCE(SUM(pv), 0), COALESCE(MIN(to_char(day, 'YYYY-MM-DD')), '')
+         FROM "%s" WHERE dim_id = %d`, DimAggregateTable(websiteID, "url"), urlID,
+	)).Scan(&dims, &pv, &day)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dims != 1 || pv != 3 || day != wantDay {
+		t.Errorf("url aggregate rows = %d, pv = %d, day = %s; want 1, 3, %s", dims, pv, day, wantDay)
+	}
+}
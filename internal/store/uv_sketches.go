@@ -0,0 +1,340 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/likaia/nginxpulse/internal/sqlutil"
+	"github.com/likaia/nginxpulse/internal/store/hll"
+	"github.com/sirupsen/logrus"
+)
+
+// UVSketchTable 返回站点按小时 / 日保存 UV 草图的表名，granularity 为 hourly / daily。
+// 草图与计数方式无关始终维护，切换到 approximate 后无需回填即可查询
+func UVSketchTable(websiteID, granularity string) string {
+	return fmt.Sprintf("%s_agg_%s_uv", websiteID, granularity)
+}
+
+// UVApproximate 站点是否按 HLL 草图近似计算 UV；此时不再写入 _agg_hourly_ip / _agg_daily_ip
+func UVApproximate(websiteID string) bool {
+	return config.UVModeForWebsite(websiteID) == config.UVModeApproximate
+}
+
+func uvSketchTables(websiteID string) []string {
+	return []string{UVSketchTable(websiteID, "hourly"), UVSketchTable(websiteID, "daily")}
+}
+
+func createUVSketchTables(execer sqlExecer, websiteID string) error {
+	stmts := []string{
+		fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS "%s" (
+                bucket BIGINT PRIMARY KEY,
+                uv_sketch BYTEA NOT NULL
+            )`, UVSketchTable(websiteID, "hourly"),
+		),
+		fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS "%s" (
+                day DATE PRIMARY KEY,
+                uv_sketch BYTEA NOT NULL
+            )`, UVSketchTable(websiteID, "daily"),
+		),
+	}
+	for _, stmt := range stmts {
+		if _, err := execer.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *aggBatch) addUV(log NginxLogRecord, ipID int64) {
+	if b == nil || log.PageviewFlag != 1 {
+		return
+	}
+	hour := hourBucket(log.Timestamp)
+	day := dayBucket(log.Timestamp)
+	if b.hourlySketches[hour] == nil {
+		b.hourlySketches[hour] = hll.New()
+	}
+	b.hourlySketches[hour].AddInt64(ipID)
+	if b.dailySketches[day] == nil {
+		b.dailySketches[day] = hll.New()
+	}
+	b.dailySketches[day].AddInt64(ipID)
+}
+
+type uvSketchStatements struct {
+	upsertHourly *sql.Stmt
+	updateHourly *sql.Stmt
+	upsertDaily  *sql.Stmt
+	updateDaily  *sql.Stmt
+}
+
+func (u *uvSketchStatements) Close() {
+	for _, stmt := range []*sql.Stmt{u.upsertHourly, u.updateHourly, u.upsertDaily, u.updateDaily} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
+
+func prepareUVSketchStatements(tx *sql.Tx, websiteID string) (*uvSketchStatements, error) {
+	stmts := &uvSketchStatements{}
+	prepare := func(table, column string) (*sql.Stmt, *sql.Stmt, error) {
+		// 冲突时原样保留并返回已有草图（同时锁住该行），由调用方合并后写回
+		upsert, err := tx.Prepare(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`INSERT INTO "%[1]s" (%[2]s, uv_sketch) VALUES (?, ?)
+             ON CONFLICT(%[2]s) DO UPDATE SET uv_sketch = "%[1]s".uv_sketch
+             RETURNING uv_sketch`, table, column,
+		)))
+		if err != nil {
+			return nil, nil, err
+		}
+		update, err := tx.Prepare(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`UPDATE "%s" SET uv_sketch = ? WHERE %s = ?`, table, column,
+		)))
+		if err != nil {
+			upsert.Close()
+			return nil, nil, err
+		}
+		return upsert, update, nil
+	}
+
+	var err error
+	stmts.upsertHourly, stmts.updateHourly, err = prepare(UVSketchTable(websiteID, "hourly"), "bucket")
+	if err != nil {
+		return nil, err
+	}
+	stmts.upsertDaily, stmts.updateDaily, err = prepare(UVSketchTable(websiteID, "daily"), "day")
+	if err != nil {
+		stmts.Close()
+		return nil, err
+	}
+	return stmts, nil
+}
+
+// applyUVSketchUpdates 按桶排序合并写入草图，与 applyAggUpdates 一样保证加锁顺序一致
+func applyUVSketchUpdates(stmts *uvSketchStatements, batch *aggBatch) error {
+	if stmts == nil || batch == nil {
+		return nil
+	}
+	buckets := make([]int64, 0, len(batch.hourlySketches))
+	for bucket := range batch.hourlySketches {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	for _, bucket := range buckets {
+		if err := mergeUVSketch(stmts.upsertHourly, stmts.updateHourly, bucket, batch.hourlySketches[bucket]); err != nil {
+			return err
+		}
+	}
+
+	days := make([]string, 0, len(batch.dailySketches))
+	for day := range batch.dailySketches {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	for _, day := range days {
+		if err := mergeUVSketch(stmts.upsertDaily, stmts.updateDaily, day, batch.dailySketches[day]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeUVSketch 写入一个桶的草图；桶已存在时在 Go 中合并，内容变化才写回
+func mergeUVSketch(upsert, update *sql.Stmt, key interface{}, sketch *hll.Sketch) error {
+	var existing []byte
+	if err := upsert.QueryRow(key, sketch.Encode()).Scan(&existing); err != nil {
+		return err
+	}
+	merged, err := hll.Decode(existing)
+	if err != nil {
+		// 草图损坏时以本批数据重新开始
+		merged = hll.New()
+	}
+	if err := merged.Merge(sketch); err != nil {
+		return err
+	}
+	if next := merged.Encode(); !bytes.Equal(next, existing) {
+		if _, err := update.Exec(next, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) backfillUVSketchesIfEmpty(websiteID string) error {
+	hasSketches, err := r.tableHasRows(UVSketchTable(websiteID, "hourly"))
+	if err != nil || hasSketches {
+		return err
+	}
+	hasLogs, err := r.tableHasRows(fmt.Sprintf("%s_nginx_logs", websiteID))
+	if err != nil || !hasLogs {
+		return err
+	}
+	return r.backfillUVSketches(websiteID)
+}
+
+// backfillUVSketches 按日从原始日志重建 UV 草图，逐日读取以控制内存
+func (r *Repository) backfillUVSketches(websiteID string) error {
+	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
+	var minTs, maxTs sql.NullInt64
+	if err := r.db.QueryRow(fmt.Sprintf(
+		`SELECT MIN(timestamp), MAX(timestamp) FROM "%s"`, logTable,
+	)).Scan(&minTs, &maxTs); err != nil {
+		return err
+	}
+
+	logrus.WithField("website", websiteID).Info("开始回填 UV 草图")
+	for _, table := range uvSketchTables(websiteID) {
+		if _, err := r.db.Exec(fmt.Sprintf(`DELETE FROM "%s"`, table)); err != nil {
+			return err
+		}
+	}
+	if !minTs.Valid {
+		return nil
+	}
+	first := time.Unix(minTs.Int64, 0).In(time.Local)
+	last := time.Unix(maxTs.Int64, 0)
+	for day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.Local); !day.After(last); day = day.AddDate(0, 0, 1) {
+		if err := r.rebuildUVSketches(websiteID, day, day.AddDate(0, 0, 1), true, true); err != nil {
+			return err
+		}
+	}
+	logrus.WithField("website", websiteID).Info("UV 草图回填完成")
+	return nil
+}
+
+// rebuildUVSketches 按剩余日志重建 [start, end) 内的草图，start/end 需落在对应层的桶边界上；
+// hourly / daily 控制重建哪一层，没有 pageview 的桶会被删除
+func (r *Repository) rebuildUVSketches(websiteID string, start, end time.Time, hourly, daily bool) error {
+	rows, err := r.db.Query(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+		`SELECT timestamp, ip_id FROM "%s_nginx_logs" WHERE pageview_flag = 1 AND timestamp >= ? AND timestamp < ?`,
+		websiteID,
+	)), start.Unix(), end.Unix())
+	if err != nil {
+		return err
+	}
+	batch := &aggBatch{
+		hourlySketches: make(map[int64]*hll.Sketch),
+		dailySketches:  make(map[string]*hll.Sketch),
+	}
+	for rows.Next() {
+		var timestamp, ipID int64
+		if err := rows.Scan(&timestamp, &ipID); err != nil {
+			rows.Close()
+			return err
+		}
+		batch.addUV(NginxLogRecord{Timestamp: time.Unix(timestamp, 0), PageviewFlag: 1}, ipID)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if hourly {
+		if _, err = tx.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`DELETE FROM "%s" WHERE bucket >= ? AND bucket < ?`, UVSketchTable(websiteID, "hourly"),
+		)), start.Unix(), end.Unix()); err != nil {
+			return err
+		}
+	} else {
+		batch.hourlySketches = nil
+	}
+	if daily {
+		if _, err = tx.Exec(sqlutil.ReplacePlaceholders(fmt.Sprintf(
+			`DELETE FROM "%s" WHERE day >= ? AND day < ?`, UVSketchTable(websiteID, "daily"),
+		)), dayBucket(start), dayBucket(end)); err != nil {
+			return err
+		}
+	} else {
+		batch.dailySketches = nil
+	}
+	stmts, err := prepareUVSketchStatements(tx, websiteID)
+	if err != nil {
+		return err
+	}
+	defer stmts.Close()
+	if err = applyUVSketchUpdates(stmts, batch); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// backfillAggregateIPs 从原始日志写入 (桶, ip_id) 明细，只在 exact 模式下使用
+func backfillAggregateIPs(execer sqlExecer, websiteID string) error {
+	logTable := fmt.Sprintf("%s_nginx_logs", websiteID)
+	if _, err := execer.Exec(fmt.Sprintf(
+		`INSERT INTO "%s" (bucket, ip_id)
+         SELECT
+             (timestamp / 3600) * 3600 AS bucket,
+             ip_id
+         FROM "%s"
+         WHERE pageview_flag = 1
+         GROUP BY bucket, ip_id
+         ON CONFLICT DO NOTHING`, fmt.Sprintf("%s_agg_hourly_ip", websiteID), logTable,
+	)); err != nil {
+		return err
+	}
+	_, err := execer.Exec(fmt.Sprintf(
+		`INSERT INTO "%s" (day, ip_id)
+         SELECT
+             date(to_timestamp(timestamp)) AS day,
+             ip_id
+         FROM "%s"
+         WHERE pageview_flag = 1
+         GROUP BY day, ip_id
+         ON CONFLICT DO NOTHING`, fmt.Sprintf("%s_agg_daily_ip", websiteID), logTable,
+	))
+	return err
+}
+
+// applyUVMode 按站点的 UV 计数方式整理 IP 明细表：approximate 下清空明细释放空间；
+// exact 下明细为空而聚合有数据（刚从 approximate 切回）时，从原始日志重建保留期内的明细
+func (r *Repository) applyUVMode(websiteID string) error {
+	hourlyIP := fmt.Sprintf("%s_agg_hourly_ip", websiteID)
+	dailyIP := fmt.Sprintf("%s_agg_daily_ip", websiteID)
+
+	if UVApproximate(websiteID) {
+		for _, table := range []string{hourlyIP, dailyIP} {
+			hasRows, err := r.tableHasRows(table)
+			if err != nil {
+				return err
+			}
+			if !hasRows {
+				continue
+			}
+			logrus.WithField("website", websiteID).Infof("UV 使用近似计数，清空 %s", table)
+			if _, err := r.db.Exec(fmt.Sprintf(`TRUNCATE TABLE "%s"`, table)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	hasIPs, err := r.tableHasRows(hourlyIP)
+	if err != nil || hasIPs {
+		return err
+	}
+	hasAgg, err := r.tableHasRows(fmt.Sprintf("%s_agg_hourly", websiteID))
+	if err != nil || !hasAgg {
+		return err
+	}
+	logrus.WithField("website", websiteID).Info("UV 使用精确计数，从原始日志重建 IP 明细")
+	return backfillAggregateIPs(r.db, websiteID)
+}
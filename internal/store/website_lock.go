@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+
+	"github.com/likaia/nginxpulse/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// websiteLocks 按网站划分的写锁：同一站点的日志写入、清空重解析与 IP 归属地回填互相排斥，
+// 不同站点之间互不阻塞。进程内用互斥锁排队，跨进程（离线导入、多实例）用 Postgres 会话级 advisory lock
+type websiteLocks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+	db    *sql.DB // 专用于持有 advisory lock 的连接池，与读写共用的连接池分开，避免持锁连接占满连接池
+}
+
+func (l *websiteLocks) get(websiteID string) *sync.Mutex {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locks == nil {
+		l.locks = make(map[string]*sync.Mutex)
+	}
+	lock, ok := l.locks[websiteID]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[websiteID] = lock
+	}
+	return lock
+}
+
+// openWebsiteLockDB 打开持锁连接池：每个正在写入的站点占用一个连接，不限制上限
+func openWebsiteLockDB(cfg config.DatabaseConfig) (*sql.DB, error) {
+	cfg.MaxOpenConns = 0
+	cfg.MaxIdleConns = 2
+	return openPostgres(cfg)
+}
+
+// lockWebsite 获取网站写锁并返回解锁函数；锁不可重入，持锁期间不要再调用同样加锁的方法
+func (r *Repository) lockWebsite(websiteID string) (func(), error) {
+	lock := r.websiteLocks.get(websiteID)
+	lock.Lock()
+	if r.websiteLocks.db == nil {
+		return lock.Unlock, nil
+	}
+
+	ctx := context.Background()
+	conn, err := r.websiteLocks.db.Conn(ctx)
+	if err != nil {
+		lock.Unlock()
+		return nil, fmt.Errorf("获取网站写锁连接失败: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(`SELECT pg_advisory_lock(hashtext('%s:write'))`, websiteID)); err != nil {
+		conn.Close()
+		lock.Unlock()
+		return nil, fmt.Errorf("获取网站写锁失败: %w", err)
+	}
+	return func() {
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(`SELECT pg_advisory_unlock(hashtext('%s:write'))`, websiteID)); err != nil {
+			// 释放失败时丢弃该连接，会话结束后锁随之释放，不能让持锁连接回到连接池
+			logrus.WithError(err).Warnf("释放网站 %s 写锁失败，关闭持锁连接", websiteID)
+			conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+		lock.Unlock()
+	}, nil
+}
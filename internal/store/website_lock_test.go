@@ -0,0 +1,52 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestLockWebsiteAcrossRepositories 两个 Repository 模拟两个进程：一方持锁时另一方阻塞，不同站点互不影响
+func TestLockWebsiteAcrossRepositories(t *testing.T) {
+	first := openTestRepository(t)
+	second := openTestRepository(t)
+	websiteID := fmt.Sprintf("locktest_%x", time.Now().UnixNano())
+
+	unlock, err := first.lockWebsite(websiteID)
+	if err != nil {
+		t.Fatalf("lockWebsite: %v", err)
+	}
+
+	acquired := make(chan func(), 1)
+	go func() {
+		unlockSecond, err := second.lockWebsite(websiteID)
+		if err != nil {
+			t.Errorf("second lockWebsite: %v", err)
+			close(acquired)
+			return
+		}
+		acquired <- unlockSecond
+	}()
+
+	other, err := second.lockWebsite(websiteID + "_other")
+	if err != nil {
+		t.Fatalf("lockWebsite other site: %v", err)
+	}
+	other()
+
+	select {
+	case <-acquired:
+		t.Fatal("second repository acquired the lock while the first still holds it")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case unlockSecond, ok := <-acquired:
+		if ok {
+			unlockSecond()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second repository did not acquire the lock after release")
+	}
+}
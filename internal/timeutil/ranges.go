@@ -2,16 +2,98 @@ package timeutil
 
 import (
 	"fmt"
+	"os"
+	"strings"
 	"time"
+	_ "time/tzdata" // 运行镜像可能不带时区数据库
 )
 
-// TimePeriod 根据时间范围字符串计算开始和结束时间
+// CustomRangeSeparator 自定义区间的分隔符，如 2024-01-01~2024-01-31
+const CustomRangeSeparator = "~"
+
+var customRangeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// LoadLocation 解析 IANA 时区名；为空或与服务器时区一致时返回 time.Local
+func LoadLocation(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "Local" {
+		return time.Local, nil
+	}
+	if tz := strings.TrimSpace(os.Getenv("TZ")); tz != "" && tz == name {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("无效的时区: %s", name)
+	}
+	return loc, nil
+}
+
+// CustomRange 把起止时间拼成 timeRange 字符串
+func CustomRange(from, to string) string {
+	return strings.TrimSpace(from) + CustomRangeSeparator + strings.TrimSpace(to)
+}
+
+// ParseCustomRange 解析 from~to 形式的自定义区间；只给日期时结束时间取当天最后一秒
+func ParseCustomRange(timeRange string, loc *time.Location) (time.Time, time.Time, bool, error) {
+	fromRaw, toRaw, ok := strings.Cut(timeRange, CustomRangeSeparator)
+	if !ok {
+		return time.Time{}, time.Time{}, false, nil
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	start, _, err := parseRangeBoundary(fromRaw, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, true, fmt.Errorf("起始时间格式错误: %s", fromRaw)
+	}
+	end, dateOnly, err := parseRangeBoundary(toRaw, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, true, fmt.Errorf("结束时间格式错误: %s", toRaw)
+	}
+	if dateOnly {
+		end = setTime(end, 23, 59, 59)
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, true, fmt.Errorf("结束时间不能早于起始时间")
+	}
+	return start, end, true, nil
+}
+
+func parseRangeBoundary(value string, loc *time.Location) (time.Time, bool, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range customRangeLayouts {
+		parsed, err := time.ParseInLocation(layout, value, loc)
+		if err == nil {
+			return parsed, layout == "2006-01-02", nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("unsupported time format")
+}
+
+// TimePeriod 根据时间范围字符串计算开始和结束时间（服务器本地时区）
 func TimePeriod(timeRange string) (time.Time, time.Time, error) {
+	return TimePeriodIn(timeRange, time.Local)
+}
 
-	now := time.Now()
+// TimePeriodIn 在指定时区下根据时间范围字符串计算开始和结束时间
+func TimePeriodIn(timeRange string, loc *time.Location) (time.Time, time.Time, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	if start, end, ok, err := ParseCustomRange(timeRange, loc); ok {
+		return start, end, err
+	}
+
+	now := time.Now().In(loc)
 	endTime := setTime(now, 23, 59, 59) // 设置为当天最后一秒
 
-	if date, ok := parseDateString(timeRange); ok {
+	if date, ok := parseDateString(timeRange, loc); ok {
 		startTime := setTime(date, 0, 0, 0)
 		return startTime, setTime(date, 23, 59, 59), nil
 	}
@@ -31,6 +113,14 @@ func TimePeriod(timeRange string) (time.Time, time.Time, error) {
 		startTime, endTime = monthBounds(now)
 	case "last30days":
 		startTime = setTime(now.AddDate(0, 0, -29), 0, 0, 0)
+	case "quarter":
+		startTime, endTime = quarterBounds(now)
+	case "lastQuarter":
+		startTime, endTime = quarterBounds(quarterStart(now).AddDate(0, -3, 0))
+	case "year":
+		startTime, endTime = yearBounds(now)
+	case "lastYear":
+		startTime, endTime = yearBounds(now.AddDate(-1, 0, 0))
 	default:
 		startTime = setTime(now, 0, 0, 0)
 	}
@@ -41,37 +131,34 @@ func TimePeriod(timeRange string) (time.Time, time.Time, error) {
 // TimePointsAndLabels 根据时间范围类型和视图类型直接返回时间点数组和标签数组
 func TimePointsAndLabels(
 	timeRangeType string, viewType string) ([]time.Time, []string) {
-	now := time.Now()
+	return TimePointsAndLabelsIn(timeRangeType, viewType, time.Local)
+}
+
+// TimePointsAndLabelsIn 在指定时区下生成时间点与标签；小时点按实际经过的小时步进，
+// 夏令时切换日会得到 23 或 25 个点而不是重复/缺失某个小时
+func TimePointsAndLabelsIn(
+	timeRangeType string, viewType string, loc *time.Location) ([]time.Time, []string) {
+	if loc == nil {
+		loc = time.Local
+	}
+	now := time.Now().In(loc)
 
 	var timePoints []time.Time
 	var labels []string
 
-	if date, ok := parseDateString(timeRangeType); ok {
-		for hour := 0; hour <= 23; hour++ {
-			hourTime := setTime(date, hour, 0, 0)
-			timePoints = append(timePoints, hourTime)
-			hourLabel := fmt.Sprintf("%d:00", hour)
-			labels = append(labels, hourLabel)
-		}
-		return timePoints, labels
-	}
-
-	if timeRangeType == "today" {
-		for hour := 0; hour <= 23; hour++ {
-			hourTime := setTime(now, hour, 0, 0)
-			timePoints = append(timePoints, hourTime)
-			hourLabel := fmt.Sprintf("%d:00", hour)
-			labels = append(labels, hourLabel)
-		}
-		return timePoints, labels
+	singleDay := time.Time{}
+	if date, ok := parseDateString(timeRangeType, loc); ok {
+		singleDay = date
+	} else if timeRangeType == "today" {
+		singleDay = now
 	} else if timeRangeType == "yesterday" {
-		for hour := 0; hour <= 23; hour++ {
-			hourTime := setTime(now.AddDate(0, 0, -1), hour, 0, 0)
-			timePoints = append(timePoints, hourTime)
-			hourLabel := fmt.Sprintf("%d:00", hour)
-			labels = append(labels, hourLabel)
-		}
-		return timePoints, labels
+		singleDay = now.AddDate(0, 0, -1)
+	}
+	if !singleDay.IsZero() {
+		dayStart := setTime(singleDay, 0, 0, 0)
+		return hourlyPoints(dayStart, dayStart.AddDate(0, 0, 1), func(t time.Time) string {
+			return fmt.Sprintf("%d:00", t.Hour())
+		})
 	}
 
 	var startDay, endDay time.Time
@@ -86,18 +173,39 @@ func TimePointsAndLabels(
 	case "last30days":
 		startDay = setTime(now.AddDate(0, 0, -29), 0, 0, 0)
 		endDay = setTime(now, 23, 0, 0)
+	case "quarter", "lastQuarter", "year", "lastYear":
+		startDay, endDay, _ = TimePeriodIn(timeRangeType, loc)
+	default:
+		start, end, ok, err := ParseCustomRange(timeRangeType, loc)
+		if !ok || err != nil {
+			break
+		}
+		if sameDay(start, end) {
+			return hourlyPoints(truncateHour(start), end, func(t time.Time) string {
+				return fmt.Sprintf("%d:00", t.Hour())
+			})
+		}
+		if viewType == "hourly" {
+			return hourlyPoints(truncateHour(start), end, func(t time.Time) string {
+				return FormatDateWithWeekday(t, false)
+			})
+		}
+		startDay, endDay = setTime(start, 0, 0, 0), end
+	}
+	if startDay.IsZero() {
+		return timePoints, labels
 	}
 
 	includeWeekday := (viewType == "daily" && timeRangeType == "last7days") ||
 		(viewType == "daily" && timeRangeType == "week")
 	hourly := viewType == "hourly"
 
-	for day := startDay; !day.After(endDay); day = day.AddDate(0, 0, 1) {
+	for day := setTime(startDay, 0, 0, 0); !day.After(endDay); day = day.AddDate(0, 0, 1) {
 		dayLabel := FormatDateWithWeekday(day, includeWeekday)
 
 		if hourly {
-			for hour := range 24 {
-				hourTime := setTime(day, hour, 0, 0)
+			points, _ := hourlyPoints(day, day.AddDate(0, 0, 1), nil)
+			for _, hourTime := range points {
 				timePoints = append(timePoints, hourTime)
 				labels = append(labels, dayLabel)
 			}
@@ -110,11 +218,32 @@ func TimePointsAndLabels(
 	return timePoints, labels
 }
 
-func parseDateString(value string) (time.Time, bool) {
+// hourlyPoints 生成 [start, end) 内每个整点，按绝对时间步进一小时
+func hourlyPoints(start, end time.Time, label func(time.Time) string) ([]time.Time, []string) {
+	var points []time.Time
+	var labels []string
+	for t := start; t.Before(end); t = t.Add(time.Hour) {
+		points = append(points, t)
+		if label != nil {
+			labels = append(labels, label(t))
+		}
+	}
+	return points, labels
+}
+
+func truncateHour(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+func sameDay(a, b time.Time) bool {
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
+
+func parseDateString(value string, loc *time.Location) (time.Time, bool) {
 	if len(value) != 10 {
 		return time.Time{}, false
 	}
-	parsed, err := time.ParseInLocation("2006-01-02", value, time.Now().Location())
+	parsed, err := time.ParseInLocation("2006-01-02", value, loc)
 	if err != nil {
 		return time.Time{}, false
 	}
@@ -164,6 +293,25 @@ func monthBounds(t time.Time) (time.Time, time.Time) {
 	return firstDay, lastDayEnd
 }
 
+func quarterStart(t time.Time) time.Time {
+	month := time.Month((int(t.Month())-1)/3*3 + 1)
+	return time.Date(t.Year(), month, 1, 0, 0, 0, 0, t.Location())
+}
+
+// quarterBounds 返回指定日期所在季度的第一天和最后一天
+func quarterBounds(t time.Time) (time.Time, time.Time) {
+	firstDay := quarterStart(t)
+	lastDay := firstDay.AddDate(0, 3, -1)
+	return firstDay, setTime(lastDay, 23, 59, 59)
+}
+
+// yearBounds 返回指定日期所在年份的第一天和最后一天
+func yearBounds(t time.Time) (time.Time, time.Time) {
+	firstDay := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	lastDay := time.Date(t.Year(), time.December, 31, 0, 0, 0, 0, t.Location())
+	return firstDay, setTime(lastDay, 23, 59, 59)
+}
+
 // setTime 设置指定时间的时、分、秒，保留原日期
 func setTime(t time.Time, hour, min, sec int) time.Time {
 	return time.Date(t.Year(), t.Month(), t.Day(), hour, min, sec, 0, t.Location())
@@ -0,0 +1,115 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/likaia/nginxpulse/internal/store"
+)
+
+// agentHeartbeatRequest agent 注册与心跳：上报主机信息与各站点推送状态，响应中携带远程配置
+type agentHeartbeatRequest struct {
+	AgentID           string                   `json:"agent_id"`
+	Hostname          string                   `json:"hostname"`
+	Version           string                   `json:"version"`
+	HeartbeatInterval int64                    `json:"heartbeat_interval"`
+	Paths             []string                 `json:"paths"`
+	Routes            []store.AgentRouteStatus `json:"routes"`
+	ConfigVersion     int64                    `json:"config_version"` // agent 当前已应用的远程配置版本
+}
+
+type agentConfigRequest struct {
+	AgentID string          `json:"agent_id"`
+	Config  json.RawMessage `json:"config"`
+}
+
+// agentView 管理页面展示的 agent，附带按心跳时间计算的在线状态
+type agentView struct {
+	store.AgentInfo
+	Online bool `json:"online"`
+}
+
+// agentRemoteConfigKeys 允许远程下发的 agent 配置项；server、accessKey、stateFile、spoolDir 等
+// 与部署环境相关的配置只能在本地配置文件中设置
+var agentRemoteConfigKeys = map[string]bool{
+	"websiteID":         true,
+	"sourceID":          true,
+	"paths":             true,
+	"inputs":            true,
+	"pollInterval":      true,
+	"batchSize":         true,
+	"flushInterval":     true,
+	"requestTimeout":    true,
+	"maxPendingLines":   true,
+	"maxLineBytes":      true,
+	"retryBackoffMin":   true,
+	"retryBackoffMax":   true,
+	"discoverInterval":  true,
+	"heartbeatInterval": true,
+	"filters":           true,
+}
+
+// normalizeAgentRemoteConfig 校验远程配置：必须是 JSON 对象且只包含允许下发的配置项；null 或空对象表示清除
+func normalizeAgentRemoteConfig(raw json.RawMessage) (json.RawMessage, error) {
+	trimmed := strings.TrimSpace(string(raw))
+	if trimmed == "" || trimmed == "null" {
+		return nil, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(trimmed), &fields); err != nil {
+		return nil, fmt.Errorf("远程配置必须是 JSON 对象: %v", err)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	unknown := make([]string, 0)
+	for key := range fields {
+		if !agentRemoteConfigKeys[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("不支持远程下发的配置项: %s", strings.Join(unknown, ", "))
+	}
+	for _, key := range []string{"pollInterval", "flushInterval", "requestTimeout", "retryBackoffMin",
+		"retryBackoffMax", "discoverInterval", "heartbeatInterval"} {
+		value, ok := fields[key]
+		if !ok {
+			continue
+		}
+		var text string
+		if err := json.Unmarshal(value, &text); err != nil {
+			return nil, fmt.Errorf("%s 必须是字符串", key)
+		}
+		if _, err := time.ParseDuration(strings.TrimSpace(text)); err != nil {
+			return nil, fmt.Errorf("%s 格式不正确: %s", key, text)
+		}
+	}
+	if value, ok := fields["filters"]; ok {
+		var filters map[string]json.RawMessage
+		if err := json.Unmarshal(value, &filters); err != nil {
+			return nil, fmt.Errorf("filters 必须是 JSON 对象")
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// buildAgentViews 标记在线状态：超过 silentAfter 与 3 个心跳周期中的较大值未上报即视为离线
+func buildAgentViews(agents []store.AgentInfo, silentAfter time.Duration, now time.Time) []agentView {
+	views := make([]agentView, 0, len(agents))
+	for _, agent := range agents {
+		timeout := silentAfter
+		if interval := time.Duration(agent.HeartbeatInterval) * time.Second * 3; interval > timeout {
+			timeout = interval
+		}
+		views = append(views, agentView{
+			AgentInfo: agent,
+			Online:    now.Sub(time.Unix(agent.LastSeenAt, 0)) <= timeout,
+		})
+	}
+	return views
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/likaia/nginxpulse/internal/config"
 	"github.com/likaia/nginxpulse/internal/enrich"
 	"github.com/likaia/nginxpulse/internal/ingest"
+	"github.com/likaia/nginxpulse/internal/store"
 	"github.com/likaia/nginxpulse/internal/version"
 	"github.com/sirupsen/logrus"
 )
@@ -293,6 +294,97 @@ func SetupRoutes(
 		})
 	})
 
+	router.POST("/api/urls/renormalize", func(c *gin.Context) {
+		if logParser == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "初始化模式暂不支持 URL 归一化",
+			})
+			return
+		}
+		var req struct {
+			ID string `json:"id"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "请求参数错误",
+			})
+			return
+		}
+		websiteID := strings.TrimSpace(req.ID)
+		if _, ok := config.GetWebsiteByID(websiteID); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "站点不存在",
+			})
+			return
+		}
+
+		updated, err := logParser.RenormalizeURLs(websiteID)
+		if err != nil {
+			if errors.Is(err, ingest.ErrURLNormalizeDisabled) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+			logrus.WithError(err).Error("URL 重新归一化失败")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("URL 重新归一化失败: %v", err),
+			})
+			return
+		}
+
+		if statsFactory != nil {
+			statsFactory.ClearCache()
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"updated": updated,
+		})
+	})
+
+	router.POST("/api/referers/reclassify", func(c *gin.Context) {
+		if logParser == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "初始化模式暂不支持来源重新分类",
+			})
+			return
+		}
+		var req struct {
+			ID string `json:"id"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "请求参数错误",
+			})
+			return
+		}
+		websiteID := strings.TrimSpace(req.ID)
+		if _, ok := config.GetWebsiteByID(websiteID); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "站点不存在",
+			})
+			return
+		}
+
+		updated, err := logParser.ReclassifyReferers(websiteID)
+		if err != nil {
+			logrus.WithError(err).Error("来源重新分类失败")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("来源重新分类失败: %v", err),
+			})
+			return
+		}
+
+		if statsFactory != nil {
+			statsFactory.ClearCache()
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"updated": updated,
+			"version": enrich.RefererSourcesVersion(),
+		})
+	})
+
 	router.GET("/api/ip-geo/anomaly", func(c *gin.Context) {
 		if statsFactory == nil {
 			c.JSON(http.StatusServiceUnavailable, gin.H{
@@ -531,6 +623,43 @@ func SetupRoutes(
 		c.String(http.StatusOK, buffer.String())
 	})
 
+	// 实时日志（SSE），推送新入库的记录；浏览器 EventSource 无法设置请求头，访问密钥可通过 accessKey 参数传递
+	router.GET("/api/logs/tail", func(c *gin.Context) {
+		if logParser == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "初始化模式暂不支持实时日志",
+			})
+			return
+		}
+		websiteID := strings.TrimSpace(c.Query("id"))
+		if _, ok := config.GetWebsiteByID(websiteID); websiteID == "" || !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "站点不存在",
+			})
+			return
+		}
+		filter, err := ingest.NewTailFilter(
+			websiteID, c.Query("ip"), c.Query("url"), c.Query("status"), c.Query("ua"), c.Query("location"),
+		)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		buffer, _ := strconv.Atoi(strings.TrimSpace(c.Query("buffer")))
+
+		sub, err := logParser.SubscribeTail(filter, buffer)
+		if err != nil {
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		defer sub.Close()
+		streamTail(c, sub)
+	})
+
 	router.GET("/api/logs/export", func(c *gin.Context) {
 		if statsFactory == nil {
 			c.JSON(http.StatusServiceUnavailable, gin.H{
@@ -825,9 +954,10 @@ func SetupRoutes(
 			return
 		}
 		type ingestRequest struct {
-			WebsiteID string   `json:"website_id"`
-			SourceID  string   `json:"source_id"`
-			Lines     []string `json:"lines"`
+			WebsiteID   string   `json:"website_id"`
+			SourceID    string   `json:"source_id"`
+			Lines       []string `json:"lines"`
+			SampleRates []int    `json:"sample_rates"`
 		}
 
 		var req ingestRequest
@@ -858,7 +988,16 @@ func SetupRoutes(
 			return
 		}
 
-		accepted, deduped, err := logParser.IngestLines(websiteID, strings.TrimSpace(req.SourceID), req.Lines)
+		if err := validateSampleRates(req.Lines, req.SampleRates); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		accepted, deduped, err := logParser.IngestLines(
+			websiteID, strings.TrimSpace(req.SourceID), req.Lines, req.SampleRates,
+		)
 		if err != nil {
 			logrus.WithError(err).Error("日志推送解析失败")
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -875,6 +1014,311 @@ func SetupRoutes(
 		})
 	})
 
+	router.POST("/api/ingest/v2/logs", func(c *gin.Context) {
+		if logParser == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "初始化模式暂不支持日志解析",
+			})
+			return
+		}
+
+		var req ingestV2Request
+		if err := decodeIngestV2Body(c.Request, &req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("请求参数错误: %v", err),
+			})
+			return
+		}
+
+		websiteID := strings.TrimSpace(req.WebsiteID)
+		agentID := strings.TrimSpace(req.AgentID)
+		if websiteID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "缺少站点ID",
+			})
+			return
+		}
+		if _, ok := config.GetWebsiteByID(websiteID); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "站点不存在",
+			})
+			return
+		}
+		if agentID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "缺少 agent_id",
+			})
+			return
+		}
+		if req.Seq <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "批次序号无效",
+			})
+			return
+		}
+		if len(req.Lines) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "日志内容为空",
+			})
+			return
+		}
+
+		if err := validateSampleRates(req.Lines, req.SampleRates); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		ack := store.AgentAck{
+			AgentID:   agentID,
+			WebsiteID: websiteID,
+			Seq:       req.Seq,
+			Files:     req.Files,
+		}
+		accepted, duplicate, err := logParser.IngestAgentBatch(
+			websiteID, strings.TrimSpace(req.SourceID), req.Lines, req.SampleRates, ack,
+		)
+		if err != nil {
+			logrus.WithError(err).Error("日志推送解析失败")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("解析失败: %v", err),
+			})
+			return
+		}
+
+		if !duplicate {
+			statsFactory.ClearCache()
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success":   true,
+			"acked_seq": req.Seq,
+			"accepted":  accepted,
+			"duplicate": duplicate,
+		})
+	})
+
+	router.POST("/api/otlp/v1/logs", func(c *gin.Context) {
+		if logParser == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "初始化模式暂不支持日志解析",
+			})
+			return
+		}
+
+		contentType, ok := otlpContentType(c.Request)
+		if !ok {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{
+				"error": "仅支持 application/x-protobuf 或 application/json",
+			})
+			return
+		}
+		req, err := decodeOTLPLogsRequest(c.Request, contentType)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("请求参数错误: %v", err),
+			})
+			return
+		}
+
+		result, err := logParser.IngestOTLPLogs(req)
+		if err != nil {
+			// 503 让 OTLP exporter 重试，已写入的部分由去重缓存拦下
+			logrus.WithError(err).Error("OTLP 日志写入失败")
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": fmt.Sprintf("写入失败: %v", err),
+			})
+			return
+		}
+		if result.Accepted > 0 {
+			statsFactory.ClearCache()
+		}
+
+		body, err := encodeOTLPLogsResponse(result, contentType)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.Data(http.StatusOK, contentType, body)
+	})
+
+	router.GET("/api/ingest/v2/ack", func(c *gin.Context) {
+		if logParser == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "初始化模式暂不支持日志解析",
+			})
+			return
+		}
+		agentID := strings.TrimSpace(c.Query("agent_id"))
+		websiteID := strings.TrimSpace(c.Query("website_id"))
+		if agentID == "" || websiteID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "缺少 agent_id 或 website_id",
+			})
+			return
+		}
+		ack, err := logParser.GetAgentAck(agentID, websiteID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("查询确认序号失败: %v", err),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, ack)
+	})
+
+	router.POST("/api/agents/heartbeat", func(c *gin.Context) {
+		if logParser == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "初始化模式暂不支持 agent 注册",
+			})
+			return
+		}
+		var req agentHeartbeatRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "请求参数错误",
+			})
+			return
+		}
+		agentID := strings.TrimSpace(req.AgentID)
+		if agentID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "缺少 agent_id",
+			})
+			return
+		}
+		info := store.AgentInfo{
+			AgentID:              agentID,
+			Hostname:             strings.TrimSpace(req.Hostname),
+			Version:              strings.TrimSpace(req.Version),
+			HeartbeatInterval:    req.HeartbeatInterval,
+			Paths:                req.Paths,
+			Routes:               req.Routes,
+			AppliedConfigVersion: req.ConfigVersion,
+		}
+		for _, route := range req.Routes {
+			info.LagBytes += route.LagBytes
+			if route.LastPushAt > info.LastPushAt {
+				info.LastPushAt = route.LastPushAt
+			}
+		}
+		saved, err := logParser.RecordAgentHeartbeat(info)
+		if err != nil {
+			logrus.WithError(err).Error("记录 agent 心跳失败")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("记录 agent 心跳失败: %v", err),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"agent_id":       saved.AgentID,
+			"config":         saved.Config,
+			"config_version": saved.ConfigVersion,
+		})
+	})
+
+	router.GET("/api/agents", func(c *gin.Context) {
+		if logParser == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "初始化模式暂不支持 agent 管理",
+			})
+			return
+		}
+		agents, err := logParser.ListAgents()
+		if err != nil {
+			logrus.WithError(err).Error("读取 agent 列表失败")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("读取 agent 列表失败: %v", err),
+			})
+			return
+		}
+		silentAfter := ingest.AgentSilentAfter()
+		c.JSON(http.StatusOK, gin.H{
+			"agents":       buildAgentViews(agents, silentAfter, time.Now()),
+			"silent_after": int64(silentAfter / time.Second),
+		})
+	})
+
+	router.POST("/api/agents/config", func(c *gin.Context) {
+		if logParser == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "初始化模式暂不支持 agent 管理",
+			})
+			return
+		}
+		var req agentConfigRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "请求参数错误",
+			})
+			return
+		}
+		agentID := strings.TrimSpace(req.AgentID)
+		if agentID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "缺少 agent_id",
+			})
+			return
+		}
+		remoteConfig, err := normalizeAgentRemoteConfig(req.Config)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		configVersion, err := logParser.SetAgentConfig(agentID, remoteConfig)
+		if errors.Is(err, store.ErrAgentNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			logrus.WithError(err).Error("保存 agent 远程配置失败")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("保存 agent 远程配置失败: %v", err),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success":        true,
+			"config_version": configVersion,
+		})
+	})
+
+	router.POST("/api/agents/delete", func(c *gin.Context) {
+		if logParser == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": "初始化模式暂不支持 agent 管理",
+			})
+			return
+		}
+		var req agentConfigRequest
+		if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.AgentID) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "请求参数错误",
+			})
+			return
+		}
+		if err := logParser.DeleteAgent(strings.TrimSpace(req.AgentID)); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, store.ErrAgentNotFound) {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+		})
+	})
+
 	// 查询接口
 	router.GET("/api/stats/:type", func(c *gin.Context) {
 		if statsFactory == nil {
@@ -0,0 +1,91 @@
+package web
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/likaia/nginxpulse/internal/store"
+)
+
+// maxIngestBodyBytes 解压后的请求体上限，防止压缩炸弹
+const maxIngestBodyBytes = 64 << 20
+
+// maxSampleRate agent 采样倍数上限
+const maxSampleRate = 1000000
+
+// ingestV2Request v2 推送协议：请求体为 JSON，可用 gzip / zstd 压缩（Content-Encoding）。
+// seq 为 agent 在该站点上单调递增的批次序号，files 为本批次结束时各文件的读取位置；
+// sample_rates 与 lines 一一对应，为 agent 采样时每行代表的请求数，未采样时省略
+type ingestV2Request struct {
+	AgentID     string                  `json:"agent_id"`
+	WebsiteID   string                  `json:"website_id"`
+	SourceID    string                  `json:"source_id"`
+	Seq         int64                   `json:"seq"`
+	Files       []store.AgentFileOffset `json:"files"`
+	Lines       []string                `json:"lines"`
+	SampleRates []int                   `json:"sample_rates,omitempty"`
+}
+
+// validateSampleRates 采样倍数必须与日志行数一致且为正数
+func validateSampleRates(lines []string, sampleRates []int) error {
+	if len(sampleRates) == 0 {
+		return nil
+	}
+	if len(sampleRates) != len(lines) {
+		return errors.New("sample_rates 与 lines 数量不一致")
+	}
+	for _, rate := range sampleRates {
+		if rate < 1 || rate > maxSampleRate {
+			return fmt.Errorf("采样倍数无效: %d", rate)
+		}
+	}
+	return nil
+}
+
+// decodeIngestV2Body 按 Content-Encoding 解压并解析请求体
+func decodeIngestV2Body(r *http.Request, out *ingestV2Request) error {
+	data, err := readIngestBody(r)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// readIngestBody 按 Content-Encoding 解压请求体并限制解压后的大小
+func readIngestBody(r *http.Request) ([]byte, error) {
+	var reader io.Reader = r.Body
+	switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = gz
+	case "zstd":
+		zr, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		reader = zr
+	default:
+		return nil, fmt.Errorf("不支持的压缩格式: %s", encoding)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxIngestBodyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxIngestBodyBytes {
+		return nil, fmt.Errorf("请求体超过 %d 字节", maxIngestBodyBytes)
+	}
+	return data, nil
+}
@@ -113,7 +113,11 @@ func buildLogExportRow(log analytics.LogEntry, lang string) []string {
 		location = "-"
 	}
 
-	requestText := strings.TrimSpace(fmt.Sprintf("%s %s", log.Method, log.URL))
+	requestURL := log.URL
+	if log.RawURL != "" {
+		requestURL = log.RawURL
+	}
+	requestText := strings.TrimSpace(fmt.Sprintf("%s %s", log.Method, requestURL))
 	if requestText == "" {
 		requestText = "-"
 	}
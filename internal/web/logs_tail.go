@@ -0,0 +1,68 @@
+package web
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/likaia/nginxpulse/internal/ingest"
+)
+
+const (
+	tailHeartbeatInterval = 15 * time.Second
+	tailDroppedInterval   = time.Second
+)
+
+// streamTail 以 SSE 推送订阅到的日志：每条记录一个 log 事件；
+// 有记录被丢弃时发送 dropped 事件（累计值），空闲时定期发送注释行保持连接
+func streamTail(c *gin.Context, sub *ingest.TailSubscription) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(tailHeartbeatInterval)
+	defer heartbeat.Stop()
+	droppedTicker := time.NewTicker(tailDroppedInterval)
+	defer droppedTicker.Stop()
+
+	var reported uint64
+	ctx := c.Request.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case record, ok := <-sub.Records():
+			if !ok {
+				return
+			}
+			c.SSEvent("log", record)
+			// 一次取完已缓冲的记录再刷新，减少小包
+			for drained := false; !drained; {
+				select {
+				case record, ok = <-sub.Records():
+					if !ok {
+						c.Writer.Flush()
+						return
+					}
+					c.SSEvent("log", record)
+				default:
+					drained = true
+				}
+			}
+			c.Writer.Flush()
+		case <-droppedTicker.C:
+			if dropped := sub.Dropped(); dropped != reported {
+				reported = dropped
+				c.SSEvent("dropped", gin.H{"dropped": dropped})
+				c.Writer.Flush()
+			}
+		case <-heartbeat.C:
+			if _, err := c.Writer.WriteString(": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
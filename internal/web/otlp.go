@@ -0,0 +1,68 @@
+package web
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/likaia/nginxpulse/internal/ingest"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpContentProtobuf = "application/x-protobuf"
+	otlpContentJSON     = "application/json"
+)
+
+// otlpContentType 返回请求使用的编码，OTLP/HTTP 只允许 protobuf 与 JSON，响应需与请求一致
+func otlpContentType(r *http.Request) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", false
+	}
+	switch mediaType {
+	case otlpContentProtobuf, otlpContentJSON:
+		return mediaType, true
+	}
+	return "", false
+}
+
+// decodeOTLPLogsRequest 解析 OTLP/HTTP 日志导出请求，JSON 编码忽略未知字段
+func decodeOTLPLogsRequest(r *http.Request, contentType string) (*collogspb.ExportLogsServiceRequest, error) {
+	data, err := readIngestBody(r)
+	if err != nil {
+		return nil, err
+	}
+	req := &collogspb.ExportLogsServiceRequest{}
+	if contentType == otlpContentJSON {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, req)
+	} else {
+		err = proto.Unmarshal(data, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// encodeOTLPLogsResponse 按请求的编码返回 ExportLogsServiceResponse，有拒绝的日志时带上 partial_success
+func encodeOTLPLogsResponse(result ingest.OTLPResult, contentType string) ([]byte, error) {
+	resp := NewOTLPLogsResponse(result)
+	if contentType == otlpContentJSON {
+		return protojson.Marshal(resp)
+	}
+	return proto.Marshal(resp)
+}
+
+// NewOTLPLogsResponse 将处理结果转换为 OTLP 响应，HTTP 与 gRPC 接收端共用
+func NewOTLPLogsResponse(result ingest.OTLPResult) *collogspb.ExportLogsServiceResponse {
+	resp := &collogspb.ExportLogsServiceResponse{}
+	if result.Rejected > 0 {
+		resp.PartialSuccess = &collogspb.ExportLogsPartialSuccess{
+			RejectedLogRecords: int64(result.Rejected),
+			ErrorMessage:       result.Message,
+		}
+	}
+	return resp
+}
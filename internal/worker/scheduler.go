@@ -97,6 +97,27 @@ func ExecutePeriodicTasks(parser *ingest.LogParser, interval time.Duration) {
 			logrus.Infof("IP 归属地回填完成: %d 个 IP", processed)
 		}
 	}
+
+	{ // 6 来源分类回填
+		classified := parser.ClassifyPendingReferers()
+		if classified > 0 {
+			logrus.Infof("来源分类回填完成: %d 个来源", classified)
+		}
+	}
+
+	{ // 7 流量异常检测
+		detected := parser.DetectTrafficAnomalies()
+		if detected > 0 {
+			logrus.Infof("流量异常检测完成: 新发现 %d 个异常", detected)
+		}
+	}
+
+	{ // 8 agent 心跳检查
+		silent := parser.CheckSilentAgents()
+		if silent > 0 {
+			logrus.Warnf("agent 心跳检查完成: %d 个 agent 失联", silent)
+		}
+	}
 }
 
 func backfillBudget(interval time.Duration) (time.Duration, int64) {
@@ -1,6 +1,7 @@
 import type { AxiosResponse } from 'axios';
 import client from './client';
 import type {
+  AgentListResponse,
   AppStatusResponse,
   ApiResponse,
   ConfigPayload,
@@ -220,6 +221,26 @@ export const markSystemNotificationsRead = async (options: {
   });
 };
 
+export const fetchAgents = async (): Promise<AgentListResponse> => {
+  const response = await client.get<ApiResponse<AgentListResponse>>('/api/agents');
+  return response.data;
+};
+
+export const saveAgentConfig = async (
+  agentId: string,
+  config: Record<string, unknown> | null
+): Promise<{ config_version: number }> => {
+  const response = await client.post<ApiResponse<{ config_version: number }>>('/api/agents/config', {
+    agent_id: agentId,
+    config,
+  });
+  return response.data;
+};
+
+export const deleteAgent = async (agentId: string): Promise<void> => {
+  await client.post<ApiResponse<{ success: boolean }>>('/api/agents/delete', { agent_id: agentId });
+};
+
 export const fetchLogs = (
   websiteId: string,
   page: number,
@@ -227,4 +227,41 @@ export interface SystemNotificationListResponse {
   unread_count?: number;
 }
 
+export interface AgentRouteStatus {
+  website_id: string;
+  source_id: string;
+  files: number;
+  lag_bytes: number;
+  pending_lines: number;
+  spool_bytes: number;
+  failures: number;
+  dropped_lines?: number;
+  sampled_out_lines?: number;
+  last_push_at?: number;
+  last_error?: string;
+}
+
+export interface AgentInfo {
+  agent_id: string;
+  hostname: string;
+  version: string;
+  heartbeat_interval: number;
+  paths: string[] | null;
+  routes: AgentRouteStatus[] | null;
+  lag_bytes: number;
+  last_push_at: number;
+  config?: Record<string, any> | null;
+  config_version: number;
+  applied_config_version: number;
+  registered_at: number;
+  last_seen_at: number;
+  silent: boolean;
+  online: boolean;
+}
+
+export interface AgentListResponse {
+  agents: AgentInfo[];
+  silent_after: number;
+}
+
 export type ApiResponse<T> = T;
@@ -9,6 +9,7 @@ const enUS = {
       daily: 'Daily',
       realtime: 'Realtime',
       logs: 'Logs',
+      agents: 'Agents',
       setup: 'Settings',
     },
     sidebar: {
@@ -17,6 +18,7 @@ const enUS = {
       dailyHint: 'Daily aggregation with trend insights',
       realtimeHint: 'Realtime behavior trends in window',
       logsHint: 'Filter and paginate access logs',
+      agentsHint: 'Agent health and remote configuration',
       setupHint: 'Adjust websites, database, and system settings',
       language: 'Language',
     },
@@ -367,6 +369,33 @@ const enUS = {
     viewCount: 'Views',
     entryCount: 'Entries',
   },
+  agents: {
+    title: 'Agents',
+    subtitle: 'Health · Push lag · Remote configuration',
+    empty: 'No agents registered yet. Agents register automatically once heartbeatInterval is enabled.',
+    silentAfter: 'Agents silent for more than {value}s are marked offline',
+    agentId: 'Agent ID',
+    hostname: 'Hostname',
+    version: 'Version',
+    online: 'Online',
+    offline: 'Silent',
+    lastSeen: 'Last heartbeat',
+    lastPush: 'Last push',
+    lag: 'Unread',
+    routes: 'Websites',
+    paths: 'Files',
+    configVersion: 'Config version',
+    configPending: 'pending',
+    editConfig: 'Remote config',
+    delete: 'Delete',
+    deleteConfirm: 'Delete the record of agent {name}? A running agent registers again on its next heartbeat.',
+    configTitle: 'Remote config · {name}',
+    configHint: 'Only websiteID, sourceID, paths, inputs, filters and interval/batch settings are supported. Leave empty to clear the remote config and use the local one.',
+    configInvalid: 'Config must be a JSON object',
+    save: 'Save',
+    routeError: 'Last error: {value}',
+    filtered: '{dropped} lines dropped · {sampled} sampled out',
+  },
   daily: {
     title: 'Daily Report',
     subtitle: 'Daily overview · Key metrics · Behavior insights',
@@ -9,6 +9,7 @@ const zhCN = {
       daily: '数据日报',
       realtime: '实时',
       logs: '访问明细',
+      agents: 'Agent',
       setup: '系统配置',
     },
     sidebar: {
@@ -17,6 +18,7 @@ const zhCN = {
       dailyHint: '按天聚合统计并提供趋势解读',
       realtimeHint: '关注窗口内实时行为趋势',
       logsHint: '按条件过滤并分页浏览',
+      agentsHint: '采集 agent 在线状态与远程配置',
       setupHint: '修改站点、数据库与系统参数',
       language: '语言',
     },
@@ -367,6 +369,33 @@ const zhCN = {
     viewCount: '查看次数',
     entryCount: '入口次数',
   },
+  agents: {
+    title: 'Agent 管理',
+    subtitle: '在线状态 · 推送延迟 · 远程配置',
+    empty: '暂无已注册的 agent，agent 配置 heartbeatInterval 后会自动注册',
+    silentAfter: '超过 {value} 秒未上报心跳视为失联',
+    agentId: 'Agent ID',
+    hostname: '主机名',
+    version: '版本',
+    online: '在线',
+    offline: '失联',
+    lastSeen: '最近心跳',
+    lastPush: '最近推送',
+    lag: '未读取',
+    routes: '站点',
+    paths: '文件',
+    configVersion: '配置版本',
+    configPending: '待生效',
+    editConfig: '远程配置',
+    delete: '删除',
+    deleteConfirm: '确定删除 agent {name} 的记录吗？agent 仍在运行时会在下次心跳时重新注册。',
+    configTitle: '远程配置 · {name}',
+    configHint: '仅支持 websiteID、sourceID、paths、inputs、filters 以及各类间隔与批量参数；留空表示清除远程配置，使用 agent 本地配置。',
+    configInvalid: '配置必须是 JSON 对象',
+    save: '保存',
+    routeError: '最近错误：{value}',
+    filtered: '已过滤 {dropped} 行 · 采样省略 {sampled} 行',
+  },
   daily: {
     title: '数据日报',
     subtitle: '每日概览 · 关键指标 · 行为洞察',
@@ -4,6 +4,7 @@ import DailyPage from '@/pages/DailyPage.vue';
 import RealtimePage from '@/pages/RealtimePage.vue';
 import LogsPage from '@/pages/LogsPage.vue';
 import SetupPage from '@/pages/SetupPage.vue';
+import AgentsPage from '@/pages/AgentsPage.vue';
 
 const router = createRouter({
   history: createWebHistory(),
@@ -48,6 +49,16 @@ const router = createRouter({
         mainClass: 'logs-page',
       },
     },
+    {
+      path: '/agents',
+      name: 'agents',
+      component: AgentsPage,
+      meta: {
+        sidebarLabelKey: 'app.menu.agents',
+        sidebarHintKey: 'app.sidebar.agentsHint',
+        mainClass: 'agents-page',
+      },
+    },
     {
       path: '/settings',
       name: 'settings',